@@ -65,8 +65,10 @@ import (
 
 	context "golang.org/x/net/context"
 
+	arbiter "github.com/iti/pbconf/lib/pbarbiter"
 	logging "github.com/iti/pbconf/lib/pblogger"
 	"github.com/iti/pbconf/lib/pbtranslate/driver"
+	trans "github.com/iti/pbconf/lib/pbtransport"
 )
 
 // driver provides a method to get a logging object
@@ -219,7 +221,15 @@ EcexuteConfig()
 func (d *driverService) ExecuteConfig(ctx context.Context, commands *driver.CommandSeq) (*driver.BoolReply, error) {
 	log.Debug("ExecuteConfig()")
 
-	transport, err := driver.ConnectToDevice(d.authFn, commands.Devid.Id, d.Name())
+	release, err := driver.AcquireDevice(ctx, d.Client(), commands.Devid.Id, d.Name(),
+		"ExecuteConfig", arbiter.Exclusive, arbiter.PriorityConfig)
+	if err != nil {
+		log.Info("Failed to acquire device: %s", err.Error())
+		return driver.ReplyFalse(err)
+	}
+	defer release()
+
+	transport, err := driver.ConnectToDeviceContext(ctx, d.authFn, commands.Devid.Id, d.Name())
 	log.Debug("HERE")
 	if err != nil {
 		log.Info("Failed to connect: %s", err.Error())
@@ -238,7 +248,11 @@ func (d *driverService) ExecuteConfig(ctx context.Context, commands *driver.Comm
 		// Need to be able to check output from service start
 		buf := append([]byte(cmd.Command), make([]byte, 30)...)
 
-		_, err := transport.Read(buf)
+		_, err := trans.ReadContext(ctx, transport, buf)
+		if ctx.Err() != nil {
+			log.Info("Command <<%s>> abandoned: %s", cmd.Command, ctx.Err().Error())
+			return driver.ReplyFalse(ctx.Err())
+		}
 		if err != nil {
 			// check that service was already running
 			log.Debug("returned output: %s", string(buf))
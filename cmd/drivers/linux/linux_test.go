@@ -0,0 +1,108 @@
+package main
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	sim "github.com/iti/pbconf/lib/pbsimulator"
+	trans "github.com/iti/pbconf/lib/pbtranslate"
+	"github.com/iti/pbconf/lib/pbtranslate/driver"
+)
+
+func begin(t *testing.T, name string) {
+	fmt.Printf("##################### Begin Linux::%s #####################\n", name)
+}
+
+func end(t *testing.T, name string) {
+	fmt.Printf("###################### End Linux::%s ######################\n", name)
+}
+
+func TestExecuteConfig(t *testing.T) {
+	begin(t, "TestExecuteConfig")
+	defer end(t, "TestExecuteConfig")
+
+	dir, err := ioutil.TempDir("", "linux")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	node, err := sim.NewNode(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Close()
+
+	host := sim.NewDevice(sim.Linux())
+	defer host.Close()
+	sshAddr, err := host.ServeSSH("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := node.AddDevice("host1", map[string]string{
+		"drivertransport": "ssh",
+		"driverlocation":  sshAddr,
+		"drivertimeout":   "30s",
+	}, map[string]string{
+		"driver":   "linux",
+		"username": "root",
+		"password": "root",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log = driver.GetLogger("linux")
+	if err = node.StartDriver(&driverService{name: "linux"}); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := "set service ssh off\n" +
+		"set service cron on\n" +
+		"service vsftpd port 2121\n" +
+		"set password root s3cret\n"
+	if err = trans.ExecuteConfig(node.Config, id, strings.NewReader(cfg)); err != nil {
+		t.Fatal(err)
+	}
+
+	if s := host.Value("service.ssh"); s != "stopped" {
+		t.Errorf("Expected ssh to be stopped, it is %s", s)
+	}
+	if o, ok := host.Files.Get("/etc/init/ssh.override"); !ok || string(o) != "manual\n" {
+		t.Errorf("Expected ssh to be disabled at boot, override is %q", o)
+	}
+	// cron was already running, which the driver tolerates
+	if s := host.Value("service.cron"); s != "running" {
+		t.Errorf("Expected cron to be running, it is %s", s)
+	}
+	if f, _ := host.Files.Get("/etc/default/vsftpd"); !strings.Contains(string(f), "port=2121\n") {
+		t.Errorf("Expected vsftpd option to be set, got %q", f)
+	}
+
+	if pw, _ := host.Password("root"); pw != "s3cret" {
+		t.Errorf("Root password not changed, device history: %v", host.History())
+	}
+	if pw, err := node.CME.GetMeta("host1", "password"); err != nil || pw != "s3cret" {
+		t.Errorf("Expected password meta to be updated, got %q (%v)", pw, err)
+	}
+}
@@ -17,6 +17,7 @@ package main
 ***********************************************************************/
 
 import (
+	arbiter "github.com/iti/pbconf/lib/pbarbiter"
 	logging "github.com/iti/pbconf/lib/pblogger"
 	driver "github.com/iti/pbconf/lib/pbtranslate/driver"
 	trans "github.com/iti/pbconf/lib/pbtransport"
@@ -200,7 +201,15 @@ func (d *driverService) transFTP(k, v string) string {
 func (d *driverService) ExecuteConfig(ctx context.Context, commands *driver.CommandSeq) (*driver.BoolReply, error) {
 	log.Debug("ExecuteConfig()")
 
-	transport, err := driver.ConnectToDevice(d.authFn, commands.Devid.Id, d.Name())
+	release, err := driver.AcquireDevice(ctx, d.Client(), commands.Devid.Id, d.Name(),
+		"ExecuteConfig", arbiter.Exclusive, arbiter.PriorityConfig)
+	if err != nil {
+		log.Info("Failed to acquire device: %s", err.Error())
+		return driver.ReplyFalse(err)
+	}
+	defer release()
+
+	transport, err := driver.ConnectToDeviceContext(ctx, d.authFn, commands.Devid.Id, d.Name())
 	if err != nil {
 		log.Info("Failed to connect: %s", err.Error())
 		return driver.ReplyFalse(err)
@@ -217,7 +226,7 @@ func (d *driverService) ExecuteConfig(ctx context.Context, commands *driver.Comm
 
 	if _, ok := transport.(*trans.FTP); ok {
 		// Get alt transport and set passtrans
-		passtrans, e = d.altTransport(commands.Devid.Id)
+		passtrans, e = d.altTransport(ctx, commands.Devid.Id)
 		if e != nil {
 			return driver.ReplyFalse(err)
 		}
@@ -227,13 +236,13 @@ func (d *driverService) ExecuteConfig(ctx context.Context, commands *driver.Comm
 
 	if _, ok := transport.(*trans.Telnet); ok {
 		// get alt transport and set configtrans
-		configtrans, e = d.altTransport(commands.Devid.Id)
+		configtrans, e = d.altTransport(ctx, commands.Devid.Id)
 		if e != nil {
 			return driver.ReplyFalse(err)
 		}
 	}
 
-	cfgfile, err := configtrans.RecvFile(fmt.Sprintf("%sSETTINGS/SET_P5.TXT", filePrefix))
+	cfgfile, err := trans.RecvFileContext(ctx, configtrans, fmt.Sprintf("%sSETTINGS/SET_P5.TXT", filePrefix))
 	if err != nil {
 		if err != io.EOF {
 			return driver.ReplyFalse(err)
@@ -360,11 +369,16 @@ func (d *driverService) ExecuteConfig(ctx context.Context, commands *driver.Comm
 			}
 
 			log.Debug("Not password command: %s", cmd.Command)
+			// Settings lines are "NAME","value" or NAME=value
+			name := cmd.Command
+			if i := strings.IndexAny(name, ",="); i >= 0 {
+				name = name[:i+1]
+			}
+			mux.Lock()
+			defer mux.Unlock()
 			for i, l := range cfgLines {
-				if strings.HasPrefix(l, strings.Split(cmd.Command, ",")[0]) {
-					mux.Lock()
+				if strings.HasPrefix(l, name) {
 					cfgLines[i] = fmt.Sprintf(cmd.Command)
-					mux.Unlock()
 					return
 				}
 			}
@@ -379,7 +393,7 @@ func (d *driverService) ExecuteConfig(ctx context.Context, commands *driver.Comm
 	}
 	_ = obuf
 
-	if err := configtrans.SendFile(
+	if err := trans.SendFileContext(ctx, configtrans,
 		fmt.Sprintf("%sSETTINGS/SET_P5.TXT", filePrefix), obuf); err != nil {
 		log.Error(err.Error())
 		return driver.ReplyFalse(err)
@@ -388,10 +402,10 @@ func (d *driverService) ExecuteConfig(ctx context.Context, commands *driver.Comm
 	return driver.ReplyTrue(nil)
 }
 
-func (d *driverService) altTransport(id int64) (trans.ClientTransport, error) {
+func (d *driverService) altTransport(ctx context.Context, id int64) (trans.ClientTransport, error) {
 	var transport trans.ClientTransport
 
-	n, err := d.Client().GetMeta(context.Background(), &driver.KVRequest{
+	n, err := d.Client().GetMeta(ctx, &driver.KVRequest{
 		Devid: &driver.DeviceID{Id: id},
 		Key:   "alttransport",
 	})
@@ -399,7 +413,7 @@ func (d *driverService) altTransport(id int64) (trans.ClientTransport, error) {
 		return nil, err
 	}
 
-	l, err := d.Client().GetMeta(context.Background(), &driver.KVRequest{
+	l, err := d.Client().GetMeta(ctx, &driver.KVRequest{
 		Devid: &driver.DeviceID{Id: id},
 		Key:   "altlocation",
 	})
@@ -412,7 +426,7 @@ func (d *driverService) altTransport(id int64) (trans.ClientTransport, error) {
 		return nil, err
 	}
 
-	err = transport.Dial(id, l.Value)
+	err = trans.DialContext(ctx, transport, id, l.Value)
 	if err != nil {
 		return nil, err
 	}
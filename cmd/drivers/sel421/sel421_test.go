@@ -0,0 +1,124 @@
+package main
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	sim "github.com/iti/pbconf/lib/pbsimulator"
+	trans "github.com/iti/pbconf/lib/pbtranslate"
+	driver "github.com/iti/pbconf/lib/pbtranslate/driver"
+)
+
+func begin(t *testing.T, name string) {
+	fmt.Printf("##################### Begin SEL421::%s #####################\n", name)
+}
+
+func end(t *testing.T, name string) {
+	fmt.Printf("###################### End SEL421::%s ######################\n", name)
+}
+
+func TestExecuteConfig(t *testing.T) {
+	begin(t, "TestExecuteConfig")
+	defer end(t, "TestExecuteConfig")
+
+	dir, err := ioutil.TempDir("", "sel421")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	node, err := sim.NewNode(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Close()
+
+	relay := sim.NewDevice(sim.SEL421())
+	defer relay.Close()
+	ftpAddr, err := relay.ServeFTP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	telnetAddr, err := relay.ServeTelnet("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := node.AddDevice("relay1", map[string]string{
+		"drivertransport": "ftp",
+		"driverlocation":  ftpAddr,
+		"drivertimeout":   "30s",
+	}, map[string]string{
+		"driver":       "sel421",
+		"alttransport": "telnet",
+		"altlocation":  telnetAddr,
+		"l1password":   sim.SEL421Level1Password,
+		"l2password":   sim.SEL421Level2Password,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log = driver.GetLogger("sel421")
+	if err = node.StartDriver(&driverService{name: "sel421"}); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := "set service ETELNET off\n" +
+		"service FTP FTPIDLE 15\n" +
+		"set password 1 NEWPASS\n"
+	if err = trans.ExecuteConfig(node.Config, id, strings.NewReader(cfg)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The settings file is written back whole, with the new settings
+	settings, _ := relay.Files.Get(sim.SEL421Port5)
+	for _, want := range []string{"[P5]\r\n", "IPADDR,\"192.168.1.2/24\"\r\n", "\"EFTPSERV\",\"Y\"\r\n",
+		"\"ETELNET\",\"N\"\r\n", "FTPIDLE=15\r\n"} {
+		if !strings.Contains(string(settings), want) {
+			t.Errorf("Settings file is missing %q:\n%s", want, settings)
+		}
+	}
+	for _, old := range []string{"\"ETELNET\",\"Y\"", "FTPIDLE=5\r\n"} {
+		if strings.Contains(string(settings), old) {
+			t.Errorf("Settings file still has %q:\n%s", old, settings)
+		}
+	}
+
+	// The password is changed over the telnet session, which the driver
+	// does not wait on
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if pw, _ := relay.Password("1AC"); pw == "NEWPASS" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Level 1 password not changed, device history: %v", relay.History())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if pw, err := node.CME.GetMeta("relay1", "l1password"); err != nil || pw != "NEWPASS" {
+		t.Errorf("Expected l1password meta to be updated, got %q (%v)", pw, err)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"net"
+	"path/filepath"
+	"sync"
+	"time"
+
+	arbiter "github.com/iti/pbconf/lib/pbarbiter"
+	driver "github.com/iti/pbconf/lib/pbtranslate/driver"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// How long a user waits in the queue for a busy device
+var sessionWait = 30 * time.Second
+
+var engine driver.EngineClient
+var engineOnce sync.Once
+var engineErr error
+
+// engineClient connects to the translation engine of the local node, which
+// hosts the device arbiter
+func engineClient() (driver.EngineClient, error) {
+	engineOnce.Do(func() {
+		sock := filepath.Join(cfg.Translation.SocketDir, "engine.sock")
+		conn, err := grpc.Dial(sock, grpc.WithInsecure(), grpc.WithDialer(
+			func(addr string, t time.Duration) (net.Conn, error) {
+				return net.Dial("unix", addr)
+			}),
+		)
+		if err != nil {
+			engineErr = err
+			return
+		}
+		engine = driver.NewEngineClient(conn)
+	})
+	return engine, engineErr
+}
+
+// acquireDevice takes an exclusive lease on the device for an interactive
+// session, waiting up to sessionWait for it to become free.  The lease is
+// renewed for as long as the session lasts.
+func acquireDevice(id int64) (func(), error) {
+	client, err := engineClient()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sessionWait)
+	defer cancel()
+	return driver.AcquireDevice(ctx, client, id, "Broker", "Interactive session", arbiter.Exclusive, arbiter.PriorityNormal)
+}
@@ -22,7 +22,10 @@ import (
 	"strings"
 
 	pbdb "github.com/iti/pbconf/lib/pbdatabase"
+	driver "github.com/iti/pbconf/lib/pbtranslate/driver"
 	pbtransport "github.com/iti/pbconf/lib/pbtransport"
+
+	"golang.org/x/net/context"
 )
 
 func direct(name string, srv io.ReadWriter, db pbdb.AppDatabase) {
@@ -52,17 +55,73 @@ func direct(name string, srv io.ReadWriter, db pbdb.AppDatabase) {
 	// Additional transports (which implement the pbtransport.ClientTransport
 	// interface) can be added to this switch statement
 	case transportType == "telnet":
-		trans = pbtransport.NewTelnet("Broker")
+		t := pbtransport.NewTelnet("Broker").(*pbtransport.Telnet)
+		t.SetPrompts(pbtransport.TelnetPromptsFromConfig(device.ConfigValue, "broker"))
+		trans = t
+	case strings.HasSuffix(transportType, pbtransport.HopSeparator+"telnet"):
+		// Telnet through one or more SSH jump hosts
+		tc, err := pbtransport.NewChain(transportType, "Broker")
+		if err != nil {
+			log.Error(err.Error())
+			return
+		}
+		c := tc.(*pbtransport.Chain)
+		c.Final().(*pbtransport.Telnet).SetPrompts(pbtransport.TelnetPromptsFromConfig(device.ConfigValue, "broker"))
+		trans = c
 	default:
 		log.Error(fmt.Sprintf("Unrecognised Transport: %v", transportType))
 		return
 	}
 
+	// Devices may only allow one session, wait our turn
+	release, err := acquireDevice(device.Id)
+	if err != nil {
+		log.Error("Could not acquire device %s: %s", device.Name, err.Error())
+		srv.Write([]byte(fmt.Sprintf("Device %s is busy, try again later\r\n", device.Name)))
+		return
+	}
+	defer release()
+
+	// Log in on behalf of the user when the device has broker credentials
+	if _, ok := device.ConfigValue("brokerusername"); ok {
+		trans.SetCredentialFn(brokerCredentials(&device))
+	}
+
 	err = trans.Dial(device.Id, location)
 	if err != nil {
+		if _, ok := err.(pbtransport.ErrAuthFailed); ok {
+			log.Error("Authentication to device %s failed: %s", device.Name, err.Error())
+			return
+		}
 		log.Error("Failed to connect to device")
 		return
 	}
 
 	trans.Interact(srv)
 }
+
+/*
+brokerCredentials logs in as the device's brokerusername.  The password is
+not kept in the device config items but in the device metadata of the CME,
+under brokerpassword, and is fetched from the translation engine the way
+drivers fetch theirs.
+*/
+func brokerCredentials(device *pbdb.PbDevice) pbtransport.CredentialFn {
+	return func(id int64) (string, string, error) {
+		u, _ := device.ConfigValue("brokerusername")
+		client, err := engineClient()
+		if err != nil {
+			return "", "", err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), sessionWait)
+		defer cancel()
+		p, err := client.GetMeta(ctx, &driver.KVRequest{
+			Devid: &driver.DeviceID{Id: id},
+			Key:   "brokerpassword",
+		})
+		if err != nil {
+			return "", "", err
+		}
+		return u, p.Value, nil
+	}
+}
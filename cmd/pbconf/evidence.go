@@ -0,0 +1,58 @@
+package main
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"os"
+
+	arbiter "github.com/iti/pbconf/lib/pbarbiter"
+	audit "github.com/iti/pbconf/lib/pbaudit"
+	change "github.com/iti/pbconf/lib/pbchange"
+	database "github.com/iti/pbconf/lib/pbdatabase"
+)
+
+// evidenceFlags select the audit evidence written by -evidence
+type evidenceFlags struct {
+	file    string
+	from    string
+	to      string
+	devices string
+	nodes   string
+}
+
+/*
+exportEvidence writes an audit evidence package to a file and returns.
+Broker sessions are only known to the running node, so a package made from
+the command line has none; the evidence API of the node includes them.
+*/
+func exportEvidence(f evidenceFlags, db database.AppDatabase, engine *change.CMEngine) error {
+	s, err := audit.ParseScope(f.from, f.to, f.devices, f.nodes)
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(f.file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = audit.Export(out, db, engine, arbiter.New(), *s); err != nil {
+		out.Close()
+		os.Remove(f.file)
+		return err
+	}
+	return out.Close()
+}
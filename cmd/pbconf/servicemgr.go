@@ -24,11 +24,14 @@ import (
 
 	api "github.com/iti/pbconf/lib/pbapi"
 	change "github.com/iti/pbconf/lib/pbchange"
+	compliance "github.com/iti/pbconf/lib/pbcompliance"
 	"github.com/iti/pbconf/lib/pbconfig"
 	database "github.com/iti/pbconf/lib/pbdatabase"
 	global "github.com/iti/pbconf/lib/pbglobal"
 	logging "github.com/iti/pbconf/lib/pblogger"
+	scheduler "github.com/iti/pbconf/lib/pbscheduler"
 	trans "github.com/iti/pbconf/lib/pbtranslate"
+	webhook "github.com/iti/pbconf/lib/pbwebhook"
 	webui "github.com/iti/pbconf/lib/pbwebui"
 
 	"golang.org/x/net/context"
@@ -38,11 +41,22 @@ func main() {
 
 	var cfgFile string
 	var cfgLogLevel string
+	var evidence evidenceFlags
 
 	flag.StringVar(&cfgFile, "c", "pbconf.conf",
 		"PBCONF config file")
 	flag.StringVar(&cfgLogLevel, "l", "",
 		"Log level ([CRITICAL|ERROR|WARNING|NOTICE|INFO|DEBUG)")
+	flag.StringVar(&evidence.file, "evidence", "",
+		"Write an audit evidence package to this file and exit")
+	flag.StringVar(&evidence.from, "from", "",
+		"Start of the period of the evidence (RFC 3339)")
+	flag.StringVar(&evidence.to, "to", "",
+		"End of the period of the evidence (RFC 3339)")
+	flag.StringVar(&evidence.devices, "devices", "",
+		"Comma separated devices the evidence covers, all if none and no -nodes")
+	flag.StringVar(&evidence.nodes, "nodes", "",
+		"Comma separated nodes whose devices the evidence covers")
 	flag.Parse()
 
 	cfg, err := pbconfig.NewConfig(cfgFile)
@@ -81,6 +95,20 @@ func main() {
 
 	_ = cmEngine
 
+	if evidence.file != "" {
+		if cmEngine == nil {
+			log.Error("Evidence can only be exported with the internal change management engine")
+			return
+		}
+		db.LoadSchema()
+		if err = exportEvidence(evidence, db, cmEngine); err != nil {
+			log.Error("Could not export evidence: %s", err.Error())
+			return
+		}
+		log.Notice("Wrote evidence to %s", evidence.file)
+		return
+	}
+
 	log.Info("Loading API manager")
 	go api.StartAPIhandler(&cfg.WebAPI, db)
 
@@ -132,6 +160,21 @@ func main() {
 	db.LoadSchema()
 	db.LoadRootNode(global.RootNode)
 
+	log.Info("Starting Scheduler")
+	if cmEngine != nil {
+		scheduler.Get().Start(db)
+	}
+
+	log.Info("Starting Webhooks")
+	if cmEngine != nil {
+		webhook.Get().Start()
+	}
+
+	log.Info("Starting Compliance Scanner")
+	if cmEngine != nil {
+		compliance.Get().Start(db)
+	}
+
 	hbDoneChan := make(chan bool)
 	heartbeatComm := NewHeartbeatComm(db, cfg.WebAPI.LogLevel)
 	heartbeatComm.Start(hbDoneChan) //signaling true on the hbDoneChan will stop the heartbeat
@@ -20,6 +20,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	change "github.com/iti/pbconf/lib/pbchange"
@@ -183,6 +184,11 @@ func (hb *Heartbeat) onReportTick(timeout time.Duration) {
 		reportCfgItem.ConfigItem.Value = time.Now().Format(time.RFC1123)
 		reportCfgItem.CreateOrUpdate(hb.db)
 		global.UpstreamConnectedStatus = true
+		if path := resp.Header.Get("X-Pbconf-Node-Path"); path != "" {
+			if err = nodeComm.SetUpstreamPath(strings.Split(path, "/")); err != nil {
+				hb.log.Debug("onReportTick::Could not record the path of the upstream node: %s", err.Error())
+			}
+		}
 		//check on policy status to see if we need to get updated policy (any policy change will trigger getting all policies)
 		commitId := resp.Header.Get("X-Pbconf-Policy-LastCommitId")
 		if commitId != hb.commitId {
@@ -26,7 +26,12 @@ import (
 
 	mux "github.com/gorilla/mux"
 
+	sessionsAPI "github.com/iti/pbconf/lib/pbarbiter"
+	auditAPI "github.com/iti/pbconf/lib/pbaudit"
+	bundleAPI "github.com/iti/pbconf/lib/pbbundle"
+	complianceAPI "github.com/iti/pbconf/lib/pbcompliance"
 	pbconfig "github.com/iti/pbconf/lib/pbconfig"
+	conflictAPI "github.com/iti/pbconf/lib/pbconflict"
 	database "github.com/iti/pbconf/lib/pbdatabase"
 	devAPI "github.com/iti/pbconf/lib/pbdevice"
 	"github.com/iti/pbconf/lib/pbglobal"
@@ -36,6 +41,11 @@ import (
 	nodeAPI "github.com/iti/pbconf/lib/pbnode"
 	policyAPI "github.com/iti/pbconf/lib/pbpolicy"
 	reportsAPI "github.com/iti/pbconf/lib/pbreports"
+	reviewAPI "github.com/iti/pbconf/lib/pbreview"
+	scheduleAPI "github.com/iti/pbconf/lib/pbscheduler"
+	searchAPI "github.com/iti/pbconf/lib/pbsearch"
+	transactionsAPI "github.com/iti/pbconf/lib/pbtransactions"
+	webhookAPI "github.com/iti/pbconf/lib/pbwebhook"
 )
 
 var server *APIServer
@@ -97,6 +107,16 @@ func StartAPIhandler(cfg *pbconfig.CfgWebAPI, db database.AppDatabase) {
 	server.AddHandler(nodeAPI.NewAPIHandler(apiLogLevel, db), rootRouter)
 	server.AddHandler(policyAPI.NewAPIHandler(apiLogLevel, db), rootRouter)
 	server.AddHandler(reportsAPI.NewAPIHandler(apiLogLevel, db), rootRouter)
+	server.AddHandler(sessionsAPI.NewAPIHandler(apiLogLevel, db), rootRouter)
+	server.AddHandler(reviewAPI.NewAPIHandler(apiLogLevel, db), rootRouter)
+	server.AddHandler(transactionsAPI.NewAPIHandler(apiLogLevel, db), rootRouter)
+	server.AddHandler(scheduleAPI.NewAPIHandler(apiLogLevel, db), rootRouter)
+	server.AddHandler(webhookAPI.NewAPIHandler(apiLogLevel, db), rootRouter)
+	server.AddHandler(bundleAPI.NewAPIHandler(apiLogLevel, db), rootRouter)
+	server.AddHandler(conflictAPI.NewAPIHandler(apiLogLevel, db), rootRouter)
+	server.AddHandler(searchAPI.NewAPIHandler(apiLogLevel, db), rootRouter)
+	server.AddHandler(auditAPI.NewAPIHandler(apiLogLevel, db), rootRouter)
+	server.AddHandler(complianceAPI.NewAPIHandler(apiLogLevel, db), rootRouter)
 
 	// This route must be last in the list
 	server.AddHandler(namespaceAPI.NewAPIHandler(apiLogLevel, db), rootRouter)
@@ -0,0 +1,475 @@
+package arbiter
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+/*
+Package arbiter serialises access to devices across the node.
+
+Many legacy devices only allow a single session, and misbehave when the
+broker, a translation driver and anything else open them at once.  Every
+consumer of a device transport acquires a lease from the node wide
+Arbiter before dialing, and releases it when done.
+
+Leases are either Shared or Exclusive.  Waiting requests are queued per
+device, ordered by priority and then by arrival, and are granted strictly
+from the head of the queue so a waiting exclusive request is not starved
+by a stream of shared ones.  Configuration transactions use
+PriorityConfig and so go ahead of anything else that is waiting, but
+never preempt a lease that has already been granted.
+*/
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/twinj/uuid"
+	"golang.org/x/net/context"
+
+	logging "github.com/iti/pbconf/lib/pblogger"
+)
+
+var log logging.Logger
+
+func init() {
+	log, _ = logging.GetLogger("Arbiter")
+}
+
+type Mode int
+
+const (
+	Shared Mode = iota
+	Exclusive
+)
+
+func (m Mode) String() string {
+	if m == Exclusive {
+		return "exclusive"
+	}
+	return "shared"
+}
+
+func (m Mode) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+func (m *Mode) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "shared":
+		*m = Shared
+	case "exclusive":
+		*m = Exclusive
+	default:
+		return fmt.Errorf("Unknown lease mode %s", text)
+	}
+	return nil
+}
+
+type Priority int
+
+const (
+	PriorityNormal Priority = 0
+	PriorityConfig Priority = 10
+)
+
+// Request describes who wants a device and how
+type Request struct {
+	DeviceID int64
+	Owner    string // Component asking, for instance "Driver:sel421"
+	Purpose  string // Free text shown in the session listing
+	Mode     Mode
+	Priority Priority
+	// Leases that are not released within TTL are reclaimed, which
+	// protects the node from consumers that die while holding a device.
+	// Zero means the lease never expires.
+	TTL time.Duration
+}
+
+type Lease struct {
+	ID       string
+	DeviceID int64
+	Owner    string
+	Purpose  string
+	Mode     Mode
+	Priority Priority
+	Acquired time.Time
+	Expires  time.Time // Zero if the lease does not expire
+
+	ttl time.Duration
+}
+
+// Session is a lease that has ended, kept so past access to devices can
+// be reported, for instance in audit evidence
+type Session struct {
+	Lease
+	Ended  time.Time
+	Reason string // "released" or "expired"
+}
+
+type Waiter struct {
+	DeviceID int64
+	Owner    string
+	Purpose  string
+	Mode     Mode
+	Priority Priority
+	Queued   time.Time
+}
+
+// DeviceSessions is the state of one device, as reported by the API
+type DeviceSessions struct {
+	DeviceID int64
+	Holders  []Lease
+	Waiting  []Waiter
+}
+
+type waiter struct {
+	req     Request
+	queued  time.Time
+	seq     uint64
+	granted chan *Lease
+}
+
+type device struct {
+	holders map[string]*Lease
+	queue   []*waiter
+}
+
+type Arbiter struct {
+	mx      sync.Mutex
+	devices map[int64]*device
+	leases  map[string]*Lease
+	seq     uint64
+	// Ended sessions, oldest first.  Only the last historyLimit are kept,
+	// and nothing before the node started, see Since.
+	history []Session
+	since   time.Time
+}
+
+const historyLimit = 10000
+
+var nodeArbiter *Arbiter
+var nodeOnce sync.Once
+
+// Get returns the node wide arbiter
+func Get() *Arbiter {
+	nodeOnce.Do(func() {
+		nodeArbiter = New()
+	})
+	return nodeArbiter
+}
+
+func New() *Arbiter {
+	return &Arbiter{
+		devices: make(map[int64]*device),
+		leases:  make(map[string]*Lease),
+		since:   time.Now(),
+	}
+}
+
+/*
+Acquire blocks until the requested lease is granted, or ctx is done.  The
+queueing timeout is therefore set by the caller through the ctx deadline.
+*/
+func (a *Arbiter) Acquire(ctx context.Context, req Request) (*Lease, error) {
+	a.mx.Lock()
+	a.seq++
+	w := &waiter{
+		req:     req,
+		queued:  time.Now(),
+		seq:     a.seq,
+		granted: make(chan *Lease, 1),
+	}
+	d := a.device(req.DeviceID)
+	d.queue = append(d.queue, w)
+	sort.SliceStable(d.queue, func(i, j int) bool {
+		if d.queue[i].req.Priority != d.queue[j].req.Priority {
+			return d.queue[i].req.Priority > d.queue[j].req.Priority
+		}
+		return d.queue[i].seq < d.queue[j].seq
+	})
+	a.dispatch(req.DeviceID)
+	a.mx.Unlock()
+
+	// Expired leases are reclaimed lazily, check now and then in case the
+	// queue is blocked by one
+	expired := time.NewTicker(time.Second)
+	defer expired.Stop()
+
+	for {
+		select {
+		case l := <-w.granted:
+			log.Debug("Device %d: %s lease %s granted to %s", l.DeviceID, l.Mode, l.ID, l.Owner)
+			return l, nil
+		case <-expired.C:
+			a.mx.Lock()
+			a.dispatch(req.DeviceID)
+			a.mx.Unlock()
+		case <-ctx.Done():
+			a.mx.Lock()
+			defer a.mx.Unlock()
+			// Lost the race, the lease was granted while giving up
+			select {
+			case l := <-w.granted:
+				a.release(l.ID, "released")
+			default:
+			}
+			a.dequeue(w)
+			a.dispatch(req.DeviceID)
+			return nil, NewTimeoutError(req.DeviceID, ctx.Err())
+		}
+	}
+}
+
+// Release gives up a lease.  Waiting requests that can now proceed are
+// granted.
+func (a *Arbiter) Release(id string) error {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+
+	l, ok := a.leases[id]
+	if !ok {
+		return NewNoLeaseError(id)
+	}
+	a.release(id, "released")
+	log.Debug("Device %d: lease %s released by %s", l.DeviceID, l.ID, l.Owner)
+	a.dispatch(l.DeviceID)
+	return nil
+}
+
+/*
+Renew pushes the expiry of a lease a full TTL past now, for holders whose
+work outlasts the TTL they asked for.  A lease that has expired was
+reclaimed and cannot be renewed.
+*/
+func (a *Arbiter) Renew(id string) error {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+
+	l, ok := a.leases[id]
+	if ok {
+		a.reap(l.DeviceID)
+		l, ok = a.leases[id]
+	}
+	if !ok {
+		return NewNoLeaseError(id)
+	}
+	if l.ttl > 0 {
+		l.Expires = time.Now().Add(l.ttl)
+	}
+	return nil
+}
+
+// Sessions lists the holders and waiters of every device that has any
+func (a *Arbiter) Sessions() []DeviceSessions {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+
+	ids := make([]int64, 0, len(a.devices))
+	for id := range a.devices {
+		a.reap(id)
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	sessions := make([]DeviceSessions, 0, len(ids))
+	for _, id := range ids {
+		sessions = append(sessions, a.sessions(id))
+	}
+	return sessions
+}
+
+/*
+History lists the sessions that ended after from and were acquired before
+to, oldest first.  Sessions still held are not included, see Sessions.
+*/
+func (a *Arbiter) History(from, to time.Time) []Session {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+
+	for id := range a.devices {
+		a.reap(id)
+	}
+	sessions := []Session{}
+	for _, s := range a.history {
+		if s.Ended.Before(from) || (!to.IsZero() && s.Acquired.After(to)) {
+			continue
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+// Since is the time from which History is complete
+func (a *Arbiter) Since() time.Time {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+	return a.since
+}
+
+// DeviceSessions lists the holders and waiters of one device
+func (a *Arbiter) DeviceSessions(id int64) DeviceSessions {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+
+	if _, ok := a.devices[id]; ok {
+		a.reap(id)
+	}
+	return a.sessions(id)
+}
+
+func (a *Arbiter) sessions(id int64) DeviceSessions {
+	ds := DeviceSessions{
+		DeviceID: id,
+		Holders:  []Lease{},
+		Waiting:  []Waiter{},
+	}
+	d, ok := a.devices[id]
+	if !ok {
+		return ds
+	}
+	for _, l := range d.holders {
+		ds.Holders = append(ds.Holders, *l)
+	}
+	sort.Slice(ds.Holders, func(i, j int) bool {
+		return ds.Holders[i].Acquired.Before(ds.Holders[j].Acquired)
+	})
+	for _, w := range d.queue {
+		ds.Waiting = append(ds.Waiting, Waiter{
+			DeviceID: w.req.DeviceID,
+			Owner:    w.req.Owner,
+			Purpose:  w.req.Purpose,
+			Mode:     w.req.Mode,
+			Priority: w.req.Priority,
+			Queued:   w.queued,
+		})
+	}
+	return ds
+}
+
+func (a *Arbiter) device(id int64) *device {
+	d, ok := a.devices[id]
+	if !ok {
+		d = &device{holders: make(map[string]*Lease)}
+		a.devices[id] = d
+	}
+	return d
+}
+
+// dispatch grants leases from the head of the queue for as long as the
+// head is compatible with the current holders.  Must hold a.mx.
+func (a *Arbiter) dispatch(id int64) {
+	d, ok := a.devices[id]
+	if !ok {
+		return
+	}
+	a.reap(id)
+
+	for len(d.queue) > 0 {
+		w := d.queue[0]
+		if !compatible(d, w.req.Mode) {
+			break
+		}
+		d.queue = d.queue[1:]
+
+		uuid.SwitchFormat(uuid.Clean)
+		now := time.Now()
+		l := &Lease{
+			ID:       uuid.NewV4().String(),
+			DeviceID: id,
+			Owner:    w.req.Owner,
+			Purpose:  w.req.Purpose,
+			Mode:     w.req.Mode,
+			Priority: w.req.Priority,
+			Acquired: now,
+		}
+		if w.req.TTL > 0 {
+			l.ttl = w.req.TTL
+			l.Expires = now.Add(w.req.TTL)
+		}
+		d.holders[l.ID] = l
+		a.leases[l.ID] = l
+		w.granted <- l
+	}
+
+	if len(d.holders) == 0 && len(d.queue) == 0 {
+		delete(a.devices, id)
+	}
+}
+
+func compatible(d *device, m Mode) bool {
+	if len(d.holders) == 0 {
+		return true
+	}
+	if m == Exclusive {
+		return false
+	}
+	for _, l := range d.holders {
+		if l.Mode == Exclusive {
+			return false
+		}
+	}
+	return true
+}
+
+// reap drops expired leases of a device.  Must hold a.mx.
+func (a *Arbiter) reap(id int64) {
+	d := a.devices[id]
+	now := time.Now()
+	for lid, l := range d.holders {
+		if !l.Expires.IsZero() && now.After(l.Expires) {
+			log.Warning("Device %d: lease %s held by %s expired, reclaiming", id, lid, l.Owner)
+			delete(d.holders, lid)
+			delete(a.leases, lid)
+			a.ended(l, l.Expires, "expired")
+		}
+	}
+}
+
+func (a *Arbiter) release(id, reason string) {
+	l, ok := a.leases[id]
+	if !ok {
+		return
+	}
+	delete(a.leases, id)
+	if d, ok := a.devices[l.DeviceID]; ok {
+		delete(d.holders, id)
+	}
+	a.ended(l, time.Now(), reason)
+}
+
+// ended adds a lease to the history.  Must hold a.mx.
+func (a *Arbiter) ended(l *Lease, at time.Time, reason string) {
+	a.history = append(a.history, Session{Lease: *l, Ended: at, Reason: reason})
+	if len(a.history) > historyLimit {
+		a.since = a.history[0].Ended
+		a.history = a.history[1:]
+	}
+}
+
+func (a *Arbiter) dequeue(w *waiter) {
+	d, ok := a.devices[w.req.DeviceID]
+	if !ok {
+		return
+	}
+	for i, q := range d.queue {
+		if q == w {
+			d.queue = append(d.queue[:i], d.queue[i+1:]...)
+			return
+		}
+	}
+}
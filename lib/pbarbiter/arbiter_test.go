@@ -0,0 +1,211 @@
+package arbiter
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func begin(t *testing.T, name string) {
+	fmt.Printf("##################### Begin Arbiter::%s #####################\n", name)
+}
+
+func end(t *testing.T, name string) {
+	fmt.Printf("###################### End Arbiter::%s ######################\n", name)
+}
+
+func acquire(t *testing.T, a *Arbiter, req Request, wait time.Duration) (*Lease, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	defer cancel()
+	return a.Acquire(ctx, req)
+}
+
+func TestExclusive(t *testing.T) {
+	begin(t, "TestExclusive")
+	defer end(t, "TestExclusive")
+
+	a := New()
+	l, err := acquire(t, a, Request{DeviceID: 1, Owner: "first", Mode: Exclusive}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A second session must wait, and give up on its deadline
+	_, err = acquire(t, a, Request{DeviceID: 1, Owner: "second", Mode: Shared}, 100*time.Millisecond)
+	if !IsTimeoutError(err) {
+		t.Fatalf("Expected a timeout, got %v", err)
+	}
+	if n := len(a.DeviceSessions(1).Waiting); n != 0 {
+		t.Errorf("Timed out request still queued (%d waiting)", n)
+	}
+
+	// Other devices are not affected
+	if _, err = acquire(t, a, Request{DeviceID: 2, Owner: "other", Mode: Exclusive}, time.Second); err != nil {
+		t.Errorf("Device 2 should be free: %s", err.Error())
+	}
+
+	if err = a.Release(l.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = acquire(t, a, Request{DeviceID: 1, Owner: "second", Mode: Shared}, time.Second); err != nil {
+		t.Errorf("Device 1 should be free after release: %s", err.Error())
+	}
+	if err = a.Release(l.ID); !IsNoLeaseError(err) {
+		t.Errorf("Double release should fail, got %v", err)
+	}
+}
+
+func TestShared(t *testing.T) {
+	begin(t, "TestShared")
+	defer end(t, "TestShared")
+
+	a := New()
+	for i := 0; i < 3; i++ {
+		if _, err := acquire(t, a, Request{DeviceID: 1, Owner: fmt.Sprintf("reader%d", i), Mode: Shared}, time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(a.DeviceSessions(1).Holders); n != 3 {
+		t.Errorf("Expected 3 shared holders, got %d", n)
+	}
+	if _, err := acquire(t, a, Request{DeviceID: 1, Owner: "writer", Mode: Exclusive}, 100*time.Millisecond); !IsTimeoutError(err) {
+		t.Errorf("Exclusive request should wait for shared holders, got %v", err)
+	}
+}
+
+func TestPriority(t *testing.T) {
+	begin(t, "TestPriority")
+	defer end(t, "TestPriority")
+
+	a := New()
+	holder, err := acquire(t, a, Request{DeviceID: 1, Owner: "holder", Mode: Exclusive}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	order := make(chan string, 2)
+	queue := func(owner string, prio Priority) {
+		l, err := acquire(t, a, Request{DeviceID: 1, Owner: owner, Mode: Exclusive, Priority: prio}, 5*time.Second)
+		if err != nil {
+			order <- err.Error()
+			return
+		}
+		order <- owner
+		a.Release(l.ID)
+	}
+
+	go queue("normal", PriorityNormal)
+	time.Sleep(50 * time.Millisecond)
+	go queue("config", PriorityConfig)
+	time.Sleep(50 * time.Millisecond)
+
+	waiting := a.DeviceSessions(1).Waiting
+	if len(waiting) != 2 || waiting[0].Owner != "config" {
+		t.Fatalf("Configuration request should be first in the queue: %+v", waiting)
+	}
+
+	a.Release(holder.ID)
+	if first := <-order; first != "config" {
+		t.Errorf("Expected config first, got %s", first)
+	}
+	if second := <-order; second != "normal" {
+		t.Errorf("Expected normal second, got %s", second)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	begin(t, "TestExpiry")
+	defer end(t, "TestExpiry")
+
+	a := New()
+	if _, err := acquire(t, a, Request{DeviceID: 1, Owner: "gone", Mode: Exclusive, TTL: 200 * time.Millisecond}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := acquire(t, a, Request{DeviceID: 1, Owner: "next", Mode: Exclusive}, 3*time.Second); err != nil {
+		t.Errorf("Expired lease was not reclaimed: %s", err.Error())
+	}
+}
+
+func TestRenew(t *testing.T) {
+	begin(t, "TestRenew")
+	defer end(t, "TestRenew")
+
+	a := New()
+	l, err := acquire(t, a, Request{DeviceID: 1, Owner: "slow", Mode: Exclusive, TTL: 300 * time.Millisecond}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Renewed past its first expiry, the lease still keeps others out
+	for i := 0; i < 4; i++ {
+		time.Sleep(150 * time.Millisecond)
+		if err = a.Renew(l.ID); err != nil {
+			t.Fatalf("Renewal %d: %s", i, err.Error())
+		}
+	}
+	if _, err = acquire(t, a, Request{DeviceID: 1, Owner: "next", Mode: Exclusive}, 100*time.Millisecond); !IsTimeoutError(err) {
+		t.Errorf("Expected the renewed lease to be held, got %v", err)
+	}
+
+	// Once it has expired it is gone
+	time.Sleep(400 * time.Millisecond)
+	if err = a.Renew(l.ID); !IsNoLeaseError(err) {
+		t.Errorf("Expected an expired lease not to renew, got %v", err)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	begin(t, "TestHistory")
+	defer end(t, "TestHistory")
+
+	a := New()
+	start := time.Now()
+	l, err := acquire(t, a, Request{DeviceID: 1, Owner: "Broker", Purpose: "Interactive session", Mode: Exclusive}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a.History(start, time.Time{})) != 0 {
+		t.Error("Held lease reported as ended")
+	}
+	if err := a.Release(l.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := acquire(t, a, Request{DeviceID: 2, Owner: "gone", Mode: Exclusive, TTL: 100 * time.Millisecond}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	h := a.History(start, time.Time{})
+	if len(h) != 2 {
+		t.Fatalf("Expected 2 sessions, got %d", len(h))
+	}
+	if h[0].Owner != "Broker" || h[0].Reason != "released" || h[0].Purpose != "Interactive session" {
+		t.Errorf("Unexpected first session: %+v", h[0])
+	}
+	if h[1].Owner != "gone" || h[1].Reason != "expired" {
+		t.Errorf("Unexpected second session: %+v", h[1])
+	}
+	if len(a.History(time.Now(), time.Time{})) != 0 {
+		t.Error("Sessions ended before from were reported")
+	}
+	if a.Since().After(start) {
+		t.Error("History does not cover the arbiter lifetime")
+	}
+}
@@ -0,0 +1,60 @@
+package arbiter
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Gave up waiting for a device
+type TimeoutError struct {
+	error
+}
+
+func NewTimeoutError(id int64, cause error) error {
+	return TimeoutError{
+		error: errors.New(fmt.Sprintf("Timed out waiting for device %d: %s", id, cause.Error())),
+	}
+}
+
+// Unknown or already released lease
+type NoLeaseError struct {
+	error
+}
+
+func NewNoLeaseError(id string) error {
+	return NoLeaseError{
+		error: errors.New(fmt.Sprintf("Lease %s not found", id)),
+	}
+}
+
+func IsTimeoutError(e error) bool {
+	switch e.(type) {
+	case TimeoutError:
+		return true
+	}
+	return false
+}
+
+func IsNoLeaseError(e error) bool {
+	switch e.(type) {
+	case NoLeaseError:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,176 @@
+package arbiter
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	mux "github.com/gorilla/mux"
+	database "github.com/iti/pbconf/lib/pbdatabase"
+	global "github.com/iti/pbconf/lib/pbglobal"
+	logging "github.com/iti/pbconf/lib/pblogger"
+)
+
+type APIHandler struct {
+	log     logging.Logger
+	db      database.AppDatabase
+	arbiter *Arbiter
+	Version int
+}
+
+// sessionInfo is DeviceSessions with the device name filled in for display
+type sessionInfo struct {
+	DeviceSessions
+	DeviceName string
+}
+
+func NewAPIHandler(loglevel string, d database.AppDatabase) *APIHandler {
+	l, _ := logging.GetLogger("Sessions API")
+	logging.SetLevel(loglevel, "Sessions API")
+	return &APIHandler{log: l, db: d, arbiter: Get(), Version: 1}
+}
+
+func (a *APIHandler) AddAPIEndpoints(router *mux.Router) {
+	a.log.Info("Registering sessions endpoints")
+
+	for _, v := range global.ApiUrlVersioning {
+		router.HandleFunc(v+"/sessions", a.handleBaseRoute).Methods("GET")
+
+		s := router.PathPrefix(v + "/sessions").Subrouter()
+		s.HandleFunc("/", a.handleBaseRoute).Methods("GET")
+		s.HandleFunc("/{devid}", a.handleWIdRoute).Methods("GET")
+		s.HandleFunc("/{devid}/{leaseid}", a.handleLeaseRoute).Methods("DELETE")
+	}
+}
+
+func (a *APIHandler) GetInfo() (string, int) {
+	return "sessions", a.Version
+}
+
+func (a *APIHandler) checkVersion(writer http.ResponseWriter, req *http.Request) *logging.ResponseLogger {
+	//deal with any version in the URL or Accept header
+	version, err := global.ProcessVersioning(req)
+	if err != nil {
+		a.log.Debug("Versioning: %s", err.Error())
+		writer.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	if version != nil && *version > a.Version {
+		a.log.Debug("Version %v not implemented, current version is %v", *version, a.Version)
+		writer.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	return &logging.ResponseLogger{
+		ResponseWriter: writer,
+		Logger:         a.log,
+		SrcNodeName:    global.RootNode,
+	}
+}
+
+// handleBaseRoute lists every device that is held or waited for
+func (a *APIHandler) handleBaseRoute(writer http.ResponseWriter, req *http.Request) {
+	resp := a.checkVersion(writer, req)
+	if resp == nil {
+		return
+	}
+
+	sessions := a.arbiter.Sessions()
+	infos := make([]sessionInfo, 0, len(sessions))
+	for _, s := range sessions {
+		infos = append(infos, a.sessionInfo(s))
+	}
+
+	jsonStr, err := json.Marshal(infos)
+	if err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "GET /sessions::Could not marshal the sessions Error: %s", err.Error())
+		return
+	}
+	if _, err = resp.Write(jsonStr); err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Notice", "GET /sessions::Writing response body Error: %s", err.Error())
+		return
+	}
+}
+
+// handleWIdRoute shows who holds, and who waits for, a single device
+func (a *APIHandler) handleWIdRoute(writer http.ResponseWriter, req *http.Request) {
+	resp := a.checkVersion(writer, req)
+	if resp == nil {
+		return
+	}
+
+	id, err := strconv.ParseInt(mux.Vars(req)["devid"], 10, 64)
+	if err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Info", "GET /sessions/{devid}::Bad device id: %s", err.Error())
+		return
+	}
+
+	jsonStr, err := json.Marshal(a.sessionInfo(a.arbiter.DeviceSessions(id)))
+	if err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "GET /sessions/{devid}::Could not marshal the sessions Error: %s", err.Error())
+		return
+	}
+	if _, err = resp.Write(jsonStr); err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Notice", "GET /sessions/{devid}::Writing response body Error: %s", err.Error())
+		return
+	}
+}
+
+// handleLeaseRoute forcibly releases a lease, for sessions left behind by
+// a consumer that went away
+func (a *APIHandler) handleLeaseRoute(writer http.ResponseWriter, req *http.Request) {
+	resp := a.checkVersion(writer, req)
+	if resp == nil {
+		return
+	}
+
+	params := mux.Vars(req)
+	id, err := strconv.ParseInt(params["devid"], 10, 64)
+	if err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Info", "DELETE /sessions/{devid}/{leaseid}::Bad device id: %s", err.Error())
+		return
+	}
+
+	found := false
+	for _, l := range a.arbiter.DeviceSessions(id).Holders {
+		if l.ID == params["leaseid"] {
+			found = true
+			break
+		}
+	}
+	if !found {
+		resp.WriteLog(http.StatusNotFound, "Info", "DELETE /sessions/{devid}/{leaseid}::Device %d has no lease %s", id, params["leaseid"])
+		return
+	}
+
+	if err = a.arbiter.Release(params["leaseid"]); err != nil {
+		resp.WriteLog(http.StatusNotFound, "Info", "DELETE /sessions/{devid}/{leaseid}::%s", err.Error())
+		return
+	}
+	a.log.Notice("Lease %s on device %d forcibly released", params["leaseid"], id)
+	resp.WriteHeader(http.StatusOK)
+}
+
+func (a *APIHandler) sessionInfo(s DeviceSessions) sessionInfo {
+	info := sessionInfo{DeviceSessions: s}
+	dev := database.PbDevice{Id: s.DeviceID}
+	if err := dev.Get(a.db); err == nil {
+		info.DeviceName = dev.Name
+	}
+	return info
+}
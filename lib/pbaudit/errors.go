@@ -0,0 +1,40 @@
+package audit
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"errors"
+)
+
+// Scope that names devices or nodes this node does not know
+type ScopeError struct {
+	error
+}
+
+func NewScopeError(msg string) error {
+	return ScopeError{
+		error: errors.New(msg),
+	}
+}
+
+func IsScopeError(e error) bool {
+	switch e.(type) {
+	case ScopeError:
+		return true
+	}
+	return false
+}
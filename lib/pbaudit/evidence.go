@@ -0,0 +1,290 @@
+package audit
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+/*
+Package audit assembles audit evidence: a signed package of what happened
+to a set of devices over a period, for compliance audits such as NERC CIP.
+
+A package holds, as JSON files listed with their checksums in a manifest
+the node signs:
+
+	device-history.json  commits to the devices in scope, with their content
+	policy-history.json  commits to the policies
+	compliance.json      commits to the report results
+	transactions.json    transactions touching the scope, with their reviews
+	sessions.json        leases on the devices in scope, broker sessions among them
+	signatures.json      the signature check of every repository
+	allowed_signers      the keys the commit signatures are checked against
+
+Secret values in configuration are redacted, see trans.RedactLine.
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	arbiter "github.com/iti/pbconf/lib/pbarbiter"
+	change "github.com/iti/pbconf/lib/pbchange"
+	database "github.com/iti/pbconf/lib/pbdatabase"
+	logging "github.com/iti/pbconf/lib/pblogger"
+	trans "github.com/iti/pbconf/lib/pbtranslate"
+)
+
+var log logging.Logger
+
+func init() {
+	log, _ = logging.GetLogger("Audit")
+}
+
+// Files of an evidence package
+const (
+	DeviceHistoryFile = "device-history.json"
+	PolicyHistoryFile = "policy-history.json"
+	ComplianceFile    = "compliance.json"
+	TransactionsFile  = "transactions.json"
+	SessionsFile      = "sessions.json"
+	SignaturesFile    = "signatures.json"
+)
+
+// Scope is what an evidence package covers.  A zero From or To leaves that
+// end of the period open.  Without devices or nodes every device is in
+// scope.
+type Scope struct {
+	From    time.Time
+	To      time.Time
+	Devices []string
+	Nodes   []string
+}
+
+// Sessions are the leases on the devices in scope.  The node only knows of
+// sessions that ended since it started, see arbiter.Arbiter.Since.
+type Sessions struct {
+	Since  time.Time
+	Ended  []arbiter.Session
+	Active []arbiter.Lease
+}
+
+/*
+Export writes the evidence package of a scope to w.  Devices named in the
+scope, and the devices of the nodes named, must be known to the database.
+*/
+func Export(w io.Writer, db database.AppDatabase, engine *change.CMEngine, arb *arbiter.Arbiter, s Scope) (*change.EvidenceManifest, error) {
+	devices, err := scopeDevices(db, s)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(devices))
+	for name := range devices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	scoped := len(s.Devices) > 0 || len(s.Nodes) > 0
+
+	files := make(map[string][]byte)
+	add := func(name string, v interface{}) error {
+		content, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		files[name] = content
+		return nil
+	}
+
+	deviceHistory := []change.EvidenceCommit{}
+	if !scoped || len(names) > 0 {
+		if deviceHistory, err = history(engine, change.DEVICE, names, s); err != nil {
+			return nil, err
+		}
+	}
+	if err = add(DeviceHistoryFile, deviceHistory); err != nil {
+		return nil, err
+	}
+	for name, ctype := range map[string]change.CMType{PolicyHistoryFile: change.POLICY, ComplianceFile: change.REPORT} {
+		h, err := history(engine, ctype, nil, s)
+		if err != nil {
+			return nil, err
+		}
+		if err = add(name, h); err != nil {
+			return nil, err
+		}
+	}
+
+	inScope := func(ctype change.CMType, object string) bool {
+		if ctype != change.DEVICE || !scoped {
+			return true
+		}
+		_, ok := devices[object]
+		return ok
+	}
+	if err = add(TransactionsFile, transactions(engine, s, inScope)); err != nil {
+		return nil, err
+	}
+	if err = add(SessionsFile, sessions(arb, s, devices, scoped)); err != nil {
+		return nil, err
+	}
+
+	verifications := make([]change.Verification, 0)
+	for _, ctype := range []change.CMType{change.DEVICE, change.POLICY, change.QUERY, change.REPORT, change.WAIVER} {
+		v, err := engine.VerifyHistory(ctype)
+		if change.IsCMNoRepoError(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		verifications = append(verifications, *v)
+	}
+	if err = add(SignaturesFile, verifications); err != nil {
+		return nil, err
+	}
+
+	m := &change.EvidenceManifest{From: s.From, To: s.To, Nodes: s.Nodes}
+	if scoped {
+		m.Devices = names
+	}
+	if m, err = engine.ExportEvidence(w, m, files); err != nil {
+		return nil, err
+	}
+	log.Notice("Exported evidence of %d devices from %s to %s", len(names), period(s.From), period(s.To))
+	return m, nil
+}
+
+// scopeDevices resolves the devices and nodes of a scope to the ids of the
+// devices they name, keyed by device name.  An empty scope is every device.
+func scopeDevices(db database.AppDatabase, s Scope) (map[string]int64, error) {
+	all, err := db.GetDevices()
+	if err != nil {
+		return nil, err
+	}
+	devices := make(map[string]int64)
+	if len(s.Devices) == 0 && len(s.Nodes) == 0 {
+		for _, d := range all {
+			devices[d.Name] = d.Id
+		}
+		return devices, nil
+	}
+
+	for _, name := range s.Devices {
+		d := database.PbDevice{Name: name}
+		if err := d.GetByName(db); err != nil {
+			return nil, NewScopeError(fmt.Sprintf("Unknown device %s", name))
+		}
+		devices[d.Name] = d.Id
+	}
+	for _, name := range s.Nodes {
+		n := database.PbNode{Name: name}
+		if err := n.GetByName(db); err != nil {
+			return nil, NewScopeError(fmt.Sprintf("Unknown node %s", name))
+		}
+		for _, d := range all {
+			if d.ParentNode != nil && *d.ParentNode == n.Id {
+				devices[d.Name] = d.Id
+			}
+		}
+	}
+	return devices, nil
+}
+
+// history returns the commits of a repository in the period of a scope,
+// with secrets redacted.  A repository that does not exist has none.
+func history(engine *change.CMEngine, ctype change.CMType, objects []string, s Scope) ([]change.EvidenceCommit, error) {
+	h, err := engine.EvidenceHistory(ctype, objects, s.From, s.To)
+	if change.IsCMNoRepoError(err) {
+		return []change.EvidenceCommit{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i := range h {
+		for j := range h[i].Files {
+			redact(&h[i].Files[j])
+		}
+	}
+	return h, nil
+}
+
+func redact(f *change.EvidenceFile) {
+	lines := strings.Split(f.Content, "\n")
+	for i, l := range lines {
+		if r := trans.RedactLine(l); r != l {
+			lines[i] = r
+			f.Redacted = true
+		}
+	}
+	if f.Redacted {
+		f.Content = strings.Join(lines, "\n")
+	}
+}
+
+// transactions returns the transactions that were open at any time in the
+// period of a scope and touch an object in scope
+func transactions(engine *change.CMEngine, s Scope, inScope func(change.CMType, string) bool) []change.Transaction {
+	list := make([]change.Transaction, 0)
+	for _, t := range engine.Transactions() {
+		if (!s.From.IsZero() && t.Updated.Before(s.From)) || (!s.To.IsZero() && t.Created.After(s.To)) {
+			continue
+		}
+		touches := inScope(t.Ctype, t.Object)
+		if t.ChangeSet != nil {
+			for _, m := range t.ChangeSet.Members {
+				touches = touches || inScope(t.Ctype, m.Object)
+			}
+		}
+		if touches {
+			list = append(list, t)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	return list
+}
+
+// sessions returns the leases on the devices of a scope in its period
+func sessions(arb *arbiter.Arbiter, s Scope, devices map[string]int64, scoped bool) Sessions {
+	ids := make(map[int64]bool)
+	for _, id := range devices {
+		ids[id] = true
+	}
+	ss := Sessions{Since: arb.Since(), Ended: make([]arbiter.Session, 0), Active: make([]arbiter.Lease, 0)}
+	for _, e := range arb.History(s.From, s.To) {
+		if !scoped || ids[e.DeviceID] {
+			ss.Ended = append(ss.Ended, e)
+		}
+	}
+	for _, d := range arb.Sessions() {
+		if scoped && !ids[d.DeviceID] {
+			continue
+		}
+		for _, l := range d.Holders {
+			if s.To.IsZero() || !l.Acquired.After(s.To) {
+				ss.Active = append(ss.Active, l)
+			}
+		}
+	}
+	return ss
+}
+
+func period(t time.Time) string {
+	if t.IsZero() {
+		return "any time"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
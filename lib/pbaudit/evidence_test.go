@@ -0,0 +1,174 @@
+package audit
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	mux "github.com/gorilla/mux"
+	arbiter "github.com/iti/pbconf/lib/pbarbiter"
+	change "github.com/iti/pbconf/lib/pbchange"
+	config "github.com/iti/pbconf/lib/pbconfig"
+	database "github.com/iti/pbconf/lib/pbdatabase"
+	global "github.com/iti/pbconf/lib/pbglobal"
+	logging "github.com/iti/pbconf/lib/pblogger"
+	"golang.org/x/net/context"
+)
+
+var logLevel = "DEBUG"
+
+func begin(t *testing.T, name string) {
+	fmt.Printf("##################### Begin Audit::%s #####################\n", name)
+}
+
+func end(t *testing.T, name string) {
+	fmt.Printf("###################### End Audit::%s ######################\n", name)
+}
+
+func checkFatal(t *testing.T, err error) {
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func device(t *testing.T, db database.AppDatabase, name, node string) int64 {
+	n := database.PbNode{Name: node}
+	checkFatal(t, n.GetByName(db))
+	d := database.PbDevice{Name: name, ParentNode: &n.Id}
+	checkFatal(t, d.Create(db))
+	checkFatal(t, d.GetByName(db))
+	return d.Id
+}
+
+func TestEvidence(t *testing.T) {
+	begin(t, "TestEvidence")
+	defer end(t, "TestEvidence")
+
+	repo, err := ioutil.TempDir("", "cmengine")
+	checkFatal(t, err)
+	defer os.RemoveAll(repo)
+	key := filepath.Join(repo, "node.key")
+	if out, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-f", key).CombinedOutput(); err != nil {
+		t.Fatalf("ssh-keygen: %s %v", out, err)
+	}
+	cfg := new(config.Config)
+	cfg.Global.NodeName = "control"
+	cfg.ChMgmt.RepoPath = repo
+	cfg.ChMgmt.LogLevel = logLevel
+	cfg.ChMgmt.SigningKey = key
+	engine, err := change.GetCMEngine(cfg)
+	checkFatal(t, err)
+	defer engine.Free()
+
+	logging.InitLogger(logLevel, &config.Config{}, "")
+	db := database.Open(filepath.Join(repo, "test_audit.db"), logLevel)
+	defer db.Close()
+	db.LoadSchema()
+	global.Start("control", &config.CfgWebAPI{Listen: ":8080"})
+	for _, name := range []string{"control", "substation"} {
+		n := database.PbNode{Name: name}
+		checkFatal(t, n.Create(db))
+	}
+	relay := device(t, db, "relay", "substation")
+	breaker := device(t, db, "breaker", "control")
+
+	start := time.Now().Add(-time.Minute)
+	for object, config := range map[string]string{"relay": "set password 1 s3cret\nset service FTP off\n", "breaker": "set service FTP on\n"} {
+		content := change.NewCMContent(object)
+		content.Files["configFile"] = []byte(config)
+		_, err = engine.VersionObject(&change.ChangeData{ObjectType: change.DEVICE, Content: content,
+			Author: &change.CMAuthor{Name: "tester", Email: "tester@iti.com"}}, "")
+		checkFatal(t, err)
+	}
+
+	arb := arbiter.New()
+	for _, id := range []int64{relay, breaker} {
+		l, err := arb.Acquire(context.Background(), arbiter.Request{DeviceID: id, Owner: "Broker", Purpose: "Interactive session"})
+		checkFatal(t, err)
+		checkFatal(t, arb.Release(l.ID))
+	}
+
+	var buf bytes.Buffer
+	m, err := Export(&buf, db, engine, arb, Scope{From: start, Nodes: []string{"substation"}})
+	checkFatal(t, err)
+	if len(m.Devices) != 1 || m.Devices[0] != "relay" {
+		t.Errorf("Expected the devices of substation, got %v", m.Devices)
+	}
+
+	e, err := engine.OpenEvidence(bytes.NewReader(buf.Bytes()))
+	checkFatal(t, err)
+	defer e.Close()
+
+	var history []change.EvidenceCommit
+	content, err := e.File(DeviceHistoryFile)
+	checkFatal(t, err)
+	checkFatal(t, json.Unmarshal(content, &history))
+	if len(history) != 1 || len(history[0].Files) != 1 {
+		t.Fatalf("Expected the one commit of relay, got %d", len(history))
+	}
+	f := history[0].Files[0]
+	if f.Object != "relay" || !f.Redacted || strings.Contains(f.Content, "s3cret") || !strings.Contains(f.Content, "FTP off") {
+		t.Errorf("Unexpected file %+v", f)
+	}
+	if history[0].Signature.Status != change.SignatureGood {
+		t.Errorf("Expected a good signature, got %s", history[0].Signature.Status)
+	}
+
+	var sessions Sessions
+	content, err = e.File(SessionsFile)
+	checkFatal(t, err)
+	checkFatal(t, json.Unmarshal(content, &sessions))
+	if len(sessions.Ended) != 1 || sessions.Ended[0].DeviceID != relay || sessions.Ended[0].Owner != "Broker" {
+		t.Errorf("Expected the session on relay, got %+v", sessions.Ended)
+	}
+
+	for _, name := range []string{PolicyHistoryFile, ComplianceFile, TransactionsFile, SignaturesFile, "allowed_signers"} {
+		if _, err = e.File(name); err != nil {
+			t.Errorf("Evidence is missing %s", name)
+		}
+	}
+
+	if _, err = Export(ioutil.Discard, db, engine, arb, Scope{Devices: []string{"nosuch"}}); !IsScopeError(err) {
+		t.Errorf("Expected a scope error, got %v", err)
+	}
+
+	router := mux.NewRouter()
+	NewAPIHandler(logLevel, db).AddAPIEndpoints(router)
+	for url, code := range map[string]int{
+		"https://localhost:8080/audit/evidence?devices=relay,breaker": http.StatusOK,
+		"https://localhost:8080/audit/evidence?from=yesterday":        http.StatusBadRequest,
+		"https://localhost:8080/audit/evidence?nodes=nosuch":          http.StatusBadRequest,
+	} {
+		req, _ := http.NewRequest("GET", url, nil)
+		writer := httptest.NewRecorder()
+		router.ServeHTTP(writer, req)
+		if writer.Code != code {
+			t.Errorf("GET %s: expected %d, got %d", url, code, writer.Code)
+		}
+	}
+}
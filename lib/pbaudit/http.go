@@ -0,0 +1,153 @@
+package audit
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	mux "github.com/gorilla/mux"
+	arbiter "github.com/iti/pbconf/lib/pbarbiter"
+	change "github.com/iti/pbconf/lib/pbchange"
+	database "github.com/iti/pbconf/lib/pbdatabase"
+	global "github.com/iti/pbconf/lib/pbglobal"
+	logging "github.com/iti/pbconf/lib/pblogger"
+)
+
+type APIHandler struct {
+	log     logging.Logger
+	db      database.AppDatabase
+	Version int
+}
+
+func NewAPIHandler(loglevel string, d database.AppDatabase) *APIHandler {
+	l, _ := logging.GetLogger("Audit API")
+	logging.SetLevel(loglevel, "Audit API")
+	return &APIHandler{log: l, db: d, Version: 1}
+}
+
+func (a *APIHandler) AddAPIEndpoints(router *mux.Router) {
+	a.log.Info("Registering audit endpoints")
+
+	for _, v := range global.ApiUrlVersioning {
+		s := router.PathPrefix(v + "/audit").Subrouter()
+		s.HandleFunc("/evidence", a.handleEvidenceRoute).Methods("GET")
+	}
+}
+
+func (a *APIHandler) GetInfo() (string, int) {
+	return "audit", a.Version
+}
+
+func (a *APIHandler) checkVersion(writer http.ResponseWriter, req *http.Request) *logging.ResponseLogger {
+	//deal with any version in the URL or Accept header
+	version, err := global.ProcessVersioning(req)
+	if err != nil {
+		a.log.Debug("Versioning: %s", err.Error())
+		writer.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	if version != nil && *version > a.Version {
+		a.log.Debug("Version %v not implemented, current version is %v", *version, a.Version)
+		writer.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	return &logging.ResponseLogger{
+		ResponseWriter: writer,
+		Logger:         a.log,
+		SrcNodeName:    global.RootNode,
+	}
+}
+
+/*
+handleEvidenceRoute exports the evidence package of a period and a set of
+devices.  from and to are RFC 3339 times, and devices and nodes are comma
+separated names.  All of them are optional.
+*/
+func (a *APIHandler) handleEvidenceRoute(writer http.ResponseWriter, req *http.Request) {
+	resp := a.checkVersion(writer, req)
+	if resp == nil {
+		return
+	}
+
+	q := req.URL.Query()
+	s, err := ParseScope(q.Get("from"), q.Get("to"), q.Get("devices"), q.Get("nodes"))
+	if err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Info", "GET /audit/evidence::%s", err.Error())
+		return
+	}
+
+	engine, err := change.GetCMEngine(nil)
+	if err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "GET /audit/evidence::Could not get an instance of Change management Engine.")
+		return
+	}
+
+	var buf bytes.Buffer
+	m, err := Export(&buf, a.db, engine, arbiter.Get(), *s)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if IsScopeError(err) {
+			status = http.StatusBadRequest
+		} else if change.IsCMSignatureError(err) {
+			status = http.StatusForbidden
+		}
+		resp.WriteLog(status, "Info", "GET /audit/evidence::%s", err.Error())
+		return
+	}
+
+	resp.Header().Set("Content-Type", "application/gzip")
+	resp.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"pbconf-evidence-%s-%s.tar.gz\"",
+		m.Node, m.Created.Format("20060102T150405Z")))
+	if _, err = resp.Write(buf.Bytes()); err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Notice", "GET /audit/evidence::Writing response body Error: %s", err.Error())
+	}
+}
+
+// ParseScope reads a scope from RFC 3339 times and comma separated lists of
+// device and node names, any of which may be empty
+func ParseScope(from, to, devices, nodes string) (*Scope, error) {
+	s := &Scope{Devices: names(devices), Nodes: names(nodes)}
+	var err error
+	if from != "" {
+		if s.From, err = time.Parse(time.RFC3339, from); err != nil {
+			return nil, NewScopeError(fmt.Sprintf("Bad from time %s", from))
+		}
+	}
+	if to != "" {
+		if s.To, err = time.Parse(time.RFC3339, to); err != nil {
+			return nil, NewScopeError(fmt.Sprintf("Bad to time %s", to))
+		}
+	}
+	if !s.From.IsZero() && !s.To.IsZero() && s.To.Before(s.From) {
+		return nil, NewScopeError("The period ends before it starts")
+	}
+	return s, nil
+}
+
+func names(list string) []string {
+	n := make([]string, 0)
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			n = append(n, name)
+		}
+	}
+	return n
+}
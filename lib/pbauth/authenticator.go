@@ -20,6 +20,10 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/btcsuite/golangcrypto/bcrypt"
@@ -39,6 +43,13 @@ type UserClaim struct {
 	Role string
 }
 
+// tokenKey checks the tokens this process signs.  The web UI and the API
+// run in the same process, so the API can tell who the web UI acts for.
+var (
+	tokenKey     *rsa.PublicKey
+	tokenKeyLock sync.RWMutex
+)
+
 func NewAuthHandler(loglevel string, d database.AppDatabase) *Auth {
 	l, _ := logging.GetLogger("Http Authentication")
 	logging.SetLevel(loglevel, "Http Authentication")
@@ -46,6 +57,9 @@ func NewAuthHandler(loglevel string, d database.AppDatabase) *Auth {
 	if err != nil {
 		l.Fatal(err.Error())
 	}
+	tokenKeyLock.Lock()
+	tokenKey = &rsaKey.PublicKey
+	tokenKeyLock.Unlock()
 	return &Auth{log: l, db: d, rsaKey: rsaKey}
 }
 
@@ -120,6 +134,45 @@ func (a *Auth) RenewToken(token *jwt.Token, expiryTime int) (string, error) {
 	return tokenString, err
 }
 
+/*
+Caller returns the user a request to the API is made for.  The web UI
+passes the session token of its user on in the Authorization header as a
+bearer token, which must be signed by this process and not have expired.
+*/
+func Caller(req *http.Request) (*UserClaim, error) {
+	tokenKeyLock.RLock()
+	key := tokenKey
+	tokenKeyLock.RUnlock()
+	if key == nil {
+		return nil, errors.New("No user tokens are issued by this node")
+	}
+
+	ah := req.Header.Get("Authorization")
+	if len(ah) < 7 || strings.ToUpper(ah[:7]) != "BEARER " {
+		return nil, errors.New("Request does not carry a user token")
+	}
+	token, err := jwt.Parse(ah[7:], func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+		}
+		return key, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, errors.New("Invalid user token")
+	}
+
+	u, _ := token.Claims["UserInfo"].(map[string]interface{})
+	name, _ := u["Name"].(string)
+	role, _ := u["Role"].(string)
+	if name == "" {
+		return nil, errors.New("No user found in the token claims")
+	}
+	return &UserClaim{Name: name, Role: role}, nil
+}
+
 //encryptPassword function encrypts the plain text password with the chosen scheme.
 // Internally the bcrypt.GenerateFromPassword salts and hashes the plain password.
 func (a *Auth) encryptPassword(plainPass string) string {
@@ -21,6 +21,7 @@ package pbauth
 
 import (
 	"github.com/btcsuite/golangcrypto/bcrypt"
+	"net/http"
 	"os"
 	"testing"
 
@@ -124,3 +125,44 @@ func TestUpdateUserPassword(t *testing.T) {
 	//cleanup
 	os.Remove(dbFile)
 }
+
+func TestCaller(t *testing.T) {
+	begin(t, "TestCaller")
+	defer end(t, "TestCaller")
+
+	dbFile := "test_caller.db"
+	dbHandle := setupDB(t, dbFile)
+	defer dbHandle.Close()
+
+	authHandler := setupAuthHandler(dbHandle)
+	token, err := authHandler.GenerateToken(&pbdatabase.PbUser{Name: "henry", Role: "reviewer"}, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("POST", "https://localhost:8080/changes/1/approve", nil)
+	if _, err := Caller(req); err == nil {
+		t.Error("Request without a token has a caller")
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token)
+	user, err := Caller(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Name != "henry" || user.Role != "reviewer" {
+		t.Errorf("Unexpected caller %+v", user)
+	}
+
+	// Tokens signed by anyone else are not taken
+	other := setupAuthHandler(dbHandle)
+	token, _ = other.GenerateToken(&pbdatabase.PbUser{Name: "mallory", Role: "reviewer"}, 5)
+	setupAuthHandler(dbHandle)
+	req.Header.Set("Authorization", "Bearer "+token)
+	if user, err = Caller(req); err == nil {
+		t.Errorf("Token from another key taken for %+v", user)
+	}
+
+	//cleanup
+	os.Remove(dbFile)
+}
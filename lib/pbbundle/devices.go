@@ -0,0 +1,148 @@
+package bundle
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"encoding/json"
+
+	database "github.com/iti/pbconf/lib/pbdatabase"
+	global "github.com/iti/pbconf/lib/pbglobal"
+)
+
+// Name of the device metadata in a bundle
+const devicesFile = "devices.json"
+
+// Device is the metadata of a device carried in a bundle.  Its node is
+// named, as node ids differ from one node's database to another.
+type Device struct {
+	Name        string
+	Node        string
+	ConfigItems []database.ConfigItem
+}
+
+// Actions importing a bundle takes on a device
+const (
+	DeviceCreate    = "create"
+	DeviceUpdate    = "update"
+	DeviceUnchanged = "unchanged"
+)
+
+// DevicePreview is what importing a bundle does to a device
+type DevicePreview struct {
+	Name   string
+	Node   string
+	Action string
+}
+
+// exportDevices returns the metadata of every device this node knows of
+func exportDevices(db database.AppDatabase) ([]byte, error) {
+	devices, err := db.GetDevices()
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]Device, 0, len(devices))
+	for _, d := range devices {
+		dev := database.PbDevice{Id: d.Id}
+		if err = dev.Get(db); err != nil {
+			return nil, err
+		}
+		bd := Device{Name: dev.Name, ConfigItems: dev.ConfigItems}
+		if dev.ParentNode != nil {
+			node := database.PbNode{Id: *dev.ParentNode}
+			if node.Get(db) == nil {
+				bd.Node = node.Name
+			}
+		}
+		out = append(out, bd)
+	}
+	return json.Marshal(out)
+}
+
+// previewDevices tells what importing device metadata does to each device
+func previewDevices(db database.AppDatabase, content []byte) ([]Device, []DevicePreview, error) {
+	var devices []Device
+	if err := json.Unmarshal(content, &devices); err != nil {
+		return nil, nil, err
+	}
+
+	previews := make([]DevicePreview, 0, len(devices))
+	for _, bd := range devices {
+		p := DevicePreview{Name: bd.Name, Node: bd.Node, Action: DeviceCreate}
+		dev := database.PbDevice{Name: bd.Name}
+		if exists, err := dev.ExistsByName(db); err != nil {
+			return nil, nil, err
+		} else if exists {
+			if err = dev.GetByName(db); err != nil {
+				return nil, nil, err
+			}
+			p.Action = DeviceUnchanged
+			have := make(map[string]string)
+			for _, item := range dev.ConfigItems {
+				have[item.Key] = item.Value
+			}
+			for _, item := range bd.ConfigItems {
+				if v, ok := have[item.Key]; !ok || v != item.Value {
+					p.Action = DeviceUpdate
+				}
+			}
+		}
+		previews = append(previews, p)
+	}
+	return devices, previews, nil
+}
+
+/*
+importDevices creates the devices of a bundle this node does not know of, and
+sets the configuration items of those it does.  A new device goes under the
+node the bundle names when this node knows of it, and under this node when
+not.
+*/
+func importDevices(db database.AppDatabase, devices []Device, previews []DevicePreview) error {
+	root := database.PbNode{Name: global.RootNode}
+	if err := root.GetByName(db); err != nil {
+		return err
+	}
+
+	for i, bd := range devices {
+		dev := database.PbDevice{Name: bd.Name}
+		switch previews[i].Action {
+		case DeviceCreate:
+			parent := root.Id
+			if bd.Node != "" {
+				node := database.PbNode{Name: bd.Node}
+				if node.GetByName(db) == nil {
+					parent = node.Id
+				}
+			}
+			dev.ParentNode = &parent
+			dev.ConfigItems = bd.ConfigItems
+			if err := dev.Create(db); err != nil {
+				return err
+			}
+		case DeviceUpdate:
+			if err := dev.GetByName(db); err != nil {
+				return err
+			}
+			dev.ConfigItems = bd.ConfigItems
+			if err := dev.Update(db); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
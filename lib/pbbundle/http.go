@@ -0,0 +1,201 @@
+package bundle
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	mux "github.com/gorilla/mux"
+	change "github.com/iti/pbconf/lib/pbchange"
+	database "github.com/iti/pbconf/lib/pbdatabase"
+	global "github.com/iti/pbconf/lib/pbglobal"
+	logging "github.com/iti/pbconf/lib/pblogger"
+)
+
+// Largest bundle taken for preview or import
+const maxBundleSize = 1 << 30
+
+// The repositories a bundle carries
+var bundleRepos = []change.CMType{change.DEVICE, change.POLICY, change.REPORT}
+
+// Preview is what importing a bundle does to this node
+type Preview struct {
+	Signer  string
+	Created time.Time
+	Repos   []change.RepoPreview
+	Devices []DevicePreview
+}
+
+type APIHandler struct {
+	log     logging.Logger
+	db      database.AppDatabase
+	Version int
+}
+
+func NewAPIHandler(loglevel string, d database.AppDatabase) *APIHandler {
+	l, _ := logging.GetLogger("Bundle API")
+	logging.SetLevel(loglevel, "Bundle API")
+	return &APIHandler{log: l, db: d, Version: 1}
+}
+
+func (a *APIHandler) AddAPIEndpoints(router *mux.Router) {
+	a.log.Info("Registering bundle endpoints")
+
+	for _, v := range global.ApiUrlVersioning {
+		router.HandleFunc(v+"/bundles", a.handleBaseRoute).Methods("GET", "POST")
+
+		s := router.PathPrefix(v + "/bundles").Subrouter()
+		s.HandleFunc("/", a.handleBaseRoute).Methods("GET", "POST")
+		s.HandleFunc("/preview", a.handlePreviewRoute).Methods("POST")
+	}
+}
+
+func (a *APIHandler) GetInfo() (string, int) {
+	return "bundles", a.Version
+}
+
+func (a *APIHandler) checkVersion(writer http.ResponseWriter, req *http.Request) *logging.ResponseLogger {
+	//deal with any version in the URL or Accept header
+	version, err := global.ProcessVersioning(req)
+	if err != nil {
+		a.log.Debug("Versioning: %s", err.Error())
+		writer.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	if version != nil && *version > a.Version {
+		a.log.Debug("Version %v not implemented, current version is %v", *version, a.Version)
+		writer.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	return &logging.ResponseLogger{
+		ResponseWriter: writer,
+		Logger:         a.log,
+		SrcNodeName:    global.RootNode,
+	}
+}
+
+// handleBaseRoute exports a bundle of this node, or imports one made by
+// another
+func (a *APIHandler) handleBaseRoute(writer http.ResponseWriter, req *http.Request) {
+	resp := a.checkVersion(writer, req)
+	if resp == nil {
+		return
+	}
+	if req.Method == "POST" {
+		a.importBundle(resp, req, "POST /bundles", true)
+		return
+	}
+
+	engine, err := change.GetCMEngine(nil)
+	if err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "GET /bundles::Could not get an instance of Change management Engine.")
+		return
+	}
+	devices, err := exportDevices(a.db)
+	if err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "GET /bundles::Could not read devices Error: %s", err.Error())
+		return
+	}
+
+	var buf bytes.Buffer
+	m, err := engine.ExportBundle(&buf, bundleRepos, map[string][]byte{devicesFile: devices})
+	if err != nil {
+		a.writeError(resp, "GET /bundles", err)
+		return
+	}
+
+	resp.Header().Set("Content-Type", "application/gzip")
+	resp.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"pbconf-%s-%s.tar.gz\"",
+		m.Node, m.Created.Format("20060102T150405Z")))
+	if _, err = resp.Write(buf.Bytes()); err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Notice", "GET /bundles::Writing response body Error: %s", err.Error())
+		return
+	}
+	a.log.Notice("GET /bundles::Exported bundle of %d repositories", len(m.Repos))
+}
+
+// handlePreviewRoute tells what importing a bundle would do, without
+// importing it
+func (a *APIHandler) handlePreviewRoute(writer http.ResponseWriter, req *http.Request) {
+	resp := a.checkVersion(writer, req)
+	if resp == nil {
+		return
+	}
+	a.importBundle(resp, req, "POST /bundles/preview", false)
+}
+
+func (a *APIHandler) importBundle(resp *logging.ResponseLogger, req *http.Request, route string, apply bool) {
+	engine, err := change.GetCMEngine(nil)
+	if err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "%s::Could not get an instance of Change management Engine.", route)
+		return
+	}
+
+	b, err := engine.OpenBundle(http.MaxBytesReader(resp, req.Body, maxBundleSize))
+	if err != nil {
+		a.writeError(resp, route, err)
+		return
+	}
+	defer b.Close()
+
+	p := Preview{Signer: b.Signer, Created: b.Manifest.Created, Devices: make([]DevicePreview, 0)}
+	if p.Repos, err = engine.PreviewBundle(b); err != nil {
+		a.writeError(resp, route, err)
+		return
+	}
+
+	var devices []Device
+	if content, err := b.File(devicesFile); err == nil {
+		if devices, p.Devices, err = previewDevices(a.db, content); err != nil {
+			resp.WriteLog(http.StatusBadRequest, "Notice", "%s::Malformed device metadata: %s", route, err.Error())
+			return
+		}
+	}
+
+	if apply {
+		if _, err = engine.ImportBundle(b); err != nil {
+			a.writeError(resp, route, err)
+			return
+		}
+		if err = importDevices(a.db, devices, p.Devices); err != nil {
+			resp.WriteLog(http.StatusInternalServerError, "Error", "%s::Could not import devices Error: %s", route, err.Error())
+			return
+		}
+		a.log.Notice("%s::Imported bundle from %s", route, b.Signer)
+	}
+
+	jsonStr, err := json.Marshal(p)
+	if err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "%s::Could not marshal the response Error: %s", route, err.Error())
+		return
+	}
+	if _, err = resp.Write(jsonStr); err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Notice", "%s::Writing response body Error: %s", route, err.Error())
+	}
+}
+
+func (a *APIHandler) writeError(resp *logging.ResponseLogger, route string, err error) {
+	status := http.StatusBadRequest
+	if change.IsCMSignatureError(err) {
+		status = http.StatusForbidden
+	}
+	resp.WriteLog(status, "Info", "%s::%s", route, err.Error())
+}
@@ -0,0 +1,177 @@
+package bundle
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	mux "github.com/gorilla/mux"
+	change "github.com/iti/pbconf/lib/pbchange"
+	config "github.com/iti/pbconf/lib/pbconfig"
+	database "github.com/iti/pbconf/lib/pbdatabase"
+	global "github.com/iti/pbconf/lib/pbglobal"
+	logging "github.com/iti/pbconf/lib/pblogger"
+)
+
+var logLevel = "DEBUG"
+
+func begin(t *testing.T, name string) {
+	fmt.Printf("##################### Begin Bundle::%s #####################\n", name)
+}
+
+func end(t *testing.T, name string) {
+	fmt.Printf("###################### End Bundle::%s ######################\n", name)
+}
+
+func checkFatal(t *testing.T, err error) {
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// node sets up the engine, database and API of a node.  The returned
+// function tears them down.
+func node(t *testing.T, name, key, trusted string) (*mux.Router, database.AppDatabase, func()) {
+	repo, err := ioutil.TempDir("", "cmengine")
+	checkFatal(t, err)
+	cfg := new(config.Config)
+	cfg.Global.NodeName = name
+	cfg.ChMgmt.RepoPath = repo
+	cfg.ChMgmt.LogLevel = logLevel
+	cfg.ChMgmt.SigningKey = key
+	cfg.ChMgmt.TrustedSigners = trusted
+	engine, err := change.GetCMEngine(cfg)
+	checkFatal(t, err)
+
+	logging.InitLogger(logLevel, &config.Config{}, "")
+	dbFile := filepath.Join(repo, "test_bundle.db")
+	db := database.Open(dbFile, logLevel)
+	db.LoadSchema()
+	global.Start(name, &config.CfgWebAPI{Listen: ":8080"})
+	root := database.PbNode{Name: name}
+	checkFatal(t, root.Create(db))
+
+	router := mux.NewRouter()
+	NewAPIHandler(logLevel, db).AddAPIEndpoints(router)
+
+	return router, db, func() {
+		db.Close()
+		engine.Free()
+		os.RemoveAll(repo)
+	}
+}
+
+func serve(router *mux.Router, method, url string, body []byte) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, url, bytes.NewReader(body))
+	writer := httptest.NewRecorder()
+	router.ServeHTTP(writer, req)
+	return writer
+}
+
+func TestBundleRoutes(t *testing.T) {
+	begin(t, "TestBundleRoutes")
+	defer end(t, "TestBundleRoutes")
+
+	keys, err := ioutil.TempDir("", "keys")
+	checkFatal(t, err)
+	defer os.RemoveAll(keys)
+	for _, k := range []string{"control", "substation"} {
+		out, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-f", filepath.Join(keys, k)).CombinedOutput()
+		if err != nil {
+			t.Fatalf("ssh-keygen: %s %v", out, err)
+		}
+	}
+	pub, err := ioutil.ReadFile(filepath.Join(keys, "control.pub"))
+	checkFatal(t, err)
+	trusted := filepath.Join(keys, "trusted")
+	checkFatal(t, ioutil.WriteFile(trusted, []byte("control "+string(pub)), 0644))
+
+	// The control center exports its devices
+	router, db, done := node(t, "control", filepath.Join(keys, "control"), "")
+	engine, _ := change.GetCMEngine(nil)
+	content := change.NewCMContent("relay")
+	content.Files["configFile"] = []byte("set service FTP on\n")
+	_, err = engine.VersionObject(&change.ChangeData{ObjectType: change.DEVICE, Content: content,
+		Author: &change.CMAuthor{Name: "tester", Email: "tester@iti.com"}}, "")
+	checkFatal(t, err)
+	root := database.PbNode{Name: "control"}
+	checkFatal(t, root.GetByName(db))
+	dev := database.PbDevice{Name: "relay", ParentNode: &root.Id,
+		ConfigItems: []database.ConfigItem{{Key: "Address", Value: "10.0.0.2"}}}
+	checkFatal(t, dev.Create(db))
+
+	writer := serve(router, "GET", "https://localhost:8080/bundles", nil)
+	if writer.Code != http.StatusOK || writer.Header().Get("Content-Type") != "application/gzip" {
+		t.Fatalf("Could not export bundle, got code %v", writer.Code)
+	}
+	bundle := writer.Body.Bytes()
+	done()
+
+	// A substation previews and imports it
+	router, db, done = node(t, "substation", filepath.Join(keys, "substation"), trusted)
+	defer done()
+
+	if writer = serve(router, "POST", "https://localhost:8080/bundles/preview", []byte("not a bundle")); writer.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a malformed bundle, got %v", writer.Code)
+	}
+
+	writer = serve(router, "POST", "https://localhost:8080/bundles/preview", bundle)
+	if writer.Code != http.StatusOK {
+		t.Fatalf("Could not preview bundle, got code %v: %s", writer.Code, writer.Body.String())
+	}
+	var p Preview
+	checkFatal(t, json.Unmarshal(writer.Body.Bytes(), &p))
+	if p.Signer != "control" || len(p.Repos) != 1 || fmt.Sprint(p.Repos[0].Objects) != "[relay]" {
+		t.Errorf("Unexpected preview %+v", p)
+	}
+	if len(p.Devices) != 1 || p.Devices[0].Action != DeviceCreate {
+		t.Errorf("Expected to create relay, got %+v", p.Devices)
+	}
+	dev = database.PbDevice{Name: "relay"}
+	if exists, _ := dev.ExistsByName(db); exists {
+		t.Errorf("Preview created the device")
+	}
+
+	writer = serve(router, "POST", "https://localhost:8080/bundles", bundle)
+	if writer.Code != http.StatusOK {
+		t.Fatalf("Could not import bundle, got code %v: %s", writer.Code, writer.Body.String())
+	}
+	checkFatal(t, dev.GetByName(db))
+	if v, ok := dev.ConfigValue("Address"); !ok || v != "10.0.0.2" {
+		t.Errorf("Device metadata not imported: %+v", dev)
+	}
+
+	writer = serve(router, "POST", "https://localhost:8080/bundles/preview", bundle)
+	checkFatal(t, json.Unmarshal(writer.Body.Bytes(), &p))
+	if !p.Repos[0].UpToDate || p.Devices[0].Action != DeviceUnchanged {
+		t.Errorf("Bundle not imported: %+v", p)
+	}
+
+	// The substation passes on what it now has
+	if writer = serve(router, "GET", "https://localhost:8080/bundles", nil); writer.Code != http.StatusOK {
+		t.Errorf("Could not export from the substation, got code %v", writer.Code)
+	}
+}
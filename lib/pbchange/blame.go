@@ -0,0 +1,182 @@
+package pbchange
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Trailers written to commits that record where a change came from
+const (
+	TrailerTransaction = "Transaction"
+	TrailerSourceNode  = "Source-Node"
+)
+
+// sourceNotesRef holds the originating node of commits that arrived in a
+// pack or bundle, which can not carry a trailer written by this node
+const sourceNotesRef = "pbconf-source"
+
+// Provenance describes the commit that last changed part of an object
+type Provenance struct {
+	Commit      string
+	Time        time.Time
+	Author      *CMAuthor
+	Message     string
+	Transaction string  `json:",omitempty"`
+	SrcNode     string  `json:",omitempty"`
+	Review      *Review `json:",omitempty"`
+}
+
+// BlameLine is a statement of an object with the commit that added it
+type BlameLine struct {
+	Statement string
+	*Provenance
+}
+
+// Blame maps every statement of an object on master to the commit that
+// last changed it.  Statements are compared without regard to their order,
+// indentation or comments.
+type Blame struct {
+	Object string
+	Commit string
+	Lines  []BlameLine
+}
+
+/*
+Blame walks the first parent history of master for an object and returns
+each of its statements with the commit that introduced it.  Changes that
+land through a merge, such as approved change requests, are blamed on the
+merge, which records the review.
+*/
+func (engine *CMEngine) Blame(otype CMType, object string) (*Blame, error) {
+	o, err := engine.run(otype, "log", "--first-parent", "--reverse", "--notes="+sourceNotesRef,
+		"--format=%x00%H%x1f%at%x1f%an%x1f%ae%x1f%N%x1f%B", "master", "--", filepath.Join(object, "data"))
+	if err != nil {
+		return nil, err
+	}
+
+	origins := make(map[string][]*Provenance)
+	prev := []string{}
+	head := ""
+	for _, record := range strings.Split(o, "\x00") {
+		if strings.TrimSpace(record) == "" {
+			continue
+		}
+		p, err := parseProvenance(record)
+		if err != nil {
+			return nil, err
+		}
+
+		cur, err := engine.objectStatements(otype, p.Commit, object)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range subtractStatements(prev, cur) {
+			origins[s] = origins[s][1:]
+		}
+		for _, s := range subtractStatements(cur, prev) {
+			origins[s] = append(origins[s], p)
+		}
+		prev, head = cur, p.Commit
+	}
+	if head == "" || len(prev) == 0 {
+		return nil, NewCMNoObjectError(object, "master")
+	}
+
+	b := &Blame{Object: object, Commit: head, Lines: make([]BlameLine, 0, len(prev))}
+	seen := make(map[string]int)
+	for _, s := range prev {
+		b.Lines = append(b.Lines, BlameLine{Statement: s, Provenance: origins[s][seen[s]]})
+		seen[s]++
+	}
+	return b, nil
+}
+
+// parseProvenance reads a record written by the log format used in Blame
+func parseProvenance(record string) (*Provenance, error) {
+	f := strings.SplitN(strings.TrimLeft(record, "\n"), "\x1f", 6)
+	if len(f) != 6 {
+		return nil, NewCMError("Malformed log record")
+	}
+	at, err := strconv.ParseInt(f[1], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := strings.TrimSpace(f[5])
+	p := &Provenance{
+		Commit:  f[0],
+		Time:    time.Unix(at, 0),
+		Author:  &CMAuthor{Name: f[2], Email: f[3]},
+		Message: strings.SplitN(msg, "\n", 2)[0],
+		SrcNode: strings.TrimSpace(f[4]),
+	}
+
+	trailers := commitTrailers(msg)
+	if src := trailers[TrailerSourceNode]; src != "" {
+		p.SrcNode = src
+	}
+	for _, t := range []string{TrailerTransaction, TrailerChangeRequest, TrailerScheduledChange} {
+		if p.Transaction = trailers[t]; p.Transaction != "" {
+			break
+		}
+	}
+	if review := reviewFromTrailers(trailers); review != nil {
+		p.Review = review
+	}
+	return p, nil
+}
+
+// commitTrailers returns the "Key: value" lines of a commit message.  The
+// last value wins for a repeated key.
+func commitTrailers(msg string) map[string]string {
+	trailers := make(map[string]string)
+	for _, line := range strings.Split(msg, "\n") {
+		kv := strings.SplitN(line, ": ", 2)
+		if len(kv) != 2 || strings.ContainsAny(kv[0], " \t") {
+			continue
+		}
+		trailers[kv[0]] = kv[1]
+	}
+	return trailers
+}
+
+// provenanceMessage adds the transaction and source node of a change to
+// its commit message
+func provenanceMessage(message string, data *ChangeData) string {
+	lines := []string{}
+	if data.TransactionID != "" {
+		lines = append(lines, fmt.Sprintf("%s: %s", TrailerTransaction, data.TransactionID))
+	}
+	if data.SrcNode != "" {
+		lines = append(lines, fmt.Sprintf("%s: %s", TrailerSourceNode, data.SrcNode))
+	}
+	if len(lines) == 0 {
+		return message
+	}
+	return strings.TrimRight(message, "\n") + "\n\n" + strings.Join(lines, "\n")
+}
+
+// sourceNoteArgs returns the git arguments that record src as the node a
+// commit came from
+func sourceNoteArgs(commit, src string) []string {
+	return []string{"notes", "--ref=" + sourceNotesRef, "add", "-f", "-m", src, commit}
+}
@@ -0,0 +1,83 @@
+package pbchange
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"testing"
+)
+
+func TestBlame(t *testing.T) {
+	begin(t, "TestBlame")
+	defer end(t, "TestBlame")
+
+	cfg := setup()
+	engine, err := GetCMEngine(cfg)
+	defer cleanup(cfg, engine)
+	checkFatal(t, err)
+
+	_, err = engine.VersionObject(proposal("relay", "set service FTP on\nset service telnet on\n"), "Initial")
+	checkFatal(t, err)
+	first, err := engine.ObjectCommits(DEVICE, "relay", "", 1)
+	checkFatal(t, err)
+
+	if _, err = engine.Blame(DEVICE, "feeder"); !IsCMNoObjectError(err) {
+		t.Errorf("Blamed an object without history: %v", err)
+	}
+
+	// A change forwarded by another node, committed the way the device
+	// API does
+	data := proposal("relay", "set service FTP on\n  set service telnet off\n")
+	data.SrcNode = "substation"
+	id, err := engine.BeginTransaction(data, "Telnet off")
+	checkFatal(t, err)
+	data.TransactionID = id
+	_, err = engine.VersionObject(data, "Telnet off")
+	checkFatal(t, err)
+	checkFatal(t, engine.FinalizeTransaction(data))
+
+	cr, err := engine.ProposeChange(proposal("relay",
+		"set service FTP on\nset service telnet off\n# remote access\nset service ssh on\n"), "Add ssh")
+	checkFatal(t, err)
+	reviewer := &CMAuthor{Name: "Kevin McHale", Email: "post@celtics.net"}
+	merge, err := engine.ApproveChange(cr, reviewer, "", nil)
+	checkFatal(t, err)
+
+	blame, err := engine.Blame(DEVICE, "relay")
+	checkFatal(t, err)
+	if blame.Object != "relay" || blame.Commit != merge || len(blame.Lines) != 3 {
+		t.Fatalf("Unexpected blame %+v", blame)
+	}
+
+	ftp, ssh, telnet := blame.Lines[0], blame.Lines[1], blame.Lines[2]
+	if ftp.Statement != "set service FTP on" || ftp.Commit != first[0] ||
+		ftp.Transaction != "" || ftp.SrcNode != "" || ftp.Review != nil || ftp.Message != "Initial" {
+		t.Errorf("Unexpected provenance for %q: %+v", ftp.Statement, ftp.Provenance)
+	}
+	if ssh.Statement != "set service ssh on" || ssh.Commit != merge || ssh.Transaction != cr ||
+		ssh.Review == nil || !ssh.Review.Approved || ssh.Review.Reviewer.Name != "Kevin McHale" ||
+		ssh.Review.Proposer.Name != "Larry Bird" {
+		t.Errorf("Unexpected provenance for %q: %+v", ssh.Statement, ssh.Provenance)
+	}
+	if telnet.Statement != "set service telnet off" || telnet.Transaction != id ||
+		telnet.SrcNode != "substation" || telnet.Author.Name != "Larry Bird" || telnet.Message != "Telnet off" {
+		t.Errorf("Unexpected provenance for %q: %+v", telnet.Statement, telnet.Provenance)
+	}
+
+	if tr, err := engine.GetTransaction(id); err != nil || tr.SrcNode != "substation" {
+		t.Errorf("Transaction lost its source node: %+v %v", tr, err)
+	}
+}
@@ -0,0 +1,537 @@
+package pbchange
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Files of a bundle besides the repositories and the files it carries
+const (
+	bundleManifest  = "manifest.json"
+	bundleSignature = "manifest.json.sig"
+)
+
+// Namespace of the signature of a bundle manifest, so that no other
+// signature made with the key of a node passes for one
+const bundleNamespace = "pbconf-bundle"
+
+// Ref a bundle is fetched to before it is merged
+const bundleRef = "refs/pbconf/bundle"
+
+// BundleRepo is a repository carried in a bundle
+type BundleRepo struct {
+	Repository string
+	Head       string
+	SignedFrom string `json:",omitempty"`
+	File       string
+	SHA256     string
+}
+
+// BundleFile is any other file carried in a bundle
+type BundleFile struct {
+	Name   string
+	SHA256 string
+}
+
+// BundleManifest lists what a bundle carries.  It is signed by the node
+// that made the bundle.
+type BundleManifest struct {
+	Node    string
+	Created time.Time
+	Repos   []BundleRepo
+	Files   []BundleFile
+}
+
+// Bundle is a bundle opened for import.  Its signature and the checksums of
+// its contents have been verified.
+type Bundle struct {
+	Manifest BundleManifest
+	Signer   string
+	dir      string
+}
+
+// RepoPreview is what importing a bundle does to a repository
+type RepoPreview struct {
+	Repository  string
+	Current     string
+	Head        string
+	UpToDate    bool
+	FastForward bool
+	Objects     []string
+	Commits     []CommitSignature
+	Diff        string
+	Problems    []string
+}
+
+/*
+ExportBundle writes a signed bundle of the master branch of the given
+repositories, and of files such as device metadata, for a node that can not
+be reached over the network.  Repositories that do not exist are left out.
+*/
+func (engine *CMEngine) ExportBundle(w io.Writer, types []CMType, files map[string][]byte) (*BundleManifest, error) {
+	if !engine.Signing() {
+		return nil, NewCMSignatureError("Bundles can not be made without a signing key")
+	}
+
+	dir, err := ioutil.TempDir("", "bundle")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	m := &BundleManifest{Node: engine.signer, Created: time.Now().UTC(),
+		Repos: make([]BundleRepo, 0), Files: make([]BundleFile, 0)}
+
+	for _, ctype := range types {
+		if _, err = engine.getGitDir(ctype); err != nil {
+			continue
+		}
+		repo, err := engine.bundleRepo(ctype, dir)
+		if err != nil {
+			return nil, err
+		}
+		if repo != nil {
+			m.Repos = append(m.Repos, *repo)
+		}
+	}
+
+	for name, content := range files {
+		if !bundleName(name) {
+			return nil, NewCMError(fmt.Sprintf("Can not bundle a file named %s", name))
+		}
+		if err = ioutil.WriteFile(filepath.Join(dir, name), content, 0600); err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(content)
+		m.Files = append(m.Files, BundleFile{Name: name, SHA256: hex.EncodeToString(sum[:])})
+	}
+
+	names := make([]string, 0, len(m.Repos)+len(m.Files))
+	for _, repo := range m.Repos {
+		names = append(names, repo.File)
+	}
+	for _, f := range m.Files {
+		names = append(names, f.Name)
+	}
+	if err = engine.writeArchive(w, dir, bundleNamespace, m, m.Created, names); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// bundleRepo writes the master history of a repository to a git bundle in
+// dir.  A repository without history is skipped.
+func (engine *CMEngine) bundleRepo(ctype CMType, dir string) (*BundleRepo, error) {
+	engine.guard(ctype).Lock()
+	defer engine.guard(ctype).Unlock()
+
+	head, err := engine.run(ctype, "rev-parse", "master")
+	if err != nil {
+		return nil, nil
+	}
+	from, err := engine.signedFrom(ctype)
+	if err != nil {
+		return nil, err
+	}
+
+	repo := &BundleRepo{
+		Repository: ctype.String(),
+		Head:       strings.TrimSpace(head),
+		SignedFrom: from,
+		File:       ctype.String() + ".bundle",
+	}
+	if _, stderr, err := engine.runC(ctype, "bundle", "create", filepath.Join(dir, repo.File), "master"); err != nil {
+		return nil, NewCMError(fmt.Sprintf("Can not bundle %s: %s", ctype, strings.TrimSpace(stderr)))
+	}
+	if repo.SHA256, err = fileSum(filepath.Join(dir, repo.File)); err != nil {
+		return nil, err
+	}
+	return repo, nil
+}
+
+/*
+OpenBundle unpacks a bundle and checks that a trusted node signed it, and
+that its contents are what the signed manifest lists.  The caller closes the
+bundle when done with it.
+*/
+func (engine *CMEngine) OpenBundle(r io.Reader) (*Bundle, error) {
+	if engine.allowedSigners == "" {
+		return nil, NewCMSignatureError("No trusted signers to check bundles against")
+	}
+
+	dir, err := ioutil.TempDir("", "bundle")
+	if err != nil {
+		return nil, err
+	}
+	b := &Bundle{dir: dir}
+	fail := func(err error) (*Bundle, error) {
+		b.Close()
+		return nil, err
+	}
+
+	manifest, signer, err := engine.readArchive(r, dir, bundleNamespace)
+	if err != nil {
+		return fail(err)
+	}
+	b.Signer = signer
+
+	if err = json.Unmarshal(manifest, &b.Manifest); err != nil {
+		return fail(NewCMError(fmt.Sprintf("Malformed bundle manifest: %s", err.Error())))
+	}
+	for _, repo := range b.Manifest.Repos {
+		if StringToCMType(repo.Repository) == NONE {
+			return fail(NewCMError(fmt.Sprintf("Bundle carries unknown repository %s", repo.Repository)))
+		}
+		if err = checkArchived(dir, repo.File, repo.SHA256); err != nil {
+			return fail(err)
+		}
+	}
+	for _, f := range b.Manifest.Files {
+		if err = checkArchived(dir, f.Name, f.SHA256); err != nil {
+			return fail(err)
+		}
+	}
+	return b, nil
+}
+
+// Close removes the unpacked bundle
+func (b *Bundle) Close() error {
+	return os.RemoveAll(b.dir)
+}
+
+// File returns a file the bundle carries besides its repositories
+func (b *Bundle) File(name string) ([]byte, error) {
+	for _, f := range b.Manifest.Files {
+		if f.Name == name {
+			return ioutil.ReadFile(filepath.Join(b.dir, name))
+		}
+	}
+	return nil, NewCMError(fmt.Sprintf("Bundle does not carry %s", name))
+}
+
+// PreviewBundle tells what importing a bundle would do to each repository,
+// and why it would be refused
+func (engine *CMEngine) PreviewBundle(b *Bundle) ([]RepoPreview, error) {
+	previews := make([]RepoPreview, 0, len(b.Manifest.Repos))
+	for _, repo := range b.Manifest.Repos {
+		ctype := StringToCMType(repo.Repository)
+		if err := engine.MakeRepo(ctype); err != nil {
+			return nil, err
+		}
+
+		engine.guard(ctype).Lock()
+		p, err := engine.previewRepo(ctype, b, repo)
+		engine.guard(ctype).Unlock()
+		if err != nil {
+			return nil, err
+		}
+		previews = append(previews, *p)
+	}
+	return previews, nil
+}
+
+/*
+ImportBundle brings the repositories of a bundle up to date with it, merging
+where they have moved on since.  Nothing is imported when any repository
+would take commits that fail verification.  When the imported history has
+commits from before its node began to sign, the signed history of the
+repository starts again at its new master.
+*/
+func (engine *CMEngine) ImportBundle(b *Bundle) ([]RepoPreview, error) {
+	previews, err := engine.PreviewBundle(b)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range previews {
+		if len(p.Problems) > 0 {
+			return previews, NewCMSignatureError(fmt.Sprintf("%s: %s", p.Repository, p.Problems[0]))
+		}
+	}
+
+	for _, p := range previews {
+		if p.UpToDate {
+			continue
+		}
+		ctype := StringToCMType(p.Repository)
+
+		engine.guard(ctype).Lock()
+		err := engine.importRepo(ctype, b, p)
+		engine.guard(ctype).Unlock()
+		if err != nil {
+			return previews, err
+		}
+
+		engine.reset(ctype)
+		engine.runEventCBs(Event{Kind: EventPackReceived, Type: ctype, Objects: p.Objects,
+			Commit: engine.GetLatestCommitID(ctype), SrcNode: b.Signer})
+	}
+	return previews, nil
+}
+
+// previewRepo fetches a repository of a bundle and compares it with master.
+// The caller holds the guard.
+func (engine *CMEngine) previewRepo(ctype CMType, b *Bundle, repo BundleRepo) (*RepoPreview, error) {
+	p := &RepoPreview{Repository: repo.Repository, Head: repo.Head, Problems: make([]string, 0)}
+
+	if _, stderr, err := engine.runC(ctype, "fetch", "-q", filepath.Join(b.dir, repo.File), "+master:"+bundleRef); err != nil {
+		return nil, NewCMError(fmt.Sprintf("Can not read %s from bundle: %s", ctype, strings.TrimSpace(stderr)))
+	}
+	head, err := engine.run(ctype, "rev-parse", bundleRef)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(head) != repo.Head {
+		p.Problems = append(p.Problems, fmt.Sprintf("Bundle head %s is not the one signed", strings.TrimSpace(head)))
+		return p, nil
+	}
+
+	current, err := engine.run(ctype, "rev-parse", "master")
+	if err != nil {
+		return nil, err
+	}
+	p.Current = strings.TrimSpace(current)
+
+	if _, err = engine.run(ctype, "merge-base", "--is-ancestor", bundleRef, "master"); err == nil {
+		p.UpToDate = true
+		p.Commits = make([]CommitSignature, 0)
+		p.Objects = make([]string, 0)
+		return p, nil
+	}
+	_, err = engine.run(ctype, "merge-base", "--is-ancestor", "master", bundleRef)
+	p.FastForward = err == nil
+
+	if p.Commits, err = engine.signatures(ctype, "master.."+bundleRef); err != nil {
+		return nil, err
+	}
+
+	// What the bundle changes since it parted from master, or all of it
+	// when their histories are unrelated
+	base, err := engine.run(ctype, "merge-base", "master", bundleRef)
+	if err != nil {
+		base, err = engine.runWith(ctype, nil, "", "hash-object", "-t", "tree", "--stdin")
+		if err != nil {
+			return nil, err
+		}
+	}
+	base = strings.TrimSpace(base)
+	o, err := engine.run(ctype, "diff", "--name-only", base, bundleRef)
+	if err != nil {
+		return nil, err
+	}
+	p.Objects = dataObjects(o)
+	if p.Diff, err = engine.run(ctype, "diff", base, bundleRef); err != nil {
+		return nil, err
+	}
+
+	// Before the signed history of the bundle, only bad signatures are
+	// refused
+	mustSign := make(map[string]bool)
+	if repo.SignedFrom != "" {
+		o, err := engine.run(ctype, "rev-list", repo.SignedFrom+"^!", bundleRef)
+		if err != nil {
+			p.Problems = append(p.Problems, fmt.Sprintf("Signed history starts at %s, which is not in the bundle", repo.SignedFrom))
+		}
+		for _, c := range strings.Fields(o) {
+			mustSign[c] = true
+		}
+	}
+	for _, c := range p.Commits {
+		if c.Status == SignatureBad || ((repo.SignedFrom == "" || mustSign[c.Commit]) && c.Status != SignatureGood) {
+			p.Problems = append(p.Problems, fmt.Sprintf("Commit %s is %s", c.Commit, c.Status))
+		}
+	}
+	return p, nil
+}
+
+// importRepo moves master to the fetched bundle.  The caller holds the
+// guard.
+func (engine *CMEngine) importRepo(ctype CMType, b *Bundle, p RepoPreview) error {
+	if _, err := engine.run(ctype, "checkout", "-q", "master"); err != nil {
+		return err
+	}
+
+	if p.FastForward {
+		if _, stderr, err := engine.runC(ctype, "merge", "-q", "--ff-only", bundleRef); err != nil {
+			return NewCMError(fmt.Sprintf("Can not import %s: %s", ctype, strings.TrimSpace(stderr)))
+		}
+	} else {
+		msg := fmt.Sprintf("Import bundle from %s", b.Signer)
+		if _, stderr, err := engine.runC(ctype, "merge", "-q", "--no-edit", "--allow-unrelated-histories", "-m", msg, bundleRef); err != nil {
+			engine.run(ctype, "merge", "--abort")
+			return NewCMError(fmt.Sprintf("Can not merge %s: %s", ctype, strings.TrimSpace(stderr)))
+		}
+	}
+
+	restart := false
+	for _, c := range p.Commits {
+		if c.Status != SignatureGood {
+			restart = true
+		}
+		if _, err := engine.run(ctype, sourceNoteArgs(c.Commit, b.Signer)...); err != nil {
+			log.Warning("Could not record the source of %s: %v", c.Commit, err)
+		}
+	}
+	if restart && engine.Signing() {
+		head, err := engine.run(ctype, "rev-parse", "master")
+		if err != nil {
+			return err
+		}
+		if err = engine.setSignedFrom(ctype, strings.TrimSpace(head)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+writeArchive signs a manifest with the key of the node and writes it, its
+signature and the named files in dir as a gzipped tar to w.  namespace
+keeps a signature made for one kind of archive from passing for another.
+*/
+func (engine *CMEngine) writeArchive(w io.Writer, dir, namespace string, m interface{}, created time.Time, files []string) error {
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, bundleManifest), manifest, 0600); err != nil {
+		return err
+	}
+	if out, err := exec.Command("ssh-keygen", "-Y", "sign", "-q", "-f", engine.signingKey,
+		"-n", namespace, filepath.Join(dir, bundleManifest)).CombinedOutput(); err != nil {
+		return NewCMSignatureError(fmt.Sprintf("Can not sign %s: %s", namespace, strings.TrimSpace(string(out))))
+	}
+
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+	for _, name := range append([]string{bundleManifest, bundleSignature}, files...) {
+		content, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), ModTime: created}
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err = tw.Write(content); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+/*
+readArchive unpacks an archive written by writeArchive into dir and checks
+that a trusted node signed its manifest.  It returns the manifest and the
+principal of the signer.  The files the manifest lists are not checked, see
+checkArchived.
+*/
+func (engine *CMEngine) readArchive(r io.Reader, dir, namespace string) ([]byte, string, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, "", NewCMError(fmt.Sprintf("Malformed archive: %s", err.Error()))
+	}
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, "", NewCMError(fmt.Sprintf("Malformed archive: %s", err.Error()))
+		}
+		if hdr.Typeflag != tar.TypeReg || !bundleName(hdr.Name) {
+			return nil, "", NewCMError(fmt.Sprintf("Malformed archive: unexpected entry %s", hdr.Name))
+		}
+		f, err := os.OpenFile(filepath.Join(dir, hdr.Name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return nil, "", NewCMError(fmt.Sprintf("Malformed archive: %s", err.Error()))
+		}
+		_, err = io.Copy(f, tr)
+		f.Close()
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	manifest, err := ioutil.ReadFile(filepath.Join(dir, bundleManifest))
+	if err != nil {
+		return nil, "", NewCMError("Malformed archive: no manifest")
+	}
+	sig := filepath.Join(dir, bundleSignature)
+	o, err := exec.Command("ssh-keygen", "-Y", "find-principals", "-f", engine.allowedSigners, "-s", sig).Output()
+	if err != nil || strings.TrimSpace(string(o)) == "" {
+		return nil, "", NewCMSignatureError("Archive is not signed by a trusted node")
+	}
+	signer := strings.Fields(string(o))[0]
+
+	verify := exec.Command("ssh-keygen", "-Y", "verify", "-f", engine.allowedSigners,
+		"-I", signer, "-n", namespace, "-s", sig)
+	verify.Stdin = bytes.NewReader(manifest)
+	if out, err := verify.CombinedOutput(); err != nil {
+		return nil, "", NewCMSignatureError(fmt.Sprintf("Archive signature does not verify: %s", strings.TrimSpace(string(out))))
+	}
+	return manifest, signer, nil
+}
+
+// checkArchived checks that a file unpacked from an archive is the one its
+// manifest lists
+func checkArchived(dir, name, sum string) error {
+	if !bundleName(name) {
+		return NewCMError(fmt.Sprintf("Malformed archive: unexpected entry %s", name))
+	}
+	got, err := fileSum(filepath.Join(dir, name))
+	if err != nil || got != sum {
+		return NewCMSignatureError(fmt.Sprintf("Archived file %s does not match its manifest", name))
+	}
+	return nil
+}
+
+// bundleName is true for a name that can only be a file in the top of an
+// unpacked bundle
+func bundleName(name string) bool {
+	return name != "" && name != "." && name != ".." && filepath.Base(name) == name && !strings.ContainsAny(name, `/\`)
+}
+
+func fileSum(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,169 @@
+package pbchange
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// repack changes a file of a bundle without signing it again
+func repack(t *testing.T, bundle []byte, name string, content []byte) []byte {
+	zr, err := gzip.NewReader(bytes.NewReader(bundle))
+	checkFatal(t, err)
+	tr := tar.NewReader(zr)
+
+	var out bytes.Buffer
+	zw := gzip.NewWriter(&out)
+	tw := tar.NewWriter(zw)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		checkFatal(t, err)
+		b, err := ioutil.ReadAll(tr)
+		checkFatal(t, err)
+		if hdr.Name == name {
+			b = content
+			hdr.Size = int64(len(b))
+		}
+		checkFatal(t, tw.WriteHeader(hdr))
+		_, err = tw.Write(b)
+		checkFatal(t, err)
+	}
+	checkFatal(t, tw.Close())
+	checkFatal(t, zw.Close())
+	return out.Bytes()
+}
+
+func TestBundle(t *testing.T) {
+	begin(t, "TestBundle")
+	defer end(t, "TestBundle")
+
+	keys, err := ioutil.TempDir("", "keys")
+	checkFatal(t, err)
+	defer os.RemoveAll(keys)
+	control := newKey(t, keys, "control")
+	substation := newKey(t, keys, "substation")
+
+	// The control center makes a bundle
+	cfg := setup()
+	cfg.Global.NodeName = "control"
+	cfg.ChMgmt.SigningKey = control
+	engine, err := GetCMEngine(cfg)
+	checkFatal(t, err)
+	_, err = engine.VersionObject(proposal("relay", "set service FTP on\n"), "")
+	checkFatal(t, err)
+
+	var bundle bytes.Buffer
+	m, err := engine.ExportBundle(&bundle, []CMType{DEVICE, POLICY, REPORT},
+		map[string][]byte{"devices.json": []byte(`[{"Name":"relay"}]`)})
+	checkFatal(t, err)
+	if m.Node != "control" || len(m.Repos) != 1 || m.Repos[0].Repository != "DEVICE" || len(m.Files) != 1 {
+		t.Errorf("Unexpected manifest %+v", m)
+	}
+	if _, err = engine.ExportBundle(ioutil.Discard, []CMType{DEVICE}, map[string][]byte{"../devices.json": nil}); err == nil {
+		t.Errorf("Bundled a file outside the bundle")
+	}
+	cleanup(cfg, engine)
+
+	// A substation that does not trust the control center refuses it
+	cfg = setup()
+	cfg.Global.NodeName = "substation"
+	cfg.ChMgmt.SigningKey = substation
+	engine, err = GetCMEngine(cfg)
+	checkFatal(t, err)
+	if _, err = engine.OpenBundle(bytes.NewReader(bundle.Bytes())); !IsCMSignatureError(err) {
+		t.Errorf("Opened a bundle from an untrusted node: %v", err)
+	}
+	cleanup(cfg, engine)
+
+	// One that does, takes it
+	pub, err := ioutil.ReadFile(control + ".pub")
+	checkFatal(t, err)
+	trusted := filepath.Join(keys, "trusted")
+	checkFatal(t, ioutil.WriteFile(trusted, []byte("control "+string(pub)), 0644))
+
+	cfg = setup()
+	cfg.Global.NodeName = "substation"
+	cfg.ChMgmt.SigningKey = substation
+	cfg.ChMgmt.TrustedSigners = trusted
+	engine, err = GetCMEngine(cfg)
+	defer cleanup(cfg, engine)
+	checkFatal(t, err)
+	_, err = engine.VersionObject(proposal("meter", "set service FTP off\n"), "")
+	checkFatal(t, err)
+
+	tampered := repack(t, bundle.Bytes(), "devices.json", []byte(`[{"Name":"rogue"}]`))
+	if _, err = engine.OpenBundle(bytes.NewReader(tampered)); !IsCMSignatureError(err) {
+		t.Errorf("Opened a tampered bundle: %v", err)
+	}
+
+	b, err := engine.OpenBundle(bytes.NewReader(bundle.Bytes()))
+	checkFatal(t, err)
+	defer b.Close()
+	if b.Signer != "control" {
+		t.Errorf("Expected bundle signed by control, got %q", b.Signer)
+	}
+	if devs, err := b.File("devices.json"); err != nil || string(devs) != `[{"Name":"relay"}]` {
+		t.Errorf("Wrong device metadata %q: %v", devs, err)
+	}
+
+	previews, err := engine.PreviewBundle(b)
+	checkFatal(t, err)
+	if len(previews) != 1 {
+		t.Fatalf("Expected a preview of one repository, got %+v", previews)
+	}
+	p := previews[0]
+	if p.FastForward || p.UpToDate || fmt.Sprint(p.Objects) != "[relay]" || len(p.Problems) != 0 ||
+		!strings.Contains(p.Diff, "+set service FTP on") {
+		t.Errorf("Unexpected preview %+v", p)
+	}
+	if head, _ := engine.run(DEVICE, "rev-parse", "master"); strings.TrimSpace(head) != p.Current {
+		t.Errorf("Preview imported the bundle")
+	}
+
+	_, err = engine.ImportBundle(b)
+	checkFatal(t, err)
+	for object, want := range map[string]string{"relay": "set service FTP on\n", "meter": "set service FTP off\n"} {
+		obj, err := engine.GetObject(DEVICE, object)
+		checkFatal(t, err)
+		if got := string(obj.Content.Files["configFile"]); got != want {
+			t.Errorf("Expected %q in %s after import, got %q", want, object, got)
+		}
+	}
+	v, err := engine.VerifyHistory(DEVICE)
+	checkFatal(t, err)
+	if !v.Valid {
+		t.Errorf("History does not verify after import: %v", v.Problems)
+	}
+
+	previews, err = engine.PreviewBundle(b)
+	checkFatal(t, err)
+	if !previews[0].UpToDate {
+		t.Errorf("Bundle not imported: %+v", previews[0])
+	}
+}
@@ -0,0 +1,335 @@
+package pbchange
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// TrailerChangeSet is written to the commits of a change set
+const TrailerChangeSet = "Change-Set"
+
+// States of the objects of a change set
+const (
+	MemberPending    = "pending"    // Not applied yet
+	MemberApplied    = "applied"    // Took its new content
+	MemberFailed     = "failed"     // Could not take its new content
+	MemberSkipped    = "skipped"    // Not tried, as an earlier object failed
+	MemberRolledBack = "rolledback" // Applied, then returned to its old content
+)
+
+/*
+ChangeSet is a coordinated change to several objects of one repository
+under one transaction.  The new content of every object is versioned in a
+single commit on the transaction branch and lands on master in a single
+merge.  With AllOrNothing set, the objects applied before one failed are
+returned to their old content.  Landed and Reverted are the commits on
+master that brought the new content in and put the old content back.
+*/
+type ChangeSet struct {
+	AllOrNothing bool
+	Members      []ChangeSetMember
+	Landed       string `json:",omitempty"`
+	Reverted     string `json:",omitempty"`
+}
+
+// ChangeSetMember is the state of one object of a change set
+type ChangeSetMember struct {
+	Object  string
+	Status  string
+	Reason  string `json:",omitempty"`
+	Updated time.Time
+}
+
+/*
+BeginChangeSet versions the new content of several objects, all of one
+type, in one commit on a new transaction branch and returns the
+transaction ID.  The first change gives the author.  Nothing reaches master
+until LandChangeSet is called.
+*/
+func (engine *CMEngine) BeginChangeSet(changes []*ChangeData, message string, allOrNothing bool) (string, error) {
+	if len(changes) == 0 {
+		return "", NewCMError("A change set needs at least one change")
+	}
+	first := changes[0]
+	if first.Author == nil || first.Author.Name == "" {
+		return "", NewCMError("A change set needs an author")
+	}
+
+	now := time.Now()
+	set := &ChangeSet{AllOrNothing: allOrNothing, Members: make([]ChangeSetMember, 0, len(changes))}
+	files := make(map[string][]byte)
+	for _, c := range changes {
+		if c.ObjectType != first.ObjectType {
+			return "", NewCMError("The objects of a change set must be of one type")
+		}
+		if c.Content == nil || c.Content.Object == "" {
+			return "", NewCMError("Every change of a change set needs an object")
+		}
+		if set.member(c.Content.Object) != nil {
+			return "", NewCMError(fmt.Sprintf("%s is in the change set more than once", c.Content.Object))
+		}
+		for fname, cont := range c.Content.Files {
+			files[path.Join(c.Content.Object, "data", fname)] = cont
+		}
+		set.Members = append(set.Members, ChangeSetMember{Object: c.Content.Object, Status: MemberPending, Updated: now})
+	}
+	if message == "" {
+		message = fmt.Sprintf("Change set of %d objects", len(changes))
+	}
+
+	data := &ChangeData{ObjectType: first.ObjectType, Author: first.Author, SrcNode: first.SrcNode,
+		TransactionID: first.TransactionID}
+	id, err := engine.openTransaction(data, message)
+	if err != nil {
+		return "", err
+	}
+	engine.transactions.update(id, func(t *Transaction) {
+		t.ChangeSet = set
+	})
+
+	store, err := engine.store(data.ObjectType)
+	if err != nil {
+		engine.setStatus(id, FAILED)
+		return "", err
+	}
+	data.TransactionID = id
+	msg := provenanceMessage(message, data) + fmt.Sprintf("\n%s: %s", TrailerChangeSet, id)
+	commit, err := store.WriteFiles(id, files, data.Author, msg)
+	if err != nil {
+		engine.setStatus(id, FAILED)
+		return "", err
+	}
+	if commit == "" {
+		engine.removeBranch(id, data.ObjectType)
+		engine.transactions.remove(id)
+		return "", NewCMError("The change set does not modify any of its objects")
+	}
+
+	for _, m := range set.Members {
+		engine.commitEvent(&ChangeData{ObjectType: data.ObjectType, Content: NewCMContent(m.Object), Author: data.Author},
+			message, id, commit)
+	}
+	engine.setStatus(id, ACTIVE)
+
+	log.Info("Change set %s of %d objects begun by %s", id, len(set.Members), data.Author.Name)
+	return id, nil
+}
+
+// ChangeSets returns the change sets the engine knows about, oldest first
+func (engine *CMEngine) ChangeSets() []Transaction {
+	sets := make([]Transaction, 0)
+	for _, t := range engine.transactions.list() {
+		if t.ChangeSet != nil {
+			sets = append(sets, t)
+		}
+	}
+	return sets
+}
+
+func (engine *CMEngine) GetChangeSet(id string) (Transaction, error) {
+	t, ok := engine.transactions.get(id)
+	if !ok || t.ChangeSet == nil {
+		return Transaction{}, NewCMError("Unknown change set")
+	}
+	return t, nil
+}
+
+// LandChangeSet merges an active change set into master and returns the
+// merge commit
+func (engine *CMEngine) LandChangeSet(id string) (string, error) {
+	t, err := engine.GetChangeSet(id)
+	if err != nil {
+		return "", err
+	}
+	if t.Status != ACTIVE || t.ChangeSet.Landed != "" {
+		return "", NewCMError(fmt.Sprintf("Change set %s is %s, it can not land", id, t.Status))
+	}
+
+	lines := []string{fmt.Sprintf("Merge change set %s", id), ""}
+	if t.Message != "" {
+		lines = append(lines, t.Message, "")
+	}
+	lines = append(lines, fmt.Sprintf("%s: %s", TrailerChangeSet, id))
+
+	commit, stderr, err := engine.mergeToMaster(t.Ctype, t.Author, strings.Join(lines, "\n"), t.Branch)
+	if stderr != "" {
+		log.Warning("Merging change set %s failed: %s", id, stderr)
+		return "", NewCMError(fmt.Sprintf("Change set %s does not merge cleanly into master", id))
+	}
+	if err != nil {
+		return "", err
+	}
+
+	engine.transactions.update(id, func(t *Transaction) {
+		t.ChangeSet = t.ChangeSet.copy()
+		t.ChangeSet.Landed = commit
+	})
+	log.Notice("Change set %s landed on master", id)
+	return commit, nil
+}
+
+// SetMemberStatus records how applying one object of a change set went
+func (engine *CMEngine) SetMemberStatus(id, object, status, reason string) error {
+	var merr error
+	err := engine.transactions.update(id, func(t *Transaction) {
+		var m *ChangeSetMember
+		if t.ChangeSet != nil {
+			t.ChangeSet = t.ChangeSet.copy()
+			m = t.ChangeSet.member(object)
+		}
+		if m == nil {
+			merr = NewCMError(fmt.Sprintf("%s is not in change set %s", object, id))
+			return
+		}
+		m.Status = status
+		m.Reason = reason
+		m.Updated = time.Now()
+	})
+	if err != nil {
+		return err
+	}
+	return merr
+}
+
+/*
+RevertChangeSet puts the content the given objects had before a landed
+change set back on master, in one commit, and returns it.  Objects the set
+created have no old content and are left as they are.
+*/
+func (engine *CMEngine) RevertChangeSet(id string, objects []string, author *CMAuthor, reason string) (string, error) {
+	t, err := engine.GetChangeSet(id)
+	if err != nil {
+		return "", err
+	}
+	if t.ChangeSet.Landed == "" {
+		return "", NewCMError(fmt.Sprintf("Change set %s has not landed", id))
+	}
+	if author == nil {
+		author = t.Author
+	}
+
+	store, err := engine.store(t.Ctype)
+	if err != nil {
+		return "", err
+	}
+	landed, err := store.ReadCommit(t.ChangeSet.Landed)
+	if err != nil {
+		return "", err
+	}
+	if len(landed.Parents) == 0 {
+		return "", NewCMError(fmt.Sprintf("Change set %s has no earlier content", id))
+	}
+	before := landed.Parents[0]
+
+	files := make(map[string][]byte)
+	for _, object := range objects {
+		old, err := store.ReadFiles(before, path.Join(object, "data"))
+		if err != nil {
+			return "", err
+		}
+		for name, cont := range old {
+			files[name] = cont
+		}
+	}
+	if len(files) == 0 {
+		return "", nil
+	}
+
+	lines := []string{fmt.Sprintf("Roll back change set %s", id), ""}
+	if reason != "" {
+		lines = append(lines, strings.TrimSpace(reason), "")
+	}
+	lines = append(lines,
+		fmt.Sprintf("%s: %s", TrailerRollbackTo, before),
+		fmt.Sprintf("%s: %s", TrailerChangeSet, id))
+
+	commit, err := store.WriteFiles("master", files, author, strings.Join(lines, "\n"))
+	if err != nil {
+		return "", err
+	}
+	if commit != "" {
+		engine.transactions.update(id, func(t *Transaction) {
+			t.ChangeSet = t.ChangeSet.copy()
+			t.ChangeSet.Reverted = commit
+		})
+		log.Notice("Change set %s rolled back for %s", id, strings.Join(objects, ", "))
+	}
+	return commit, nil
+}
+
+/*
+FinalizeChangeSet ends a change set.  Once it has landed, the commit
+listeners are run for every object of the set, with the object as it now
+is on master, and one transaction event names them all.
+*/
+func (engine *CMEngine) FinalizeChangeSet(id string, status TransactionStatus) error {
+	t, err := engine.GetChangeSet(id)
+	if err != nil {
+		return err
+	}
+	rerr := engine.setStatus(id, status)
+
+	objects := make([]string, 0, len(t.ChangeSet.Members))
+	for _, m := range t.ChangeSet.Members {
+		objects = append(objects, m.Object)
+		if t.ChangeSet.Landed == "" {
+			continue
+		}
+		cdata, err := engine.GetObject(t.Ctype, m.Object)
+		if err != nil {
+			log.Warning("Change set %s: can not read %s back: %s", id, m.Object, err.Error())
+			continue
+		}
+		cdata.TransactionID = id
+		cdata.SrcNode = t.SrcNode
+		engine.runCommitCBs(t.Ctype, cdata)
+	}
+
+	engine.runEventCBs(Event{
+		Kind:        EventTransaction,
+		Type:        t.Ctype,
+		Objects:     objects,
+		Commit:      t.ChangeSet.Landed,
+		Transaction: id,
+		Status:      status.String(),
+		Author:      t.Author,
+		Message:     t.Message,
+		SrcNode:     t.SrcNode,
+	})
+	return rerr
+}
+
+func (cs *ChangeSet) member(object string) *ChangeSetMember {
+	for i := range cs.Members {
+		if cs.Members[i].Object == object {
+			return &cs.Members[i]
+		}
+	}
+	return nil
+}
+
+// copy returns a change set that shares nothing with cs, for an update to
+// leave the copies already handed out alone
+func (cs *ChangeSet) copy() *ChangeSet {
+	c := *cs
+	c.Members = append([]ChangeSetMember(nil), cs.Members...)
+	return &c
+}
@@ -0,0 +1,143 @@
+package pbchange
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestChangeSets(t *testing.T) {
+	begin(t, "TestChangeSets")
+	defer end(t, "TestChangeSets")
+
+	cfg := setup()
+	engine, err := GetCMEngine(cfg)
+	defer cleanup(cfg, engine)
+	checkFatal(t, err)
+
+	var events []Event
+	engine.RegisterEventListener(func(ev Event) {
+		if ev.Kind == EventTransaction {
+			events = append(events, ev)
+		}
+	})
+
+	_, err = engine.VersionObject(proposal("relay1", "set password L2 old\n"), "")
+	checkFatal(t, err)
+	_, err = engine.VersionObject(proposal("relay2", "set password L2 old\n"), "")
+	checkFatal(t, err)
+
+	if _, err = engine.BeginChangeSet(nil, "", true); err == nil {
+		t.Errorf("Began an empty change set")
+	}
+	twice := []*ChangeData{proposal("relay1", "set password L2 new\n"), proposal("relay1", "set password L2 new\n")}
+	if _, err = engine.BeginChangeSet(twice, "", true); err == nil {
+		t.Errorf("Began a change set with an object twice")
+	}
+	mixed := []*ChangeData{proposal("relay1", "set password L2 new\n"), proposal("relay2", "set password L2 new\n")}
+	mixed[1].ObjectType = POLICY
+	if _, err = engine.BeginChangeSet(mixed, "", true); err == nil {
+		t.Errorf("Began a change set of mixed types")
+	}
+	same := []*ChangeData{proposal("relay1", "set password L2 old\n")}
+	if _, err = engine.BeginChangeSet(same, "", true); err == nil {
+		t.Errorf("Began a change set that changes nothing")
+	}
+
+	changes := []*ChangeData{
+		proposal("relay1", "set password L2 new\n"),
+		proposal("relay2", "set password L2 new\n"),
+		proposal("relay3", "set password L2 new\n"),
+	}
+	id, err := engine.BeginChangeSet(changes, "Rotate the level 2 password", true)
+	checkFatal(t, err)
+
+	// Nothing on master until it lands
+	cd, err := engine.GetObject(DEVICE, "relay1")
+	checkFatal(t, err)
+	if string(cd.Content.Files["configFile"]) != "set password L2 old\n" {
+		t.Errorf("Change set leaked into master")
+	}
+
+	commit, err := engine.LandChangeSet(id)
+	checkFatal(t, err)
+	body, err := engine.run(DEVICE, "log", "-1", "--format=%B", commit)
+	checkFatal(t, err)
+	if !strings.Contains(body, TrailerChangeSet+": "+id) {
+		t.Errorf("Unexpected merge commit:\n%s", body)
+	}
+	if _, err = engine.LandChangeSet(id); err == nil {
+		t.Errorf("Landed a change set twice")
+	}
+	for _, o := range []string{"relay1", "relay2", "relay3"} {
+		cd, err := engine.GetObject(DEVICE, o)
+		checkFatal(t, err)
+		if string(cd.Content.Files["configFile"]) != "set password L2 new\n" {
+			t.Errorf("%s did not land: %q", o, cd.Content.Files["configFile"])
+		}
+	}
+
+	// The second relay fails, the first is put back and the third skipped
+	checkFatal(t, engine.SetMemberStatus(id, "relay1", MemberApplied, ""))
+	checkFatal(t, engine.SetMemberStatus(id, "relay2", MemberFailed, "Timed out"))
+	checkFatal(t, engine.SetMemberStatus(id, "relay3", MemberSkipped, ""))
+	checkFatal(t, engine.SetMemberStatus(id, "relay1", MemberRolledBack, ""))
+	if err = engine.SetMemberStatus(id, "breaker", MemberApplied, ""); err == nil {
+		t.Errorf("Set the status of an object not in the change set")
+	}
+
+	reverted, err := engine.RevertChangeSet(id, []string{"relay1", "relay2", "relay3"}, nil, "Timed out")
+	checkFatal(t, err)
+	if reverted == "" {
+		t.Fatalf("Nothing rolled back")
+	}
+	for _, o := range []string{"relay1", "relay2"} {
+		cd, err := engine.GetObject(DEVICE, o)
+		checkFatal(t, err)
+		if string(cd.Content.Files["configFile"]) != "set password L2 old\n" {
+			t.Errorf("%s not rolled back: %q", o, cd.Content.Files["configFile"])
+		}
+	}
+
+	checkFatal(t, engine.FinalizeChangeSet(id, FAILED))
+	tr, err := engine.GetChangeSet(id)
+	checkFatal(t, err)
+	if tr.Status != FAILED || tr.ChangeSet.Landed != commit || tr.ChangeSet.Reverted != reverted {
+		t.Errorf("Unexpected change set %+v %+v", tr, tr.ChangeSet)
+	}
+	want := []string{MemberRolledBack, MemberFailed, MemberSkipped}
+	for i, m := range tr.ChangeSet.Members {
+		if m.Status != want[i] {
+			t.Errorf("%s is %s, expected %s", m.Object, m.Status, want[i])
+		}
+	}
+	if tr.ChangeSet.Members[1].Reason != "Timed out" {
+		t.Errorf("Unexpected reason %q", tr.ChangeSet.Members[1].Reason)
+	}
+
+	if len(events) != 1 || events[0].Transaction != id || events[0].Status != FAILED.String() ||
+		strings.Join(events[0].Objects, " ") != "relay1 relay2 relay3" {
+		t.Errorf("Unexpected events %+v", events)
+	}
+	if len(engine.ChangeSets()) != 1 {
+		t.Errorf("Unexpected change sets %+v", engine.ChangeSets())
+	}
+	if _, err = engine.GetChangeSet("nope"); err == nil {
+		t.Errorf("Found an unknown change set")
+	}
+}
@@ -18,6 +18,7 @@ package pbchange
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"io"
 	"os"
@@ -30,9 +31,9 @@ func (engine *CMEngine) saveMeta(oname string, metadata map[string]string) error
 	// Metatdata is always going to be a device
 	otype := DEVICE
 
-	engine.guard.Unlock()
+	engine.guard(DEVICE).Unlock()
 	engine.reset(otype)
-	engine.guard.Lock()
+	engine.guard(DEVICE).Lock()
 
 	metapath := filepath.Join(engine.Repopath, otype.String(), oname, "meta/")
 	metafile := filepath.Join(metapath, "meta.db")
@@ -65,8 +66,8 @@ func (engine *CMEngine) saveMeta(oname string, metadata map[string]string) error
 
 // Wraps loadMeta to handle locking
 func (engine *CMEngine) LoadMeta(oname string) (map[string]string, error) {
-	engine.guard.Lock()
-	defer engine.guard.Unlock()
+	engine.guard(DEVICE).Lock()
+	defer engine.guard(DEVICE).Unlock()
 
 	return engine.loadMeta(oname)
 }
@@ -76,9 +77,9 @@ func (engine *CMEngine) loadMeta(oname string) (map[string]string, error) {
 	otype := DEVICE
 
 	// Reset locks, so unlock, then relock
-	engine.guard.Unlock()
+	engine.guard(DEVICE).Unlock()
 	engine.reset(otype)
-	engine.guard.Lock()
+	engine.guard(DEVICE).Lock()
 
 	metapath := filepath.Join(engine.Repopath, otype.String(), oname, "meta")
 	metafile := filepath.Join(metapath, "meta.db")
@@ -131,9 +132,31 @@ func (engine *CMEngine) loadMeta(oname string) (map[string]string, error) {
 	return metadata, nil
 }
 
+// GetMetaAt returns the metadata of a device as it was at the given
+// commit, without touching the working tree.  A device without metadata
+// has none.
+func (engine *CMEngine) GetMetaAt(oname, commit string) (map[string]string, error) {
+	store, err := engine.store(DEVICE)
+	if err != nil {
+		return nil, err
+	}
+	files, err := store.ReadFiles(commit, filepath.Join(oname, "meta"))
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := make(map[string]string)
+	if in := files[filepath.Join(oname, "meta", "meta.db")]; len(bytes.TrimSpace(in)) != 0 {
+		if err := json.Unmarshal(in, &metadata); err != nil {
+			return nil, err
+		}
+	}
+	return metadata, nil
+}
+
 func (engine *CMEngine) GetMeta(oname string, key string) (string, error) {
-	engine.guard.Lock()
-	defer engine.guard.Unlock()
+	engine.guard(DEVICE).Lock()
+	defer engine.guard(DEVICE).Unlock()
 
 	if _, err := engine.run(DEVICE, "checkout", "master"); err != nil {
 		return "", err
@@ -157,8 +180,8 @@ func (engine *CMEngine) DeleteMeta(oname, key string) error {
 	metapath := filepath.Join(engine.Repopath, DEVICE.String(), oname,
 		"meta/meta.db")
 
-	engine.guard.Lock()
-	defer engine.guard.Unlock()
+	engine.guard(DEVICE).Lock()
+	defer engine.guard(DEVICE).Unlock()
 	if _, err := engine.run(DEVICE, "checkout", "master"); err != nil {
 		return err
 	}
@@ -203,8 +226,8 @@ func (engine *CMEngine) VersionMeta(oname, key, val string) error {
 
 	log.Debug("Metapath: %s", metapath)
 
-	engine.guard.Lock()
-	defer engine.guard.Unlock()
+	engine.guard(DEVICE).Lock()
+	defer engine.guard(DEVICE).Unlock()
 
 	log.Debug("checking out master")
 	if _, err := engine.run(DEVICE, "checkout", "master"); err != nil {
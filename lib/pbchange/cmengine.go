@@ -20,7 +20,6 @@ import (
 	"bytes"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -78,16 +77,45 @@ func initCMEngine(cfg *config.Config) (*CMEngine, error) {
 		}
 	}
 
+	if err = checkStorage(cfg.ChMgmt.Storage); err != nil {
+		return nil, err
+	}
+
+	reviewerRole := cfg.ChMgmt.ReviewerRole
+	if reviewerRole == "" {
+		reviewerRole = "admin"
+	}
+
 	e := &CMEngine{
-		Repopath:    path,
-		binpath:     binpath,
-		UploadPack:  true,
-		ReceivePack: true,
+		Repopath:        path,
+		binpath:         binpath,
+		storage:         cfg.ChMgmt.Storage,
+		UploadPack:      true,
+		ReceivePack:     true,
+		RequireApproval: cfg.ChMgmt.RequireApproval,
+		ReviewerRole:    reviewerRole,
+	}
+
+	// Only a key configured for signing is used, never the key of the web
+	// server
+	if key := cfg.ChMgmt.SigningKey; key != "" && key == cfg.WebAPI.ServerKey {
+		return nil, NewCMSignatureError("The signing key must not be the key of the web server")
+	}
+	if err = e.setupSigning(cfg.ChMgmt.SigningKey, cfg.ChMgmt.TrustedSigners, cfg.Global.NodeName); err != nil {
+		return nil, err
+	}
+	if err = e.verifyRepos(); err != nil {
+		return nil, err
 	}
 
 	e.commitCBs = make([]*cbStore, 0)
 	e.packRcvdCBs = make([]*cbStore, 0)
 
+	e.transactions = newTransactionStore(path)
+	if err = e.recoverTransactions(); err != nil {
+		return nil, err
+	}
+
 	return e, nil
 }
 
@@ -103,8 +131,8 @@ func (engine *CMEngine) reset(cmtype CMType) {
 		return
 	}
 
-	engine.guard.Lock()
-	defer engine.guard.Unlock()
+	engine.guard(cmtype).Lock()
+	defer engine.guard(cmtype).Unlock()
 
 	_, err := engine.run(cmtype, "reset", "--hard")
 	if err != nil {
@@ -115,16 +143,16 @@ func (engine *CMEngine) reset(cmtype CMType) {
 }
 
 func (engine *CMEngine) GetLatestCommitID(cmtype CMType) string {
-	engine.guard.Lock()
-	defer engine.guard.Unlock()
-
-	id, err := engine.run(cmtype, "log", "--pretty=format:\"%H\"", "-1")
+	store, err := engine.store(cmtype)
+	if err != nil {
+		return ""
+	}
+	id, err := store.Resolve("master")
 	if err != nil {
 		log.Info("Reset Error: %v\n", err)
 		return ""
 	}
-
-	return string(id)
+	return quoted(id)
 }
 
 func (engine *CMEngine) HasBranch(cmtype CMType, branch string) bool {
@@ -153,15 +181,6 @@ func (engine *CMEngine) VersionObject(data *ChangeData, message string, branch .
 		useBranch = branch[0]
 	}
 
-	var werr error
-	filesAdded := false
-
-	defer func() {
-		if werr != nil || !filesAdded {
-			engine.reset(data.ObjectType)
-		}
-	}()
-
 	log.Debug("Ensuring repo exists")
 	if err := engine.MakeRepo(data.ObjectType); err != nil {
 		return "", err
@@ -172,82 +191,14 @@ func (engine *CMEngine) VersionObject(data *ChangeData, message string, branch .
 		message = "Automatically added by Change Management Engine"
 	}
 
-	// Make sure we're on the correct branch
-	log.Info("Resetting repo")
-	engine.reset(data.ObjectType)
-
-	engine.guard.Lock()
-	if _, err := engine.run(data.ObjectType, "checkout", useBranch); err != nil {
-		log.Warning("Got Error: %v\n", err)
-		engine.guard.Unlock()
-		return "", err
-	}
-
-	// Write the file out
-	var fsObjPath string
-	if dir, err := engine.getGitDir(data.ObjectType); err != nil {
-		engine.guard.Unlock()
+	rval, err := engine.writeObject(data, "data", provenanceMessage(message, data), useBranch)
+	if err != nil {
 		return "", err
-	} else {
-		fsObjPath = filepath.Join(dir, data.Content.Object)
-	}
-	fsFilePath := filepath.Join(fsObjPath, "data")
-	repoFileBase := filepath.Join(data.Content.Object, "data")
-
-	os.MkdirAll(fsFilePath, os.ModeDir|0700)
-
-	for fname, cont := range data.Content.Files {
-		werr = ioutil.WriteFile(filepath.Join(fsFilePath, fname), cont, os.ModePerm)
-		if werr != nil {
-			log.Warning("Error: %v\n", werr)
-			engine.guard.Unlock()
-			return "", werr
-		}
-
-		// Ad the file to the index
-		_, werr = engine.run(data.ObjectType, "add", filepath.Join(repoFileBase, fname))
-		if werr != nil {
-			log.Warning("Error: %v\n", werr)
-			engine.guard.Unlock()
-			return "", werr
-		}
 	}
 
-	if o, werr := engine.run(data.ObjectType, "status", "--porcelain"); werr != nil {
-		log.Warning("Could not determine repo status: %v", werr)
-		return "", werr
-	} else {
-		if o != "" {
-			filesAdded = true
-		}
+	if rval != "" {
+		engine.commitEvent(data, message, useBranch, rval)
 	}
-
-	// Commit
-
-	if filesAdded {
-		_, werr = engine.run(data.ObjectType, "commit", "-m", message, "--author",
-			fmt.Sprintf("%s <%s>", data.Author.Name, data.Author.Email))
-		if werr != nil {
-			log.Warning("Error: %v\n", werr)
-			engine.guard.Unlock()
-			return "", werr
-		}
-	}
-
-	// GetLatestCommitID() does its own locking
-	engine.guard.Unlock()
-
-	var rval string
-	if filesAdded {
-		rval = engine.GetLatestCommitID(data.ObjectType)
-	} else {
-		rval = ""
-	}
-
-	engine.guard.Lock()
-	engine.run(data.ObjectType, "checkout", "master")
-	engine.guard.Unlock()
-
 	return rval, nil
 }
 
@@ -263,8 +214,6 @@ func dirExists(path string) (bool, error) {
 }
 
 func (engine *CMEngine) ListObjects(otype CMType) ([]string, error) {
-	engine.reset(otype)
-
 	path := filepath.Join(engine.Repopath, otype.String())
 	r := make([]string, 0)
 	exists, err := dirExists(path)
@@ -275,19 +224,27 @@ func (engine *CMEngine) ListObjects(otype CMType) ([]string, error) {
 		return r, NewCMNoRepoError(otype.String())
 	}
 
-	objects, walkerr := ioutil.ReadDir(path)
-	for _, o := range objects {
-		if strings.HasPrefix(o.Name(), ".") {
+	// List the committed tree, not the working tree a write may be using
+	store, err := engine.store(otype)
+	if err != nil {
+		return r, err
+	}
+	names, err := store.ListDir("master", "")
+	if err != nil {
+		return r, err
+	}
+	for _, name := range names {
+		if strings.HasPrefix(name, ".") {
 			continue
 		}
-		if o.Name() == "README" {
+		if name == "README" {
 			continue
 		}
 
-		r = append(r, o.Name())
+		r = append(r, name)
 	}
 
-	return r, walkerr
+	return r, nil
 }
 
 func (engine *CMEngine) RemoveObject(otype CMType, oname string, author *CMAuthor) error {
@@ -295,8 +252,8 @@ func (engine *CMEngine) RemoveObject(otype CMType, oname string, author *CMAutho
 
 	basePath := filepath.Join(engine.Repopath, otype.String(), oname)
 
-	engine.guard.Lock()
-	defer engine.guard.Unlock()
+	engine.guard(otype).Lock()
+	defer engine.guard(otype).Unlock()
 
 	_, err := engine.run(otype, "rm", "-r", basePath)
 	if err != nil {
@@ -317,8 +274,8 @@ func (engine *CMEngine) RenameObject(otype CMType, oname string, newname string,
 
 	srcPath := filepath.Join(engine.Repopath, otype.String(), oname)
 	destPath := filepath.Join(engine.Repopath, otype.String(), newname)
-	engine.guard.Lock()
-	defer engine.guard.Unlock()
+	engine.guard(otype).Lock()
+	defer engine.guard(otype).Unlock()
 
 	_, err := engine.run(otype, "mv", srcPath, destPath)
 	if err != nil {
@@ -335,50 +292,44 @@ func (engine *CMEngine) RenameObject(otype CMType, oname string, newname string,
 }
 
 func (engine *CMEngine) GetObject(otype CMType, oname string) (*ChangeData, error) {
+	return engine.getCommitted(otype, oname, "data")
+}
 
-	cd := &ChangeData{ObjectType: otype}
+// getCommitted returns an object as of the last commit on master.  Reads
+// go to the committed tree, so they do not wait for writes in progress.
+func (engine *CMEngine) getCommitted(otype CMType, oname, sub string) (*ChangeData, error) {
 
-	// Git reset
-	engine.reset(otype)
+	cd := &ChangeData{ObjectType: otype}
 
-	ll, err := engine.Log(otype, oname, 1)
+	store, err := engine.store(otype)
 	if err != nil {
 		return nil, err
 	}
-
-	cd.Log = &ll[0]
-	cd.CommitID = ll[0].Id
-	cd.Author = &CMAuthor{
-		Name:  ll[0].Author,
-		Email: ll[0].AuthorEmail,
-		When:  ll[0].Time,
+	id, err := store.Resolve("master")
+	if err != nil {
+		return nil, err
+	}
+	c, err := store.ReadCommit(id)
+	if err != nil {
+		return nil, err
 	}
 
-	objectPath := filepath.Join(otype.String(), oname, "data")
-	basePath := filepath.Join(engine.Repopath, objectPath)
-
-	content := &CMContent{Object: oname}
-	content.Files = make(map[string][]byte, 1)
-
-	filepath.Walk(basePath, func(path string, info os.FileInfo, err error) error {
-		if path == basePath {
-			return err
-		}
-
-		f, e := os.Open(path)
-		if e != nil {
-			return e
-		}
-
-		buf, e := ioutil.ReadAll(f)
-		if e != nil {
-			return e
-		}
-		content.Files[info.Name()] = buf
-		return err
-	})
+	cd.Log = &LogLine{
+		Time:           c.Committer.When,
+		Id:             c.ID,
+		Message:        c.Subject(),
+		Author:         c.Author.Name,
+		AuthorEmail:    c.Author.Email,
+		Committer:      c.Committer.Name,
+		CommitterEmail: c.Committer.Email,
+	}
+	cd.CommitID = c.ID
+	cd.Author = c.Author
 
-	cd.Content = content
+	cd.Content, err = engine.committedContent(otype, cd.CommitID, oname, sub)
+	if err != nil {
+		return nil, err
+	}
 
 	return cd, nil
 }
@@ -419,19 +370,47 @@ func (engine *CMEngine) Pull(cmtype CMType, upstream Upstream) error {
 
 	// Should never need a transaction for a pull
 
+	before, err := engine.run(cmtype, "rev-parse", "master")
+	if err != nil {
+		return err
+	}
+	before = strings.TrimSpace(before)
+
 	// When using self signed certificates, Git needs to bypass certificate
 	// validity checks.
-	//stdout, stderr, err := engine.runC(cmtype, "-c", "http.sslVerify=false", "pull", upurl)
+	//stdout, stderr, err := engine.runC(cmtype, "-c", "http.sslVerify=false", "fetch", upurl, "master")
 
 	// When using certificates that the host system can validate, make sure
 	// that Git is verifying certificates
-	stdout, stderr, err := engine.runC(cmtype, "-c", "http.sslVerify=false", "pull", upurl)
+	stdout, stderr, err := engine.runC(cmtype, "-c", "http.sslVerify=false", "fetch", upurl, "master")
 	log.Debug("Out: %s\nErr: %s", stdout, stderr)
 	if err != nil {
 		return NewCMCommunicationError(stdout, err)
 	}
 
-	return nil
+	engine.guard(cmtype).Lock()
+	remote, err := engine.run(cmtype, "rev-parse", "FETCH_HEAD")
+	if err != nil {
+		engine.guard(cmtype).Unlock()
+		return err
+	}
+	remote = strings.TrimSpace(remote)
+
+	// Refuse history no trusted node signed before it touches master
+	if engine.allowedSigners != "" {
+		if err = engine.verifyRange(cmtype, before, remote); err != nil {
+			engine.guard(cmtype).Unlock()
+			log.Error("Pulled history of %s fails verification: %s", cmtype, err.Error())
+			return err
+		}
+	}
+
+	ids, err := engine.mergeUpstream(cmtype, upstream.IP(), remote)
+	engine.guard(cmtype).Unlock()
+	if len(ids) != 0 {
+		engine.conflictEvents(ids)
+	}
+	return err
 }
 
 func (engine *CMEngine) Log(cmtype CMType, path string, limit ...int) ([]LogLine, error) {
@@ -442,22 +421,17 @@ func (engine *CMEngine) Log(cmtype CMType, path string, limit ...int) ([]LogLine
 
 	loglines := make([]LogLine, 0)
 
-	engine.reset(cmtype)
-
-	engine.guard.Lock()
-	defer engine.guard.Unlock()
-
 	var o string
 	var err error
 	if len(limit) == 0 || limit[0] == 0 {
-		o, err = engine.run(cmtype, "log", format)
+		o, err = engine.run(cmtype, "log", format, "master")
 		if err != nil {
 			return nil, err
 		}
 	} else {
 		log.Debug("Called with limit >%v<", limit[0])
 		o, err = engine.run(cmtype, "log", format,
-			fmt.Sprintf("-%d", limit[0]))
+			fmt.Sprintf("-%d", limit[0]), "master")
 		if err != nil {
 			return nil, err
 		}
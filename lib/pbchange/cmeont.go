@@ -27,9 +27,9 @@ func (engine *CMEngine) saveOntology(ontology string) error {
 
 	otype := ONTOLOGY
 
-	engine.guard.Unlock()
+	engine.guard(ONTOLOGY).Unlock()
 	engine.reset(otype)
-	engine.guard.Lock()
+	engine.guard(ONTOLOGY).Lock()
 
 	fspath := filepath.Join(engine.Repopath, otype.String())
 	ontfile := filepath.Join(fspath, "ontology")
@@ -58,9 +58,9 @@ func (engine *CMEngine) saveOntology(ontology string) error {
 func (engine *CMEngine) loadOntology() (string, error) {
 	otype := ONTOLOGY
 
-	engine.guard.Unlock()
+	engine.guard(ONTOLOGY).Unlock()
 	engine.reset(otype)
-	engine.guard.Lock()
+	engine.guard(ONTOLOGY).Lock()
 
 	fspath := filepath.Join(engine.Repopath, otype.String())
 	ontfile := filepath.Join(fspath, "ontology")
@@ -16,13 +16,6 @@ package pbchange
    limitations under the License.
 ***********************************************************************/
 
-import (
-	"fmt"
-	"io/ioutil"
-	"os"
-	"path/filepath"
-)
-
 func (engine *CMEngine) VersionRaw(data *ChangeData, message string, branch ...string) (string, error) {
 
 	var useBranch string
@@ -33,15 +26,6 @@ func (engine *CMEngine) VersionRaw(data *ChangeData, message string, branch ...s
 		useBranch = branch[0]
 	}
 
-	var werr error
-	filesAdded := false
-
-	defer func() {
-		if werr != nil || !filesAdded {
-			engine.reset(data.ObjectType)
-		}
-	}()
-
 	log.Debug("Ensuring repo exists")
 	if err := engine.MakeRepo(data.ObjectType); err != nil {
 		return "", err
@@ -52,144 +36,17 @@ func (engine *CMEngine) VersionRaw(data *ChangeData, message string, branch ...s
 		message = "Automatically added by Change Management Engine"
 	}
 
-	// Make sure we're on the correct branch
-	log.Info("Resetting repo")
-	engine.reset(data.ObjectType)
-
-	engine.guard.Lock()
-	if _, err := engine.run(data.ObjectType, "checkout", useBranch); err != nil {
-		log.Warning("Got Error: %v\n", err)
-		engine.guard.Unlock()
-		return "", err
-	}
-
-	// Write the file out
-	var fsObjPath string
-	if dir, err := engine.getGitDir(data.ObjectType); err != nil {
-		engine.guard.Unlock()
+	rval, err := engine.writeObject(data, "raw", message, useBranch)
+	if err != nil {
 		return "", err
-	} else {
-		fsObjPath = filepath.Join(dir, data.Content.Object)
-	}
-	fsFilePath := filepath.Join(fsObjPath, "raw")
-	repoFileBase := filepath.Join(data.Content.Object, "raw")
-
-	os.MkdirAll(fsFilePath, os.ModeDir|0700)
-
-	for fname, cont := range data.Content.Files {
-
-		// Create creates the named file with mode 0600 (before umask),
-		// truncating it if it already exists.
-		var f *os.File
-		f, werr = os.Create(filepath.Join(fsFilePath, fname))
-		if werr != nil {
-			log.Warning("Error: %v\n", werr)
-			engine.guard.Unlock()
-			return "", werr
-		} else {
-			// we don't actually need the open file here
-			f.Close()
-		}
-
-		werr = ioutil.WriteFile(filepath.Join(fsFilePath, fname), cont, os.ModePerm)
-		if werr != nil {
-			log.Warning("Error: %v\n", werr)
-			engine.guard.Unlock()
-			return "", werr
-		}
-
-		// Ad the file to the index
-		_, werr = engine.run(data.ObjectType, "add", filepath.Join(repoFileBase, fname))
-		if werr != nil {
-			log.Warning("Error: %v\n", werr)
-			engine.guard.Unlock()
-			return "", werr
-		}
 	}
 
-	if o, werr := engine.run(data.ObjectType, "status", "--porcelain"); werr != nil {
-		log.Warning("Could not determine repo status: %v", werr)
-		return "", werr
-	} else {
-		if o != "" {
-			filesAdded = true
-		}
+	if rval != "" {
+		engine.commitEvent(data, message, useBranch, rval)
 	}
-
-	// Commit
-
-	if filesAdded {
-		_, werr = engine.run(data.ObjectType, "commit", "-m", message, "--author",
-			fmt.Sprintf("%s <%s>", data.Author.Name, data.Author.Email))
-		if werr != nil {
-			log.Warning("Error: %v\n", werr)
-			engine.guard.Unlock()
-			return "", werr
-		}
-	}
-
-	// GetLatestCommitID() does its own locking
-	engine.guard.Unlock()
-
-	var rval string
-	if filesAdded {
-		rval = engine.GetLatestCommitID(data.ObjectType)
-	} else {
-		rval = ""
-	}
-
-	engine.guard.Lock()
-	engine.run(data.ObjectType, "checkout", "master")
-	engine.guard.Unlock()
-
 	return rval, nil
 }
 
 func (engine *CMEngine) GetRawObject(otype CMType, oname string) (*ChangeData, error) {
-
-	cd := &ChangeData{ObjectType: otype}
-
-	// Git reset
-	engine.reset(otype)
-
-	ll, err := engine.Log(otype, oname, 1)
-	if err != nil {
-		return nil, err
-	}
-
-	cd.Log = &ll[0]
-	cd.CommitID = ll[0].Id
-	cd.Author = &CMAuthor{
-		Name:  ll[0].Author,
-		Email: ll[0].AuthorEmail,
-		When:  ll[0].Time,
-	}
-
-	objectPath := filepath.Join(otype.String(), oname, "raw")
-	basePath := filepath.Join(engine.Repopath, objectPath)
-
-	content := &CMContent{Object: oname}
-	content.Files = make(map[string][]byte, 1)
-
-	filepath.Walk(basePath, func(path string, info os.FileInfo, err error) error {
-		if path == basePath {
-			return err
-		}
-
-		f, e := os.Open(path)
-		if e != nil {
-			return e
-		}
-
-		buf, e := ioutil.ReadAll(f)
-		if e != nil {
-			return e
-		}
-		content.Files[info.Name()] = buf
-		return err
-	})
-
-	cd.Content = content
-
-	return cd, nil
+	return engine.getCommitted(otype, oname, "raw")
 }
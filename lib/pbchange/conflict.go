@@ -0,0 +1,415 @@
+package pbchange
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// TrailerConflict is written to the merge that settles a conflict with the
+// upstream node, once for each conflict
+const TrailerConflict = "Conflict"
+
+// Ways a conflict can be resolved
+const (
+	ConflictLocal  = "local"  // Keep the object as it is on this node
+	ConflictRemote = "remote" // Take the object as it is upstream
+	ConflictMerged = "merged" // Take a version submitted by the resolver
+)
+
+/*
+Conflict records an object that was changed both here and upstream in ways
+git could not merge.  Local is master when the conflict was found, Remote
+the upstream master and Base their merge base, if they have one.  The
+transaction branch starts at Remote; a merged resolution is committed on
+top of it.
+*/
+type Conflict struct {
+	Upstream   string
+	Local      string
+	Remote     string
+	Base       string    `json:",omitempty"`
+	Resolution string    `json:",omitempty"`
+	Resolver   *CMAuthor `json:",omitempty"`
+}
+
+// ConflictVersions holds the object at the merge base and on either side
+// of a conflict.  A side where the object does not exist is nil.
+type ConflictVersions struct {
+	Base   *ChangeData
+	Local  *ChangeData
+	Remote *ChangeData
+}
+
+// Conflicts returns the conflicts that have not been merged yet, oldest
+// first
+func (engine *CMEngine) Conflicts() []Transaction {
+	list := make([]Transaction, 0)
+	for _, t := range engine.transactions.list() {
+		if t.Status == CONFLICT || t.Status == RESOLVED {
+			list = append(list, t)
+		}
+	}
+	return list
+}
+
+func (engine *CMEngine) GetConflict(id string) (Transaction, error) {
+	t, ok := engine.transactions.get(id)
+	if !ok || t.Conflict == nil {
+		return Transaction{}, NewCMError("Unknown conflict")
+	}
+	return t, nil
+}
+
+// GetConflictVersions returns both versions of the object of a conflict,
+// along with the version they were changed from
+func (engine *CMEngine) GetConflictVersions(id string) (*ConflictVersions, error) {
+	t, err := engine.GetConflict(id)
+	if err != nil {
+		return nil, err
+	}
+
+	get := func(commit string) (*ChangeData, error) {
+		if commit == "" {
+			return nil, nil
+		}
+		cd, err := engine.GetObjectAt(t.Ctype, t.Object, commit)
+		if IsCMNoObjectError(err) {
+			return nil, nil
+		}
+		return cd, err
+	}
+
+	v := &ConflictVersions{}
+	if v.Base, err = get(t.Conflict.Base); err != nil {
+		return nil, err
+	}
+	if v.Local, err = get(t.Conflict.Local); err != nil {
+		return nil, err
+	}
+	if v.Remote, err = get(t.Conflict.Remote); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+/*
+ResolveConflict settles a conflict by keeping the local version of its
+object, taking the remote one, or, for a merged resolution, taking the
+content in data.  Once every conflict of the same pull is resolved the
+upstream history is merged into master with the resolutions applied, and
+the merge commit is returned.  Until then the returned commit is empty.
+A conflict can be resolved again as long as it has not been merged.
+*/
+func (engine *CMEngine) ResolveConflict(id, resolution string, data *ChangeData, resolver *CMAuthor) (string, error) {
+	t, err := engine.GetConflict(id)
+	if err != nil {
+		return "", err
+	}
+	if t.Status != CONFLICT && t.Status != RESOLVED {
+		return "", NewCMConflictError(fmt.Sprintf("Conflict %s is %s", id, t.Status), []string{id})
+	}
+	if resolver == nil || resolver.Name == "" {
+		return "", NewCMError("A conflict needs someone to resolve it")
+	}
+
+	switch resolution {
+	case ConflictLocal, ConflictRemote:
+	case ConflictMerged:
+		if data == nil || data.Content == nil || len(data.Content.Files) == 0 {
+			return "", NewCMError("A merged resolution needs the merged content")
+		}
+		if t.Conflict.Resolution == ConflictMerged {
+			// Start over from the remote version
+			engine.guard(t.Ctype).Lock()
+			engine.removeWorktree(t.Ctype, t.Branch)
+			_, err = engine.run(t.Ctype, "branch", "-f", t.Branch, t.Conflict.Remote)
+			engine.guard(t.Ctype).Unlock()
+			if err != nil {
+				return "", err
+			}
+		}
+		merged := &ChangeData{
+			ObjectType:    t.Ctype,
+			Content:       &CMContent{Object: t.Object, Files: data.Content.Files},
+			Author:        resolver,
+			TransactionID: id,
+		}
+		if _, err = engine.VersionObject(merged, fmt.Sprintf("Resolve conflict %s", id), t.Branch); err != nil {
+			return "", err
+		}
+	default:
+		return "", NewCMError(fmt.Sprintf("Unknown resolution %s", resolution))
+	}
+
+	err = engine.transactions.update(id, func(t *Transaction) {
+		t.Status = RESOLVED
+		t.Conflict.Resolution = resolution
+		t.Conflict.Resolver = resolver
+	})
+	if err != nil {
+		return "", err
+	}
+	log.Notice("Conflict %s on %s %s resolved as %s by %s", id, t.Ctype, t.Object, resolution, resolver.Name)
+
+	engine.guard(t.Ctype).Lock()
+	commit, ids, err := engine.settleConflicts(t.Ctype, t.Conflict.Upstream, t.Conflict.Remote)
+	engine.guard(t.Ctype).Unlock()
+	if len(ids) != 0 {
+		engine.conflictEvents(ids)
+	}
+	if err != nil || commit == "" {
+		return "", err
+	}
+
+	for _, c := range engine.Conflicts() {
+		if c.Ctype == t.Ctype && c.Conflict.Remote == t.Conflict.Remote {
+			engine.FinalizeTransaction(&ChangeData{ObjectType: c.Ctype, TransactionID: c.ID, CommitID: commit})
+		}
+	}
+	return commit, nil
+}
+
+/*
+mergeUpstream merges the fetched upstream master into master.  Objects git
+can not merge are parked as conflicts, and the merge is left undone until
+they are all resolved.  Conflicts on an earlier upstream master are dropped,
+since the new one supersedes them.  The IDs of new conflicts are returned.
+The caller holds the guard.
+*/
+func (engine *CMEngine) mergeUpstream(ctype CMType, upstream, remote string) ([]string, error) {
+	if _, err := engine.run(ctype, "merge-base", "--is-ancestor", remote, "master"); err == nil {
+		return nil, nil
+	}
+
+	// Still waiting on resolutions, ResolveConflict merges once they are in
+	if open := engine.openConflicts(ctype, remote); len(open) != 0 {
+		return nil, conflictError(ctype, open)
+	}
+	for _, t := range engine.Conflicts() {
+		if t.Ctype == ctype {
+			log.Notice("Dropping conflict %s on %s, upstream has moved on", t.ID, t.Object)
+			engine.deleteBranch(ctype, t.Branch)
+			engine.transactions.remove(t.ID)
+		}
+	}
+
+	if _, err := engine.run(ctype, "checkout", "-q", "master"); err != nil {
+		return nil, err
+	}
+	stdout, stderr, err := engine.runC(ctype, "merge", "--no-edit", remote)
+	log.Debug("Out: %s\nErr: %s", stdout, stderr)
+	if err == nil {
+		return nil, nil
+	}
+
+	objects := engine.unmergedObjects(ctype)
+	engine.run(ctype, "merge", "--abort")
+	if len(objects) == 0 {
+		return nil, NewCMCommunicationError(stderr, err)
+	}
+
+	ids, err := engine.recordConflicts(ctype, upstream, remote, objects)
+	if err != nil {
+		return ids, err
+	}
+	return ids, conflictError(ctype, engine.openConflicts(ctype, remote))
+}
+
+/*
+settleConflicts merges remote into master once every conflict on it is
+resolved, and returns the merge commit.  If master has since picked up
+other changes that conflict with remote, those are parked as new
+conflicts and their IDs returned.  The caller holds the guard.
+*/
+func (engine *CMEngine) settleConflicts(ctype CMType, upstream, remote string) (string, []string, error) {
+	open := engine.openConflicts(ctype, remote)
+	for _, t := range open {
+		if t.Status != RESOLVED {
+			return "", nil, nil
+		}
+	}
+
+	if _, err := engine.run(ctype, "checkout", "-q", "master"); err != nil {
+		return "", nil, err
+	}
+	// Conflicts are expected here, they are settled below
+	engine.run(ctype, "merge", "--no-ff", "--no-commit", remote)
+
+	lines := []string{fmt.Sprintf("Merge upstream changes from %s", upstream), ""}
+	for _, t := range open {
+		rev := t.Branch
+		if t.Conflict.Resolution == ConflictLocal {
+			rev = "HEAD"
+		}
+		if err := engine.takeObject(ctype, t.Object, rev); err != nil {
+			engine.run(ctype, "merge", "--abort")
+			return "", nil, err
+		}
+		lines = append(lines, fmt.Sprintf("%s: %s", TrailerConflict, t.ID))
+	}
+
+	if objects := engine.unmergedObjects(ctype); len(objects) != 0 {
+		engine.run(ctype, "merge", "--abort")
+		ids, err := engine.recordConflicts(ctype, upstream, remote, objects)
+		if err != nil {
+			return "", ids, err
+		}
+		return "", ids, conflictError(ctype, engine.openConflicts(ctype, remote))
+	}
+
+	if _, stderr, err := engine.runC(ctype, "commit", "-q", "-m", strings.Join(lines, "\n")); err != nil {
+		engine.run(ctype, "merge", "--abort")
+		return "", nil, NewCMError(fmt.Sprintf("Can not merge upstream changes: %s", strings.TrimSpace(stderr)))
+	}
+	commit, err := engine.run(ctype, "rev-parse", "HEAD")
+	if err != nil {
+		return "", nil, err
+	}
+	log.Notice("Merged upstream changes to %s from %s", ctype, upstream)
+	return strings.TrimSpace(commit), nil, nil
+}
+
+// takeObject replaces an object in the index and work tree with its
+// version at rev, removing it if it does not exist there
+func (engine *CMEngine) takeObject(ctype CMType, object, rev string) error {
+	if _, err := engine.run(ctype, "rm", "-r", "-q", "-f", "--ignore-unmatch", "--", object); err != nil {
+		return err
+	}
+	o, err := engine.run(ctype, "ls-tree", "--name-only", rev, "--", object)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(o) == "" {
+		return nil
+	}
+	_, err = engine.run(ctype, "checkout", rev, "--", object)
+	return err
+}
+
+// unmergedObjects returns the objects with unmerged paths in the index,
+// sorted
+func (engine *CMEngine) unmergedObjects(ctype CMType) []string {
+	o, _ := engine.run(ctype, "diff", "--name-only", "--diff-filter=U")
+	seen := make(map[string]bool)
+	objects := make([]string, 0)
+	for _, path := range strings.Fields(o) {
+		object := strings.SplitN(path, "/", 2)[0]
+		if !seen[object] {
+			seen[object] = true
+			objects = append(objects, object)
+		}
+	}
+	sort.Strings(objects)
+	return objects
+}
+
+// recordConflicts parks a conflict for each object that does not have one
+// on remote yet.  The caller holds the guard.
+func (engine *CMEngine) recordConflicts(ctype CMType, upstream, remote string, objects []string) ([]string, error) {
+	local, err := engine.run(ctype, "rev-parse", "master")
+	if err != nil {
+		return nil, err
+	}
+	base, _ := engine.run(ctype, "merge-base", "master", remote)
+
+	parked := make(map[string]bool)
+	for _, t := range engine.openConflicts(ctype, remote) {
+		parked[t.Object] = true
+	}
+
+	free := func(id string) bool {
+		if engine.transactions.has(id) {
+			return false
+		}
+		_, err := engine.run(ctype, "rev-parse", "--verify", "--quiet", "refs/heads/"+id)
+		return err != nil
+	}
+
+	ids := make([]string, 0)
+	for _, object := range objects {
+		if parked[object] {
+			continue
+		}
+		id, err := engine.getUUID(5, free)
+		if err != nil {
+			return ids, NewCMCollisionError()
+		}
+		if _, err = engine.run(ctype, "branch", id, remote); err != nil {
+			return ids, NewCMTransactionError(id)
+		}
+		t := &Transaction{
+			ID:      id,
+			Status:  CONFLICT,
+			Ctype:   ctype,
+			Branch:  id,
+			Object:  object,
+			Message: fmt.Sprintf("%s was changed both here and upstream", object),
+			Conflict: &Conflict{
+				Upstream: upstream,
+				Local:    strings.TrimSpace(local),
+				Remote:   remote,
+				Base:     strings.TrimSpace(base),
+			},
+		}
+		if err = engine.transactions.add(t); err != nil {
+			engine.run(ctype, "branch", "-D", id)
+			return ids, err
+		}
+		log.Warning("Changes to %s %s from %s conflict with this node, parked as %s", ctype, object, upstream, id)
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// openConflicts returns the conflicts on remote that have not been merged
+func (engine *CMEngine) openConflicts(ctype CMType, remote string) []Transaction {
+	list := make([]Transaction, 0)
+	for _, t := range engine.Conflicts() {
+		if t.Ctype == ctype && t.Conflict.Remote == remote {
+			list = append(list, t)
+		}
+	}
+	return list
+}
+
+func conflictError(ctype CMType, open []Transaction) error {
+	ids := make([]string, 0, len(open))
+	objects := make([]string, 0, len(open))
+	for _, t := range open {
+		if t.Status == CONFLICT {
+			ids = append(ids, t.ID)
+		}
+		objects = append(objects, t.Object)
+	}
+	return NewCMConflictError(fmt.Sprintf("Upstream changes to %s %s conflict with this node and wait for resolution",
+		ctype, strings.Join(objects, ", ")), ids)
+}
+
+// conflictEvents tells the event listeners about new conflicts
+func (engine *CMEngine) conflictEvents(ids []string) {
+	for _, id := range ids {
+		t, err := engine.GetConflict(id)
+		if err != nil {
+			continue
+		}
+		engine.runEventCBs(Event{Kind: EventConflict, Type: t.Ctype, Objects: []string{t.Object},
+			Commit: t.Conflict.Remote, Transaction: id, Status: t.Status.String(), Message: t.Message})
+	}
+}
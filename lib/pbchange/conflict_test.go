@@ -0,0 +1,127 @@
+package pbchange
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestConflicts(t *testing.T) {
+	begin(t, "TestConflicts")
+	defer end(t, "TestConflicts")
+
+	cfg := setup()
+	engine, err := GetCMEngine(cfg)
+	defer cleanup(cfg, engine)
+	checkFatal(t, err)
+
+	version := func(object, content string, branch ...string) {
+		_, err := engine.VersionObject(proposal(object, content), "Change "+object, branch...)
+		checkFatal(t, err)
+	}
+	content := func(object string) string {
+		cd, err := engine.GetObject(DEVICE, object)
+		checkFatal(t, err)
+		return string(cd.Content.Files["configFile"])
+	}
+
+	version("relay", "set service FTP on\n")
+	version("meter", "set service telnet on\n")
+
+	// Upstream changes both objects and adds one, this node changes both
+	// differently
+	_, err = engine.run(DEVICE, "branch", "upstream")
+	checkFatal(t, err)
+	version("relay", "set service FTP off\n", "upstream")
+	version("meter", "set service telnet off\n", "upstream")
+	version("feeder", "set service ssh on\n", "upstream")
+	version("relay", "set service FTP disabled\n")
+	version("meter", "set service telnet disabled\n")
+	remote, err := engine.run(DEVICE, "rev-parse", "upstream")
+	checkFatal(t, err)
+	remote = strings.TrimSpace(remote)
+
+	engine.guard(DEVICE).Lock()
+	ids, err := engine.mergeUpstream(DEVICE, "upstream", remote)
+	engine.guard(DEVICE).Unlock()
+	if !IsCMConflictError(err) || len(ids) != 2 || len(err.(CMConflictError).IDs) != 2 {
+		t.Fatalf("Expected two conflicts, got %v %v", ids, err)
+	}
+
+	// Pulling the same upstream again parks nothing new
+	engine.guard(DEVICE).Lock()
+	again, err := engine.mergeUpstream(DEVICE, "upstream", remote)
+	engine.guard(DEVICE).Unlock()
+	if !IsCMConflictError(err) || len(again) != 0 || len(engine.Conflicts()) != 2 {
+		t.Errorf("Conflicts parked twice: %v %v", again, err)
+	}
+	if content("relay") != "set service FTP disabled\n" || content("feeder") != "" {
+		t.Errorf("Conflicting pull touched master")
+	}
+
+	conflicts := make(map[string]string)
+	for _, c := range engine.Conflicts() {
+		conflicts[c.Object] = c.ID
+	}
+	v, err := engine.GetConflictVersions(conflicts["relay"])
+	checkFatal(t, err)
+	if string(v.Base.Content.Files["configFile"]) != "set service FTP on\n" ||
+		string(v.Local.Content.Files["configFile"]) != "set service FTP disabled\n" ||
+		string(v.Remote.Content.Files["configFile"]) != "set service FTP off\n" {
+		t.Errorf("Unexpected conflict versions %+v", v)
+	}
+
+	resolver := &CMAuthor{Name: "Kevin McHale", Email: "post@celtics.net"}
+	if _, err = engine.ResolveConflict(conflicts["relay"], "both", nil, resolver); err == nil {
+		t.Errorf("Unknown resolution accepted")
+	}
+	if _, err = engine.ResolveConflict(conflicts["relay"], ConflictMerged, nil, resolver); err == nil {
+		t.Errorf("Merged resolution without content accepted")
+	}
+
+	merged := proposal("relay", "set service FTP off\nset service ssh on\n")
+	commit, err := engine.ResolveConflict(conflicts["relay"], ConflictMerged, merged, resolver)
+	checkFatal(t, err)
+	if commit != "" || content("relay") != "set service FTP disabled\n" {
+		t.Errorf("Merged before every conflict was resolved")
+	}
+
+	commit, err = engine.ResolveConflict(conflicts["meter"], ConflictLocal, nil, resolver)
+	checkFatal(t, err)
+	if commit == "" {
+		t.Fatalf("Resolving the last conflict did not merge")
+	}
+	if content("relay") != "set service FTP off\nset service ssh on\n" ||
+		content("meter") != "set service telnet disabled\n" ||
+		content("feeder") != "set service ssh on\n" {
+		t.Errorf("Resolutions not applied: %q %q %q", content("relay"), content("meter"), content("feeder"))
+	}
+	if len(engine.Conflicts()) != 0 {
+		t.Errorf("Conflicts left after the merge: %v", engine.Conflicts())
+	}
+	if tr, _ := engine.GetTransaction(conflicts["meter"]); tr.Status != COMPLETE {
+		t.Errorf("Expected conflict to be complete, it is %s", tr.Status)
+	}
+
+	engine.guard(DEVICE).Lock()
+	ids, err = engine.mergeUpstream(DEVICE, "upstream", remote)
+	engine.guard(DEVICE).Unlock()
+	if err != nil || len(ids) != 0 {
+		t.Errorf("Merged upstream not recognised: %v %v", ids, err)
+	}
+}
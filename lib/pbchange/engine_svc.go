@@ -25,6 +25,7 @@ import (
 var devMonLog logging.Logger
 var sweepLog logging.Logger
 var cleanLog logging.Logger
+var maintLog logging.Logger
 
 func (engine *CMEngine) Start(timers ...int) chan bool {
 	ll := logging.GetLevel("CME:Main")
@@ -34,12 +35,15 @@ func (engine *CMEngine) Start(timers ...int) chan bool {
 	logging.SetLevel(ll, "CME:Sweeper")
 	cleanLog, _ = logging.GetLogger("CME:Cleaner")
 	logging.SetLevel(ll, "CME:Cleaner")
+	maintLog, _ = logging.GetLogger("CME:Maintenance")
+	logging.SetLevel(ll, "CME:Maintenance")
 
 	doneChan := make(chan bool)
 
 	var devMonTime int
 	var sweepTime int
 	var cleanTime int
+	maintTime := 24 * 60 * 60
 
 	switch {
 	case len(timers) == 1:
@@ -50,10 +54,15 @@ func (engine *CMEngine) Start(timers ...int) chan bool {
 		devMonTime = timers[0]
 		cleanTime = timers[1]
 		sweepTime = 60
-	case len(timers) >= 3:
+	case len(timers) == 3:
 		devMonTime = timers[0]
 		cleanTime = timers[1]
 		sweepTime = timers[2]
+	case len(timers) >= 4:
+		devMonTime = timers[0]
+		cleanTime = timers[1]
+		sweepTime = timers[2]
+		maintTime = timers[3]
 	default:
 		devMonTime = 10
 		cleanTime = 10
@@ -63,6 +72,7 @@ func (engine *CMEngine) Start(timers ...int) chan bool {
 	devMonTicker := time.NewTicker(time.Second * time.Duration(devMonTime))
 	sweepTicker := time.NewTicker(time.Second * time.Duration(sweepTime))
 	cleanTicker := time.NewTicker(time.Second * time.Duration(cleanTime))
+	maintTicker := time.NewTicker(time.Second * time.Duration(maintTime))
 
 	go func() {
 		go func() {
@@ -83,11 +93,18 @@ func (engine *CMEngine) Start(timers ...int) chan bool {
 			}
 		}()
 
+		go func() {
+			for t := range maintTicker.C {
+				engine.maintain(t)
+			}
+		}()
+
 		switch {
 		case <-doneChan:
 			devMonTicker.Stop()
 			sweepTicker.Stop()
 			cleanTicker.Stop()
+			maintTicker.Stop()
 		}
 	}()
 
@@ -105,10 +122,11 @@ func (engine *CMEngine) cleanBranches(t time.Time) {
 	tracker := make(map[string][]string, 0)
 
 	// Remove dead refs
-	engine.guard.Lock()
-	for id, trans := range activeTransactions {
+	for _, trans := range engine.transactions.list() {
 		if _, ok := tracker[trans.Ctype.String()]; !ok {
+			engine.guard(trans.Ctype).Lock()
 			l, err := engine.getBranches(trans.Ctype)
+			engine.guard(trans.Ctype).Unlock()
 			if err != nil {
 				cleanLog.Error("Encountered Error listing branches: ", err.Error())
 				continue
@@ -124,14 +142,14 @@ func (engine *CMEngine) cleanBranches(t time.Time) {
 				}
 			}
 			return -1
-		}(id, tracker[trans.Ctype.String()])
+		}(trans.Branch, tracker[trans.Ctype.String()])
 
-		if indx == -1 {
+		// The branch of a new transaction may not be made yet
+		if indx == -1 && trans.Status != INITIALIZING {
 			// There is no branch for the transactionID
-			delete(activeTransactions, id)
+			engine.transactions.remove(trans.ID)
 		}
 	}
-	engine.guard.Unlock()
 
 	// At this point, all refs should point to something and
 	// all branches should be loaded
@@ -140,29 +158,24 @@ func (engine *CMEngine) cleanBranches(t time.Time) {
 
 	// Mark
 	dead := make([]string, 0)
-	engine.guard.Lock()
 	for _, list := range tracker {
 		for _, branch := range list {
-			if _, ok := activeTransactions[branch]; !ok {
+			if !engine.transactions.has(branch) {
 				dead = append(dead, branch)
 			}
 		}
 	}
-	engine.guard.Unlock()
 
 	// Sweep
-	engine.guard.Lock()
 	for objtype, _ := range tracker {
-		engine.run(StringToCMType(objtype), "checkout", "master")
 		for _, branch := range dead {
-			engine.run(StringToCMType(objtype), "branch", "-D", branch)
+			engine.removeBranch(branch, StringToCMType(objtype))
 		}
 	}
-	engine.guard.Unlock()
 }
 
 func (engine *CMEngine) getBranches(ctype CMType) ([]string, error) {
-	o, e := engine.run(ctype, "branch", "--list")
+	o, e := engine.run(ctype, "branch", "--list", "--format=%(refname:short)")
 	if e != nil {
 		return nil, e
 	}
@@ -170,9 +183,8 @@ func (engine *CMEngine) getBranches(ctype CMType) ([]string, error) {
 	r := make([]string, 0)
 	lines := strings.Split(o, "\n")
 	for _, line := range lines {
-		line = strings.TrimPrefix(line, "*")
 		line = strings.TrimSpace(line)
-		if line == "master" {
+		if line == "" || line == "master" || strings.HasPrefix(line, "(") {
 			continue
 		}
 		r = append(r, line)
@@ -181,34 +193,45 @@ func (engine *CMEngine) getBranches(ctype CMType) ([]string, error) {
 	return r, nil
 }
 
+// How long failed, rejected and cancelled transactions are kept, with their
+// branches, so what went wrong can still be looked at
+const finishedRetention = 7 * 24 * time.Hour
+
 func (engine *CMEngine) sweepComplete(t time.Time) {
-	// Clear Completed transactions
+	// Clear Completed transactions, and the ones that ended otherwise once
+	// they have been kept long enough
 	sweepLog.Debug("sweepComplete(%v)\n", t)
 
-	for id, status := range activeTransactions {
-		if status.Status == COMPLETE {
-			sweepLog.Debug("Removing completed transaction %s", id)
-			engine.guard.Lock()
-			activeTransactions[id].Status = CLEANED
-			engine.guard.Unlock()
+	for _, trans := range engine.transactions.list() {
+		switch trans.Status {
+		case COMPLETE:
+			sweepLog.Debug("Removing completed transaction %s", trans.ID)
+		case FAILED, REJECTED, CANCELLED:
+			if t.Sub(trans.Updated) < finishedRetention {
+				continue
+			}
+			sweepLog.Debug("Removing %s transaction %s", trans.Status, trans.ID)
+		default:
+			continue
+		}
+		engine.setStatus(trans.ID, CLEANED)
 
-			engine.removeBranch(id, status)
+		engine.removeBranch(trans.Branch, trans.Ctype)
 
-			engine.guard.Lock()
-			delete(activeTransactions, id)
-			engine.guard.Unlock()
-		}
+		engine.transactions.remove(trans.ID)
 	}
 }
 
-func (e *CMEngine) removeBranch(id string, t *Transaction) {
-	e.guard.Lock()
-	defer e.guard.Unlock()
-
-	// Make sure we're on master
-	e.run(t.Ctype, "checkout", "master")
+func (e *CMEngine) removeBranch(branch string, ctype CMType) {
+	e.guard(ctype).Lock()
+	defer e.guard(ctype).Unlock()
 
-	// Force remove the branch
-	e.run(t.Ctype, "branch", "-D", id)
+	e.deleteBranch(ctype, branch)
+}
 
+// deleteBranch force removes a branch along with its worktree.  The caller
+// holds the guard.
+func (e *CMEngine) deleteBranch(ctype CMType, branch string) {
+	e.removeWorktree(ctype, branch)
+	e.run(ctype, "branch", "-D", branch)
 }
@@ -79,3 +79,35 @@ func IsCMIDError(e error) bool {
 	}
 	return false
 }
+
+func IsCMReviewError(e error) bool {
+	switch e.(type) {
+	case CMReviewError:
+		return true
+	}
+	return false
+}
+
+func IsCMNoObjectError(e error) bool {
+	switch e.(type) {
+	case CMNoObjectError:
+		return true
+	}
+	return false
+}
+
+func IsCMSignatureError(e error) bool {
+	switch e.(type) {
+	case CMSignatureError:
+		return true
+	}
+	return false
+}
+
+func IsCMConflictError(e error) bool {
+	switch e.(type) {
+	case CMConflictError:
+		return true
+	}
+	return false
+}
@@ -104,3 +104,49 @@ func NewCMIDError() error {
 		error: errors.New("Failed to find an acceptable UUID"),
 	}
 }
+
+// Change request can not be reviewed as asked
+type CMReviewError struct {
+	error
+}
+
+func NewCMReviewError(s string) error {
+	return CMReviewError{
+		error: errors.New(s),
+	}
+}
+
+// Object absent at a commit
+type CMNoObjectError struct {
+	error
+}
+
+func NewCMNoObjectError(o, commit string) error {
+	return CMNoObjectError{
+		error: errors.New(fmt.Sprintf("%s did not exist at commit %s", o, commit)),
+	}
+}
+
+// Upstream history conflicts with this node
+type CMConflictError struct {
+	error
+	IDs []string
+}
+
+func NewCMConflictError(s string, ids []string) error {
+	return CMConflictError{
+		error: errors.New(s),
+		IDs:   ids,
+	}
+}
+
+// Missing or untrusted commit signatures
+type CMSignatureError struct {
+	error
+}
+
+func NewCMSignatureError(s string) error {
+	return CMSignatureError{
+		error: errors.New(s),
+	}
+}
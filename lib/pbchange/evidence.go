@@ -0,0 +1,325 @@
+package pbchange
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Namespace of the signature of an evidence manifest
+const evidenceNamespace = "pbconf-evidence"
+
+// EvidenceManifest lists the files of an audit evidence package and what
+// they cover.  It is signed by the node that made the package.
+type EvidenceManifest struct {
+	Node    string
+	Created time.Time
+	From    time.Time
+	To      time.Time
+	Devices []string `json:",omitempty"`
+	Nodes   []string `json:",omitempty"`
+	Files   []BundleFile
+}
+
+// Evidence is an evidence package opened for inspection.  Its signature
+// and the checksums of its files have been verified.
+type Evidence struct {
+	Manifest EvidenceManifest
+	Signer   string
+	dir      string
+}
+
+// EvidenceFile is a file of an object as a commit left it
+type EvidenceFile struct {
+	Object  string
+	File    string
+	Blob    string `json:",omitempty"` // Empty if the commit removed the file
+	Content string `json:",omitempty"`
+	Removed bool   `json:",omitempty"`
+	// Set by callers that take secrets out of Content, which then no
+	// longer hashes to Blob
+	Redacted bool `json:",omitempty"`
+}
+
+/*
+EvidenceCommit is a commit on master with what is needed to check it
+independently of the node: the commit object as stored, signature included,
+and the blob ids of the files it changed.
+*/
+type EvidenceCommit struct {
+	*Provenance
+	Committed time.Time
+	Signature CommitSignature
+	Objects   []string
+	Files     []EvidenceFile
+	Raw       string
+}
+
+/*
+EvidenceHistory returns the commits on master, oldest first, that were
+committed between from and to and changed any of objects, or any object at
+all if objects is empty.  A zero from or to leaves that end of the range
+open.  Commits carry the files of the objects in scope that they changed.
+*/
+func (engine *CMEngine) EvidenceHistory(otype CMType, objects []string, from, to time.Time) ([]EvidenceCommit, error) {
+	if _, err := engine.getGitDir(otype); err != nil {
+		return nil, NewCMNoRepoError(otype.String())
+	}
+	if engine.GetLatestCommitID(otype) == "" {
+		return []EvidenceCommit{}, nil
+	}
+
+	args := []string{"log", "--reverse", "--notes=" + sourceNotesRef,
+		"--format=%x00%H%x1f%at%x1f%an%x1f%ae%x1f%N%x1f%B"}
+	if !from.IsZero() {
+		args = append(args, "--since="+from.UTC().Format(time.RFC3339))
+	}
+	if !to.IsZero() {
+		args = append(args, "--until="+to.UTC().Format(time.RFC3339))
+	}
+	args = append(args, "master", "--")
+	args = append(args, objects...)
+	o, err := engine.run(otype, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	signatures, err := engine.signatures(otype, "master")
+	if err != nil {
+		return nil, err
+	}
+	signed := make(map[string]CommitSignature)
+	for _, s := range signatures {
+		signed[s.Commit] = s
+	}
+
+	store, err := engine.store(otype)
+	if err != nil {
+		return nil, err
+	}
+	inScope := make(map[string]bool)
+	for _, obj := range objects {
+		inScope[obj] = true
+	}
+
+	history := make([]EvidenceCommit, 0)
+	for _, record := range strings.Split(o, "\x00") {
+		if strings.TrimSpace(record) == "" {
+			continue
+		}
+		p, err := parseProvenance(record)
+		if err != nil {
+			return nil, err
+		}
+		c, err := store.ReadCommit(p.Commit)
+		if err != nil {
+			return nil, err
+		}
+		raw, err := engine.run(otype, "cat-file", "commit", p.Commit)
+		if err != nil {
+			return nil, err
+		}
+
+		ec := EvidenceCommit{
+			Provenance: p,
+			Committed:  c.Committer.When,
+			Signature:  signed[p.Commit],
+			Objects:    make([]string, 0),
+			Raw:        raw,
+		}
+		if ec.Files, err = engine.evidenceFiles(otype, c, inScope); err != nil {
+			return nil, err
+		}
+		seen := make(map[string]bool)
+		for _, f := range ec.Files {
+			if !seen[f.Object] {
+				seen[f.Object] = true
+				ec.Objects = append(ec.Objects, f.Object)
+			}
+		}
+		history = append(history, ec)
+	}
+	return history, nil
+}
+
+// evidenceFiles returns the files a commit changed against its first
+// parent, limited to the objects in scope unless scope is empty
+func (engine *CMEngine) evidenceFiles(otype CMType, c *StoredCommit, scope map[string]bool) ([]EvidenceFile, error) {
+	var base string
+	if len(c.Parents) > 0 {
+		base = c.Parents[0]
+	} else {
+		empty, err := engine.runWith(otype, nil, "", "hash-object", "-t", "tree", "--stdin")
+		if err != nil {
+			return nil, err
+		}
+		base = strings.TrimSpace(empty)
+	}
+	o, err := engine.run(otype, "diff", "--name-status", "--no-renames", base, c.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]EvidenceFile, 0)
+	for _, line := range strings.Split(o, "\n") {
+		f := strings.SplitN(line, "\t", 2)
+		if len(f) != 2 {
+			continue
+		}
+		parts := strings.SplitN(f[1], "/", 2)
+		if len(parts) != 2 || (len(scope) > 0 && !scope[parts[0]]) {
+			continue
+		}
+		ef := EvidenceFile{Object: parts[0], File: parts[1]}
+		if f[0] == "D" {
+			ef.Removed = true
+		} else {
+			blob, err := engine.run(otype, "rev-parse", c.ID+":"+f[1])
+			if err != nil {
+				return nil, err
+			}
+			content, err := engine.run(otype, "cat-file", "blob", strings.TrimSpace(blob))
+			if err != nil {
+				return nil, err
+			}
+			ef.Blob = strings.TrimSpace(blob)
+			ef.Content = content
+		}
+		files = append(files, ef)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].Object != files[j].Object {
+			return files[i].Object < files[j].Object
+		}
+		return files[i].File < files[j].File
+	})
+	return files, nil
+}
+
+/*
+ExportEvidence writes an evidence package: the given files and a manifest
+of their checksums, signed by the node.  The trusted signers of the node
+are added so the package and the commit signatures it carries can be
+checked without it.  The manifest is filled in and returned.
+*/
+func (engine *CMEngine) ExportEvidence(w io.Writer, m *EvidenceManifest, files map[string][]byte) (*EvidenceManifest, error) {
+	if !engine.Signing() {
+		return nil, NewCMSignatureError("Evidence can not be signed without a signing key")
+	}
+
+	dir, err := ioutil.TempDir("", "evidence")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	carried := make(map[string][]byte, len(files)+1)
+	for name, content := range files {
+		carried[name] = content
+	}
+	if _, ok := carried[allowedSignersFile]; !ok && engine.allowedSigners != "" {
+		if carried[allowedSignersFile], err = ioutil.ReadFile(engine.allowedSigners); err != nil {
+			return nil, err
+		}
+	}
+
+	m.Node = engine.signer
+	m.Created = time.Now().UTC()
+	m.Files = make([]BundleFile, 0, len(carried))
+	names := make([]string, 0, len(carried))
+	for name := range carried {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !bundleName(name) || name == bundleManifest || name == bundleSignature {
+			return nil, NewCMError(fmt.Sprintf("Can not add a file named %s to evidence", name))
+		}
+		if err = ioutil.WriteFile(filepath.Join(dir, name), carried[name], 0600); err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(carried[name])
+		m.Files = append(m.Files, BundleFile{Name: name, SHA256: hex.EncodeToString(sum[:])})
+	}
+
+	if err = engine.writeArchive(w, dir, evidenceNamespace, m, m.Created, names); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+/*
+OpenEvidence unpacks an evidence package and checks that a trusted node
+signed it and that its files are what the manifest lists.  The caller
+closes the package when done with it.
+*/
+func (engine *CMEngine) OpenEvidence(r io.Reader) (*Evidence, error) {
+	if engine.allowedSigners == "" {
+		return nil, NewCMSignatureError("No trusted signers to check evidence against")
+	}
+
+	dir, err := ioutil.TempDir("", "evidence")
+	if err != nil {
+		return nil, err
+	}
+	e := &Evidence{dir: dir}
+	fail := func(err error) (*Evidence, error) {
+		e.Close()
+		return nil, err
+	}
+
+	manifest, signer, err := engine.readArchive(r, dir, evidenceNamespace)
+	if err != nil {
+		return fail(err)
+	}
+	e.Signer = signer
+
+	if err = json.Unmarshal(manifest, &e.Manifest); err != nil {
+		return fail(NewCMError(fmt.Sprintf("Malformed evidence manifest: %s", err.Error())))
+	}
+	for _, f := range e.Manifest.Files {
+		if err = checkArchived(dir, f.Name, f.SHA256); err != nil {
+			return fail(err)
+		}
+	}
+	return e, nil
+}
+
+// Close removes the unpacked evidence
+func (e *Evidence) Close() error {
+	return os.RemoveAll(e.dir)
+}
+
+// File returns a file of the evidence
+func (e *Evidence) File(name string) ([]byte, error) {
+	for _, f := range e.Manifest.Files {
+		if f.Name == name {
+			return ioutil.ReadFile(filepath.Join(e.dir, name))
+		}
+	}
+	return nil, NewCMError(fmt.Sprintf("Evidence does not carry %s", name))
+}
@@ -0,0 +1,115 @@
+package pbchange
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEvidence(t *testing.T) {
+	begin(t, "TestEvidence")
+	defer end(t, "TestEvidence")
+
+	keys, err := ioutil.TempDir("", "keys")
+	checkFatal(t, err)
+	defer os.RemoveAll(keys)
+
+	cfg := setup()
+	cfg.Global.NodeName = "substation"
+	cfg.ChMgmt.SigningKey = newKey(t, keys, "node")
+	engine, err := GetCMEngine(cfg)
+	defer cleanup(cfg, engine)
+	checkFatal(t, err)
+
+	start := time.Now().Add(-time.Minute)
+	_, err = engine.VersionObject(proposal("relay", "set service FTP on\n"), "")
+	checkFatal(t, err)
+	_, err = engine.VersionObject(proposal("breaker", "set password secret\n"), "")
+	checkFatal(t, err)
+	_, err = engine.VersionObject(proposal("relay", "set service FTP off\n"), "")
+	checkFatal(t, err)
+
+	history, err := engine.EvidenceHistory(DEVICE, []string{"relay"}, start, time.Time{})
+	checkFatal(t, err)
+	if len(history) != 2 {
+		t.Fatalf("Expected 2 commits of relay, got %d", len(history))
+	}
+	last := history[1]
+	if last.Signature.Status != SignatureGood {
+		t.Errorf("Expected a good signature, got %s", last.Signature.Status)
+	}
+	if !strings.Contains(last.Raw, "gpgsig") {
+		t.Error("Raw commit does not carry its signature")
+	}
+	if len(last.Objects) != 1 || last.Objects[0] != "relay" {
+		t.Errorf("Unexpected objects %v", last.Objects)
+	}
+	if len(last.Files) != 1 || last.Files[0].Content != "set service FTP off\n" || last.Files[0].Blob == "" {
+		t.Errorf("Unexpected files %+v", last.Files)
+	}
+
+	all, err := engine.EvidenceHistory(DEVICE, nil, time.Time{}, time.Time{})
+	checkFatal(t, err)
+	changed := 0
+	for _, c := range all {
+		changed += len(c.Objects)
+	}
+	if changed != 3 {
+		t.Errorf("Expected 3 object changes, got %d", changed)
+	}
+	later, err := engine.EvidenceHistory(DEVICE, nil, time.Now().Add(time.Hour), time.Time{})
+	checkFatal(t, err)
+	if len(later) != 0 {
+		t.Errorf("Expected no commits after the range, got %d", len(later))
+	}
+
+	var buf bytes.Buffer
+	m, err := engine.ExportEvidence(&buf, &EvidenceManifest{From: start, Devices: []string{"relay"}},
+		map[string][]byte{"device-history.json": []byte("[]")})
+	checkFatal(t, err)
+	if m.Node != "substation" || len(m.Files) != 2 {
+		t.Errorf("Unexpected manifest %+v", m)
+	}
+
+	e, err := engine.OpenEvidence(bytes.NewReader(buf.Bytes()))
+	checkFatal(t, err)
+	defer e.Close()
+	if e.Signer != "substation" || len(e.Manifest.Devices) != 1 {
+		t.Errorf("Unexpected evidence %s %+v", e.Signer, e.Manifest)
+	}
+	signers, err := e.File(allowedSignersFile)
+	checkFatal(t, err)
+	if !strings.HasPrefix(string(signers), "substation ") {
+		t.Errorf("Evidence does not carry the signers: %s", signers)
+	}
+
+	// Neither a changed file nor a bundle passes for evidence
+	if _, err = engine.OpenEvidence(bytes.NewReader(repack(t, buf.Bytes(), "device-history.json", []byte("{}")))); !IsCMSignatureError(err) {
+		t.Errorf("Tampered evidence was accepted: %v", err)
+	}
+	var bundle bytes.Buffer
+	_, err = engine.ExportBundle(&bundle, []CMType{DEVICE}, nil)
+	checkFatal(t, err)
+	if _, err = engine.OpenEvidence(bytes.NewReader(bundle.Bytes())); !IsCMSignatureError(err) {
+		t.Errorf("Bundle was accepted as evidence: %v", err)
+	}
+}
@@ -192,6 +192,11 @@ func (e *CMEngine) serviceRpc(hr handlerReq) {
 
 	input, _ := ioutil.ReadAll(r.Body)
 
+	var before string
+	if rpc == "receive-pack" {
+		before = strings.TrimSpace(string(e.gitCommand(dir, "rev-parse", "master")))
+	}
+
 	w.Header().Set("Content-Type", fmt.Sprintf("application/x-git-%s-result", rpc))
 	w.WriteHeader(http.StatusOK)
 
@@ -226,12 +231,37 @@ func (e *CMEngine) serviceRpc(hr handlerReq) {
 		}
 		e.runPackRcvCBs(cbdata.ObjectType, &cbdata)
 
+		after := strings.TrimSpace(string(e.gitCommand(dir, "rev-parse", "master")))
+		if after != before {
+			objects, err := e.ChangedObjects(hr.Ctype, before, after)
+			if err != nil {
+				log.Warning("Could not tell what the pack changed: %v", err)
+			}
+			if src != "" {
+				e.recordSource(dir, before, after, src)
+			}
+			e.runEventCBs(Event{Kind: EventPackReceived, Type: hr.Ctype, Objects: objects,
+				Commit: after, Transaction: hr.Transaction, SrcNode: src})
+		}
+
 	}
 
 	log.Debug("calling reset()")
 	e.reset(hr.Ctype)
 }
 
+// recordSource notes src as the origin of the commits a pack added to
+// master
+func (e *CMEngine) recordSource(dir, before, after, src string) {
+	revs := after
+	if before != "" {
+		revs = before + ".." + after
+	}
+	for _, commit := range strings.Fields(string(e.gitCommand(dir, "rev-list", revs))) {
+		e.gitCommand(dir, sourceNoteArgs(commit, src)...)
+	}
+}
+
 func (e *CMEngine) getInfoRefs(hr handlerReq) {
 	log.Debug("getInfoRefs()")
 	w, r, dir := hr.w, hr.r, hr.Dir
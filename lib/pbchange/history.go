@@ -0,0 +1,227 @@
+package pbchange
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// committedContent reads the files of an object under sub, "data" or
+// "raw", from the tree of a commit.  It leaves the working tree alone, so
+// it needs no lock.
+func (engine *CMEngine) committedContent(otype CMType, rev, oname, sub string) (*CMContent, error) {
+	store, err := engine.store(otype)
+	if err != nil {
+		return nil, err
+	}
+	files, err := store.ReadFiles(rev, filepath.Join(oname, sub))
+	if err != nil {
+		return nil, err
+	}
+
+	content := NewCMContent(oname)
+	for file, data := range files {
+		content.Files[filepath.Base(file)] = data
+	}
+	return content, nil
+}
+
+/*
+ObjectCommits returns the IDs of the commits that changed an object, newest
+first, starting from rev, or from master if rev is empty.  At most limit
+commits are returned, unless limit is zero.
+*/
+func (engine *CMEngine) ObjectCommits(otype CMType, oname, rev string, limit int) ([]string, error) {
+	if rev == "" {
+		rev = "master"
+	}
+
+	opts := []string{"log", "--format=%H"}
+	if limit > 0 {
+		opts = append(opts, fmt.Sprintf("-%d", limit))
+	}
+	opts = append(opts, rev, "--", filepath.Join(oname, "data"))
+
+	o, err := engine.run(otype, opts...)
+	if err != nil {
+		return nil, NewCMError(fmt.Sprintf("Unknown commit %s", rev))
+	}
+	return strings.Fields(o), nil
+}
+
+// ChangedObjects returns the names of the objects whose data differs
+// between two commits
+func (engine *CMEngine) ChangedObjects(otype CMType, from, to string) ([]string, error) {
+	for _, c := range []string{from, to} {
+		if _, err := engine.run(otype, "rev-parse", "--verify", "--quiet", c+"^{commit}"); err != nil {
+			return nil, NewCMError(fmt.Sprintf("Unknown commit %s", c))
+		}
+	}
+
+	o, err := engine.run(otype, "diff", "--name-only", from, to)
+	if err != nil {
+		return nil, err
+	}
+	return dataObjects(o), nil
+}
+
+// ChangedMeta returns the names of the devices whose metadata differs
+// between two commits
+func (engine *CMEngine) ChangedMeta(from, to string) ([]string, error) {
+	for _, c := range []string{from, to} {
+		if _, err := engine.run(DEVICE, "rev-parse", "--verify", "--quiet", c+"^{commit}"); err != nil {
+			return nil, NewCMError(fmt.Sprintf("Unknown commit %s", c))
+		}
+	}
+
+	o, err := engine.run(DEVICE, "diff", "--name-only", from, to)
+	if err != nil {
+		return nil, err
+	}
+	return objectsUnder(o, "meta"), nil
+}
+
+// dataObjects returns the objects whose data is among the given files
+func dataObjects(o string) []string {
+	return objectsUnder(o, "data")
+}
+
+// objectsUnder returns the objects with files under sub among the given
+// files
+func objectsUnder(o, sub string) []string {
+	seen := make(map[string]bool)
+	objects := make([]string, 0)
+	for _, file := range strings.Fields(o) {
+		parts := strings.Split(file, "/")
+		if len(parts) < 3 || parts[1] != sub || seen[parts[0]] {
+			continue
+		}
+		seen[parts[0]] = true
+		objects = append(objects, parts[0])
+	}
+	sort.Strings(objects)
+	return objects
+}
+
+// LastChange returns the last commit on master that changed the data of an
+// object
+func (engine *CMEngine) LastChange(otype CMType, oname string) (*LogLine, error) {
+	ids, err := engine.ObjectCommits(otype, oname, "", 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, NewCMNoObjectError(oname, "master")
+	}
+
+	store, err := engine.store(otype)
+	if err != nil {
+		return nil, err
+	}
+	c, err := store.ReadCommit(ids[0])
+	if err != nil {
+		return nil, err
+	}
+	return &LogLine{
+		Time:           c.Committer.When,
+		Id:             c.ID,
+		Message:        c.Subject(),
+		Author:         c.Author.Name,
+		AuthorEmail:    c.Author.Email,
+		Committer:      c.Committer.Name,
+		CommitterEmail: c.Committer.Email,
+	}, nil
+}
+
+// HistoryLine is a line of object data that a commit on master added or
+// removed
+type HistoryLine struct {
+	Object  string
+	File    string
+	Commit  string
+	Time    time.Time
+	Author  string
+	Message string
+	Added   bool
+	Text    string
+}
+
+/*
+SearchHistory returns the lines matching pattern, a regular expression
+compared without regard to case, that commits on master added to or
+removed from the data of any object, newest first.  At most limit commits
+are looked at, unless limit is zero.
+*/
+func (engine *CMEngine) SearchHistory(otype CMType, pattern string, limit int) ([]HistoryLine, error) {
+	re, err := regexp.Compile("(?i)" + pattern)
+	if err != nil {
+		return nil, NewCMError(fmt.Sprintf("Bad pattern %s", pattern))
+	}
+
+	opts := []string{"log", "-i", "-G" + pattern, "--format=%x00%H%x1f%at%x1f%an%x1f%s",
+		"-p", "--no-color", "--no-ext-diff", "--unified=0"}
+	if limit > 0 {
+		opts = append(opts, fmt.Sprintf("-%d", limit))
+	}
+	opts = append(opts, "master", "--", ":(glob)*/data/**")
+	o, err := engine.run(otype, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := make([]HistoryLine, 0)
+	for _, record := range strings.Split(o, "\x00") {
+		if strings.TrimSpace(record) == "" {
+			continue
+		}
+		rl := strings.Split(record, "\n")
+		f := strings.SplitN(rl[0], "\x1f", 4)
+		if len(f) != 4 {
+			return nil, NewCMError("Can not read the history")
+		}
+		at, _ := strconv.ParseInt(f[1], 10, 64)
+		commit := HistoryLine{Commit: f[0], Time: time.Unix(at, 0), Author: f[2], Message: f[3]}
+
+		var file string
+		for _, l := range rl[1:] {
+			switch {
+			case strings.HasPrefix(l, "--- a/"):
+				file = strings.TrimPrefix(l, "--- a/")
+			case strings.HasPrefix(l, "+++ b/"):
+				file = strings.TrimPrefix(l, "+++ b/")
+			case strings.HasPrefix(l, "---"), strings.HasPrefix(l, "+++"):
+			case strings.HasPrefix(l, "+"), strings.HasPrefix(l, "-"):
+				parts := strings.SplitN(file, "/", 3)
+				if len(parts) != 3 || !re.MatchString(l[1:]) {
+					continue
+				}
+				h := commit
+				h.Object, h.File = parts[0], parts[2]
+				h.Added = l[0] == '+'
+				h.Text = l[1:]
+				lines = append(lines, h)
+			}
+		}
+	}
+	return lines, nil
+}
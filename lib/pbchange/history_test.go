@@ -0,0 +1,123 @@
+package pbchange
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestObjectHistory(t *testing.T) {
+	begin(t, "TestObjectHistory")
+	defer end(t, "TestObjectHistory")
+
+	cfg := setup()
+	engine, err := GetCMEngine(cfg)
+	defer cleanup(cfg, engine)
+	checkFatal(t, err)
+
+	_, err = engine.VersionObject(proposal("relay", "set service FTP on\n"), "")
+	checkFatal(t, err)
+	_, err = engine.VersionObject(proposal("meter", "set service FTP on\n"), "")
+	checkFatal(t, err)
+	from, err := engine.run(DEVICE, "rev-parse", "HEAD")
+	checkFatal(t, err)
+	from = strings.TrimSpace(from)
+
+	_, err = engine.VersionObject(proposal("relay", "set service FTP off\n"), "")
+	checkFatal(t, err)
+	_, err = engine.VersionObject(proposal("clock", "set service FTP off\n"), "")
+	checkFatal(t, err)
+
+	commits, err := engine.ObjectCommits(DEVICE, "relay", "", 0)
+	checkFatal(t, err)
+	if len(commits) != 2 {
+		t.Fatalf("Expected two commits of relay, got %v", commits)
+	}
+	old, err := engine.ObjectCommits(DEVICE, "relay", from, 1)
+	checkFatal(t, err)
+	if len(old) != 1 || old[0] != commits[1] {
+		t.Errorf("Expected %s before %s, got %v", commits[1], from, old)
+	}
+	if _, err = engine.ObjectCommits(DEVICE, "relay", "0123456", 1); err == nil {
+		t.Errorf("Got the history of an unknown commit")
+	}
+
+	changed, err := engine.ChangedObjects(DEVICE, from, "master")
+	checkFatal(t, err)
+	if fmt.Sprint(changed) != "[clock relay]" {
+		t.Errorf("Expected clock and relay to change, got %v", changed)
+	}
+	if _, err = engine.ChangedObjects(DEVICE, "0123456", "master"); err == nil {
+		t.Errorf("Compared with an unknown commit")
+	}
+}
+
+func TestSearchHistory(t *testing.T) {
+	begin(t, "TestSearchHistory")
+	defer end(t, "TestSearchHistory")
+
+	cfg := setup()
+	engine, err := GetCMEngine(cfg)
+	defer cleanup(cfg, engine)
+	checkFatal(t, err)
+
+	_, err = engine.VersionObject(proposal("relay", "set service FTP on\n"), "Turn FTP on")
+	checkFatal(t, err)
+	from := strings.Trim(engine.GetLatestCommitID(DEVICE), "\"")
+	checkFatal(t, engine.VersionMeta("relay", "driver", "sel421"))
+	_, err = engine.VersionObject(proposal("relay", "set service SSH on\n"), "Turn FTP off")
+	checkFatal(t, err)
+	to := strings.Trim(engine.GetLatestCommitID(DEVICE), "\"")
+
+	lines, err := engine.SearchHistory(DEVICE, "ftp", 0)
+	checkFatal(t, err)
+	if len(lines) != 2 || lines[0].Added || !lines[1].Added || lines[0].Object != "relay" ||
+		lines[0].File != "configFile" || lines[0].Text != "set service FTP on" || lines[0].Message != "Turn FTP off" {
+		t.Errorf("Unexpected history %+v", lines)
+	}
+	if lines, _ = engine.SearchHistory(DEVICE, "ftp", 1); len(lines) != 1 {
+		t.Errorf("Limit not applied: %+v", lines)
+	}
+	if _, err = engine.SearchHistory(DEVICE, "(", 0); err == nil {
+		t.Errorf("Searched with a bad pattern")
+	}
+
+	last, err := engine.LastChange(DEVICE, "relay")
+	checkFatal(t, err)
+	if last.Id != to || last.Message != "Turn FTP off" || last.Author != "Larry Bird" {
+		t.Errorf("Unexpected last change %+v", last)
+	}
+	if _, err = engine.LastChange(DEVICE, "breaker"); !IsCMNoObjectError(err) {
+		t.Errorf("Last change of an unknown object: %v", err)
+	}
+
+	meta, err := engine.ChangedMeta(from, to)
+	checkFatal(t, err)
+	if fmt.Sprint(meta) != "[relay]" {
+		t.Errorf("Unexpected changed metadata %v", meta)
+	}
+	m, err := engine.GetMetaAt("relay", to)
+	checkFatal(t, err)
+	if m["driver"] != "sel421" {
+		t.Errorf("Unexpected metadata %v", m)
+	}
+	if m, err = engine.GetMetaAt("relay", from); err != nil || len(m) != 0 {
+		t.Errorf("Unexpected earlier metadata %v %v", m, err)
+	}
+}
@@ -18,7 +18,9 @@ package pbchange
 
 import (
 	"fmt"
+	"strings"
 	"sync"
+	"time"
 )
 
 type cbStore struct {
@@ -81,3 +83,68 @@ func (engine *CMEngine) runPackRcvCBs(cbtype CMType, cbdata *ChangeData) {
 
 	wg.Wait()
 }
+
+// Kinds of events the engine tells its event listeners about
+const (
+	EventCommit       = "commit"       // An object was versioned
+	EventPackReceived = "packreceived" // Another node pushed commits here
+	EventTransaction  = "transaction"  // A transaction was finalized
+	EventConflict     = "conflict"     // Upstream history conflicts with this node
+)
+
+/*
+Event tells listeners outside the engine that a repository changed.
+Objects names the objects involved, several for a pack from another node.
+Status is only set for transaction events.
+*/
+type Event struct {
+	Kind        string
+	Type        CMType
+	Objects     []string
+	Commit      string
+	Transaction string
+	Status      string
+	Author      *CMAuthor
+	Message     string
+	SrcNode     string
+	Time        time.Time
+}
+
+type EventCB func(Event)
+
+// RegisterEventListener has fn called with every event of every repository
+func (engine *CMEngine) RegisterEventListener(fn EventCB) {
+	engine.eventCBs = append(engine.eventCBs, fn)
+}
+
+// commitEvent tells the event listeners about a commit to an object
+func (engine *CMEngine) commitEvent(data *ChangeData, message, branch, commit string) {
+	ev := Event{
+		Kind:    EventCommit,
+		Type:    data.ObjectType,
+		Objects: []string{data.Content.Object},
+		Commit:  strings.Trim(commit, "\""),
+		Author:  data.Author,
+		Message: message,
+	}
+	if branch != "master" {
+		ev.Transaction = branch
+	}
+	engine.runEventCBs(ev)
+}
+
+func (engine *CMEngine) runEventCBs(ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	for _, fn := range engine.eventCBs {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Error(fmt.Sprintf("Event listener failed: %v", r))
+				}
+			}()
+			fn(ev)
+		}()
+	}
+}
@@ -0,0 +1,629 @@
+package pbchange
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Directory next to the repositories holding the archives of compacted
+// history, one directory per repository
+const archiveDir = "archive"
+
+// Name of the manifest in a history archive
+const archiveManifest = "manifest.json"
+
+/*
+Retention limits how many versions of one file of an object the history of a
+repository keeps.  A version is expired when it is not among the newest Count
+versions, or is older than MaxAge.  A zero limit does not apply, and the
+latest version never expires.
+*/
+type Retention struct {
+	File   string
+	Count  int
+	MaxAge time.Duration
+}
+
+// RetentionCB returns the retention of the objects of a repository, by
+// object name
+type RetentionCB func() map[string]Retention
+
+// ArchivedVersion is an expired version of a file in a history archive
+type ArchivedVersion struct {
+	Object  string
+	File    string
+	Commit  string
+	Time    time.Time
+	Message string
+	Path    string // Of the content, within the archive
+}
+
+// Compaction is the outcome of compacting the history of a repository
+type Compaction struct {
+	Repository string
+	Time       time.Time
+	Expired    int
+	Archive    string `json:",omitempty"`
+	Before     string
+	After      string
+}
+
+// RepoStats are the size metrics of a repository
+type RepoStats struct {
+	Repository     string
+	Commits        int
+	LooseObjects   int
+	PackedObjects  int
+	Packs          int
+	ObjectsKiB     int64
+	DiskKiB        int64
+	LastGC         *time.Time  `json:",omitempty"`
+	LastCompaction *Compaction `json:",omitempty"`
+}
+
+type maintenance struct {
+	lastGC         *time.Time
+	lastCompaction *Compaction
+}
+
+/*
+RegisterRetention sets the function the engine asks for the retention of the
+objects of a repository before it compacts its history.  The history of a
+repository without one is never compacted.
+*/
+func (engine *CMEngine) RegisterRetention(otype CMType, fn RetentionCB) {
+	engine.maintLock.Lock()
+	defer engine.maintLock.Unlock()
+
+	if engine.retention == nil {
+		engine.retention = make(map[CMType]RetentionCB)
+	}
+	engine.retention[otype] = fn
+}
+
+func (engine *CMEngine) maintState(otype CMType) *maintenance {
+	if engine.maint == nil {
+		engine.maint = make(map[CMType]*maintenance)
+	}
+	m, ok := engine.maint[otype]
+	if !ok {
+		m = &maintenance{}
+		engine.maint[otype] = m
+	}
+	return m
+}
+
+// maintain compacts the history of the repositories with a retention, and
+// collects their garbage
+func (engine *CMEngine) maintain(t time.Time) {
+	maintLog.Debug("maintain(%v)", t)
+
+	for _, ctype := range cmTypes {
+		if _, err := engine.getGitDir(ctype); err != nil {
+			continue
+		}
+
+		engine.maintLock.Lock()
+		fn := engine.retention[ctype]
+		engine.maintLock.Unlock()
+
+		prune := false
+		if fn != nil {
+			c, err := engine.CompactHistory(ctype, fn(), t)
+			if err != nil {
+				maintLog.Error("Can not compact history of %s: %s", ctype, err.Error())
+			} else if c.Expired > 0 {
+				maintLog.Info("Archived %d expired versions of %s to %s", c.Expired, ctype, c.Archive)
+				prune = true
+			}
+		}
+
+		if err := engine.collectGarbage(ctype, prune, t); err != nil {
+			maintLog.Error("Can not collect garbage of %s: %s", ctype, err.Error())
+			continue
+		}
+		if stats, err := engine.RepoStats(ctype); err == nil {
+			maintLog.Info("%s: %d commits, %d objects, %d KiB on disk",
+				ctype, stats.Commits, stats.LooseObjects+stats.PackedObjects, stats.DiskKiB)
+		}
+	}
+}
+
+// collectGarbage packs a repository, dropping unreachable objects at once
+// when prune is set
+func (engine *CMEngine) collectGarbage(otype CMType, prune bool, t time.Time) error {
+	engine.guard(otype).Lock()
+	defer engine.guard(otype).Unlock()
+
+	args := []string{"gc", "--quiet"}
+	if prune {
+		args = append(args, "--prune=now")
+	}
+	if _, stderr, err := engine.runC(otype, args...); err != nil {
+		return NewCMError(strings.TrimSpace(stderr))
+	}
+
+	engine.maintLock.Lock()
+	engine.maintState(otype).lastGC = &t
+	engine.maintLock.Unlock()
+	return nil
+}
+
+// RepoStats returns the size of a repository, and when it was last
+// maintained
+func (engine *CMEngine) RepoStats(otype CMType) (*RepoStats, error) {
+	engine.guard(otype).Lock()
+	defer engine.guard(otype).Unlock()
+
+	dir, err := engine.getGitDir(otype)
+	if err != nil {
+		return nil, NewCMNoRepoError(otype.String())
+	}
+
+	stats := &RepoStats{Repository: otype.String()}
+
+	o, err := engine.run(otype, "count-objects", "-v")
+	if err != nil {
+		return nil, NewCMError(fmt.Sprintf("Can not count objects of %s", otype))
+	}
+	for _, line := range strings.Split(o, "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		n, _ := strconv.ParseInt(strings.TrimSpace(parts[1]), 10, 64)
+		switch parts[0] {
+		case "count":
+			stats.LooseObjects = int(n)
+		case "in-pack":
+			stats.PackedObjects = int(n)
+		case "packs":
+			stats.Packs = int(n)
+		case "size", "size-pack":
+			stats.ObjectsKiB += n
+		}
+	}
+
+	if o, err = engine.run(otype, "rev-list", "--count", "--all"); err == nil {
+		stats.Commits, _ = strconv.Atoi(strings.TrimSpace(o))
+	}
+
+	var size int64
+	filepath.Walk(filepath.Join(dir, ".git"), func(p string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	stats.DiskKiB = size / 1024
+
+	engine.maintLock.Lock()
+	m := engine.maintState(otype)
+	stats.LastGC = m.lastGC
+	stats.LastCompaction = m.lastCompaction
+	engine.maintLock.Unlock()
+
+	return stats, nil
+}
+
+/*
+CompactHistory drops the expired versions of files from the history of a
+repository.  The dropped versions are archived first, to a compressed tar
+file with a manifest under the archive directory.  Only commits that change
+nothing but an expired version are dropped, the commits after the first of
+them are made again with their author, committer and message, and master is
+moved only if the tree it ends with is unchanged.  Commits of the signed
+history are signed again.
+
+Compaction rewrites master, so it is refused while the repository has open
+transactions, and is meant for repositories that are not pushed upstream.
+*/
+func (engine *CMEngine) CompactHistory(otype CMType, policies map[string]Retention, now time.Time) (*Compaction, error) {
+	engine.guard(otype).Lock()
+	defer engine.guard(otype).Unlock()
+
+	c, err := engine.compactHistory(otype, policies, now)
+	if err != nil {
+		return nil, err
+	}
+
+	engine.maintLock.Lock()
+	engine.maintState(otype).lastCompaction = c
+	engine.maintLock.Unlock()
+	return c, nil
+}
+
+func (engine *CMEngine) compactHistory(otype CMType, policies map[string]Retention, now time.Time) (*Compaction, error) {
+	if _, err := engine.getGitDir(otype); err != nil {
+		return nil, NewCMNoRepoError(otype.String())
+	}
+	for _, trans := range engine.transactions.list() {
+		if trans.Ctype == otype && (trans.Status == ACTIVE || trans.Status == SCHEDULED) {
+			return nil, NewCMError(fmt.Sprintf("%s has open transactions", otype))
+		}
+	}
+
+	head, err := engine.run(otype, "rev-parse", "master")
+	if err != nil {
+		return nil, NewCMError(fmt.Sprintf("%s has no history", otype))
+	}
+	head = strings.TrimSpace(head)
+	c := &Compaction{Repository: otype.String(), Time: now, Before: head, After: head}
+
+	// Each line is a commit followed by its parents, oldest first
+	o, err := engine.run(otype, "rev-list", "--reverse", "--parents", "master")
+	if err != nil {
+		return nil, err
+	}
+	history := make([][]string, 0)
+	for _, line := range strings.Split(strings.TrimSpace(o), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 2 {
+			return nil, NewCMError(fmt.Sprintf("History of %s is not linear", otype))
+		}
+		history = append(history, fields)
+	}
+
+	expired, err := engine.expiredVersions(otype, policies, now)
+	if err != nil || len(expired) == 0 {
+		return c, err
+	}
+
+	first := -1
+	signedIdx := -1
+	signedFrom, err := engine.signedFrom(otype)
+	if err != nil {
+		return nil, err
+	}
+	for i, fields := range history {
+		if _, ok := expired[fields[0]]; ok && first == -1 {
+			first = i
+		}
+		if fields[0] == signedFrom {
+			signedIdx = i
+		}
+	}
+	if signedIdx >= 0 && !engine.Signing() {
+		// The commits made again would fail verification
+		return nil, NewCMSignatureError(fmt.Sprintf("Can not sign the compacted history of %s", otype))
+	}
+
+	versions := make([]ArchivedVersion, 0, len(expired))
+	for _, fields := range history {
+		if v, ok := expired[fields[0]]; ok {
+			versions = append(versions, v)
+		}
+	}
+	if c.Archive, err = engine.archiveVersions(otype, versions, now); err != nil {
+		return nil, err
+	}
+	abort := func(err error) (*Compaction, error) {
+		os.Remove(c.Archive)
+		return nil, err
+	}
+
+	prev := ""
+	if len(history[first]) > 1 {
+		prev = history[first][1]
+	}
+	newSignedFrom := ""
+	pending := false
+
+	// Until its next kept version, a file keeps the version before the
+	// expired ones, as its tree entry
+	kept := make(map[string]string)
+	for i := first; i < len(history); i++ {
+		commit := history[i][0]
+		if v, ok := expired[commit]; ok {
+			file := path.Join(v.Object, "data", v.File)
+			if _, ok := kept[file]; !ok {
+				entry, err := engine.run(otype, "ls-tree", commit+"^", "--", file)
+				if err != nil {
+					return abort(err)
+				}
+				kept[file] = strings.TrimSpace(entry)
+			}
+			if commit == signedFrom {
+				pending = true
+			}
+			continue
+		}
+
+		changed, err := engine.changedFiles(otype, commit)
+		if err != nil {
+			return abort(err)
+		}
+		for _, file := range changed {
+			delete(kept, file)
+		}
+
+		prev, err = engine.recommit(otype, commit, prev, kept, signedIdx >= 0 && i >= signedIdx)
+		if err != nil {
+			return abort(err)
+		}
+		if commit == signedFrom || pending {
+			newSignedFrom = prev
+			pending = false
+		}
+	}
+
+	oldTree, err := engine.run(otype, "rev-parse", head+"^{tree}")
+	if err != nil {
+		return abort(err)
+	}
+	newTree, err := engine.run(otype, "rev-parse", prev+"^{tree}")
+	if err != nil {
+		return abort(err)
+	}
+	if oldTree != newTree {
+		return abort(NewCMError(fmt.Sprintf("Compacted history of %s does not end with the same tree", otype)))
+	}
+
+	if _, stderr, err := engine.runC(otype, "update-ref", "-m", "Compact history", "refs/heads/master", prev, head); err != nil {
+		return abort(NewCMError(strings.TrimSpace(stderr)))
+	}
+	if newSignedFrom != "" {
+		if err = engine.setSignedFrom(otype, newSignedFrom); err != nil {
+			return nil, err
+		}
+	}
+	engine.run(otype, "checkout", "-q", "master")
+	engine.run(otype, "reset", "-q", "--hard", "master")
+	engine.run(otype, "reflog", "expire", "--expire-unreachable=now", "--all")
+
+	c.Expired = len(expired)
+	c.After = prev
+	return c, nil
+}
+
+// expiredVersions returns the versions the retention of each object lets go,
+// by commit.  The caller holds the guard.
+func (engine *CMEngine) expiredVersions(otype CMType, policies map[string]Retention, now time.Time) (map[string]ArchivedVersion, error) {
+	expired := make(map[string]ArchivedVersion)
+
+	for object, r := range policies {
+		if r.File == "" || (r.Count <= 0 && r.MaxAge <= 0) {
+			continue
+		}
+		file := path.Join(object, "data", r.File)
+
+		o, err := engine.run(otype, "log", "--format=%H %ct", "master", "--", file)
+		if err != nil {
+			return nil, err
+		}
+		for i, line := range strings.Split(strings.TrimSpace(o), "\n") {
+			fields := strings.Fields(line)
+			if i == 0 || len(fields) != 2 {
+				continue
+			}
+			secs, _ := strconv.ParseInt(fields[1], 10, 64)
+			when := time.Unix(secs, 0)
+			if !((r.Count > 0 && i >= r.Count) || (r.MaxAge > 0 && now.Sub(when) > r.MaxAge)) {
+				continue
+			}
+
+			// Keep commits that change anything else
+			changed, err := engine.changedFiles(otype, fields[0])
+			if err != nil {
+				return nil, err
+			}
+			if len(changed) != 1 || changed[0] != file {
+				continue
+			}
+
+			subject, _ := engine.run(otype, "log", "-1", "--format=%s", fields[0])
+			expired[fields[0]] = ArchivedVersion{
+				Object:  object,
+				File:    r.File,
+				Commit:  fields[0],
+				Time:    when.UTC(),
+				Message: strings.TrimSpace(subject),
+				Path:    path.Join(object, fields[0], r.File),
+			}
+		}
+	}
+	return expired, nil
+}
+
+// archiveVersions writes the expired versions, oldest first, and their
+// manifest to a new archive, and returns its path.  The caller holds the
+// guard.
+func (engine *CMEngine) archiveVersions(otype CMType, versions []ArchivedVersion, now time.Time) (string, error) {
+	dir := filepath.Join(engine.Repopath, archiveDir, otype.String())
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	name := filepath.Join(dir, fmt.Sprintf("%s-%s.tar.gz", otype, now.UTC().Format("20060102T150405Z")))
+
+	sort.SliceStable(versions, func(i, j int) bool {
+		return versions[i].Object < versions[j].Object
+	})
+
+	f, err := os.Create(name + ".tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(name + ".tmp")
+	defer f.Close()
+
+	zw := gzip.NewWriter(f)
+	tw := tar.NewWriter(zw)
+	add := func(p string, content []byte, when time.Time) error {
+		hdr := &tar.Header{Name: p, Mode: 0644, Size: int64(len(content)), ModTime: when}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(content)
+		return err
+	}
+
+	for _, v := range versions {
+		content, err := engine.run(otype, "show", v.Commit+":"+path.Join(v.Object, "data", v.File))
+		if err != nil {
+			return "", NewCMError(fmt.Sprintf("Can not read %s of %s at %s", v.File, v.Object, v.Commit))
+		}
+		if err = add(v.Path, []byte(content), v.Time); err != nil {
+			return "", err
+		}
+	}
+	manifest, err := json.MarshalIndent(versions, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err = add(archiveManifest, manifest, now); err != nil {
+		return "", err
+	}
+
+	if err = tw.Close(); err != nil {
+		return "", err
+	}
+	if err = zw.Close(); err != nil {
+		return "", err
+	}
+	if err = f.Sync(); err != nil {
+		return "", err
+	}
+	if err = os.Rename(name+".tmp", name); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// changedFiles returns the files a commit changes.  The caller holds the
+// guard.
+func (engine *CMEngine) changedFiles(otype CMType, commit string) ([]string, error) {
+	o, err := engine.run(otype, "diff-tree", "--no-commit-id", "--name-only", "-r", "--root", commit)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(o), nil
+}
+
+// runWith runs git with extra environment and the given input.  The caller
+// holds the guard.
+func (engine *CMEngine) runWith(otype CMType, env []string, stdin string, opts ...string) (string, error) {
+	cmd, err := engine.cmd(otype, opts...)
+	if err != nil {
+		return "", err
+	}
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdin = strings.NewReader(stdin)
+	o, err := cmd.Output()
+	return string(o), err
+}
+
+/*
+recommit makes a commit again on a new parent, with the author, committer and
+message of the original.  Its tree is the original one, with the entries of
+kept replacing those of the same files.  The caller holds the guard.
+*/
+func (engine *CMEngine) recommit(otype CMType, commit, parent string, kept map[string]string, sign bool) (string, error) {
+	raw, err := engine.run(otype, "cat-file", "commit", commit)
+	if err != nil {
+		return "", err
+	}
+	headers := raw
+	message := ""
+	if i := strings.Index(raw, "\n\n"); i >= 0 {
+		headers = raw[:i]
+		message = raw[i+2:]
+	}
+
+	var tree string
+	env := make([]string, 0)
+	for _, line := range strings.Split(headers, "\n") {
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		switch fields[0] {
+		case "tree":
+			tree = fields[1]
+		case "author":
+			env = append(env, identityEnv("AUTHOR", fields[1])...)
+		case "committer":
+			env = append(env, identityEnv("COMMITTER", fields[1])...)
+		}
+	}
+
+	if len(kept) > 0 {
+		dir, err := engine.getGitDir(otype)
+		if err != nil {
+			return "", err
+		}
+		index := []string{"GIT_INDEX_FILE=" + filepath.Join(dir, ".git", "compact-index")}
+		defer os.Remove(filepath.Join(dir, ".git", "compact-index"))
+
+		entries := make([]string, 0, len(kept))
+		for _, entry := range kept {
+			entries = append(entries, entry)
+		}
+		if _, err = engine.runWith(otype, index, "", "read-tree", tree); err != nil {
+			return "", err
+		}
+		if _, err = engine.runWith(otype, index, strings.Join(entries, "\n")+"\n", "update-index", "--index-info"); err != nil {
+			return "", err
+		}
+		o, err := engine.runWith(otype, index, "", "write-tree")
+		if err != nil {
+			return "", err
+		}
+		tree = strings.TrimSpace(o)
+	}
+
+	args := []string{"commit-tree", tree}
+	if parent != "" {
+		args = append(args, "-p", parent)
+	}
+	if sign {
+		args = append(args, "-S")
+	} else {
+		args = append(args, "--no-gpg-sign")
+	}
+
+	o, err := engine.runWith(otype, env, message, args...)
+	if err != nil {
+		return "", NewCMError(fmt.Sprintf("Can not make %s again: %s", commit, err.Error()))
+	}
+	return strings.TrimSpace(o), nil
+}
+
+// identityEnv turns an author or committer header of a commit into the
+// environment git takes it from
+func identityEnv(role, ident string) []string {
+	lt := strings.LastIndex(ident, "<")
+	gt := strings.LastIndex(ident, ">")
+	if lt < 0 || gt < lt {
+		return nil
+	}
+	return []string{
+		"GIT_" + role + "_NAME=" + strings.TrimSpace(ident[:lt]),
+		"GIT_" + role + "_EMAIL=" + ident[lt+1:gt],
+		"GIT_" + role + "_DATE=" + strings.TrimSpace(ident[gt+1:]),
+	}
+}
@@ -0,0 +1,152 @@
+package pbchange
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func reportRun(object, run string) *ChangeData {
+	content := NewCMContent(object)
+	content.Files["queryFile"] = []byte("select * from log")
+	content.Files["reportFile"] = []byte(run)
+
+	return &ChangeData{
+		ObjectType: REPORT,
+		Content:    content,
+		Author:     &CMAuthor{Name: "Larry Bird", Email: "tootall@celtics.net", When: time.Now()},
+	}
+}
+
+func TestCompactHistory(t *testing.T) {
+	begin(t, "TestCompactHistory")
+	defer end(t, "TestCompactHistory")
+
+	keys, err := ioutil.TempDir("", "keys")
+	checkFatal(t, err)
+	defer os.RemoveAll(keys)
+
+	cfg := setup()
+	cfg.ChMgmt.SigningKey = newKey(t, keys, "node")
+	engine, err := GetCMEngine(cfg)
+	defer cleanup(cfg, engine)
+	checkFatal(t, err)
+
+	for _, run := range []string{"run 1", "run 2", "run 3", "run 4", "run 5"} {
+		_, err = engine.VersionObject(reportRun("uptime", run), "")
+		checkFatal(t, err)
+		_, err = engine.VersionObject(reportRun("inventory", "inventory "+run), "")
+		checkFatal(t, err)
+	}
+	before, err := engine.RepoStats(REPORT)
+	checkFatal(t, err)
+	tree, err := engine.run(REPORT, "rev-parse", "master^{tree}")
+	checkFatal(t, err)
+
+	policies := map[string]Retention{"uptime": {File: "reportFile", Count: 2}}
+	c, err := engine.CompactHistory(REPORT, policies, time.Now())
+	checkFatal(t, err)
+	// The first run also added the query, so it stays
+	if c.Expired != 2 || c.Before == c.After {
+		t.Fatalf("Expected two expired runs, got %+v", c)
+	}
+
+	after, err := engine.RepoStats(REPORT)
+	checkFatal(t, err)
+	if after.Commits != before.Commits-2 || after.LastCompaction != c {
+		t.Errorf("Expected %d commits after compaction, got %+v", before.Commits-2, after)
+	}
+	if newTree, _ := engine.run(REPORT, "rev-parse", "master^{tree}"); newTree != tree {
+		t.Errorf("Compaction changed the tree")
+	}
+	if author, _ := engine.run(REPORT, "log", "-1", "--format=%an", "master"); strings.TrimSpace(author) != "Larry Bird" {
+		t.Errorf("Compaction lost the author, got %q", author)
+	}
+	runs, err := engine.run(REPORT, "log", "--format=%H", "master", "--", "uptime/data/reportFile")
+	checkFatal(t, err)
+	if n := len(strings.Fields(runs)); n != 3 {
+		t.Errorf("Expected three runs of uptime to remain, got %d", n)
+	}
+	v, err := engine.VerifyHistory(REPORT)
+	checkFatal(t, err)
+	if !v.Valid {
+		t.Errorf("Compacted history does not verify: %v", v.Problems)
+	}
+
+	// The expired runs are in the archive
+	f, err := os.Open(c.Archive)
+	checkFatal(t, err)
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	checkFatal(t, err)
+	tr := tar.NewReader(zr)
+	files := make(map[string]string)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		b, _ := ioutil.ReadAll(tr)
+		files[hdr.Name] = string(b)
+	}
+	var manifest []ArchivedVersion
+	checkFatal(t, json.Unmarshal([]byte(files[archiveManifest]), &manifest))
+	if len(manifest) != 2 {
+		t.Fatalf("Expected two versions in the manifest, got %+v", manifest)
+	}
+	for i, want := range []string{"run 2", "run 3"} {
+		if got := files[manifest[i].Path]; got != want {
+			t.Errorf("Expected %q archived at %s, got %q", want, manifest[i].Path, got)
+		}
+	}
+
+	// Nothing more expires
+	c, err = engine.CompactHistory(REPORT, policies, time.Now())
+	checkFatal(t, err)
+	if c.Expired != 0 || c.Archive != "" {
+		t.Errorf("Compacted twice: %+v", c)
+	}
+
+	// An open transaction holds compaction off, one that failed does not
+	aged := map[string]Retention{"inventory": {File: "reportFile", MaxAge: time.Hour}}
+	id, err := engine.BeginTransaction(reportRun("uptime", "run 6"), "")
+	checkFatal(t, err)
+	if _, err = engine.CompactHistory(REPORT, aged, time.Now().Add(2*time.Hour)); err == nil {
+		t.Errorf("Compacted with an open transaction")
+	}
+	checkFatal(t, engine.FinalizeTransaction(&ChangeData{ObjectType: REPORT, TransactionID: id}, FAILED))
+
+	c, err = engine.CompactHistory(REPORT, aged, time.Now().Add(2*time.Hour))
+	checkFatal(t, err)
+	if c.Expired != 3 {
+		t.Errorf("Expected three runs of inventory past their age, got %+v", c)
+	}
+
+	checkFatal(t, engine.collectGarbage(REPORT, true, time.Now()))
+	after, err = engine.RepoStats(REPORT)
+	checkFatal(t, err)
+	if after.LastGC == nil || after.LooseObjects != 0 || after.Packs != 1 {
+		t.Errorf("Garbage not collected: %+v", after)
+	}
+}
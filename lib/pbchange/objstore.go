@@ -0,0 +1,1052 @@
+package pbchange
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Modes of the entries of a tree
+const (
+	treeMode = "40000"
+	linkMode = "120000"
+	// Files the git backend writes are executable, new ones here match
+	fileMode = "100755"
+)
+
+// Object types of a pack entry
+var packTypes = map[byte]string{1: "commit", 2: "tree", 3: "blob", 4: "tag"}
+
+const (
+	packOfsDelta = 6
+	packRefDelta = 7
+)
+
+var (
+	objectID = regexp.MustCompile("^[0-9a-f]{40}$")
+	plainRef = regexp.MustCompile("^[A-Za-z0-9_][A-Za-z0-9_./-]*$")
+)
+
+/*
+nativeStorage does the reads and writes of Storage in process.  Objects are
+read from loose files and from the packs git gc leaves, and written as loose
+files, the same as git writes them.  Revisions it can not resolve from refs
+alone, like "master~2", are handed to git, and signing a commit runs
+ssh-keygen.  The rest of the engine runs git with this backend too.
+*/
+type nativeStorage struct {
+	engine *CMEngine
+	ctype  CMType
+	dir    string // The main working tree
+	gitdir string
+	git    *gitStorage
+
+	packs []*packIndex // Loaded on first use
+}
+
+type treeEntry struct {
+	mode string
+	name string
+	id   string
+}
+
+func (e treeEntry) isTree() bool {
+	return e.mode == treeMode
+}
+
+// packIndex is a version 2 pack index
+type packIndex struct {
+	pack    string
+	fanout  [256]uint32
+	ids     []byte
+	offsets []byte
+	large   []byte
+}
+
+type indexEntry struct {
+	stat [40]byte
+	id   string
+}
+
+func newNativeStorage(engine *CMEngine, ctype CMType, dir string, git *gitStorage) *nativeStorage {
+	return &nativeStorage{
+		engine: engine,
+		ctype:  ctype,
+		dir:    dir,
+		gitdir: filepath.Join(dir, ".git"),
+		git:    git,
+	}
+}
+
+func (s *nativeStorage) Resolve(rev string) (string, error) {
+	var id string
+	switch {
+	case objectID.MatchString(rev):
+		id = rev
+	case rev == "HEAD" || strings.HasPrefix(rev, "refs/"):
+		id = s.readRef(rev)
+	case plainRef.MatchString(rev) && !strings.Contains(rev, ".."):
+		for _, prefix := range []string{"refs/tags/", "refs/heads/", "refs/remotes/"} {
+			if id = s.readRef(prefix + rev); id != "" {
+				break
+			}
+		}
+	}
+	if id == "" {
+		return s.git.Resolve(rev)
+	}
+
+	// Tags are followed to what they tag
+	for {
+		typ, data, err := s.readObject(id)
+		if err != nil {
+			return "", NewCMError(fmt.Sprintf("Unknown commit %s", rev))
+		}
+		switch typ {
+		case "commit":
+			return id, nil
+		case "tag":
+			id = strings.TrimPrefix(strings.SplitN(string(data), "\n", 2)[0], "object ")
+		default:
+			return "", NewCMError(fmt.Sprintf("%s is not a commit", rev))
+		}
+	}
+}
+
+func (s *nativeStorage) ReadCommit(id string) (*StoredCommit, error) {
+	typ, data, err := s.readObject(id)
+	if err != nil || typ != "commit" {
+		return nil, NewCMError(fmt.Sprintf("Unknown commit %s", id))
+	}
+
+	c := &StoredCommit{ID: id, Parents: make([]string, 0)}
+	parts := strings.SplitN(string(data), "\n\n", 2)
+	if len(parts) == 2 {
+		c.Message = parts[1]
+	}
+	for _, line := range strings.Split(parts[0], "\n") {
+		f := strings.SplitN(line, " ", 2)
+		if len(f) != 2 {
+			continue
+		}
+		switch f[0] {
+		case "tree":
+			c.Tree = f[1]
+		case "parent":
+			c.Parents = append(c.Parents, f[1])
+		case "author":
+			c.Author = parseIdent(f[1])
+		case "committer":
+			c.Committer = parseIdent(f[1])
+		}
+	}
+	return c, nil
+}
+
+func (s *nativeStorage) ReadFiles(commit, dir string) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	e, err := s.lookup(commit, dir)
+	if err != nil || e == nil {
+		return files, err
+	}
+	return files, s.collect(*e, path.Clean(dir), files)
+}
+
+func (s *nativeStorage) ListDir(commit, dir string) ([]string, error) {
+	names := make([]string, 0)
+	e, err := s.lookup(commit, dir)
+	if err != nil || e == nil || !e.isTree() {
+		return names, err
+	}
+
+	entries, err := s.readTree(e.id)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		names = append(names, entry.name)
+	}
+	return names, nil
+}
+
+/*
+WriteFiles builds the new tree and commit of a branch from the objects
+already stored and moves the branch with the same lock file git uses.  A
+write to master also brings the main working tree and its index up to the
+new commit, so git finds them clean.
+*/
+func (s *nativeStorage) WriteFiles(branch string, files map[string][]byte, author *CMAuthor, message string) (string, error) {
+	if !plainRef.MatchString(branch) || strings.Contains(branch, "..") {
+		return "", NewCMError(fmt.Sprintf("Unknown branch %s", branch))
+	}
+
+	var g *sync.Mutex
+	if branch == "master" {
+		g = s.engine.guard(s.ctype)
+	} else {
+		g = s.engine.treeGuard(s.engine.worktreePath(s.ctype, branch))
+	}
+	g.Lock()
+	defer g.Unlock()
+
+	ref := "refs/heads/" + branch
+	parent := s.readRef(ref)
+	if parent == "" {
+		return "", NewCMError(fmt.Sprintf("Unknown branch %s", branch))
+	}
+	pc, err := s.ReadCommit(parent)
+	if err != nil {
+		return "", err
+	}
+
+	tree, err := s.updateTree(pc.Tree, files)
+	if err != nil {
+		return "", err
+	}
+	if tree == pc.Tree {
+		return "", nil
+	}
+
+	message = cleanMessage(message)
+	if message == "" {
+		return "", NewCMError("A commit needs a message")
+	}
+	now := time.Now()
+	commit := []byte(fmt.Sprintf("tree %s\nparent %s\nauthor %s\ncommitter %s\n\n%s",
+		tree, parent, formatIdent(author.Name, author.Email, now),
+		formatIdent(committerName, committerEmail, now), message))
+	if s.engine.Signing() {
+		if commit, err = s.sign(commit); err != nil {
+			return "", err
+		}
+	}
+
+	id, err := s.writeObject("commit", commit)
+	if err != nil {
+		return "", err
+	}
+	if err = s.updateRef(ref, parent, id, strings.SplitN(message, "\n", 2)[0], now); err != nil {
+		return "", err
+	}
+
+	if branch == "master" {
+		if head, _ := ioutil.ReadFile(filepath.Join(s.gitdir, "HEAD")); strings.TrimSpace(string(head)) == "ref: "+ref {
+			if err = s.checkout(tree, files); err != nil {
+				return id, err
+			}
+		}
+	}
+	return id, nil
+}
+
+// lookup returns the entry at dir in the tree of a commit, or nil if there
+// is none
+func (s *nativeStorage) lookup(commit, dir string) (*treeEntry, error) {
+	id, err := s.Resolve(commit)
+	if err != nil {
+		return nil, err
+	}
+	c, err := s.ReadCommit(id)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &treeEntry{mode: treeMode, id: c.Tree}
+	for _, name := range strings.Split(path.Clean(dir), "/") {
+		if name == "" || name == "." {
+			continue
+		}
+		if !e.isTree() {
+			return nil, nil
+		}
+		entries, err := s.readTree(e.id)
+		if err != nil {
+			return nil, err
+		}
+		var next *treeEntry
+		for i := range entries {
+			if entries[i].name == name {
+				next = &entries[i]
+				break
+			}
+		}
+		if next == nil {
+			return nil, nil
+		}
+		e = next
+	}
+	return e, nil
+}
+
+// collect reads every file under a tree entry into files
+func (s *nativeStorage) collect(e treeEntry, at string, files map[string][]byte) error {
+	if !e.isTree() {
+		if e.mode == "160000" {
+			return nil
+		}
+		_, data, err := s.readObject(e.id)
+		if err != nil {
+			return err
+		}
+		files[at] = data
+		return nil
+	}
+
+	entries, err := s.readTree(e.id)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err = s.collect(entry, path.Join(at, entry.name), files); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateTree writes files, keyed by their path below a tree, over the
+// tree and returns the new tree.  An empty id starts an empty tree.
+func (s *nativeStorage) updateTree(id string, files map[string][]byte) (string, error) {
+	entries := make([]treeEntry, 0)
+	if id != "" {
+		var err error
+		if entries, err = s.readTree(id); err != nil {
+			return "", err
+		}
+	}
+
+	set := func(e treeEntry) {
+		for i := range entries {
+			if entries[i].name == e.name {
+				entries[i] = e
+				return
+			}
+		}
+		entries = append(entries, e)
+	}
+	find := func(name string) *treeEntry {
+		for i := range entries {
+			if entries[i].name == name {
+				return &entries[i]
+			}
+		}
+		return nil
+	}
+
+	subdirs := make(map[string]map[string][]byte)
+	for name, content := range files {
+		parts := strings.SplitN(name, "/", 2)
+		if parts[0] == "" || parts[0] == "." || parts[0] == ".." || parts[0] == ".git" {
+			return "", NewCMError(fmt.Sprintf("Can not write %s", name))
+		}
+		if len(parts) == 2 {
+			if subdirs[parts[0]] == nil {
+				subdirs[parts[0]] = make(map[string][]byte)
+			}
+			subdirs[parts[0]][parts[1]] = content
+			continue
+		}
+
+		blob, err := s.writeObject("blob", content)
+		if err != nil {
+			return "", err
+		}
+		mode := fileMode
+		if old := find(name); old != nil && !old.isTree() && old.mode != linkMode {
+			mode = old.mode
+		}
+		set(treeEntry{mode: mode, name: name, id: blob})
+	}
+
+	for name, sub := range subdirs {
+		old := ""
+		if e := find(name); e != nil && e.isTree() {
+			old = e.id
+		}
+		tree, err := s.updateTree(old, sub)
+		if err != nil {
+			return "", err
+		}
+		set(treeEntry{mode: treeMode, name: name, id: tree})
+	}
+
+	return s.writeObject("tree", encodeTree(entries))
+}
+
+func (s *nativeStorage) readTree(id string) ([]treeEntry, error) {
+	typ, data, err := s.readObject(id)
+	if err != nil {
+		return nil, err
+	}
+	if typ != "tree" {
+		return nil, NewCMError(fmt.Sprintf("Object %s is a %s, not a tree", id, typ))
+	}
+
+	entries := make([]treeEntry, 0)
+	for len(data) > 0 {
+		sp := bytes.IndexByte(data, ' ')
+		nul := bytes.IndexByte(data, 0)
+		if sp < 0 || nul < sp || len(data) < nul+21 {
+			return nil, NewCMError(fmt.Sprintf("Corrupt tree %s", id))
+		}
+		entries = append(entries, treeEntry{
+			mode: string(data[:sp]),
+			name: string(data[sp+1 : nul]),
+			id:   hex.EncodeToString(data[nul+1 : nul+21]),
+		})
+		data = data[nul+21:]
+	}
+	return entries, nil
+}
+
+// encodeTree sorts entries the way git does, with a directory sorting as
+// if its name ended in a slash
+func encodeTree(entries []treeEntry) []byte {
+	key := func(e treeEntry) string {
+		if e.isTree() {
+			return e.name + "/"
+		}
+		return e.name
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return key(entries[i]) < key(entries[j])
+	})
+
+	var buf bytes.Buffer
+	for _, e := range entries {
+		raw, _ := hex.DecodeString(e.id)
+		fmt.Fprintf(&buf, "%s %s\x00", e.mode, e.name)
+		buf.Write(raw)
+	}
+	return buf.Bytes()
+}
+
+func (s *nativeStorage) objectPath(id string) string {
+	return filepath.Join(s.gitdir, "objects", id[:2], id[2:])
+}
+
+// readObject returns the type and content of an object
+func (s *nativeStorage) readObject(id string) (string, []byte, error) {
+	if !objectID.MatchString(id) {
+		return "", nil, NewCMError(fmt.Sprintf("Bad object ID %s", id))
+	}
+
+	for retry := 0; retry < 2; retry++ {
+		typ, data, err := s.readLoose(id)
+		if !os.IsNotExist(err) {
+			return typ, data, err
+		}
+		if typ, data, found, err := s.readPacked(id); found || err != nil {
+			return typ, data, err
+		}
+
+		// git gc may have just moved it to a new pack
+		s.packs = nil
+	}
+	return "", nil, NewCMError(fmt.Sprintf("Object %s not found", id))
+}
+
+func (s *nativeStorage) readLoose(id string) (string, []byte, error) {
+	f, err := os.Open(s.objectPath(id))
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+
+	zr, err := zlib.NewReader(f)
+	if err != nil {
+		return "", nil, err
+	}
+	b, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return "", nil, err
+	}
+
+	nul := bytes.IndexByte(b, 0)
+	if nul < 0 || len(strings.Fields(string(b[:nul]))) != 2 {
+		return "", nil, NewCMError(fmt.Sprintf("Corrupt object %s", id))
+	}
+	return strings.Fields(string(b[:nul]))[0], b[nul+1:], nil
+}
+
+func (s *nativeStorage) hasObject(id string) bool {
+	if _, err := os.Stat(s.objectPath(id)); err == nil {
+		return true
+	}
+	raw, _ := hex.DecodeString(id)
+	for _, idx := range s.packIndexes() {
+		if _, ok := idx.find(raw); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// writeObject stores an object as a loose file and returns its ID
+func (s *nativeStorage) writeObject(typ string, data []byte) (string, error) {
+	header := fmt.Sprintf("%s %d\x00", typ, len(data))
+	h := sha1.New()
+	h.Write([]byte(header))
+	h.Write(data)
+	id := hex.EncodeToString(h.Sum(nil))
+	if s.hasObject(id) {
+		return id, nil
+	}
+
+	dir := filepath.Dir(s.objectPath(id))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	tmp, err := ioutil.TempFile(dir, "tmp_obj_")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	zw := zlib.NewWriter(tmp)
+	zw.Write([]byte(header))
+	zw.Write(data)
+	if err = zw.Close(); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err = tmp.Close(); err != nil {
+		return "", err
+	}
+	if err = os.Chmod(tmp.Name(), 0444); err != nil {
+		return "", err
+	}
+	return id, os.Rename(tmp.Name(), s.objectPath(id))
+}
+
+func (s *nativeStorage) packIndexes() []*packIndex {
+	if s.packs != nil {
+		return s.packs
+	}
+
+	s.packs = make([]*packIndex, 0)
+	names, _ := filepath.Glob(filepath.Join(s.gitdir, "objects", "pack", "*.idx"))
+	for _, name := range names {
+		idx, err := loadPackIndex(name)
+		if err != nil {
+			log.Warning("Skipping pack index %s: %s", name, err.Error())
+			continue
+		}
+		s.packs = append(s.packs, idx)
+	}
+	return s.packs
+}
+
+func loadPackIndex(name string) (*packIndex, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < 8+256*4+40 || !bytes.Equal(b[:4], []byte("\377tOc")) || binary.BigEndian.Uint32(b[4:]) != 2 {
+		return nil, NewCMError("Not a version 2 pack index")
+	}
+
+	idx := &packIndex{pack: strings.TrimSuffix(name, ".idx") + ".pack"}
+	for i := range idx.fanout {
+		idx.fanout[i] = binary.BigEndian.Uint32(b[8+4*i:])
+	}
+	n := int(idx.fanout[255])
+	p := 8 + 256*4
+	if len(b) < p+28*n+40 {
+		return nil, NewCMError("Truncated pack index")
+	}
+	idx.ids = b[p : p+20*n]
+	p += 24 * n // Skip the CRCs
+	idx.offsets = b[p : p+4*n]
+	idx.large = b[p+4*n : len(b)-40]
+	return idx, nil
+}
+
+// find returns where an object starts in the pack
+func (idx *packIndex) find(id []byte) (int64, bool) {
+	if len(id) != 20 {
+		return 0, false
+	}
+	lo := 0
+	if id[0] > 0 {
+		lo = int(idx.fanout[id[0]-1])
+	}
+	hi := int(idx.fanout[id[0]])
+	i := lo + sort.Search(hi-lo, func(k int) bool {
+		return bytes.Compare(idx.ids[(lo+k)*20:(lo+k)*20+20], id) >= 0
+	})
+	if i >= hi || !bytes.Equal(idx.ids[i*20:i*20+20], id) {
+		return 0, false
+	}
+
+	off := binary.BigEndian.Uint32(idx.offsets[4*i:])
+	if off&0x80000000 == 0 {
+		return int64(off), true
+	}
+	j := int(off&0x7fffffff) * 8
+	if j+8 > len(idx.large) {
+		return 0, false
+	}
+	return int64(binary.BigEndian.Uint64(idx.large[j:])), true
+}
+
+func (s *nativeStorage) readPacked(id string) (string, []byte, bool, error) {
+	raw, _ := hex.DecodeString(id)
+	for _, idx := range s.packIndexes() {
+		off, ok := idx.find(raw)
+		if !ok {
+			continue
+		}
+		f, err := os.Open(idx.pack)
+		if err != nil {
+			return "", nil, false, err
+		}
+		typ, data, err := s.readPackEntry(f, off)
+		f.Close()
+		return typ, data, true, err
+	}
+	return "", nil, false, nil
+}
+
+// readPackEntry reads the object at off in a pack, applying deltas
+func (s *nativeStorage) readPackEntry(f *os.File, off int64) (string, []byte, error) {
+	r := bufio.NewReader(io.NewSectionReader(f, off, 1<<62))
+	c, err := r.ReadByte()
+	if err != nil {
+		return "", nil, err
+	}
+	typ := (c >> 4) & 7
+	size := int64(c & 15)
+	for shift := uint(4); c&0x80 != 0; shift += 7 {
+		if c, err = r.ReadByte(); err != nil {
+			return "", nil, err
+		}
+		size |= int64(c&0x7f) << shift
+	}
+
+	var btyp string
+	var base []byte
+	switch typ {
+	case packOfsDelta:
+		if c, err = r.ReadByte(); err != nil {
+			return "", nil, err
+		}
+		rel := int64(c & 0x7f)
+		for c&0x80 != 0 {
+			if c, err = r.ReadByte(); err != nil {
+				return "", nil, err
+			}
+			rel = (rel+1)<<7 | int64(c&0x7f)
+		}
+		btyp, base, err = s.readPackEntry(f, off-rel)
+	case packRefDelta:
+		raw := make([]byte, 20)
+		if _, err = io.ReadFull(r, raw); err != nil {
+			return "", nil, err
+		}
+		btyp, base, err = s.readObject(hex.EncodeToString(raw))
+	default:
+		name, ok := packTypes[typ]
+		if !ok {
+			return "", nil, NewCMError(fmt.Sprintf("Unknown pack entry type %d", typ))
+		}
+		data, err := inflate(r, size)
+		return name, data, err
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	delta, err := inflate(r, size)
+	if err != nil {
+		return "", nil, err
+	}
+	data, err := applyDelta(base, delta)
+	return btyp, data, err
+}
+
+func inflate(r io.Reader, size int64) ([]byte, error) {
+	zr, err := zlib.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, size)
+	_, err = io.ReadFull(zr, data)
+	return data, err
+}
+
+// applyDelta rebuilds an object from its base and a git delta
+func applyDelta(base, delta []byte) ([]byte, error) {
+	corrupt := NewCMError("Corrupt delta in pack")
+
+	src, n := deltaSize(delta)
+	if n == 0 || src != len(base) {
+		return nil, corrupt
+	}
+	delta = delta[n:]
+	dst, n := deltaSize(delta)
+	if n == 0 {
+		return nil, corrupt
+	}
+	delta = delta[n:]
+
+	out := make([]byte, 0, dst)
+	for len(delta) > 0 {
+		op := delta[0]
+		delta = delta[1:]
+		switch {
+		case op&0x80 != 0:
+			// Copy from the base: four offset bytes, then three size
+			// bytes, each present if its bit is set
+			var off, size int
+			for i := uint(0); i < 7; i++ {
+				if op&(1<<i) == 0 {
+					continue
+				}
+				if len(delta) == 0 {
+					return nil, corrupt
+				}
+				if i < 4 {
+					off |= int(delta[0]) << (8 * i)
+				} else {
+					size |= int(delta[0]) << (8 * (i - 4))
+				}
+				delta = delta[1:]
+			}
+			if size == 0 {
+				size = 0x10000
+			}
+			if off+size > len(base) {
+				return nil, corrupt
+			}
+			out = append(out, base[off:off+size]...)
+		case op != 0:
+			// Insert the next op bytes
+			if int(op) > len(delta) {
+				return nil, corrupt
+			}
+			out = append(out, delta[:op]...)
+			delta = delta[op:]
+		default:
+			return nil, corrupt
+		}
+	}
+	if len(out) != dst {
+		return nil, corrupt
+	}
+	return out, nil
+}
+
+func deltaSize(b []byte) (int, int) {
+	size := 0
+	for i, c := range b {
+		size |= int(c&0x7f) << (7 * uint(i))
+		if c&0x80 == 0 {
+			return size, i + 1
+		}
+	}
+	return 0, 0
+}
+
+// readRef returns the commit a ref points at, following symbolic refs, or
+// nothing if there is no such ref
+func (s *nativeStorage) readRef(name string) string {
+	for depth := 0; depth < 5; depth++ {
+		b, err := ioutil.ReadFile(filepath.Join(s.gitdir, name))
+		if err != nil {
+			return s.packedRef(name)
+		}
+		v := strings.TrimSpace(string(b))
+		if !strings.HasPrefix(v, "ref: ") {
+			return v
+		}
+		name = strings.TrimPrefix(v, "ref: ")
+	}
+	return ""
+}
+
+func (s *nativeStorage) packedRef(name string) string {
+	b, err := ioutil.ReadFile(filepath.Join(s.gitdir, "packed-refs"))
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		f := strings.Fields(line)
+		if len(f) == 2 && f[1] == name && objectID.MatchString(f[0]) {
+			return f[0]
+		}
+	}
+	return ""
+}
+
+// updateRef moves a ref from old to id under the lock file git uses, and
+// logs the move where git keeps a log of the ref
+func (s *nativeStorage) updateRef(ref, old, id, subject string, when time.Time) error {
+	name := filepath.Join(s.gitdir, ref)
+	lock, err := os.OpenFile(name+".lock", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return NewCMError(fmt.Sprintf("Can not lock %s: %s", ref, err.Error()))
+	}
+	defer os.Remove(name + ".lock")
+
+	if cur := s.readRef(ref); cur != old {
+		lock.Close()
+		return NewCMError(fmt.Sprintf("%s moved while it was being written", ref))
+	}
+	_, err = lock.WriteString(id + "\n")
+	if cerr := lock.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(name+".lock", name); err != nil {
+		return err
+	}
+
+	entry := fmt.Sprintf("%s %s %s\tcommit: %s\n", old, id,
+		formatIdent(committerName, committerEmail, when), subject)
+	for _, l := range []string{ref, "HEAD"} {
+		if l == "HEAD" && s.readRef("HEAD") != id {
+			continue
+		}
+		f, err := os.OpenFile(filepath.Join(s.gitdir, "logs", l), os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			continue
+		}
+		f.WriteString(entry)
+		f.Close()
+	}
+	return nil
+}
+
+// checkout writes the files of a commit to master into the main working
+// tree and rewrites the index from the new tree
+func (s *nativeStorage) checkout(tree string, files map[string][]byte) error {
+	for name, content := range files {
+		p := filepath.Join(s.dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), os.ModeDir|0700); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(p, content, os.ModePerm); err != nil {
+			return err
+		}
+	}
+	return s.writeIndex(tree)
+}
+
+/*
+writeIndex writes a version 2 index of a tree.  Entries that did not change
+keep the file status git recorded; the others get none, which makes git
+compare the file with its content the next time it looks.
+*/
+func (s *nativeStorage) writeIndex(tree string) error {
+	old := s.readIndex()
+
+	type entry struct {
+		path, mode, id string
+	}
+	entries := make([]entry, 0)
+	var walk func(id, at string) error
+	walk = func(id, at string) error {
+		children, err := s.readTree(id)
+		if err != nil {
+			return err
+		}
+		for _, c := range children {
+			p := path.Join(at, c.name)
+			if c.isTree() {
+				if err = walk(c.id, p); err != nil {
+					return err
+				}
+				continue
+			}
+			entries = append(entries, entry{path: p, mode: c.mode, id: c.id})
+		}
+		return nil
+	}
+	if err := walk(tree, ""); err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].path < entries[j].path
+	})
+
+	var buf bytes.Buffer
+	buf.WriteString("DIRC")
+	binary.Write(&buf, binary.BigEndian, uint32(2))
+	binary.Write(&buf, binary.BigEndian, uint32(len(entries)))
+	for _, e := range entries {
+		var stat [40]byte
+		if o, ok := old[e.path]; ok && o.id == e.id {
+			stat = o.stat
+		}
+		mode, _ := strconv.ParseUint(e.mode, 8, 32)
+		binary.BigEndian.PutUint32(stat[24:], uint32(mode))
+		buf.Write(stat[:])
+
+		raw, _ := hex.DecodeString(e.id)
+		buf.Write(raw)
+		flags := len(e.path)
+		if flags > 0xfff {
+			flags = 0xfff
+		}
+		binary.Write(&buf, binary.BigEndian, uint16(flags))
+		buf.WriteString(e.path)
+		buf.Write(make([]byte, (62+len(e.path)+8)&^7-(62+len(e.path))))
+	}
+	sum := sha1.Sum(buf.Bytes())
+	buf.Write(sum[:])
+
+	name := filepath.Join(s.gitdir, "index")
+	lock, err := os.OpenFile(name+".lock", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return NewCMError(fmt.Sprintf("Can not lock the index: %s", err.Error()))
+	}
+	defer os.Remove(name + ".lock")
+	_, err = lock.Write(buf.Bytes())
+	if cerr := lock.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(name+".lock", name)
+}
+
+// readIndex returns the merged entries of a version 2 or 3 index, keyed
+// by path, or nothing if it can not read the index
+func (s *nativeStorage) readIndex() map[string]indexEntry {
+	entries := make(map[string]indexEntry)
+	b, err := ioutil.ReadFile(filepath.Join(s.gitdir, "index"))
+	if err != nil || len(b) < 12 || string(b[:4]) != "DIRC" {
+		return entries
+	}
+	if v := binary.BigEndian.Uint32(b[4:]); v != 2 && v != 3 {
+		return entries
+	}
+
+	n := int(binary.BigEndian.Uint32(b[8:]))
+	p := 12
+	for i := 0; i < n; i++ {
+		if p+62 > len(b) {
+			return entries
+		}
+		var e indexEntry
+		copy(e.stat[:], b[p:p+40])
+		e.id = hex.EncodeToString(b[p+40 : p+60])
+		flags := binary.BigEndian.Uint16(b[p+60:])
+		q := p + 62
+		if flags&0x4000 != 0 {
+			q += 2
+		}
+		nul := bytes.IndexByte(b[q:], 0)
+		if nul < 0 {
+			return entries
+		}
+		if flags&0x3000 == 0 {
+			entries[string(b[q:q+nul])] = e
+		}
+		p += (q - p + nul + 8) &^ 7
+	}
+	return entries
+}
+
+// sign adds the node's signature to a commit, as git does with gpg.format
+// set to ssh
+func (s *nativeStorage) sign(commit []byte) ([]byte, error) {
+	cmd := exec.Command("ssh-keygen", "-Y", "sign", "-q", "-n", "git", "-f", s.engine.signingKey)
+	cmd.Stdin = bytes.NewReader(commit)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	sig, err := cmd.Output()
+	if err != nil {
+		return nil, NewCMSignatureError(fmt.Sprintf("Can not sign commit: %s", strings.TrimSpace(stderr.String())))
+	}
+
+	header := "gpgsig " + strings.Replace(strings.TrimRight(string(sig), "\n"), "\n", "\n ", -1) + "\n"
+	i := bytes.Index(commit, []byte("\n\n")) + 1
+	signed := make([]byte, 0, len(commit)+len(header))
+	signed = append(signed, commit[:i]...)
+	signed = append(signed, header...)
+	return append(signed, commit[i:]...), nil
+}
+
+// cleanMessage tidies a commit message as git commit -m does: trailing
+// whitespace and blank lines at either end go, runs of blank lines become
+// one
+func cleanMessage(message string) string {
+	lines := make([]string, 0)
+	blank := false
+	for _, line := range strings.Split(message, "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" {
+			blank = len(lines) > 0
+			continue
+		}
+		if blank {
+			lines = append(lines, "")
+			blank = false
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func formatIdent(name, email string, when time.Time) string {
+	clean := strings.NewReplacer("<", "", ">", "", "\n", "")
+	return fmt.Sprintf("%s <%s> %d %s", strings.TrimSpace(clean.Replace(name)),
+		strings.TrimSpace(clean.Replace(email)), when.Unix(), when.Format("-0700"))
+}
+
+// parseIdent reads "Name <email> seconds zone"
+func parseIdent(s string) *CMAuthor {
+	a := &CMAuthor{}
+	lt, gt := strings.Index(s, "<"), strings.LastIndex(s, ">")
+	if lt < 0 || gt < lt {
+		a.Name = s
+		return a
+	}
+	a.Name = strings.TrimSpace(s[:lt])
+	a.Email = s[lt+1 : gt]
+	if f := strings.Fields(s[gt+1:]); len(f) > 0 {
+		secs, _ := strconv.ParseInt(f[0], 10, 64)
+		a.When = time.Unix(secs, 0)
+	}
+	return a
+}
@@ -0,0 +1,152 @@
+package pbchange
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNativeStorage(t *testing.T) {
+	begin(t, "TestNativeStorage")
+	defer end(t, "TestNativeStorage")
+
+	keys, err := ioutil.TempDir("", "keys")
+	checkFatal(t, err)
+	defer os.RemoveAll(keys)
+
+	cfg := setup()
+	cfg.Global.NodeName = "substation"
+	cfg.ChMgmt.SigningKey = newKey(t, keys, "node")
+	cfg.ChMgmt.Storage = StorageNative
+	engine, err := GetCMEngine(cfg)
+	defer cleanup(cfg, engine)
+	checkFatal(t, err)
+
+	first, err := engine.VersionObject(proposal("relay", "set service FTP on\n"), "")
+	checkFatal(t, err)
+	_, err = engine.VersionObject(proposal("relay", "set service FTP off\n"), "Turn FTP off\n\n\n")
+	checkFatal(t, err)
+	_, err = engine.VersionObject(proposal("breaker", "set service SSH on\n"), "")
+	checkFatal(t, err)
+	if c, err := engine.VersionObject(proposal("breaker", "set service SSH on\n"), ""); err != nil || c != "" {
+		t.Errorf("Unchanged object committed: %q %v", c, err)
+	}
+
+	id, err := engine.BeginTransaction(proposal("relay", "set service FTP on\n"), "In flight")
+	checkFatal(t, err)
+	checkFatal(t, engine.FinalizeTransaction(&ChangeData{ObjectType: DEVICE, TransactionID: id}))
+
+	// git takes what was written as its own
+	git := func(args ...string) string {
+		o, stderr, err := engine.runC(DEVICE, args...)
+		if err != nil {
+			t.Fatalf("git %v: %s %v", args, stderr, err)
+		}
+		return o
+	}
+	git("fsck", "--strict")
+	if o := git("status", "--porcelain"); o != "" {
+		t.Errorf("Main working tree not clean: %q", o)
+	}
+	if o := git("log", "-1", "--format=%B", "master~1"); o != "Turn FTP off\n\n" {
+		t.Errorf("Message not cleaned up: %q", o)
+	}
+	v, err := engine.VerifyHistory(DEVICE)
+	checkFatal(t, err)
+	if !v.Valid {
+		t.Errorf("Signed history does not verify: %+v", v.Problems)
+	}
+	if o := git("log", "-1", "--format=%an <%ae> %cn", first[1:len(first)-1]); o != "Larry Bird <tootall@celtics.net> Change Management Engine\n" {
+		t.Errorf("Unexpected identities %q", o)
+	}
+
+	// Both backends read the same, from loose objects and from packs
+	native, err := engine.store(DEVICE)
+	checkFatal(t, err)
+	cli := &gitStorage{engine: engine, ctype: DEVICE}
+	compare := func(when string) {
+		for _, rev := range []string{"master", "master~2", first[1 : len(first)-1]} {
+			nid, err := native.Resolve(rev)
+			checkFatal(t, err)
+			cid, err := cli.Resolve(rev)
+			checkFatal(t, err)
+			if nid != cid {
+				t.Errorf("%s: %s resolves to %s and %s", when, rev, nid, cid)
+			}
+
+			nf, err := native.ReadFiles(nid, "relay")
+			checkFatal(t, err)
+			cf, err := cli.ReadFiles(cid, "relay")
+			checkFatal(t, err)
+			if len(nf) == 0 || !reflect.DeepEqual(nf, cf) {
+				t.Errorf("%s: files at %s differ: %q %q", when, rev, nf, cf)
+			}
+
+			nc, err := native.ReadCommit(nid)
+			checkFatal(t, err)
+			cc, err := cli.ReadCommit(cid)
+			checkFatal(t, err)
+			if nc.Tree != cc.Tree || nc.Message != cc.Message || !reflect.DeepEqual(nc.Parents, cc.Parents) ||
+				*nc.Author != *cc.Author || *nc.Committer != *cc.Committer {
+				t.Errorf("%s: commit %s differs: %+v %+v", when, rev, nc, cc)
+			}
+		}
+
+		names, err := native.ListDir("master", "")
+		checkFatal(t, err)
+		if strings.Join(names, " ") != "README breaker relay" {
+			t.Errorf("%s: unexpected names %v", when, names)
+		}
+	}
+	compare("loose")
+
+	git("gc", "--quiet", "--aggressive")
+	if loose, _ := filepath.Glob(filepath.Join(cfg.ChMgmt.RepoPath, "DEVICE", ".git", "objects", "??")); len(loose) != 0 {
+		t.Fatalf("gc left loose objects: %v", loose)
+	}
+	native, _ = engine.store(DEVICE)
+	compare("packed")
+
+	// Writing on top of packed objects and refs
+	_, err = engine.VersionObject(proposal("relay", "set service FTP off\n"), "")
+	checkFatal(t, err)
+	git("fsck", "--strict")
+	cd, err := engine.GetObject(DEVICE, "relay")
+	checkFatal(t, err)
+	if string(cd.Content.Files["configFile"]) != "set service FTP off\n" {
+		t.Errorf("Unexpected content %q", cd.Content.Files["configFile"])
+	}
+	if o := git("status", "--porcelain"); o != "" {
+		t.Errorf("Main working tree not clean: %q", o)
+	}
+
+	// Nodes on either backend exchange history
+	clone := filepath.Join(keys, "clone")
+	out, err := exec.Command("git", "clone", "-q", filepath.Join(cfg.ChMgmt.RepoPath, "DEVICE"), clone).CombinedOutput()
+	if err != nil {
+		t.Fatalf("git clone: %s %v", out, err)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(clone, "relay", "data", "configFile")); string(b) != "set service FTP off\n" {
+		t.Errorf("Clone has %q", b)
+	}
+}
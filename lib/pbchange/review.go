@@ -0,0 +1,489 @@
+package pbchange
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Trailers written to the commit that records a review
+const (
+	TrailerChangeRequest = "Change-Request"
+	TrailerProposedBy    = "Proposed-by"
+	TrailerApprovedBy    = "Approved-by"
+	TrailerRejectedBy    = "Rejected-by"
+	TrailerComment       = "Review-Comment"
+)
+
+/*
+Review is the approval record of a change request.  Until the request is
+reviewed only the proposer is set.  The record is kept in the metadata of
+the commit that merges the transaction branch into master, or, for a
+rejected request, of an empty commit at the tip of the branch.
+*/
+type Review struct {
+	TransactionID string
+	Proposer      *CMAuthor
+	Reviewer      *CMAuthor
+	Approved      bool
+	Comment       string
+}
+
+// StatementDiff lists the statements a change request adds to, and
+// removes from, the object on master.  Statements are compared without
+// regard to their order, indentation or comments.
+type StatementDiff struct {
+	Object  string
+	Added   []string
+	Removed []string
+}
+
+/*
+ProposeChange versions data on a new transaction branch and holds it there
+for review.  The returned transaction ID names the change request.  Nothing
+reaches master until ApproveChange is called by someone other than the
+author.
+*/
+func (engine *CMEngine) ProposeChange(data *ChangeData, message string) (string, error) {
+	if data.Author == nil || data.Author.Name == "" {
+		return "", NewCMReviewError("A change request needs an author")
+	}
+
+	id, err := engine.BeginTransaction(data, message)
+	if err != nil {
+		return "", err
+	}
+
+	count, err := engine.run(data.ObjectType, "rev-list", "--count", "master.."+id)
+	if err != nil || strings.TrimSpace(count) == "0" {
+		engine.removeBranch(id, data.ObjectType)
+		engine.transactions.remove(id)
+		return "", NewCMReviewError(fmt.Sprintf("Change to %s does not modify it", data.Content.Object))
+	}
+
+	err = engine.transactions.update(id, func(t *Transaction) {
+		t.Status = PENDING
+		t.Review = &Review{TransactionID: id, Proposer: data.Author}
+	})
+	if err != nil {
+		return "", err
+	}
+
+	log.Info("Change request %s for %s %s proposed by %s", id, data.ObjectType, data.Content.Object, data.Author.Name)
+	return id, nil
+}
+
+/*
+ProposeRemoval proposes taking an object out of the repository.  It is held
+for review like any other change request, and the object stays on master
+until the request is approved.
+*/
+func (engine *CMEngine) ProposeRemoval(otype CMType, oname string, author *CMAuthor, message string) (string, error) {
+	if author == nil || author.Name == "" {
+		return "", NewCMReviewError("A change request needs an author")
+	}
+	if message == "" {
+		message = fmt.Sprintf("Removing %s from repository", oname)
+	}
+
+	data := &ChangeData{ObjectType: otype, Content: NewCMContent(oname), Author: author}
+	id, err := engine.openTransaction(data, message)
+	if err != nil {
+		return "", err
+	}
+	fail := func(err error) (string, error) {
+		engine.removeBranch(id, otype)
+		engine.transactions.remove(id)
+		return "", err
+	}
+
+	dir, err := engine.worktree(otype, id)
+	if err != nil {
+		return fail(err)
+	}
+	engine.treeGuard(dir).Lock()
+	engine.runIn(dir, "reset", "-q", "--hard")
+	_, stderr, err := engine.runIn(dir, "rm", "-r", "-q", "--", oname)
+	if err == nil {
+		_, stderr, err = engine.runIn(dir, "commit", "-q", "--author", formatAuthor(author), "-m", message)
+	}
+	engine.treeGuard(dir).Unlock()
+	if err != nil {
+		return fail(NewCMReviewError(fmt.Sprintf("Can not remove %s: %s", oname, strings.TrimSpace(stderr))))
+	}
+
+	err = engine.transactions.update(id, func(t *Transaction) {
+		t.Status = PENDING
+		t.Review = &Review{TransactionID: id, Proposer: author}
+	})
+	if err != nil {
+		return "", err
+	}
+
+	log.Info("Change request %s to remove %s %s proposed by %s", id, otype, oname, author.Name)
+	return id, nil
+}
+
+// ChangeRequests returns the change requests the engine knows about,
+// keyed by transaction ID.  Approved requests drop out once their branch
+// has been swept.
+func (engine *CMEngine) ChangeRequests() map[string]Transaction {
+	reqs := make(map[string]Transaction, 0)
+	for _, t := range engine.transactions.list() {
+		if t.Review != nil {
+			reqs[t.ID] = t
+		}
+	}
+	return reqs
+}
+
+func (engine *CMEngine) GetChangeRequest(id string) (Transaction, error) {
+	t, ok := engine.transactions.get(id)
+	if !ok || t.Review == nil {
+		return Transaction{}, NewCMError("Unknown change request")
+	}
+	return t, nil
+}
+
+// ReviewDiff lists the statements a change request adds to and removes
+// from its object.  Secrets are shown as they are.
+func (engine *CMEngine) ReviewDiff(id string) (*StatementDiff, error) {
+	t, err := engine.GetChangeRequest(id)
+	if err != nil {
+		return nil, err
+	}
+
+	base, err := engine.objectStatements(t.Ctype, "master", t.Object)
+	if err != nil {
+		return nil, err
+	}
+	proposed, err := engine.objectStatements(t.Ctype, id, t.Object)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StatementDiff{
+		Object:  t.Object,
+		Added:   subtractStatements(proposed, base),
+		Removed: subtractStatements(base, proposed),
+	}, nil
+}
+
+/*
+ApproveChange merges a pending change request into master and finalizes
+its transaction, which runs the commit listeners.  The reviewer must not
+be the proposer.  apply, if not nil, is given the object as merged, to
+send it on to a device; if it fails the merge is reverted, so master keeps
+what the device has, the transaction fails and the error from apply comes
+back.  The ID of the merge commit is returned.
+*/
+func (engine *CMEngine) ApproveChange(id string, reviewer *CMAuthor, comment string, apply func(*ChangeData) error) (string, error) {
+	t, review, err := engine.startReview(id, reviewer, comment)
+	if err != nil {
+		return "", err
+	}
+	review.Approved = true
+
+	commit, stderr, err := engine.mergeToMaster(t.Ctype, reviewer, review.commitMessage(t.Message), id)
+	if stderr != "" {
+		log.Warning("Merging change request %s failed: %s", id, stderr)
+		return "", NewCMReviewError(fmt.Sprintf("Change request %s does not merge cleanly into master", id))
+	}
+	if err != nil {
+		return "", err
+	}
+
+	engine.transactions.update(id, func(t *Transaction) {
+		t.Review = review
+	})
+	log.Notice("Change request %s approved by %s", id, reviewer.Name)
+
+	cdata, err := engine.GetObject(t.Ctype, t.Object)
+	if err != nil {
+		return commit, err
+	}
+	cdata.CommitID = commit
+	cdata.TransactionID = id
+
+	if apply != nil {
+		if err = apply(cdata); err != nil {
+			log.Warning("Change request %s could not be applied: %s", id, err.Error())
+			message := fmt.Sprintf("Revert change request %s\n\n%s\n\n%s: %s", id, err.Error(), TrailerChangeRequest, id)
+			if _, rerr := engine.revertMerge(t.Ctype, reviewer, message, commit); rerr != nil {
+				log.Error("Change request %s stays on master: %s", id, rerr.Error())
+			}
+			engine.FinalizeTransaction(cdata, FAILED)
+			return "", err
+		}
+	}
+	return commit, engine.FinalizeTransaction(cdata)
+}
+
+// RejectChange turns a pending change request down.  The branch is kept for
+// a while so the rejection can still be looked at.
+func (engine *CMEngine) RejectChange(id string, reviewer *CMAuthor, comment string) error {
+	t, review, err := engine.startReview(id, reviewer, comment)
+	if err != nil {
+		return err
+	}
+
+	// The rejection is recorded on the branch, in its worktree, brought up
+	// to the branch in case the branch was written without it
+	dir, err := engine.worktree(t.Ctype, t.Branch)
+	if err != nil {
+		return err
+	}
+	engine.treeGuard(dir).Lock()
+	engine.runIn(dir, "reset", "-q", "--hard")
+	_, stderr, err := engine.runIn(dir, "commit", "--allow-empty", "--author", formatAuthor(reviewer),
+		"-m", review.commitMessage(t.Message))
+	engine.treeGuard(dir).Unlock()
+	if err != nil {
+		return NewCMError(fmt.Sprintf("Can not record the rejection: %s", strings.TrimSpace(stderr)))
+	}
+
+	engine.transactions.update(id, func(t *Transaction) {
+		t.Review = review
+		t.Status = REJECTED
+	})
+	log.Notice("Change request %s rejected by %s", id, reviewer.Name)
+	return nil
+}
+
+// ReviewRecord reads the approval record back out of a commit.  Commits
+// that do not record a review return a CMError.
+func (engine *CMEngine) ReviewRecord(cmtype CMType, commit string) (*Review, error) {
+	o, err := engine.run(cmtype, "log", "-1", "--format=%B", commit)
+	if err != nil {
+		return nil, err
+	}
+
+	review := reviewFromTrailers(commitTrailers(o))
+	if review == nil {
+		return nil, NewCMError(fmt.Sprintf("Commit %s does not record a review", commit))
+	}
+	return review, nil
+}
+
+// reviewFromTrailers returns the review recorded by the trailers of a
+// commit, or nil if they do not record one
+func reviewFromTrailers(trailers map[string]string) *Review {
+	review := &Review{
+		TransactionID: trailers[TrailerChangeRequest],
+		Comment:       trailers[TrailerComment],
+	}
+	if by, ok := trailers[TrailerProposedBy]; ok {
+		review.Proposer = parseAuthor(by)
+	}
+	if by, ok := trailers[TrailerRejectedBy]; ok {
+		review.Reviewer = parseAuthor(by)
+	}
+	if by, ok := trailers[TrailerApprovedBy]; ok {
+		review.Reviewer = parseAuthor(by)
+		review.Approved = true
+	}
+
+	if review.TransactionID == "" || review.Reviewer == nil {
+		return nil
+	}
+	return review
+}
+
+// startReview checks that reviewer may decide on a change request and
+// returns the request with a copy of its review filled in
+func (engine *CMEngine) startReview(id string, reviewer *CMAuthor, comment string) (Transaction, *Review, error) {
+	t, err := engine.GetChangeRequest(id)
+	if err != nil {
+		return t, nil, err
+	}
+	if t.Status != PENDING {
+		return t, nil, NewCMReviewError(fmt.Sprintf("Change request %s is %s, not pending review", id, t.Status))
+	}
+	if reviewer == nil || reviewer.Name == "" {
+		return t, nil, NewCMReviewError("A review needs a reviewer")
+	}
+	if reviewer.Name == t.Review.Proposer.Name {
+		return t, nil, NewCMReviewError("A change request can not be reviewed by its author")
+	}
+
+	review := *t.Review
+	review.Reviewer = reviewer
+	review.Comment = strings.Replace(comment, "\n", " ", -1)
+	return t, &review, nil
+}
+
+func (r *Review) commitMessage(message string) string {
+	verb, by := "Reject", TrailerRejectedBy
+	if r.Approved {
+		verb, by = "Merge", TrailerApprovedBy
+	}
+
+	lines := []string{
+		fmt.Sprintf("%s change request %s", verb, r.TransactionID),
+		"",
+	}
+	if message != "" {
+		lines = append(lines, message, "")
+	}
+	lines = append(lines,
+		fmt.Sprintf("%s: %s", TrailerChangeRequest, r.TransactionID),
+		fmt.Sprintf("%s: %s", TrailerProposedBy, formatAuthor(r.Proposer)),
+		fmt.Sprintf("%s: %s", by, formatAuthor(r.Reviewer)))
+	if r.Comment != "" {
+		lines = append(lines, fmt.Sprintf("%s: %s", TrailerComment, r.Comment))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func formatAuthor(a *CMAuthor) string {
+	return fmt.Sprintf("%s <%s>", a.Name, a.Email)
+}
+
+func parseAuthor(s string) *CMAuthor {
+	a := &CMAuthor{Name: s}
+	if i := strings.LastIndex(s, " <"); i != -1 && strings.HasSuffix(s, ">") {
+		a.Name = s[:i]
+		a.Email = s[i+2 : len(s)-1]
+	}
+	return a
+}
+
+/*
+mergeToMaster merges a branch into master with a merge commit, authored by
+author, and returns the commit.  If the merge itself fails it is aborted
+and what git said comes back too.
+*/
+func (engine *CMEngine) mergeToMaster(ctype CMType, author *CMAuthor, message, branch string) (string, string, error) {
+	engine.reset(ctype)
+
+	engine.guard(ctype).Lock()
+	defer engine.guard(ctype).Unlock()
+
+	if _, err := engine.run(ctype, "checkout", "master"); err != nil {
+		return "", "", err
+	}
+	_, stderr, err := engine.runAs(ctype, author, "merge", "--no-ff", "-m", message, branch)
+	if err != nil {
+		engine.run(ctype, "merge", "--abort")
+		if stderr == "" {
+			stderr = err.Error()
+		}
+		return "", stderr, err
+	}
+	commit, err := engine.run(ctype, "rev-parse", "HEAD")
+	if err != nil {
+		return "", "", err
+	}
+	return strings.TrimSpace(commit), "", nil
+}
+
+// revertMerge takes the changes a merge brought to master back off with a
+// new commit, authored by author, and returns that commit
+func (engine *CMEngine) revertMerge(ctype CMType, author *CMAuthor, message, merge string) (string, error) {
+	engine.reset(ctype)
+
+	engine.guard(ctype).Lock()
+	defer engine.guard(ctype).Unlock()
+
+	if _, err := engine.run(ctype, "checkout", "master"); err != nil {
+		return "", err
+	}
+	_, stderr, err := engine.runAs(ctype, author, "revert", "--no-commit", "-m", "1", merge)
+	if err == nil {
+		_, stderr, err = engine.runAs(ctype, author, "commit", "-q", "-m", message)
+	}
+	if err != nil {
+		engine.run(ctype, "revert", "--abort")
+		return "", NewCMError(fmt.Sprintf("Can not revert %s: %s", shortCommit(merge), strings.TrimSpace(stderr)))
+	}
+	commit, err := engine.run(ctype, "rev-parse", "HEAD")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(commit), nil
+}
+
+// runAs runs a git command that commits with author as the author, the
+// engine stays the committer
+func (engine *CMEngine) runAs(cmtype CMType, author *CMAuthor, opts ...string) (string, string, error) {
+	cmd, err := engine.cmd(cmtype, opts...)
+	if err != nil {
+		return "", "", err
+	}
+
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME="+author.Name,
+		"GIT_AUTHOR_EMAIL="+author.Email)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	return stdout.String(), stderr.String(), err
+}
+
+// objectStatements returns the statements of every data file of an object
+// at the given revision, sorted
+func (engine *CMEngine) objectStatements(cmtype CMType, rev, object string) ([]string, error) {
+	store, err := engine.store(cmtype)
+	if err != nil {
+		return nil, err
+	}
+	files, err := store.ReadFiles(rev, filepath.Join(object, "data"))
+	if err != nil {
+		return nil, err
+	}
+
+	statements := make([]string, 0)
+	for _, content := range files {
+		for _, line := range strings.Split(string(content), "\n") {
+			line = strings.Join(strings.Fields(line), " ")
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			statements = append(statements, line)
+		}
+	}
+
+	sort.Strings(statements)
+	return statements, nil
+}
+
+// subtractStatements returns the statements in a that are not matched by
+// one in b.  Both must be sorted.
+func subtractStatements(a, b []string) []string {
+	r := make([]string, 0)
+	i, j := 0, 0
+	for i < len(a) {
+		switch {
+		case j >= len(b) || a[i] < b[j]:
+			r = append(r, a[i])
+			i++
+		case a[i] == b[j]:
+			i++
+			j++
+		default:
+			j++
+		}
+	}
+	return r
+}
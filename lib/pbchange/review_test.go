@@ -0,0 +1,236 @@
+package pbchange
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func proposal(object, content string) *ChangeData {
+	commit := NewCMContent(object)
+	commit.Files["configFile"] = []byte(content)
+
+	return &ChangeData{
+		ObjectType: DEVICE,
+		Content:    commit,
+		Author: &CMAuthor{
+			Name:  "Larry Bird",
+			Email: "tootall@celtics.net",
+			When:  time.Now(),
+		},
+	}
+}
+
+func TestApproveChange(t *testing.T) {
+	begin(t, "TestApproveChange")
+	defer end(t, "TestApproveChange")
+
+	cfg := setup()
+	engine, err := GetCMEngine(cfg)
+	defer cleanup(cfg, engine)
+	checkFatal(t, err)
+
+	_, err = engine.VersionObject(proposal("relay", "set service FTP on\nset service ETELNET on\n"), "")
+	checkFatal(t, err)
+
+	// Reordering is not a change
+	id, err := engine.ProposeChange(proposal("relay",
+		"set service ETELNET off\n\n# keep ftp\nset service FTP on\n"), "Turn telnet off")
+	checkFatal(t, err)
+
+	diff, err := engine.ReviewDiff(id)
+	checkFatal(t, err)
+	if !reflect.DeepEqual(diff.Added, []string{"set service ETELNET off"}) ||
+		!reflect.DeepEqual(diff.Removed, []string{"set service ETELNET on"}) {
+		t.Errorf("Unexpected diff %+v", diff)
+	}
+
+	// Nothing on master until approved
+	cd, err := engine.GetObject(DEVICE, "relay")
+	checkFatal(t, err)
+	if string(cd.Content.Files["configFile"]) != "set service FTP on\nset service ETELNET on\n" {
+		t.Errorf("Change request leaked into master")
+	}
+
+	author := &CMAuthor{Name: "Larry Bird", Email: "tootall@celtics.net"}
+	if _, err = engine.ApproveChange(id, author, "", nil); !IsCMReviewError(err) {
+		t.Errorf("Author was able to approve their own change: %v", err)
+	}
+
+	reviewer := &CMAuthor{Name: "Kevin McHale", Email: "post@celtics.net"}
+	commit, err := engine.ApproveChange(id, reviewer, "Looks good", nil)
+	checkFatal(t, err)
+
+	cd, err = engine.GetObject(DEVICE, "relay")
+	checkFatal(t, err)
+	if string(cd.Content.Files["configFile"]) != "set service ETELNET off\n\n# keep ftp\nset service FTP on\n" {
+		t.Errorf("Approved change not merged: %q", cd.Content.Files["configFile"])
+	}
+
+	review, err := engine.ReviewRecord(DEVICE, commit)
+	checkFatal(t, err)
+	if review.TransactionID != id || !review.Approved || review.Comment != "Looks good" ||
+		review.Reviewer.Email != "post@celtics.net" || review.Proposer.Name != "Larry Bird" {
+		t.Errorf("Unexpected review record %+v", review)
+	}
+
+	if tr, _ := engine.GetChangeRequest(id); tr.Status != COMPLETE {
+		t.Errorf("Expected transaction to be complete, it is %s", tr.Status)
+	}
+	if _, err = engine.ApproveChange(id, reviewer, "", nil); !IsCMReviewError(err) {
+		t.Errorf("Change request approved twice: %v", err)
+	}
+}
+
+func TestApproveChangeNotApplied(t *testing.T) {
+	begin(t, "TestApproveChangeNotApplied")
+	defer end(t, "TestApproveChangeNotApplied")
+
+	cfg := setup()
+	engine, err := GetCMEngine(cfg)
+	defer cleanup(cfg, engine)
+	checkFatal(t, err)
+
+	_, err = engine.VersionObject(proposal("relay", "set service FTP on\n"), "")
+	checkFatal(t, err)
+	reviewer := &CMAuthor{Name: "Kevin McHale", Email: "post@celtics.net"}
+	refuse := func(cd *ChangeData) error {
+		return errors.New("device refused the config")
+	}
+
+	// The device keeps its config, and so does master
+	id, err := engine.ProposeChange(proposal("relay", "set service FTP off\n"), "Turn ftp off")
+	checkFatal(t, err)
+	applied := ""
+	_, err = engine.ApproveChange(id, reviewer, "", func(cd *ChangeData) error {
+		applied = string(cd.Content.Files["configFile"])
+		return refuse(cd)
+	})
+	if err == nil || applied != "set service FTP off\n" {
+		t.Errorf("Expected the merged config applied and refused, applied %q, got %v", applied, err)
+	}
+	cd, err := engine.GetObject(DEVICE, "relay")
+	checkFatal(t, err)
+	if string(cd.Content.Files["configFile"]) != "set service FTP on\n" {
+		t.Errorf("Refused change left on master: %q", cd.Content.Files["configFile"])
+	}
+	if tr, _ := engine.GetChangeRequest(id); tr.Status != FAILED {
+		t.Errorf("Expected transaction to have failed, it is %s", tr.Status)
+	}
+
+	// An object the request brought in goes away again
+	id, err = engine.ProposeChange(proposal("meter", "set service ssh on\n"), "New meter")
+	checkFatal(t, err)
+	_, err = engine.ApproveChange(id, reviewer, "", refuse)
+	if err == nil {
+		t.Errorf("Expected the approval to fail")
+	}
+	if names, _ := engine.ListObjects(DEVICE); !reflect.DeepEqual(names, []string{"relay"}) {
+		t.Errorf("Refused object left on master: %v", names)
+	}
+}
+
+func TestRejectChange(t *testing.T) {
+	begin(t, "TestRejectChange")
+	defer end(t, "TestRejectChange")
+
+	cfg := setup()
+	engine, err := GetCMEngine(cfg)
+	defer cleanup(cfg, engine)
+	checkFatal(t, err)
+
+	_, err = engine.VersionObject(proposal("host", "set service ssh on\n"), "")
+	checkFatal(t, err)
+
+	if _, err = engine.ProposeChange(proposal("host", "set service ssh on\n"), "No-op"); !IsCMReviewError(err) {
+		t.Errorf("Change request without changes was accepted: %v", err)
+	}
+
+	id, err := engine.ProposeChange(proposal("host", "set service ssh off\n"), "Lock down ssh")
+	checkFatal(t, err)
+
+	reviewer := &CMAuthor{Name: "Kevin McHale", Email: "post@celtics.net"}
+	checkFatal(t, engine.RejectChange(id, reviewer, "Not during the outage"))
+
+	cd, err := engine.GetObject(DEVICE, "host")
+	checkFatal(t, err)
+	if string(cd.Content.Files["configFile"]) != "set service ssh on\n" {
+		t.Errorf("Rejected change reached master")
+	}
+
+	review, err := engine.ReviewRecord(DEVICE, id)
+	checkFatal(t, err)
+	if review.Approved || review.Reviewer.Name != "Kevin McHale" || review.Comment != "Not during the outage" {
+		t.Errorf("Unexpected review record %+v", review)
+	}
+
+	if tr, _ := engine.GetChangeRequest(id); tr.Status != REJECTED {
+		t.Errorf("Expected transaction to be rejected, it is %s", tr.Status)
+	}
+
+	// The rejection is kept for a while, then swept with its branch
+	engine.sweepComplete(time.Now())
+	if !engine.HasBranch(DEVICE, id) {
+		t.Errorf("Rejected change request swept right away")
+	}
+	engine.sweepComplete(time.Now().Add(finishedRetention))
+	if _, err = engine.GetChangeRequest(id); err == nil || engine.HasBranch(DEVICE, id) {
+		t.Errorf("Rejected change request kept past its retention")
+	}
+}
+
+func TestProposeRemoval(t *testing.T) {
+	begin(t, "TestProposeRemoval")
+	defer end(t, "TestProposeRemoval")
+
+	cfg := setup()
+	engine, err := GetCMEngine(cfg)
+	defer cleanup(cfg, engine)
+	checkFatal(t, err)
+
+	_, err = engine.VersionObject(proposal("relay", "set service FTP on\n"), "")
+	checkFatal(t, err)
+
+	author := &CMAuthor{Name: "Larry Bird", Email: "tootall@celtics.net"}
+	id, err := engine.ProposeRemoval(DEVICE, "relay", author, "")
+	checkFatal(t, err)
+
+	diff, err := engine.ReviewDiff(id)
+	checkFatal(t, err)
+	if len(diff.Added) != 0 || !reflect.DeepEqual(diff.Removed, []string{"set service FTP on"}) {
+		t.Errorf("Unexpected diff %+v", diff)
+	}
+
+	// The object stays until the removal is approved
+	if names, _ := engine.ListObjects(DEVICE); !reflect.DeepEqual(names, []string{"relay"}) {
+		t.Errorf("Removal reached master before review: %v", names)
+	}
+
+	reviewer := &CMAuthor{Name: "Kevin McHale", Email: "post@celtics.net"}
+	_, err = engine.ApproveChange(id, reviewer, "", nil)
+	checkFatal(t, err)
+	if names, _ := engine.ListObjects(DEVICE); len(names) != 0 {
+		t.Errorf("Approved removal left %v", names)
+	}
+
+	if _, err = engine.ProposeRemoval(DEVICE, "relay", author, ""); !IsCMReviewError(err) {
+		t.Errorf("Removal of a missing object was proposed: %v", err)
+	}
+}
@@ -0,0 +1,184 @@
+package pbchange
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Trailers written to the commits of a rollback
+const (
+	TrailerRollbackTo      = "Rollback-To"
+	TrailerRollbackCommit  = "Rollback-Commit"
+	TrailerRollbackOutcome = "Rollback-Outcome"
+)
+
+// Outcomes of a rollback, as recorded in the history of the object
+const (
+	RollbackApplied   = "applied"
+	RollbackRejected  = "rejected"
+	RollbackFailed    = "failed"
+	RollbackProposed  = "proposed"
+	RollbackForwarded = "forwarded"
+)
+
+/*
+Rollback describes an attempt to return an object to the content it had at
+an earlier commit.  Commit is the commit that versioned the old content
+again, if it got that far.  Reason explains the outcome.
+*/
+type Rollback struct {
+	Object  string
+	Target  string
+	Commit  string
+	Outcome string
+	Reason  string
+	Author  *CMAuthor
+}
+
+/*
+GetObjectAt returns an object as it was at the given commit, which may be
+given by any name git resolves.  An unknown commit is a CMError, and an
+object that did not exist at the commit a CMNoObjectError.
+*/
+func (engine *CMEngine) GetObjectAt(otype CMType, oname string, commit string) (*ChangeData, error) {
+	store, err := engine.store(otype)
+	if err != nil {
+		return nil, err
+	}
+	rev, err := store.Resolve(commit)
+	if err != nil {
+		return nil, NewCMError(fmt.Sprintf("Unknown commit %s", commit))
+	}
+
+	content, err := engine.committedContent(otype, rev, oname, "data")
+	if err != nil {
+		return nil, err
+	}
+	if len(content.Files) == 0 {
+		return nil, NewCMNoObjectError(oname, commit)
+	}
+
+	return &ChangeData{ObjectType: otype, Content: content, CommitID: rev}, nil
+}
+
+/*
+RevertObject puts an object back on master the way it was before commit.
+It is for a change that reached master but could not be applied to the
+device, so master keeps matching the device.  subject heads the message of
+the commit that reverts, followed by reason and trailers.  The ID of that
+commit is returned.
+*/
+func (engine *CMEngine) RevertObject(otype CMType, oname, commit string, author *CMAuthor, subject, reason string, trailers ...string) (string, error) {
+	store, err := engine.store(otype)
+	if err != nil {
+		return "", err
+	}
+	landed, err := store.ReadCommit(strings.Trim(commit, "\""))
+	if err != nil {
+		return "", err
+	}
+	if len(landed.Parents) == 0 {
+		return "", NewCMError(fmt.Sprintf("%s has no content before %s", oname, shortCommit(landed.ID)))
+	}
+	before := landed.Parents[0]
+
+	files, err := store.ReadFiles(before, path.Join(oname, "data"))
+	if err != nil {
+		return "", err
+	}
+	if len(files) == 0 {
+		return "", NewCMError(fmt.Sprintf("%s did not exist before %s", oname, shortCommit(landed.ID)))
+	}
+
+	lines := []string{subject, ""}
+	if reason != "" {
+		lines = append(lines, strings.TrimSpace(reason), "")
+	}
+	lines = append(lines, fmt.Sprintf("%s: %s", TrailerRollbackTo, before))
+	lines = append(lines, trailers...)
+
+	reverted, err := store.WriteFiles("master", files, author, strings.Join(lines, "\n"))
+	if err != nil {
+		return "", err
+	}
+	log.Notice("%s reverted on master to %s", oname, before)
+	return quoted(reverted), nil
+}
+
+// CommitMessage is the message for the commit that versions the old
+// content again
+func (r *Rollback) CommitMessage(message string) string {
+	lines := []string{fmt.Sprintf("Roll back %s to %s", r.Object, shortCommit(r.Target)), ""}
+	if message != "" {
+		lines = append(lines, message, "")
+	}
+	lines = append(lines, fmt.Sprintf("%s: %s", TrailerRollbackTo, r.Target))
+	return strings.Join(lines, "\n")
+}
+
+/*
+RecordRollback adds an empty commit to master that records the outcome of
+a rollback, so failed and refused rollbacks show up in the history of the
+object next to the ones that went through.  The ID of the commit is
+returned.
+*/
+func (engine *CMEngine) RecordRollback(otype CMType, r *Rollback) (string, error) {
+	if r.Author == nil {
+		return "", NewCMError("A rollback needs an author")
+	}
+
+	lines := []string{fmt.Sprintf("Rollback of %s to %s %s", r.Object, shortCommit(r.Target), r.Outcome), ""}
+	if r.Reason != "" {
+		lines = append(lines, strings.TrimSpace(r.Reason), "")
+	}
+	lines = append(lines,
+		fmt.Sprintf("%s: %s", TrailerRollbackTo, r.Target),
+		fmt.Sprintf("%s: %s", TrailerRollbackOutcome, r.Outcome))
+	if r.Commit != "" {
+		lines = append(lines, fmt.Sprintf("%s: %s", TrailerRollbackCommit, r.Commit))
+	}
+
+	engine.reset(otype)
+
+	engine.guard(otype).Lock()
+	defer engine.guard(otype).Unlock()
+
+	if _, err := engine.run(otype, "checkout", "master"); err != nil {
+		return "", err
+	}
+	_, stderr, err := engine.runAs(otype, r.Author, "commit", "--allow-empty", "-m", strings.Join(lines, "\n"))
+	if err != nil {
+		log.Warning("Recording rollback of %s failed: %s", r.Object, stderr)
+		return "", err
+	}
+	commit, err := engine.run(otype, "rev-parse", "HEAD")
+	if err != nil {
+		return "", err
+	}
+	log.Notice("Rollback of %s to %s %s", r.Object, r.Target, r.Outcome)
+	return strings.TrimSpace(commit), nil
+}
+
+func shortCommit(commit string) string {
+	if len(commit) > 7 {
+		return commit[:7]
+	}
+	return commit
+}
@@ -0,0 +1,112 @@
+package pbchange
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRollback(t *testing.T) {
+	begin(t, "TestRollback")
+	defer end(t, "TestRollback")
+
+	cfg := setup()
+	engine, err := GetCMEngine(cfg)
+	defer cleanup(cfg, engine)
+	checkFatal(t, err)
+
+	_, err = engine.VersionObject(proposal("relay", "set service FTP on\n"), "")
+	checkFatal(t, err)
+	target, err := engine.run(DEVICE, "rev-parse", "HEAD")
+	checkFatal(t, err)
+	target = strings.TrimSpace(target)
+
+	_, err = engine.VersionObject(proposal("relay", "set service FTP off\n"), "")
+	checkFatal(t, err)
+
+	if _, err = engine.GetObjectAt(DEVICE, "relay", "0123456"); err == nil {
+		t.Errorf("Got an object at an unknown commit")
+	}
+	if _, err = engine.GetObjectAt(DEVICE, "meter", target); !IsCMNoObjectError(err) {
+		t.Errorf("Got an object that did not exist at the commit")
+	}
+
+	// Short IDs resolve to the full commit
+	old, err := engine.GetObjectAt(DEVICE, "relay", target[:7])
+	checkFatal(t, err)
+	if old.CommitID != target || string(old.Content.Files["configFile"]) != "set service FTP on\n" {
+		t.Errorf("Unexpected old object %+v", old)
+	}
+
+	rb := &Rollback{Object: "relay", Target: target, Author: proposal("relay", "").Author}
+	old.Author = rb.Author
+	_, err = engine.VersionObject(old, rb.CommitMessage("FTP is needed after all"))
+	checkFatal(t, err)
+	rb.Commit, err = engine.run(DEVICE, "rev-parse", "HEAD")
+	checkFatal(t, err)
+	rb.Commit = strings.TrimSpace(rb.Commit)
+
+	cd, err := engine.GetObject(DEVICE, "relay")
+	checkFatal(t, err)
+	if string(cd.Content.Files["configFile"]) != "set service FTP on\n" {
+		t.Errorf("Rollback did not restore the old config")
+	}
+
+	rb.Outcome = RollbackFailed
+	rb.Reason = "device did not answer"
+	record, err := engine.RecordRollback(DEVICE, rb)
+	checkFatal(t, err)
+
+	body, err := engine.run(DEVICE, "log", "-1", "--format=%an%n%B", record)
+	checkFatal(t, err)
+	for _, want := range []string{
+		"Larry Bird\n",
+		"device did not answer",
+		TrailerRollbackTo + ": " + target,
+		TrailerRollbackOutcome + ": " + RollbackFailed,
+		TrailerRollbackCommit + ": " + rb.Commit,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Rollback record is missing %q:\n%s", want, body)
+		}
+	}
+
+	// Recording changes nothing
+	cd, err = engine.GetObject(DEVICE, "relay")
+	checkFatal(t, err)
+	if string(cd.Content.Files["configFile"]) != "set service FTP on\n" {
+		t.Errorf("Recording the rollback changed the config")
+	}
+
+	// A rollback the device did not take is reverted on master
+	reverted, err := engine.RevertObject(DEVICE, "relay", rb.Commit, rb.Author, "Revert the rollback of relay", rb.Reason)
+	checkFatal(t, err)
+	cd, err = engine.GetObject(DEVICE, "relay")
+	checkFatal(t, err)
+	if string(cd.Content.Files["configFile"]) != "set service FTP off\n" {
+		t.Errorf("Revert did not put back the config from before the rollback")
+	}
+	body, err = engine.run(DEVICE, "log", "-1", "--format=%s%n%B", strings.Trim(reverted, "\""))
+	checkFatal(t, err)
+	if !strings.HasPrefix(body, "Revert the rollback of relay\n") || !strings.Contains(body, "device did not answer") {
+		t.Errorf("Unexpected revert commit:\n%s", body)
+	}
+	if _, err = engine.RevertObject(DEVICE, "meter", rb.Commit, rb.Author, "Revert", ""); err == nil {
+		t.Errorf("Reverted an object that did not exist")
+	}
+}
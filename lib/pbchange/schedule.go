@@ -0,0 +1,200 @@
+package pbchange
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TrailerScheduledChange is written to the commit that lands a scheduled
+// change on master
+const TrailerScheduledChange = "Scheduled-Change"
+
+/*
+Schedule says when a scheduled change may be applied: not before At, if
+set, and only while the named maintenance window is open, if one is
+given.  Note tells why the change is still waiting, or why it failed.
+*/
+type Schedule struct {
+	At     time.Time
+	Window string
+	Note   string
+}
+
+/*
+ScheduleChange versions data on a new transaction branch and holds it
+there until it is due.  The scheduler lands it on master with LandChange
+when its time comes.  The returned transaction ID names the scheduled
+change.
+*/
+func (engine *CMEngine) ScheduleChange(data *ChangeData, message string, sched Schedule) (string, error) {
+	if sched.At.IsZero() && sched.Window == "" {
+		return "", NewCMError("A scheduled change needs a start time or a maintenance window")
+	}
+
+	id, err := engine.BeginTransaction(data, message)
+	if err != nil {
+		return "", err
+	}
+
+	err = engine.transactions.update(id, func(t *Transaction) {
+		t.Status = SCHEDULED
+		t.Schedule = &sched
+	})
+	if err != nil {
+		return "", err
+	}
+
+	log.Info("Change %s to %s %s scheduled", id, data.ObjectType, data.Content.Object)
+	return id, nil
+}
+
+// ScheduledChanges returns the changes still waiting to be applied, oldest
+// first
+func (engine *CMEngine) ScheduledChanges() []Transaction {
+	list := make([]Transaction, 0)
+	for _, t := range engine.transactions.list() {
+		if t.Status == SCHEDULED {
+			list = append(list, t)
+		}
+	}
+	return list
+}
+
+func (engine *CMEngine) GetScheduledChange(id string) (Transaction, error) {
+	t, ok := engine.transactions.get(id)
+	if !ok || t.Schedule == nil {
+		return Transaction{}, NewCMError("Unknown scheduled change")
+	}
+	return t, nil
+}
+
+// NoteSchedule records why a scheduled change is still waiting
+func (engine *CMEngine) NoteSchedule(id string, note string) error {
+	return engine.transactions.update(id, func(t *Transaction) {
+		if t.Schedule != nil {
+			t.Schedule.Note = note
+		}
+	})
+}
+
+/*
+LandChange merges a scheduled change into master, by its author, and
+returns the merge commit.  The transaction is active again afterwards; the
+caller applies the change and finalizes the transaction, reverting it with
+RevertLanded if the device did not take it.  A change that does not merge
+cleanly fails.
+*/
+func (engine *CMEngine) LandChange(id string) (string, error) {
+	t, err := engine.claimScheduled(id, ACTIVE, "")
+	if err != nil {
+		return "", err
+	}
+
+	lines := []string{fmt.Sprintf("Merge scheduled change %s", id), ""}
+	if t.Message != "" {
+		lines = append(lines, t.Message, "")
+	}
+	lines = append(lines, fmt.Sprintf("%s: %s", TrailerScheduledChange, id))
+
+	commit, stderr, err := engine.mergeToMaster(t.Ctype, t.Author, strings.Join(lines, "\n"), t.Branch)
+	if stderr != "" {
+		log.Warning("Merging scheduled change %s failed: %s", id, stderr)
+		msg := fmt.Sprintf("Scheduled change %s does not merge cleanly into master", id)
+		engine.failScheduled(id, msg)
+		return "", NewCMError(msg)
+	}
+	if err != nil {
+		engine.failScheduled(id, err.Error())
+		return "", err
+	}
+
+	log.Notice("Scheduled change %s landed on master", id)
+	return commit, nil
+}
+
+/*
+RevertLanded puts the object of a scheduled change back on master the way
+it was before commit, the commit LandChange returned.  It is for a change
+that landed but could not be applied to the device, so master keeps
+matching the device.  The ID of the commit that reverts is returned.
+*/
+func (engine *CMEngine) RevertLanded(id, commit, reason string) (string, error) {
+	t, err := engine.GetScheduledChange(id)
+	if err != nil {
+		return "", err
+	}
+	reverted, err := engine.RevertObject(t.Ctype, t.Object, commit, t.Author,
+		fmt.Sprintf("Revert scheduled change %s", id), reason,
+		fmt.Sprintf("%s: %s", TrailerScheduledChange, id))
+	if err != nil {
+		return "", err
+	}
+	log.Notice("Scheduled change %s reverted on master", id)
+	return reverted, nil
+}
+
+// CancelChange calls off a scheduled change that has not been applied.
+// The branch is kept so the change can still be looked at.
+func (engine *CMEngine) CancelChange(id string, by *CMAuthor) error {
+	note := "Cancelled"
+	if by != nil && by.Name != "" {
+		note = fmt.Sprintf("Cancelled by %s", by.Name)
+	}
+	if _, err := engine.claimScheduled(id, CANCELLED, note); err != nil {
+		return err
+	}
+	log.Notice("Scheduled change %s cancelled", id)
+	return nil
+}
+
+// claimScheduled moves a change that is still scheduled on to status, so
+// landing and cancelling a change can not both happen
+func (engine *CMEngine) claimScheduled(id string, status TransactionStatus, note string) (Transaction, error) {
+	var claimed Transaction
+	var cerr error
+	err := engine.transactions.update(id, func(t *Transaction) {
+		if t.Schedule == nil {
+			cerr = NewCMError("Unknown scheduled change")
+			return
+		}
+		if t.Status != SCHEDULED {
+			cerr = NewCMError(fmt.Sprintf("Change %s is %s, not scheduled", id, t.Status))
+			return
+		}
+		t.Status = status
+		t.Schedule.Note = note
+		claimed = *t
+	})
+	if err != nil {
+		if IsCMError(err) {
+			return claimed, NewCMError("Unknown scheduled change")
+		}
+		return claimed, err
+	}
+	return claimed, cerr
+}
+
+// failScheduled fails a scheduled change that could not be landed
+func (engine *CMEngine) failScheduled(id string, note string) {
+	engine.transactions.update(id, func(t *Transaction) {
+		t.Status = FAILED
+		t.Schedule.Note = note
+	})
+}
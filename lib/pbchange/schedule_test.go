@@ -0,0 +1,135 @@
+package pbchange
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScheduleChange(t *testing.T) {
+	begin(t, "TestScheduleChange")
+	defer end(t, "TestScheduleChange")
+
+	cfg := setup()
+	engine, err := GetCMEngine(cfg)
+	defer cleanup(cfg, engine)
+	checkFatal(t, err)
+
+	_, err = engine.VersionObject(proposal("relay", "set service FTP on\n"), "")
+	checkFatal(t, err)
+
+	if _, err = engine.ScheduleChange(proposal("relay", "set service FTP off\n"), "", Schedule{}); err == nil {
+		t.Errorf("Scheduled a change without a time or window")
+	}
+
+	at := time.Now().Add(time.Hour)
+	id, err := engine.ScheduleChange(proposal("relay", "set service FTP off\n"), "Turn FTP off", Schedule{At: at})
+	checkFatal(t, err)
+	later, err := engine.ScheduleChange(proposal("meter", "set service FTP off\n"), "", Schedule{Window: "sunday"})
+	checkFatal(t, err)
+
+	// Nothing on master until it lands
+	cd, err := engine.GetObject(DEVICE, "relay")
+	checkFatal(t, err)
+	if string(cd.Content.Files["configFile"]) != "set service FTP on\n" {
+		t.Errorf("Scheduled change leaked into master")
+	}
+	if len(engine.ScheduledChanges()) != 2 {
+		t.Errorf("Unexpected scheduled changes %+v", engine.ScheduledChanges())
+	}
+
+	checkFatal(t, engine.NoteSchedule(id, "Waiting"))
+	tr, err := engine.GetScheduledChange(id)
+	checkFatal(t, err)
+	if tr.Status != SCHEDULED || !tr.Schedule.At.Equal(at) || tr.Schedule.Note != "Waiting" {
+		t.Errorf("Unexpected scheduled change %+v", tr)
+	}
+
+	commit, err := engine.LandChange(id)
+	checkFatal(t, err)
+	cd, err = engine.GetObject(DEVICE, "relay")
+	checkFatal(t, err)
+	if string(cd.Content.Files["configFile"]) != "set service FTP off\n" {
+		t.Errorf("Scheduled change did not land on master")
+	}
+	body, err := engine.run(DEVICE, "log", "-1", "--format=%an%n%B", commit)
+	checkFatal(t, err)
+	if !strings.HasPrefix(body, "Larry Bird\n") || !strings.Contains(body, TrailerScheduledChange+": "+id) {
+		t.Errorf("Unexpected merge commit:\n%s", body)
+	}
+
+	tr, err = engine.GetTransaction(id)
+	checkFatal(t, err)
+	if tr.Status != ACTIVE {
+		t.Errorf("Landed change is %s", tr.Status)
+	}
+	if _, err = engine.LandChange(id); err == nil {
+		t.Errorf("Landed a change twice")
+	}
+	if err = engine.CancelChange(id, nil); err == nil {
+		t.Errorf("Cancelled a change that already landed")
+	}
+
+	reviewer := &CMAuthor{Name: "Kevin McHale", Email: "post@celtics.net"}
+	checkFatal(t, engine.CancelChange(later, reviewer))
+	tr, err = engine.GetTransaction(later)
+	checkFatal(t, err)
+	if tr.Status != CANCELLED || tr.Schedule.Note != "Cancelled by Kevin McHale" {
+		t.Errorf("Unexpected cancelled change %+v", tr)
+	}
+	if _, err = engine.LandChange(later); err == nil {
+		t.Errorf("Landed a cancelled change")
+	}
+	if len(engine.ScheduledChanges()) != 0 {
+		t.Errorf("Unexpected scheduled changes %+v", engine.ScheduledChanges())
+	}
+}
+
+func TestScheduleConflict(t *testing.T) {
+	begin(t, "TestScheduleConflict")
+	defer end(t, "TestScheduleConflict")
+
+	cfg := setup()
+	engine, err := GetCMEngine(cfg)
+	defer cleanup(cfg, engine)
+	checkFatal(t, err)
+
+	_, err = engine.VersionObject(proposal("relay", "set service FTP on\n"), "")
+	checkFatal(t, err)
+	id, err := engine.ScheduleChange(proposal("relay", "set service FTP off\n"), "", Schedule{Window: "sunday"})
+	checkFatal(t, err)
+
+	// Master moves on before the window opens
+	_, err = engine.VersionObject(proposal("relay", "set service ETELNET off\n"), "")
+	checkFatal(t, err)
+
+	if _, err = engine.LandChange(id); err == nil {
+		t.Fatalf("Conflicting change landed")
+	}
+	tr, err := engine.GetTransaction(id)
+	checkFatal(t, err)
+	if tr.Status != FAILED || tr.Schedule.Note == "" {
+		t.Errorf("Conflicting change did not fail %+v", tr)
+	}
+	cd, err := engine.GetObject(DEVICE, "relay")
+	checkFatal(t, err)
+	if string(cd.Content.Files["configFile"]) != "set service ETELNET off\n" {
+		t.Errorf("Failed merge left master changed")
+	}
+}
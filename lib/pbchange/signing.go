@@ -0,0 +1,446 @@
+package pbchange
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Files the engine keeps next to the repositories for signing
+const (
+	signingKeyFile     = "signing.key"
+	allowedSignersFile = "allowed_signers"
+)
+
+/*
+The anchor of the signed history holds, for each repository, the first
+commit of its signed history.  Every commit from there on must carry a
+trusted signature.  The anchor is kept outside the repositories and signed
+with the node's key, so it can not be edited to skip commits, and once a
+repository has signed commits a missing anchor fails verification.
+*/
+const (
+	signedHistoryFile      = "signed_history"
+	signedHistoryNamespace = "pbconf-signed-history"
+)
+
+// The repositories the engine may keep
+var cmTypes = []CMType{DEVICE, POLICY, QUERY, REPORT, ONTOLOGY, WAIVER}
+
+// Signature states of a commit
+const (
+	SignatureGood      = "good"
+	SignatureBad       = "bad"
+	SignatureUntrusted = "untrusted"
+	SignatureUnsigned  = "unsigned"
+	SignatureUnchecked = "unchecked"
+)
+
+// Refuses pushed commits that do not carry a trusted signature
+const preReceiveHook = `#!/bin/sh
+# Installed by the PBCONF change management engine
+zero=0000000000000000000000000000000000000000
+while read old new ref; do
+	[ "$new" = "$zero" ] && continue
+	if [ "$old" = "$zero" ]; then
+		range="$new --not --all"
+	else
+		range="$old..$new"
+	fi
+	git log --format='%H %G?' $range | while read commit status; do
+		if [ "$status" != "G" ]; then
+			echo "Commit $commit is not signed by a trusted node" >&2
+			exit 1
+		fi
+	done || exit 1
+done
+`
+
+// CommitSignature is the signature of one commit
+type CommitSignature struct {
+	Commit  string
+	Subject string
+	Status  string
+	Signer  string `json:",omitempty"`
+	Key     string `json:",omitempty"`
+}
+
+/*
+Verification is the outcome of checking the signatures in the history of a
+repository.  SignedFrom is the first commit of the signed history; commits
+before it were made before signing was turned on and are listed, but only a
+bad signature among them makes the history invalid.
+*/
+type Verification struct {
+	Repository string
+	SignedFrom string
+	Valid      bool
+	Problems   []string
+	Commits    []CommitSignature
+}
+
+// Signing is true when the engine signs its commits
+func (engine *CMEngine) Signing() bool {
+	return engine.signingKey != ""
+}
+
+/*
+setupSigning copies the node's key next to the repositories, where ssh-keygen
+accepts its permissions, and writes the allowed signers file from the node's
+own public key and the trusted keys of other nodes.
+*/
+func (engine *CMEngine) setupSigning(keyfile, trusted, principal string) error {
+	signers := make([]string, 0)
+
+	if keyfile != "" {
+		key, err := ioutil.ReadFile(keyfile)
+		if err != nil {
+			return NewCMSignatureError(fmt.Sprintf("Can not read signing key: %s", err.Error()))
+		}
+		keypath := filepath.Join(engine.Repopath, signingKeyFile)
+		if err = ioutil.WriteFile(keypath, key, 0600); err != nil {
+			return err
+		}
+		if err = os.Chmod(keypath, 0600); err != nil {
+			return err
+		}
+
+		// Git looks for the public half next to the key
+		pub, err := exec.Command("ssh-keygen", "-y", "-f", keypath).Output()
+		if err != nil {
+			return NewCMSignatureError(fmt.Sprintf("Can not use %s as a signing key: %s", keyfile, err.Error()))
+		}
+		if err = ioutil.WriteFile(keypath+".pub", pub, 0644); err != nil {
+			return err
+		}
+
+		if principal == "" {
+			principal = "pbconf"
+		}
+		signers = append(signers, fmt.Sprintf("%s %s", principal, strings.TrimSpace(string(pub))))
+		engine.signingKey = keypath
+		engine.signer = principal
+	}
+
+	if trusted != "" {
+		t, err := ioutil.ReadFile(trusted)
+		if err != nil {
+			return NewCMSignatureError(fmt.Sprintf("Can not read trusted signers: %s", err.Error()))
+		}
+		for _, line := range strings.Split(string(t), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+				signers = append(signers, line)
+			}
+		}
+	}
+
+	if len(signers) == 0 {
+		return nil
+	}
+	engine.allowedSigners = filepath.Join(engine.Repopath, allowedSignersFile)
+	return ioutil.WriteFile(engine.allowedSigners, []byte(strings.Join(signers, "\n")+"\n"), 0644)
+}
+
+// configureSigning points git at the key and the trusted signers of the
+// engine, and installs the hook that refuses unsigned pushes.  The caller
+// holds the guard.
+func (engine *CMEngine) configureSigning(ctype CMType) error {
+	if engine.allowedSigners != "" {
+		if _, err := engine.run(ctype, "config", "gpg.format", "ssh"); err != nil {
+			return err
+		}
+		if _, err := engine.run(ctype, "config", "gpg.ssh.allowedSignersFile", engine.allowedSigners); err != nil {
+			return err
+		}
+	}
+	if !engine.Signing() {
+		return nil
+	}
+
+	if _, err := engine.run(ctype, "config", "user.signingkey", engine.signingKey); err != nil {
+		return err
+	}
+	if _, err := engine.run(ctype, "config", "commit.gpgsign", "true"); err != nil {
+		return err
+	}
+
+	dir, err := engine.getGitDir(ctype)
+	if err != nil {
+		return err
+	}
+	hooks := filepath.Join(dir, ".git", "hooks")
+	if err = os.MkdirAll(hooks, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(hooks, "pre-receive"), []byte(preReceiveHook), 0755)
+}
+
+// readAnchor reads the anchor of the signed history, by repository, after
+// checking its signature.  There is none before signing starts.
+func (engine *CMEngine) readAnchor() (map[string]string, error) {
+	anchor := make(map[string]string)
+	file := filepath.Join(engine.Repopath, signedHistoryFile)
+	content, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return anchor, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	verify := exec.Command("ssh-keygen", "-Y", "verify", "-f", engine.allowedSigners,
+		"-I", engine.signer, "-n", signedHistoryNamespace, "-s", file+".sig")
+	verify.Stdin = bytes.NewReader(content)
+	if out, err := verify.CombinedOutput(); err != nil {
+		return nil, NewCMSignatureError(fmt.Sprintf("Anchor of the signed history does not verify: %s", strings.TrimSpace(string(out))))
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		if f := strings.Fields(line); len(f) == 2 {
+			anchor[f[0]] = f[1]
+		}
+	}
+	return anchor, nil
+}
+
+// signedFrom returns the first commit of the signed history of a
+// repository, or nothing if the engine does not sign or the history has
+// not started
+func (engine *CMEngine) signedFrom(ctype CMType) (string, error) {
+	if !engine.Signing() {
+		return "", nil
+	}
+	engine.anchorLock.Lock()
+	defer engine.anchorLock.Unlock()
+
+	anchor, err := engine.readAnchor()
+	if err != nil {
+		return "", err
+	}
+	return anchor[ctype.String()], nil
+}
+
+// setSignedFrom moves the start of the signed history of a repository to
+// commit and signs the anchor again
+func (engine *CMEngine) setSignedFrom(ctype CMType, commit string) error {
+	engine.anchorLock.Lock()
+	defer engine.anchorLock.Unlock()
+
+	anchor, err := engine.readAnchor()
+	if err != nil {
+		return err
+	}
+	anchor[ctype.String()] = commit
+
+	lines := make([]string, 0, len(anchor))
+	for repo, from := range anchor {
+		lines = append(lines, repo+" "+from)
+	}
+	sort.Strings(lines)
+
+	file := filepath.Join(engine.Repopath, signedHistoryFile)
+	if err = ioutil.WriteFile(file, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		return err
+	}
+	os.Remove(file + ".sig")
+	if out, err := exec.Command("ssh-keygen", "-Y", "sign", "-q", "-f", engine.signingKey,
+		"-n", signedHistoryNamespace, file).CombinedOutput(); err != nil {
+		return NewCMSignatureError(fmt.Sprintf("Can not sign the anchor of the signed history: %s", strings.TrimSpace(string(out))))
+	}
+	return nil
+}
+
+// beginSignedHistory marks where the signed history of a repository
+// starts, with an empty signed commit if the latest one is not signed.
+// The caller holds the guard.
+func (engine *CMEngine) beginSignedHistory(ctype CMType) error {
+	if !engine.Signing() {
+		return nil
+	}
+	if from, err := engine.signedFrom(ctype); err != nil || from != "" {
+		return err
+	}
+
+	status, err := engine.run(ctype, "log", "-1", "--format=%G?", "master")
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(status) != "G" {
+		if _, err = engine.run(ctype, "commit", "--allow-empty", "-m", "Begin signed history"); err != nil {
+			return NewCMSignatureError(fmt.Sprintf("Can not sign commits in %s: %s", ctype, err.Error()))
+		}
+	}
+
+	head, err := engine.run(ctype, "rev-parse", "master")
+	if err != nil {
+		return err
+	}
+	return engine.setSignedFrom(ctype, strings.TrimSpace(head))
+}
+
+// verifyRepos checks the history of every repository when the engine
+// starts, and starts signed history where there is none yet
+func (engine *CMEngine) verifyRepos() error {
+	for _, ctype := range cmTypes {
+		if _, err := engine.getGitDir(ctype); err != nil {
+			continue
+		}
+		if err := engine.verifyRepo(ctype); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (engine *CMEngine) verifyRepo(ctype CMType) error {
+	engine.guard(ctype).Lock()
+	defer engine.guard(ctype).Unlock()
+
+	if err := engine.configureSigning(ctype); err != nil {
+		return err
+	}
+	v, err := engine.verifyHistory(ctype)
+	if err != nil {
+		return err
+	}
+	if !v.Valid {
+		log.Error("History of %s fails verification: %s", ctype, strings.Join(v.Problems, "; "))
+		return NewCMSignatureError(fmt.Sprintf("History of %s fails verification: %s", ctype, v.Problems[0]))
+	}
+	return engine.beginSignedHistory(ctype)
+}
+
+// VerifyHistory checks the signature of every commit on master
+func (engine *CMEngine) VerifyHistory(otype CMType) (*Verification, error) {
+	engine.guard(otype).Lock()
+	defer engine.guard(otype).Unlock()
+
+	return engine.verifyHistory(otype)
+}
+
+func (engine *CMEngine) verifyHistory(otype CMType) (*Verification, error) {
+	if _, err := engine.getGitDir(otype); err != nil {
+		return nil, NewCMNoRepoError(otype.String())
+	}
+
+	v := &Verification{Repository: otype.String(), Valid: true, Problems: make([]string, 0)}
+	from, err := engine.signedFrom(otype)
+	if err != nil {
+		v.Valid = false
+		v.Problems = append(v.Problems, err.Error())
+	}
+	v.SignedFrom = from
+
+	commits, err := engine.signatures(otype, "master")
+	if err != nil {
+		return nil, err
+	}
+	v.Commits = commits
+
+	mustSign := make(map[string]bool)
+	if engine.Signing() && v.Valid && v.SignedFrom == "" {
+		// Signed commits with no anchor mean the anchor was removed
+		for _, c := range commits {
+			if c.Status == SignatureGood {
+				v.Valid = false
+				v.Problems = append(v.Problems, "Signed history has no anchor")
+				break
+			}
+		}
+	}
+	if v.SignedFrom != "" {
+		if _, err = engine.run(otype, "merge-base", "--is-ancestor", v.SignedFrom, "master"); err != nil {
+			v.Valid = false
+			v.Problems = append(v.Problems, fmt.Sprintf("Signed history starts at %s, which is not on master", v.SignedFrom))
+		} else {
+			o, err := engine.run(otype, "rev-list", v.SignedFrom+"^!", "master")
+			if err != nil {
+				return nil, err
+			}
+			for _, c := range strings.Fields(o) {
+				mustSign[c] = true
+			}
+		}
+	}
+
+	for _, c := range commits {
+		if c.Status == SignatureBad || (mustSign[c.Commit] && c.Status != SignatureGood) {
+			v.Valid = false
+			v.Problems = append(v.Problems, fmt.Sprintf("Commit %s is %s", c.Commit, c.Status))
+		}
+	}
+	return v, nil
+}
+
+// verifyRange checks that every commit in from..to has a trusted signature.
+// The caller holds the guard.
+func (engine *CMEngine) verifyRange(ctype CMType, from, to string) error {
+	commits, err := engine.signatures(ctype, from+".."+to)
+	if err != nil {
+		return err
+	}
+	for _, c := range commits {
+		if c.Status != SignatureGood {
+			return NewCMSignatureError(fmt.Sprintf("Commit %s is %s", c.Commit, c.Status))
+		}
+	}
+	return nil
+}
+
+func (engine *CMEngine) signatures(ctype CMType, revs string) ([]CommitSignature, error) {
+	o, err := engine.run(ctype, "log", "--format=%H%x00%G?%x00%GS%x00%GK%x00%s", revs)
+	if err != nil {
+		return nil, err
+	}
+
+	commits := make([]CommitSignature, 0)
+	for _, line := range strings.Split(o, "\n") {
+		f := strings.SplitN(line, "\x00", 5)
+		if len(f) != 5 {
+			continue
+		}
+		commits = append(commits, CommitSignature{
+			Commit:  f[0],
+			Status:  signatureStatus(f[1]),
+			Signer:  f[2],
+			Key:     f[3],
+			Subject: f[4],
+		})
+	}
+	return commits, nil
+}
+
+func signatureStatus(g string) string {
+	switch g {
+	case "G":
+		return SignatureGood
+	case "B":
+		return SignatureBad
+	case "U":
+		return SignatureUntrusted
+	case "N":
+		return SignatureUnsigned
+	}
+	return SignatureUnchecked
+}
@@ -0,0 +1,130 @@
+package pbchange
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// newKey makes an ssh key for a node that is not this one
+func newKey(t *testing.T, dir, name string) string {
+	key := filepath.Join(dir, name)
+	out, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-f", key).CombinedOutput()
+	if err != nil {
+		t.Fatalf("ssh-keygen: %s %v", out, err)
+	}
+	return key
+}
+
+func TestSigning(t *testing.T) {
+	begin(t, "TestSigning")
+	defer end(t, "TestSigning")
+
+	keys, err := ioutil.TempDir("", "keys")
+	checkFatal(t, err)
+	defer os.RemoveAll(keys)
+
+	cfg := setup()
+	cfg.Global.NodeName = "substation"
+	cfg.ChMgmt.SigningKey = newKey(t, keys, "node")
+
+	// The key of the web server is not a signing key
+	cfg.WebAPI.ServerKey = cfg.ChMgmt.SigningKey
+	if _, err = GetCMEngine(cfg); !IsCMSignatureError(err) {
+		t.Errorf("Engine signs with the key of the web server: %v", err)
+	}
+	cfg.WebAPI.ServerKey = ""
+
+	engine, err := GetCMEngine(cfg)
+	defer cleanup(cfg, engine)
+	checkFatal(t, err)
+	if !engine.Signing() {
+		t.Fatal("Engine does not sign with a key configured")
+	}
+
+	_, err = engine.VersionObject(proposal("relay", "set service FTP on\n"), "")
+	checkFatal(t, err)
+	_, err = engine.VersionObject(proposal("relay", "set service FTP off\n"), "")
+	checkFatal(t, err)
+
+	v, err := engine.VerifyHistory(DEVICE)
+	checkFatal(t, err)
+	if !v.Valid || v.SignedFrom == "" {
+		t.Fatalf("Signed history does not verify: %+v", v)
+	}
+	for _, c := range v.Commits {
+		if c.Status != SignatureGood || c.Signer != "substation" {
+			t.Errorf("Commit %s %q is %s by %q", c.Commit, c.Subject, c.Status, c.Signer)
+		}
+	}
+
+	// Pushes must be signed by a trusted node
+	dir, err := engine.getGitDir(DEVICE)
+	checkFatal(t, err)
+	clone := filepath.Join(keys, "clone")
+	git := func(args ...string) error {
+		cmd := exec.Command("git", append([]string{"-C", clone, "-c", "user.name=Downstream", "-c", "user.email=down@stream"}, args...)...)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Logf("git %v: %s", args, out)
+		}
+		return err
+	}
+	checkFatal(t, exec.Command("git", "clone", "-q", dir, clone).Run())
+	checkFatal(t, git("commit", "-q", "--allow-empty", "-m", "Unsigned"))
+	if git("push", "-q", "origin", "master") == nil {
+		t.Errorf("Accepted an unsigned push")
+	}
+	checkFatal(t, git("reset", "-q", "--hard", "HEAD~1"))
+	checkFatal(t, git("-c", "gpg.format=ssh", "-c", "user.signingkey="+newKey(t, keys, "stranger"),
+		"commit", "-q", "-S", "--allow-empty", "-m", "Signed by a stranger"))
+	if git("push", "-q", "origin", "master") == nil {
+		t.Errorf("Accepted a push signed by an untrusted key")
+	}
+
+	// The anchor of the signed history can be neither removed nor edited
+	anchor := filepath.Join(cfg.ChMgmt.RepoPath, signedHistoryFile)
+	saved, err := ioutil.ReadFile(anchor)
+	checkFatal(t, err)
+	checkFatal(t, os.Remove(anchor))
+	if v, err = engine.VerifyHistory(DEVICE); err != nil || v.Valid {
+		t.Errorf("History verified without its anchor: %+v %v", v, err)
+	}
+	checkFatal(t, ioutil.WriteFile(anchor, []byte("DEVICE "+v.Commits[0].Commit+"\n"), 0644))
+	if v, err = engine.VerifyHistory(DEVICE); err != nil || v.Valid {
+		t.Errorf("History verified with an edited anchor: %+v %v", v, err)
+	}
+	checkFatal(t, ioutil.WriteFile(anchor, saved, 0644))
+
+	// Tampering shows when the engine starts again
+	_, err = engine.run(DEVICE, "-c", "commit.gpgsign=false", "commit", "--allow-empty", "-m", "Unsigned")
+	checkFatal(t, err)
+	v, err = engine.VerifyHistory(DEVICE)
+	checkFatal(t, err)
+	if v.Valid || len(v.Problems) != 1 {
+		t.Errorf("Unsigned commit not caught: %+v", v.Problems)
+	}
+
+	engine.Free()
+	if _, err = GetCMEngine(cfg); !IsCMSignatureError(err) {
+		t.Errorf("Engine started on tampered history: %v", err)
+	}
+}
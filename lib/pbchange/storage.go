@@ -0,0 +1,272 @@
+package pbchange
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Storage backends of the engine, set by the storage key of the change
+// section of the configuration
+const (
+	StorageGit    = "git"    // Runs the git binary, the default
+	StorageNative = "native" // Does the reads and writes of Storage in process
+)
+
+/*
+Storage reads and writes the objects of one repository.  It covers only the
+five operations below; everything else the engine does to a repository
+runs the git binary whichever backend is configured: merges, Push and Pull,
+Log and other history walks, garbage collection, worktrees, the smart HTTP
+endpoints and commit signing, which runs ssh-keygen.  Both backends keep the
+repository in the standard git layout, so nodes using different backends
+can exchange history.
+*/
+type Storage interface {
+	// Resolve returns the ID of the commit a revision names
+	Resolve(rev string) (string, error)
+
+	// ReadCommit returns a commit by ID
+	ReadCommit(id string) (*StoredCommit, error)
+
+	// ReadFiles returns the files under dir in the tree of a commit, keyed
+	// by their path in the tree.  A missing dir has no files.
+	ReadFiles(commit, dir string) (map[string][]byte, error)
+
+	// ListDir returns the names in a directory of the tree of a commit,
+	// the top of the tree if dir is empty
+	ListDir(commit, dir string) ([]string, error)
+
+	// WriteFiles commits files, keyed by path, on top of a branch and
+	// moves the branch to the new commit.  It returns the commit, or
+	// nothing if the files did not change.
+	WriteFiles(branch string, files map[string][]byte, author *CMAuthor, message string) (string, error)
+}
+
+// StoredCommit is a commit as a storage backend reads it
+type StoredCommit struct {
+	ID        string
+	Tree      string
+	Parents   []string
+	Author    *CMAuthor
+	Committer *CMAuthor
+	Message   string
+}
+
+// Subject returns the first line of the commit message
+func (c *StoredCommit) Subject() string {
+	return strings.SplitN(c.Message, "\n", 2)[0]
+}
+
+// The engine commits as this identity, with the author of a change as the
+// author
+const (
+	committerName  = "Change Management Engine"
+	committerEmail = "ignore@ignore"
+)
+
+func checkStorage(backend string) error {
+	switch backend {
+	case "", StorageGit, StorageNative:
+		return nil
+	}
+	return NewCMError(fmt.Sprintf("Unknown storage backend %s", backend))
+}
+
+// store returns the storage backend of a repository
+func (engine *CMEngine) store(ctype CMType) (Storage, error) {
+	dir, err := engine.getGitDir(ctype)
+	if err != nil {
+		return nil, NewCMNoRepoError(ctype.String())
+	}
+
+	git := &gitStorage{engine: engine, ctype: ctype}
+	if engine.storage == StorageNative {
+		return newNativeStorage(engine, ctype, dir, git), nil
+	}
+	return git, nil
+}
+
+// quoted wraps a commit ID in quotes, the way VersionObject and
+// GetLatestCommitID have always returned them
+func quoted(id string) string {
+	if id == "" {
+		return ""
+	}
+	return "\"" + id + "\""
+}
+
+// gitStorage is the storage backend that runs the git binary
+type gitStorage struct {
+	engine *CMEngine
+	ctype  CMType
+}
+
+func (s *gitStorage) Resolve(rev string) (string, error) {
+	id, err := s.engine.run(s.ctype, "rev-parse", "--verify", "--quiet", rev+"^{commit}")
+	if err != nil {
+		return "", NewCMError(fmt.Sprintf("Unknown commit %s", rev))
+	}
+	return strings.TrimSpace(id), nil
+}
+
+func (s *gitStorage) ReadCommit(id string) (*StoredCommit, error) {
+	o, err := s.engine.run(s.ctype, "log", "-1",
+		"--format=%H%x00%T%x00%P%x00%an%x00%ae%x00%at%x00%cn%x00%ce%x00%ct%x00%B", id)
+	if err != nil {
+		return nil, NewCMError(fmt.Sprintf("Unknown commit %s", id))
+	}
+
+	f := strings.SplitN(o, "\x00", 10)
+	if len(f) != 10 {
+		return nil, NewCMError(fmt.Sprintf("Can not read commit %s", id))
+	}
+	at, _ := strconv.ParseInt(f[5], 10, 64)
+	ct, _ := strconv.ParseInt(f[8], 10, 64)
+	return &StoredCommit{
+		ID:        f[0],
+		Tree:      f[1],
+		Parents:   strings.Fields(f[2]),
+		Author:    &CMAuthor{Name: f[3], Email: f[4], When: time.Unix(at, 0)},
+		Committer: &CMAuthor{Name: f[6], Email: f[7], When: time.Unix(ct, 0)},
+		Message:   strings.TrimRight(f[9], "\n") + "\n",
+	}, nil
+}
+
+func (s *gitStorage) ReadFiles(commit, dir string) (map[string][]byte, error) {
+	o, err := s.engine.run(s.ctype, "ls-tree", "-r", "--name-only", commit, "--", dir)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string][]byte)
+	for _, file := range strings.Split(strings.TrimSpace(o), "\n") {
+		if file == "" {
+			continue
+		}
+		data, err := s.engine.run(s.ctype, "show", commit+":"+file)
+		if err != nil {
+			return nil, err
+		}
+		files[file] = []byte(data)
+	}
+	return files, nil
+}
+
+func (s *gitStorage) ListDir(commit, dir string) ([]string, error) {
+	opts := []string{"ls-tree", "--name-only", commit}
+	if dir != "" {
+		opts = append(opts, "--", dir+"/")
+	}
+	o, err := s.engine.run(s.ctype, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0)
+	for _, name := range strings.Split(strings.TrimSpace(o), "\n") {
+		if name != "" {
+			names = append(names, filepath.Base(name))
+		}
+	}
+	return names, nil
+}
+
+/*
+WriteFiles writes master in the main working tree of the repository, other
+branches in their own worktree, and commits them there.
+*/
+func (s *gitStorage) WriteFiles(branch string, files map[string][]byte, author *CMAuthor, message string) (string, error) {
+	engine := s.engine
+
+	var dir string
+	var g *sync.Mutex
+	var err error
+	if branch == "master" {
+		dir, err = engine.getGitDir(s.ctype)
+		g = engine.guard(s.ctype)
+	} else {
+		dir, err = engine.worktree(s.ctype, branch)
+		g = engine.treeGuard(dir)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	g.Lock()
+	defer g.Unlock()
+
+	// Start from the last commit, and go back to it unless this one lands
+	committed := false
+	engine.runIn(dir, "reset", "-q", "--hard")
+	defer func() {
+		if !committed {
+			engine.runIn(dir, "reset", "-q", "--hard")
+		}
+	}()
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fsFilePath := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(fsFilePath), os.ModeDir|0700)
+		if err = ioutil.WriteFile(fsFilePath, files[name], os.ModePerm); err != nil {
+			log.Warning("Error: %v\n", err)
+			return "", err
+		}
+
+		// Add the file to the index
+		if _, _, err = engine.runIn(dir, "add", name); err != nil {
+			log.Warning("Error: %v\n", err)
+			return "", err
+		}
+	}
+
+	o, _, err := engine.runIn(dir, "status", "--porcelain")
+	if err != nil {
+		log.Warning("Could not determine repo status: %v", err)
+		return "", err
+	}
+	if o == "" {
+		return "", nil
+	}
+
+	_, stderr, err := engine.runIn(dir, "commit", "-m", message, "--author", formatAuthor(author))
+	if err != nil {
+		log.Warning("Error: %v %s\n", err, stderr)
+		return "", err
+	}
+	committed = true
+
+	id, _, err := engine.runIn(dir, "rev-parse", "HEAD")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(id), nil
+}
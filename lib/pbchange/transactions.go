@@ -16,41 +16,81 @@ package pbchange
    limitations under the License.
 ***********************************************************************/
 
-var activeTransactions map[string]*Transaction
-
-func init() {
-	activeTransactions = make(map[string]*Transaction, 0)
-}
-
 func (engine *CMEngine) BeginTransaction(data *ChangeData, message string) (string, error) {
 
 	log.Debug("BeginTransaction()")
 
+	id, err := engine.openTransaction(data, message)
+	if err != nil {
+		return "", err
+	}
+
+	// does its own locking
+	tdata := *data
+	tdata.TransactionID = id
+	_, err = engine.VersionObject(&tdata, message, id)
+	if err != nil {
+		engine.setStatus(id, FAILED)
+		return "", err
+	}
+
+	engine.setStatus(id, ACTIVE)
+
+	return id, nil
+}
+
+// openTransaction records a transaction for data and creates its branch
+// from master, making the repository if there is none yet.  Nothing is
+// versioned on the branch.
+func (engine *CMEngine) openTransaction(data *ChangeData, message string) (string, error) {
+	// An ID is free if neither a transaction nor a leftover branch uses it
+	free := func(id string) bool {
+		if engine.transactions.has(id) {
+			return false
+		}
+		if _, err := engine.getGitDir(data.ObjectType); err != nil {
+			return true
+		}
+		return !engine.HasBranch(data.ObjectType, id)
+	}
+
 	var id string
 	if data.TransactionID != "" {
-		if _, ok := activeTransactions[data.TransactionID]; ok {
+		if !free(data.TransactionID) {
 			return "", NewCMError("Transaction ID Conflict")
 		}
 		id = data.TransactionID
 	} else {
 		var err error
-		id, err = engine.getUUID(5, func(id string) bool {
-			_, ok := activeTransactions[id]
-			return !ok
-		})
+		id, err = engine.getUUID(5, free)
 		if err != nil {
 			log.Debug("Could not create a transaction ID")
 			return "", NewCMCollisionError()
 		}
 	}
 
-	activeTransactions[id] = &Transaction{Status: INITIALIZING, Ctype: data.ObjectType}
+	t := &Transaction{
+		ID:      id,
+		Status:  INITIALIZING,
+		Ctype:   data.ObjectType,
+		Branch:  id,
+		Message: message,
+		Author:  data.Author,
+		SrcNode: data.SrcNode,
+	}
+	if data.Content != nil {
+		t.Object = data.Content.Object
+	}
+	if err := engine.transactions.add(t); err != nil {
+		return "", err
+	}
 
 	_, ckerr := engine.getGitDir(data.ObjectType)
 	if ckerr != nil {
 		log.Debug("Repo Missing")
 		if mrerr := engine.MakeRepo(data.ObjectType); mrerr != nil {
 			log.Debug("Failed to make repo: %s", mrerr.Error())
+			engine.transactions.remove(id)
 			return "", mrerr
 		}
 	}
@@ -58,25 +98,15 @@ func (engine *CMEngine) BeginTransaction(data *ChangeData, message string) (stri
 	// Create the branch, we do not need a lock here
 	if _, err := engine.run(data.ObjectType, "branch", id); err != nil {
 		log.Warning("Failed to create transaction branch")
+		engine.transactions.remove(id)
 		return "", NewCMTransactionError(id)
 	}
-
-	// does its own locking
-	_, err := engine.VersionObject(data, message, id)
-	if err != nil {
-		activeTransactions[id].Status = FAILED
-		return "", err
-	}
-
-	activeTransactions[id].Status = ACTIVE
-
 	return id, nil
 }
 
 func (engine *CMEngine) FinalizeTransaction(cbdata *ChangeData, status ...TransactionStatus) error {
 
 	var newStatus TransactionStatus
-	var rerr error = nil
 
 	id := cbdata.TransactionID
 
@@ -86,16 +116,30 @@ func (engine *CMEngine) FinalizeTransaction(cbdata *ChangeData, status ...Transa
 		newStatus = status[0]
 	}
 
-	if _, ok := activeTransactions[id]; ok {
-		activeTransactions[id].Status = newStatus
-	} else {
-		rerr = NewCMError("Unknown Transaction")
-	}
+	rerr := engine.setStatus(id, newStatus)
 
 	// Make sure the CBdata we send has the correct trans ID
 	cdata := *cbdata
 	engine.runCommitCBs(cdata.ObjectType, &cdata)
 
-	log.Debug("Current Transactions: %v", activeTransactions)
+	ev := Event{Kind: EventTransaction, Type: cdata.ObjectType, Transaction: id,
+		Status: newStatus.String(), SrcNode: cdata.SrcNode}
+	if t, err := engine.GetTransaction(id); err == nil {
+		ev.Objects = []string{t.Object}
+		ev.Author = t.Author
+		ev.Message = t.Message
+		if ev.SrcNode == "" {
+			ev.SrcNode = t.SrcNode
+		}
+	}
+	engine.runEventCBs(ev)
+
+	log.Debug("Current Transactions: %v", engine.transactions.list())
 	return rerr
 }
+
+func (engine *CMEngine) setStatus(id string, status TransactionStatus) error {
+	return engine.transactions.update(id, func(t *Transaction) {
+		t.Status = status
+	})
+}
@@ -0,0 +1,237 @@
+package pbchange
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// transactionFile holds the transaction store, next to the repositories
+const transactionFile = "transactions.json"
+
+/*
+transactionStore keeps the state of every transaction that has not been
+cleaned up yet.  Every change is written through to a file in the repo
+path, so transactions survive a restart of the node.  Callers get copies;
+changes go through update so they are persisted.
+*/
+type transactionStore struct {
+	sync.Mutex
+	path         string
+	transactions map[string]*Transaction
+}
+
+func newTransactionStore(repopath string) *transactionStore {
+	return &transactionStore{
+		path:         filepath.Join(repopath, transactionFile),
+		transactions: make(map[string]*Transaction, 0),
+	}
+}
+
+// load reads the store back from disk.  A missing file is an empty store.
+func (s *transactionStore) load() error {
+	s.Lock()
+	defer s.Unlock()
+
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	list := make([]*Transaction, 0)
+	if err = json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	for _, t := range list {
+		s.transactions[t.ID] = t
+	}
+	return nil
+}
+
+// save writes the store out, the caller holds the lock
+func (s *transactionStore) save() error {
+	list := make([]*Transaction, 0, len(s.transactions))
+	for _, t := range s.transactions {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write and rename, so a crash never leaves half a store behind
+	tmp := s.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// add stores a new transaction, failing if the ID is taken
+func (s *transactionStore) add(t *Transaction) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.transactions[t.ID]; ok {
+		return NewCMError("Transaction ID Conflict")
+	}
+	now := time.Now()
+	t.Created = now
+	t.Updated = now
+	s.transactions[t.ID] = t
+	return s.save()
+}
+
+// update applies fn to a stored transaction and persists the result
+func (s *transactionStore) update(id string, fn func(*Transaction)) error {
+	s.Lock()
+	defer s.Unlock()
+
+	t, ok := s.transactions[id]
+	if !ok {
+		return NewCMError("Unknown Transaction")
+	}
+	fn(t)
+	t.Updated = time.Now()
+	return s.save()
+}
+
+func (s *transactionStore) remove(id string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.transactions[id]; !ok {
+		return nil
+	}
+	delete(s.transactions, id)
+	return s.save()
+}
+
+func (s *transactionStore) get(id string) (Transaction, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	t, ok := s.transactions[id]
+	if !ok {
+		return Transaction{}, false
+	}
+	return *t, true
+}
+
+func (s *transactionStore) has(id string) bool {
+	_, ok := s.get(id)
+	return ok
+}
+
+// list returns copies of the stored transactions, oldest first
+func (s *transactionStore) list() []Transaction {
+	s.Lock()
+	defer s.Unlock()
+
+	list := make([]Transaction, 0, len(s.transactions))
+	for _, t := range s.transactions {
+		list = append(list, *t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	return list
+}
+
+/*
+recoverTransactions reconciles the stored transactions with the branches
+in the repositories after a restart.  Transactions whose branch is gone
+are dropped, branches without a transaction are deleted, and transactions
+that were still in flight are failed since nothing is left to finish them.
+Change requests waiting for review are kept as they are.
+*/
+func (engine *CMEngine) recoverTransactions() error {
+	if err := engine.transactions.load(); err != nil {
+		return err
+	}
+
+	for _, ctype := range []CMType{DEVICE, POLICY, QUERY, REPORT} {
+		if _, err := engine.getGitDir(ctype); err != nil {
+			continue
+		}
+
+		engine.guard(ctype).Lock()
+		engine.run(ctype, "worktree", "prune")
+		branches, err := engine.getBranches(ctype)
+		engine.guard(ctype).Unlock()
+		if err != nil {
+			return err
+		}
+
+		exists := make(map[string]bool, len(branches))
+		for _, b := range branches {
+			exists[b] = true
+			if !engine.transactions.has(b) {
+				log.Info("Removing orphan %s branch %s", ctype, b)
+				engine.removeBranch(b, ctype)
+			}
+		}
+
+		for _, t := range engine.transactions.list() {
+			if t.Ctype != ctype {
+				continue
+			}
+			if !exists[t.Branch] {
+				log.Info("Dropping %s transaction %s, its branch is gone", t.Status, t.ID)
+				engine.transactions.remove(t.ID)
+				continue
+			}
+			if t.Status == INITIALIZING || t.Status == ACTIVE {
+				log.Warning("Transaction %s was interrupted, marking it failed", t.ID)
+				engine.transactions.update(t.ID, func(t *Transaction) {
+					t.Status = FAILED
+				})
+			}
+		}
+	}
+
+	// Transactions of repositories that no longer exist
+	for _, t := range engine.transactions.list() {
+		if _, err := engine.getGitDir(t.Ctype); err != nil {
+			engine.transactions.remove(t.ID)
+		}
+	}
+	return nil
+}
+
+// Transactions returns the transactions the engine is tracking, oldest
+// first
+func (engine *CMEngine) Transactions() []Transaction {
+	return engine.transactions.list()
+}
+
+func (engine *CMEngine) GetTransaction(id string) (Transaction, error) {
+	t, ok := engine.transactions.get(id)
+	if !ok {
+		return t, NewCMError("Unknown Transaction")
+	}
+	return t, nil
+}
@@ -0,0 +1,78 @@
+package pbchange
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"testing"
+)
+
+func TestRecoverTransactions(t *testing.T) {
+	begin(t, "TestRecoverTransactions")
+	defer end(t, "TestRecoverTransactions")
+
+	cfg := setup()
+	engine, err := GetCMEngine(cfg)
+	checkFatal(t, err)
+
+	_, err = engine.VersionObject(proposal("relay", "set service FTP on\n"), "")
+	checkFatal(t, err)
+
+	active, err := engine.BeginTransaction(proposal("relay", "set service FTP off\n"), "In flight")
+	checkFatal(t, err)
+	pending, err := engine.ProposeChange(proposal("relay", "set service ETELNET off\n"), "Needs review")
+	checkFatal(t, err)
+
+	_, err = engine.run(DEVICE, "branch", "orphan")
+	checkFatal(t, err)
+
+	// Restart the engine on the same repositories
+	engine.Free()
+	engine, err = GetCMEngine(cfg)
+	defer cleanup(cfg, engine)
+	checkFatal(t, err)
+
+	tr, err := engine.GetTransaction(active)
+	checkFatal(t, err)
+	if tr.Status != FAILED {
+		t.Errorf("Expected interrupted transaction to fail, it is %s", tr.Status)
+	}
+	if tr.Author == nil || tr.Author.Name != "Larry Bird" || tr.Created.IsZero() || tr.Branch != active {
+		t.Errorf("Transaction not recovered intact: %+v", tr)
+	}
+
+	tr, err = engine.GetChangeRequest(pending)
+	checkFatal(t, err)
+	if tr.Status != PENDING || tr.Review.Proposer.Name != "Larry Bird" {
+		t.Errorf("Expected change request to still be pending: %+v", tr)
+	}
+
+	if engine.HasBranch(DEVICE, "orphan") {
+		t.Errorf("Orphan branch survived the restart")
+	}
+	if len(engine.Transactions()) != 2 {
+		t.Errorf("Unexpected transactions %+v", engine.Transactions())
+	}
+
+	// IDs of leftover branches are not handed out again
+	_, err = engine.run(DEVICE, "branch", "leftover")
+	checkFatal(t, err)
+	data := proposal("relay", "set service FTP off\n")
+	data.TransactionID = "leftover"
+	if _, err = engine.BeginTransaction(data, ""); err == nil {
+		t.Errorf("Transaction reused the ID of an existing branch")
+	}
+}
@@ -4,9 +4,9 @@ package pbchange
 
 import "fmt"
 
-const _CMType_name = "DEVICEPOLICYQUERYREPORTONTOLOGYNONE"
+const _CMType_name = "DEVICEPOLICYQUERYREPORTONTOLOGYWAIVERNONE"
 
-var _CMType_index = [...]uint8{0, 6, 12, 17, 23, 31, 35}
+var _CMType_index = [...]uint8{0, 6, 12, 17, 23, 31, 37, 41}
 
 func (i CMType) String() string {
 	if i < 0 || i >= CMType(len(_CMType_index)-1) {
@@ -15,9 +15,9 @@ func (i CMType) String() string {
 	return _CMType_name[_CMType_index[i]:_CMType_index[i+1]]
 }
 
-const _TransactionStatus_name = "INITIALIZINGACTIVECOMPLETEFAILEDCLEANED"
+const _TransactionStatus_name = "INITIALIZINGACTIVECOMPLETEFAILEDCLEANEDPENDINGREJECTEDSCHEDULEDCANCELLEDCONFLICTRESOLVED"
 
-var _TransactionStatus_index = [...]uint8{0, 12, 18, 26, 32, 39}
+var _TransactionStatus_index = [...]uint8{0, 12, 18, 26, 32, 39, 46, 54, 63, 72, 80, 88}
 
 func (i TransactionStatus) String() string {
 	if i < 0 || i >= TransactionStatus(len(_TransactionStatus_index)-1) {
@@ -36,6 +36,7 @@ const (
 	QUERY                  // A Report Defination
 	REPORT                 // The results of running a report
 	ONTOLOGY               // Ontology stub that is later compined with policy
+	WAIVER                 // An exemption from a policy rule
 	NONE
 )
 
@@ -49,6 +50,8 @@ func StringToCMType(s string) CMType {
 		return QUERY
 	case "REPORT":
 		return REPORT
+	case "WAIVER":
+		return WAIVER
 	}
 
 	return NONE
@@ -62,11 +65,29 @@ const (
 	COMPLETE
 	FAILED
 	CLEANED
+	PENDING   // Change request awaiting review
+	REJECTED  // Change request turned down by its reviewer
+	SCHEDULED // Change waiting for its time to be applied
+	CANCELLED // Scheduled change called off before it was applied
+	CONFLICT  // Upstream change to an object that conflicts with this node
+	RESOLVED  // Conflict resolved, waiting for the others of its pull
 )
 
 type Transaction struct {
-	Status TransactionStatus
-	Ctype  CMType
+	ID        string
+	Status    TransactionStatus
+	Ctype     CMType
+	Branch    string
+	Object    string
+	Message   string
+	Author    *CMAuthor
+	SrcNode   string `json:",omitempty"` // Node the transaction came from
+	Created   time.Time
+	Updated   time.Time
+	Review    *Review    // Set for change requests only
+	Schedule  *Schedule  // Set for scheduled changes only
+	Conflict  *Conflict  // Set for merge conflicts only
+	ChangeSet *ChangeSet // Set for change sets only
 }
 
 type CMEngine struct {
@@ -75,12 +96,38 @@ type CMEngine struct {
 	binpath     string
 	commitCBs   []*cbStore
 	packRcvdCBs []*cbStore
+	eventCBs    []EventCB
+
+	transactions *transactionStore
 
 	// Remove
 	UploadPack  bool
 	ReceivePack bool
 
-	guard    sync.Mutex
+	// Storage backend, StorageGit or StorageNative
+	storage string
+
+	// Change requests
+	RequireApproval bool
+	ReviewerRole    string
+
+	// Commit signing, off when the node has no key
+	signingKey     string
+	signer         string
+	allowedSigners string
+	anchorLock     sync.Mutex
+
+	// History retention and maintenance, by repository
+	retention map[CMType]RetentionCB
+	maint     map[CMType]*maintenance
+	maintLock sync.Mutex
+
+	// Writes to a repository and its main working tree, by repository, and
+	// to the worktree of a transaction, by worktree
+	guards     map[CMType]*sync.Mutex
+	treeGuards map[string]*sync.Mutex
+	guardLock  sync.Mutex
+
 	metalock sync.Mutex
 }
 
@@ -86,8 +86,8 @@ func (e *CMEngine) MakeRepo(ctype CMType) error {
 		os.Mkdir(fullpath, os.ModeDir|0700)
 	}
 
-	e.guard.Lock()
-	defer e.guard.Unlock()
+	e.guard(ctype).Lock()
+	defer e.guard(ctype).Unlock()
 	if _, err := e.run(ctype, "status"); err == nil {
 		// Repo initialized
 		return nil
@@ -102,10 +102,13 @@ func (e *CMEngine) MakeRepo(ctype CMType) error {
 	}
 
 	// Comits will fail if a name and email are not set
-	if _, err := e.run(ctype, "config", "user.name", "Change Management Engine"); err != nil {
+	if _, err := e.run(ctype, "config", "user.name", committerName); err != nil {
 		return err
 	}
-	if _, err := e.run(ctype, "config", "user.email", "ignore@ignore"); err != nil {
+	if _, err := e.run(ctype, "config", "user.email", committerEmail); err != nil {
+		return err
+	}
+	if err := e.configureSigning(ctype); err != nil {
 		return err
 	}
 
@@ -121,7 +124,7 @@ func (e *CMEngine) MakeRepo(ctype CMType) error {
 		return err
 	}
 
-	return nil
+	return e.beginSignedHistory(ctype)
 }
 
 // run() runs the command and returns the stdout
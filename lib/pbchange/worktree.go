@@ -0,0 +1,174 @@
+package pbchange
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// worktreeDir holds the worktrees of transaction branches, next to the
+// repositories
+const worktreeDir = "worktrees"
+
+/*
+guard returns the lock of a repository.  It is held by anything that
+writes to the repository or uses its main working tree, which always has
+master checked out.  Reads of committed trees do not need it.
+*/
+func (engine *CMEngine) guard(ctype CMType) *sync.Mutex {
+	engine.guardLock.Lock()
+	defer engine.guardLock.Unlock()
+
+	if engine.guards == nil {
+		engine.guards = make(map[CMType]*sync.Mutex)
+	}
+	g, ok := engine.guards[ctype]
+	if !ok {
+		g = new(sync.Mutex)
+		engine.guards[ctype] = g
+	}
+	return g
+}
+
+/*
+treeGuard returns the lock of a transaction worktree.  The lock outlives
+the worktree: a writer may have looked it up and be waiting on it while
+the worktree is removed, and must then still exclude everyone else who
+looks it up.  A lock is a few bytes, so they are kept for good.
+*/
+func (engine *CMEngine) treeGuard(dir string) *sync.Mutex {
+	engine.guardLock.Lock()
+	defer engine.guardLock.Unlock()
+
+	if engine.treeGuards == nil {
+		engine.treeGuards = make(map[string]*sync.Mutex)
+	}
+	g, ok := engine.treeGuards[dir]
+	if !ok {
+		g = new(sync.Mutex)
+		engine.treeGuards[dir] = g
+	}
+	return g
+}
+
+func (engine *CMEngine) worktreePath(ctype CMType, branch string) string {
+	return filepath.Join(engine.Repopath, worktreeDir, ctype.String(), branch)
+}
+
+/*
+worktree returns the directory a transaction branch is checked out in,
+adding a worktree for it if there is none yet.  Transactions are written
+in their own worktree, so they neither wait for nor disturb other writes
+to the repository.  The check for the worktree is made under its lock, and
+made again under the lock of the repository before adding one, which is
+taken first, so only one writer adds it.
+*/
+func (engine *CMEngine) worktree(ctype CMType, branch string) (string, error) {
+	dir := engine.worktreePath(ctype, branch)
+	exists := func() bool {
+		_, err := os.Stat(filepath.Join(dir, ".git"))
+		return err == nil
+	}
+
+	g := engine.treeGuard(dir)
+	g.Lock()
+	found := exists()
+	g.Unlock()
+	if found {
+		return dir, nil
+	}
+
+	engine.guard(ctype).Lock()
+	defer engine.guard(ctype).Unlock()
+	g = engine.treeGuard(dir)
+	g.Lock()
+	defer g.Unlock()
+	if exists() {
+		return dir, nil
+	}
+
+	// Forget worktrees whose directory went away
+	engine.run(ctype, "worktree", "prune")
+	if err := os.MkdirAll(filepath.Dir(dir), os.ModeDir|0700); err != nil {
+		return "", err
+	}
+	if _, stderr, err := engine.runC(ctype, "worktree", "add", "-q", dir, branch); err != nil {
+		return "", NewCMError(fmt.Sprintf("Can not check out %s: %s", branch, strings.TrimSpace(stderr)))
+	}
+	return dir, nil
+}
+
+// removeWorktree drops the worktree of a transaction branch, if it has
+// one.  The caller holds the guard.
+func (engine *CMEngine) removeWorktree(ctype CMType, branch string) {
+	dir := engine.worktreePath(ctype, branch)
+	if _, err := os.Stat(dir); err != nil {
+		return
+	}
+
+	g := engine.treeGuard(dir)
+	g.Lock()
+	defer g.Unlock()
+
+	if _, err := engine.run(ctype, "worktree", "remove", "--force", dir); err != nil {
+		os.RemoveAll(dir)
+		engine.run(ctype, "worktree", "prune")
+	}
+}
+
+// runIn runs a git command in dir, a working tree of a repository, and
+// returns stdout and stderr
+func (engine *CMEngine) runIn(dir string, opts ...string) (string, string, error) {
+	cmd := exec.Command(engine.binpath, opts...)
+	cmd.Dir = dir
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	return stdout.String(), stderr.String(), err
+}
+
+/*
+writeObject writes the files of an object under sub, "data" or "raw", on a
+branch and commits them with the storage backend of the repository.  It
+returns the new commit, or nothing if the files did not change.
+*/
+func (engine *CMEngine) writeObject(data *ChangeData, sub, message, branch string) (string, error) {
+	store, err := engine.store(data.ObjectType)
+	if err != nil {
+		return "", err
+	}
+
+	files := make(map[string][]byte)
+	for fname, cont := range data.Content.Files {
+		files[path.Join(data.Content.Object, sub, fname)] = cont
+	}
+
+	id, err := store.WriteFiles(branch, files, data.Author, message)
+	if err != nil {
+		return "", err
+	}
+	return quoted(id), nil
+}
@@ -0,0 +1,113 @@
+package pbchange
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWorktrees(t *testing.T) {
+	begin(t, "TestWorktrees")
+	defer end(t, "TestWorktrees")
+
+	cfg := setup()
+	engine, err := GetCMEngine(cfg)
+	defer cleanup(cfg, engine)
+	checkFatal(t, err)
+
+	_, err = engine.VersionObject(proposal("relay", "set service FTP on\n"), "")
+	checkFatal(t, err)
+
+	id, err := engine.BeginTransaction(proposal("relay", "set service FTP off\n"), "In flight")
+	checkFatal(t, err)
+
+	// The transaction is written in its own worktree, master is untouched
+	dir := engine.worktreePath(DEVICE, id)
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "relay", "data", "configFile")); err != nil || string(b) != "set service FTP off\n" {
+		t.Errorf("Transaction not written to its worktree: %q %v", b, err)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(cfg.ChMgmt.RepoPath, "DEVICE", "relay", "data", "configFile")); string(b) != "set service FTP on\n" {
+		t.Errorf("Transaction leaked into the main working tree: %q", b)
+	}
+
+	// Reads and writes of other repositories do not wait for a busy one
+	engine.guard(DEVICE).Lock()
+	done := make(chan error)
+	go func() {
+		cd, err := engine.GetObject(DEVICE, "relay")
+		if err == nil && string(cd.Content.Files["configFile"]) != "set service FTP on\n" {
+			t.Errorf("Read saw the transaction: %q", cd.Content.Files["configFile"])
+		}
+		if err == nil {
+			_, err = engine.ListObjects(DEVICE)
+		}
+		if err == nil {
+			policy := proposal("access", "allow admin\n")
+			policy.ObjectType = POLICY
+			_, err = engine.VersionObject(policy, "")
+		}
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		checkFatal(t, err)
+	case <-time.After(30 * time.Second):
+		t.Fatalf("Blocked on the lock of another repository")
+	}
+	engine.guard(DEVICE).Unlock()
+
+	objects, err := engine.ListObjects(DEVICE)
+	checkFatal(t, err)
+	if len(objects) != 1 || objects[0] != "relay" {
+		t.Errorf("Unexpected objects %v", objects)
+	}
+
+	// Finished transactions take their worktree with them, but not its lock,
+	// which those waiting on it still share with those looking it up later
+	guard := engine.treeGuard(dir)
+	checkFatal(t, engine.FinalizeTransaction(&ChangeData{ObjectType: DEVICE, TransactionID: id}))
+	engine.sweepComplete(time.Now())
+	if _, err = os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("Worktree left behind: %v", err)
+	}
+	if engine.HasBranch(DEVICE, id) {
+		t.Errorf("Branch left behind")
+	}
+	if engine.treeGuard(dir) != guard {
+		t.Errorf("Lock of the removed worktree replaced")
+	}
+
+	// Writers racing to a branch without a worktree add it once
+	id, err = engine.openTransaction(proposal("relay", ""), "Raced")
+	checkFatal(t, err)
+	errs := make(chan error)
+	for i := 0; i < 4; i++ {
+		go func() {
+			_, err := engine.worktree(DEVICE, id)
+			errs <- err
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		if err = <-errs; err != nil {
+			t.Errorf("Worktree not added: %v", err)
+		}
+	}
+}
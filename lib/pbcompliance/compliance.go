@@ -0,0 +1,499 @@
+package compliance
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	change "github.com/iti/pbconf/lib/pbchange"
+	database "github.com/iti/pbconf/lib/pbdatabase"
+	internode "github.com/iti/pbconf/lib/pbinternode"
+	logging "github.com/iti/pbconf/lib/pblogger"
+	policy "github.com/iti/pbconf/lib/pbpolicy"
+	trans "github.com/iti/pbconf/lib/pbtranslate"
+)
+
+var log logging.Logger
+
+func init() {
+	log, _ = logging.GetLogger("Compliance")
+}
+
+// Statuses of a finding
+const (
+	Pass    = "pass"
+	Fail    = "fail"
+	Unknown = "unknown" // The rule could not be evaluated
+	Waived  = "waived"  // The rule fails, but a waiver exempts the device
+)
+
+// The REPORT object the scans are kept in, and its files.  The findings go
+// where the report engine keeps the output of a report.
+const (
+	ReportObject = "compliance"
+	ReportFile   = "reportFile"
+	ScoreFile    = "scoreFile"
+)
+
+const (
+	defaultInterval = 3600 // Seconds between scans
+	keepScores      = 1000 // Entries of the score history kept
+)
+
+// The repositories whose commits call for a scan
+var cmTypes = []change.CMType{change.DEVICE, change.POLICY, change.WAIVER}
+
+// Finding is the result of checking one rule on one device
+type Finding struct {
+	Device   string
+	Type     string
+	Node     string // The node the device sits under
+	Policy   string
+	Rule     string
+	Severity string
+	Status   string
+	Evidence string
+	Waiver   string `json:",omitempty"` // The waiver of a waived finding
+}
+
+// Tally counts findings by status.  Score is the percentage of passes among
+// the findings that could be evaluated and are not waived, 100 if there are
+// none.
+type Tally struct {
+	Pass    int
+	Fail    int
+	Waived  int
+	Unknown int
+	Score   float64
+}
+
+func (t *Tally) add(f Finding) {
+	switch f.Status {
+	case Pass:
+		t.Pass++
+	case Fail:
+		t.Fail++
+	case Waived:
+		t.Waived++
+	default:
+		t.Unknown++
+	}
+	t.Score = 100
+	if t.Pass+t.Fail > 0 {
+		t.Score = float64(t.Pass) * 100 / float64(t.Pass+t.Fail)
+	}
+}
+
+// Summary tallies the findings of a node, device type or rule
+type Summary struct {
+	Key     string
+	Devices int
+	Tally
+}
+
+// Report is the outcome of a scan, with the commits of the device, policy
+// and waiver repositories it read.  Expiring holds the waivers that are
+// about to expire or have expired.
+type Report struct {
+	Scanned  time.Time
+	Devices  string
+	Policies string
+	Waivers  string
+	Tally
+	Findings []Finding
+	Expiring []Waiver `json:",omitempty"`
+}
+
+/*
+Score is an entry of the score history.  One is added for every scan whose
+findings differ from those of the scan before, so the history holds the
+points where compliance changed.  Failed counts failures by severity.
+*/
+type Score struct {
+	Time time.Time
+	Tally
+	Failed map[string]int
+}
+
+// Summarize tallies the findings of the report by "node", "type" or
+// "rule", in order of key
+func (r *Report) Summarize(by string) []Summary {
+	tallies := make(map[string]*Summary)
+	devices := make(map[string]map[string]bool)
+	for _, f := range r.Findings {
+		var key string
+		switch by {
+		case "node":
+			key = f.Node
+		case "type":
+			key = f.Type
+		default:
+			key = f.Rule
+		}
+		if _, ok := tallies[key]; !ok {
+			tallies[key] = &Summary{Key: key, Tally: Tally{Score: 100}}
+			devices[key] = make(map[string]bool)
+		}
+		tallies[key].add(f)
+		devices[key][f.Device] = true
+	}
+
+	summaries := make([]Summary, 0, len(tallies))
+	for key, s := range tallies {
+		s.Devices = len(devices[key])
+		summaries = append(summaries, *s)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Key < summaries[j].Key
+	})
+	return summaries
+}
+
+/*
+Scanner evaluates every device against the policies that apply to it, on a
+schedule and after every commit to the device, policy or waiver repository.
+Failures a waiver covers are reported as waived, and waivers about to expire
+raise alarms.  The findings are versioned as a REPORT object along with the score history, so
+the audit trail of compliance is in the CME like that of everything else.
+*/
+type Scanner struct {
+	engine *change.CMEngine
+	db     database.AppDatabase
+	nc     *internode.InterNode
+
+	scan sync.Mutex // Held while scanning
+
+	mx     sync.RWMutex
+	last   *Report
+	loaded bool
+	warned map[string]string // The expiry each waiver last raised an alarm for
+
+	kick chan bool
+}
+
+var nodeScanner *Scanner
+var nodeOnce sync.Once
+
+// Get returns the node wide scanner, which follows the commits of the
+// change management engine once started
+func Get() *Scanner {
+	nodeOnce.Do(func() {
+		engine, err := change.GetCMEngine(nil)
+		if err != nil {
+			log.Warning("No change management engine, nothing to scan: %s", err.Error())
+		}
+		nodeScanner = New(engine)
+		if engine == nil {
+			return
+		}
+		for _, t := range cmTypes {
+			engine.RegisterCommitListener(t, nodeScanner, commitCallback)
+			engine.RegisterPackRcvdListener(t, nodeScanner, commitCallback)
+		}
+	})
+	return nodeScanner
+}
+
+// New returns a scanner over the repositories of engine.  It scans
+// nothing until started.
+func New(engine *change.CMEngine) *Scanner {
+	return &Scanner{engine: engine, kick: make(chan bool, 1)}
+}
+
+// commitCallback asks for a scan.  It does not hold up the commit.
+func commitCallback(handler interface{}, cd *change.ChangeData) {
+	handler.(*Scanner).poke()
+}
+
+func (s *Scanner) poke() {
+	select {
+	case s.kick <- true:
+	default:
+	}
+}
+
+/*
+Start scans every interval seconds, an hour if not given, and soon after
+every commit, until true is sent on the returned channel.  Devices are
+looked up in db.  A first scan is made right away.
+*/
+func (s *Scanner) Start(db database.AppDatabase, interval ...int) chan bool {
+	s.mx.Lock()
+	s.db = db
+	s.nc = internode.NewInterNodeCommunicator(db)
+	s.mx.Unlock()
+
+	every := defaultInterval
+	if len(interval) > 0 && interval[0] > 0 {
+		every = interval[0]
+	}
+
+	doneChan := make(chan bool)
+	ticker := time.NewTicker(time.Second * time.Duration(every))
+	s.poke()
+	go func() {
+		for {
+			select {
+			case t := <-ticker.C:
+				s.Run(t)
+			case <-s.kick:
+				s.Run(time.Now())
+			case <-doneChan:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+	return doneChan
+}
+
+// Run scans and logs what went wrong, for the scheduled scans
+func (s *Scanner) Run(now time.Time) {
+	r, err := s.Scan(now)
+	if err != nil {
+		log.Warning("Compliance scan failed: %s", err.Error())
+		return
+	}
+	log.Info("Compliance scan: %d passed, %d failed, %d waived, %d unknown", r.Pass, r.Fail, r.Waived, r.Unknown)
+}
+
+/*
+Scan evaluates every device against the rules that apply to it and keeps
+the report.  Devices whose configuration is not in the repository, or does
+not parse, get unknown findings.  Failures covered by a waiver that has not
+expired by now are waived.  The report object is only committed when
+the findings changed since the last scan.
+*/
+func (s *Scanner) Scan(now time.Time) (*Report, error) {
+	if s.engine == nil {
+		return nil, fmt.Errorf("No change management engine to scan")
+	}
+	s.mx.RLock()
+	db, nc := s.db, s.nc
+	s.mx.RUnlock()
+	if nc == nil {
+		return nil, fmt.Errorf("The scanner is not started")
+	}
+
+	s.scan.Lock()
+	defer s.scan.Unlock()
+
+	policies, err := policy.LoadPolicies(s.engine)
+	if err != nil {
+		return nil, err
+	}
+	waivers, err := LoadWaivers(s.engine)
+	if err != nil {
+		return nil, err
+	}
+	s.alarm(waivers, now)
+	devices, err := db.GetDevices()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].Name < devices[j].Name
+	})
+
+	r := &Report{
+		Scanned:  now.UTC(),
+		Devices:  s.engine.GetLatestCommitID(change.DEVICE),
+		Policies: s.engine.GetLatestCommitID(change.POLICY),
+		Waivers:  s.engine.GetLatestCommitID(change.WAIVER),
+		Tally:    Tally{Score: 100},
+		Findings: make([]Finding, 0),
+		Expiring: expiring(waivers, now),
+	}
+	for _, d := range devices {
+		findings, err := s.scanDevice(policies, waivers, nc, d, now)
+		if err != nil {
+			log.Info("Could not scan %s: %s", d.Name, err.Error())
+			continue
+		}
+		for _, f := range findings {
+			r.Tally.add(f)
+		}
+		r.Findings = append(r.Findings, findings...)
+	}
+
+	if err = s.keep(r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// scanDevice evaluates the rules that apply to a device
+func (s *Scanner) scanDevice(policies []policy.Policy, waivers []Waiver, nc *internode.InterNode, d database.PbDevice, now time.Time) ([]Finding, error) {
+	target, err := policy.DeviceTarget(s.engine, nc, d)
+	if err != nil {
+		return nil, err
+	}
+	rules := policy.Resolve(policies, target)
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	var settings []trans.Setting
+	missing := ""
+	cd, err := s.engine.GetObject(change.DEVICE, d.Name)
+	if err != nil || len(cd.Content.Files) == 0 {
+		missing = "No configuration in the repository"
+	} else if settings, err = trans.ObjectSettings(cd); err != nil {
+		missing = "The configuration does not parse"
+	}
+
+	node := ""
+	if len(target.Path) > 0 {
+		node = target.Path[len(target.Path)-1]
+	}
+	findings := make([]Finding, 0, len(rules))
+	for _, rule := range rules {
+		f := Finding{
+			Device:   d.Name,
+			Type:     target.Type,
+			Node:     node,
+			Policy:   rule.Policy,
+			Rule:     RuleText(rule),
+			Severity: rule.Severity,
+		}
+		if missing != "" {
+			f.Status, f.Evidence = Unknown, missing
+		} else {
+			f.Status, f.Evidence = Check(rule, settings)
+		}
+		if f.Status == Fail {
+			for _, w := range waivers {
+				if w.covers(f, target.Path, now) {
+					f.Status, f.Waiver = Waived, w.Name
+					break
+				}
+			}
+		}
+		findings = append(findings, f)
+	}
+	return findings, nil
+}
+
+// keep makes a report the last one, and commits it with a new entry of the
+// score history if its findings differ from those of the last one
+func (s *Scanner) keep(r *Report) error {
+	last, err := s.Last()
+	if err != nil && !IsNoScanError(err) {
+		return err
+	}
+	changed := last == nil
+	if !changed {
+		was, _ := json.Marshal(last.Findings)
+		is, _ := json.Marshal(r.Findings)
+		changed = !bytes.Equal(was, is)
+	}
+
+	if changed {
+		history, err := s.scores()
+		if err != nil {
+			return err
+		}
+		score := Score{Time: r.Scanned, Tally: r.Tally, Failed: make(map[string]int)}
+		for _, f := range r.Findings {
+			if f.Status == Fail {
+				score.Failed[f.Severity]++
+			}
+		}
+		history = append(history, score)
+		if len(history) > keepScores {
+			history = history[len(history)-keepScores:]
+		}
+
+		content := change.NewCMContent(ReportObject)
+		if content.Files[ReportFile], err = json.MarshalIndent(r, "", "  "); err != nil {
+			return err
+		}
+		if content.Files[ScoreFile], err = json.MarshalIndent(history, "", "  "); err != nil {
+			return err
+		}
+		cd := &change.ChangeData{ObjectType: change.REPORT, Content: content,
+			Author: &change.CMAuthor{Name: "Compliance scanner"}}
+		msg := fmt.Sprintf("Compliance scan: %d passed, %d failed, %d waived, %d unknown", r.Pass, r.Fail, r.Waived, r.Unknown)
+		if _, err = s.engine.VersionObject(cd, msg); err != nil {
+			return err
+		}
+	}
+
+	s.mx.Lock()
+	s.last = r
+	s.mx.Unlock()
+	return nil
+}
+
+// Last returns the report of the last scan, read from the repository if
+// this scanner has not scanned yet
+func (s *Scanner) Last() (*Report, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if !s.loaded && s.last == nil && s.engine != nil {
+		cd, err := s.engine.GetObject(change.REPORT, ReportObject)
+		if err == nil && len(cd.Content.Files[ReportFile]) > 0 {
+			var r Report
+			if err = json.Unmarshal(cd.Content.Files[ReportFile], &r); err != nil {
+				return nil, err
+			}
+			s.last = &r
+		}
+		s.loaded = true
+	}
+	if s.last == nil {
+		return nil, NewNoScanError("No compliance scan has run")
+	}
+	return s.last, nil
+}
+
+// History returns the entries of the score history between from and to,
+// either of which may be zero to leave that end open
+func (s *Scanner) History(from, to time.Time) ([]Score, error) {
+	history, err := s.scores()
+	if err != nil {
+		return nil, err
+	}
+	scores := make([]Score, 0, len(history))
+	for _, sc := range history {
+		if (!from.IsZero() && sc.Time.Before(from)) || (!to.IsZero() && sc.Time.After(to)) {
+			continue
+		}
+		scores = append(scores, sc)
+	}
+	return scores, nil
+}
+
+func (s *Scanner) scores() ([]Score, error) {
+	history := make([]Score, 0)
+	if s.engine == nil {
+		return history, nil
+	}
+	cd, err := s.engine.GetObject(change.REPORT, ReportObject)
+	if err != nil || len(cd.Content.Files[ScoreFile]) == 0 {
+		return history, nil
+	}
+	if err = json.Unmarshal(cd.Content.Files[ScoreFile], &history); err != nil {
+		return nil, err
+	}
+	return history, nil
+}
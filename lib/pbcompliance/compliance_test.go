@@ -0,0 +1,397 @@
+package compliance
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	mux "github.com/gorilla/mux"
+	auth "github.com/iti/pbconf/lib/pbauth"
+	change "github.com/iti/pbconf/lib/pbchange"
+	config "github.com/iti/pbconf/lib/pbconfig"
+	database "github.com/iti/pbconf/lib/pbdatabase"
+	global "github.com/iti/pbconf/lib/pbglobal"
+	internode "github.com/iti/pbconf/lib/pbinternode"
+	logging "github.com/iti/pbconf/lib/pblogger"
+	policy "github.com/iti/pbconf/lib/pbpolicy"
+	trans "github.com/iti/pbconf/lib/pbtranslate"
+)
+
+var logLevel = "DEBUG"
+
+func begin(t *testing.T, name string) {
+	fmt.Printf("##################### Begin Compliance::%s #####################\n", name)
+}
+
+func end(t *testing.T, name string) {
+	fmt.Printf("###################### End Compliance::%s ######################\n", name)
+}
+
+func checkFatal(t *testing.T, err error) {
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	begin(t, "TestCheck")
+	defer end(t, "TestCheck")
+
+	settings, err := trans.Settings(strings.NewReader("set password level2 abc123\n" +
+		"set service TELNET on\n" +
+		"set timeout 1200\n" +
+		"service sshd port 22\n"))
+	checkFatal(t, err)
+	classes, err := policy.Parse(strings.NewReader(`SEL421 {
+	password.level2 min-length 8
+	password.level2.length <= 16
+	password.level2 complexity MIXEDCASE
+	service.telnet state OFF
+	timeout lte 900
+	sshd.port in [22, 2222]
+	password.level2 matches /^abc/
+	banner.text equals "Authorized use only"
+	timeout within 900
+	requires sshd.port
+}`))
+	checkFatal(t, err)
+
+	want := []struct{ status, evidence string }{
+		{Fail, "password.level2 is 6 characters long"},
+		{Pass, "password.level2.length is 6"},
+		{Fail, "password.level2 is LOWERCASE"},
+		{Fail, "service.telnet is on"},
+		{Fail, "timeout is 1200"},
+		{Pass, "sshd.port is 22"},
+		{Pass, "password.level2 is " + trans.Redacted},
+		{Fail, "banner.text is not set"},
+		{Unknown, "The scanner does not know the predicate within"},
+		{Pass, "sshd.port is set"},
+	}
+	rules := policy.Resolve([]policy.Policy{{Name: "p", Classes: classes}}, policy.Target{Type: "SEL421"})
+	if len(rules) != len(want) {
+		t.Fatalf("Expected %d rules, got %d", len(want), len(rules))
+	}
+	for i, r := range rules {
+		status, evidence := Check(r, settings)
+		if status != want[i].status || evidence != want[i].evidence {
+			t.Errorf("%s: expected %s %q, got %s %q", RuleText(r), want[i].status, want[i].evidence, status, evidence)
+		}
+		if strings.Contains(evidence, "abc123") {
+			t.Errorf("%s: evidence gives the password away", RuleText(r))
+		}
+	}
+}
+
+func TestScan(t *testing.T) {
+	begin(t, "TestScan")
+	defer end(t, "TestScan")
+
+	repo, err := ioutil.TempDir("", "cmengine")
+	checkFatal(t, err)
+	defer os.RemoveAll(repo)
+	cfg := new(config.Config)
+	cfg.Global.NodeName = "control"
+	cfg.ChMgmt.RepoPath = repo
+	cfg.ChMgmt.LogLevel = logLevel
+	engine, err := change.GetCMEngine(cfg)
+	checkFatal(t, err)
+	defer engine.Free()
+
+	logging.InitLogger(logLevel, &config.Config{}, "")
+	db := database.Open(filepath.Join(repo, "test_compliance.db"), logLevel)
+	defer db.Close()
+	db.LoadSchema()
+	global.Start("control", &config.CfgWebAPI{Listen: ":8080"})
+	for _, name := range []string{"control", "substation"} {
+		n := database.PbNode{Name: name}
+		checkFatal(t, n.Create(db))
+	}
+
+	version := func(otype change.CMType, object, file, content string) {
+		c := change.NewCMContent(object)
+		c.Files[file] = []byte(content)
+		_, err := engine.VersionObject(&change.ChangeData{ObjectType: otype, Content: c,
+			Author: &change.CMAuthor{Name: "tester", Email: "tester@iti.com"}}, "")
+		checkFatal(t, err)
+	}
+	for _, d := range []struct{ name, node, driver, cfg string }{
+		{"relay", "substation", "SEL421", "set password level2 abc123\nset service TELNET on\n"},
+		{"breaker", "control", "SEL351", "set service TELNET off\n"},
+	} {
+		n := database.PbNode{Name: d.node}
+		checkFatal(t, n.GetByName(db))
+		dev := database.PbDevice{Name: d.name, ParentNode: &n.Id}
+		checkFatal(t, dev.Create(db))
+		version(change.DEVICE, d.name, "configFile", d.cfg)
+		checkFatal(t, engine.VersionMeta(d.name, "driver", d.driver))
+	}
+	version(change.POLICY, "base", "Rules", `* {
+	service.telnet == off
+}
+SEL421 under substation severity high {
+	password.level2 min-length 8
+	requires password.level2
+}`)
+
+	s := New(engine)
+	if _, err = s.Scan(time.Now()); err == nil {
+		t.Errorf("Scanned without being started")
+	}
+	s.db, s.nc = db, internode.NewInterNodeCommunicator(db)
+
+	r, err := s.Scan(time.Now())
+	checkFatal(t, err)
+	if r.Pass != 2 || r.Fail != 2 || r.Unknown != 0 || r.Score != 50 {
+		t.Errorf("Unexpected tally %+v", r.Tally)
+	}
+	for _, f := range r.Findings {
+		if f.Device == "relay" && f.Rule == "password.level2 min-length 8" {
+			if f.Status != Fail || f.Severity != policy.SeverityHigh || f.Node != "substation" || f.Type != "SEL421" {
+				t.Errorf("Unexpected finding %+v", f)
+			}
+		}
+	}
+	nodes := r.Summarize("node")
+	if len(nodes) != 2 || nodes[0].Key != "control" || nodes[0].Score != 100 || nodes[1].Devices != 1 || nodes[1].Fail != 2 {
+		t.Errorf("Unexpected summary by node %+v", nodes)
+	}
+
+	// Nothing changed, nothing is committed
+	head := engine.GetLatestCommitID(change.REPORT)
+	_, err = s.Scan(time.Now())
+	checkFatal(t, err)
+	if engine.GetLatestCommitID(change.REPORT) != head {
+		t.Errorf("A scan with the same findings was committed")
+	}
+
+	version(change.DEVICE, "breaker", "configFile", "set service TELNET on\n")
+	_, err = s.Scan(time.Now())
+	checkFatal(t, err)
+	history, err := s.History(time.Time{}, time.Time{})
+	checkFatal(t, err)
+	if len(history) != 2 || history[0].Score != 50 || history[1].Pass != 1 || history[1].Failed[policy.SeverityMedium] != 2 {
+		t.Errorf("Unexpected history %+v", history)
+	}
+
+	// A new scanner picks up the last report from the repository
+	last, err := New(engine).Last()
+	checkFatal(t, err)
+	if last.Fail != 3 {
+		t.Errorf("Expected the last report, got %+v", last.Tally)
+	}
+
+	router := mux.NewRouter()
+	a := NewAPIHandler(logLevel, db)
+	a.scanner = s
+	a.AddAPIEndpoints(router)
+	since := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	for url, code := range map[string]int{
+		"https://localhost:8080/compliance":                         http.StatusOK,
+		"https://localhost:8080/compliance/findings?status=fail":    http.StatusOK,
+		"https://localhost:8080/compliance/history?from=2000-01-01": http.StatusBadRequest,
+		"https://localhost:8080/compliance/history?from=" + since:   http.StatusOK,
+	} {
+		req, _ := http.NewRequest("GET", url, nil)
+		writer := httptest.NewRecorder()
+		router.ServeHTTP(writer, req)
+		if writer.Code != code {
+			t.Errorf("GET %s: expected %d, got %d", url, code, writer.Code)
+		}
+	}
+
+	req, _ := http.NewRequest("POST", "https://localhost:8080/compliance/scan", nil)
+	writer := httptest.NewRecorder()
+	router.ServeHTTP(writer, req)
+	var o Overview
+	checkFatal(t, json.Unmarshal(writer.Body.Bytes(), &o))
+	if len(o.ByType) != 2 || o.ByType[0].Key != "SEL351" || o.ByType[0].Fail != 1 || len(o.ByRule) != 3 {
+		t.Errorf("Unexpected overview %+v", o)
+	}
+
+	// A waiver for the relay, asked for by one user and approved by
+	// another, turns its failure into a waived finding.  Users are the ones
+	// their token names.
+	for _, u := range []struct{ name, role string }{{"tester", engine.ReviewerRole}, {"reviewer", engine.ReviewerRole}, {"operator", "user"}} {
+		user := database.PbUser{Name: u.name, Email: u.name + "@iti.com", Password: "notreally", Role: u.role}
+		checkFatal(t, user.Create(db))
+	}
+	tokens := auth.NewAuthHandler(logLevel, db)
+	as := func(method, url, user, body string) int {
+		req, _ := http.NewRequest(method, url, strings.NewReader(body))
+		if user != "" {
+			token, err := tokens.GenerateToken(&database.PbUser{Name: user}, 5)
+			checkFatal(t, err)
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		writer := httptest.NewRecorder()
+		router.ServeHTTP(writer, req)
+		return writer.Code
+	}
+	waiverURL := "https://localhost:8080/compliance/waivers/relay-password"
+	expires := time.Now().Add(7 * 24 * time.Hour).UTC().Format(time.RFC3339)
+	body := `{"Rule": "password.level2 min-length 8", "Nodes": ["substation"], "Justification": "Only takes 6 characters",
+		"Requester": "reviewer", "Approver": "reviewer", "Expires": "` + expires + `"}`
+	for _, c := range []struct {
+		user string
+		code int
+	}{
+		{"", http.StatusUnauthorized},
+		{"nobody", http.StatusForbidden},
+		{"tester", http.StatusOK},
+	} {
+		if code := as("PUT", waiverURL, c.user, body); code != c.code {
+			t.Errorf("PUT waiver as %q: expected %d, got %d", c.user, c.code, code)
+		}
+	}
+	w, err := GetWaiver(engine, "relay-password")
+	checkFatal(t, err)
+	if w.Requester != "tester" || w.Approver != "" {
+		t.Errorf("Expected the waiver requested by its caller and not approved, got %+v", w)
+	}
+
+	// Waiting for approval it exempts nothing
+	r, err = s.Scan(time.Now())
+	checkFatal(t, err)
+	if r.Waived != 0 || len(r.Expiring) != 0 {
+		t.Errorf("Waiver took effect before approval %+v", r.Tally)
+	}
+
+	for _, c := range []struct {
+		user string
+		code int
+	}{
+		{"", http.StatusUnauthorized},
+		{"tester", http.StatusForbidden},
+		{"operator", http.StatusForbidden},
+		{"reviewer", http.StatusOK},
+		{"reviewer", http.StatusConflict},
+	} {
+		if code := as("POST", waiverURL+"/approve", c.user, ""); code != c.code {
+			t.Errorf("Approve waiver as %q: expected %d, got %d", c.user, c.code, code)
+		}
+	}
+	w, err = GetWaiver(engine, "relay-password")
+	checkFatal(t, err)
+	if w.Requester != "tester" || w.Approver != "reviewer" {
+		t.Errorf("Expected the requester and approver recorded, got %+v", w)
+	}
+
+	r, err = s.Scan(time.Now())
+	checkFatal(t, err)
+	if r.Pass != 1 || r.Fail != 2 || r.Waived != 1 || len(r.Expiring) != 1 {
+		t.Errorf("Unexpected tally with a waiver %+v", r.Tally)
+	}
+	req, _ = http.NewRequest("GET", "https://localhost:8080/compliance/findings?status=waived", nil)
+	writer = httptest.NewRecorder()
+	router.ServeHTTP(writer, req)
+	var waived []Finding
+	checkFatal(t, json.Unmarshal(writer.Body.Bytes(), &waived))
+	if len(waived) != 1 || waived[0].Device != "relay" || waived[0].Waiver != "relay-password" {
+		t.Errorf("Unexpected waived findings %+v", waived)
+	}
+
+	// Anyone known can take it away
+	if code := as("DELETE", waiverURL, "", ""); code != http.StatusUnauthorized {
+		t.Errorf("DELETE waiver without a user: expected %d, got %d", http.StatusUnauthorized, code)
+	}
+	if code := as("DELETE", waiverURL, "operator", ""); code != http.StatusOK {
+		t.Errorf("DELETE waiver: expected %d, got %d", http.StatusOK, code)
+	}
+	req, _ = http.NewRequest("GET", "https://localhost:8080/compliance/waivers/relay-password", nil)
+	writer = httptest.NewRecorder()
+	router.ServeHTTP(writer, req)
+	if writer.Code != http.StatusNotFound {
+		t.Errorf("GET removed waiver: expected %d, got %d", http.StatusNotFound, writer.Code)
+	}
+}
+
+func TestWaiver(t *testing.T) {
+	begin(t, "TestWaiver")
+	defer end(t, "TestWaiver")
+
+	now := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+	w := Waiver{
+		Name:          "relay-password",
+		Rule:          "password.level2 min-length 8",
+		Nodes:         []string{"substation"},
+		Justification: "The relay only takes 6 characters",
+		Requester:     "tester",
+		Approver:      "reviewer",
+		Expires:       now.Add(10 * 24 * time.Hour),
+	}
+	checkFatal(t, w.Validate(now))
+	for _, bad := range []Waiver{
+		{Name: w.Name, Rule: w.Rule, Nodes: w.Nodes, Justification: w.Justification, Approver: w.Approver, Expires: w.Expires},
+		{Name: w.Name, Rule: w.Rule, Nodes: w.Nodes, Justification: w.Justification, Requester: w.Requester, Approver: w.Requester, Expires: w.Expires},
+		{Name: w.Name, Rule: w.Rule, Justification: w.Justification, Requester: w.Requester, Approver: w.Approver, Expires: w.Expires},
+		{Name: w.Name, Rule: w.Rule, Nodes: w.Nodes, Justification: w.Justification, Requester: w.Requester, Approver: w.Approver, Expires: now},
+	} {
+		if err := bad.Validate(now); !IsBadWaiverError(err) {
+			t.Errorf("Expected %+v not to validate, got %v", bad, err)
+		}
+	}
+
+	f := Finding{Device: "relay", Type: "SEL421", Policy: "base", Rule: w.Rule, Status: Fail}
+	other := f
+	other.Rule = "service.telnet == off"
+	for _, c := range []struct {
+		f    Finding
+		path []string
+		at   time.Time
+		want bool
+	}{
+		{f, []string{"control", "substation"}, now, true},
+		{f, []string{"control"}, now, false},
+		{other, []string{"control", "substation"}, now, false},
+		{f, []string{"control", "substation"}, w.Expires, false},
+	} {
+		if got := w.covers(c.f, c.path, c.at); got != c.want {
+			t.Errorf("Waiver covers %+v under %v at %s: expected %v", c.f, c.path, c.at, c.want)
+		}
+	}
+	pending := w
+	pending.Approver = ""
+	checkFatal(t, pending.Validate(now))
+	if pending.covers(f, []string{"control", "substation"}, now) {
+		t.Errorf("Waiver covers %+v before it is approved", f)
+	}
+
+	// An alarm is raised as the waiver nears its expiry, then once it expired
+	s := New(nil)
+	s.alarm([]Waiver{w}, now.Add(-30*24*time.Hour))
+	if len(s.warned) != 0 {
+		t.Errorf("Alarm raised a month ahead %v", s.warned)
+	}
+	s.alarm([]Waiver{w}, now)
+	if s.warned[w.Name] != w.Expires.Format(time.RFC3339) {
+		t.Errorf("No alarm for a waiver about to expire %v", s.warned)
+	}
+	s.alarm([]Waiver{w}, w.Expires)
+	if s.warned[w.Name] != "expired "+w.Expires.Format(time.RFC3339) {
+		t.Errorf("No alarm for an expired waiver %v", s.warned)
+	}
+}
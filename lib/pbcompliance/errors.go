@@ -0,0 +1,78 @@
+package compliance
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"errors"
+)
+
+// No scan has run yet
+type NoScanError struct {
+	error
+}
+
+func NewNoScanError(msg string) error {
+	return NoScanError{
+		error: errors.New(msg),
+	}
+}
+
+func IsNoScanError(e error) bool {
+	switch e.(type) {
+	case NoScanError:
+		return true
+	}
+	return false
+}
+
+// A waiver lacks what it needs
+type BadWaiverError struct {
+	error
+}
+
+func NewBadWaiverError(msg string) error {
+	return BadWaiverError{
+		error: errors.New(msg),
+	}
+}
+
+func IsBadWaiverError(e error) bool {
+	switch e.(type) {
+	case BadWaiverError:
+		return true
+	}
+	return false
+}
+
+// No waiver goes by the name
+type NoWaiverError struct {
+	error
+}
+
+func NewNoWaiverError(msg string) error {
+	return NoWaiverError{
+		error: errors.New(msg),
+	}
+}
+
+func IsNoWaiverError(e error) bool {
+	switch e.(type) {
+	case NoWaiverError:
+		return true
+	}
+	return false
+}
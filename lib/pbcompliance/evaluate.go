@@ -0,0 +1,163 @@
+package compliance
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	policy "github.com/iti/pbconf/lib/pbpolicy"
+	trans "github.com/iti/pbconf/lib/pbtranslate"
+)
+
+// Predicates the ontology knows by another name
+var aliases = map[string]string{
+	"eq":  "==",
+	"neq": "!=",
+	"gt":  ">",
+	"gte": ">=",
+	"lt":  "<",
+	"lte": "<=",
+}
+
+// RuleText writes a rule the way a policy states it
+func RuleText(r policy.Rule) string {
+	return fmt.Sprintf("%s %s %s", r.Subject, r.Predicate, r.Object)
+}
+
+/*
+Check evaluates a rule against the settings of a device configuration and
+returns the status of the finding and the evidence for it.  The subject of
+a rule names a setting:
+
+	service.NAME     set service NAME STATE
+	password.NAME    set password NAME VALUE
+	variable.NAME    set NAME VALUE
+	SVC.NAME         service SVC NAME VALUE, else set SVC.NAME VALUE
+	NAME             set NAME VALUE
+
+Names compare without regard to case.  A subject ending in .length stands
+for the length of the setting it follows.  Values of secrets are never
+given as evidence.
+*/
+func Check(r policy.Rule, settings []trans.Setting) (string, string) {
+	if r.Predicate == "requires" {
+		if _, _, ok := value(settings, r.Object); ok {
+			return Pass, fmt.Sprintf("%s is set", r.Object)
+		}
+		return Fail, fmt.Sprintf("%s is not set", r.Object)
+	}
+
+	have, secret, ok := value(settings, r.Subject)
+	if !ok {
+		return Fail, fmt.Sprintf("%s is not set", r.Subject)
+	}
+	shown := have
+	if secret {
+		shown = trans.Redacted
+	}
+	evidence := fmt.Sprintf("%s is %s", r.Subject, shown)
+
+	op := r.Predicate
+	if alias, ok := aliases[op]; ok {
+		op = alias
+	}
+	var pass bool
+	switch op {
+	case "==", "!=", "<", "<=", ">", ">=", "in", "matches":
+		pass = policy.Satisfies(have, op, r.Type, r.Value)
+	case "equals":
+		pass = have == fmt.Sprint(r.Value)
+	case "state", "status":
+		pass = strings.EqualFold(have, r.Object)
+	case "min-length", "max-length":
+		n, isInt := r.Value.(int64)
+		if !isInt {
+			return Unknown, fmt.Sprintf("%s needs a number, not %s", r.Predicate, r.Object)
+		}
+		evidence = fmt.Sprintf("%s is %d characters long", r.Subject, len(have))
+		if op == "min-length" {
+			pass = int64(len(have)) >= n
+		} else {
+			pass = int64(len(have)) <= n
+		}
+	case "complexity":
+		c := complexity(have)
+		evidence = fmt.Sprintf("%s is %s", r.Subject, c)
+		pass = strings.EqualFold(c, r.Object)
+	default:
+		return Unknown, fmt.Sprintf("The scanner does not know the predicate %s", r.Predicate)
+	}
+	if pass {
+		return Pass, evidence
+	}
+	return Fail, evidence
+}
+
+// value finds the value a configuration gives the subject of a rule, and
+// whether it is a secret
+func value(settings []trans.Setting, subject string) (string, bool, bool) {
+	if v, secret, ok := lookup(settings, subject); ok {
+		return v, secret, true
+	}
+	if strings.HasSuffix(subject, ".length") {
+		if v, _, ok := lookup(settings, strings.TrimSuffix(subject, ".length")); ok {
+			return strconv.Itoa(len(v)), false, true
+		}
+	}
+	return "", false, false
+}
+
+func lookup(settings []trans.Setting, subject string) (string, bool, bool) {
+	op, svc, key := "variable", "", subject
+	if i := strings.Index(subject, "."); i > 0 {
+		switch prefix := subject[:i]; prefix {
+		case "service", "password", "variable":
+			op, key = prefix, subject[i+1:]
+		default:
+			op, svc, key = "service_option", prefix, subject[i+1:]
+		}
+	}
+
+	find := func(op, svc, key string) (string, bool) {
+		for _, s := range settings {
+			if s.Op == op && strings.EqualFold(s.Svc, svc) && strings.EqualFold(s.Key, key) {
+				return s.Val, true
+			}
+		}
+		return "", false
+	}
+	v, ok := find(op, svc, key)
+	if !ok && op == "service_option" {
+		op, key = "variable", subject
+		v, ok = find(op, "", key)
+	}
+	return v, op == "password" || trans.IsSecretKey(key), ok
+}
+
+// complexity names the case of the letters of a value as policies do
+func complexity(v string) string {
+	hasUpper, hasLower := strings.ToLower(v) != v, strings.ToUpper(v) != v
+	switch {
+	case hasUpper && hasLower:
+		return "MIXEDCASE"
+	case hasUpper:
+		return "UPPERCASE"
+	}
+	return "LOWERCASE"
+}
@@ -0,0 +1,424 @@
+package compliance
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	mux "github.com/gorilla/mux"
+	auth "github.com/iti/pbconf/lib/pbauth"
+	change "github.com/iti/pbconf/lib/pbchange"
+	database "github.com/iti/pbconf/lib/pbdatabase"
+	global "github.com/iti/pbconf/lib/pbglobal"
+	logging "github.com/iti/pbconf/lib/pblogger"
+)
+
+type APIHandler struct {
+	log     logging.Logger
+	db      database.AppDatabase
+	scanner *Scanner
+	Version int
+}
+
+func NewAPIHandler(loglevel string, d database.AppDatabase) *APIHandler {
+	l, _ := logging.GetLogger("Compliance API")
+	logging.SetLevel(loglevel, "Compliance API")
+	return &APIHandler{log: l, db: d, scanner: Get(), Version: 1}
+}
+
+func (a *APIHandler) AddAPIEndpoints(router *mux.Router) {
+	a.log.Info("Registering compliance endpoints")
+
+	for _, v := range global.ApiUrlVersioning {
+		router.HandleFunc(v+"/compliance", a.handleBaseRoute).Methods("GET")
+
+		s := router.PathPrefix(v + "/compliance").Subrouter()
+		s.HandleFunc("/", a.handleBaseRoute).Methods("GET")
+		s.HandleFunc("/findings", a.handleFindingsRoute).Methods("GET")
+		s.HandleFunc("/history", a.handleHistoryRoute).Methods("GET")
+		s.HandleFunc("/scan", a.handleScanRoute).Methods("POST")
+		s.HandleFunc("/waivers", a.handleWaiversRoute).Methods("GET")
+		s.HandleFunc("/waivers/{name}", a.handleGetWaiverRoute).Methods("GET")
+		s.HandleFunc("/waivers/{name}", a.handlePutWaiverRoute).Methods("PUT")
+		s.HandleFunc("/waivers/{name}", a.handleDeleteWaiverRoute).Methods("DELETE")
+		s.HandleFunc("/waivers/{name}/approve", a.handleApproveWaiverRoute).Methods("POST")
+	}
+}
+
+func (a *APIHandler) GetInfo() (string, int) {
+	return "compliance", a.Version
+}
+
+func (a *APIHandler) checkVersion(writer http.ResponseWriter, req *http.Request) *logging.ResponseLogger {
+	//deal with any version in the URL or Accept header
+	version, err := global.ProcessVersioning(req)
+	if err != nil {
+		a.log.Debug("Versioning: %s", err.Error())
+		writer.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	if version != nil && *version > a.Version {
+		a.log.Debug("Version %v not implemented, current version is %v", *version, a.Version)
+		writer.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	return &logging.ResponseLogger{
+		ResponseWriter: writer,
+		Logger:         a.log,
+		SrcNodeName:    global.RootNode,
+	}
+}
+
+// Overview summarizes the last scan by node, device type and rule, with the
+// waivers about to expire
+type Overview struct {
+	Scanned  time.Time
+	Devices  string
+	Policies string
+	Waivers  string
+	Tally
+	ByNode   []Summary
+	ByType   []Summary
+	ByRule   []Summary
+	Expiring []Waiver
+}
+
+func overview(r *Report) Overview {
+	o := Overview{
+		Scanned:  r.Scanned,
+		Devices:  r.Devices,
+		Policies: r.Policies,
+		Waivers:  r.Waivers,
+		Tally:    r.Tally,
+		ByNode:   r.Summarize("node"),
+		ByType:   r.Summarize("type"),
+		ByRule:   r.Summarize("rule"),
+		Expiring: r.Expiring,
+	}
+	if o.Expiring == nil {
+		o.Expiring = make([]Waiver, 0)
+	}
+	return o
+}
+
+func (a *APIHandler) writeJSON(resp *logging.ResponseLogger, route string, v interface{}) {
+	jsonStr, err := json.Marshal(v)
+	if err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "%s::Could not marshal the response Error: %s", route, err.Error())
+		return
+	}
+	if _, err = resp.Write(jsonStr); err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Notice", "%s::Writing response body Error: %s", route, err.Error())
+	}
+}
+
+func (a *APIHandler) last(resp *logging.ResponseLogger, route string) *Report {
+	r, err := a.scanner.Last()
+	if err != nil {
+		if IsNoScanError(err) {
+			resp.WriteLog(http.StatusNotFound, "Info", "%s::%s", route, err.Error())
+		} else {
+			resp.WriteLog(http.StatusInternalServerError, "Notice", "%s::Could not read the last scan: %s", route, err.Error())
+		}
+		return nil
+	}
+	return r
+}
+
+// handleBaseRoute returns the overview of the last scan
+func (a *APIHandler) handleBaseRoute(writer http.ResponseWriter, req *http.Request) {
+	resp := a.checkVersion(writer, req)
+	if resp == nil {
+		return
+	}
+	if r := a.last(resp, "GET /compliance"); r != nil {
+		a.writeJSON(resp, "GET /compliance", overview(r))
+	}
+}
+
+/*
+handleFindingsRoute returns the findings of the last scan.  The device,
+node, type, policy, rule, severity, status and waiver parameters keep the
+findings that have that value, so status=waived lists the waived findings.
+*/
+func (a *APIHandler) handleFindingsRoute(writer http.ResponseWriter, req *http.Request) {
+	resp := a.checkVersion(writer, req)
+	if resp == nil {
+		return
+	}
+	r := a.last(resp, "GET /compliance/findings")
+	if r == nil {
+		return
+	}
+
+	params := req.URL.Query()
+	keep := func(f Finding) bool {
+		for param, v := range map[string]string{
+			"device": f.Device, "node": f.Node, "type": f.Type, "policy": f.Policy,
+			"rule": f.Rule, "severity": f.Severity, "status": f.Status, "waiver": f.Waiver,
+		} {
+			if want := params.Get(param); want != "" && want != v {
+				return false
+			}
+		}
+		return true
+	}
+	findings := make([]Finding, 0)
+	for _, f := range r.Findings {
+		if keep(f) {
+			findings = append(findings, f)
+		}
+	}
+	a.writeJSON(resp, "GET /compliance/findings", findings)
+}
+
+// handleHistoryRoute returns the score history, limited to the RFC 3339
+// times in from and to if given
+func (a *APIHandler) handleHistoryRoute(writer http.ResponseWriter, req *http.Request) {
+	resp := a.checkVersion(writer, req)
+	if resp == nil {
+		return
+	}
+
+	var from, to time.Time
+	var err error
+	params := req.URL.Query()
+	if f := params.Get("from"); f != "" {
+		if from, err = time.Parse(time.RFC3339, f); err != nil {
+			resp.WriteLog(http.StatusBadRequest, "Info", "GET /compliance/history::Bad from %s", f)
+			return
+		}
+	}
+	if t := params.Get("to"); t != "" {
+		if to, err = time.Parse(time.RFC3339, t); err != nil {
+			resp.WriteLog(http.StatusBadRequest, "Info", "GET /compliance/history::Bad to %s", t)
+			return
+		}
+	}
+
+	scores, err := a.scanner.History(from, to)
+	if err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "GET /compliance/history::Could not read the history: %s", err.Error())
+		return
+	}
+	a.writeJSON(resp, "GET /compliance/history", scores)
+}
+
+// handleScanRoute scans right away and returns the overview
+func (a *APIHandler) handleScanRoute(writer http.ResponseWriter, req *http.Request) {
+	resp := a.checkVersion(writer, req)
+	if resp == nil {
+		return
+	}
+	r, err := a.scanner.Scan(time.Now())
+	if err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "POST /compliance/scan::Scan failed: %s", err.Error())
+		return
+	}
+	a.writeJSON(resp, "POST /compliance/scan", overview(r))
+}
+
+func (a *APIHandler) engine(resp *logging.ResponseLogger, route string) *change.CMEngine {
+	if a.scanner.engine == nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "%s::No change management engine", route)
+	}
+	return a.scanner.engine
+}
+
+// handleWaiversRoute lists the waivers
+func (a *APIHandler) handleWaiversRoute(writer http.ResponseWriter, req *http.Request) {
+	resp := a.checkVersion(writer, req)
+	if resp == nil {
+		return
+	}
+	engine := a.engine(resp, "GET /compliance/waivers")
+	if engine == nil {
+		return
+	}
+	waivers, err := LoadWaivers(engine)
+	if err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "GET /compliance/waivers::Could not read the waivers: %s", err.Error())
+		return
+	}
+	a.writeJSON(resp, "GET /compliance/waivers", waivers)
+}
+
+func (a *APIHandler) handleGetWaiverRoute(writer http.ResponseWriter, req *http.Request) {
+	resp := a.checkVersion(writer, req)
+	if resp == nil {
+		return
+	}
+	engine := a.engine(resp, "GET /compliance/waivers/{name}")
+	if engine == nil {
+		return
+	}
+	w, err := GetWaiver(engine, mux.Vars(req)["name"])
+	if err != nil {
+		if IsNoWaiverError(err) {
+			resp.WriteLog(http.StatusNotFound, "Info", "GET /compliance/waivers/{name}::%s", err.Error())
+		} else {
+			resp.WriteLog(http.StatusInternalServerError, "Notice", "GET /compliance/waivers/{name}::%s", err.Error())
+		}
+		return
+	}
+	a.writeJSON(resp, "GET /compliance/waivers/{name}", w)
+}
+
+// caller looks up the user a change to a waiver is made for.  It answers
+// the request and returns nil if there is no such user.
+func (a *APIHandler) caller(resp *logging.ResponseLogger, req *http.Request, route string) *database.PbUser {
+	claim, err := auth.Caller(req)
+	if err != nil {
+		resp.WriteLog(http.StatusUnauthorized, "Info", "%s::No user, %s", route, err.Error())
+		return nil
+	}
+	user := database.PbUser{Name: claim.Name}
+	if err = user.GetByName(a.db); err != nil {
+		resp.WriteLog(http.StatusForbidden, "Info", "%s::Unknown user %s", route, claim.Name)
+		return nil
+	}
+	return &user
+}
+
+/*
+handlePutWaiverRoute creates or replaces a waiver, requested by the user
+the request is made for.  The waiver waits for approval, by someone else,
+before it exempts anything.
+*/
+func (a *APIHandler) handlePutWaiverRoute(writer http.ResponseWriter, req *http.Request) {
+	resp := a.checkVersion(writer, req)
+	if resp == nil {
+		return
+	}
+	route := "PUT /compliance/waivers/{name}"
+	requester := a.caller(resp, req, route)
+	if requester == nil {
+		return
+	}
+
+	var w Waiver
+	if err := json.NewDecoder(req.Body).Decode(&w); err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Notice", "%s::Decoder error: %s", route, err.Error())
+		return
+	}
+	w.Name = mux.Vars(req)["name"]
+	w.Requester = requester.Name
+	w.Approver = ""
+	now := time.Now()
+	if err := w.Validate(now); err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Info", "%s::%s", route, err.Error())
+		return
+	}
+
+	engine := a.engine(resp, route)
+	if engine == nil {
+		return
+	}
+	author := &change.CMAuthor{Name: requester.Name, Email: requester.Email, When: now}
+	if err := SaveWaiver(engine, &w, author, now); err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "%s::Could not save the waiver: %s", route, err.Error())
+		return
+	}
+	resp.WriteLog(http.StatusOK, "Info", "%s::Waiver %s requested by %s", route, w.Name, w.Requester)
+}
+
+/*
+handleApproveWaiverRoute approves a waiver in the name of the user the
+request is made for, who must not be the requester and must hold the
+reviewer role if the engine names one.
+*/
+func (a *APIHandler) handleApproveWaiverRoute(writer http.ResponseWriter, req *http.Request) {
+	resp := a.checkVersion(writer, req)
+	if resp == nil {
+		return
+	}
+	route := "POST /compliance/waivers/{name}/approve"
+	approver := a.caller(resp, req, route)
+	if approver == nil {
+		return
+	}
+	engine := a.engine(resp, route)
+	if engine == nil {
+		return
+	}
+	if engine.ReviewerRole != "" && approver.Role != engine.ReviewerRole {
+		resp.WriteLog(http.StatusForbidden, "Info", "%s::%s does not have the %s role needed to approve waivers", route, approver.Name, engine.ReviewerRole)
+		return
+	}
+
+	w, err := GetWaiver(engine, mux.Vars(req)["name"])
+	if err != nil {
+		if IsNoWaiverError(err) {
+			resp.WriteLog(http.StatusNotFound, "Info", "%s::%s", route, err.Error())
+		} else {
+			resp.WriteLog(http.StatusInternalServerError, "Notice", "%s::%s", route, err.Error())
+		}
+		return
+	}
+	switch {
+	case w.Approved():
+		resp.WriteLog(http.StatusConflict, "Info", "%s::Waiver %s is already approved by %s", route, w.Name, w.Approver)
+		return
+	case w.Requester == approver.Name:
+		resp.WriteLog(http.StatusForbidden, "Info", "%s::%s can not approve their own request", route, approver.Name)
+		return
+	}
+
+	now := time.Now()
+	w.Approver = approver.Name
+	author := &change.CMAuthor{Name: approver.Name, Email: approver.Email, When: now}
+	if err := SaveWaiver(engine, w, author, now); err != nil {
+		status := http.StatusInternalServerError
+		if IsBadWaiverError(err) {
+			status = http.StatusBadRequest
+		}
+		resp.WriteLog(status, "Info", "%s::Could not approve the waiver: %s", route, err.Error())
+		return
+	}
+	resp.WriteLog(http.StatusOK, "Info", "%s::Waiver %s requested by %s and approved by %s", route, w.Name, w.Requester, w.Approver)
+}
+
+// handleDeleteWaiverRoute removes a waiver in the name of the user the
+// request is made for.  Taking an exemption away needs no approval.
+func (a *APIHandler) handleDeleteWaiverRoute(writer http.ResponseWriter, req *http.Request) {
+	resp := a.checkVersion(writer, req)
+	if resp == nil {
+		return
+	}
+	route := "DELETE /compliance/waivers/{name}"
+	user := a.caller(resp, req, route)
+	if user == nil {
+		return
+	}
+	engine := a.engine(resp, route)
+	if engine == nil {
+		return
+	}
+
+	by := &change.CMAuthor{Name: user.Name, Email: user.Email, When: time.Now()}
+	if err := RemoveWaiver(engine, mux.Vars(req)["name"], by); err != nil {
+		if IsNoWaiverError(err) {
+			resp.WriteLog(http.StatusNotFound, "Info", "%s::%s", route, err.Error())
+		} else {
+			resp.WriteLog(http.StatusInternalServerError, "Notice", "%s::Could not remove the waiver: %s", route, err.Error())
+		}
+		return
+	}
+	resp.WriteLog(http.StatusOK, "Info", "%s::Waiver removed by %s", route, user.Name)
+}
@@ -0,0 +1,215 @@
+package compliance
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	change "github.com/iti/pbconf/lib/pbchange"
+)
+
+// The file of a WAIVER object that holds the waiver
+const WaiverFile = "waiverFile"
+
+// How long before it expires a waiver raises an alarm
+const expiryWarning = 14 * 24 * time.Hour
+
+/*
+Waiver exempts devices from a rule until it expires.  Rule is the rule as
+findings give it, such as "password.level2 min-length 8", and Policy, if
+given, limits the waiver to the rule of that policy.  The waiver covers the
+devices named in Devices, the devices under the nodes in Nodes and the
+devices of the types in Types.  Requester asked for the waiver and
+Approver, someone else, agreed to it.  Until it is approved a waiver
+exempts nothing.
+*/
+type Waiver struct {
+	Name          string
+	Policy        string `json:",omitempty"`
+	Rule          string
+	Devices       []string `json:",omitempty"`
+	Nodes         []string `json:",omitempty"`
+	Types         []string `json:",omitempty"`
+	Justification string
+	Requester     string
+	Approver      string
+	Expires       time.Time
+}
+
+// Validate checks a waiver says what it exempts, why, who asked for it and
+// until when, that it is not approved by whoever asked for it and that it
+// has not expired by now
+func (w *Waiver) Validate(now time.Time) error {
+	switch {
+	case w.Name == "":
+		return NewBadWaiverError("A waiver needs a name")
+	case w.Rule == "":
+		return NewBadWaiverError("A waiver needs the rule it exempts from")
+	case len(w.Devices)+len(w.Nodes)+len(w.Types) == 0:
+		return NewBadWaiverError("A waiver needs devices, nodes or types to exempt")
+	case w.Justification == "":
+		return NewBadWaiverError("A waiver needs a justification")
+	case w.Requester == "":
+		return NewBadWaiverError("A waiver needs a requester")
+	case w.Approver == w.Requester:
+		return NewBadWaiverError("A waiver can not be approved by its requester")
+	case w.Expires.IsZero():
+		return NewBadWaiverError("A waiver needs an expiry date")
+	case !now.Before(w.Expires):
+		return NewBadWaiverError(fmt.Sprintf("The waiver expired on %s", w.Expires.Format(time.RFC3339)))
+	}
+	return nil
+}
+
+// Approved tells if someone other than the requester agreed to the waiver
+func (w *Waiver) Approved() bool {
+	return w.Approver != "" && w.Approver != w.Requester
+}
+
+// covers tells if the waiver exempts a finding by now.  path is the node
+// path of the device of the finding.
+func (w *Waiver) covers(f Finding, path []string, now time.Time) bool {
+	if !w.Approved() || !now.Before(w.Expires) || w.Rule != f.Rule || (w.Policy != "" && w.Policy != f.Policy) {
+		return false
+	}
+	return contains(w.Devices, f.Device) || contains(w.Types, f.Type) || overlaps(w.Nodes, path)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func overlaps(list, path []string) bool {
+	for _, v := range path {
+		if contains(list, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadWaivers reads every waiver in the repository, in order of name
+func LoadWaivers(engine *change.CMEngine) ([]Waiver, error) {
+	names, err := engine.ListObjects(change.WAIVER)
+	if err != nil {
+		if change.IsCMNoRepoError(err) {
+			return []Waiver{}, nil
+		}
+		return nil, err
+	}
+	sort.Strings(names)
+
+	waivers := make([]Waiver, 0, len(names))
+	for _, name := range names {
+		w, err := GetWaiver(engine, name)
+		if err != nil {
+			return nil, err
+		}
+		waivers = append(waivers, *w)
+	}
+	return waivers, nil
+}
+
+// GetWaiver reads a waiver from the repository
+func GetWaiver(engine *change.CMEngine, name string) (*Waiver, error) {
+	cd, err := engine.GetObject(change.WAIVER, name)
+	if err != nil || len(cd.Content.Files[WaiverFile]) == 0 {
+		return nil, NewNoWaiverError(fmt.Sprintf("No waiver %s", name))
+	}
+	var w Waiver
+	if err = json.Unmarshal(cd.Content.Files[WaiverFile], &w); err != nil {
+		return nil, fmt.Errorf("Waiver %s: %s", name, err.Error())
+	}
+	w.Name = name
+	return &w, nil
+}
+
+// SaveWaiver versions a waiver once it validates, in the name of author,
+// the requester or the approver
+func SaveWaiver(engine *change.CMEngine, w *Waiver, author *change.CMAuthor, now time.Time) error {
+	if err := w.Validate(now); err != nil {
+		return err
+	}
+	content := change.NewCMContent(w.Name)
+	var err error
+	if content.Files[WaiverFile], err = json.MarshalIndent(w, "", "  "); err != nil {
+		return err
+	}
+	cd := &change.ChangeData{ObjectType: change.WAIVER, Content: content, Author: author}
+	by := fmt.Sprintf("Requested by %s, waiting for approval", w.Requester)
+	if w.Approved() {
+		by = fmt.Sprintf("Requested by %s, approved by %s", w.Requester, w.Approver)
+	}
+	msg := fmt.Sprintf("Waive %s until %s: %s\n\n%s", w.Rule, w.Expires.Format("2006-01-02"), w.Justification, by)
+	_, err = engine.VersionObject(cd, msg)
+	return err
+}
+
+// RemoveWaiver takes a waiver out of the repository
+func RemoveWaiver(engine *change.CMEngine, name string, author *change.CMAuthor) error {
+	if _, err := GetWaiver(engine, name); err != nil {
+		return err
+	}
+	return engine.RemoveObject(change.WAIVER, name, author)
+}
+
+// expiring returns the approved waivers that expire within the warning
+// period of now, or have expired
+func expiring(waivers []Waiver, now time.Time) []Waiver {
+	r := make([]Waiver, 0)
+	for _, w := range waivers {
+		if w.Approved() && w.Expires.Sub(now) <= expiryWarning {
+			r = append(r, w)
+		}
+	}
+	return r
+}
+
+/*
+alarm raises an alarm for every waiver that is about to expire, and again
+once it has expired.  An alarm is raised once for each, unless the waiver
+is given a new expiry date.
+*/
+func (s *Scanner) alarm(waivers []Waiver, now time.Time) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.warned == nil {
+		s.warned = make(map[string]string)
+	}
+
+	for _, w := range expiring(waivers, now) {
+		expires := w.Expires.Format(time.RFC3339)
+		state := expires
+		msg := fmt.Sprintf("Waiver %s of %s expires on %s", w.Name, w.Rule, expires)
+		if !now.Before(w.Expires) {
+			state = "expired " + expires
+			msg = fmt.Sprintf("Waiver %s of %s expired on %s", w.Name, w.Rule, expires)
+		}
+		if s.warned[w.Name] != state {
+			log.Warning("%s", msg)
+			s.warned[w.Name] = state
+		}
+	}
+}
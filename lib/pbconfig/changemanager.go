@@ -25,6 +25,20 @@ type cfgChange struct {
 	RepoPath string `gcfg:"repopath"`
 	LogLevel string `gcfg:"loglevel" cfg_key:"optional"`
 	BinPath  string `gcfg:"binpath"  cfg_key:"optional"`
+
+	// How objects are read from and written to the repositories: "git",
+	// the default, runs the git binary, "native" does it in process.
+	// Merges, history, push and pull run git either way.
+	Storage string `gcfg:"storage" cfg_key:"optional"`
+
+	// Hold device and policy changes for a second person to approve
+	RequireApproval bool   `gcfg:"requireapproval" cfg_key:"optional"`
+	ReviewerRole    string `gcfg:"reviewerrole" cfg_key:"optional"`
+
+	// Sign every commit with the node's key, and trust the keys of the
+	// other nodes that push here
+	SigningKey     string `gcfg:"signingkey" cfg_key:"optional"`
+	TrustedSigners string `gcfg:"trustedsigners" cfg_key:"optional"`
 }
 
 func (c *cfgChange) CheckCfgFieldsExist() error {
@@ -0,0 +1,264 @@
+package conflict
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	mux "github.com/gorilla/mux"
+	change "github.com/iti/pbconf/lib/pbchange"
+	database "github.com/iti/pbconf/lib/pbdatabase"
+	global "github.com/iti/pbconf/lib/pbglobal"
+	logging "github.com/iti/pbconf/lib/pblogger"
+)
+
+type APIHandler struct {
+	log     logging.Logger
+	db      database.AppDatabase
+	Version int
+}
+
+// conflict is a conflict as shown to operators.  The versions of the
+// object are only filled in when a single conflict is asked for.
+type conflict struct {
+	TransactionID string
+	ObjectType    string
+	Object        string
+	Message       string
+	Status        string
+	*change.Conflict
+	Base   map[string]string `json:",omitempty"`
+	Local  map[string]string `json:",omitempty"`
+	Remote map[string]string `json:",omitempty"`
+}
+
+// resolveRequest is the body of a resolve request.  Files holds the merged
+// content of the object, for a merged resolution only.
+type resolveRequest struct {
+	Resolver   string
+	Resolution string
+	Files      map[string]string
+}
+
+func NewAPIHandler(loglevel string, d database.AppDatabase) *APIHandler {
+	l, _ := logging.GetLogger("Conflicts API")
+	logging.SetLevel(loglevel, "Conflicts API")
+	return &APIHandler{log: l, db: d, Version: 1}
+}
+
+func (a *APIHandler) AddAPIEndpoints(router *mux.Router) {
+	a.log.Info("Registering conflict endpoints")
+
+	for _, v := range global.ApiUrlVersioning {
+		router.HandleFunc(v+"/conflicts", a.handleBaseRoute).Methods("GET")
+
+		s := router.PathPrefix(v + "/conflicts").Subrouter()
+		s.HandleFunc("/", a.handleBaseRoute).Methods("GET")
+		s.HandleFunc("/{transid}", a.handleWIdRoute).Methods("GET")
+		s.HandleFunc("/{transid}/resolve", a.handleResolveRoute).Methods("POST")
+	}
+}
+
+func (a *APIHandler) GetInfo() (string, int) {
+	return "conflicts", a.Version
+}
+
+func (a *APIHandler) checkVersion(writer http.ResponseWriter, req *http.Request) *logging.ResponseLogger {
+	//deal with any version in the URL or Accept header
+	version, err := global.ProcessVersioning(req)
+	if err != nil {
+		a.log.Debug("Versioning: %s", err.Error())
+		writer.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	if version != nil && *version > a.Version {
+		a.log.Debug("Version %v not implemented, current version is %v", *version, a.Version)
+		writer.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	return &logging.ResponseLogger{
+		ResponseWriter: writer,
+		Logger:         a.log,
+		SrcNodeName:    global.RootNode,
+	}
+}
+
+// handleBaseRoute lists the conflicts waiting to be merged, oldest first
+func (a *APIHandler) handleBaseRoute(writer http.ResponseWriter, req *http.Request) {
+	resp := a.checkVersion(writer, req)
+	if resp == nil {
+		return
+	}
+
+	engine, err := change.GetCMEngine(nil)
+	if err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "GET /conflicts::Could not get instance of CME, error: %s", err.Error())
+		return
+	}
+
+	list := make([]conflict, 0)
+	for _, t := range engine.Conflicts() {
+		list = append(list, newConflict(t))
+	}
+
+	jsonStr, err := json.Marshal(list)
+	if err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "GET /conflicts::Could not marshal the conflicts Error: %s", err.Error())
+		return
+	}
+	if _, err = resp.Write(jsonStr); err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Notice", "GET /conflicts::Writing response body Error: %s", err.Error())
+		return
+	}
+}
+
+// handleWIdRoute shows a conflict with the base, local and remote versions
+// of its object
+func (a *APIHandler) handleWIdRoute(writer http.ResponseWriter, req *http.Request) {
+	resp := a.checkVersion(writer, req)
+	if resp == nil {
+		return
+	}
+
+	id := mux.Vars(req)["transid"]
+	engine, err := change.GetCMEngine(nil)
+	if err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "GET /conflicts/{transid}::Could not get instance of CME, error: %s", err.Error())
+		return
+	}
+
+	t, err := engine.GetConflict(id)
+	if err != nil {
+		resp.WriteLog(http.StatusNotFound, "Info", "GET /conflicts/{transid}::%s", err.Error())
+		return
+	}
+	versions, err := engine.GetConflictVersions(id)
+	if err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "GET /conflicts/{transid}::Could not read the versions of conflict %s, error: %s", id, err.Error())
+		return
+	}
+
+	c := newConflict(t)
+	c.Base, c.Local, c.Remote = files(versions.Base), files(versions.Local), files(versions.Remote)
+
+	jsonStr, err := json.Marshal(c)
+	if err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "GET /conflicts/{transid}::Could not marshal the conflict Error: %s", err.Error())
+		return
+	}
+	if _, err = resp.Write(jsonStr); err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Notice", "GET /conflicts/{transid}::Writing response body Error: %s", err.Error())
+		return
+	}
+}
+
+/*
+handleResolveRoute resolves a conflict by picking the local or remote
+version of its object, or by submitting a merged one.  Once every conflict
+of the same pull is resolved the upstream changes are merged, and the
+merge commit is returned.
+*/
+func (a *APIHandler) handleResolveRoute(writer http.ResponseWriter, req *http.Request) {
+	resp := a.checkVersion(writer, req)
+	if resp == nil {
+		return
+	}
+
+	id := mux.Vars(req)["transid"]
+	var rr resolveRequest
+	if err := json.NewDecoder(req.Body).Decode(&rr); err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Notice", "POST /conflicts/{transid}/resolve::Decoder error: %s", err.Error())
+		return
+	}
+
+	engine, err := change.GetCMEngine(nil)
+	if err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "POST /conflicts/{transid}/resolve::Could not get instance of CME, error: %s", err.Error())
+		return
+	}
+
+	user := database.PbUser{Name: rr.Resolver}
+	if err = user.GetByName(a.db); err != nil {
+		resp.WriteLog(http.StatusForbidden, "Info", "POST /conflicts/{transid}/resolve::Unknown user %s", rr.Resolver)
+		return
+	}
+	if engine.ReviewerRole != "" && user.Role != engine.ReviewerRole {
+		resp.WriteLog(http.StatusForbidden, "Info", "POST /conflicts/{transid}/resolve::%s does not have the %s role needed to resolve conflicts", user.Name, engine.ReviewerRole)
+		return
+	}
+
+	t, err := engine.GetConflict(id)
+	if err != nil {
+		resp.WriteLog(http.StatusNotFound, "Info", "POST /conflicts/{transid}/resolve::%s", err.Error())
+		return
+	}
+
+	var data *change.ChangeData
+	if len(rr.Files) != 0 {
+		content := change.NewCMContent(t.Object)
+		for name, body := range rr.Files {
+			content.Files[name] = []byte(body)
+		}
+		data = &change.ChangeData{ObjectType: t.Ctype, Content: content}
+	}
+
+	resolver := &change.CMAuthor{Name: user.Name, Email: user.Email, When: time.Now()}
+	commit, err := engine.ResolveConflict(id, rr.Resolution, data, resolver)
+	if err != nil {
+		status := http.StatusBadRequest
+		if change.IsCMConflictError(err) {
+			status = http.StatusConflict
+		}
+		resp.WriteLog(status, "Info", "POST /conflicts/{transid}/resolve::%s", err.Error())
+		return
+	}
+
+	jsonStr, err := json.Marshal(struct {
+		CommitID string `json:",omitempty"`
+	}{commit})
+	if err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "POST /conflicts/{transid}/resolve::Could not marshal the commit Error: %s", err.Error())
+		return
+	}
+	resp.Write(jsonStr)
+}
+
+func newConflict(t change.Transaction) conflict {
+	return conflict{
+		TransactionID: t.ID,
+		ObjectType:    t.Ctype.String(),
+		Object:        t.Object,
+		Message:       t.Message,
+		Status:        t.Status.String(),
+		Conflict:      t.Conflict,
+	}
+}
+
+// files returns the files of a version of an object as text, or nil if
+// the object does not exist in that version
+func files(cd *change.ChangeData) map[string]string {
+	if cd == nil {
+		return nil
+	}
+	m := make(map[string]string, len(cd.Content.Files))
+	for name, body := range cd.Content.Files {
+		m[name] = string(body)
+	}
+	return m
+}
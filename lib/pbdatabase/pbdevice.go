@@ -149,6 +149,17 @@ func (dev *PbDevice) GetConnectionString(db AppDatabase, subsys string) (string,
 	return transItem.Value, locItem.Value, nil
 }
 
+// ConfigValue looks up key in the config items already loaded by Get or
+// GetByName
+func (dev *PbDevice) ConfigValue(key string) (string, bool) {
+	for _, item := range dev.ConfigItems {
+		if item.Key == key {
+			return item.Value, true
+		}
+	}
+	return "", false
+}
+
 /*************** Device, DeviceConfigItems, DeviceConfigLines table access helper functions ********************/
 func (dev *PbDevice) createDeviceTableTransaction(db AppDatabase, transaction *sql.Tx) error {
 	if dev.ParentNode == nil {
@@ -0,0 +1,339 @@
+package device
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	mux "github.com/gorilla/mux"
+	change "github.com/iti/pbconf/lib/pbchange"
+	database "github.com/iti/pbconf/lib/pbdatabase"
+	global "github.com/iti/pbconf/lib/pbglobal"
+	logging "github.com/iti/pbconf/lib/pblogger"
+	trans "github.com/iti/pbconf/lib/pbtranslate"
+	"golang.org/x/net/context"
+)
+
+// How long a change set has to configure its devices, and again to give
+// them their old config back.  It does not end with the request, so a
+// client going away does not leave the devices half configured.
+const changeSetTimeout = 10 * time.Minute
+
+// configureDevice sends a config to a device through the translation engine
+var configureDevice = func(ctx context.Context, id int64, config []byte) error {
+	return trans.ExecuteConfigContext(ctx, nil, id, bytes.NewBuffer(config))
+}
+
+// changeSetRequest is the body of a POST to /device/changesets
+type changeSetRequest struct {
+	Author       *change.CMAuthor
+	Message      string
+	AllOrNothing bool
+	Devices      []changeSetDevice
+}
+
+// changeSetDevice is the new config of one device of a change set
+type changeSetDevice struct {
+	Device string
+	Config string
+}
+
+// changeSetProblem is why one device kept a change set from being applied
+type changeSetProblem struct {
+	Device string
+	Error  string
+}
+
+// changeSetResult is a change set with the transaction it runs under
+type changeSetResult struct {
+	TransactionID string
+	Status        string
+	Author        *change.CMAuthor
+	Message       string
+	*change.ChangeSet
+}
+
+func newChangeSetResult(t change.Transaction) changeSetResult {
+	return changeSetResult{
+		TransactionID: t.ID,
+		Status:        t.Status.String(),
+		Author:        t.Author,
+		Message:       t.Message,
+		ChangeSet:     t.ChangeSet,
+	}
+}
+
+// handleChangeSets handles the GET and POST routes for "/device/changesets"
+func (a *APIHandler) handleChangeSets(writer http.ResponseWriter, req *http.Request) {
+	//deal with any version in the URL or Accept header
+	version, err := global.ProcessVersioning(req)
+	if err != nil {
+		a.log.Debug("Versioning: %s", err.Error())
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if version != nil && *version > a.Version {
+		a.log.Debug("Version %v not implemented, current version is %v", *version, a.Version)
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	resp := &logging.ResponseLogger{
+		ResponseWriter: writer,
+		Logger:         a.log,
+		SrcNodeName:    global.RootNode,
+	}
+	switch req.Method {
+	case "GET":
+		a.getChangeSetsHandler(resp, req)
+	case "POST":
+		a.postChangeSetHandler(resp, req)
+	}
+}
+
+// handleChangeSet handles the GET route for "/device/changesets/{transid}"
+func (a *APIHandler) handleChangeSet(writer http.ResponseWriter, req *http.Request) {
+	//deal with any version in the URL or Accept header
+	version, err := global.ProcessVersioning(req)
+	if err != nil {
+		a.log.Debug("Versioning: %s", err.Error())
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if version != nil && *version > a.Version {
+		a.log.Debug("Version %v not implemented, current version is %v", *version, a.Version)
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	resp := &logging.ResponseLogger{
+		ResponseWriter: writer,
+		Logger:         a.log,
+		SrcNodeName:    global.RootNode,
+	}
+
+	changeEng, err := change.GetCMEngine(nil)
+	if err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "GET /device/changesets/{id}::Could not get instance of CME, error: %s", err.Error())
+		return
+	}
+	t, err := changeEng.GetChangeSet(mux.Vars(req)["transid"])
+	if err != nil {
+		resp.WriteLog(http.StatusNotFound, "Info", "GET /device/changesets/{id}::%s", err.Error())
+		return
+	}
+	a.writeChangeSet(newChangeSetResult(t), http.StatusOK, resp)
+}
+
+func (a *APIHandler) getChangeSetsHandler(resp *logging.ResponseLogger, req *http.Request) {
+	changeEng, err := change.GetCMEngine(nil)
+	if err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "GET /device/changesets::Could not get instance of CME, error: %s", err.Error())
+		return
+	}
+
+	sets := make([]changeSetResult, 0)
+	for _, t := range changeEng.ChangeSets() {
+		if t.Ctype == change.DEVICE {
+			sets = append(sets, newChangeSetResult(t))
+		}
+	}
+	jsonStr, err := json.Marshal(sets)
+	if err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "GET /device/changesets::Could not marshal the change sets Error: %s", err.Error())
+		return
+	}
+	resp.Write(jsonStr)
+}
+
+/*
+postChangeSetHandler changes the config of several devices of this node
+under one transaction.  Every config is checked against the ontology before
+anything is written, and one failing check refuses the whole set.  The
+configs are then versioned and landed on master together and applied to the
+devices in the order given.  With AllOrNothing set, the first device that
+fails stops the set and the devices already applied are given their old
+config back; otherwise every device is tried and only the failed ones are
+rolled back in the repository.  The response reports every device.
+*/
+func (a *APIHandler) postChangeSetHandler(resp *logging.ResponseLogger, req *http.Request) {
+	var request changeSetRequest
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Notice", "POST /device/changesets::Decoder error: %s", err.Error())
+		return
+	}
+	if len(request.Devices) == 0 {
+		resp.WriteLog(http.StatusBadRequest, "Info", "POST /device/changesets::No devices given")
+		return
+	}
+
+	info := &change.ChangeData{Author: request.Author, Log: &change.LogLine{Message: request.Message}}
+	if err := a.completeConfigurationDataStruct(info); err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Notice", "POST /device/changesets::Change set missing fields, error: %s", err.Error())
+		return
+	}
+
+	changeEng, err := change.GetCMEngine(nil)
+	if err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "POST /device/changesets::Could not get instance of CME, error: %s", err.Error())
+		return
+	}
+	if changeEng.RequireApproval {
+		resp.WriteLog(http.StatusConflict, "Info", "POST /device/changesets::Changes that need approval can not be made as a change set")
+		return
+	}
+	rootnode, err := nodeComm.GetRootNode()
+	if err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Warning", "POST /device/changesets::Could not recover root node from database, cannot proceed")
+		return
+	}
+
+	// Check the whole set before touching anything
+	devices := make([]database.PbDevice, 0, len(request.Devices))
+	old := make(map[string][]byte)
+	changes := make([]*change.ChangeData, 0, len(request.Devices))
+	problems := make([]changeSetProblem, 0)
+	for _, d := range request.Devices {
+		device := database.PbDevice{Name: d.Device}
+		if err := device.GetByName(a.db); err != nil {
+			problems = append(problems, changeSetProblem{d.Device, "Unknown device"})
+			continue
+		}
+		if device.ParentNode == nil || *device.ParentNode != rootnode.Id {
+			problems = append(problems, changeSetProblem{d.Device, "The device is configured by another node"})
+			continue
+		}
+		if err := a.checkDeviceConfigWOntology(device, bytes.NewBufferString(d.Config), changeEng); err != nil {
+			problems = append(problems, changeSetProblem{d.Device, err.Error()})
+			continue
+		}
+		if content, err := a.getDeviceConfigurationContentFromRepo(device.Name); err == nil {
+			old[device.Name] = content
+		}
+
+		cfg := &change.ChangeData{ObjectType: change.DEVICE, Author: info.Author, Content: change.NewCMContent(device.Name),
+			Log: &change.LogLine{Message: info.Log.Message}}
+		cfg.Content.Files["configFile"] = []byte(d.Config)
+		devices = append(devices, device)
+		changes = append(changes, cfg)
+	}
+	if len(problems) != 0 {
+		jsonStr, err := json.Marshal(problems)
+		if err != nil {
+			resp.WriteLog(http.StatusInternalServerError, "Notice", "POST /device/changesets::Could not marshal the problems Error: %s", err.Error())
+			return
+		}
+		a.log.Info("POST /device/changesets::Change set refused, %d devices did not pass", len(problems))
+		resp.WriteHeader(http.StatusBadRequest)
+		resp.Write(jsonStr)
+		return
+	}
+
+	transID, err := changeEng.BeginChangeSet(changes, info.Log.Message, request.AllOrNothing)
+	if err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Info", "POST /device/changesets::Could not begin the change set, error: %s", err.Error())
+		return
+	}
+	if _, err = changeEng.LandChangeSet(transID); err != nil {
+		changeEng.FinalizeChangeSet(transID, change.FAILED)
+		resp.WriteLog(http.StatusConflict, "Info", "POST /device/changesets::%s", err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), changeSetTimeout)
+	applied := make([]database.PbDevice, 0, len(devices))
+	failed := make([]string, 0)
+	for i, device := range devices {
+		a.log.Debug("Configuring device with id %d", device.Id)
+		err := configureDevice(ctx, device.Id, changes[i].Content.Files["configFile"])
+		if err == nil {
+			changeEng.SetMemberStatus(transID, device.Name, change.MemberApplied, "")
+			applied = append(applied, device)
+			continue
+		}
+
+		a.log.Warning("Configuring device with id %d failed: %s", device.Id, err.Error())
+		changeEng.SetMemberStatus(transID, device.Name, change.MemberFailed, err.Error())
+		failed = append(failed, device.Name)
+		if request.AllOrNothing {
+			for _, rest := range devices[i+1:] {
+				changeEng.SetMemberStatus(transID, rest.Name, change.MemberSkipped, "An earlier device failed")
+			}
+			break
+		}
+	}
+
+	// Put the old configs back in the repository, and on the devices too when
+	// the set is all or nothing
+	cancel()
+	revert := failed
+	if request.AllOrNothing && len(failed) != 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), changeSetTimeout)
+		defer cancel()
+		for _, device := range applied {
+			content, ok := old[device.Name]
+			if !ok {
+				changeEng.SetMemberStatus(transID, device.Name, change.MemberApplied, "No earlier config to return to")
+				continue
+			}
+			if err := configureDevice(ctx, device.Id, content); err != nil {
+				a.log.Warning("Returning device with id %d to its old config failed: %s", device.Id, err.Error())
+				changeEng.SetMemberStatus(transID, device.Name, change.MemberApplied, "Could not return to the old config: "+err.Error())
+				continue
+			}
+			changeEng.SetMemberStatus(transID, device.Name, change.MemberRolledBack, "")
+			revert = append(revert, device.Name)
+		}
+		for _, d := range devices[len(applied)+1:] {
+			revert = append(revert, d.Name)
+		}
+	}
+	if len(revert) != 0 {
+		if _, err = changeEng.RevertChangeSet(transID, revert, info.Author, "Not every device of the change set took its new config"); err != nil {
+			a.log.Warning("POST /device/changesets::Could not roll back change set %s, error: %s", transID, err.Error())
+		}
+	}
+
+	status, code := change.COMPLETE, http.StatusOK
+	if len(failed) != 0 {
+		status, code = change.FAILED, http.StatusInternalServerError
+	}
+	if err = changeEng.FinalizeChangeSet(transID, status); err != nil {
+		a.log.Debug("postChangeSetHandler: FinalizeChangeSet returned with error: " + err.Error())
+	}
+
+	t, err := changeEng.GetChangeSet(transID)
+	if err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "POST /device/changesets::%s", err.Error())
+		return
+	}
+	a.log.Info("POST /device/changesets::Change set %s of %d devices %s", transID, len(devices), t.Status.String())
+	a.writeChangeSet(newChangeSetResult(t), code, resp)
+}
+
+func (a *APIHandler) writeChangeSet(set changeSetResult, status int, resp *logging.ResponseLogger) {
+	jsonStr, err := json.Marshal(set)
+	if err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "/device/changesets::Could not marshal the change set Error: %s", err.Error())
+		return
+	}
+	resp.WriteHeader(status)
+	resp.Write(jsonStr)
+}
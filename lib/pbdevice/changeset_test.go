@@ -0,0 +1,173 @@
+package device
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	mux "github.com/gorilla/mux"
+	change "github.com/iti/pbconf/lib/pbchange"
+	config "github.com/iti/pbconf/lib/pbconfig"
+	database "github.com/iti/pbconf/lib/pbdatabase"
+	global "github.com/iti/pbconf/lib/pbglobal"
+	logging "github.com/iti/pbconf/lib/pblogger"
+	"golang.org/x/net/context"
+)
+
+/*
+newTestNode sets up this node as the root node with a database, a
+repository and the device routes, and the user tester and the given
+devices in it.  The returned function tears it all down.
+*/
+func newTestNode(t *testing.T, dbFile string, names ...string) (database.AppDatabase, *change.CMEngine, *mux.Router, func()) {
+	logging.InitLogger("DEBUG", &config.Config{}, "")
+	os.Remove(dbFile)
+	db := database.Open(dbFile, "DEBUG")
+	db.LoadSchema()
+
+	repo, err := ioutil.TempDir("", "cmengine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := new(config.Config)
+	cfg.ChMgmt.RepoPath = repo
+	cfg.ChMgmt.LogLevel = "DEBUG"
+	engine, err := change.GetCMEngine(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	teardown := func() {
+		engine.Free()
+		os.RemoveAll(repo)
+		db.Close()
+		os.Remove(dbFile)
+	}
+
+	global.Start("Root", &config.CfgWebAPI{Listen: ":8080"})
+	global.CTX = context.WithValue(global.CTX, "configuration", new(config.Config))
+	router := mux.NewRouter()
+	NewAPIHandler("DEBUG", db).AddAPIEndpoints(router)
+
+	node := database.PbNode{Name: "Root",
+		ConfigItems: []database.ConfigItem{
+			{Key: "UpstreamNode", Value: ""},
+			{Key: "PropogateDeviceConfig", Value: "false"},
+		},
+	}
+	if err := node.Create(db); err != nil {
+		teardown()
+		t.Fatal(err)
+	}
+	user := database.PbUser{Name: "tester", Email: "tester@iti.com", Password: "notreally"}
+	if err := user.Create(db); err != nil {
+		teardown()
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		dev := database.PbDevice{Name: name, ParentNode: &node.Id}
+		if err := dev.Create(db); err != nil {
+			teardown()
+			t.Fatal(err)
+		}
+		engine.VersionMeta(name, "driver", "dummy")
+	}
+	return db, engine, router, teardown
+}
+
+func TestChangeSetOutlivesRequest(t *testing.T) {
+	fmt.Printf("##################### Begin Device::%s #####################\n", "TestChangeSetOutlivesRequest")
+	defer fmt.Printf("###################### End Device::%s ######################\n", "TestChangeSetOutlivesRequest")
+
+	names := []string{"A_Device", "B_Device", "C_Device"}
+	db, _, router, teardown := newTestNode(t, "test_changeSetContext.db", names...)
+	defer teardown()
+
+	// The client goes away while the first device is configured.  The
+	// devices that follow, and the roll back of an all or nothing set, must
+	// still be given a live context.
+	defer func(f func(context.Context, int64, []byte) error) { configureDevice = f }(configureDevice)
+	post := func(allOrNothing bool, config, fail string) (*httptest.ResponseRecorder, []string) {
+		set := changeSetRequest{
+			Author:       &change.CMAuthor{Name: "tester"},
+			Message:      "change set",
+			AllOrNothing: allOrNothing,
+		}
+		for _, name := range names {
+			set.Devices = append(set.Devices, changeSetDevice{Device: name, Config: config + name})
+		}
+		body, _ := json.Marshal(set)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		req, err := http.NewRequest("POST", "https://localhost:8080/device/changesets", bytes.NewBuffer(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req = req.WithContext(ctx)
+
+		dead := make([]string, 0)
+		configureDevice = func(ctx context.Context, id int64, config []byte) error {
+			cancel()
+			if ctx.Err() != nil {
+				dev := database.PbDevice{Id: id}
+				dev.Get(db)
+				dead = append(dead, dev.Name)
+				return ctx.Err()
+			}
+			if bytes.Equal(config, []byte(fail)) {
+				return errors.New("refused")
+			}
+			return nil
+		}
+		writer := httptest.NewRecorder()
+		router.ServeHTTP(writer, req)
+		return writer, dead
+	}
+
+	writer, dead := post(false, "SET ", "")
+	if writer.Code != http.StatusOK || len(dead) != 0 {
+		t.Fatalf("Expected every device configured, got %d, %s, dead contexts for %v", writer.Code, writer.Body.String(), dead)
+	}
+	var result changeSetResult
+	if err := json.Unmarshal(writer.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != change.COMPLETE.String() {
+		t.Errorf("Expected the change set complete, got %s", result.Status)
+	}
+
+	writer, dead = post(true, "SET new ", "SET new B_Device")
+	if writer.Code != http.StatusInternalServerError || len(dead) != 0 {
+		t.Fatalf("Expected the roll back to outlive the request, got %d, %s, dead contexts for %v", writer.Code, writer.Body.String(), dead)
+	}
+	result = changeSetResult{}
+	if err := json.Unmarshal(writer.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Members) == 0 || result.Members[0].Status != change.MemberRolledBack {
+		t.Errorf("Expected A_Device given its old config back, got %+v", result.Members)
+	}
+}
@@ -33,7 +33,9 @@ import (
 	internode "github.com/iti/pbconf/lib/pbinternode"
 	logging "github.com/iti/pbconf/lib/pblogger"
 	ontology "github.com/iti/pbconf/lib/pbontology"
+	scheduler "github.com/iti/pbconf/lib/pbscheduler"
 	trans "github.com/iti/pbconf/lib/pbtranslate"
+	"golang.org/x/net/context"
 	validator "gopkg.in/validator.v2"
 )
 
@@ -67,8 +69,13 @@ func (a *APIHandler) AddAPIEndpoints(router *mux.Router) {
 
 		s := router.PathPrefix(v + "/device").Subrouter()
 		s.HandleFunc("/", a.handleBaseRoute).Methods("HEAD", "GET", "POST", "PATCH")
+		s.HandleFunc("/changesets", a.handleChangeSets).Methods("GET", "POST")
+		s.HandleFunc("/changesets/{transid}", a.handleChangeSet).Methods("GET")
 		s.HandleFunc("/{devid}", a.handleWIdRoute).Methods("GET", "PATCH", "DELETE")
 		s.HandleFunc("/{devid}/config", a.handleConfig).Methods("GET", "PATCH")
+		s.HandleFunc("/{devid}/config/rollback", a.handleConfigRollback).Methods("POST")
+		s.HandleFunc("/{devid}/config/diff", a.handleConfigDiff).Methods("GET")
+		s.HandleFunc("/{devid}/config/blame", a.handleConfigBlame).Methods("GET")
 		s.HandleFunc("/{devid}/meta", a.handleMeta).Methods("GET", "PATCH", "DELETE")
 		s.HandleFunc("/{devid}/{cfgkey}", a.handleWIdRouteCfgItem).Methods("GET", "DELETE")
 		// Change management hook
@@ -618,6 +625,271 @@ func (a *APIHandler) patchConfigHandler(resp *logging.ResponseLogger, req *http.
 	a.patchDeviceConfigHierarchy(dbDev, &cfg, resp, req)
 }
 
+// rollbackResult is the response to a config rollback
+type rollbackResult struct {
+	Outcome       string
+	CommitID      string `json:",omitempty"`
+	RecordID      string `json:",omitempty"`
+	TransactionID string `json:",omitempty"`
+}
+
+// handleConfigRollback handles the POST route for "/device/{devid}/config/rollback". The request body names
+// the commit to go back to in CommitID, along with the Author and Log.Message of the rollback.
+func (a *APIHandler) handleConfigRollback(writer http.ResponseWriter, req *http.Request) {
+	//deal with any version in the URL or Accept header
+	version, err := global.ProcessVersioning(req)
+	if err != nil {
+		a.log.Debug("Versioning: %s", err.Error())
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if version != nil && *version > a.Version {
+		a.log.Debug("Version %v not implemented, current version is %v", *version, a.Version)
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+	resp := &logging.ResponseLogger{
+		ResponseWriter: writer,
+		Logger:         a.log,
+		SrcNodeName:    global.RootNode,
+	}
+
+	params := mux.Vars(req)
+	deviceId, err := a.parseIdFromRoute(params["devid"]) // string to int64
+	if err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Info", "POST /device/{id}/config/rollback::Could not recover device id from route.")
+		return
+	}
+
+	dbDev := database.PbDevice{Id: deviceId}
+	exists, err := dbDev.ExistsById(a.db)
+	if err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Info", "POST /device/{id}/config/rollback:: Error checking existence of device in the database.")
+		return
+	}
+	if !exists {
+		resp.WriteLog(http.StatusNotFound, "Info", "POST /device/{id}/config/rollback:: Could not find device in the database")
+		return
+	}
+	if err = dbDev.Get(a.db); err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Info", "POST /device/{id}/config/rollback::Error getting device from the database")
+		return
+	}
+
+	var request change.ChangeData
+	if err = json.NewDecoder(req.Body).Decode(&request); err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Notice", "POST /device/{id}/config/rollback::Decoder error: %s", err.Error())
+		return
+	}
+	if request.CommitID == "" {
+		resp.WriteLog(http.StatusBadRequest, "Info", "POST /device/{id}/config/rollback::No commit to roll back to")
+		return
+	}
+	if request.Log == nil {
+		request.Log = &change.LogLine{}
+	}
+	if err = a.completeConfigurationDataStruct(&request); err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Notice", "POST /device/{id}/config/rollback::Rollback missing fields, error: %s", err.Error())
+		return
+	}
+	a.rollbackDeviceConfigHierarchy(dbDev, &request, resp, req)
+}
+
+// configDiff is the semantic diff of a device configuration between two
+// commits
+type configDiff struct {
+	Device string
+	From   string
+	To     string
+	*trans.ConfigDiff
+}
+
+/*
+handleConfigDiff compares the configuration of a device at two commits key
+by key.  The from and to query parameters name the commits.  To defaults to
+master, and from to the change of the device before to.  A device that did
+not exist at one of the commits is compared against an empty configuration.
+*/
+func (a *APIHandler) handleConfigDiff(writer http.ResponseWriter, req *http.Request) {
+	//deal with any version in the URL or Accept header
+	version, err := global.ProcessVersioning(req)
+	if err != nil {
+		a.log.Debug("Versioning: %s", err.Error())
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if version != nil && *version > a.Version {
+		a.log.Debug("Version %v not implemented, current version is %v", *version, a.Version)
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+	resp := &logging.ResponseLogger{
+		ResponseWriter: writer,
+		Logger:         a.log,
+		SrcNodeName:    global.RootNode,
+	}
+
+	params := mux.Vars(req)
+	deviceId, err := a.parseIdFromRoute(params["devid"]) // string to int64
+	if err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Info", "GET /device/{id}/config/diff::Could not recover device id from route.")
+		return
+	}
+
+	dbDev := database.PbDevice{Id: deviceId}
+	exists, err := dbDev.ExistsById(a.db)
+	if err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Info", "GET /device/{id}/config/diff:: Error checking existence of device in the database.")
+		return
+	}
+	if !exists {
+		resp.WriteLog(http.StatusNotFound, "Info", "GET /device/{id}/config/diff:: Could not find device in the database")
+		return
+	}
+	if err = dbDev.Get(a.db); err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Info", "GET /device/{id}/config/diff::Error getting device from the database")
+		return
+	}
+
+	changeEng, err := change.GetCMEngine(nil)
+	if err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "GET /device/{id}/config/diff::Could not get instance of CME, error: %s", err.Error())
+		return
+	}
+
+	query := req.URL.Query()
+	from, to := query.Get("from"), query.Get("to")
+	if to == "" {
+		to = "master"
+	}
+	if from == "" {
+		commits, err := changeEng.ObjectCommits(change.DEVICE, dbDev.Name, to, 2)
+		if err != nil {
+			resp.WriteLog(http.StatusNotFound, "Info", "GET /device/{id}/config/diff::%s", err.Error())
+			return
+		}
+		if len(commits) < 2 {
+			resp.WriteLog(http.StatusNotFound, "Info", "GET /device/{id}/config/diff::No earlier configuration of %s to compare with", dbDev.Name)
+			return
+		}
+		from = commits[1]
+	}
+
+	commits := []string{from, to}
+	versions := make([]*change.ChangeData, 2)
+	for i, commit := range commits {
+		versions[i], err = changeEng.GetObjectAt(change.DEVICE, dbDev.Name, commit)
+		if err != nil && !change.IsCMNoObjectError(err) {
+			resp.WriteLog(http.StatusNotFound, "Info", "GET /device/{id}/config/diff::%s", err.Error())
+			return
+		}
+		if versions[i] != nil {
+			commits[i] = versions[i].CommitID
+		}
+	}
+	if versions[0] == nil && versions[1] == nil {
+		resp.WriteLog(http.StatusNotFound, "Info", "GET /device/{id}/config/diff::%s has no configuration at %s or %s", dbDev.Name, from, to)
+		return
+	}
+
+	d, err := trans.DiffObjects(versions[0], versions[1])
+	if err != nil {
+		resp.WriteLog(http.StatusUnprocessableEntity, "Info", "GET /device/{id}/config/diff::Could not parse the configuration, error: %s", err.Error())
+		return
+	}
+
+	jsonStr, err := json.Marshal(configDiff{Device: dbDev.Name, From: commits[0], To: commits[1], ConfigDiff: d})
+	if err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "GET /device/{id}/config/diff::Could not marshal the diff Error: %s", err.Error())
+		return
+	}
+	if _, err = resp.Write(jsonStr); err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Notice", "GET /device/{id}/config/diff::Writing response body Error: %s", err.Error())
+	}
+}
+
+/*
+handleConfigBlame returns each statement of a device configuration with the
+commit, author, transaction and review that last changed it.  The statement
+query parameter keeps only the statements that contain it, ignoring case.
+*/
+func (a *APIHandler) handleConfigBlame(writer http.ResponseWriter, req *http.Request) {
+	//deal with any version in the URL or Accept header
+	version, err := global.ProcessVersioning(req)
+	if err != nil {
+		a.log.Debug("Versioning: %s", err.Error())
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if version != nil && *version > a.Version {
+		a.log.Debug("Version %v not implemented, current version is %v", *version, a.Version)
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+	resp := &logging.ResponseLogger{
+		ResponseWriter: writer,
+		Logger:         a.log,
+		SrcNodeName:    global.RootNode,
+	}
+
+	params := mux.Vars(req)
+	deviceId, err := a.parseIdFromRoute(params["devid"]) // string to int64
+	if err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Info", "GET /device/{id}/config/blame::Could not recover device id from route.")
+		return
+	}
+
+	dbDev := database.PbDevice{Id: deviceId}
+	exists, err := dbDev.ExistsById(a.db)
+	if err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Info", "GET /device/{id}/config/blame:: Error checking existence of device in the database.")
+		return
+	}
+	if !exists {
+		resp.WriteLog(http.StatusNotFound, "Info", "GET /device/{id}/config/blame:: Could not find device in the database")
+		return
+	}
+	if err = dbDev.Get(a.db); err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Info", "GET /device/{id}/config/blame::Error getting device from the database")
+		return
+	}
+
+	changeEng, err := change.GetCMEngine(nil)
+	if err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "GET /device/{id}/config/blame::Could not get instance of CME, error: %s", err.Error())
+		return
+	}
+
+	blame, err := changeEng.Blame(change.DEVICE, dbDev.Name)
+	if err != nil {
+		if change.IsCMNoObjectError(err) {
+			resp.WriteLog(http.StatusNotFound, "Info", "GET /device/{id}/config/blame::%s has no configuration", dbDev.Name)
+		} else {
+			resp.WriteLog(http.StatusInternalServerError, "Notice", "GET /device/{id}/config/blame::%s", err.Error())
+		}
+		return
+	}
+
+	if filter := strings.ToLower(req.URL.Query().Get("statement")); filter != "" {
+		lines := make([]change.BlameLine, 0)
+		for _, l := range blame.Lines {
+			if strings.Contains(strings.ToLower(l.Statement), filter) {
+				lines = append(lines, l)
+			}
+		}
+		blame.Lines = lines
+	}
+
+	jsonStr, err := json.Marshal(blame)
+	if err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "GET /device/{id}/config/blame::Could not marshal the blame Error: %s", err.Error())
+		return
+	}
+	if _, err = resp.Write(jsonStr); err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Notice", "GET /device/{id}/config/blame::Writing response body Error: %s", err.Error())
+	}
+}
+
 /********************Non route helper functions *******************/
 func (a *APIHandler) patchDeviceHierarchy(device database.PbDevice, resp *logging.ResponseLogger, req *http.Request) {
 	if device.ParentNode == nil { //can't do anything without a parent node specified
@@ -853,6 +1125,27 @@ func (a *APIHandler) patchDeviceConfigHierarchy(device database.PbDevice, cfg *c
 		return
 	}
 
+	// Changes given a start time or maintenance window wait for the scheduler
+	query := req.URL.Query()
+	if query.Get("at") != "" || query.Get("window") != "" {
+		if rootnode.Id != *device.ParentNode {
+			resp.WriteLog(http.StatusBadRequest, "Info", "PATCH /device/{id}/config::Changes are scheduled on the node that configures the device")
+			return
+		}
+		if changeEng.RequireApproval {
+			resp.WriteLog(http.StatusConflict, "Info", "PATCH /device/{id}/config::Changes that need approval can not be scheduled")
+			return
+		}
+		a.scheduleDeviceConfig(device, cfg, changeEng, resp, req)
+		return
+	}
+
+	// Devices of other nodes are reviewed where they are configured
+	if changeEng.RequireApproval && rootnode.Id == *device.ParentNode {
+		a.proposeDeviceConfig(device, cfg, changeEng, resp)
+		return
+	}
+
 	transID, err := changeEng.BeginTransaction(cfg, cfg.Log.Message)
 	if err != nil {
 		resp.WriteLog(http.StatusBadRequest, "Debug", "PATCH /device/{id}/config:::BeginTransaction error:%s", err.Error())
@@ -876,7 +1169,7 @@ func (a *APIHandler) patchDeviceConfigHierarchy(device database.PbDevice, cfg *c
 		}
 
 		if rootnode.Id == *device.ParentNode {
-			device_ok, err = a.updatePhysicalDeviceWithCfg(device, buf)
+			device_ok, err = a.updatePhysicalDeviceWithCfg(req.Context(), device, buf)
 			if err != nil {
 				resp.WriteLog(http.StatusBadRequest, "Info", "PATCH /device/{id}/config::Was not able to update the configuration on the device. Cannot proceed")
 				return
@@ -903,6 +1196,237 @@ func (a *APIHandler) patchDeviceConfigHierarchy(device database.PbDevice, cfg *c
 	resp.WriteHeader(http.StatusOK)
 }
 
+// proposeDeviceConfig checks the config against the ontology and holds it
+// on a transaction branch until it is approved through the changes API
+func (a *APIHandler) proposeDeviceConfig(device database.PbDevice, cfg *change.ChangeData, changeEng *change.CMEngine, resp *logging.ResponseLogger) {
+	var buf *bytes.Buffer
+	for _, v := range cfg.Content.Files {
+		buf = bytes.NewBuffer(v)
+		break
+	}
+	if buf == nil {
+		resp.WriteLog(http.StatusBadRequest, "Info", "PATCH /device/{id}/config::No configuration given")
+		return
+	}
+
+	if err := a.checkDeviceConfigWOntology(device, bytes.NewBuffer(buf.Bytes()), changeEng); err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Info", "PATCH /device/{id}/config::%s", err)
+		return
+	}
+
+	cfg.Content.Object = device.Name
+	transID, err := changeEng.ProposeChange(cfg, cfg.Log.Message)
+	if err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Info", "PATCH /device/{id}/config::Could not propose the change, error: %s", err.Error())
+		return
+	}
+
+	jsonStr, err := json.Marshal(struct{ TransactionID string }{transID})
+	if err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "PATCH /device/{id}/config::Could not marshal the change request Error: %s", err.Error())
+		return
+	}
+	a.log.Info("PATCH /device/{id}/config::Change request %s awaits review", transID)
+	resp.WriteHeader(http.StatusAccepted)
+	resp.Write(jsonStr)
+}
+
+// scheduleDeviceConfig checks the config against the ontology and queues it
+// for the scheduler, to be applied at the time or in the maintenance window
+// given in the at and window query parameters
+func (a *APIHandler) scheduleDeviceConfig(device database.PbDevice, cfg *change.ChangeData, changeEng *change.CMEngine, resp *logging.ResponseLogger, req *http.Request) {
+	var sched change.Schedule
+	query := req.URL.Query()
+	if at := query.Get("at"); at != "" {
+		t, err := time.Parse(time.RFC3339, at)
+		if err != nil {
+			resp.WriteLog(http.StatusBadRequest, "Info", "PATCH /device/{id}/config::Bad start time %s, error: %s", at, err.Error())
+			return
+		}
+		sched.At = t
+	}
+	if sched.Window = query.Get("window"); sched.Window != "" {
+		if _, err := scheduler.Get().GetWindow(sched.Window); err != nil {
+			resp.WriteLog(http.StatusBadRequest, "Info", "PATCH /device/{id}/config::%s", err.Error())
+			return
+		}
+	}
+
+	var buf *bytes.Buffer
+	for _, v := range cfg.Content.Files {
+		buf = bytes.NewBuffer(v)
+		break
+	}
+	if buf == nil {
+		resp.WriteLog(http.StatusBadRequest, "Info", "PATCH /device/{id}/config::No configuration given")
+		return
+	}
+
+	if err := a.checkDeviceConfigWOntology(device, bytes.NewBuffer(buf.Bytes()), changeEng); err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Info", "PATCH /device/{id}/config::%s", err)
+		return
+	}
+
+	cfg.Content.Object = device.Name
+	transID, err := changeEng.ScheduleChange(cfg, cfg.Log.Message, sched)
+	if err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Info", "PATCH /device/{id}/config::Could not schedule the change, error: %s", err.Error())
+		return
+	}
+
+	jsonStr, err := json.Marshal(struct{ TransactionID string }{transID})
+	if err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "PATCH /device/{id}/config::Could not marshal the scheduled change Error: %s", err.Error())
+		return
+	}
+	a.log.Info("PATCH /device/{id}/config::Change %s scheduled", transID)
+	resp.WriteHeader(http.StatusAccepted)
+	resp.Write(jsonStr)
+}
+
+/*
+rollbackDeviceConfigHierarchy returns a device to the config it had at the
+requested commit.  The old config is checked against the current policy
+first.  For devices configured by this node it is versioned again, on a
+transaction like any other change, and sent to the device, and reverted on
+master if the device does not take it; devices of other
+nodes get it through their parent node.  With approval required the
+rollback becomes a change request instead.  Whatever the outcome, it is
+recorded in the history of the device.
+*/
+func (a *APIHandler) rollbackDeviceConfigHierarchy(device database.PbDevice, request *change.ChangeData, resp *logging.ResponseLogger, req *http.Request) {
+	if device.ParentNode == nil { //can't do anything without a parent node specified
+		resp.WriteLog(http.StatusBadRequest, "Debug", "POST /device/{id}/config/rollback:: device does not have any parent node. Error in forming the request.")
+		return
+	}
+	rootnode, err := nodeComm.GetRootNode()
+	if err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Warning", "POST /device/{id}/config/rollback::Could not recover root node from database, cannot proceed")
+		return
+	}
+
+	changeEng, err := change.GetCMEngine(nil)
+	if err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Notice", "POST /device/{id}/config/rollback::Could not get instance of CME, error: %s", err.Error())
+		return
+	}
+
+	cfg, err := changeEng.GetObjectAt(change.DEVICE, device.Name, request.CommitID)
+	if err != nil {
+		resp.WriteLog(http.StatusNotFound, "Info", "POST /device/{id}/config/rollback::%s", err.Error())
+		return
+	}
+	rb := &change.Rollback{Object: device.Name, Target: cfg.CommitID, Author: request.Author}
+	cfg.CommitID = ""
+	cfg.Author = request.Author
+	cfg.Log = &change.LogLine{Message: rb.CommitMessage(request.Log.Message)}
+
+	var content []byte
+	for _, v := range cfg.Content.Files {
+		content = v
+		break
+	}
+
+	if err = a.checkDeviceConfigWOntology(device, bytes.NewBuffer(content), changeEng); err != nil {
+		a.failRollback(changeEng, rb, change.RollbackRejected, err.Error(), http.StatusBadRequest, resp)
+		return
+	}
+
+	if rootnode.Id != *device.ParentNode {
+		downstreamIPInfo, err := nodeComm.GetDownstreamNodeIP(*device.ParentNode)
+		if err != nil {
+			a.failRollback(changeEng, rb, change.RollbackFailed, "IP Address of the parent node for the device could not be recovered", http.StatusBadRequest, resp)
+			return
+		}
+		if !nodeComm.UpdateDeviceConfigDownstream(device, cfg, downstreamIPInfo) {
+			a.failRollback(changeEng, rb, change.RollbackFailed, "Could not send the device config to the parent node of the device", http.StatusBadRequest, resp)
+			return
+		}
+		rb.Outcome = change.RollbackForwarded
+		a.writeRollback(changeEng, rb, "", http.StatusOK, resp)
+		return
+	}
+
+	if changeEng.RequireApproval {
+		transID, err := changeEng.ProposeChange(cfg, cfg.Log.Message)
+		if err != nil {
+			a.failRollback(changeEng, rb, change.RollbackFailed, "Could not propose the change, error: "+err.Error(), http.StatusBadRequest, resp)
+			return
+		}
+		rb.Outcome = change.RollbackProposed
+		rb.Reason = fmt.Sprintf("Awaiting review as change request %s", transID)
+		a.writeRollback(changeEng, rb, transID, http.StatusAccepted, resp)
+		return
+	}
+
+	transID, err := changeEng.BeginTransaction(cfg, cfg.Log.Message)
+	if err != nil {
+		a.failRollback(changeEng, rb, change.RollbackFailed, "BeginTransaction error: "+err.Error(), http.StatusBadRequest, resp)
+		return
+	}
+	cfg.TransactionID = transID
+
+	commit, err := changeEng.VersionObject(cfg, cfg.Log.Message)
+	if err != nil {
+		changeEng.FinalizeTransaction(cfg, change.FAILED)
+		a.failRollback(changeEng, rb, change.RollbackFailed, "Could not version the old config, error: "+err.Error(), http.StatusInternalServerError, resp)
+		return
+	}
+	rb.Commit = strings.Trim(commit, "\"")
+
+	// The device keeps its config when it does not take the old one, and
+	// so does master
+	a.log.Debug("Configuring device with id %d", device.Id)
+	if err = configureDevice(req.Context(), device.Id, content); err != nil {
+		reason := "Configuring the device failed: " + err.Error()
+		if _, rerr := changeEng.RevertObject(change.DEVICE, device.Name, commit, request.Author,
+			fmt.Sprintf("Revert the rollback of %s", device.Name), reason); rerr != nil {
+			a.log.Error("Could not revert the rollback of %s on master, error: %s", device.Name, rerr.Error())
+			reason += "; master could not be reverted and no longer matches the device: " + rerr.Error()
+		}
+		changeEng.FinalizeTransaction(cfg, change.FAILED)
+		a.failRollback(changeEng, rb, change.RollbackFailed, reason, http.StatusInternalServerError, resp)
+		return
+	}
+	if err = changeEng.FinalizeTransaction(cfg); err != nil {
+		a.log.Debug("rollbackDeviceConfigHierarchy: FinalizeTransaction returned with error: " + err.Error())
+	}
+	rb.Outcome = change.RollbackApplied
+	a.writeRollback(changeEng, rb, transID, http.StatusOK, resp)
+}
+
+// failRollback records a rollback that did not go through and tells the
+// client why
+func (a *APIHandler) failRollback(changeEng *change.CMEngine, rb *change.Rollback, outcome, reason string, status int, resp *logging.ResponseLogger) {
+	rb.Outcome = outcome
+	rb.Reason = reason
+	if _, err := changeEng.RecordRollback(change.DEVICE, rb); err != nil {
+		a.log.Warning("Could not record the rollback of %s, error: %s", rb.Object, err.Error())
+	}
+	resp.WriteLog(status, "Info", "POST /device/{id}/config/rollback::Rollback %s: %s", outcome, reason)
+}
+
+func (a *APIHandler) writeRollback(changeEng *change.CMEngine, rb *change.Rollback, transID string, status int, resp *logging.ResponseLogger) {
+	record, err := changeEng.RecordRollback(change.DEVICE, rb)
+	if err != nil {
+		a.log.Warning("Could not record the rollback of %s, error: %s", rb.Object, err.Error())
+	}
+
+	jsonStr, err := json.Marshal(rollbackResult{
+		Outcome:       rb.Outcome,
+		CommitID:      rb.Commit,
+		RecordID:      record,
+		TransactionID: transID,
+	})
+	if err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "POST /device/{id}/config/rollback::Could not marshal the rollback Error: %s", err.Error())
+		return
+	}
+	a.log.Info("POST /device/{id}/config/rollback::Rollback of %s to %s %s", rb.Object, rb.Target, rb.Outcome)
+	resp.WriteHeader(status)
+	resp.Write(jsonStr)
+}
+
 func (a *APIHandler) patchDeviceMetadataHierarchy(device database.PbDevice, metaKey string, metaValue string, resp *logging.ResponseLogger, req *http.Request) {
 	if device.ParentNode == nil { //can't do anything without a parent node specified
 		resp.WriteLog(http.StatusBadRequest, "Debug", "PATCH /device/{id}/meta:: device does not have any parent node. Error in forming the request.")
@@ -1175,10 +1699,13 @@ func CfgPackRcvdCallback(handler interface{}, cmData *change.ChangeData) {
 //updatePhysicalDeviceWithCfg updates the physical device with all config changes.
 //Here device is the stored device on the database, in case the content changes things like password, and we
 //need to access the cached stored content before applying the new content
-func (a *APIHandler) updatePhysicalDeviceWithCfg(device database.PbDevice, buf *bytes.Buffer) (bool, error) {
+//The request context is passed along so a client going away, or the device timeouts, stop the driver
+func (a *APIHandler) updatePhysicalDeviceWithCfg(ctx context.Context, device database.PbDevice, buf *bytes.Buffer) (bool, error) {
 	// Op complete, so apply
 	a.log.Debug("Configuring device with id %d", device.Id)
-	trans.ExecuteConfig(nil, device.Id, buf)
+	if err := trans.ExecuteConfigContext(ctx, nil, device.Id, buf); err != nil {
+		a.log.Warning("Configuring device with id %d failed: %s", device.Id, err.Error())
+	}
 	return true, nil
 }
 
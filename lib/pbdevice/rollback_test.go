@@ -0,0 +1,100 @@
+package device
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	change "github.com/iti/pbconf/lib/pbchange"
+	database "github.com/iti/pbconf/lib/pbdatabase"
+	"golang.org/x/net/context"
+)
+
+func TestRollbackNotTaken(t *testing.T) {
+	fmt.Printf("##################### Begin Device::%s #####################\n", "TestRollbackNotTaken")
+	defer fmt.Printf("###################### End Device::%s ######################\n", "TestRollbackNotTaken")
+
+	db, engine, router, teardown := newTestNode(t, "test_rollbackNotTaken.db", "A_Device")
+	defer teardown()
+	dev := database.PbDevice{Name: "A_Device"}
+	if err := dev.GetByName(db); err != nil {
+		t.Fatal(err)
+	}
+
+	author := &change.CMAuthor{Name: "tester", Email: "tester@iti.com"}
+	var target string
+	for _, c := range []string{"SET old", "SET current"} {
+		cfg := &change.ChangeData{ObjectType: change.DEVICE, Author: author, Content: change.NewCMContent(dev.Name)}
+		cfg.Content.Files["configFile"] = []byte(c)
+		commit, err := engine.VersionObject(cfg, "config")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if target == "" {
+			target = strings.Trim(commit, "\"")
+		}
+	}
+
+	defer func(f func(context.Context, int64, []byte) error) { configureDevice = f }(configureDevice)
+	rollback := func(refuse bool) int {
+		configureDevice = func(ctx context.Context, id int64, config []byte) error {
+			if refuse {
+				return errors.New("refused")
+			}
+			return nil
+		}
+		body, _ := json.Marshal(change.ChangeData{CommitID: target, Author: &change.CMAuthor{Name: "tester"},
+			Log: &change.LogLine{Message: "back to the old config"}})
+		req, err := http.NewRequest("POST", fmt.Sprintf("https://localhost:8080/device/%d/config/rollback", dev.Id), bytes.NewBuffer(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		writer := httptest.NewRecorder()
+		router.ServeHTTP(writer, req)
+		return writer.Code
+	}
+	current := func() string {
+		cd, err := engine.GetObject(change.DEVICE, dev.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(cd.Content.Files["configFile"])
+	}
+
+	// Master keeps the config the device kept
+	if code := rollback(true); code != http.StatusInternalServerError {
+		t.Errorf("Expected the rollback to fail, got %d", code)
+	}
+	if c := current(); c != "SET current" {
+		t.Errorf("Expected master to keep the current config, got %q", c)
+	}
+
+	if code := rollback(false); code != http.StatusOK {
+		t.Errorf("Expected the rollback applied, got %d", code)
+	}
+	if c := current(); c != "SET old" {
+		t.Errorf("Expected master to hold the old config, got %q", c)
+	}
+}
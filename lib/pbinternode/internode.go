@@ -264,7 +264,7 @@ func (a *InterNode) UpdateDeviceConfigUpstream(device database.PbDevice, cfg *ch
 		return false, nil
 	}
 	//AT THIS POINT THERE IS AN UPSTREAM NODE
-	jsonStr, err := json.Marshal(cfg)
+	jsonStr, err := json.Marshal(fromThisNode(cfg))
 	if err != nil {
 		a.log.Debug("UpdateDeviceConfigUpstream: Error marshaling device content to send upstream")
 		return false, err
@@ -296,7 +296,7 @@ func (a *InterNode) UpdateDeviceConfigDownstream(device database.PbDevice, cfg *
 	//reset ids to match the device ids downstream
 	device.Id = *downstreamDevId
 	device.ParentNode = parentId
-	jsonStr, err := json.Marshal(cfg)
+	jsonStr, err := json.Marshal(fromThisNode(cfg))
 	if err != nil {
 		a.log.Debug("UpdateDeviceDownstream: Error marshaling device content to send downstream")
 		return false
@@ -523,7 +523,7 @@ func (a *InterNode) GetUpstreamNodePolicies() ([]change.ChangeData, error) {
 // UpdatePolicyUpstream returns error as return value
 func (a *InterNode) UpdatePolicyUpstream(policy *change.ChangeData, upstreamNodeIP *string) error {
 	//AT THIS POINT WE ARE SURE WE HAVE AN UPSTREAM NODE
-	jsonStr, err := json.Marshal(policy)
+	jsonStr, err := json.Marshal(fromThisNode(policy))
 	if err != nil {
 		a.log.Debug("UpdatePolicyUpstream: Could not marshal policy to send upstream Error: %s", err.Error())
 		return err
@@ -538,6 +538,17 @@ func (a *InterNode) DeletePolicyUpstream(policyName string, upstreamNodeIP *stri
 }
 
 /********************************* Utility functions ***********************************************/
+// fromThisNode returns a copy of a change to forward to another node.  A
+// change that did not come from another node is marked as coming from this
+// one, so the receiving node can record where it originated.
+func fromThisNode(data *change.ChangeData) *change.ChangeData {
+	fwd := *data
+	if fwd.SrcNode == "" {
+		fwd.SrcNode = global.RootNode
+	}
+	return &fwd
+}
+
 func (a *InterNode) GetRootNode() (database.PbNode, error) {
 	node := database.PbNode{Name: global.RootNode}
 	err := node.GetByName(a.db)
@@ -608,6 +619,65 @@ func (a *InterNode) GetDownstreamNodeIP(nodeId int64) (string, error) {
 	return nodeIP, nil
 }
 
+// GetNodePath returns the names of the nodes from the top of the hierarchy down to this one.
+// The nodes above this one are learned from the upstream node on every heartbeat.
+func (a *InterNode) GetNodePath() ([]string, error) {
+	node, err := a.GetRootNode()
+	if err != nil {
+		return nil, err
+	}
+	cfgItem := database.PbNodeConfigItem{NodeId: node.Id, ConfigItem: database.ConfigItem{Key: "Upstream Path"}}
+	exists, err := cfgItem.Exists(a.db)
+	if err != nil {
+		a.log.Debug("GetNodePath: error checking existence of the upstream path: %s", err.Error())
+		return nil, err
+	}
+	path := make([]string, 0)
+	if exists {
+		if err := cfgItem.Get(a.db); err != nil {
+			a.log.Debug("GetNodePath: Could not recover the upstream path, got error: %s", err.Error())
+			return nil, err
+		}
+		if cfgItem.Value != "" {
+			path = strings.Split(cfgItem.Value, "/")
+		}
+	}
+	return append(path, node.Name), nil
+}
+
+// SetUpstreamPath records the path of the upstream node, as returned by its GetNodePath
+func (a *InterNode) SetUpstreamPath(path []string) error {
+	node, err := a.GetRootNode()
+	if err != nil {
+		return err
+	}
+	cfgItem := database.PbNodeConfigItem{NodeId: node.Id,
+		ConfigItem: database.ConfigItem{Key: "Upstream Path", Value: strings.Join(path, "/")}}
+	return cfgItem.CreateOrUpdate(a.db)
+}
+
+// GetDevicePath returns the path of the node a device belongs to.  Devices reported by a
+// child node are placed under that node; nodes further down are not known here.
+func (a *InterNode) GetDevicePath(device database.PbDevice) ([]string, error) {
+	path, err := a.GetNodePath()
+	if err != nil {
+		return nil, err
+	}
+	root, err := a.GetRootNode()
+	if err != nil {
+		return nil, err
+	}
+	if device.ParentNode == nil || *device.ParentNode == root.Id {
+		return path, nil
+	}
+	parent := database.PbNode{Id: *device.ParentNode}
+	if err = parent.Get(a.db); err != nil {
+		a.log.Debug("GetDevicePath: Could not recover the parent node of %s, got error: %s", device.Name, err.Error())
+		return nil, err
+	}
+	return append(path, parent.Name), nil
+}
+
 /********************************* internal functions ******************************************/
 func (a *InterNode) getRootIdAtIp(upstreamNodeIP string) (*int64, error) {
 	destUrl := "https://" + upstreamNodeIP + "/node"
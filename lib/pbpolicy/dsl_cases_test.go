@@ -34,14 +34,14 @@ var Cases = []DSLCase{
 }`,
 
 		// Result
-		`[{"Class":"SEL421","Axioms":[{"s":"password.level2","p":"min-length","o":"4"},{"s":"password.level2","p":"max-length","o":"16"},{"s":"password.level2","p":"complexity","o":"MIXEDCASE"},{"s":"SEL421","p":"requires","o":"password.level2"}]}]`,
+		`[{"Class":"SEL421","Axioms":[{"s":"password.level2","p":"min-length","o":"4","t":"int","v":4},{"s":"password.level2","p":"max-length","o":"16","t":"int","v":16},{"s":"password.level2","p":"complexity","o":"MIXEDCASE","t":"word","v":"MIXEDCASE"},{"s":"SEL421","p":"requires","o":"password.level2","t":"word","v":"password.level2"}]}]`,
 	},
 
 	{2, // Case 2
 		`SEL421 { password.level2 min-length 4 password.level2 max-length 16 password.level2 complexity MIXEDCASE requires password.level2 }`,
 
 		// Result
-		`[{"Class":"SEL421","Axioms":[{"s":"password.level2","p":"min-length","o":"4"},{"s":"password.level2","p":"max-length","o":"16"},{"s":"password.level2","p":"complexity","o":"MIXEDCASE"},{"s":"SEL421","p":"requires","o":"password.level2"}]}]`,
+		`[{"Class":"SEL421","Axioms":[{"s":"password.level2","p":"min-length","o":"4","t":"int","v":4},{"s":"password.level2","p":"max-length","o":"16","t":"int","v":16},{"s":"password.level2","p":"complexity","o":"MIXEDCASE","t":"word","v":"MIXEDCASE"},{"s":"SEL421","p":"requires","o":"password.level2","t":"word","v":"password.level2"}]}]`,
 	},
 
 	{3, // Case 3
@@ -50,14 +50,14 @@ var Cases = []DSLCase{
 }`,
 
 		// Result
-		`[{"Class":"SEL421","Axioms":[{"s":"password.level2","p":"min-length","o":"4"}]}]`,
+		`[{"Class":"SEL421","Axioms":[{"s":"password.level2","p":"min-length","o":"4","t":"int","v":4}]}]`,
 	},
 
 	{4, // Case 4
 		`SEL421 { password.level2 min-length 4 }`,
 
 		// Result
-		`[{"Class":"SEL421","Axioms":[{"s":"password.level2","p":"min-length","o":"4"}]}]`,
+		`[{"Class":"SEL421","Axioms":[{"s":"password.level2","p":"min-length","o":"4","t":"int","v":4}]}]`,
 	},
 
 	{5, // Case 5
@@ -71,14 +71,14 @@ var Cases = []DSLCase{
 		`SEL421 { one two three }`,
 
 		// Result
-		`[{"Class":"SEL421","Axioms":[{"s":"one","p":"two","o":"three"}]}]`,
+		`[{"Class":"SEL421","Axioms":[{"s":"one","p":"two","o":"three","t":"word","v":"three"}]}]`,
 	},
 
 	{7, // Case 7
 		`SEL421 { password.level2 min-length 4 }`,
 
 		// Result
-		`[{"Class":"SEL421","Axioms":[{"s":"password.level2","p":"min-length","o":"4"}]}]`,
+		`[{"Class":"SEL421","Axioms":[{"s":"password.level2","p":"min-length","o":"4","t":"int","v":4}]}]`,
 	},
 
 	{8, // Case 8
@@ -94,6 +94,77 @@ foo {
 	requires foobar
 }`,
 		// Result
-		`[{"Class":"SEL421","Axioms":[{"s":"password.level2","p":"min-length","o":"4"},{"s":"password.level2","p":"max-length","o":"16"},{"s":"password.level2","p":"complexity","o":"MIXEDCASE"},{"s":"SEL421","p":"requires","o":"password.level2"}]},{"Class":"foo","Axioms":[{"s":"one","p":"two","o":"three"},{"s":"four","p":"five","o":"six"},{"s":"foo","p":"requires","o":"foobar"}]}]`,
+		`[{"Class":"SEL421","Axioms":[{"s":"password.level2","p":"min-length","o":"4","t":"int","v":4},{"s":"password.level2","p":"max-length","o":"16","t":"int","v":16},{"s":"password.level2","p":"complexity","o":"MIXEDCASE","t":"word","v":"MIXEDCASE"},{"s":"SEL421","p":"requires","o":"password.level2","t":"word","v":"password.level2"}]},{"Class":"foo","Axioms":[{"s":"one","p":"two","o":"three","t":"word","v":"three"},{"s":"four","p":"five","o":"six","t":"word","v":"six"},{"s":"foo","p":"requires","o":"foobar","t":"word","v":"foobar"}]}]`,
 	},
+	{9, // Case 9
+		`# Typed values
+SEL421 {
+	password.level2.length >= 8 # inclusive
+	session.timeout <= 900
+	session.timeout != 0
+	port.5.speed = 9600
+	version.firmware > 1.5
+	banner.text equals "Authorized use only"
+}`,
+
+		// Result
+		`[{"Class":"SEL421","Axioms":[{"s":"password.level2.length","p":"\u003e=","o":"8","t":"int","v":8},{"s":"session.timeout","p":"\u003c=","o":"900","t":"int","v":900},{"s":"session.timeout","p":"!=","o":"0","t":"int","v":0},{"s":"port.5.speed","p":"==","o":"9600","t":"int","v":9600},{"s":"version.firmware","p":"\u003e","o":"1.5","t":"float","v":1.5},{"s":"banner.text","p":"equals","o":"Authorized use only","t":"string","v":"Authorized use only"}]}]`,
+	},
+
+	{10, // Case 10
+		`SEL421 {
+	service.telnet in [off, disabled]
+	password.level2.complexity in [MIXEDCASE, "MIXED CASE", 3]
+	hostname matches /^sub[0-9]+-relay$/
+	banner.text matches "^Authorized"
+	path matches /a\/b/
+	requires banner.text
+}`,
+
+		// Result
+		`[{"Class":"SEL421","Axioms":[{"s":"service.telnet","p":"in","o":"[off, disabled]","t":"set","v":["off","disabled"]},{"s":"password.level2.complexity","p":"in","o":"[MIXEDCASE, \"MIXED CASE\", 3]","t":"set","v":["MIXEDCASE","MIXED CASE",3]},{"s":"hostname","p":"matches","o":"^sub[0-9]+-relay$","t":"regex","v":"^sub[0-9]+-relay$"},{"s":"banner.text","p":"matches","o":"^Authorized","t":"regex","v":"^Authorized"},{"s":"path","p":"matches","o":"a/b","t":"regex","v":"a/b"},{"s":"SEL421","p":"requires","o":"banner.text","t":"word","v":"banner.text"}]}]`,
+	},
+
+	{11, // Case 11
+		`SEL421 under transmission where site == substation and firmware >= "R120.2" and zone in [east, west] and serial matches /^42/ {
+	password.level2.length >= 12
+}
+* where vendor = SEL severity high {
+	service.telnet == off
+}`,
+
+		// Result
+		`[{"Class":"SEL421","Under":"transmission","Where":[{"k":"site","op":"==","o":"substation","t":"word","v":"substation"},{"k":"firmware","op":"\u003e=","o":"R120.2","t":"string","v":"R120.2"},{"k":"zone","op":"in","o":"[east, west]","t":"set","v":["east","west"]},{"k":"serial","op":"matches","o":"^42","t":"regex","v":"^42"}],"Axioms":[{"s":"password.level2.length","p":"\u003e=","o":"12","t":"int","v":12}]},{"Class":"*","Where":[{"k":"vendor","op":"==","o":"SEL","t":"word","v":"SEL"}],"Severity":"high","Axioms":[{"s":"service.telnet","p":"==","o":"off","t":"word","v":"off"}]}]`,
+	},
+
+	{12, // Case 12
+		`# Keywords of a class header are words in the class
+SEL421 severity low {
+	severity == high
+	mode = under
+	logic in [and, or]
+	filter != where
+}`,
+
+		// Result
+		`[{"Class":"SEL421","Severity":"low","Axioms":[{"s":"severity","p":"==","o":"high","t":"word","v":"high"},{"s":"mode","p":"==","o":"under","t":"word","v":"under"},{"s":"logic","p":"in","o":"[and, or]","t":"set","v":["and","or"]},{"s":"filter","p":"!=","o":"where","t":"word","v":"where"}]}]`,
+	},
+}
+
+// Inputs that do not parse
+var BadCases = []string{
+	`SEL421 { password.level2 length >= MIXEDCASE }`,
+	`SEL421 { hostname matches /[/ }`,
+	`SEL421 { hostname matches [a, b] }`,
+	`SEL421 { banner.text equals "unterminated }`,
+	`SEL421 { service.telnet in [off, ] }`,
+	`SEL421 { port.speed < 99999999999999999999 }`,
+	`SEL421 { one two }`,
+	`SEL421 where { service.telnet == off }`,
+	`SEL421 where zone in east { service.telnet == off }`,
+	`SEL421 where zone near east { service.telnet == off }`,
+	`SEL421 where firmware > /1/ { service.telnet == off }`,
+	`SEL421 under { service.telnet == off }`,
+	`SEL421 severity dire { service.telnet == off }`,
+	`under { service.telnet == off }`,
 }
@@ -55,3 +55,11 @@ func dodsltests(input DSLCase) error {
 
 	return nil
 }
+
+func TestDSLErrors(t *testing.T) {
+	for _, c := range BadCases {
+		if _, err := policy.Parse(strings.NewReader(c)); err == nil {
+			t.Errorf("Parsed %s", c)
+		}
+	}
+}
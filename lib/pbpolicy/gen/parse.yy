@@ -15,23 +15,70 @@
 ***********************************************************************/
 
 %{
-// Do Not Edit:  go tool yacc -o parse.go gen/parse.yy
+// Do Not Edit:  goyacc -o parse.go gen/parse.yy
 package policy
 import  (
     "io"
     "bufio"
     "errors"
     "fmt"
+    "regexp"
+    "strconv"
+    "strings"
+    "sync"
 )
 
+// Types of the value of an axiom
+const (
+    TypeWord   = "word"
+    TypeInt    = "int"
+    TypeFloat  = "float"
+    TypeString = "string"
+    TypeRegex  = "regex"
+    TypeSet    = "set"
+)
+
+// Severities a class can give its rules, medium when it gives none
+const (
+    SeverityLow      = "low"
+    SeverityMedium   = "medium"
+    SeverityHigh     = "high"
+    SeverityCritical = "critical"
+)
+
+// The object of an axiom is always given as written in "o", for consumers
+// that only know about words, and typed in "t" and "v".  A value is an
+// int64, float64 or string, or a list of them for a set.
 type axiom struct {
     Subject string `json:"s"`
     Predicate string `json:"p"`
     Object string `json:"o"`
+    Type string `json:"t"`
+    Value interface{} `json:"v"`
+}
+
+type value struct {
+    Type string
+    Text string
+    Value interface{}
+}
+
+// A condition of a where clause, on a key of the metadata of a device
+type condition struct {
+    Key string `json:"k"`
+    Op string `json:"op"`
+    Object string `json:"o"`
+    Type string `json:"t"`
+    Value interface{} `json:"v"`
 }
 
+// A class names a device type, or * for any.  It can be limited to the
+// devices below a node and to those whose metadata meets every condition.
 type pol struct {
     Class string
+    Under string `json:",omitempty"`
+    Where []condition `json:",omitempty"`
+    Severity string `json:",omitempty"`
     Axioms []axiom
 }
 
@@ -43,30 +90,161 @@ func NewPolicy(name string) *pol {
 
 var ast []pol
 
+// First error found in the values of the input, which yacc does not check
+var parseErr error
+
+// The parser keeps its state in globals
+var parseLock sync.Mutex
+
 func Parse(s io.Reader) ([]pol, error) {
+    parseLock.Lock()
+    defer parseLock.Unlock()
+
     ast = make([]pol, 0)
+    parseErr = nil
+    CUR_CLASS = nil
     l := NewLexer(bufio.NewReader(s))
     retVal := yyParse(l)
     if retVal == 1 {
         return ast, errors.New("Got error parsing the input, need to abort")
     }
+    if parseErr != nil {
+        return ast, parseErr
+    }
     return ast, nil
 }
 
 var CUR_CLASS *pol
 
+var (
+    intWord   = regexp.MustCompile(`^-?[0-9]+$`)
+    floatWord = regexp.MustCompile(`^-?[0-9]+\.[0-9]+$`)
+)
+
+func valueError(yylex yyLexer, msg string) {
+    yylex.Error(msg)
+    if parseErr == nil {
+        parseErr = errors.New(msg)
+    }
+}
+
+// wordValue types a bare word as an integer, a decimal or a word
+func wordValue(yylex yyLexer, lit string) value {
+    switch {
+    case intWord.MatchString(lit):
+        i, err := strconv.ParseInt(lit, 10, 64)
+        if err != nil {
+            valueError(yylex, fmt.Sprintf("Integer %s is out of range", lit))
+        }
+        return value{Type: TypeInt, Text: lit, Value: i}
+    case floatWord.MatchString(lit):
+        f, _ := strconv.ParseFloat(lit, 64)
+        return value{Type: TypeFloat, Text: lit, Value: f}
+    }
+    return value{Type: TypeWord, Text: lit, Value: lit}
+}
+
+func stringValue(yylex yyLexer, lit string) value {
+    s, err := strconv.Unquote(lit)
+    if err != nil {
+        valueError(yylex, fmt.Sprintf("Bad string %s", lit))
+    }
+    return value{Type: TypeString, Text: s, Value: s}
+}
+
+// regexValue takes a pattern written between slashes, or the text of a
+// string or word given to matches
+func regexValue(yylex yyLexer, src string) value {
+    if _, err := regexp.Compile(src); err != nil {
+        valueError(yylex, fmt.Sprintf("Bad regular expression %s: %s", src, err.Error()))
+    }
+    return value{Type: TypeRegex, Text: src, Value: src}
+}
+
+func setValue(items []value) value {
+    text := make([]string, len(items))
+    values := make([]interface{}, len(items))
+    for i, v := range items {
+        text[i] = v.Text
+        if v.Type == TypeString {
+            text[i] = strconv.Quote(v.Text)
+        }
+        values[i] = v.Value
+    }
+    return value{Type: TypeSet, Text: "[" + strings.Join(text, ", ") + "]", Value: values}
+}
+
+func newCondition(yylex yyLexer, key, op string, v value) condition {
+    switch op {
+    case "=":
+        op = "=="
+    case "in":
+        if v.Type != TypeSet {
+            valueError(yylex, fmt.Sprintf("where %s in needs a set, not %s", key, v.Text))
+        }
+    case "matches":
+        if v.Type == TypeSet {
+            valueError(yylex, fmt.Sprintf("where %s matches a set", key))
+        } else if v.Type != TypeRegex {
+            v = regexValue(yylex, v.Text)
+        }
+    case "==", "!=":
+    case "<", "<=", ">", ">=":
+        if v.Type == TypeSet || v.Type == TypeRegex {
+            valueError(yylex, fmt.Sprintf("where %s %s needs a number or version, not %s", key, op, v.Text))
+        }
+    default:
+        valueError(yylex, fmt.Sprintf("Unknown operator %s in where %s", op, key))
+    }
+    return condition{Key: key, Op: op, Object: v.Text, Type: v.Type, Value: v.Value}
+}
+
+func addAxiom(subject, predicate string, v value) {
+    if CUR_CLASS == nil {
+        fmt.Println("Error Here")
+        return
+    }
+    CUR_CLASS.Axioms = append(CUR_CLASS.Axioms, axiom{
+        Subject: subject,
+        Predicate: predicate,
+        Object: v.Text,
+        Type: v.Type,
+        Value: v.Value,
+    })
+}
+
 %}
 
 %union {
     lit string
+    val value
+    vals []value
+    cond condition
+    conds []condition
 }
 
 
-%token TOKCOMMENT
 %token TOKLBRACE
 %token TOKRBRACE
-%token TOKREQUIRE
-%token TOKWORD
+%token TOKLBRACKET
+%token TOKRBRACKET
+%token TOKCOMMA
+%token <lit> TOKOP
+%token <lit> TOKREQUIRE
+%token <lit> TOKSTRING
+%token <lit> TOKREGEX
+%token <lit> TOKWORD
+%token <lit> TOKANY
+%token TOKUNDER
+%token TOKWHERE
+%token TOKAND
+%token TOKSEVERITY
+
+%type <val> value item
+%type <vals> items
+%type <lit> class_name under severity
+%type <conds> where conditions
+%type <cond> condition
 
 %%
 
@@ -84,16 +262,84 @@ class:
       ;
 
 class_start:
-            TOKWORD TOKLBRACE
+            class_name under where severity TOKLBRACE
             {
               if CUR_CLASS != nil {
                 fmt.Println("There's an error here")
               } else {
-                CUR_CLASS = NewPolicy($1.lit)
+                CUR_CLASS = NewPolicy($1)
+                CUR_CLASS.Under = $2
+                CUR_CLASS.Where = $3
+                CUR_CLASS.Severity = $4
               }
             }
             ;
 
+class_name:
+          TOKWORD
+          | TOKANY
+          ;
+
+under:
+     /* empty */
+     {
+        $$ = ""
+     }
+     | TOKUNDER TOKWORD
+     {
+        $$ = $2
+     }
+     ;
+
+where:
+     /* empty */
+     {
+        $$ = nil
+     }
+     | TOKWHERE conditions
+     {
+        $$ = $2
+     }
+     ;
+
+severity:
+        /* empty */
+        {
+            $$ = ""
+        }
+        | TOKSEVERITY TOKWORD
+        {
+            switch $2 {
+            case SeverityLow, SeverityMedium, SeverityHigh, SeverityCritical:
+            default:
+                valueError(yylex, fmt.Sprintf("Unknown severity %s", $2))
+            }
+            $$ = $2
+        }
+        ;
+
+conditions:
+          condition
+          {
+            $$ = []condition{$1}
+          }
+          | conditions TOKAND condition
+          {
+            $$ = append($1, $3)
+          }
+          ;
+
+condition:
+         TOKWORD TOKOP value
+         {
+            $$ = newCondition(yylex, $1, $2, $3)
+         }
+         | TOKWORD TOKWORD value
+         {
+            $$ = newCondition(yylex, $1, $2, $3)
+         }
+         ;
+
 axioms:
       axioms axiom
       | axiom
@@ -101,21 +347,35 @@ axioms:
 
 axiom:
      std_axiom
+     | op_axiom
      | require_axiom
      ;
 
 std_axiom:
-      TOKWORD TOKWORD TOKWORD
+      TOKWORD TOKWORD value
       {
-        if CUR_CLASS == nil {
-            fmt.Println("Error Here")
-        } else {
-            CUR_CLASS.Axioms = append(CUR_CLASS.Axioms, axiom{
-                Subject: $1.lit,
-                Predicate: $2.lit,
-                Object: $3.lit,
-            })
+        v := $3
+        if $2 == "matches" && v.Type != TypeRegex {
+            if v.Type == TypeSet {
+                valueError(yylex, fmt.Sprintf("%s matches a set", $1))
+            }
+            v = regexValue(yylex, v.Text)
+        }
+        addAxiom($1, $2, v)
+      }
+      ;
+
+op_axiom:
+      TOKWORD TOKOP value
+      {
+        op := $2
+        if op == "=" {
+            op = "=="
         }
+        if (op != "==" && op != "!=") && $3.Type != TypeInt && $3.Type != TypeFloat {
+            valueError(yylex, fmt.Sprintf("%s %s needs a number, not %s", $1, op, $3.Text))
+        }
+        addAxiom($1, op, $3)
       }
       ;
 
@@ -125,14 +385,48 @@ require_axiom:
         if CUR_CLASS == nil {
             fmt.Println("Error Here")
         } else {
-            CUR_CLASS.Axioms = append(CUR_CLASS.Axioms, axiom{
-                Subject: CUR_CLASS.Class,
-                Predicate: "requires",
-                Object: $2.lit,
-            })
+            addAxiom(CUR_CLASS.Class, "requires", value{Type: TypeWord, Text: $2, Value: $2})
         }
       }
       ;
 
-%%
+value:
+     item
+     | TOKREGEX
+     {
+        src := strings.Replace($1[1:len($1)-1], `\/`, "/", -1)
+        $$ = regexValue(yylex, src)
+     }
+     | TOKLBRACKET items TOKRBRACKET
+     {
+        $$ = setValue($2)
+     }
+     | TOKLBRACKET TOKRBRACKET
+     {
+        $$ = setValue(nil)
+     }
+     ;
+
+items:
+     item
+     {
+        $$ = []value{$1}
+     }
+     | items TOKCOMMA item
+     {
+        $$ = append($1, $3)
+     }
+     ;
 
+item:
+    TOKWORD
+    {
+        $$ = wordValue(yylex, $1)
+    }
+    | TOKSTRING
+    {
+        $$ = stringValue(yylex, $1)
+    }
+    ;
+
+%%
@@ -63,6 +63,7 @@ func (a *PolicyHandler) AddAPIEndpoints(router *mux.Router) {
 		s.HandleFunc("/", a.handleBaseRoute).Methods("GET", "POST", "HEAD")
 		s.HandleFunc("/all", a.handleGetAll).Methods("GET")
 		s.HandleFunc("/default/{nodename}", a.handleDefaultRoute).Methods("HEAD")
+		s.HandleFunc("/effective/{devicename}", a.handleEffectiveRoute).Methods("GET")
 		s.HandleFunc("/{policyname}", a.handleWIdRoute).Methods("GET", "PUT", "DELETE")
 		s.HandleFunc("/{devid}/validate", a.handleWIdValidateRoute)
 		s.HandleFunc("/{devid}/validate/{valid}", a.handleWIdValidateStatusRoute)
@@ -132,6 +133,10 @@ func (a *PolicyHandler) headBaseHandler(resp *logging.ResponseLogger, req *http.
 	}
 	commitId := changeEng.GetLatestCommitID(change.POLICY)
 	resp.Header().Set("X-Pbconf-Policy-LastCommitId", commitId)
+	// Let the child know where it sits in the hierarchy, for policies scoped to nodes
+	if path, err := nodeComm.GetNodePath(); err == nil {
+		resp.Header().Set("X-Pbconf-Node-Path", strings.Join(path, "/"))
+	}
 	resp.WriteHeader(http.StatusOK)
 }
 
@@ -267,9 +272,70 @@ func (a *PolicyHandler) headDefaultHandler(resp *logging.ResponseLogger, req *ht
 	}
 	commitId := changeEng.GetLatestCommitID(change.POLICY)
 	resp.Header().Set("X-Pbconf-Policy-LastCommitId", commitId)
+	// Let the child know where it sits in the hierarchy, for policies scoped to nodes
+	if path, err := nodeComm.GetNodePath(); err == nil {
+		resp.Header().Set("X-Pbconf-Node-Path", strings.Join(path, "/"))
+	}
 	resp.WriteHeader(http.StatusOK)
 }
 
+// handleEffectiveRoute returns the policy rules that apply to a device once scopes,
+// conditions and overrides are resolved
+func (a *PolicyHandler) handleEffectiveRoute(writer http.ResponseWriter, req *http.Request) {
+	//deal with any version in the URL or Accept header
+	version, err := global.ProcessVersioning(req)
+	if err != nil {
+		a.log.Debug("Versioning: %s", err.Error())
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if version != nil && *version > a.Version {
+		a.log.Debug("Version %v not implemented, current version is %v", *version, a.Version)
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+	resp := &logging.ResponseLogger{
+		ResponseWriter: writer,
+		Logger:         a.log,
+		SrcNodeName:    global.RootNode,
+	}
+
+	device := database.PbDevice{Name: mux.Vars(req)["devicename"]}
+	if err = device.GetByName(a.db); err != nil {
+		resp.WriteLog(http.StatusNotFound, "Info", "GET /policy/effective/{devicename}::No device named %s", device.Name)
+		return
+	}
+	changeEng, err := change.GetCMEngine(nil)
+	if err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Notice", "Could not get handle to change management engine. Error:%s", err.Error())
+		return
+	}
+	target, err := DeviceTarget(changeEng, nodeComm, device)
+	if err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Notice", "GET /policy/effective/{devicename}::Could not describe device %s, Error: %s", device.Name, err.Error())
+		return
+	}
+	policies, err := LoadPolicies(changeEng)
+	if err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Notice", "GET /policy/effective/{devicename}::Could not load the policies, Error: %s", err.Error())
+		return
+	}
+
+	effective := struct {
+		Target
+		Rules []Rule
+	}{target, Resolve(policies, target)}
+	jsonStr, err := json.Marshal(effective)
+	if err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Notice", "GET /policy/effective/{devicename}::Could not marshal the rules, Error: %s", err.Error())
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	if _, err = writer.Write(jsonStr); err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Notice", "GET /policy/effective/{devicename}::Writing response body Error: %s", err.Error())
+	}
+}
+
 func (a *PolicyHandler) handleWIdRoute(writer http.ResponseWriter, req *http.Request) {
 	//deal with any version in the URL or Accept header
 	version, err := global.ProcessVersioning(req)
@@ -358,15 +424,21 @@ func (a *PolicyHandler) putPolicyHierarchy(policy *change.ChangeData, resp *logg
 		resp.WriteLog(http.StatusBadRequest, "Notice", "PUT /Policy::Could not get instance of change management engine. Cannot proceed")
 		return
 	}
-	policy.TransactionID, err = engine.BeginTransaction(policy, policy.Log.Message)
+	upstreamNodeIP, err := nodeComm.GetUpstreamNodeIP()
 	if err != nil {
-		resp.WriteLog(http.StatusBadRequest, "Notice", "PUT /Policy::BeginTransaction error: %s", err.Error())
+		resp.WriteLog(http.StatusBadRequest, "Warning", "PUT /Policy::Error retrieving IP Address of the upstream node. Cannot proceed")
 		return
 	}
 
-	upstreamNodeIP, err := nodeComm.GetUpstreamNodeIP()
+	// Policies are reviewed on the master node only
+	if engine.RequireApproval && upstreamNodeIP == nil {
+		a.proposePolicy(policy, engine, resp)
+		return
+	}
+
+	policy.TransactionID, err = engine.BeginTransaction(policy, policy.Log.Message)
 	if err != nil {
-		resp.WriteLog(http.StatusBadRequest, "Warning", "PUT /Policy::Error retrieving IP Address of the upstream node. Cannot proceed")
+		resp.WriteLog(http.StatusBadRequest, "Notice", "PUT /Policy::BeginTransaction error: %s", err.Error())
 		return
 	}
 	// now the logic
@@ -391,6 +463,14 @@ func (a *PolicyHandler) putPolicyHierarchy(policy *change.ChangeData, resp *logg
 		if err != nil {
 			if strings.HasPrefix(err.Error(), global.NoConnection) || strings.HasPrefix(err.Error(), global.NoHttpOK) {
 				//connection error, we are now master
+				if engine.RequireApproval {
+					// The forwarding transaction never got anywhere, the
+					// change is reviewed here in its own
+					engine.FinalizeTransaction(policy, change.FAILED)
+					policy.TransactionID = ""
+					a.proposePolicy(policy, engine, resp)
+					return
+				}
 				validated, explanation, err := ValidateAgainstOntology(a.log, policy)
 				if err != nil {
 					a.log.Debug(explanation)
@@ -415,6 +495,73 @@ func (a *PolicyHandler) putPolicyHierarchy(policy *change.ChangeData, resp *logg
 	resp.WriteHeader(http.StatusOK)
 }
 
+// proposePolicy validates the policy and holds it on a transaction branch
+// until it is approved through the changes API
+func (a *PolicyHandler) proposePolicy(policy *change.ChangeData, engine *change.CMEngine, resp *logging.ResponseLogger) {
+	validated, explanation, err := ValidateAgainstOntology(a.log, policy)
+	if err != nil {
+		a.log.Debug(explanation)
+		resp.WriteLog(http.StatusBadRequest, "Notice", "PUT /Policy::Error trying to validate. Error:%s", err.Error())
+		return
+	}
+	if !validated {
+		resp.WriteLog(http.StatusBadRequest, "Notice", "PUT /Policy::Could not validate policy. Explanation:%s", explanation)
+		return
+	}
+
+	transID, err := engine.ProposeChange(policy, policy.Log.Message)
+	if err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Notice", "PUT /Policy::Could not propose the change, error: %s", err.Error())
+		return
+	}
+
+	jsonStr, err := json.Marshal(struct{ TransactionID string }{transID})
+	if err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "PUT /Policy::Could not marshal the change request Error: %s", err.Error())
+		return
+	}
+	a.log.Info("PUT /Policy::Change request %s awaits review", transID)
+	resp.WriteHeader(http.StatusAccepted)
+	resp.Write(jsonStr)
+}
+
+// removalRequest is the body of a DELETE when removals need approval
+type removalRequest struct {
+	Author  string
+	Message string
+}
+
+// proposeRemoval holds the removal of a policy on a transaction branch until
+// it is approved through the changes API.  The body names who asks for it.
+func (a *PolicyHandler) proposeRemoval(policyName string, engine *change.CMEngine, resp *logging.ResponseLogger, req *http.Request) {
+	var rr removalRequest
+	if err := json.NewDecoder(req.Body).Decode(&rr); err != nil || rr.Author == "" {
+		resp.WriteLog(http.StatusBadRequest, "Notice", "DELETE /Policy::Removals are reviewed, the request must name its author")
+		return
+	}
+	user := database.PbUser{Name: rr.Author}
+	if err := user.GetByName(a.db); err != nil {
+		resp.WriteLog(http.StatusForbidden, "Info", "DELETE /Policy::Unknown user %s", rr.Author)
+		return
+	}
+
+	author := &change.CMAuthor{Name: user.Name, Email: user.Email, When: time.Now()}
+	transID, err := engine.ProposeRemoval(change.POLICY, policyName, author, rr.Message)
+	if err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Notice", "DELETE /Policy::Could not propose the removal, error: %s", err.Error())
+		return
+	}
+
+	jsonStr, err := json.Marshal(struct{ TransactionID string }{transID})
+	if err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "DELETE /Policy::Could not marshal the change request Error: %s", err.Error())
+		return
+	}
+	a.log.Info("DELETE /Policy::Change request %s awaits review", transID)
+	resp.WriteHeader(http.StatusAccepted)
+	resp.Write(jsonStr)
+}
+
 func (a *PolicyHandler) deletePolicyHierarchy(policyName string, resp *logging.ResponseLogger, req *http.Request) {
 	engine, err := change.GetCMEngine(nil)
 	if err != nil {
@@ -427,6 +574,11 @@ func (a *PolicyHandler) deletePolicyHierarchy(policyName string, resp *logging.R
 		resp.WriteLog(http.StatusBadRequest, "Warning", "DELETE /Policy::Error retrieving IP Address of the upstream node. Cannot proceed")
 		return
 	}
+	// Removals are reviewed on the master node only
+	if engine.RequireApproval && upstreamNodeIP == nil {
+		a.proposeRemoval(policyName, engine, resp, req)
+		return
+	}
 	// now the logic
 	if upstreamNodeIP == nil { //if we are the master node
 		// at this point go ahead and delete the policy in the git repository. The heartbeat system will handle sending it down
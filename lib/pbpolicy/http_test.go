@@ -27,6 +27,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -751,6 +752,32 @@ func TestDeleteWIdHandler(t *testing.T) {
 	if writer.Code != http.StatusOK {
 		testingError(t, test, "Did not get StatusOK, version is now not 1?")
 	}
+
+	//with approval required, a removal is only proposed
+	cmEngine.RequireApproval = true
+	defer func() { cmEngine.RequireApproval = false }()
+	user := pbdatabase.PbUser{Name: "tester", Email: "tester@iti.com"}
+	if err = user.Create(dbHandle); err != nil {
+		testingError(t, test, "setup user: %s", err.Error())
+	}
+	req = createNewRequest(t, "DELETE", "https://localhost:8080/policy/Policy A", strings.NewReader("{}"))
+	writer = httptest.NewRecorder()
+	muxRouter.ServeHTTP(writer, req)
+	if writer.Code != http.StatusBadRequest {
+		testingError(t, test, "Removal without an author was not refused, got %d", writer.Code)
+	}
+	req = createNewRequest(t, "DELETE", "https://localhost:8080/policy/Policy A", strings.NewReader(`{"Author": "tester"}`))
+	writer = httptest.NewRecorder()
+	muxRouter.ServeHTTP(writer, req)
+	if writer.Code != http.StatusAccepted {
+		testingError(t, test, "Expected the removal to await review, got %d", writer.Code)
+	}
+	if policies, _ = cmEngine.ListObjects(change.POLICY); len(policies) != 1 {
+		testingError(t, test, "Removal reached the repository before review: %v", policies)
+	}
+	if len(cmEngine.ChangeRequests()) != 1 {
+		testingError(t, test, "Expected one change request, have %v", cmEngine.ChangeRequests())
+	}
 }
 
 func TestPutWIdHandler(t *testing.T) {
@@ -0,0 +1,321 @@
+package policy
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	change "github.com/iti/pbconf/lib/pbchange"
+	database "github.com/iti/pbconf/lib/pbdatabase"
+	internode "github.com/iti/pbconf/lib/pbinternode"
+)
+
+// Policy is a policy object as parsed from its rules
+type Policy struct {
+	Name    string
+	Classes []pol
+}
+
+// Target is a device as policies see it
+type Target struct {
+	Device string
+	Type   string            // The driver of the device
+	Meta   map[string]string // The metadata of the device
+	Path   []string          // The nodes above the device, from the top of the hierarchy down
+}
+
+// Rule is an axiom of a policy that applies to a target
+type Rule struct {
+	axiom
+	Policy   string
+	Class    string
+	Under    string      `json:",omitempty"`
+	Where    []condition `json:",omitempty"`
+	Severity string
+}
+
+/*
+LoadPolicies parses every policy in the repository, in order of name.  All
+nodes hold the same policies, as they are pulled from the upstream node.
+*/
+func LoadPolicies(engine *change.CMEngine) ([]Policy, error) {
+	names, err := engine.ListObjects(change.POLICY)
+	if err != nil {
+		if _, ok := err.(change.CMNoRepoError); ok {
+			return []Policy{}, nil
+		}
+		return nil, err
+	}
+	sort.Strings(names)
+
+	policies := make([]Policy, 0, len(names))
+	for _, name := range names {
+		p, err := engine.GetObject(change.POLICY, name)
+		if err != nil {
+			return nil, err
+		}
+		classes, err := Parse(bytes.NewReader(p.Content.Files["Rules"]))
+		if err != nil {
+			return nil, fmt.Errorf("Policy %s: %s", name, err.Error())
+		}
+		policies = append(policies, Policy{Name: name, Classes: classes})
+	}
+	return policies, nil
+}
+
+// DeviceTarget describes a device from its metadata on master and its place
+// in the node hierarchy
+func DeviceTarget(engine *change.CMEngine, nc *internode.InterNode, device database.PbDevice) (Target, error) {
+	meta, err := engine.GetMetaAt(device.Name, "master")
+	if err != nil {
+		return Target{}, err
+	}
+	path, err := nc.GetDevicePath(device)
+	if err != nil {
+		return Target{}, err
+	}
+	return Target{Device: device.Name, Type: meta["driver"], Meta: meta, Path: path}, nil
+}
+
+/*
+Resolve returns the rules of the policies that apply to a target.  A class
+applies if it names the type of the target or is *, its node is on the path
+of the target, and the metadata of the target meets all its conditions.
+
+Rules on the same subject and predicate override one another.  The rule of
+the class scoped to the deepest node wins, then that of a class naming the
+device type over *, then that of the class with the most conditions.  Left
+with a tie, the rule that comes last wins, so a policy can restate what an
+earlier one says.  Every requires rule is kept.
+*/
+func Resolve(policies []Policy, t Target) []Rule {
+	type ranked struct {
+		rule Rule
+		rank [3]int
+	}
+	rules := make([]ranked, 0)
+	index := make(map[string]int)
+
+	for _, p := range policies {
+		for _, c := range p.Classes {
+			depth, ok := c.applies(t)
+			if !ok {
+				continue
+			}
+			rank := [3]int{depth, 0, len(c.Where)}
+			if c.Class != "*" {
+				rank[1] = 1
+			}
+			for _, a := range c.Axioms {
+				r := ranked{
+					rule: Rule{axiom: a, Policy: p.Name, Class: c.Class, Under: c.Under, Where: c.Where, Severity: c.Severity},
+					rank: rank,
+				}
+				if r.rule.Severity == "" {
+					r.rule.Severity = SeverityMedium
+				}
+				key := a.Subject + "\x00" + a.Predicate
+				if a.Predicate == "requires" {
+					key += "\x00" + a.Object
+				}
+				i, seen := index[key]
+				if !seen {
+					index[key] = len(rules)
+					rules = append(rules, r)
+				} else if !outranks(rules[i].rank, rank) {
+					rules[i] = r
+				}
+			}
+		}
+	}
+
+	resolved := make([]Rule, len(rules))
+	for i, r := range rules {
+		resolved[i] = r.rule
+	}
+	return resolved
+}
+
+func outranks(a, b [3]int) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] > b[i]
+		}
+	}
+	return false
+}
+
+// applies tells if a class covers a target and, if so, how far down the
+// path of the target its scope starts
+func (c pol) applies(t Target) (int, bool) {
+	if c.Class != "*" && c.Class != t.Type {
+		return 0, false
+	}
+	depth := 0
+	if c.Under != "" {
+		for i, n := range t.Path {
+			if n == c.Under {
+				depth = i + 1
+			}
+		}
+		if depth == 0 {
+			return 0, false
+		}
+	}
+	for _, w := range c.Where {
+		if !w.holds(t.Meta) {
+			return 0, false
+		}
+	}
+	return depth, true
+}
+
+// holds tells if metadata meets a condition.  A condition on a key the
+// device does not have fails, whatever its operator.
+func (w condition) holds(meta map[string]string) bool {
+	have, ok := meta[w.Key]
+	if !ok {
+		return false
+	}
+	return Satisfies(have, w.Op, w.Type, w.Value)
+}
+
+/*
+Satisfies tells if a value, as a device has it, stands in relation op to the
+typed value of a rule or condition: one of == != < <= > >= in matches.
+Numbers compare as numbers; other values are ordered as versions, a part at
+a time, so a version with two parts such as 2.10 is quoted in a policy to
+keep it from being taken as a decimal.
+*/
+func Satisfies(have, op, t string, v interface{}) bool {
+	switch op {
+	case "==":
+		return equals(have, t, v)
+	case "!=":
+		return !equals(have, t, v)
+	case "in":
+		items, _ := v.([]interface{})
+		for _, item := range items {
+			if equals(have, itemType(item), item) {
+				return true
+			}
+		}
+		return false
+	case "matches":
+		re, err := regexp.Compile(fmt.Sprint(v))
+		return err == nil && re.MatchString(have)
+	}
+
+	var cmp int
+	switch t {
+	case TypeInt, TypeFloat:
+		n, err := strconv.ParseFloat(have, 64)
+		if err != nil {
+			return false
+		}
+		cmp = compareFloats(n, toFloat(v))
+	case TypeSet, TypeRegex:
+		return false
+	default:
+		cmp = CompareVersions(have, fmt.Sprint(v))
+	}
+	switch op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+func equals(have, t string, v interface{}) bool {
+	switch t {
+	case TypeInt, TypeFloat:
+		n, err := strconv.ParseFloat(have, 64)
+		return err == nil && n == toFloat(v)
+	}
+	return have == fmt.Sprint(v)
+}
+
+func itemType(v interface{}) string {
+	switch v.(type) {
+	case int64:
+		return TypeInt
+	case float64:
+		return TypeFloat
+	}
+	return TypeString
+}
+
+func toFloat(v interface{}) float64 {
+	switch n := v.(type) {
+	case int64:
+		return float64(n)
+	case float64:
+		return n
+	}
+	return 0
+}
+
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+var versionSeparators = regexp.MustCompile(`[^a-zA-Z0-9]+`)
+
+/*
+CompareVersions orders two version strings, such as firmware revisions.
+They are split on anything but letters and digits and compared a part at a
+time, numerically where both parts are numbers.  A version that runs out of
+parts first is the lower one.
+*/
+func CompareVersions(a, b string) int {
+	pa := versionSeparators.Split(strings.Trim(a, " "), -1)
+	pb := versionSeparators.Split(strings.Trim(b, " "), -1)
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		na, erra := strconv.ParseUint(pa[i], 10, 64)
+		nb, errb := strconv.ParseUint(pb[i], 10, 64)
+		if erra == nil && errb == nil {
+			switch {
+			case na < nb:
+				return -1
+			case na > nb:
+				return 1
+			}
+			continue
+		}
+		if c := strings.Compare(pa[i], pb[i]); c != 0 {
+			return c
+		}
+	}
+	return compareFloats(float64(len(pa)), float64(len(pb)))
+}
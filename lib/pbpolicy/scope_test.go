@@ -0,0 +1,137 @@
+package policy_test
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/iti/pbconf/lib/pbpolicy"
+)
+
+func parsePolicy(t *testing.T, name, rules string) policy.Policy {
+	classes, err := policy.Parse(strings.NewReader(rules))
+	if err != nil {
+		t.Fatalf("%s: %s", name, err.Error())
+	}
+	return policy.Policy{Name: name, Classes: classes}
+}
+
+func TestResolve(t *testing.T) {
+	fmt.Printf("================= Begin TestResolve ==================\n")
+	defer fmt.Printf("================= End TestResolve ==================\n")
+
+	policies := []policy.Policy{
+		parsePolicy(t, "a-base", `SEL421 {
+	password.level2.length >= 8
+	session.timeout <= 900
+	requires password.level2
+}
+* {
+	service.telnet == off
+}`),
+		parsePolicy(t, "b-sites", `SEL421 under transmission {
+	password.level2.length >= 12
+}
+* under transmission where site == substation {
+	service.telnet == disabled
+}
+SEL421 under east {
+	password.level2.length >= 10
+}`),
+		parsePolicy(t, "c-firmware", `SEL421 where firmware < "R120.10" and zone in [east, west] {
+	session.timeout <= 300
+	requires session.timeout
+}`),
+	}
+
+	target := policy.Target{
+		Device: "relay",
+		Type:   "SEL421",
+		Meta:   map[string]string{"site": "substation", "firmware": "R120.9", "zone": "west"},
+		Path:   []string{"master", "transmission", "east"},
+	}
+	check := func(rules []policy.Policy, tg policy.Target, want map[string]string) {
+		got := make(map[string]string)
+		for _, r := range policy.Resolve(rules, tg) {
+			got[r.Subject+" "+r.Predicate+" "+r.Object] = r.Policy
+		}
+		if len(got) != len(want) {
+			t.Errorf("Resolved %v, expected %v", got, want)
+			return
+		}
+		for k, v := range want {
+			if got[k] != v {
+				t.Errorf("Rule %s from %q, expected %q", k, got[k], v)
+			}
+		}
+	}
+
+	// The deepest node wins, and conditions make a rule more specific
+	check(policies, target, map[string]string{
+		"password.level2.length >= 10":    "b-sites",
+		"session.timeout <= 300":          "c-firmware",
+		"SEL421 requires password.level2": "a-base",
+		"SEL421 requires session.timeout": "c-firmware",
+		"service.telnet == disabled":      "b-sites",
+	})
+
+	// Outside the transmission subtree, on newer firmware
+	target.Path = []string{"master", "distribution"}
+	target.Meta["firmware"] = "R120.10"
+	check(policies, target, map[string]string{
+		"password.level2.length >= 8":     "a-base",
+		"session.timeout <= 900":          "a-base",
+		"SEL421 requires password.level2": "a-base",
+		"service.telnet == off":           "a-base",
+	})
+
+	// Other device types only get what applies to any
+	target.Type = "SEL351"
+	target.Path = []string{"master", "transmission"}
+	check(policies, target, map[string]string{
+		"service.telnet == disabled": "b-sites",
+	})
+
+	// A later policy restates an earlier one at the same scope
+	policies = append(policies, parsePolicy(t, "d-restate", `* {
+	service.telnet == no
+}`))
+	delete(target.Meta, "site")
+	check(policies, target, map[string]string{
+		"service.telnet == no": "d-restate",
+	})
+}
+
+func TestCompareVersions(t *testing.T) {
+	cases := []struct {
+		a, b string
+		cmp  int
+	}{
+		{"1.2", "1.10", -1},
+		{"R120.10", "R120.9", 1},
+		{"2.0", "2.0", 0},
+		{"2.0", "2.0.1", -1},
+		{"R120-V2", "R121-V1", -1},
+	}
+	for _, c := range cases {
+		if cmp := policy.CompareVersions(c.a, c.b); cmp != c.cmp {
+			t.Errorf("CompareVersions(%s, %s) = %d, expected %d", c.a, c.b, cmp, c.cmp)
+		}
+	}
+}
@@ -29,6 +29,7 @@ import (
 	database "github.com/iti/pbconf/lib/pbdatabase"
 	global "github.com/iti/pbconf/lib/pbglobal"
 	logging "github.com/iti/pbconf/lib/pblogger"
+	trans "github.com/iti/pbconf/lib/pbtranslate"
 	validator "gopkg.in/validator.v2"
 )
 
@@ -54,8 +55,15 @@ func (a *APIHandler) AddAPIEndpoints(router *mux.Router) {
 		s.HandleFunc("/", a.handleBaseRoute).Methods("GET", "POST", "HEAD")
 		s.HandleFunc("/{reportid}", a.handleWIdRoute).Methods("GET", "PUT", "DELETE")
 		s.HandleFunc("/report/{reportid}", a.handleWIdReportContent).Methods("GET")
+		s.HandleFunc("/diff/{from}/{to}", a.handleConfigDiff).Methods("GET")
+		s.HandleFunc("/signatures/{repo}", a.handleSignatures).Methods("GET")
+		s.HandleFunc("/repository/{repo}", a.handleRepoStats).Methods("GET")
 	}
 	a.startPeriodicReportTimers()
+
+	if engine, err := change.GetCMEngine(nil); err == nil {
+		engine.RegisterRetention(change.REPORT, a.reportRetention)
+	}
 }
 
 func (a *APIHandler) GetInfo() (string, int) {
@@ -78,6 +86,9 @@ func (a *APIHandler) startPeriodicReportTimers() {
 			a.log.Debug("startPeriodicReportTimers::CME Getting object Error: %s", err.Error())
 			return
 		}
+		if len(chData.Content.Files["queryFile"]) == 0 { //Not a query, such as the compliance report
+			continue
+		}
 		var savedQuery PbReportQuery
 		decoder := json.NewDecoder(bytes.NewBuffer(chData.Content.Files["queryFile"]))
 		if err = decoder.Decode(&savedQuery); err != nil {
@@ -170,6 +181,10 @@ func (a *APIHandler) postBaseHandler(resp *logging.ResponseLogger, req *http.Req
 		resp.WriteLog(http.StatusBadRequest, "Notice", "POST /reports::validation error: %s", err.Error())
 		return
 	}
+	if _, err = query.Retention(); err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Notice", "POST /reports::validation error: %s", err.Error())
+		return
+	}
 	//check if new query can be run successfully
 	if _, err = ParseQuery(strings.NewReader(query.Query)); err != nil {
 		resp.WriteLog(http.StatusBadRequest, "Debug", "POST /reports:: Could not parse the query successfully, Error:%s", err.Error())
@@ -294,6 +309,10 @@ func (a *APIHandler) putWIdRouteHandler(resp *logging.ResponseLogger, req *http.
 		resp.WriteLog(http.StatusBadRequest, "Notice", "PUT /reports/{reportid}::validation error: %s", err.Error())
 		return
 	}
+	if _, err = query.Retention(); err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Notice", "PUT /reports/{reportid}::validation error: %s", err.Error())
+		return
+	}
 	//check if new query can be run successfully
 	_, err = ParseQuery(strings.NewReader(query.Query))
 	if err != nil {
@@ -465,7 +484,230 @@ func (a *APIHandler) handleWIdReportContent(writer http.ResponseWriter, req *htt
 	}
 }
 
+// deviceDiff is the semantic diff of the configuration of one device
+type deviceDiff struct {
+	Device string
+	*trans.ConfigDiff
+}
+
+// configDiffReport lists the devices whose configuration differs between
+// two commits
+type configDiffReport struct {
+	From    string
+	To      string
+	Devices []deviceDiff
+}
+
+/*
+handleConfigDiff compares the configuration of every device that changed
+between two commits of the device repository, key by key rather than line
+by line.  Secret values are redacted.
+*/
+func (a *APIHandler) handleConfigDiff(writer http.ResponseWriter, req *http.Request) {
+	//deal with any version in the URL or Accept header
+	version, err := global.ProcessVersioning(req)
+	if err != nil {
+		a.log.Debug("Versioning: %s", err.Error())
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if version != nil && *version > a.Version {
+		a.log.Debug("Version %v not implemented, current version is %v", *version, a.Version)
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+	resp := &logging.ResponseLogger{
+		ResponseWriter: writer,
+		Logger:         a.log,
+		SrcNodeName:    global.RootNode,
+	}
+	params := mux.Vars(req)
+	from, to := params["from"], params["to"]
+
+	engine, err := change.GetCMEngine(nil)
+	if err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "GET /reports/diff/{from}/{to}::Could not get an instance of Change management Engine.")
+		return
+	}
+
+	devices, err := engine.ChangedObjects(change.DEVICE, from, to)
+	if err != nil {
+		resp.WriteLog(http.StatusNotFound, "Info", "GET /reports/diff/{from}/{to}::%s", err.Error())
+		return
+	}
+
+	report := configDiffReport{From: from, To: to, Devices: make([]deviceDiff, 0)}
+	for _, device := range devices {
+		versions := make([]*change.ChangeData, 2)
+		for i, commit := range []string{from, to} {
+			versions[i], err = engine.GetObjectAt(change.DEVICE, device, commit)
+			if err != nil && !change.IsCMNoObjectError(err) {
+				resp.WriteLog(http.StatusInternalServerError, "Notice", "GET /reports/diff/{from}/{to}::%s", err.Error())
+				return
+			}
+		}
+		d, err := trans.DiffObjects(versions[0], versions[1])
+		if err != nil {
+			resp.WriteLog(http.StatusUnprocessableEntity, "Info", "GET /reports/diff/{from}/{to}::Could not parse the configuration of %s, error: %s", device, err.Error())
+			return
+		}
+		if !d.Empty() {
+			report.Devices = append(report.Devices, deviceDiff{Device: device, ConfigDiff: d})
+		}
+	}
+
+	jsonStr, err := json.Marshal(report)
+	if err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "GET /reports/diff/{from}/{to}::Could not marshal the report Error: %s", err.Error())
+		return
+	}
+	if _, err = resp.Write(jsonStr); err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Notice", "GET /reports/diff/{from}/{to}::Writing response body Error: %s", err.Error())
+	}
+}
+
+/*
+handleSignatures reports the signature of every commit in a repository of
+the CME (device, policy, query or report), and whether the signed history
+is intact, for auditors.
+*/
+func (a *APIHandler) handleSignatures(writer http.ResponseWriter, req *http.Request) {
+	//deal with any version in the URL or Accept header
+	version, err := global.ProcessVersioning(req)
+	if err != nil {
+		a.log.Debug("Versioning: %s", err.Error())
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if version != nil && *version > a.Version {
+		a.log.Debug("Version %v not implemented, current version is %v", *version, a.Version)
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+	resp := &logging.ResponseLogger{
+		ResponseWriter: writer,
+		Logger:         a.log,
+		SrcNodeName:    global.RootNode,
+	}
+	repo := mux.Vars(req)["repo"]
+
+	ctype := change.StringToCMType(strings.ToUpper(repo))
+	if ctype == change.NONE {
+		resp.WriteLog(http.StatusNotFound, "Info", "GET /reports/signatures/{repo}::Unknown repository %s", repo)
+		return
+	}
+
+	engine, err := change.GetCMEngine(nil)
+	if err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "GET /reports/signatures/{repo}::Could not get an instance of Change management Engine.")
+		return
+	}
+
+	v, err := engine.VerifyHistory(ctype)
+	if err != nil {
+		resp.WriteLog(http.StatusNotFound, "Info", "GET /reports/signatures/{repo}::%s", err.Error())
+		return
+	}
+	if !v.Valid {
+		a.log.Warning("GET /reports/signatures/{repo}::History of %s fails verification", v.Repository)
+	}
+
+	jsonStr, err := json.Marshal(v)
+	if err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "GET /reports/signatures/{repo}::Could not marshal the report Error: %s", err.Error())
+		return
+	}
+	if _, err = resp.Write(jsonStr); err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Notice", "GET /reports/signatures/{repo}::Writing response body Error: %s", err.Error())
+	}
+}
+
+// handleRepoStats reports the size of a repository of the change management
+// engine, and when it was last compacted and packed
+func (a *APIHandler) handleRepoStats(writer http.ResponseWriter, req *http.Request) {
+	//deal with any version in the URL or Accept header
+	version, err := global.ProcessVersioning(req)
+	if err != nil {
+		a.log.Debug("Versioning: %s", err.Error())
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if version != nil && *version > a.Version {
+		a.log.Debug("Version %v not implemented, current version is %v", *version, a.Version)
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+	resp := &logging.ResponseLogger{
+		ResponseWriter: writer,
+		Logger:         a.log,
+		SrcNodeName:    global.RootNode,
+	}
+	repo := mux.Vars(req)["repo"]
+
+	ctype := change.StringToCMType(strings.ToUpper(repo))
+	if ctype == change.NONE {
+		resp.WriteLog(http.StatusNotFound, "Info", "GET /reports/repository/{repo}::Unknown repository %s", repo)
+		return
+	}
+
+	engine, err := change.GetCMEngine(nil)
+	if err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "GET /reports/repository/{repo}::Could not get an instance of Change management Engine.")
+		return
+	}
+
+	stats, err := engine.RepoStats(ctype)
+	if err != nil {
+		resp.WriteLog(http.StatusNotFound, "Info", "GET /reports/repository/{repo}::%s", err.Error())
+		return
+	}
+
+	jsonStr, err := json.Marshal(stats)
+	if err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "GET /reports/repository/{repo}::Could not marshal the report Error: %s", err.Error())
+		return
+	}
+	if _, err = resp.Write(jsonStr); err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Notice", "GET /reports/repository/{repo}::Writing response body Error: %s", err.Error())
+	}
+}
+
 /********************************* utility functions *****************************************/
+// reportRetention returns the retention of the runs of every report that
+// limits them, for the engine to compact the REPORT history with
+func (a *APIHandler) reportRetention() map[string]change.Retention {
+	policies := make(map[string]change.Retention)
+
+	engine, err := change.GetCMEngine(nil)
+	if err != nil {
+		return policies
+	}
+	queryList, err := engine.ListObjects(change.REPORT)
+	if err != nil {
+		return policies
+	}
+	for _, queryName := range queryList {
+		chData, err := engine.GetObject(change.REPORT, queryName)
+		if err != nil {
+			continue
+		}
+		var savedQuery PbReportQuery
+		if err = json.Unmarshal(chData.Content.Files["queryFile"], &savedQuery); err != nil {
+			a.log.Debug("reportRetention::Report Decoder Error: %s", err.Error())
+			continue
+		}
+		r, err := savedQuery.Retention()
+		if err != nil {
+			a.log.Warning("reportRetention::%s: %s", queryName, err.Error())
+			continue
+		}
+		if r.Count > 0 || r.MaxAge > 0 {
+			policies[queryName] = r
+		}
+	}
+	return policies
+}
+
 func (a *APIHandler) completeChangeDataStruct(chData *change.ChangeData) error {
 	if chData.Author == nil || chData.Author.Name == "" {
 		a.log.Debug("completeChangeDataStruct: No Author found. Cannot proceed")
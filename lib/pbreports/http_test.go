@@ -918,3 +918,69 @@ func TestGetContentWIdHandler(t *testing.T) {
 		testingError(t, test, "Did not get StatusOK, version is now not 1?")
 	}
 }
+
+func TestRepoStatsHandler(t *testing.T) {
+	test := "TestRepoStatsHandler"
+	begin(t, test)
+	defer end(t, test)
+
+	dbFile := "test_repoStatsReport.db"
+	dbHandle := setupDB(t, dbFile)
+	defer os.Remove(dbFile)
+	defer dbHandle.Close()
+
+	cmEngine := getCME(t)
+	defer cleanupCME(cmEngine)
+	muxRouter := setupApiHandler(dbHandle)
+	setupGlobal(t, "root")
+
+	sig := &change.CMAuthor{
+		Name:  "tester",
+		Email: "tester@iti.com",
+		When:  time.Now(),
+	}
+
+	//test1: bad retention is refused
+	query := reports.PbReportQuery{Name: "Uptime Report", Query: "Dont know yet", TimeStamp: time.Now().Format(time.RFC1123), Period: "-1", KeepRuns: 2, KeepFor: "forever"}
+	if _, err := query.Retention(); err == nil {
+		testingError(t, test, "Accepted a retention of %s", query.KeepFor)
+	}
+	query.KeepFor = "720h"
+	r, err := query.Retention()
+	if err != nil || r.Count != 2 || r.MaxAge != 720*time.Hour {
+		testingError(t, test, "Wrong retention %+v, Error: %v", r, err)
+	}
+
+	//test2: runs of the report are in the history
+	commit := change.NewCMContent(query.Name)
+	jsonStr, err := json.Marshal(query)
+	if err != nil {
+		testingError(t, test, "Could not marshal the query, Error: %s", err.Error())
+	}
+	commit.Files["queryFile"] = []byte(jsonStr)
+	for _, run := range []string{"run 1", "run 2", "run 3"} {
+		commit.Files["reportFile"] = []byte(run)
+		data := &change.ChangeData{ObjectType: change.REPORT, Content: commit, Author: sig}
+		if _, err = cmEngine.VersionObject(data, "Updated"); err != nil {
+			testingError(t, test, "Could not version run, Error: %s", err.Error())
+		}
+	}
+	req := createNewRequest(t, "GET", "https://localhost:8080/reports/repository/report", nil)
+	writer := httptest.NewRecorder()
+	muxRouter.ServeHTTP(writer, req)
+	if writer.Code != http.StatusOK {
+		testingError(t, test, "Could not GET repository stats. got code: %v", writer.Code)
+	}
+	var stats change.RepoStats
+	if err = json.Unmarshal(writer.Body.Bytes(), &stats); err != nil || stats.Repository != "REPORT" || stats.Commits != 4 {
+		testingError(t, test, "Wrong repository stats %+v, Error: %v", stats, err)
+	}
+
+	//test3: unknown repository
+	req = createNewRequest(t, "GET", "https://localhost:8080/reports/repository/nothing", nil)
+	writer = httptest.NewRecorder()
+	muxRouter.ServeHTTP(writer, req)
+	if writer.Code != http.StatusNotFound {
+		testingError(t, test, "Expected 404 for an unknown repository, got code: %v", writer.Code)
+	}
+}
@@ -39,6 +39,30 @@ type PbReportQuery struct {
 	Query     string `validate:"nonzero"`
 	TimeStamp string
 	Period    string
+	// Runs of the report the history keeps, by count and by age.  Every
+	// run is kept when neither is set.
+	KeepRuns int    `json:",omitempty"`
+	KeepFor  string `json:",omitempty"`
+}
+
+// Retention returns the retention of the runs of the report in the history
+// of the REPORT repository
+func (q PbReportQuery) Retention() (change.Retention, error) {
+	r := change.Retention{File: "reportFile", Count: q.KeepRuns}
+	if q.KeepRuns < 0 {
+		return r, errors.New("KeepRuns can not be negative")
+	}
+	if q.KeepFor != "" {
+		d, err := time.ParseDuration(q.KeepFor)
+		if err != nil {
+			return r, fmt.Errorf("KeepFor: %s", err.Error())
+		}
+		if d <= 0 {
+			return r, errors.New("KeepFor must be positive")
+		}
+		r.MaxAge = d
+	}
+	return r, nil
 }
 
 type PbReportQueryHttp struct {
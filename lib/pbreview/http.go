@@ -0,0 +1,360 @@
+package review
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	mux "github.com/gorilla/mux"
+	auth "github.com/iti/pbconf/lib/pbauth"
+	change "github.com/iti/pbconf/lib/pbchange"
+	database "github.com/iti/pbconf/lib/pbdatabase"
+	global "github.com/iti/pbconf/lib/pbglobal"
+	logging "github.com/iti/pbconf/lib/pblogger"
+	trans "github.com/iti/pbconf/lib/pbtranslate"
+)
+
+type APIHandler struct {
+	log     logging.Logger
+	db      database.AppDatabase
+	Version int
+}
+
+/*
+changeRequest is a change request as shown to reviewers.  A pending request
+to change a device config comes with the same diff as the config history,
+any other with the statements it adds and removes.  Secrets are redacted
+from both.
+*/
+type changeRequest struct {
+	TransactionID string
+	ObjectType    string
+	Object        string
+	Message       string
+	Status        string
+	Review        *change.Review
+	Diff          *trans.ConfigDiff     `json:",omitempty"`
+	Statements    *change.StatementDiff `json:",omitempty"`
+}
+
+// reviewRequest is the body of an approve or reject request.  The reviewer
+// is the user the request is made for, not named in the body.
+type reviewRequest struct {
+	Comment string
+}
+
+func NewAPIHandler(loglevel string, d database.AppDatabase) *APIHandler {
+	l, _ := logging.GetLogger("Changes API")
+	logging.SetLevel(loglevel, "Changes API")
+	return &APIHandler{log: l, db: d, Version: 1}
+}
+
+func (a *APIHandler) AddAPIEndpoints(router *mux.Router) {
+	a.log.Info("Registering change request endpoints")
+
+	for _, v := range global.ApiUrlVersioning {
+		router.HandleFunc(v+"/changes", a.handleBaseRoute).Methods("GET")
+
+		s := router.PathPrefix(v + "/changes").Subrouter()
+		s.HandleFunc("/", a.handleBaseRoute).Methods("GET")
+		s.HandleFunc("/{transid}", a.handleWIdRoute).Methods("GET")
+		s.HandleFunc("/{transid}/approve", a.handleApproveRoute).Methods("POST")
+		s.HandleFunc("/{transid}/reject", a.handleRejectRoute).Methods("POST")
+	}
+}
+
+func (a *APIHandler) GetInfo() (string, int) {
+	return "changes", a.Version
+}
+
+func (a *APIHandler) checkVersion(writer http.ResponseWriter, req *http.Request) *logging.ResponseLogger {
+	//deal with any version in the URL or Accept header
+	version, err := global.ProcessVersioning(req)
+	if err != nil {
+		a.log.Debug("Versioning: %s", err.Error())
+		writer.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	if version != nil && *version > a.Version {
+		a.log.Debug("Version %v not implemented, current version is %v", *version, a.Version)
+		writer.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	return &logging.ResponseLogger{
+		ResponseWriter: writer,
+		Logger:         a.log,
+		SrcNodeName:    global.RootNode,
+	}
+}
+
+// handleBaseRoute lists the change requests, pending ones first
+func (a *APIHandler) handleBaseRoute(writer http.ResponseWriter, req *http.Request) {
+	resp := a.checkVersion(writer, req)
+	if resp == nil {
+		return
+	}
+
+	engine, err := change.GetCMEngine(nil)
+	if err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "GET /changes::Could not get instance of CME, error: %s", err.Error())
+		return
+	}
+
+	reqs := make([]changeRequest, 0)
+	for id, t := range engine.ChangeRequests() {
+		reqs = append(reqs, newChangeRequest(id, t))
+	}
+	sort.Slice(reqs, func(i, j int) bool {
+		pi, pj := reqs[i].Status == change.PENDING.String(), reqs[j].Status == change.PENDING.String()
+		if pi != pj {
+			return pi
+		}
+		return reqs[i].TransactionID < reqs[j].TransactionID
+	})
+
+	jsonStr, err := json.Marshal(reqs)
+	if err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "GET /changes::Could not marshal the change requests Error: %s", err.Error())
+		return
+	}
+	if _, err = resp.Write(jsonStr); err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Notice", "GET /changes::Writing response body Error: %s", err.Error())
+		return
+	}
+}
+
+// handleWIdRoute shows a change request along with its diff against master
+func (a *APIHandler) handleWIdRoute(writer http.ResponseWriter, req *http.Request) {
+	resp := a.checkVersion(writer, req)
+	if resp == nil {
+		return
+	}
+
+	id := mux.Vars(req)["transid"]
+	engine, err := change.GetCMEngine(nil)
+	if err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "GET /changes/{transid}::Could not get instance of CME, error: %s", err.Error())
+		return
+	}
+
+	t, err := engine.GetChangeRequest(id)
+	if err != nil {
+		resp.WriteLog(http.StatusNotFound, "Info", "GET /changes/{transid}::%s", err.Error())
+		return
+	}
+
+	cr := newChangeRequest(id, t)
+	if t.Status == change.PENDING && t.Ctype == change.DEVICE {
+		versions := make([]*change.ChangeData, 2)
+		for i, rev := range []string{"master", id} {
+			versions[i], err = engine.GetObjectAt(t.Ctype, t.Object, rev)
+			if err != nil && !change.IsCMNoObjectError(err) {
+				resp.WriteLog(http.StatusInternalServerError, "Notice", "GET /changes/{transid}::Could not read change request %s, error: %s", id, err.Error())
+				return
+			}
+		}
+		if cr.Diff, err = trans.DiffObjects(versions[0], versions[1]); err != nil {
+			resp.WriteLog(http.StatusUnprocessableEntity, "Info", "GET /changes/{transid}::Could not parse the configuration, error: %s", err.Error())
+			return
+		}
+	} else if t.Status == change.PENDING {
+		if cr.Statements, err = engine.ReviewDiff(id); err != nil {
+			resp.WriteLog(http.StatusInternalServerError, "Notice", "GET /changes/{transid}::Could not diff change request %s, error: %s", id, err.Error())
+			return
+		}
+		redact(cr.Statements.Added)
+		redact(cr.Statements.Removed)
+	}
+
+	jsonStr, err := json.Marshal(cr)
+	if err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "GET /changes/{transid}::Could not marshal the change request Error: %s", err.Error())
+		return
+	}
+	if _, err = resp.Write(jsonStr); err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Notice", "GET /changes/{transid}::Writing response body Error: %s", err.Error())
+		return
+	}
+}
+
+// handleApproveRoute merges a change request into master and, for devices
+// configured by this node, sends the new config to the device.  If the
+// device does not take it the merge is reverted.
+func (a *APIHandler) handleApproveRoute(writer http.ResponseWriter, req *http.Request) {
+	resp := a.checkVersion(writer, req)
+	if resp == nil {
+		return
+	}
+
+	id := mux.Vars(req)["transid"]
+	engine, reviewer, comment, ok := a.reviewer(resp, req, "POST /changes/{transid}/approve")
+	if !ok {
+		return
+	}
+
+	t, err := engine.GetChangeRequest(id)
+	if err != nil {
+		resp.WriteLog(http.StatusNotFound, "Info", "POST /changes/{transid}/approve::%s", err.Error())
+		return
+	}
+
+	// The config goes to the device before the request counts as approved,
+	// a device that refuses it takes the merge back off master
+	var applyErr error
+	var apply func(*change.ChangeData) error
+	if t.Ctype == change.DEVICE {
+		apply = func(cdata *change.ChangeData) error {
+			applyErr = a.applyDeviceConfig(req, t.Object, cdata)
+			return applyErr
+		}
+	}
+
+	commit, err := engine.ApproveChange(id, reviewer, comment, apply)
+	if applyErr != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Warning", "POST /changes/{transid}/approve::Change request %s was not applied, %s", id, applyErr.Error())
+		return
+	}
+	if err != nil {
+		status := http.StatusBadRequest
+		if change.IsCMReviewError(err) {
+			status = http.StatusConflict
+		}
+		resp.WriteLog(status, "Info", "POST /changes/{transid}/approve::%s", err.Error())
+		return
+	}
+
+	jsonStr, err := json.Marshal(struct{ CommitID string }{commit})
+	if err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "POST /changes/{transid}/approve::Could not marshal the commit Error: %s", err.Error())
+		return
+	}
+	resp.Write(jsonStr)
+}
+
+func (a *APIHandler) handleRejectRoute(writer http.ResponseWriter, req *http.Request) {
+	resp := a.checkVersion(writer, req)
+	if resp == nil {
+		return
+	}
+
+	id := mux.Vars(req)["transid"]
+	engine, reviewer, comment, ok := a.reviewer(resp, req, "POST /changes/{transid}/reject")
+	if !ok {
+		return
+	}
+
+	if err := engine.RejectChange(id, reviewer, comment); err != nil {
+		status := http.StatusNotFound
+		if change.IsCMReviewError(err) {
+			status = http.StatusConflict
+		}
+		resp.WriteLog(status, "Info", "POST /changes/{transid}/reject::%s", err.Error())
+		return
+	}
+	resp.WriteHeader(http.StatusOK)
+}
+
+// reviewer decodes a review request and checks the user it is made for
+// holds the role the engine requires of reviewers
+func (a *APIHandler) reviewer(resp *logging.ResponseLogger, req *http.Request, route string) (*change.CMEngine, *change.CMAuthor, string, bool) {
+	caller, err := auth.Caller(req)
+	if err != nil {
+		resp.WriteLog(http.StatusUnauthorized, "Info", "%s::No reviewer, %s", route, err.Error())
+		return nil, nil, "", false
+	}
+
+	var rr reviewRequest
+	if err := json.NewDecoder(req.Body).Decode(&rr); err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Notice", "%s::Decoder error: %s", route, err.Error())
+		return nil, nil, "", false
+	}
+
+	engine, err := change.GetCMEngine(nil)
+	if err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "%s::Could not get instance of CME, error: %s", route, err.Error())
+		return nil, nil, "", false
+	}
+
+	user := database.PbUser{Name: caller.Name}
+	if err = user.GetByName(a.db); err != nil {
+		resp.WriteLog(http.StatusForbidden, "Info", "%s::Unknown reviewer %s", route, caller.Name)
+		return nil, nil, "", false
+	}
+	if user.Role != engine.ReviewerRole {
+		resp.WriteLog(http.StatusForbidden, "Info", "%s::%s does not have the %s role needed to review changes", route, user.Name, engine.ReviewerRole)
+		return nil, nil, "", false
+	}
+
+	return engine, &change.CMAuthor{Name: user.Name, Email: user.Email, When: time.Now()}, rr.Comment, true
+}
+
+// applyDeviceConfig sends the approved config of a device to the
+// translation engine, if the device is configured by this node.  An
+// approved removal leaves the device alone.
+func (a *APIHandler) applyDeviceConfig(req *http.Request, name string, cdata *change.ChangeData) error {
+	device := database.PbDevice{Name: name}
+	if err := device.GetByName(a.db); err != nil {
+		return fmt.Errorf("device %s could not be found", name)
+	}
+
+	rootnode := database.PbNode{Name: global.RootNode}
+	if err := rootnode.GetByName(a.db); err != nil {
+		return fmt.Errorf("the root node could not be found")
+	}
+	if device.ParentNode == nil || *device.ParentNode != rootnode.Id {
+		a.log.Debug("Device %s is configured by another node", name)
+		return nil
+	}
+
+	var buf *bytes.Buffer
+	for _, v := range cdata.Content.Files {
+		buf = bytes.NewBuffer(v)
+		break
+	}
+	if buf == nil {
+		a.log.Debug("Device %s has no config left to send", name)
+		return nil
+	}
+
+	a.log.Debug("Configuring device with id %d", device.Id)
+	if err := trans.ExecuteConfigContext(req.Context(), nil, device.Id, buf); err != nil {
+		return fmt.Errorf("configuring device %s failed: %s", name, err.Error())
+	}
+	return nil
+}
+
+func redact(statements []string) {
+	for i, l := range statements {
+		statements[i] = trans.RedactLine(l)
+	}
+}
+
+func newChangeRequest(id string, t change.Transaction) changeRequest {
+	return changeRequest{
+		TransactionID: id,
+		ObjectType:    t.Ctype.String(),
+		Object:        t.Object,
+		Message:       t.Message,
+		Status:        t.Status.String(),
+		Review:        t.Review,
+	}
+}
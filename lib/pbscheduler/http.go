@@ -0,0 +1,310 @@
+package scheduler
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	mux "github.com/gorilla/mux"
+	change "github.com/iti/pbconf/lib/pbchange"
+	database "github.com/iti/pbconf/lib/pbdatabase"
+	global "github.com/iti/pbconf/lib/pbglobal"
+	logging "github.com/iti/pbconf/lib/pblogger"
+)
+
+type APIHandler struct {
+	log       logging.Logger
+	db        database.AppDatabase
+	scheduler *Scheduler
+	Version   int
+}
+
+// scheduledChange is a scheduled change as shown through the API
+type scheduledChange struct {
+	TransactionID string
+	Device        string
+	Status        string
+	Message       string
+	Author        *change.CMAuthor
+	At            time.Time
+	Window        string
+	Note          string
+	Created       time.Time
+	Updated       time.Time
+}
+
+// cancelRequest is the optional body of a cancellation
+type cancelRequest struct {
+	User string
+}
+
+func NewAPIHandler(loglevel string, d database.AppDatabase) *APIHandler {
+	l, _ := logging.GetLogger("Schedule API")
+	logging.SetLevel(loglevel, "Schedule API")
+	return &APIHandler{log: l, db: d, scheduler: Get(), Version: 1}
+}
+
+func (a *APIHandler) AddAPIEndpoints(router *mux.Router) {
+	a.log.Info("Registering schedule endpoints")
+
+	for _, v := range global.ApiUrlVersioning {
+		router.HandleFunc(v+"/schedule", a.handleBaseRoute).Methods("GET")
+
+		s := router.PathPrefix(v + "/schedule").Subrouter()
+		s.HandleFunc("/", a.handleBaseRoute).Methods("GET")
+		s.HandleFunc("/windows", a.handleWindowsRoute).Methods("GET", "POST")
+		s.HandleFunc("/windows/{name}", a.handleWindowRoute).Methods("GET", "DELETE")
+		s.HandleFunc("/freezes", a.handleFreezesRoute).Methods("GET", "POST")
+		s.HandleFunc("/freezes/{name}", a.handleFreezeRoute).Methods("GET", "DELETE")
+		s.HandleFunc("/{transid}", a.handleWIdRoute).Methods("GET", "DELETE")
+	}
+}
+
+func (a *APIHandler) GetInfo() (string, int) {
+	return "schedule", a.Version
+}
+
+func (a *APIHandler) checkVersion(writer http.ResponseWriter, req *http.Request) *logging.ResponseLogger {
+	//deal with any version in the URL or Accept header
+	version, err := global.ProcessVersioning(req)
+	if err != nil {
+		a.log.Debug("Versioning: %s", err.Error())
+		writer.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	if version != nil && *version > a.Version {
+		a.log.Debug("Version %v not implemented, current version is %v", *version, a.Version)
+		writer.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	return &logging.ResponseLogger{
+		ResponseWriter: writer,
+		Logger:         a.log,
+		SrcNodeName:    global.RootNode,
+	}
+}
+
+// handleBaseRoute lists the changes waiting to be applied, oldest first
+func (a *APIHandler) handleBaseRoute(writer http.ResponseWriter, req *http.Request) {
+	resp := a.checkVersion(writer, req)
+	if resp == nil {
+		return
+	}
+
+	engine, err := change.GetCMEngine(nil)
+	if err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "GET /schedule::Could not get instance of CME, error: %s", err.Error())
+		return
+	}
+
+	changes := make([]scheduledChange, 0)
+	for _, t := range engine.ScheduledChanges() {
+		changes = append(changes, newScheduledChange(t))
+	}
+	a.writeJSON(resp, "GET /schedule", changes)
+}
+
+// handleWIdRoute shows a scheduled change, including what became of it,
+// or cancels one that is still waiting
+func (a *APIHandler) handleWIdRoute(writer http.ResponseWriter, req *http.Request) {
+	resp := a.checkVersion(writer, req)
+	if resp == nil {
+		return
+	}
+	route := req.Method + " /schedule/{transid}"
+
+	engine, err := change.GetCMEngine(nil)
+	if err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "%s::Could not get instance of CME, error: %s", route, err.Error())
+		return
+	}
+
+	id := mux.Vars(req)["transid"]
+	t, err := engine.GetScheduledChange(id)
+	if err != nil {
+		resp.WriteLog(http.StatusNotFound, "Info", "%s::%s", route, err.Error())
+		return
+	}
+
+	if req.Method == "GET" {
+		a.writeJSON(resp, route, newScheduledChange(t))
+		return
+	}
+
+	var by *change.CMAuthor
+	var cr cancelRequest
+	if req.ContentLength != 0 {
+		if err = json.NewDecoder(req.Body).Decode(&cr); err != nil {
+			resp.WriteLog(http.StatusBadRequest, "Notice", "%s::Decoder error: %s", route, err.Error())
+			return
+		}
+	}
+	if cr.User != "" {
+		user := database.PbUser{Name: cr.User}
+		if err = user.GetByName(a.db); err != nil {
+			resp.WriteLog(http.StatusForbidden, "Info", "%s::Unknown user %s", route, cr.User)
+			return
+		}
+		by = &change.CMAuthor{Name: user.Name, Email: user.Email, When: time.Now()}
+	}
+
+	if err = engine.CancelChange(id, by); err != nil {
+		resp.WriteLog(http.StatusConflict, "Info", "%s::%s", route, err.Error())
+		return
+	}
+	a.log.Notice("%s::Scheduled change %s cancelled", route, id)
+	resp.WriteHeader(http.StatusOK)
+}
+
+func (a *APIHandler) handleWindowsRoute(writer http.ResponseWriter, req *http.Request) {
+	resp := a.checkVersion(writer, req)
+	if resp == nil {
+		return
+	}
+
+	if req.Method == "GET" {
+		a.writeJSON(resp, "GET /schedule/windows", a.scheduler.Windows())
+		return
+	}
+
+	var w Window
+	if err := json.NewDecoder(req.Body).Decode(&w); err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Notice", "POST /schedule/windows::Decoder error: %s", err.Error())
+		return
+	}
+	if err := a.scheduler.SetWindow(w); err != nil {
+		a.writeError(resp, "POST /schedule/windows", err)
+		return
+	}
+	a.log.Notice("POST /schedule/windows::Maintenance window %s set", w.Name)
+	resp.WriteHeader(http.StatusOK)
+}
+
+func (a *APIHandler) handleWindowRoute(writer http.ResponseWriter, req *http.Request) {
+	resp := a.checkVersion(writer, req)
+	if resp == nil {
+		return
+	}
+	route := req.Method + " /schedule/windows/{name}"
+	name := mux.Vars(req)["name"]
+
+	if req.Method == "GET" {
+		w, err := a.scheduler.GetWindow(name)
+		if err != nil {
+			a.writeError(resp, route, err)
+			return
+		}
+		a.writeJSON(resp, route, w)
+		return
+	}
+
+	if err := a.scheduler.RemoveWindow(name); err != nil {
+		a.writeError(resp, route, err)
+		return
+	}
+	a.log.Notice("%s::Maintenance window %s removed", route, name)
+	resp.WriteHeader(http.StatusOK)
+}
+
+func (a *APIHandler) handleFreezesRoute(writer http.ResponseWriter, req *http.Request) {
+	resp := a.checkVersion(writer, req)
+	if resp == nil {
+		return
+	}
+
+	if req.Method == "GET" {
+		a.writeJSON(resp, "GET /schedule/freezes", a.scheduler.Freezes())
+		return
+	}
+
+	var f Freeze
+	if err := json.NewDecoder(req.Body).Decode(&f); err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Notice", "POST /schedule/freezes::Decoder error: %s", err.Error())
+		return
+	}
+	if err := a.scheduler.SetFreeze(f); err != nil {
+		a.writeError(resp, "POST /schedule/freezes", err)
+		return
+	}
+	a.log.Notice("POST /schedule/freezes::Freeze %s set", f.Name)
+	resp.WriteHeader(http.StatusOK)
+}
+
+func (a *APIHandler) handleFreezeRoute(writer http.ResponseWriter, req *http.Request) {
+	resp := a.checkVersion(writer, req)
+	if resp == nil {
+		return
+	}
+	route := req.Method + " /schedule/freezes/{name}"
+	name := mux.Vars(req)["name"]
+
+	if req.Method == "GET" {
+		f, err := a.scheduler.GetFreeze(name)
+		if err != nil {
+			a.writeError(resp, route, err)
+			return
+		}
+		a.writeJSON(resp, route, f)
+		return
+	}
+
+	if err := a.scheduler.RemoveFreeze(name); err != nil {
+		a.writeError(resp, route, err)
+		return
+	}
+	a.log.Notice("%s::Freeze %s removed", route, name)
+	resp.WriteHeader(http.StatusOK)
+}
+
+func (a *APIHandler) writeJSON(resp *logging.ResponseLogger, route string, v interface{}) {
+	jsonStr, err := json.Marshal(v)
+	if err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "%s::Could not marshal the response Error: %s", route, err.Error())
+		return
+	}
+	if _, err = resp.Write(jsonStr); err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Notice", "%s::Writing response body Error: %s", route, err.Error())
+	}
+}
+
+func (a *APIHandler) writeError(resp *logging.ResponseLogger, route string, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case IsInvalidError(err):
+		status = http.StatusBadRequest
+	case IsNotFoundError(err):
+		status = http.StatusNotFound
+	}
+	resp.WriteLog(status, "Info", "%s::%s", route, err.Error())
+}
+
+func newScheduledChange(t change.Transaction) scheduledChange {
+	return scheduledChange{
+		TransactionID: t.ID,
+		Device:        t.Object,
+		Status:        t.Status.String(),
+		Message:       t.Message,
+		Author:        t.Author,
+		At:            t.Schedule.At,
+		Window:        t.Schedule.Window,
+		Note:          t.Schedule.Note,
+		Created:       t.Created,
+		Updated:       t.Updated,
+	}
+}
@@ -0,0 +1,531 @@
+package scheduler
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+/*
+Package scheduler applies device changes when they are allowed to go out.
+
+A scheduled change is versioned on its own transaction branch by the
+change management engine and waits there, with a start time, a named
+maintenance window, or both.  Once the time has come, the window is open
+and no freeze covers the device, the scheduler lands the change on master,
+sends the config to the device and finalizes the transaction.
+
+Windows and freezes are scoped to the devices of a node, to a group of
+devices sharing the "group" metadata key, or to both.  They are kept in
+the repo path so they survive a restart of the node.
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	change "github.com/iti/pbconf/lib/pbchange"
+	database "github.com/iti/pbconf/lib/pbdatabase"
+	logging "github.com/iti/pbconf/lib/pblogger"
+	trans "github.com/iti/pbconf/lib/pbtranslate"
+)
+
+var log logging.Logger
+
+func init() {
+	log, _ = logging.GetLogger("Scheduler")
+}
+
+// stateFile holds the windows and freezes, next to the repositories
+const stateFile = "schedule.json"
+
+// GroupKey is the device metadata key that names the group of a device
+const GroupKey = "group"
+
+// How long a device gets to take a scheduled config
+const applyTimeout = 5 * time.Minute
+
+// Scope picks the devices a window or freeze covers.  An empty field
+// matches every device.
+type Scope struct {
+	Node  string // Name of the node that configures the device
+	Group string // Group metadata of the device
+}
+
+// Device is what the scheduler needs to know about a device
+type Device struct {
+	Id    int64
+	Name  string
+	Node  string
+	Group string
+}
+
+func (s Scope) Covers(d Device) bool {
+	return (s.Node == "" || s.Node == d.Node) && (s.Group == "" || s.Group == d.Group)
+}
+
+/*
+Window is a named maintenance window.  Without Repeat it is open once,
+from Start until End.  With Repeat set to a duration, for instance "168h"
+for a weekly window, it opens again every Repeat after Start.
+*/
+type Window struct {
+	Name string
+	Scope
+	Start  time.Time
+	End    time.Time
+	Repeat string
+}
+
+func (w *Window) Validate() error {
+	if w.Name == "" {
+		return NewInvalidError("A maintenance window needs a name")
+	}
+	if !w.End.After(w.Start) {
+		return NewInvalidError(fmt.Sprintf("Maintenance window %s ends before it starts", w.Name))
+	}
+	if w.Repeat == "" {
+		return nil
+	}
+	period, err := time.ParseDuration(w.Repeat)
+	if err != nil || period <= 0 {
+		return NewInvalidError(fmt.Sprintf("Maintenance window %s has a bad repeat %q", w.Name, w.Repeat))
+	}
+	if w.End.Sub(w.Start) > period {
+		return NewInvalidError(fmt.Sprintf("Maintenance window %s is longer than its repeat", w.Name))
+	}
+	return nil
+}
+
+// Open tells whether the window is open at t
+func (w *Window) Open(t time.Time) bool {
+	if t.Before(w.Start) {
+		return false
+	}
+	if w.Repeat == "" {
+		return t.Before(w.End)
+	}
+	period, err := time.ParseDuration(w.Repeat)
+	if err != nil || period <= 0 {
+		return false
+	}
+	start := w.Start.Add(t.Sub(w.Start) / period * period)
+	return t.Before(start.Add(w.End.Sub(w.Start)))
+}
+
+// Freeze blocks changes to the devices it covers from Start until End
+type Freeze struct {
+	Name string
+	Scope
+	Start  time.Time
+	End    time.Time
+	Reason string
+}
+
+func (f *Freeze) Validate() error {
+	if f.Name == "" {
+		return NewInvalidError("A freeze needs a name")
+	}
+	if !f.End.After(f.Start) {
+		return NewInvalidError(fmt.Sprintf("Freeze %s ends before it starts", f.Name))
+	}
+	return nil
+}
+
+func (f *Freeze) Active(t time.Time) bool {
+	return !t.Before(f.Start) && t.Before(f.End)
+}
+
+type state struct {
+	Windows []Window
+	Freezes []Freeze
+}
+
+type Scheduler struct {
+	mx      sync.Mutex
+	path    string
+	windows map[string]Window
+	freezes map[string]Freeze
+
+	// Lookup finds a device by name and Apply sends it a config.  Start
+	// fills them in when they are not set.
+	Lookup func(name string) (Device, error)
+	Apply  func(ctx context.Context, d Device, config *bytes.Buffer) error
+}
+
+var nodeScheduler *Scheduler
+var nodeOnce sync.Once
+
+// Get returns the node wide scheduler, which keeps its state in the repo
+// path of the change management engine
+func Get() *Scheduler {
+	nodeOnce.Do(func() {
+		path := ""
+		if engine, err := change.GetCMEngine(nil); err == nil {
+			path = filepath.Join(engine.Repopath, stateFile)
+		} else {
+			log.Warning("No change management engine, windows and freezes will not be saved: %s", err.Error())
+		}
+		nodeScheduler = New(path)
+		if err := nodeScheduler.load(); err != nil {
+			log.Error("Could not load the schedule: %s", err.Error())
+		}
+	})
+	return nodeScheduler
+}
+
+// New returns a scheduler that keeps its state in path, or only in
+// memory if path is empty
+func New(path string) *Scheduler {
+	return &Scheduler{
+		path:    path,
+		windows: make(map[string]Window),
+		freezes: make(map[string]Freeze),
+	}
+}
+
+func (s *Scheduler) load() error {
+	if s.path == "" {
+		return nil
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var st state
+	if err = json.Unmarshal(data, &st); err != nil {
+		return err
+	}
+	for _, w := range st.Windows {
+		s.windows[w.Name] = w
+	}
+	for _, f := range st.Freezes {
+		s.freezes[f.Name] = f
+	}
+	return nil
+}
+
+// save writes the state out, the caller holds the lock
+func (s *Scheduler) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(state{Windows: s.listWindows(), Freezes: s.listFreezes()}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write and rename, so a crash never leaves half a file behind
+	tmp := s.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// Windows returns the maintenance windows sorted by name
+func (s *Scheduler) Windows() []Window {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.listWindows()
+}
+
+func (s *Scheduler) listWindows() []Window {
+	list := make([]Window, 0, len(s.windows))
+	for _, w := range s.windows {
+		list = append(list, w)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func (s *Scheduler) GetWindow(name string) (Window, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	w, ok := s.windows[name]
+	if !ok {
+		return w, NewNotFoundError("Maintenance window", name)
+	}
+	return w, nil
+}
+
+// SetWindow adds a maintenance window, or replaces the one of that name
+func (s *Scheduler) SetWindow(w Window) error {
+	if err := w.Validate(); err != nil {
+		return err
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.windows[w.Name] = w
+	return s.save()
+}
+
+// RemoveWindow deletes a maintenance window.  Changes scheduled for it
+// wait until a window of that name is set again, or they are cancelled.
+func (s *Scheduler) RemoveWindow(name string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if _, ok := s.windows[name]; !ok {
+		return NewNotFoundError("Maintenance window", name)
+	}
+	delete(s.windows, name)
+	return s.save()
+}
+
+// Freezes returns the freezes sorted by name
+func (s *Scheduler) Freezes() []Freeze {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.listFreezes()
+}
+
+func (s *Scheduler) listFreezes() []Freeze {
+	list := make([]Freeze, 0, len(s.freezes))
+	for _, f := range s.freezes {
+		list = append(list, f)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func (s *Scheduler) GetFreeze(name string) (Freeze, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	f, ok := s.freezes[name]
+	if !ok {
+		return f, NewNotFoundError("Freeze", name)
+	}
+	return f, nil
+}
+
+// SetFreeze adds a freeze, or replaces the one of that name
+func (s *Scheduler) SetFreeze(f Freeze) error {
+	if err := f.Validate(); err != nil {
+		return err
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.freezes[f.Name] = f
+	return s.save()
+}
+
+func (s *Scheduler) RemoveFreeze(name string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if _, ok := s.freezes[name]; !ok {
+		return NewNotFoundError("Freeze", name)
+	}
+	delete(s.freezes, name)
+	return s.save()
+}
+
+/*
+Held tells why a change scheduled as sched may not be applied to d at now.
+It returns an empty string once the change is due.
+*/
+func (s *Scheduler) Held(now time.Time, sched *change.Schedule, d Device) string {
+	if !sched.At.IsZero() && now.Before(sched.At) {
+		return fmt.Sprintf("Waiting until %s", sched.At.Format(time.RFC3339))
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if sched.Window != "" {
+		w, ok := s.windows[sched.Window]
+		switch {
+		case !ok:
+			return fmt.Sprintf("Maintenance window %s does not exist", sched.Window)
+		case !w.Covers(d):
+			return fmt.Sprintf("Maintenance window %s does not cover %s", w.Name, d.Name)
+		case !w.Open(now):
+			return fmt.Sprintf("Waiting for maintenance window %s", w.Name)
+		}
+	}
+
+	for _, f := range s.listFreezes() {
+		if f.Active(now) && f.Covers(d) {
+			return fmt.Sprintf("Frozen by %s until %s: %s", f.Name, f.End.Format(time.RFC3339), f.Reason)
+		}
+	}
+	return ""
+}
+
+// Run applies the scheduled device changes that are due at now
+func (s *Scheduler) Run(now time.Time) {
+	engine, err := change.GetCMEngine(nil)
+	if err != nil {
+		log.Warning("Could not get instance of CME, error: %s", err.Error())
+		return
+	}
+
+	for _, t := range engine.ScheduledChanges() {
+		if t.Ctype != change.DEVICE {
+			continue
+		}
+
+		var note string
+		d, err := s.Lookup(t.Object)
+		if err != nil {
+			note = fmt.Sprintf("Device %s could not be found: %s", t.Object, err.Error())
+		} else {
+			note = s.Held(now, t.Schedule, d)
+		}
+		if note != "" {
+			if note != t.Schedule.Note {
+				log.Info("Scheduled change %s is held: %s", t.ID, note)
+				engine.NoteSchedule(t.ID, note)
+			}
+			continue
+		}
+
+		s.apply(engine, t, d)
+	}
+}
+
+// apply lands a due change on master, sends it to the device and
+// finalizes its transaction.  A change the device did not take is
+// reverted on master.
+func (s *Scheduler) apply(engine *change.CMEngine, t change.Transaction, d Device) {
+	commit, err := engine.LandChange(t.ID)
+	if err != nil {
+		log.Warning("Scheduled change %s could not be landed: %s", t.ID, err.Error())
+		return
+	}
+
+	cdata, err := engine.GetObject(change.DEVICE, t.Object)
+	if err != nil {
+		log.Warning("Scheduled change %s could not be read back: %s", t.ID, err.Error())
+		s.revert(engine, t, commit, "Reading the landed config failed: "+err.Error())
+		engine.FinalizeTransaction(&change.ChangeData{ObjectType: change.DEVICE, TransactionID: t.ID}, change.FAILED)
+		return
+	}
+	cdata.CommitID = commit
+	cdata.TransactionID = t.ID
+
+	var buf *bytes.Buffer
+	for _, v := range cdata.Content.Files {
+		buf = bytes.NewBuffer(v)
+		break
+	}
+	if buf == nil {
+		buf = new(bytes.Buffer)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), applyTimeout)
+	err = s.Apply(ctx, d, buf)
+	cancel()
+	if err != nil {
+		log.Warning("Scheduled change %s could not be applied to %s: %s", t.ID, d.Name, err.Error())
+		s.revert(engine, t, commit, "Configuring the device failed: "+err.Error())
+		engine.FinalizeTransaction(cdata, change.FAILED)
+		return
+	}
+
+	log.Notice("Scheduled change %s applied to %s", t.ID, d.Name)
+	engine.FinalizeTransaction(cdata)
+}
+
+// revert takes a change that landed but was not applied back off master,
+// and notes why on the change
+func (s *Scheduler) revert(engine *change.CMEngine, t change.Transaction, commit, note string) {
+	if _, err := engine.RevertLanded(t.ID, commit, note); err != nil {
+		log.Error("Scheduled change %s is on master but not on %s, and could not be reverted: %s", t.ID, t.Object, err.Error())
+		note += "; reverting master failed: " + err.Error()
+	}
+	engine.NoteSchedule(t.ID, note)
+}
+
+/*
+Start runs the scheduler every interval seconds, 30 if not given, until
+true is sent on the returned channel.  Devices are looked up in db and
+configured through the translation engine unless Lookup and Apply are
+already set.
+*/
+func (s *Scheduler) Start(db database.AppDatabase, interval ...int) chan bool {
+	if s.Lookup == nil {
+		s.Lookup = func(name string) (Device, error) {
+			return lookupDevice(db, name)
+		}
+	}
+	if s.Apply == nil {
+		s.Apply = func(ctx context.Context, d Device, config *bytes.Buffer) error {
+			return trans.ExecuteConfigContext(ctx, nil, d.Id, config)
+		}
+	}
+
+	every := 30
+	if len(interval) > 0 && interval[0] > 0 {
+		every = interval[0]
+	}
+
+	doneChan := make(chan bool)
+	ticker := time.NewTicker(time.Second * time.Duration(every))
+	go func() {
+		for {
+			select {
+			case t := <-ticker.C:
+				s.Run(t)
+			case <-doneChan:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+	return doneChan
+}
+
+func lookupDevice(db database.AppDatabase, name string) (Device, error) {
+	dev := database.PbDevice{Name: name}
+	if err := dev.GetByName(db); err != nil {
+		return Device{}, err
+	}
+	d := Device{Id: dev.Id, Name: dev.Name}
+
+	if dev.ParentNode != nil {
+		node := database.PbNode{Id: *dev.ParentNode}
+		if err := node.Get(db); err == nil {
+			d.Node = node.Name
+		}
+	}
+	if engine, err := change.GetCMEngine(nil); err == nil {
+		d.Group, _ = engine.GetMeta(name, GroupKey)
+	}
+	return d, nil
+}
@@ -0,0 +1,263 @@
+package scheduler
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	change "github.com/iti/pbconf/lib/pbchange"
+	config "github.com/iti/pbconf/lib/pbconfig"
+)
+
+func begin(t *testing.T, name string) {
+	fmt.Printf("##################### Begin Scheduler::%s #####################\n", name)
+}
+
+func end(t *testing.T, name string) {
+	fmt.Printf("###################### End Scheduler::%s ######################\n", name)
+}
+
+func checkFatal(t *testing.T, err error) {
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+var base = time.Date(2018, time.June, 3, 2, 0, 0, 0, time.UTC) // a Sunday
+
+func TestWindowOpen(t *testing.T) {
+	begin(t, "TestWindowOpen")
+	defer end(t, "TestWindowOpen")
+
+	once := Window{Name: "once", Start: base, End: base.Add(4 * time.Hour)}
+	weekly := Window{Name: "weekly", Start: base, End: base.Add(4 * time.Hour), Repeat: "168h"}
+	checkFatal(t, once.Validate())
+	checkFatal(t, weekly.Validate())
+
+	for _, c := range []struct {
+		w    Window
+		at   time.Duration
+		open bool
+	}{
+		{once, -time.Minute, false},
+		{once, 0, true},
+		{once, 4*time.Hour - time.Second, true},
+		{once, 4 * time.Hour, false},
+		{once, 7 * 24 * time.Hour, false},
+		{weekly, -time.Minute, false},
+		{weekly, time.Hour, true},
+		{weekly, 5 * time.Hour, false},
+		{weekly, 7*24*time.Hour + time.Hour, true},
+		{weekly, 7*24*time.Hour + 5*time.Hour, false},
+		{weekly, 70*24*time.Hour + 3*time.Hour, true},
+	} {
+		if c.w.Open(base.Add(c.at)) != c.open {
+			t.Errorf("Window %s open at %v should be %v", c.w.Name, c.at, c.open)
+		}
+	}
+
+	for _, w := range []Window{
+		{Start: base, End: base.Add(time.Hour)},
+		{Name: "backwards", Start: base, End: base.Add(-time.Hour)},
+		{Name: "bad", Start: base, End: base.Add(time.Hour), Repeat: "weekly"},
+		{Name: "long", Start: base, End: base.Add(2 * time.Hour), Repeat: "1h"},
+	} {
+		if err := w.Validate(); !IsInvalidError(err) {
+			t.Errorf("Window %+v should not validate: %v", w, err)
+		}
+	}
+}
+
+func TestHeld(t *testing.T) {
+	begin(t, "TestHeld")
+	defer end(t, "TestHeld")
+
+	s := New("")
+	checkFatal(t, s.SetWindow(Window{Name: "sunday", Scope: Scope{Group: "feeders"},
+		Start: base, End: base.Add(4 * time.Hour), Repeat: "168h"}))
+	checkFatal(t, s.SetFreeze(Freeze{Name: "storm", Scope: Scope{Node: "substation"},
+		Start: base.Add(7 * 24 * time.Hour), End: base.Add(8 * 24 * time.Hour), Reason: "Storm season"}))
+
+	relay := Device{Id: 1, Name: "relay", Node: "substation", Group: "feeders"}
+	meter := Device{Id: 2, Name: "meter", Node: "substation", Group: "meters"}
+	inWindow := base.Add(time.Hour)
+	nextWindow := inWindow.Add(7 * 24 * time.Hour)
+
+	for _, c := range []struct {
+		sched change.Schedule
+		d     Device
+		now   time.Time
+		held  string
+	}{
+		{change.Schedule{Window: "sunday"}, relay, inWindow, ""},
+		{change.Schedule{Window: "sunday"}, relay, base.Add(5 * time.Hour), "Waiting for maintenance window sunday"},
+		{change.Schedule{Window: "sunday"}, meter, inWindow, "Maintenance window sunday does not cover meter"},
+		{change.Schedule{Window: "monday"}, relay, inWindow, "Maintenance window monday does not exist"},
+		{change.Schedule{At: nextWindow}, relay, inWindow, "Waiting until"},
+		{change.Schedule{At: inWindow}, meter, nextWindow, "Frozen by storm"},
+		{change.Schedule{Window: "sunday"}, relay, nextWindow, "Frozen by storm"},
+	} {
+		held := s.Held(c.now, &c.sched, c.d)
+		if (c.held == "") != (held == "") || !strings.HasPrefix(held, c.held) {
+			t.Errorf("Schedule %+v of %s at %v: expected %q, got %q", c.sched, c.d.Name, c.now, c.held, held)
+		}
+	}
+}
+
+func TestState(t *testing.T) {
+	begin(t, "TestState")
+	defer end(t, "TestState")
+
+	dir, err := ioutil.TempDir("", "scheduler")
+	checkFatal(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, stateFile)
+
+	s := New(path)
+	checkFatal(t, s.SetWindow(Window{Name: "sunday", Start: base, End: base.Add(time.Hour), Repeat: "168h"}))
+	checkFatal(t, s.SetWindow(Window{Name: "outage", Start: base, End: base.Add(time.Hour)}))
+	checkFatal(t, s.SetFreeze(Freeze{Name: "storm", Start: base, End: base.Add(time.Hour)}))
+	checkFatal(t, s.RemoveWindow("outage"))
+	if err = s.RemoveFreeze("drought"); !IsNotFoundError(err) {
+		t.Errorf("Removed an unknown freeze: %v", err)
+	}
+
+	s = New(path)
+	checkFatal(t, s.load())
+	if len(s.Windows()) != 1 || len(s.Freezes()) != 1 {
+		t.Fatalf("Unexpected state %+v %+v", s.Windows(), s.Freezes())
+	}
+	w, err := s.GetWindow("sunday")
+	checkFatal(t, err)
+	if !w.Start.Equal(base) || w.Repeat != "168h" {
+		t.Errorf("Window not restored intact: %+v", w)
+	}
+}
+
+func proposal(object, content string) *change.ChangeData {
+	commit := change.NewCMContent(object)
+	commit.Files["configFile"] = []byte(content)
+
+	return &change.ChangeData{
+		ObjectType: change.DEVICE,
+		Content:    commit,
+		Author: &change.CMAuthor{
+			Name:  "Larry Bird",
+			Email: "tootall@celtics.net",
+			When:  time.Now(),
+		},
+	}
+}
+
+func TestRun(t *testing.T) {
+	begin(t, "TestRun")
+	defer end(t, "TestRun")
+
+	repopath, err := ioutil.TempDir("", "cmengine")
+	checkFatal(t, err)
+	defer os.RemoveAll(repopath)
+	cfg := new(config.Config)
+	cfg.ChMgmt.RepoPath = repopath
+	cfg.ChMgmt.LogLevel = "DEBUG"
+	engine, err := change.GetCMEngine(cfg)
+	checkFatal(t, err)
+	defer engine.Free()
+
+	for _, name := range []string{"relay", "meter", "clock"} {
+		_, err = engine.VersionObject(proposal(name, "set service FTP on\n"), "")
+		checkFatal(t, err)
+	}
+
+	s := New("")
+	checkFatal(t, s.SetFreeze(Freeze{Name: "meters", Scope: Scope{Group: "meters"},
+		Start: base, End: base.Add(time.Hour), Reason: "Billing run"}))
+
+	applied := make(map[string]string)
+	s.Lookup = func(name string) (Device, error) {
+		group := ""
+		if name == "meter" {
+			group = "meters"
+		}
+		return Device{Name: name, Group: group}, nil
+	}
+	s.Apply = func(ctx context.Context, d Device, config *bytes.Buffer) error {
+		if d.Name == "clock" {
+			return errors.New("no answer")
+		}
+		applied[d.Name] = config.String()
+		return nil
+	}
+
+	relay, err := engine.ScheduleChange(proposal("relay", "set service FTP off\n"), "", change.Schedule{At: base})
+	checkFatal(t, err)
+	meter, err := engine.ScheduleChange(proposal("meter", "set service FTP off\n"), "", change.Schedule{At: base})
+	checkFatal(t, err)
+	clock, err := engine.ScheduleChange(proposal("clock", "set service FTP off\n"), "", change.Schedule{At: base})
+	checkFatal(t, err)
+	later, err := engine.ScheduleChange(proposal("relay", "set service ETELNET off\n"), "", change.Schedule{At: base.Add(time.Hour)})
+	checkFatal(t, err)
+
+	s.Run(base.Add(time.Minute))
+
+	if len(applied) != 1 || applied["relay"] != "set service FTP off\n" {
+		t.Errorf("Unexpected applies %v", applied)
+	}
+	for id, want := range map[string]string{
+		relay: fmt.Sprintf("%s ", change.COMPLETE),
+		meter: fmt.Sprintf("%s Frozen by meters", change.SCHEDULED),
+		clock: fmt.Sprintf("%s Configuring the device failed: no answer", change.FAILED),
+		later: fmt.Sprintf("%s Waiting until", change.SCHEDULED),
+	} {
+		tr, err := engine.GetTransaction(id)
+		checkFatal(t, err)
+		if got := tr.Status.String() + " " + tr.Schedule.Note; !strings.HasPrefix(got, want) {
+			t.Errorf("Change %s: expected %q, got %q", tr.Object, want, got)
+		}
+	}
+
+	cd, err := engine.GetObject(change.DEVICE, "relay")
+	checkFatal(t, err)
+	if string(cd.Content.Files["configFile"]) != "set service FTP off\n" {
+		t.Errorf("Applied change is not on master")
+	}
+	cd, err = engine.GetObject(change.DEVICE, "meter")
+	checkFatal(t, err)
+	if string(cd.Content.Files["configFile"]) != "set service FTP on\n" {
+		t.Errorf("Frozen change reached master")
+	}
+	cd, err = engine.GetObject(change.DEVICE, "clock")
+	checkFatal(t, err)
+	if string(cd.Content.Files["configFile"]) != "set service FTP on\n" {
+		t.Errorf("Change the device did not take was left on master")
+	}
+
+	// The freeze thaws
+	s.Run(base.Add(2 * time.Hour))
+	if applied["meter"] != "set service FTP off\n" {
+		t.Errorf("Thawed change was not applied %v", applied)
+	}
+}
@@ -0,0 +1,127 @@
+package search
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	mux "github.com/gorilla/mux"
+	database "github.com/iti/pbconf/lib/pbdatabase"
+	global "github.com/iti/pbconf/lib/pbglobal"
+	logging "github.com/iti/pbconf/lib/pblogger"
+)
+
+type APIHandler struct {
+	log     logging.Logger
+	db      database.AppDatabase
+	index   *Index
+	Version int
+}
+
+func NewAPIHandler(loglevel string, d database.AppDatabase) *APIHandler {
+	l, _ := logging.GetLogger("Search API")
+	logging.SetLevel(loglevel, "Search API")
+	return &APIHandler{log: l, db: d, index: Get(), Version: 1}
+}
+
+func (a *APIHandler) AddAPIEndpoints(router *mux.Router) {
+	a.log.Info("Registering search endpoints")
+
+	for _, v := range global.ApiUrlVersioning {
+		router.HandleFunc(v+"/search", a.handleBaseRoute).Methods("GET")
+
+		s := router.PathPrefix(v + "/search").Subrouter()
+		s.HandleFunc("/", a.handleBaseRoute).Methods("GET")
+	}
+}
+
+func (a *APIHandler) GetInfo() (string, int) {
+	return "search", a.Version
+}
+
+func (a *APIHandler) checkVersion(writer http.ResponseWriter, req *http.Request) *logging.ResponseLogger {
+	//deal with any version in the URL or Accept header
+	version, err := global.ProcessVersioning(req)
+	if err != nil {
+		a.log.Debug("Versioning: %s", err.Error())
+		writer.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	if version != nil && *version > a.Version {
+		a.log.Debug("Version %v not implemented, current version is %v", *version, a.Version)
+		writer.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	return &logging.ResponseLogger{
+		ResponseWriter: writer,
+		Logger:         a.log,
+		SrcNodeName:    global.RootNode,
+	}
+}
+
+/*
+handleBaseRoute searches the device, policy and report repositories and
+device metadata.  The q parameter holds the query, see Query.  With
+history=true, changes that added or removed matching lines are reported
+too.  Limit caps the number of hits.
+*/
+func (a *APIHandler) handleBaseRoute(writer http.ResponseWriter, req *http.Request) {
+	resp := a.checkVersion(writer, req)
+	if resp == nil {
+		return
+	}
+
+	params := req.URL.Query()
+	query, err := ParseQuery(params.Get("q"))
+	if err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Info", "GET /search::%s", err.Error())
+		return
+	}
+
+	limit := 0
+	if l := params.Get("limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil || limit < 0 {
+			resp.WriteLog(http.StatusBadRequest, "Info", "GET /search::Bad limit %s", l)
+			return
+		}
+	}
+	history := false
+	if h := params.Get("history"); h != "" {
+		if history, err = strconv.ParseBool(h); err != nil {
+			resp.WriteLog(http.StatusBadRequest, "Info", "GET /search::Bad history %s", h)
+			return
+		}
+	}
+
+	results, err := a.index.Search(query, limit, history)
+	if err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "GET /search::Search failed: %s", err.Error())
+		return
+	}
+
+	jsonStr, err := json.Marshal(results)
+	if err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "GET /search::Could not marshal the results Error: %s", err.Error())
+		return
+	}
+	if _, err = resp.Write(jsonStr); err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Notice", "GET /search::Writing response body Error: %s", err.Error())
+		return
+	}
+}
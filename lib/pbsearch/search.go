@@ -0,0 +1,824 @@
+package search
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	change "github.com/iti/pbconf/lib/pbchange"
+	logging "github.com/iti/pbconf/lib/pblogger"
+	trans "github.com/iti/pbconf/lib/pbtranslate"
+)
+
+var log logging.Logger
+
+func init() {
+	log, _ = logging.GetLogger("Search")
+}
+
+// MetaFile is the name the metadata of a device is searched under, as if
+// it were one more file of the device holding a key=value line per key
+const MetaFile = "meta"
+
+// Redacted stands in for secret values in the index and in results
+const Redacted = trans.Redacted
+
+const (
+	defaultLimit   = 50  // Hits returned unless a limit is asked for
+	maxLimit       = 500 // Hits returned at most
+	historyCommits = 200 // Commits a history search looks at per repository
+	historyPerHit  = 20  // Past lines reported per hit
+)
+
+// The repositories that are searched
+var cmTypes = []change.CMType{change.DEVICE, change.POLICY, change.REPORT}
+
+// document is an object as the index holds it
+type document struct {
+	ctype   change.CMType
+	object  string
+	files   map[string][]string // Lines of every file, secrets redacted
+	meta    map[string]string   // Device metadata without secret keys
+	changed *change.LogLine     // Last change to the data of the object
+}
+
+type docKey struct {
+	ctype  change.CMType
+	object string
+}
+
+/*
+Index is an inverted index over the objects of the device, policy and report
+repositories, and over the metadata of devices.  Values of keys that look
+like they hold secrets are never indexed, so they can not be found and do
+not show up in results.  The index remembers the commit of master it last
+read each repository at, and catches up from there before every search and
+after every commit, so only the objects that changed are read again.
+*/
+type Index struct {
+	engine *change.CMEngine
+
+	refresh sync.Mutex // Held while a repository is read
+
+	mx       sync.RWMutex
+	docs     map[docKey]*document
+	postings map[string]map[docKey]bool
+	seen     map[change.CMType]string
+}
+
+var nodeIndex *Index
+var nodeOnce sync.Once
+
+// Get returns the node wide index, which follows the commits of the change
+// management engine
+func Get() *Index {
+	nodeOnce.Do(func() {
+		engine, err := change.GetCMEngine(nil)
+		if err != nil {
+			log.Warning("No change management engine, nothing to search: %s", err.Error())
+		}
+		nodeIndex = New(engine)
+		if engine == nil {
+			return
+		}
+		for _, t := range cmTypes {
+			engine.RegisterCommitListener(t, nodeIndex, commitCallback)
+			engine.RegisterPackRcvdListener(t, nodeIndex, commitCallback)
+		}
+	})
+	return nodeIndex
+}
+
+// New returns an empty index over the repositories of engine
+func New(engine *change.CMEngine) *Index {
+	return &Index{
+		engine:   engine,
+		docs:     make(map[docKey]*document),
+		postings: make(map[string]map[docKey]bool),
+		seen:     make(map[change.CMType]string),
+	}
+}
+
+// commitCallback catches the index up with a repository that changed.  It
+// does not hold up the commit.
+func commitCallback(handler interface{}, cd *change.ChangeData) {
+	idx := handler.(*Index)
+	go func() {
+		if err := idx.Refresh(cd.ObjectType); err != nil {
+			log.Warning("Could not index %s: %s", cd.ObjectType.String(), err.Error())
+		}
+	}()
+}
+
+// Refresh reads the objects of a repository that changed since the index
+// last saw it, all of them the first time
+func (idx *Index) Refresh(ctype change.CMType) error {
+	if idx.engine == nil {
+		return nil
+	}
+	idx.refresh.Lock()
+	defer idx.refresh.Unlock()
+
+	head := strings.Trim(idx.engine.GetLatestCommitID(ctype), "\"")
+	idx.mx.RLock()
+	seen := idx.seen[ctype]
+	idx.mx.RUnlock()
+	if head == seen {
+		return nil
+	}
+
+	var objects []string
+	var err error
+	if seen != "" && head != "" {
+		objects, err = idx.changedSince(ctype, seen, head)
+		if err != nil {
+			// History was rewritten under the index, start over
+			log.Info("Reindexing %s: %s", ctype.String(), err.Error())
+			seen = ""
+		}
+	}
+	if seen == "" || head == "" {
+		objects, err = idx.rebuild(ctype, head)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, object := range objects {
+		doc, err := idx.load(ctype, object, head)
+		if err != nil {
+			return err
+		}
+		idx.mx.Lock()
+		idx.remove(docKey{ctype, object})
+		if doc != nil {
+			idx.add(doc)
+		}
+		idx.mx.Unlock()
+	}
+
+	idx.mx.Lock()
+	idx.seen[ctype] = head
+	idx.mx.Unlock()
+	log.Debug("Indexed %d objects of %s at %s", len(objects), ctype.String(), head)
+	return nil
+}
+
+// changedSince returns the objects whose data, or metadata, changed
+// between two commits
+func (idx *Index) changedSince(ctype change.CMType, from, to string) ([]string, error) {
+	objects, err := idx.engine.ChangedObjects(ctype, from, to)
+	if err != nil || ctype != change.DEVICE {
+		return objects, err
+	}
+	meta, err := idx.engine.ChangedMeta(from, to)
+	if err != nil {
+		return nil, err
+	}
+	return append(objects, meta...), nil
+}
+
+// rebuild drops what the index holds of a repository and returns every
+// object in it
+func (idx *Index) rebuild(ctype change.CMType, head string) ([]string, error) {
+	idx.mx.Lock()
+	for k := range idx.docs {
+		if k.ctype == ctype {
+			idx.remove(k)
+		}
+	}
+	idx.mx.Unlock()
+
+	if head == "" {
+		return nil, nil
+	}
+	objects, err := idx.engine.ListObjects(ctype)
+	if err != nil && !change.IsCMNoRepoError(err) {
+		return nil, err
+	}
+	return objects, nil
+}
+
+// load reads an object as it is at head, or returns nil if it is gone
+func (idx *Index) load(ctype change.CMType, object, head string) (*document, error) {
+	doc := &document{ctype: ctype, object: object, files: make(map[string][]string), meta: make(map[string]string)}
+
+	cd, err := idx.engine.GetObjectAt(ctype, object, head)
+	if err != nil && !change.IsCMNoObjectError(err) {
+		return nil, err
+	}
+	if cd != nil {
+		for name, content := range cd.Content.Files {
+			if bytes.IndexByte(content, 0) != -1 {
+				continue // Not text
+			}
+			lines := strings.Split(strings.TrimRight(string(content), "\n"), "\n")
+			for i := range lines {
+				lines[i] = trans.RedactLine(lines[i])
+			}
+			doc.files[name] = lines
+		}
+		if doc.changed, err = idx.engine.LastChange(ctype, object); err != nil {
+			log.Debug("No last change for %s: %s", object, err.Error())
+		}
+	}
+
+	if ctype == change.DEVICE {
+		meta, err := idx.engine.GetMetaAt(object, head)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range meta {
+			if !trans.IsSecretKey(k) {
+				doc.meta[k] = v
+			}
+		}
+	}
+
+	if cd == nil && len(doc.meta) == 0 {
+		return nil, nil
+	}
+	return doc, nil
+}
+
+// add puts a document in the index, the caller holds the write lock
+func (idx *Index) add(doc *document) {
+	k := docKey{doc.ctype, doc.object}
+	idx.docs[k] = doc
+	for _, tok := range doc.tokens() {
+		if idx.postings[tok] == nil {
+			idx.postings[tok] = make(map[docKey]bool)
+		}
+		idx.postings[tok][k] = true
+	}
+}
+
+// remove takes a document out of the index, the caller holds the write lock
+func (idx *Index) remove(k docKey) {
+	doc, ok := idx.docs[k]
+	if !ok {
+		return
+	}
+	for _, tok := range doc.tokens() {
+		delete(idx.postings[tok], k)
+		if len(idx.postings[tok]) == 0 {
+			delete(idx.postings, tok)
+		}
+	}
+	delete(idx.docs, k)
+}
+
+// lines returns the lines of a file of the document, the metadata as
+// key=value lines in key order
+func (doc *document) lines(file string) []string {
+	if file != MetaFile {
+		return doc.files[file]
+	}
+	keys := make([]string, 0, len(doc.meta))
+	for k := range doc.meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	lines := make([]string, 0, len(keys))
+	for _, k := range keys {
+		lines = append(lines, k+"="+doc.meta[k])
+	}
+	return lines
+}
+
+// fileNames returns the files of the document in name order, metadata last
+func (doc *document) fileNames() []string {
+	names := make([]string, 0, len(doc.files)+1)
+	for name := range doc.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(doc.meta) != 0 {
+		names = append(names, MetaFile)
+	}
+	return names
+}
+
+// tokens returns the distinct tokens of the document
+func (doc *document) tokens() []string {
+	seen := make(map[string]bool)
+	for _, name := range doc.fileNames() {
+		for _, line := range doc.lines(name) {
+			for _, tok := range tokenize(line) {
+				seen[tok] = true
+			}
+		}
+	}
+	toks := make([]string, 0, len(seen))
+	for tok := range seen {
+		toks = append(toks, tok)
+	}
+	return toks
+}
+
+// tokenize splits text into lower case runs of letters, digits and
+// underscores
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+	})
+}
+
+// term is a word or quoted phrase of a query.  A word ending in * matches
+// any word it starts.
+type term struct {
+	text   string
+	prefix bool
+	re     *regexp.Regexp
+}
+
+/*
+Query is a parsed search.  Text is matched without regard to case, word by
+word, and every term must match somewhere in an object for it to be a hit.
+The fields narrow the hits down:
+
+	type:DEVICE           the type of repository
+	object:relay*         the object name, as understood by path.Match
+	file:configFile       the file a term must match in, meta for metadata
+	meta.driver:sel*      a metadata key of a device
+*/
+type Query struct {
+	Terms   []string          `json:",omitempty"`
+	Types   []string          `json:",omitempty"`
+	Objects []string          `json:",omitempty"`
+	Files   []string          `json:",omitempty"`
+	Meta    map[string]string `json:",omitempty"`
+	terms   []term
+}
+
+// ParseQuery reads a query such as `telnet type:DEVICE object:bay1-*`
+func ParseQuery(q string) (*Query, error) {
+	words, err := splitQuery(q)
+	if err != nil {
+		return nil, err
+	}
+
+	query := &Query{Meta: make(map[string]string)}
+	for _, w := range words {
+		field, value := "", w
+		if i := strings.Index(w, ":"); i > 0 && !strings.HasPrefix(w, "\"") {
+			field, value = strings.ToLower(w[:i]), strings.Trim(w[i+1:], "\"")
+		}
+		switch {
+		case field == "type":
+			t := strings.ToUpper(value)
+			if !knownType(t) {
+				return nil, NewQueryError(fmt.Sprintf("Can not search %s", value))
+			}
+			query.Types = append(query.Types, t)
+		case field == "object":
+			if _, err := path.Match(value, ""); err != nil {
+				return nil, NewQueryError(fmt.Sprintf("Bad object pattern %s", value))
+			}
+			query.Objects = append(query.Objects, value)
+		case field == "file":
+			query.Files = append(query.Files, value)
+		case strings.HasPrefix(field, "meta."):
+			key := w[len("meta."):strings.Index(w, ":")]
+			if trans.IsSecretKey(key) {
+				return nil, NewQueryError(fmt.Sprintf("Can not search on %s", key))
+			}
+			if _, err := path.Match(strings.ToLower(value), ""); err != nil {
+				return nil, NewQueryError(fmt.Sprintf("Bad pattern %s", value))
+			}
+			query.Meta[key] = value
+		default:
+			if err := query.addTerm(strings.Trim(w, "\"")); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(query.terms) == 0 && len(query.Types)+len(query.Objects)+len(query.Files)+len(query.Meta) == 0 {
+		return nil, NewQueryError("Nothing to search for")
+	}
+	return query, nil
+}
+
+// splitQuery splits a query into words, keeping quoted phrases together
+func splitQuery(q string) ([]string, error) {
+	words := make([]string, 0)
+	var cur strings.Builder
+	quoted := false
+	for _, r := range q {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			cur.WriteRune(r)
+		case unicode.IsSpace(r) && !quoted:
+			if cur.Len() != 0 {
+				words = append(words, cur.String())
+				cur.Reset()
+			}
+		default:
+			cur.WriteRune(r)
+		}
+	}
+	if quoted {
+		return nil, NewQueryError("Unterminated quote")
+	}
+	if cur.Len() != 0 {
+		words = append(words, cur.String())
+	}
+	return words, nil
+}
+
+func (query *Query) addTerm(text string) error {
+	t := term{text: strings.ToLower(text)}
+	if strings.HasSuffix(t.text, "*") {
+		t.prefix = true
+		t.text = strings.TrimRight(t.text, "*")
+	}
+	if len(tokenize(t.text)) == 0 {
+		return nil
+	}
+
+	expr := regexp.QuoteMeta(t.text)
+	if isWord(t.text[0]) {
+		expr = `\b` + expr
+	}
+	if !t.prefix && isWord(t.text[len(t.text)-1]) {
+		expr += `\b`
+	}
+	t.re = regexp.MustCompile("(?i)" + expr)
+	query.terms = append(query.terms, t)
+	query.Terms = append(query.Terms, text)
+	return nil
+}
+
+func isWord(b byte) bool {
+	return b == '_' || b >= '0' && b <= '9' || b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z'
+}
+
+func knownType(t string) bool {
+	for _, c := range cmTypes {
+		if c.String() == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Match is a line of an object that matched the query.  Highlights holds
+// the byte ranges of the line that matched.
+type Match struct {
+	File       string
+	Line       int
+	Text       string
+	Highlights [][2]int
+}
+
+// HistoryMatch is a line that matched the query in a change to an object,
+// added by the commit if Added is set and removed by it if not
+type HistoryMatch struct {
+	File       string
+	Commit     string
+	Time       time.Time
+	Author     string
+	Message    string
+	Added      bool
+	Text       string
+	Highlights [][2]int
+}
+
+/*
+Hit is an object that matches a query.  Current is set when the object as
+it is on master matches, and Changed tells when that content was last
+changed.  With history asked for, History holds the changes that added or
+removed matching lines, newest first, and an object that only matched in
+the past is a hit with Current unset.
+*/
+type Hit struct {
+	Type    string
+	Object  string
+	Current bool
+	Changed *change.LogLine `json:",omitempty"`
+	Matches []Match
+	History []HistoryMatch `json:",omitempty"`
+}
+
+// Results are the hits of a search, the best first.  Total counts the
+// hits before the limit was applied.
+type Results struct {
+	Query *Query
+	Total int
+	Hits  []Hit
+}
+
+// Search returns up to limit hits, the default number if limit is zero,
+// looking through the history of the repositories as well if history is
+// set
+func (idx *Index) Search(query *Query, limit int, history bool) (*Results, error) {
+	if limit <= 0 {
+		limit = defaultLimit
+	}
+	if limit > maxLimit {
+		limit = maxLimit
+	}
+
+	types := make([]change.CMType, 0)
+	for _, t := range cmTypes {
+		if len(query.Types) == 0 || contains(query.Types, t.String()) {
+			types = append(types, t)
+		}
+	}
+	for _, t := range types {
+		if err := idx.Refresh(t); err != nil {
+			return nil, err
+		}
+	}
+
+	hits := make(map[docKey]*Hit)
+	idx.mx.RLock()
+	for _, k := range idx.candidates(query, types) {
+		if hit := query.match(idx.docs[k]); hit != nil {
+			hits[k] = hit
+		}
+	}
+	idx.mx.RUnlock()
+
+	if history && len(query.terms) != 0 {
+		if err := idx.searchHistory(query, types, hits); err != nil {
+			return nil, err
+		}
+	}
+
+	res := &Results{Query: query, Total: len(hits), Hits: make([]Hit, 0, len(hits))}
+	for _, hit := range hits {
+		res.Hits = append(res.Hits, *hit)
+	}
+	sort.Slice(res.Hits, func(i, j int) bool {
+		a, b := res.Hits[i], res.Hits[j]
+		if a.Current != b.Current {
+			return a.Current
+		}
+		if len(a.Matches) != len(b.Matches) {
+			return len(a.Matches) > len(b.Matches)
+		}
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		return a.Object < b.Object
+	})
+	if len(res.Hits) > limit {
+		res.Hits = res.Hits[:limit]
+	}
+	return res, nil
+}
+
+// candidates returns the documents of the given types that hold a token
+// of every term, the caller holds the read lock
+func (idx *Index) candidates(query *Query, types []change.CMType) []docKey {
+	var set map[docKey]bool
+	for _, t := range query.terms {
+		for _, tok := range tokenize(t.text) {
+			found := make(map[docKey]bool)
+			for k := range idx.postings[tok] {
+				found[k] = true
+			}
+			if t.prefix {
+				last := tokenize(t.text)
+				if tok == last[len(last)-1] {
+					for word, docs := range idx.postings {
+						if strings.HasPrefix(word, tok) {
+							for k := range docs {
+								found[k] = true
+							}
+						}
+					}
+				}
+			}
+			if set == nil {
+				set = found
+				continue
+			}
+			for k := range set {
+				if !found[k] {
+					delete(set, k)
+				}
+			}
+		}
+	}
+	if set == nil {
+		set = make(map[docKey]bool)
+		for k := range idx.docs {
+			set[k] = true
+		}
+	}
+
+	keys := make([]docKey, 0, len(set))
+	for k := range set {
+		for _, t := range types {
+			if k.ctype == t {
+				keys = append(keys, k)
+			}
+		}
+	}
+	return keys
+}
+
+// wantsObject is true if the field filters of the query let an object of
+// a type through
+func (query *Query) wantsObject(ctype change.CMType, object string) bool {
+	if len(query.Types) != 0 && !contains(query.Types, ctype.String()) {
+		return false
+	}
+	if len(query.Objects) == 0 {
+		return true
+	}
+	for _, p := range query.Objects {
+		if ok, _ := path.Match(p, object); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (query *Query) wantsFile(file string) bool {
+	return len(query.Files) == 0 || contains(query.Files, file)
+}
+
+func (query *Query) wantsMeta(doc *document) bool {
+	for k, p := range query.Meta {
+		v, ok := doc.meta[k]
+		if !ok {
+			return false
+		}
+		if m, _ := path.Match(strings.ToLower(p), strings.ToLower(v)); !m {
+			return false
+		}
+	}
+	return true
+}
+
+// match returns the hit a document makes, or nil if it is not one
+func (query *Query) match(doc *document) *Hit {
+	if !query.wantsObject(doc.ctype, doc.object) || !query.wantsMeta(doc) {
+		return nil
+	}
+
+	hit := &Hit{Type: doc.ctype.String(), Object: doc.object, Current: true, Changed: doc.changed, Matches: make([]Match, 0)}
+	matched := make([]bool, len(query.terms))
+	for _, name := range doc.fileNames() {
+		if !query.wantsFile(name) {
+			continue
+		}
+		for n, line := range doc.lines(name) {
+			if h := query.highlight(line, matched); len(h) != 0 {
+				hit.Matches = append(hit.Matches, Match{File: name, Line: n + 1, Text: line, Highlights: h})
+			}
+		}
+	}
+	for _, m := range matched {
+		if !m {
+			return nil
+		}
+	}
+	if len(query.terms) == 0 && len(query.Files) != 0 {
+		for _, name := range doc.fileNames() {
+			if query.wantsFile(name) {
+				return hit
+			}
+		}
+		return nil
+	}
+	return hit
+}
+
+// highlight returns the ranges of a line that match any term, in order,
+// and notes the terms that matched
+func (query *Query) highlight(line string, matched []bool) [][2]int {
+	ranges := make([][2]int, 0)
+	for i, t := range query.terms {
+		for _, r := range t.re.FindAllStringIndex(line, -1) {
+			ranges = append(ranges, [2]int{r[0], r[1]})
+			matched[i] = true
+		}
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i][0] < ranges[j][0] })
+	return ranges
+}
+
+/*
+searchHistory adds the changes that added or removed matching lines to the
+hits.  Lines are redacted before they are matched, so a past secret can not
+be found.  An object that no longer matches is a hit if its history holds
+every term.
+*/
+func (idx *Index) searchHistory(query *Query, types []change.CMType, hits map[docKey]*Hit) error {
+	past := make(map[docKey][]bool)
+	for _, ctype := range types {
+		if idx.engine.GetLatestCommitID(ctype) == "" {
+			continue // No history yet
+		}
+		for ti, t := range query.terms {
+			pattern := regexp.QuoteMeta(t.text)
+			lines, err := idx.engine.SearchHistory(ctype, pattern, historyCommits)
+			if err != nil {
+				return err
+			}
+
+			for _, l := range lines {
+				k := docKey{ctype, l.Object}
+				if !query.wantsObject(ctype, l.Object) || !query.wantsFile(l.File) {
+					continue
+				}
+				text := trans.RedactLine(l.Text)
+				ranges := t.re.FindAllStringIndex(text, -1)
+				if len(ranges) == 0 {
+					continue
+				}
+
+				hit, ok := hits[k]
+				if !ok {
+					idx.mx.RLock()
+					doc := idx.docs[k]
+					idx.mx.RUnlock()
+					if len(query.Meta) != 0 && (doc == nil || !query.wantsMeta(doc)) {
+						continue
+					}
+					hit = &Hit{Type: ctype.String(), Object: l.Object, Matches: make([]Match, 0)}
+					if doc != nil {
+						hit.Changed = doc.changed
+					}
+					hits[k] = hit
+				}
+				if !hit.Current {
+					if past[k] == nil {
+						past[k] = make([]bool, len(query.terms))
+					}
+					past[k][ti] = true
+				}
+				if len(hit.History) >= historyPerHit {
+					continue
+				}
+
+				h := make([][2]int, 0, len(ranges))
+				for _, r := range ranges {
+					h = append(h, [2]int{r[0], r[1]})
+				}
+				hit.History = append(hit.History, HistoryMatch{
+					File:       l.File,
+					Commit:     l.Commit,
+					Time:       l.Time,
+					Author:     l.Author,
+					Message:    l.Message,
+					Added:      l.Added,
+					Text:       text,
+					Highlights: h,
+				})
+			}
+		}
+	}
+
+	for k, terms := range past {
+		for _, m := range terms {
+			if !m {
+				delete(hits, k)
+				break
+			}
+		}
+	}
+	for _, hit := range hits {
+		sort.SliceStable(hit.History, func(i, j int) bool {
+			return hit.History[i].Time.After(hit.History[j].Time)
+		})
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
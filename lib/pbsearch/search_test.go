@@ -0,0 +1,183 @@
+package search
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	change "github.com/iti/pbconf/lib/pbchange"
+	config "github.com/iti/pbconf/lib/pbconfig"
+)
+
+func begin(t *testing.T, name string) {
+	fmt.Printf("##################### Begin Search::%s #####################\n", name)
+}
+
+func end(t *testing.T, name string) {
+	fmt.Printf("###################### End Search::%s ######################\n", name)
+}
+
+func checkFatal(t *testing.T, err error) {
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func version(t *testing.T, engine *change.CMEngine, ctype change.CMType, object, content string) {
+	cd := &change.ChangeData{
+		ObjectType: ctype,
+		Content:    change.NewCMContent(object),
+		Author:     &change.CMAuthor{Name: "Larry Bird", Email: "tootall@celtics.net", When: time.Now()},
+	}
+	cd.Content.Files["configFile"] = []byte(content)
+	_, err := engine.VersionObject(cd, "")
+	checkFatal(t, err)
+}
+
+func search(t *testing.T, idx *Index, q string, history bool) *Results {
+	query, err := ParseQuery(q)
+	checkFatal(t, err)
+	res, err := idx.Search(query, 0, history)
+	checkFatal(t, err)
+	return res
+}
+
+func objects(res *Results) string {
+	names := make([]string, 0, len(res.Hits))
+	for _, h := range res.Hits {
+		names = append(names, h.Object)
+	}
+	return strings.Join(names, " ")
+}
+
+func TestParseQuery(t *testing.T) {
+	begin(t, "TestParseQuery")
+	defer end(t, "TestParseQuery")
+
+	q, err := ParseQuery(`ftp "service telnet" type:device object:bay1-* file:meta meta.driver:sel* admin*`)
+	checkFatal(t, err)
+	if strings.Join(q.Terms, "|") != "ftp|service telnet|admin*" || q.Types[0] != "DEVICE" ||
+		q.Objects[0] != "bay1-*" || q.Files[0] != "meta" || q.Meta["driver"] != "sel*" {
+		t.Errorf("Unexpected query %+v", q)
+	}
+
+	for _, bad := range []string{"", `"open`, "type:QUERY", "meta.password:x", "object:[", "***"} {
+		if _, err := ParseQuery(bad); !IsQueryError(err) {
+			t.Errorf("Parsed %q: %v", bad, err)
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	begin(t, "TestSearch")
+	defer end(t, "TestSearch")
+
+	repopath, err := ioutil.TempDir("", "cmengine")
+	checkFatal(t, err)
+	defer os.RemoveAll(repopath)
+	cfg := new(config.Config)
+	cfg.ChMgmt.RepoPath = repopath
+	engine, err := change.GetCMEngine(cfg)
+	checkFatal(t, err)
+	defer engine.Free()
+
+	version(t, engine, change.DEVICE, "relay1", "set service FTP on\nset password L2 hunter2\n")
+	version(t, engine, change.DEVICE, "relay2", "set service FTP off\nset service SSH on\n")
+	version(t, engine, change.DEVICE, "meter", "set service SSH on\n")
+	version(t, engine, change.POLICY, "no-ftp", "deny service FTP\n")
+	checkFatal(t, engine.VersionMeta("relay1", "driver", "sel421"))
+	checkFatal(t, engine.VersionMeta("relay1", "snmpcommunity", "private"))
+	checkFatal(t, engine.VersionMeta("relay2", "driver", "linux"))
+
+	idx := New(engine)
+
+	res := search(t, idx, "ftp", false)
+	if objects(res) != "no-ftp relay1 relay2" && objects(res) != "relay1 relay2 no-ftp" {
+		t.Errorf("Unexpected hits for ftp: %s", objects(res))
+	}
+	for _, h := range res.Hits {
+		if h.Object != "relay1" {
+			continue
+		}
+		m := h.Matches[0]
+		if len(h.Matches) != 1 || m.File != "configFile" || m.Line != 1 || m.Highlights[0] != [2]int{12, 15} ||
+			m.Text[m.Highlights[0][0]:m.Highlights[0][1]] != "FTP" {
+			t.Errorf("Unexpected matches %+v", h.Matches)
+		}
+		if !h.Current || h.Changed == nil || h.Changed.Author != "Larry Bird" {
+			t.Errorf("Unexpected hit %+v", h)
+		}
+	}
+
+	// Field filters
+	if o := objects(search(t, idx, "ftp type:DEVICE", false)); o != "relay1 relay2" {
+		t.Errorf("Unexpected hits for devices: %s", o)
+	}
+	if o := objects(search(t, idx, "ssh object:relay*", false)); o != "relay2" {
+		t.Errorf("Unexpected hits for relays: %s", o)
+	}
+	if o := objects(search(t, idx, "meta.driver:SEL*", false)); o != "relay1" {
+		t.Errorf("Unexpected hits for the driver: %s", o)
+	}
+	if o := objects(search(t, idx, "linux file:meta", false)); o != "relay2" {
+		t.Errorf("Unexpected hits in metadata: %s", o)
+	}
+	if o := objects(search(t, idx, `"service ssh" "ftp off"`, false)); o != "relay2" {
+		t.Errorf("Unexpected hits for phrases: %s", o)
+	}
+	if o := objects(search(t, idx, "hunt*", false)); o != "" {
+		t.Errorf("Found a password: %s", o)
+	}
+	if o := objects(search(t, idx, "private", false)); o != "" {
+		t.Errorf("Found a secret metadata value: %s", o)
+	}
+
+	// Commits, and metadata that changes without one, are picked up
+	version(t, engine, change.DEVICE, "relay1", "set service FTP off\nset service TELNET on\n")
+	checkFatal(t, engine.VersionMeta("meter", "driver", "sel421"))
+	if o := objects(search(t, idx, "telnet", false)); o != "relay1" {
+		t.Errorf("Unexpected hits after a commit: %s", o)
+	}
+	if o := objects(search(t, idx, "meta.driver:sel421", false)); o != "meter relay1" {
+		t.Errorf("Unexpected hits after a metadata change: %s", o)
+	}
+	checkFatal(t, engine.RemoveObject(change.DEVICE, "relay2", &change.CMAuthor{Name: "Larry Bird", Email: "tootall@celtics.net"}))
+	if o := objects(search(t, idx, "ssh", false)); o != "meter" {
+		t.Errorf("Unexpected hits after a removal: %s", o)
+	}
+
+	// History
+	res = search(t, idx, `"ftp on" type:DEVICE`, true)
+	if objects(res) != "relay1" || res.Hits[0].Current || len(res.Hits[0].History) != 2 {
+		t.Fatalf("Unexpected history hits %+v", res.Hits)
+	}
+	if h := res.Hits[0].History; h[0].Added || !h[1].Added || h[0].Text != "set service FTP on" || h[0].Commit == "" {
+		t.Errorf("Unexpected history %+v", h)
+	}
+	if o := objects(search(t, idx, "hunter2", true)); o != "" {
+		t.Errorf("Found a password in the history: %s", o)
+	}
+	res = search(t, idx, "ssh", true)
+	if objects(res) != "meter relay2" || !res.Hits[0].Current || res.Hits[1].Current {
+		t.Errorf("Unexpected history hits %+v", res.Hits)
+	}
+}
@@ -0,0 +1,241 @@
+package simulator
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"path"
+	"strings"
+	"time"
+)
+
+// How long a passive data connection is waited for
+const ftpDataTimeout = 10 * time.Second
+
+/*
+ServeFTP starts an FTP server over the settings files of the device on
+addr and returns the address it listens on.  Only passive mode is
+supported, which is all the FTP transport uses.  File transfers are
+recorded in the device history as "RETR <path>" and "STOR <path>".
+*/
+func (d *Device) ServeFTP(addr string) (string, error) {
+	return d.serve(addr, d.ftpSession)
+}
+
+type ftpSession struct {
+	d      *Device
+	c      net.Conn
+	user   string
+	authed bool
+	cwd    string
+	pasv   net.Listener
+}
+
+func (d *Device) ftpSession(c net.Conn) {
+	f := &ftpSession{d: d, c: c, cwd: "/"}
+	defer f.closePasv()
+
+	r := bufio.NewReader(c)
+	f.reply(220, "%s FTP server ready", d.Personality.Name)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		parts := strings.SplitN(line, " ", 2)
+		cmd := strings.ToUpper(parts[0])
+		arg := ""
+		if len(parts) > 1 {
+			arg = strings.TrimSpace(parts[1])
+		}
+
+		switch cmd {
+		case "USER":
+			f.user = arg
+			f.authed = false
+			f.reply(331, "User name okay, need password")
+			continue
+		case "PASS":
+			if _, ok := d.authenticate(f.user, arg); ok {
+				f.authed = true
+				f.reply(230, "User logged in")
+			} else {
+				f.reply(530, "Login incorrect")
+			}
+			continue
+		case "QUIT":
+			f.reply(221, "Goodbye")
+			return
+		case "NOOP":
+			f.reply(200, "OK")
+			continue
+		case "SYST":
+			f.reply(215, "UNIX Type: L8")
+			continue
+		}
+
+		if !f.authed {
+			f.reply(530, "Not logged in")
+			continue
+		}
+
+		switch cmd {
+		case "TYPE":
+			f.reply(200, "Type set to %s", arg)
+		case "PWD":
+			f.reply(257, "\"%s\" is the current directory", f.cwd)
+		case "CWD":
+			dir := f.resolve(arg)
+			if !d.Files.IsDir(dir) {
+				f.reply(550, "%s: No such directory", arg)
+				continue
+			}
+			f.cwd = dir
+			f.reply(250, "Directory changed to %s", dir)
+		case "CDUP":
+			f.cwd = path.Dir(f.cwd)
+			f.reply(250, "Directory changed to %s", f.cwd)
+		case "PASV":
+			f.passive()
+		case "LIST", "NLST":
+			names := d.Files.List(f.resolve(arg))
+			f.transfer(func(data net.Conn) error {
+				for _, n := range names {
+					if _, err := fmt.Fprintf(data, "%s\r\n", n); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		case "RETR":
+			name := f.resolve(arg)
+			content, ok := d.Files.Get(name)
+			if !ok {
+				f.reply(550, "%s: No such file", arg)
+				continue
+			}
+			d.record("RETR " + name)
+			f.transfer(func(data net.Conn) error {
+				if _, err := data.Write(content); err != nil {
+					return err
+				}
+				// goftp discards whatever is buffered after the 150 reply,
+				// so hold the 226 until the client has closed its end
+				if tc, ok := data.(*net.TCPConn); ok {
+					tc.CloseWrite()
+					data.SetReadDeadline(time.Now().Add(ftpDataTimeout))
+					io.Copy(ioutil.Discard, data)
+				}
+				return nil
+			})
+		case "STOR":
+			name := f.resolve(arg)
+			d.record("STOR " + name)
+			f.transfer(func(data net.Conn) error {
+				content, err := ioutil.ReadAll(data)
+				if err != nil {
+					return err
+				}
+				d.Files.Put(name, content)
+				return nil
+			})
+		case "DELE":
+			if !d.Files.Remove(f.resolve(arg)) {
+				f.reply(550, "%s: No such file", arg)
+				continue
+			}
+			f.reply(250, "File removed")
+		default:
+			f.reply(502, "Command not implemented")
+		}
+	}
+}
+
+func (f *ftpSession) reply(code int, format string, a ...interface{}) {
+	fmt.Fprintf(f.c, "%d %s\r\n", code, fmt.Sprintf(format, a...))
+}
+
+func (f *ftpSession) resolve(name string) string {
+	if name == "" {
+		return f.cwd
+	}
+	if strings.HasPrefix(name, "/") {
+		return cleanPath(name)
+	}
+	return cleanPath(path.Join(f.cwd, name))
+}
+
+func (f *ftpSession) passive() {
+	f.closePasv()
+
+	host, _, _ := net.SplitHostPort(f.c.LocalAddr().String())
+	ip := net.ParseIP(host).To4()
+	if ip == nil {
+		ip = net.IPv4(127, 0, 0, 1).To4()
+	}
+
+	l, err := net.Listen("tcp", net.JoinHostPort(ip.String(), "0"))
+	if err != nil {
+		f.reply(425, "Can not open data connection")
+		return
+	}
+	f.pasv = l
+
+	port := l.Addr().(*net.TCPAddr).Port
+	f.reply(227, "Entering Passive Mode (%d,%d,%d,%d,%d,%d)",
+		ip[0], ip[1], ip[2], ip[3], port>>8, port&0xff)
+}
+
+func (f *ftpSession) closePasv() {
+	if f.pasv != nil {
+		f.pasv.Close()
+		f.pasv = nil
+	}
+}
+
+// transfer runs fn over the passive data connection
+func (f *ftpSession) transfer(fn func(net.Conn) error) {
+	if f.pasv == nil {
+		f.reply(425, "Use PASV first")
+		return
+	}
+	defer f.closePasv()
+
+	f.reply(150, "Opening data connection")
+
+	if tl, ok := f.pasv.(*net.TCPListener); ok {
+		tl.SetDeadline(time.Now().Add(ftpDataTimeout))
+	}
+	data, err := f.pasv.Accept()
+	if err != nil {
+		f.reply(425, "Can not open data connection")
+		return
+	}
+
+	err = fn(data)
+	data.Close()
+	if err != nil && err != io.EOF {
+		f.reply(451, "Transfer aborted: %s", err.Error())
+		return
+	}
+	f.reply(226, "Transfer complete")
+}
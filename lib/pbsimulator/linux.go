@@ -0,0 +1,381 @@
+package simulator
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"bufio"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+/*
+Linux is a Linux host with upstart services, as managed by the linux
+driver.  Logins are checked against the user table, root/root by default.
+Command lines run through a small shell that understands ;, &&, | and
+output redirection, and offers echo, cat, rm, sed -i, chpasswd, service,
+hostname, whoami, true and false over the device files.  Services are
+kept in the device values as service.<name>, either "running" or
+"stopped".
+*/
+func Linux() *Personality {
+	return &Personality{
+		Name:           "Linux",
+		Banner:         "Welcome to Ubuntu 14.04.5 LTS\n\n",
+		Login:          true,
+		LoginPrompt:    "simhost login: ",
+		PasswordPrompt: "Password: ",
+		LoginFailed:    "\nLogin incorrect\n",
+		Levels: []Level{
+			{Name: "user", Prompt: "$ "},
+		},
+		Default: linuxShell,
+		Users: map[string]string{
+			"root": "root",
+		},
+		Values: map[string]string{
+			"service.ssh":    "running",
+			"service.vsftpd": "running",
+			"service.cron":   "running",
+		},
+		Files: map[string]string{
+			"/etc/hostname":       "simhost\n",
+			"/etc/default/ssh":    "SSHD_OPTS=\n",
+			"/etc/default/vsftpd": "",
+		},
+	}
+}
+
+type shToken struct {
+	text string
+	op   bool
+}
+
+// shTokenize splits a command line into words and operators, removing
+// quotes
+func shTokenize(line string) ([]shToken, error) {
+	var toks []shToken
+	var word []rune
+	inWord := false
+	var quote rune
+
+	flush := func() {
+		if inWord {
+			toks = append(toks, shToken{text: string(word)})
+		}
+		word = word[:0]
+		inWord = false
+	}
+
+	runes := []rune(line)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word = append(word, r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case r == '\\' && i+1 < len(runes):
+			i++
+			word = append(word, runes[i])
+			inWord = true
+		case r == ' ' || r == '\t':
+			flush()
+		case r == ';' || r == '|' || r == '>' || r == '&':
+			flush()
+			op := string(r)
+			if i+1 < len(runes) && runes[i+1] == r && r != ';' {
+				op += string(r)
+				i++
+			}
+			toks = append(toks, shToken{text: op, op: true})
+		default:
+			word = append(word, r)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("Syntax error: Unterminated quoted string")
+	}
+	flush()
+	return toks, nil
+}
+
+func linuxShell(s *Session, line string) (string, int) {
+	toks, err := shTokenize(line)
+	if err != nil {
+		return "sh: 1: " + err.Error() + "\n", 2
+	}
+
+	var out string
+	status := 0
+	skip := false
+	var pipeline []shToken
+	run := func() {
+		if !skip && len(pipeline) > 0 {
+			o, st := shPipeline(s, pipeline)
+			out += o
+			status = st
+		}
+		pipeline = nil
+	}
+
+	for _, t := range toks {
+		if t.op && (t.text == ";" || t.text == "&&") {
+			run()
+			skip = t.text == "&&" && status != 0
+			continue
+		}
+		pipeline = append(pipeline, t)
+	}
+	run()
+	return out, status
+}
+
+// shPipeline runs commands joined by |, honouring > and >> on each
+func shPipeline(s *Session, toks []shToken) (string, int) {
+	var stdin, out string
+	status := 0
+
+	var cmds [][]shToken
+	start := 0
+	for i, t := range toks {
+		if t.op && t.text == "|" {
+			cmds = append(cmds, toks[start:i])
+			start = i + 1
+		}
+	}
+	cmds = append(cmds, toks[start:])
+
+	for _, cmd := range cmds {
+		var args []string
+		var redirect, mode string
+		for i := 0; i < len(cmd); i++ {
+			t := cmd[i]
+			if t.op && (t.text == ">" || t.text == ">>") {
+				if i+1 >= len(cmd) || cmd[i+1].op {
+					return "sh: 1: Syntax error: redirection unexpected\n", 2
+				}
+				mode = t.text
+				redirect = cmd[i+1].text
+				i++
+				continue
+			}
+			if t.op {
+				return fmt.Sprintf("sh: 1: Syntax error: \"%s\" unexpected\n", t.text), 2
+			}
+			args = append(args, t.text)
+		}
+
+		var stdout, stderr string
+		if len(args) > 0 {
+			stdout, stderr, status = shCommand(s, args, stdin)
+		}
+		out += stderr
+
+		switch mode {
+		case ">":
+			s.Device.Files.Put(redirect, []byte(stdout))
+			stdout = ""
+		case ">>":
+			s.Device.Files.Append(redirect, []byte(stdout))
+			stdout = ""
+		}
+		stdin = stdout
+	}
+	return out + stdin, status
+}
+
+func shCommand(s *Session, args []string, stdin string) (stdout, stderr string, status int) {
+	d := s.Device
+	switch args[0] {
+	case "true":
+		return "", "", 0
+	case "false":
+		return "", "", 1
+	case "echo":
+		if len(args) > 1 && args[1] == "-n" {
+			return strings.Join(args[2:], " "), "", 0
+		}
+		return strings.Join(args[1:], " ") + "\n", "", 0
+	case "hostname":
+		data, _ := d.Files.Get("/etc/hostname")
+		return string(data), "", 0
+	case "whoami":
+		return s.User + "\n", "", 0
+	case "cat":
+		if len(args) == 1 {
+			return stdin, "", 0
+		}
+		for _, f := range args[1:] {
+			data, ok := d.Files.Get(f)
+			if !ok {
+				stderr += fmt.Sprintf("cat: %s: No such file or directory\n", f)
+				status = 1
+				continue
+			}
+			stdout += string(data)
+		}
+		return
+	case "rm":
+		force := false
+		for _, f := range args[1:] {
+			if f == "-f" {
+				force = true
+				continue
+			}
+			if !d.Files.Remove(f) && !force {
+				stderr += fmt.Sprintf("rm: cannot remove '%s': No such file or directory\n", f)
+				status = 1
+			}
+		}
+		return
+	case "chpasswd":
+		sc := bufio.NewScanner(strings.NewReader(stdin))
+		for sc.Scan() {
+			up := strings.SplitN(sc.Text(), ":", 2)
+			if len(up) != 2 {
+				continue
+			}
+			if _, ok := d.Password(up[0]); !ok {
+				stderr += fmt.Sprintf("chpasswd: line 1: user '%s' does not exist\n", up[0])
+				status = 1
+				continue
+			}
+			d.SetPassword(up[0], up[1])
+		}
+		return
+	case "service":
+		return shService(d, args)
+	case "sed":
+		return shSed(d, args)
+	}
+	return "", fmt.Sprintf("sh: 1: %s: not found\n", args[0]), 127
+}
+
+// shService starts and stops upstart jobs, with upstart's complaints
+func shService(d *Device, args []string) (stdout, stderr string, status int) {
+	if len(args) < 3 {
+		return "", "Usage: service < option > | --status-all | [ service_name [ command | --full-restart ] ]\n", 1
+	}
+	name, action := args[1], args[2]
+	state := d.Value("service." + name)
+	if state == "" {
+		return "", fmt.Sprintf("%s: unrecognized service\n", name), 1
+	}
+
+	switch action {
+	case "start":
+		if state == "running" {
+			return "", fmt.Sprintf("start: Job is already running: %s\n", name), 1
+		}
+		d.SetValue("service."+name, "running")
+		return fmt.Sprintf("%s start/running, process 1234\n", name), "", 0
+	case "stop":
+		if state != "running" {
+			return "", "stop: Unknown instance: \n", 1
+		}
+		d.SetValue("service."+name, "stopped")
+		return fmt.Sprintf("%s stop/waiting\n", name), "", 0
+	case "restart":
+		d.SetValue("service."+name, "running")
+		return fmt.Sprintf("%s start/running, process 1234\n", name), "", 0
+	case "status":
+		if state == "running" {
+			return fmt.Sprintf("%s start/running, process 1234\n", name), "", 0
+		}
+		return fmt.Sprintf("%s stop/waiting\n", name), "", 0
+	}
+	return "", fmt.Sprintf("%s: unknown action %s\n", name, action), 1
+}
+
+// shSed supports in place substitution, sed -i -e 's/re/repl/[g]' file
+func shSed(d *Device, args []string) (stdout, stderr string, status int) {
+	var expr string
+	var files []string
+	for i := 1; i < len(args); i++ {
+		switch {
+		case args[i] == "-i":
+		case args[i] == "-e" && i+1 < len(args):
+			i++
+			expr = args[i]
+		case expr == "":
+			expr = args[i]
+		default:
+			files = append(files, args[i])
+		}
+	}
+
+	re, repl, global, err := parseSubst(expr)
+	if err != nil {
+		return "", "sed: -e expression #1: " + err.Error() + "\n", 1
+	}
+
+	for _, f := range files {
+		data, ok := d.Files.Get(f)
+		if !ok {
+			stderr += fmt.Sprintf("sed: can't read %s: No such file or directory\n", f)
+			status = 2
+			continue
+		}
+		lines := strings.SplitAfter(string(data), "\n")
+		for i, l := range lines {
+			nl := strings.HasSuffix(l, "\n")
+			l = strings.TrimSuffix(l, "\n")
+			if global {
+				l = re.ReplaceAllString(l, repl)
+			} else if loc := re.FindStringSubmatchIndex(l); loc != nil {
+				var dst []byte
+				dst = re.ExpandString(dst, repl, l, loc)
+				l = l[:loc[0]] + string(dst) + l[loc[1]:]
+			}
+			if nl {
+				l += "\n"
+			}
+			lines[i] = l
+		}
+		d.Files.Put(f, []byte(strings.Join(lines, "")))
+	}
+	return
+}
+
+func parseSubst(expr string) (*regexp.Regexp, string, bool, error) {
+	if len(expr) < 2 || expr[0] != 's' {
+		return nil, "", false, fmt.Errorf("unknown command: `%s'", expr)
+	}
+	delim := string(expr[1])
+	parts := strings.Split(expr[2:], delim)
+	if len(parts) != 3 {
+		return nil, "", false, fmt.Errorf("unterminated `s' command")
+	}
+
+	// Basic regular expressions escape their groups
+	pattern := strings.NewReplacer(`\(`, "(", `\)`, ")").Replace(parts[0])
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, "", false, err
+	}
+
+	repl := strings.NewReplacer("$", "$$", "&", "${0}",
+		`\1`, "${1}", `\2`, "${2}", `\3`, "${3}").Replace(parts[1])
+	return re, repl, strings.Contains(parts[2], "g"), nil
+}
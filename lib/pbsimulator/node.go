@@ -0,0 +1,147 @@
+package simulator
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+
+	"golang.org/x/net/context"
+
+	change "github.com/iti/pbconf/lib/pbchange"
+	config "github.com/iti/pbconf/lib/pbconfig"
+	database "github.com/iti/pbconf/lib/pbdatabase"
+	global "github.com/iti/pbconf/lib/pbglobal"
+	trans "github.com/iti/pbconf/lib/pbtranslate"
+	driver "github.com/iti/pbconf/lib/pbtranslate/driver"
+)
+
+/*
+Node is the part of a PBCONF node drivers talk to: the database, the
+change management repository and the translation engine, all kept under
+one directory.  Drivers started on the node run in process, so a test can
+call pbtranslate.ExecuteConfig and follow the change down to a simulated
+device.
+
+The translation engine and the change management engine are process
+wide, so only one Node may be created per process.
+*/
+type Node struct {
+	Config *config.Config
+	DB     database.AppDatabase
+	CME    *change.CMEngine
+
+	drivers []func()
+}
+
+func NewNode(dir string) (*Node, error) {
+	cfg := new(config.Config)
+	cfg.Global.NodeName = "simulator"
+	cfg.Global.Database = filepath.Join(dir, "pbconf.db")
+	cfg.ChMgmt.RepoPath = filepath.Join(dir, "repo")
+	cfg.Translation.SocketDir = filepath.Join(dir, "sockets")
+
+	if err := os.MkdirAll(cfg.Translation.SocketDir, 0700); err != nil {
+		return nil, err
+	}
+
+	if global.CTX == nil {
+		global.CTX = context.Background()
+	}
+	global.CTX = context.WithValue(global.CTX, "configuration", cfg)
+
+	db := database.Open(cfg.Global.Database, cfg.Global.LogLevel)
+	if err := db.Ping(); err != nil {
+		return nil, err
+	}
+	db.LoadSchema()
+	db.LoadRootNode(cfg.Global.NodeName)
+
+	cme, err := change.GetCMEngine(cfg)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if _, err := trans.Start(cfg); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Node{Config: cfg, DB: db, CME: cme}, nil
+}
+
+/*
+AddDevice creates a device with the given config items, such as
+drivertransport and driverlocation, and metadata, which must include the
+driver name under "driver".  The new device id is returned.
+*/
+func (n *Node) AddDevice(name string, items, meta map[string]string) (int64, error) {
+	root := database.PbNode{Name: n.Config.Global.NodeName}
+	if err := root.GetByName(n.DB); err != nil {
+		return 0, err
+	}
+
+	dev := database.PbDevice{Name: name, ParentNode: &root.Id}
+	for _, k := range sortedKeys(items) {
+		dev.ConfigItems = append(dev.ConfigItems, database.ConfigItem{Key: k, Value: items[k]})
+	}
+	if err := dev.Create(n.DB); err != nil {
+		return 0, err
+	}
+	if err := dev.GetByName(n.DB); err != nil {
+		return 0, err
+	}
+
+	for _, k := range sortedKeys(meta) {
+		if err := n.CME.VersionMeta(name, k, meta[k]); err != nil {
+			return 0, err
+		}
+	}
+	return dev.Id, nil
+}
+
+// StartDriver runs a driver service in process and registers it with the
+// translation engine
+func (n *Node) StartDriver(d driver.DriverService) error {
+	stop, err := driver.Start(d, n.Config)
+	if err != nil {
+		return err
+	}
+	n.drivers = append(n.drivers, stop)
+	return nil
+}
+
+// Close stops the drivers and closes the database.  The translation
+// engine keeps running until the process exits.
+func (n *Node) Close() error {
+	for _, stop := range n.drivers {
+		stop()
+	}
+	n.drivers = nil
+	return n.DB.Close()
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,176 @@
+package simulator
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"strings"
+)
+
+// Level is an access level of a device, identified by its prompt
+type Level struct {
+	Name   string
+	Prompt string
+}
+
+/*
+Handler runs a command.  args holds the command line split on white
+space, with the command name first.  The output is returned with the exit
+status reported to SSH clients.
+*/
+type Handler func(s *Session, args []string) (string, int)
+
+// LineHandler runs a whole command line, for instance through a shell
+type LineHandler func(s *Session, line string) (string, int)
+
+type Command struct {
+	Level int // Lowest access level allowed to run the command
+	Run   Handler
+}
+
+/*
+Personality describes how a kind of device behaves.  The session state
+machine is driven by the access levels and the command table: a session
+starts at the first level (or at LoginLevel once logged in), shows the
+prompt of its current level, and commands move it between levels, ask
+for passwords, change the settings files, and so on.
+*/
+type Personality struct {
+	Name string
+
+	// Banner is shown when an interactive session starts
+	Banner string
+
+	// Telnet sessions ask for a username and password when Login is set
+	Login          bool
+	LoginPrompt    string
+	PasswordPrompt string
+	LoginFailed    string
+
+	Levels     []Level
+	LoginLevel int
+
+	Commands map[string]Command
+	// FoldCase matches command names case insensitively.  Command table
+	// keys must then be upper case.
+	FoldCase bool
+	// Abbrev, when set, is how many leading characters of a command name
+	// are significant, as on SEL relays where ACCESS is ACC
+	Abbrev int
+	// Default runs lines whose first word is not in Commands, for
+	// instance a shell.  Without it such lines get Unknown.
+	Default LineHandler
+	Unknown string
+	Denied  string
+
+	// Initial device state
+	Users  map[string]string
+	Values map[string]string
+	Files  map[string]string
+
+	// Authenticate overrides the password check of the login and file
+	// transfer servers
+	Authenticate func(d *Device, user, password string) (int, bool)
+}
+
+/*
+Session is one conversation with a device: a telnet connection, an
+interactive SSH shell, or a single SSH command.
+*/
+type Session struct {
+	Device *Device
+	Level  int
+	User   string
+
+	closed bool
+	ask    *question
+}
+
+type question struct {
+	prompt string
+	answer func(s *Session, answer string) string
+}
+
+func (d *Device) NewSession(user string, level int) *Session {
+	return &Session{Device: d, User: user, Level: level}
+}
+
+// Prompt is what the device shows while waiting for the next line
+func (s *Session) Prompt() string {
+	if s.ask != nil {
+		return s.ask.prompt
+	}
+	levels := s.Device.Personality.Levels
+	if s.Level < 0 || s.Level >= len(levels) {
+		return ""
+	}
+	return levels[s.Level].Prompt
+}
+
+// Ask makes the next line an answer to prompt instead of a command
+func (s *Session) Ask(prompt string, fn func(s *Session, answer string) string) {
+	s.ask = &question{prompt: prompt, answer: fn}
+}
+
+func (s *Session) Close() {
+	s.closed = true
+}
+
+func (s *Session) Closed() bool {
+	return s.closed
+}
+
+// Input handles a line typed at the prompt and returns the response
+func (s *Session) Input(line string) string {
+	if q := s.ask; q != nil {
+		s.ask = nil
+		return q.answer(s, line)
+	}
+	if strings.TrimSpace(line) == "" {
+		return ""
+	}
+	out, _ := s.Exec(line)
+	return out
+}
+
+// Exec runs a command line, ignoring any pending question
+func (s *Session) Exec(line string) (string, int) {
+	p := s.Device.Personality
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		return "", 0
+	}
+	s.Device.record(strings.TrimSpace(line))
+
+	name := args[0]
+	if p.FoldCase {
+		name = strings.ToUpper(name)
+	}
+	if p.Abbrev > 0 && len(name) > p.Abbrev {
+		name = name[:p.Abbrev]
+	}
+	cmd, ok := p.Commands[name]
+	if !ok {
+		if p.Default != nil {
+			return p.Default(s, line)
+		}
+		return p.Unknown, 127
+	}
+	if s.Level < cmd.Level {
+		return p.Denied, 1
+	}
+	return cmd.Run(s, args)
+}
@@ -0,0 +1,174 @@
+package simulator
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SEL421Port5 is the Ethernet port settings file of the simulated relay,
+// as seen over FTP
+const SEL421Port5 = "/SEL-421-1/SETTINGS/SET_P5.TXT"
+
+// Factory default access level passwords
+const (
+	SEL421Level1Password = "OTTER"
+	SEL421Level2Password = "TAIL"
+)
+
+// The default port 5 settings.  Enables are written "NAME","Y" and FTP
+// server settings NAME=value, as the SEL-421 driver writes them back.
+const sel421Port5Settings = `[P5]
+"EPORT","Y"
+MAXACC,"2"
+IPADDR,"192.168.1.2/24"
+DEFRTR,"192.168.1.1"
+"ETCPKA","Y"
+"ETELNET","Y"
+TPORT,"23"
+"EFTPSERV","Y"
+FTPCBAN=FTP SERVER:
+FTPIDLE=5
+FTPANMS=N
+FTPAUSER=2
+"EHTTP","N"
+`
+
+// Access level usernames, as used by ACC/2AC and by FTP logins
+var sel421Users = map[int]string{1: "1AC", 2: "2AC"}
+
+/*
+SEL421 is an SEL-421 protection relay.  Sessions start at access level 0
+with the = prompt.  ACC and 2AC ask for the level 1 and level 2
+passwords and move to the => and =>> prompts, QUI drops back to level 0
+and PAS changes a level password, either as PAS <level> <password> or
+interactively.  The FTP server accepts the level usernames 1AC and 2AC
+with the matching password, and serves the settings files.
+*/
+func SEL421() *Personality {
+	return &Personality{
+		Name:   "SEL-421",
+		Banner: "\nSEL-421\n\n",
+		Levels: []Level{
+			{Name: "0", Prompt: "="},
+			{Name: "1", Prompt: "=>"},
+			{Name: "2", Prompt: "=>>"},
+		},
+		FoldCase: true,
+		Abbrev:   3,
+		Unknown:  "\nInvalid Command\n\n",
+		Denied:   "\nInvalid Access Level\n\n",
+		Commands: map[string]Command{
+			"ACC": {Level: 0, Run: sel421Access(1)},
+			"2AC": {Level: 1, Run: sel421Access(2)},
+			"PAS": {Level: 2, Run: sel421Password},
+			"QUI": {Level: 0, Run: sel421Quit},
+			"ID":  {Level: 0, Run: sel421ID},
+			"SHO": {Level: 1, Run: sel421Show},
+			"EXI": {Level: 0, Run: func(s *Session, args []string) (string, int) {
+				s.Close()
+				return "", 0
+			}},
+		},
+		Users: map[string]string{
+			"1AC": SEL421Level1Password,
+			"2AC": SEL421Level2Password,
+		},
+		Files: map[string]string{
+			SEL421Port5: strings.Replace(sel421Port5Settings, "\n", "\r\n", -1),
+		},
+		Authenticate: func(d *Device, user, password string) (int, bool) {
+			for level, u := range sel421Users {
+				if strings.ToUpper(user) != u {
+					continue
+				}
+				pw, ok := d.Password(u)
+				return level, ok && pw == password
+			}
+			return 0, false
+		},
+	}
+}
+
+func sel421Banner(level int) string {
+	return fmt.Sprintf("\nSEL-421\nLevel %d\n\n", level)
+}
+
+func sel421Access(level int) Handler {
+	return func(s *Session, args []string) (string, int) {
+		if s.Level >= level {
+			return sel421Banner(s.Level), 0
+		}
+		s.Ask("Password: ?", func(s *Session, answer string) string {
+			pw, _ := s.Device.Password(sel421Users[level])
+			if answer != pw {
+				return "\nInvalid Password\n\n"
+			}
+			s.Level = level
+			return sel421Banner(level)
+		})
+		return "", 0
+	}
+}
+
+func sel421Password(s *Session, args []string) (string, int) {
+	if len(args) < 2 {
+		return "\nInvalid Format\n\n", 1
+	}
+	var user string
+	switch args[1] {
+	case "1":
+		user = sel421Users[1]
+	case "2":
+		user = sel421Users[2]
+	default:
+		return "\nInvalid Level\n\n", 1
+	}
+
+	if len(args) > 2 {
+		s.Device.SetPassword(user, args[2])
+		return "\nSet\n\n", 0
+	}
+	s.Ask("Password: ?", func(s *Session, answer string) string {
+		s.Device.SetPassword(user, answer)
+		return "\nSet\n\n"
+	})
+	return "", 0
+}
+
+func sel421Quit(s *Session, args []string) (string, int) {
+	s.Level = 0
+	return sel421Banner(0), 0
+}
+
+func sel421ID(s *Session, args []string) (string, int) {
+	return "\n\"FID=SEL-421-R126-V0-Z024016-D20170915\",\"0964\"\n" +
+		"\"DEVID=SEL-421\",\"0402\"\n\n", 0
+}
+
+// sel421Show handles SHO P <port>, listing the port settings
+func sel421Show(s *Session, args []string) (string, int) {
+	if len(args) < 3 || strings.ToUpper(args[1]) != "P" {
+		return "\nInvalid Format\n\n", 1
+	}
+	data, ok := s.Device.Files.Get(fmt.Sprintf("/SEL-421-1/SETTINGS/SET_P%s.TXT", args[2]))
+	if !ok {
+		return "\nInvalid Port\n\n", 1
+	}
+	return "\n" + strings.Replace(string(data), "\r\n", "\n", -1) + "\n", 0
+}
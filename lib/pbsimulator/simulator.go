@@ -0,0 +1,286 @@
+package simulator
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+/*
+Package simulator stands up local telnet, SSH and FTP servers that behave
+like the devices PBCONF manages, so drivers and transports can be tested
+without the hardware.
+
+A Device is created from a Personality, which describes the prompts,
+access levels, commands and initial settings files of a kind of device.
+SEL421 and Linux are provided.  Each server a Device is asked to serve
+shares the same state, so a password changed over telnet is the one
+checked by the FTP server, and a settings file stored over FTP is the one
+read back by a test.
+
+Node runs the parts of a PBCONF node that drivers need, so that tests can
+go all the way from pbtranslate.ExecuteConfig to the simulated device.
+*/
+
+import (
+	"net"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	logging "github.com/iti/pbconf/lib/pblogger"
+)
+
+var log logging.Logger
+
+func init() {
+	log, _ = logging.GetLogger("Simulator")
+}
+
+// Device is a simulated device, reachable over any of the servers started
+// on it
+type Device struct {
+	Personality *Personality
+	Files       *Files
+
+	// Forwarding lets SSH clients open tunnels through the device, so it
+	// can stand in for a jump host
+	Forwarding bool
+
+	mx        sync.Mutex
+	passwords map[string]string
+	values    map[string]string
+	history   []string
+	listeners []net.Listener
+	conns     map[net.Conn]bool
+}
+
+func NewDevice(p *Personality) *Device {
+	d := &Device{
+		Personality: p,
+		Files:       NewFiles(),
+		passwords:   make(map[string]string),
+		values:      make(map[string]string),
+		conns:       make(map[net.Conn]bool),
+	}
+	for u, pw := range p.Users {
+		d.passwords[u] = pw
+	}
+	for k, v := range p.Values {
+		d.values[k] = v
+	}
+	for name, data := range p.Files {
+		d.Files.Put(name, []byte(data))
+	}
+	return d
+}
+
+// Password returns the current password of a user or access level
+func (d *Device) Password(user string) (string, bool) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	pw, ok := d.passwords[user]
+	return pw, ok
+}
+
+func (d *Device) SetPassword(user, password string) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	d.passwords[user] = password
+}
+
+// Value returns an item of device state kept by the personality, such as
+// whether a service is running
+func (d *Device) Value(key string) string {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	return d.values[key]
+}
+
+func (d *Device) SetValue(key, val string) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	d.values[key] = val
+}
+
+// History lists every command run on the device, in order, over any
+// server.  Answers to password prompts are not recorded.
+func (d *Device) History() []string {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	return append([]string{}, d.history...)
+}
+
+func (d *Device) record(cmd string) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	d.history = append(d.history, cmd)
+}
+
+// authenticate checks credentials and returns the access level they grant
+func (d *Device) authenticate(user, password string) (int, bool) {
+	if d.Personality.Authenticate != nil {
+		return d.Personality.Authenticate(d, user, password)
+	}
+	pw, ok := d.Password(user)
+	if !ok || pw != password {
+		return 0, false
+	}
+	return d.Personality.LoginLevel, true
+}
+
+// Close stops every server of the device and drops open sessions
+func (d *Device) Close() error {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	for _, l := range d.listeners {
+		l.Close()
+	}
+	for c := range d.conns {
+		c.Close()
+	}
+	d.listeners = nil
+	d.conns = make(map[net.Conn]bool)
+	return nil
+}
+
+// serve accepts connections on addr and hands each to handle, returning
+// the address actually listened on
+func (d *Device) serve(addr string, handle func(net.Conn)) (string, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+
+	d.mx.Lock()
+	d.listeners = append(d.listeners, l)
+	d.mx.Unlock()
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			d.track(c)
+			go func() {
+				defer d.untrack(c)
+				handle(c)
+			}()
+		}
+	}()
+
+	return l.Addr().String(), nil
+}
+
+func (d *Device) track(c net.Conn) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	d.conns[c] = true
+}
+
+func (d *Device) untrack(c net.Conn) {
+	c.Close()
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	delete(d.conns, c)
+}
+
+// Files is the settings file store of a device
+type Files struct {
+	mx    sync.Mutex
+	files map[string][]byte
+}
+
+func NewFiles() *Files {
+	return &Files{files: make(map[string][]byte)}
+}
+
+func cleanPath(name string) string {
+	return path.Clean("/" + name)
+}
+
+func (f *Files) Get(name string) ([]byte, bool) {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	data, ok := f.files[cleanPath(name)]
+	if !ok {
+		return nil, false
+	}
+	return append([]byte{}, data...), true
+}
+
+func (f *Files) Put(name string, data []byte) {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	f.files[cleanPath(name)] = append([]byte{}, data...)
+}
+
+func (f *Files) Append(name string, data []byte) {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	name = cleanPath(name)
+	f.files[name] = append(f.files[name], data...)
+}
+
+func (f *Files) Remove(name string) bool {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	name = cleanPath(name)
+	_, ok := f.files[name]
+	delete(f.files, name)
+	return ok
+}
+
+// List returns the names of the files and directories directly in dir
+func (f *Files) List(dir string) []string {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+
+	dir = cleanPath(dir)
+	if dir != "/" {
+		dir += "/"
+	}
+	seen := make(map[string]bool)
+	for name := range f.files {
+		if !strings.HasPrefix(name, dir) {
+			continue
+		}
+		entry := strings.SplitN(strings.TrimPrefix(name, dir), "/", 2)[0]
+		seen[entry] = true
+	}
+
+	names := make([]string, 0, len(seen))
+	for n := range seen {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// IsDir reports whether any file lives under dir
+func (f *Files) IsDir(dir string) bool {
+	dir = cleanPath(dir)
+	if dir == "/" {
+		return true
+	}
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	for name := range f.files {
+		if strings.HasPrefix(name, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,239 @@
+package simulator
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	transport "github.com/iti/pbconf/lib/pbtransport"
+)
+
+func begin(t *testing.T, name string) {
+	fmt.Printf("##################### Begin Simulator::%s #####################\n", name)
+}
+
+func end(t *testing.T, name string) {
+	fmt.Printf("###################### End Simulator::%s ######################\n", name)
+}
+
+func credentials(user, pass string) transport.CredentialFn {
+	return func(id int64) (string, string, error) {
+		return user, pass, nil
+	}
+}
+
+func TestSEL421Levels(t *testing.T) {
+	begin(t, "TestSEL421Levels")
+	defer end(t, "TestSEL421Levels")
+
+	d := NewDevice(SEL421())
+	s := d.NewSession("", 0)
+
+	steps := []struct {
+		line   string
+		prompt string
+	}{
+		{"2ac", "="}, // Not allowed from level 0
+		{"acc", "Password: ?"},
+		{"wrong", "="},
+		{"ACCESS", "Password: ?"},
+		{SEL421Level1Password, "=>"},
+		{"2AC", "Password: ?"},
+		{SEL421Level2Password, "=>>"},
+		{"PAS 1 NEWPASS", "=>>"},
+		{"qui", "="},
+	}
+	for _, step := range steps {
+		s.Input(step.line)
+		if p := s.Prompt(); p != step.prompt {
+			t.Fatalf("After %q expected prompt %q, got %q", step.line, step.prompt, p)
+		}
+	}
+
+	if pw, _ := d.Password("1AC"); pw != "NEWPASS" {
+		t.Errorf("PAS did not change the level 1 password")
+	}
+	if h := d.History(); len(h) != 6 {
+		t.Errorf("Password answers should not be recorded: %v", h)
+	}
+}
+
+func TestTelnetLogin(t *testing.T) {
+	begin(t, "TestTelnetLogin")
+	defer end(t, "TestTelnetLogin")
+
+	d := NewDevice(Linux())
+	defer d.Close()
+	addr, err := d.ServeTelnet("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tn := transport.NewTelnet("Simulator").(*transport.Telnet)
+	tn.SetCredentialFn(credentials("root", "wrong"))
+	if err = tn.Dial(1, addr); err == nil {
+		t.Fatal("Login with a bad password succeeded")
+	} else if _, ok := err.(transport.ErrAuthFailed); !ok {
+		t.Fatalf("Expected an authentication failure, got %s", err.Error())
+	}
+
+	tn = transport.NewTelnet("Simulator").(*transport.Telnet)
+	tn.SetCredentialFn(credentials("root", "root"))
+	if err = tn.Dial(1, addr); err != nil {
+		t.Fatal(err)
+	}
+	defer tn.Close()
+
+	if _, err = tn.Write([]byte("hostname\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	var out []byte
+	buf := make([]byte, 256)
+	for !strings.Contains(string(out), "simhost\r\n$ ") {
+		n, err := tn.Read(buf)
+		if err != nil {
+			t.Fatalf("Read failed after %q: %s", out, err.Error())
+		}
+		out = append(out, buf[:n]...)
+	}
+}
+
+func TestSSHExec(t *testing.T) {
+	begin(t, "TestSSHExec")
+	defer end(t, "TestSSHExec")
+
+	d := NewDevice(Linux())
+	defer d.Close()
+	addr, err := d.ServeSSH("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := transport.NewSSH("Simulator")
+	s.SetCredentialFn(credentials("root", "root"))
+	if err = s.Dial(1, addr); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if _, err = s.Write([]byte("echo a=1 > /etc/default/x; echo b=2 >> /etc/default/x")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Write([]byte("sed -i -e 's/^a[ ]*=.*/a=3/g' /etc/default/x")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := append([]byte("cat /etc/default/x"), make([]byte, 32)...)
+	n, err := s.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != "a=3\nb=2\n" {
+		t.Errorf("Unexpected file content %q", got)
+	}
+
+	buf = append([]byte("service ssh start"), make([]byte, 64)...)
+	n, err = s.Read(buf)
+	if err == nil || !strings.Contains(string(buf[:n]), "Job is already running") {
+		t.Errorf("Expected upstart to complain, got %q (%v)", buf[:n], err)
+	}
+}
+
+func TestFTP(t *testing.T) {
+	begin(t, "TestFTP")
+	defer end(t, "TestFTP")
+
+	d := NewDevice(SEL421())
+	defer d.Close()
+	addr, err := d.ServeFTP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := transport.NewFTP("Simulator")
+	f.SetCredentialFn(credentials("2AC", SEL421Level2Password))
+	f.Dial(1, addr)
+
+	// The FTP transport hands back io.EOF on a complete transfer
+	data, err := f.RecvFile(SEL421Port5)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "[P5]\r\n") {
+		t.Fatalf("Unexpected settings file %q", data)
+	}
+
+	if err = f.SendFile(SEL421Port5, []byte("[P5]\r\nEPORT,\"N\"\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ = d.Files.Get(SEL421Port5); string(data) != "[P5]\r\nEPORT,\"N\"\r\n" {
+		t.Errorf("Settings file not stored: %q", data)
+	}
+
+	h := d.History()
+	if len(h) != 2 || h[0] != "RETR "+SEL421Port5 || h[1] != "STOR "+SEL421Port5 {
+		t.Errorf("Unexpected history %v", h)
+	}
+}
+
+func TestJumpHost(t *testing.T) {
+	begin(t, "TestJumpHost")
+	defer end(t, "TestJumpHost")
+
+	bastion := NewDevice(Linux())
+	bastion.Forwarding = true
+	bastion.SetPassword("jump", "hop")
+	defer bastion.Close()
+	jumpAddr, err := bastion.ServeSSH("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	relay := NewDevice(SEL421())
+	defer relay.Close()
+	relayAddr, err := relay.ServeTelnet("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr, err := transport.GetTransport("ssh>telnet", "Simulator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := tr.(*transport.Chain)
+	c.SetHopCredentialFn(func(id int64, hop int) (string, string, error) {
+		return "jump", "hop", nil
+	})
+	if err = c.Dial(1, jumpAddr+transport.HopSeparator+relayAddr); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.Write([]byte("ID\r\n"))
+	var out []byte
+	buf := make([]byte, 256)
+	for !strings.Contains(string(out), "DEVID=SEL-421") {
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Fatalf("Read failed after %q: %s", out, err.Error())
+		}
+		out = append(out, buf[:n]...)
+	}
+}
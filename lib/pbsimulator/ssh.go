@@ -0,0 +1,165 @@
+package simulator
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+/*
+ServeSSH starts an SSH server for the device on addr and returns the
+address it listens on.  Commands sent with exec run as a single command
+session, shell requests get the same interactive session as telnet.  A
+fresh host key is generated for every server.
+*/
+func (d *Device) ServeSSH(addr string) (string, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			level, ok := d.authenticate(c.User(), string(pass))
+			if !ok {
+				return nil, errors.New("Permission denied")
+			}
+			return &ssh.Permissions{
+				Extensions: map[string]string{"level": strconv.Itoa(level)},
+			}, nil
+		},
+	}
+	config.AddHostKey(signer)
+
+	return d.serve(addr, func(c net.Conn) {
+		d.sshSession(c, config)
+	})
+}
+
+func (d *Device) sshSession(c net.Conn, config *ssh.ServerConfig) {
+	sc, chans, reqs, err := ssh.NewServerConn(c, config)
+	if err != nil {
+		log.Debug("SSH handshake failed: %s", err.Error())
+		return
+	}
+	defer sc.Close()
+	go ssh.DiscardRequests(reqs)
+
+	level, _ := strconv.Atoi(sc.Permissions.Extensions["level"])
+
+	for nc := range chans {
+		switch nc.ChannelType() {
+		case "session":
+			ch, creqs, err := nc.Accept()
+			if err != nil {
+				continue
+			}
+			go d.sshChannel(ch, creqs, sc.User(), level)
+		case "direct-tcpip":
+			if !d.Forwarding {
+				nc.Reject(ssh.Prohibited, "forwarding is disabled")
+				continue
+			}
+			go d.sshForward(nc)
+		default:
+			nc.Reject(ssh.UnknownChannelType, "unsupported channel type")
+		}
+	}
+}
+
+func (d *Device) sshChannel(ch ssh.Channel, reqs <-chan *ssh.Request, user string, level int) {
+	exit := func(status int) {
+		ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(status)}))
+		ch.Close()
+	}
+
+	for req := range reqs {
+		switch req.Type {
+		case "exec":
+			var payload struct{ Command string }
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+
+			// Clients padding the command with NUL bytes are not uncommon
+			cmd := strings.TrimRight(payload.Command, "\x00")
+			out, status := d.NewSession(user, level).Exec(cmd)
+			io.WriteString(ch, out)
+			exit(status)
+			return
+		case "shell":
+			req.Reply(true, nil)
+			go func() {
+				interact(d.NewSession(user, level), newLineReader(ch), ch)
+				exit(0)
+			}()
+		case "pty-req":
+			req.Reply(true, nil)
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+// sshForward connects a direct-tcpip channel, as opened by a client using
+// the device as a jump host
+func (d *Device) sshForward(nc ssh.NewChannel) {
+	var dst struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	if err := ssh.Unmarshal(nc.ExtraData(), &dst); err != nil {
+		nc.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+
+	conn, err := net.Dial("tcp", net.JoinHostPort(dst.Host, strconv.Itoa(int(dst.Port))))
+	if err != nil {
+		nc.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	ch, reqs, err := nc.Accept()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	go func() {
+		io.Copy(ch, conn)
+		ch.Close()
+	}()
+	io.Copy(conn, ch)
+	conn.Close()
+}
@@ -0,0 +1,199 @@
+package simulator
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+)
+
+// Telnet commands and options used by the server side (RFC 854)
+const (
+	tnSE   = 240
+	tnSB   = 250
+	tnWILL = 251
+	tnWONT = 252
+	tnDO   = 253
+	tnDONT = 254
+	tnIAC  = 255
+
+	tnOptSGA  = 3
+	tnOptNAWS = 31
+)
+
+// ServeTelnet starts a telnet server for the device on addr, for instance
+// "127.0.0.1:0", and returns the address it listens on
+func (d *Device) ServeTelnet(addr string) (string, error) {
+	return d.serve(addr, d.telnetSession)
+}
+
+func (d *Device) telnetSession(c net.Conn) {
+	p := d.Personality
+
+	// Offer a little negotiation, as real devices do, so clients have to
+	// cope with it
+	c.Write([]byte{tnIAC, tnWILL, tnOptSGA, tnIAC, tnDO, tnOptNAWS})
+
+	r := newLineReader(&tnFilter{r: c})
+	s := d.NewSession("", 0)
+
+	if p.Login {
+		loggedIn := false
+		for tries := 0; tries < 3 && !loggedIn; tries++ {
+			io.WriteString(c, p.LoginPrompt)
+			user, err := r.readLine()
+			if err != nil {
+				return
+			}
+			io.WriteString(c, p.PasswordPrompt)
+			pass, err := r.readLine()
+			if err != nil {
+				return
+			}
+			if level, ok := d.authenticate(user, pass); ok {
+				s.User = user
+				s.Level = level
+				loggedIn = true
+			} else {
+				io.WriteString(c, crlf(p.LoginFailed))
+			}
+		}
+		if !loggedIn {
+			return
+		}
+	}
+
+	interact(s, r, c)
+}
+
+// interact runs the prompt loop of an interactive session
+func interact(s *Session, r *lineReader, w io.Writer) {
+	io.WriteString(w, crlf(s.Device.Personality.Banner))
+	for !s.Closed() {
+		if _, err := io.WriteString(w, s.Prompt()); err != nil {
+			return
+		}
+		line, err := r.readLine()
+		if err != nil {
+			return
+		}
+		if _, err := io.WriteString(w, crlf(s.Input(line))); err != nil {
+			return
+		}
+	}
+}
+
+// crlf converts line endings to the network form
+func crlf(s string) string {
+	return strings.Replace(strings.Replace(s, "\r\n", "\n", -1), "\n", "\r\n", -1)
+}
+
+// tnFilter strips telnet commands from the client stream
+type tnFilter struct {
+	r     io.Reader
+	state int
+}
+
+const (
+	tnfData = iota
+	tnfIAC
+	tnfOpt
+	tnfSB
+	tnfSBIAC
+)
+
+func (f *tnFilter) Read(buf []byte) (int, error) {
+	raw := make([]byte, len(buf))
+	for {
+		n, err := f.r.Read(raw)
+		out := buf[:0]
+		for _, b := range raw[:n] {
+			switch f.state {
+			case tnfData:
+				if b == tnIAC {
+					f.state = tnfIAC
+				} else {
+					out = append(out, b)
+				}
+			case tnfIAC:
+				switch b {
+				case tnIAC:
+					out = append(out, b)
+					f.state = tnfData
+				case tnWILL, tnWONT, tnDO, tnDONT:
+					f.state = tnfOpt
+				case tnSB:
+					f.state = tnfSB
+				default:
+					f.state = tnfData
+				}
+			case tnfOpt:
+				f.state = tnfData
+			case tnfSB:
+				if b == tnIAC {
+					f.state = tnfSBIAC
+				}
+			case tnfSBIAC:
+				if b == tnSE {
+					f.state = tnfData
+				} else {
+					f.state = tnfSB
+				}
+			}
+		}
+		if len(out) > 0 || err != nil {
+			return len(out), err
+		}
+	}
+}
+
+// lineReader reads lines ended by CR, LF, CR LF or CR NUL
+type lineReader struct {
+	r      *bufio.Reader
+	skipLF bool
+}
+
+func newLineReader(r io.Reader) *lineReader {
+	return &lineReader{r: bufio.NewReader(r)}
+}
+
+func (l *lineReader) readLine() (string, error) {
+	var line []byte
+	for {
+		b, err := l.r.ReadByte()
+		if err != nil {
+			return string(line), err
+		}
+		if l.skipLF {
+			l.skipLF = false
+			if b == '\n' || b == 0 {
+				continue
+			}
+		}
+		switch b {
+		case '\r':
+			l.skipLF = true
+			return string(line), nil
+		case '\n':
+			return string(line), nil
+		default:
+			line = append(line, b)
+		}
+	}
+}
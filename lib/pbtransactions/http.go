@@ -0,0 +1,177 @@
+package transactions
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	mux "github.com/gorilla/mux"
+	change "github.com/iti/pbconf/lib/pbchange"
+	database "github.com/iti/pbconf/lib/pbdatabase"
+	global "github.com/iti/pbconf/lib/pbglobal"
+	logging "github.com/iti/pbconf/lib/pblogger"
+)
+
+type APIHandler struct {
+	log     logging.Logger
+	db      database.AppDatabase
+	Version int
+}
+
+// transactionInfo is a transaction with its type and status spelled out
+type transactionInfo struct {
+	ID         string
+	ObjectType string
+	Status     string
+	Branch     string
+	Object     string
+	Message    string
+	Author     *change.CMAuthor
+	Created    time.Time
+	Updated    time.Time
+	Review     *change.Review    `json:",omitempty"`
+	ChangeSet  *change.ChangeSet `json:",omitempty"`
+}
+
+func NewAPIHandler(loglevel string, d database.AppDatabase) *APIHandler {
+	l, _ := logging.GetLogger("Transactions API")
+	logging.SetLevel(loglevel, "Transactions API")
+	return &APIHandler{log: l, db: d, Version: 1}
+}
+
+func (a *APIHandler) AddAPIEndpoints(router *mux.Router) {
+	a.log.Info("Registering transactions endpoints")
+
+	for _, v := range global.ApiUrlVersioning {
+		router.HandleFunc(v+"/transactions", a.handleBaseRoute).Methods("GET")
+
+		s := router.PathPrefix(v + "/transactions").Subrouter()
+		s.HandleFunc("/", a.handleBaseRoute).Methods("GET")
+		s.HandleFunc("/{transid}", a.handleWIdRoute).Methods("GET")
+	}
+}
+
+func (a *APIHandler) GetInfo() (string, int) {
+	return "transactions", a.Version
+}
+
+func (a *APIHandler) checkVersion(writer http.ResponseWriter, req *http.Request) *logging.ResponseLogger {
+	//deal with any version in the URL or Accept header
+	version, err := global.ProcessVersioning(req)
+	if err != nil {
+		a.log.Debug("Versioning: %s", err.Error())
+		writer.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	if version != nil && *version > a.Version {
+		a.log.Debug("Version %v not implemented, current version is %v", *version, a.Version)
+		writer.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	return &logging.ResponseLogger{
+		ResponseWriter: writer,
+		Logger:         a.log,
+		SrcNodeName:    global.RootNode,
+	}
+}
+
+// handleBaseRoute lists the transactions, oldest first.  They can be
+// narrowed down with the status and type query parameters.
+func (a *APIHandler) handleBaseRoute(writer http.ResponseWriter, req *http.Request) {
+	resp := a.checkVersion(writer, req)
+	if resp == nil {
+		return
+	}
+
+	engine, err := change.GetCMEngine(nil)
+	if err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "GET /transactions::Could not get instance of CME, error: %s", err.Error())
+		return
+	}
+
+	status := strings.ToUpper(req.URL.Query().Get("status"))
+	ctype := strings.ToUpper(req.URL.Query().Get("type"))
+
+	infos := make([]transactionInfo, 0)
+	for _, t := range engine.Transactions() {
+		if status != "" && t.Status.String() != status {
+			continue
+		}
+		if ctype != "" && t.Ctype.String() != ctype {
+			continue
+		}
+		infos = append(infos, newTransactionInfo(t))
+	}
+
+	jsonStr, err := json.Marshal(infos)
+	if err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "GET /transactions::Could not marshal the transactions Error: %s", err.Error())
+		return
+	}
+	if _, err = resp.Write(jsonStr); err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Notice", "GET /transactions::Writing response body Error: %s", err.Error())
+		return
+	}
+}
+
+func (a *APIHandler) handleWIdRoute(writer http.ResponseWriter, req *http.Request) {
+	resp := a.checkVersion(writer, req)
+	if resp == nil {
+		return
+	}
+
+	engine, err := change.GetCMEngine(nil)
+	if err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "GET /transactions/{transid}::Could not get instance of CME, error: %s", err.Error())
+		return
+	}
+
+	t, err := engine.GetTransaction(mux.Vars(req)["transid"])
+	if err != nil {
+		resp.WriteLog(http.StatusNotFound, "Info", "GET /transactions/{transid}::%s", err.Error())
+		return
+	}
+
+	jsonStr, err := json.Marshal(newTransactionInfo(t))
+	if err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "GET /transactions/{transid}::Could not marshal the transaction Error: %s", err.Error())
+		return
+	}
+	if _, err = resp.Write(jsonStr); err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Notice", "GET /transactions/{transid}::Writing response body Error: %s", err.Error())
+		return
+	}
+}
+
+func newTransactionInfo(t change.Transaction) transactionInfo {
+	return transactionInfo{
+		ID:         t.ID,
+		ObjectType: t.Ctype.String(),
+		Status:     t.Status.String(),
+		Branch:     t.Branch,
+		Object:     t.Object,
+		Message:    t.Message,
+		Author:     t.Author,
+		Created:    t.Created,
+		Updated:    t.Updated,
+		Review:     t.Review,
+		ChangeSet:  t.ChangeSet,
+	}
+}
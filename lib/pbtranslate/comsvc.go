@@ -17,6 +17,7 @@ package pbtranslate
 ***********************************************************************/
 
 import (
+	arbiter "github.com/iti/pbconf/lib/pbarbiter"
 	cme "github.com/iti/pbconf/lib/pbchange"
 	config "github.com/iti/pbconf/lib/pbconfig"
 	logging "github.com/iti/pbconf/lib/pblogger"
@@ -139,6 +140,45 @@ func (s *EngineService) SaveMeta(ctx context.Context, req *driver.KVPair) (*driv
 
 }
 
+/*
+Acquire queues for a lease on a device from the node wide arbiter.  The
+deadline of the calling driver bounds the time spent waiting.
+*/
+func (s *EngineService) Acquire(ctx context.Context, req *driver.LeaseRequest) (*driver.Lease, error) {
+	mode := arbiter.Shared
+	if req.Exclusive {
+		mode = arbiter.Exclusive
+	}
+
+	l, err := arbiter.Get().Acquire(ctx, arbiter.Request{
+		DeviceID: req.Devid.Id,
+		Owner:    req.Owner,
+		Purpose:  req.Purpose,
+		Mode:     mode,
+		Priority: arbiter.Priority(req.Priority),
+		TTL:      time.Duration(req.Ttl) * time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &driver.Lease{Id: l.ID, Devid: req.Devid}, nil
+}
+
+func (s *EngineService) Release(ctx context.Context, req *driver.Lease) (*driver.BoolReply, error) {
+	if err := arbiter.Get().Release(req.Id); err != nil {
+		return driver.ReplyFalse(err)
+	}
+	return driver.ReplyTrue(nil)
+}
+
+func (s *EngineService) Renew(ctx context.Context, req *driver.Lease) (*driver.BoolReply, error) {
+	if err := arbiter.Get().Renew(req.Id); err != nil {
+		return driver.ReplyFalse(err)
+	}
+	return driver.ReplyTrue(nil)
+}
+
 var log logging.Logger
 
 func Start(cfg *config.Config) (chan bool, error) {
@@ -0,0 +1,272 @@
+package pbtranslate
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"strings"
+
+	change "github.com/iti/pbconf/lib/pbchange"
+)
+
+// Redacted stands in for secret values in a ConfigDiff
+const Redacted = "********"
+
+// Variables and service options whose key contains one of these words
+// hold secrets, as passwords always do
+var secretWords = []string{"pass", "secret", "token", "key", "credential", "community"}
+
+// KeyChange is a key that a configuration adds, removes or sets to a new
+// value.  Old is empty for added keys and New for removed ones.
+type KeyChange struct {
+	Svc string `json:",omitempty"`
+	Key string
+	Old string `json:",omitempty"`
+	New string `json:",omitempty"`
+}
+
+// OpDiff holds the changes to the keys of one type of statement
+type OpDiff struct {
+	Added   []KeyChange
+	Removed []KeyChange
+	Changed []KeyChange
+}
+
+/*
+ConfigDiff compares two configurations statement by statement rather than
+line by line, so reformatting does not show up as a change.  Ops is keyed
+by the type of statement: service, password, variable or service_option.
+A key set more than once counts with its last value.  Reordered is set
+when the configurations set the same values in a different order, which
+can matter to devices that apply statements one at a time.
+*/
+type ConfigDiff struct {
+	Ops       map[string]*OpDiff
+	Reordered bool
+}
+
+// Empty is true when the configurations set the same values
+func (d *ConfigDiff) Empty() bool {
+	return len(d.Ops) == 0 && !d.Reordered
+}
+
+type opKey struct {
+	Op  string
+	Svc string
+	Key string
+}
+
+// DiffConfig parses two configurations and reports the keys that differ.
+// Secret values are replaced by Redacted.
+func DiffConfig(old, new io.Reader) (*ConfigDiff, error) {
+	oldOps, err := parseCfg(old)
+	if err != nil {
+		return nil, err
+	}
+	newOps, err := parseCfg(new)
+	if err != nil {
+		return nil, err
+	}
+
+	oldVals, oldOrder := lastValues(oldOps)
+	newVals, newOrder := lastValues(newOps)
+
+	d := &ConfigDiff{Ops: make(map[string]*OpDiff)}
+	opDiff := func(k opKey) *OpDiff {
+		if _, ok := d.Ops[k.Op]; !ok {
+			d.Ops[k.Op] = &OpDiff{
+				Added:   make([]KeyChange, 0),
+				Removed: make([]KeyChange, 0),
+				Changed: make([]KeyChange, 0),
+			}
+		}
+		return d.Ops[k.Op]
+	}
+
+	for _, k := range oldOrder {
+		ov := oldVals[k]
+		nv, ok := newVals[k]
+		switch {
+		case !ok:
+			o := opDiff(k)
+			o.Removed = append(o.Removed, keyChange(k, ov, ""))
+		case nv != ov:
+			o := opDiff(k)
+			o.Changed = append(o.Changed, keyChange(k, ov, nv))
+		}
+	}
+	for _, k := range newOrder {
+		if _, ok := oldVals[k]; !ok {
+			o := opDiff(k)
+			o.Added = append(o.Added, keyChange(k, "", newVals[k]))
+		}
+	}
+
+	for _, o := range d.Ops {
+		sortChanges(o.Added)
+		sortChanges(o.Removed)
+		sortChanges(o.Changed)
+	}
+
+	if len(d.Ops) == 0 {
+		for i := range oldOrder {
+			if oldOrder[i] != newOrder[i] {
+				d.Reordered = true
+				break
+			}
+		}
+	}
+
+	return d, nil
+}
+
+// DiffObjects compares two versions of a device configuration as stored by
+// the CME.  Either may be nil for a device that did not exist at the time.
+func DiffObjects(old, new *change.ChangeData) (*ConfigDiff, error) {
+	return DiffConfig(objectContent(old), objectContent(new))
+}
+
+// objectContent joins the files of an object in name order
+func objectContent(cd *change.ChangeData) io.Reader {
+	buf := &bytes.Buffer{}
+	if cd == nil || cd.Content == nil {
+		return buf
+	}
+
+	names := make([]string, 0, len(cd.Content.Files))
+	for name := range cd.Content.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		buf.Write(cd.Content.Files[name])
+		buf.WriteString("\n")
+	}
+	return buf
+}
+
+// Setting is the value a configuration gives a key.  Op is the type of
+// statement: service, password, variable or service_option.
+type Setting struct {
+	Op  string
+	Svc string `json:",omitempty"`
+	Key string
+	Val string
+}
+
+// Settings parses a configuration and returns the last value it sets for
+// each key, in the order those values are set
+func Settings(r io.Reader) ([]Setting, error) {
+	ops, err := parseCfg(r)
+	if err != nil {
+		return nil, err
+	}
+	vals, order := lastValues(ops)
+	settings := make([]Setting, len(order))
+	for i, k := range order {
+		settings[i] = Setting{Op: k.Op, Svc: k.Svc, Key: k.Key, Val: vals[k]}
+	}
+	return settings, nil
+}
+
+// ObjectSettings returns the settings of a device configuration as stored
+// by the CME
+func ObjectSettings(cd *change.ChangeData) ([]Setting, error) {
+	return Settings(objectContent(cd))
+}
+
+// lastValues returns the last value set for each key, and the keys in the
+// order their last values are set
+func lastValues(ops []op) (map[opKey]string, []opKey) {
+	vals := make(map[opKey]string)
+	last := make(map[opKey]int)
+	for i, o := range ops {
+		k := opKey{Op: o.Op, Svc: o.Svc, Key: o.Key}
+		vals[k] = o.Val
+		last[k] = i
+	}
+
+	order := make([]opKey, 0, len(last))
+	for k := range last {
+		order = append(order, k)
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return last[order[i]] < last[order[j]]
+	})
+	return vals, order
+}
+
+func keyChange(k opKey, old, new string) KeyChange {
+	if isSecret(k) {
+		if old != "" {
+			old = Redacted
+		}
+		if new != "" {
+			new = Redacted
+		}
+	}
+	return KeyChange{Svc: k.Svc, Key: k.Key, Old: old, New: new}
+}
+
+func isSecret(k opKey) bool {
+	return k.Op == "password" || IsSecretKey(k.Key)
+}
+
+// IsSecretKey is true for the names of keys that hold secrets
+func IsSecretKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, w := range secretWords {
+		if strings.Contains(key, w) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+RedactLine replaces every word of a line that follows a word naming a
+secret, such as password or community, so "set password L2 s3cret" becomes
+"set password ******** ********".  Assignments and separators are kept.
+*/
+func RedactLine(line string) string {
+	fields := strings.Fields(line)
+	secret := false
+	for i, f := range fields {
+		if secret && f != "=" && f != ":" {
+			fields[i] = Redacted
+			continue
+		}
+		if IsSecretKey(strings.Trim(f, "\"':=,")) {
+			secret = true
+		}
+	}
+	if !secret {
+		return line
+	}
+	return strings.Join(fields, " ")
+}
+
+func sortChanges(c []KeyChange) {
+	sort.Slice(c, func(i, j int) bool {
+		if c[i].Svc != c[j].Svc {
+			return c[i].Svc < c[j].Svc
+		}
+		return c[i].Key < c[j].Key
+	})
+}
@@ -0,0 +1,129 @@
+package pbtranslate
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func begin(t *testing.T, name string) {
+	fmt.Printf("##################### Begin Translate::%s #####################\n", name)
+}
+
+func end(t *testing.T, name string) {
+	fmt.Printf("###################### End Translate::%s ######################\n", name)
+}
+
+func TestDiffConfig(t *testing.T) {
+	begin(t, "TestDiffConfig")
+	defer end(t, "TestDiffConfig")
+
+	old := "set service FTP on\n" +
+		"set service TELNET on\n" +
+		"set password 1 OLDPASS\n" +
+		"set timeout 30\n" +
+		"set snmpcommunity public\n" +
+		"service sshd port 22\n"
+	new := "SET SERVICE FTP off\n" +
+		"set password 1 NEWPASS\n" +
+		"set timeout 60\n" +
+		"set timeout 45\n" +
+		"set snmpcommunity private\n" +
+		"service sshd port 22\n" +
+		"set hostname relay1\n"
+
+	d, err := DiffConfig(strings.NewReader(old), strings.NewReader(new))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(what string, got []KeyChange, want ...KeyChange) {
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s: expected %v, got %v", what, want, got)
+		}
+	}
+	check("Changed services", d.Ops["service"].Changed, KeyChange{Key: "FTP", Old: "on", New: "off"})
+	check("Removed services", d.Ops["service"].Removed, KeyChange{Key: "TELNET", Old: "on"})
+	check("Changed passwords", d.Ops["password"].Changed, KeyChange{Key: "1", Old: Redacted, New: Redacted})
+	check("Changed variables", d.Ops["variable"].Changed,
+		KeyChange{Key: "snmpcommunity", Old: Redacted, New: Redacted},
+		KeyChange{Key: "timeout", Old: "30", New: "45"})
+	check("Added variables", d.Ops["variable"].Added, KeyChange{Key: "hostname", New: "relay1"})
+	if _, ok := d.Ops["service_option"]; ok {
+		t.Errorf("Unchanged service option reported: %+v", d.Ops["service_option"])
+	}
+	if d.Reordered || d.Empty() {
+		t.Errorf("Unexpected diff %+v", d)
+	}
+
+	// Same values, different order
+	d, err = DiffConfig(strings.NewReader("set a 1\nset b 2\n"), strings.NewReader("set b 2\nset a 1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Ops) != 0 || !d.Reordered {
+		t.Errorf("Expected a reordering only, got %+v", d)
+	}
+
+	// Reformatting is not a change
+	d, err = DiffConfig(strings.NewReader("set a 1\nset b 2\n"), strings.NewReader("set   a 1\n\n\tSET b 2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !d.Empty() {
+		t.Errorf("Expected no differences, got %+v", d)
+	}
+}
+
+func TestSettings(t *testing.T) {
+	begin(t, "TestSettings")
+	defer end(t, "TestSettings")
+
+	cfg := "set service FTP on\n" +
+		"set timeout 30\n" +
+		"service sshd port 22\n" +
+		"set service FTP off\n"
+	settings, err := Settings(strings.NewReader(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Setting{
+		{Op: "variable", Key: "timeout", Val: "30"},
+		{Op: "service_option", Svc: "sshd", Key: "port", Val: "22"},
+		{Op: "service", Key: "FTP", Val: "off"},
+	}
+	if fmt.Sprint(settings) != fmt.Sprint(want) {
+		t.Errorf("Expected %v, got %v", want, settings)
+	}
+}
+
+func TestRedactLine(t *testing.T) {
+	begin(t, "TestRedactLine")
+	defer end(t, "TestRedactLine")
+
+	if l := RedactLine("set password L2 s3cret"); l != "set password "+Redacted+" "+Redacted {
+		t.Errorf("Unexpected redaction %q", l)
+	}
+	if l := RedactLine(`  "Community": "public",`); strings.Contains(l, "public") {
+		t.Errorf("Unexpected redaction %q", l)
+	}
+	if l := RedactLine("set service  FTP on"); l != "set service  FTP on" {
+		t.Errorf("Line without secrets changed: %q", l)
+	}
+}
@@ -73,6 +73,33 @@ func Main(driver DriverService) {
 
 	log := GetLogger(driver.Name())
 
+	stop, err := Start(driver, cfg)
+	if err != nil {
+		panic(err)
+	}
+
+	log.Debug("setting up signal handler")
+
+	// Also trap ctrl-c
+	signalschan := make(chan os.Signal, 1)
+	signal.Notify(signalschan, os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGSTOP)
+	<-signalschan
+	stop()
+	os.Exit(0)
+}
+
+/*
+Start connects driver to the translation engine described by c, serves it
+on its socket in the background and registers it with the engine.  The
+returned function stops serving and removes the socket.
+
+Main is the normal way to run a driver, Start is used directly to run a
+driver inside another process, such as a test.
+*/
+func Start(driver DriverService, c *config.Config) (func(), error) {
+	cfg = c
+	log := GetLogger(driver.Name())
+
 	engine := filepath.Join(cfg.Translation.SocketDir, "engine.sock")
 
 	log.Debug("Connecting to engine")
@@ -82,7 +109,7 @@ func Main(driver DriverService) {
 		}),
 	)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	driver.SetClient(NewEngineClient(client))
@@ -90,48 +117,38 @@ func Main(driver DriverService) {
 	socket := filepath.Join(cfg.Translation.SocketDir, fmt.Sprintf(
 		"%s.sock", driver.Name()))
 
-	log.Debug("setting up signal handler")
-
-	// Also trap ctrl-c
-	signalschan := make(chan os.Signal, 1)
-	signal.Notify(signalschan, os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGSTOP)
-	go func() {
-		<-signalschan
-		os.Remove(socket)
-		os.Exit(0)
-	}()
-
 	listener, err := net.Listen("unix", socket)
 	if err != nil {
-		panic(err)
+		client.Close()
+		return nil, err
 	}
-	defer func() {
-		listener.Close()
-		os.Remove(socket)
-	}()
 
 	service := grpc.NewServer()
 	RegisterDriverServer(service, driver)
+	go service.Serve(listener)
+
+	stop := func() {
+		service.Stop()
+		listener.Close()
+		os.Remove(socket)
+		client.Close()
+	}
 
 	req := RegRequest{
 		Name:   driver.Name(),
 		Socket: socket,
 	}
 
-	go func() {
-
-		r, err := driver.Client().Register(context.Background(), &req)
-		if err != nil {
-			panic(err)
-		}
-
-		if r.Ok != true {
-			panic(errors.New("Failed to register with engine"))
-		}
-	}()
-
-	service.Serve(listener)
+	r, err := driver.Client().Register(context.Background(), &req)
+	if err == nil && r.Ok != true {
+		err = errors.New("Failed to register with engine")
+	}
+	if err != nil {
+		stop()
+		return nil, err
+	}
 
+	return stop, nil
 }
 
 func GetLogger(name string) logging.Logger {
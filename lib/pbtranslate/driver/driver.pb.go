@@ -22,6 +22,8 @@ It has these top-level messages:
 	CommandSeq
 	ConfigFile
 	ConfigFiles
+	LeaseRequest
+	Lease
 */
 package driver
 
@@ -246,6 +248,44 @@ func (m *ConfigFiles) GetFiles() []*ConfigFile {
 	return nil
 }
 
+type LeaseRequest struct {
+	Devid     *DeviceID `protobuf:"bytes,1,opt,name=devid" json:"devid,omitempty"`
+	Owner     string    `protobuf:"bytes,2,opt,name=owner" json:"owner,omitempty"`
+	Purpose   string    `protobuf:"bytes,3,opt,name=purpose" json:"purpose,omitempty"`
+	Exclusive bool      `protobuf:"varint,4,opt,name=exclusive" json:"exclusive,omitempty"`
+	Priority  int32     `protobuf:"varint,5,opt,name=priority" json:"priority,omitempty"`
+	Ttl       int64     `protobuf:"varint,6,opt,name=ttl" json:"ttl,omitempty"`
+}
+
+func (m *LeaseRequest) Reset()                    { *m = LeaseRequest{} }
+func (m *LeaseRequest) String() string            { return proto.CompactTextString(m) }
+func (*LeaseRequest) ProtoMessage()               {}
+func (*LeaseRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{13} }
+
+func (m *LeaseRequest) GetDevid() *DeviceID {
+	if m != nil {
+		return m.Devid
+	}
+	return nil
+}
+
+type Lease struct {
+	Id    string    `protobuf:"bytes,1,opt,name=id" json:"id,omitempty"`
+	Devid *DeviceID `protobuf:"bytes,2,opt,name=devid" json:"devid,omitempty"`
+}
+
+func (m *Lease) Reset()                    { *m = Lease{} }
+func (m *Lease) String() string            { return proto.CompactTextString(m) }
+func (*Lease) ProtoMessage()               {}
+func (*Lease) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{14} }
+
+func (m *Lease) GetDevid() *DeviceID {
+	if m != nil {
+		return m.Devid
+	}
+	return nil
+}
+
 func init() {
 	proto.RegisterType((*BoolReply)(nil), "Driver.BoolReply")
 	proto.RegisterType((*KVPair)(nil), "Driver.KVPair")
@@ -260,6 +300,8 @@ func init() {
 	proto.RegisterType((*CommandSeq)(nil), "Driver.CommandSeq")
 	proto.RegisterType((*ConfigFile)(nil), "Driver.ConfigFile")
 	proto.RegisterType((*ConfigFiles)(nil), "Driver.ConfigFiles")
+	proto.RegisterType((*LeaseRequest)(nil), "Driver.LeaseRequest")
+	proto.RegisterType((*Lease)(nil), "Driver.Lease")
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -272,6 +314,9 @@ type EngineClient interface {
 	Register(ctx context.Context, in *RegRequest, opts ...grpc.CallOption) (*BoolReply, error)
 	GetMeta(ctx context.Context, in *KVRequest, opts ...grpc.CallOption) (*KVPair, error)
 	SaveMeta(ctx context.Context, in *KVPair, opts ...grpc.CallOption) (*BoolReply, error)
+	Acquire(ctx context.Context, in *LeaseRequest, opts ...grpc.CallOption) (*Lease, error)
+	Release(ctx context.Context, in *Lease, opts ...grpc.CallOption) (*BoolReply, error)
+	Renew(ctx context.Context, in *Lease, opts ...grpc.CallOption) (*BoolReply, error)
 }
 
 type engineClient struct {
@@ -309,12 +354,42 @@ func (c *engineClient) SaveMeta(ctx context.Context, in *KVPair, opts ...grpc.Ca
 	return out, nil
 }
 
+func (c *engineClient) Acquire(ctx context.Context, in *LeaseRequest, opts ...grpc.CallOption) (*Lease, error) {
+	out := new(Lease)
+	err := grpc.Invoke(ctx, "/Driver.Engine/Acquire", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *engineClient) Release(ctx context.Context, in *Lease, opts ...grpc.CallOption) (*BoolReply, error) {
+	out := new(BoolReply)
+	err := grpc.Invoke(ctx, "/Driver.Engine/Release", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *engineClient) Renew(ctx context.Context, in *Lease, opts ...grpc.CallOption) (*BoolReply, error) {
+	out := new(BoolReply)
+	err := grpc.Invoke(ctx, "/Driver.Engine/Renew", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // Server API for Engine service
 
 type EngineServer interface {
 	Register(context.Context, *RegRequest) (*BoolReply, error)
 	GetMeta(context.Context, *KVRequest) (*KVPair, error)
 	SaveMeta(context.Context, *KVPair) (*BoolReply, error)
+	Acquire(context.Context, *LeaseRequest) (*Lease, error)
+	Release(context.Context, *Lease) (*BoolReply, error)
+	Renew(context.Context, *Lease) (*BoolReply, error)
 }
 
 func RegisterEngineServer(s *grpc.Server, srv EngineServer) {
@@ -357,6 +432,42 @@ func _Engine_SaveMeta_Handler(srv interface{}, ctx context.Context, dec func(int
 	return out, nil
 }
 
+func _Engine_Acquire_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+	in := new(LeaseRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(EngineServer).Acquire(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Engine_Release_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+	in := new(Lease)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(EngineServer).Release(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _Engine_Renew_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error) (interface{}, error) {
+	in := new(Lease)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(EngineServer).Renew(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 var _Engine_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "Driver.Engine",
 	HandlerType: (*EngineServer)(nil),
@@ -373,6 +484,18 @@ var _Engine_serviceDesc = grpc.ServiceDesc{
 			MethodName: "SaveMeta",
 			Handler:    _Engine_SaveMeta_Handler,
 		},
+		{
+			MethodName: "Acquire",
+			Handler:    _Engine_Acquire_Handler,
+		},
+		{
+			MethodName: "Release",
+			Handler:    _Engine_Release_Handler,
+		},
+		{
+			MethodName: "Renew",
+			Handler:    _Engine_Renew_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{},
 }
@@ -570,41 +693,49 @@ var _Driver_serviceDesc = grpc.ServiceDesc{
 }
 
 var fileDescriptor0 = []byte{
-	// 563 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0xac, 0x54, 0x5b, 0x6f, 0x12, 0x41,
-	0x14, 0xb6, 0x6c, 0x59, 0x96, 0x03, 0x54, 0x1c, 0x2f, 0x21, 0xf8, 0x62, 0xc6, 0xc4, 0x34, 0x31,
-	0xc1, 0x48, 0x4d, 0xac, 0xbe, 0xd9, 0x82, 0xc6, 0x34, 0x26, 0xcd, 0x60, 0x89, 0xd1, 0x07, 0x33,
-	0xc2, 0x29, 0x59, 0x81, 0x5d, 0xba, 0x33, 0xa0, 0xfd, 0x33, 0xfe, 0x38, 0x7f, 0x89, 0xb3, 0x3b,
-	0x97, 0x25, 0x74, 0x49, 0x88, 0xfa, 0x36, 0xe7, 0xf2, 0x9d, 0xef, 0x9c, 0x39, 0x17, 0xa8, 0x8f,
-	0x93, 0x70, 0x85, 0x49, 0x67, 0x91, 0xc4, 0x32, 0x26, 0x7e, 0x2f, 0x93, 0xe8, 0x43, 0xa8, 0x9e,
-	0xc4, 0xf1, 0x8c, 0xe1, 0x62, 0x76, 0x4d, 0x0e, 0xa0, 0x14, 0x4f, 0x5b, 0x7b, 0x8f, 0xf6, 0x0e,
-	0x03, 0xa6, 0x5e, 0xf4, 0x13, 0xf8, 0x67, 0xc3, 0x73, 0x1e, 0x26, 0xe4, 0x09, 0x94, 0xc7, 0xb8,
-	0x0a, 0xc7, 0x99, 0xb1, 0xd6, 0x6d, 0x76, 0x34, 0xbc, 0xd3, 0x53, 0xca, 0x11, 0xbe, 0xef, 0x31,
-	0x6d, 0x26, 0x4d, 0xf0, 0xa6, 0x78, 0xdd, 0x2a, 0x29, 0xaf, 0x2a, 0x4b, 0x9f, 0xe4, 0x1e, 0x94,
-	0x57, 0x7c, 0xb6, 0xc4, 0x96, 0x97, 0xe9, 0xb4, 0x40, 0xfb, 0x50, 0x3d, 0x1b, 0x32, 0xbc, 0x5a,
-	0xa2, 0x90, 0x7f, 0x1f, 0x9c, 0x1e, 0x03, 0x30, 0x9c, 0xd8, 0x38, 0x04, 0xf6, 0x23, 0x3e, 0xc7,
-	0x2c, 0x4c, 0x95, 0x65, 0x6f, 0xf2, 0x00, 0x7c, 0x11, 0x8f, 0xa6, 0x28, 0x0d, 0xcc, 0x48, 0xb4,
-	0x0d, 0x81, 0x0d, 0x9f, 0x96, 0x6d, 0xc8, 0x3d, 0xa6, 0x5e, 0x54, 0x40, 0x63, 0x80, 0x49, 0x6a,
-	0x3c, 0x8d, 0xa3, 0xcb, 0x70, 0xb2, 0x73, 0x82, 0x36, 0x81, 0xd2, 0x5a, 0x02, 0x26, 0x69, 0xaf,
-	0xe0, 0x47, 0xf6, 0xd7, 0x7f, 0xe4, 0x3b, 0x04, 0x17, 0x02, 0x93, 0x73, 0x2e, 0xc4, 0xce, 0x7c,
-	0xaa, 0x88, 0xa5, 0xc2, 0xac, 0x71, 0x3a, 0x39, 0xb5, 0x2d, 0x54, 0xac, 0x1f, 0x71, 0x32, 0x36,
-	0xe4, 0x4e, 0xa6, 0x5f, 0xa0, 0x62, 0x0a, 0xfc, 0xa7, 0xd2, 0x54, 0x21, 0x42, 0x72, 0xa9, 0x5b,
-	0x1b, 0x30, 0x2d, 0xd0, 0x0b, 0xf0, 0x86, 0xfc, 0xff, 0x4f, 0xcc, 0x63, 0xa8, 0x9c, 0xc6, 0xf3,
-	0x39, 0x8f, 0xc6, 0xa4, 0x05, 0x95, 0x91, 0x7e, 0x9a, 0x56, 0x5b, 0x91, 0x72, 0x00, 0xe3, 0x34,
-	0xc0, 0xab, 0x9d, 0x53, 0x78, 0x0a, 0x81, 0x09, 0x20, 0x54, 0x1e, 0x9e, 0x72, 0xbd, 0x6d, 0x5d,
-	0x4d, 0x34, 0xe6, 0x1c, 0xe8, 0xeb, 0x94, 0x22, 0x9d, 0x8a, 0xb7, 0xe1, 0x0c, 0x0b, 0x47, 0x2e,
-	0x4b, 0x2f, 0x92, 0x18, 0xe9, 0x99, 0xab, 0x33, 0x2b, 0xd2, 0xaf, 0x50, 0xcb, 0xb1, 0xbb, 0xb7,
-	0xf9, 0x10, 0xca, 0x97, 0x29, 0xc0, 0x24, 0x47, 0xf2, 0xe4, 0x6c, 0x2c, 0xa6, 0x1d, 0xba, 0xbf,
-	0xf6, 0xc0, 0xef, 0x47, 0x93, 0x30, 0x42, 0x72, 0x04, 0x81, 0x5a, 0x8d, 0x50, 0x48, 0x4c, 0x88,
-	0x43, 0xe4, 0xcb, 0xd2, 0xbe, 0x63, 0x75, 0x6e, 0xfd, 0xe9, 0x2d, 0xd2, 0x81, 0xca, 0x3b, 0x94,
-	0x1f, 0x50, 0x72, 0xe2, 0xec, 0x6e, 0x4f, 0xdb, 0x07, 0xb9, 0x2a, 0x3d, 0x0a, 0xca, 0xff, 0x19,
-	0x04, 0x03, 0xbe, 0xc2, 0x0c, 0xb0, 0x61, 0x2d, 0x24, 0xe8, 0xfe, 0x2e, 0x81, 0xb9, 0x3c, 0xe4,
-	0x05, 0x54, 0x15, 0x97, 0xd9, 0xb0, 0x1b, 0xb5, 0xb7, 0xef, 0xde, 0xac, 0x52, 0x28, 0xc6, 0x97,
-	0xd0, 0xf8, 0x98, 0xf0, 0x48, 0xcc, 0xd4, 0xa8, 0x65, 0xbb, 0xe2, 0x90, 0x76, 0x7b, 0xda, 0x64,
-	0xa3, 0x79, 0x6a, 0x14, 0x14, 0xf0, 0x15, 0x34, 0x1d, 0xd0, 0x0e, 0xbf, 0x6b, 0xb3, 0x51, 0x6c,
-	0x81, 0x3e, 0x87, 0xba, 0x83, 0xa6, 0xa3, 0x5d, 0xb3, 0x5e, 0x4a, 0xd8, 0x02, 0x79, 0x03, 0x24,
-	0x67, 0x5b, 0x8d, 0x4c, 0x95, 0xf7, 0x37, 0xf8, 0xb4, 0x7a, 0x4b, 0x88, 0x63, 0x68, 0xf4, 0x7f,
-	0xe2, 0x68, 0x29, 0xed, 0x15, 0x2a, 0x70, 0x2b, 0xfc, 0xe4, 0x93, 0xe0, 0xb3, 0xaf, 0x6f, 0xfd,
-	0x37, 0x3f, 0x3b, 0xf6, 0x47, 0x7f, 0x02, 0x00, 0x00, 0xff, 0xff, 0xe6, 0xe2, 0xf5, 0x81, 0xfc,
-	0x05, 0x00, 0x00,
+	// 698 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xac, 0x55, 0x5b, 0x6f, 0x12, 0x4d,
+	0x18, 0x86, 0xa5, 0x0b, 0xcb, 0x0b, 0xf4, 0xeb, 0x37, 0x1f, 0x9f, 0x21, 0xe8, 0x05, 0x19, 0x13,
+	0x43, 0xd2, 0x88, 0x4a, 0x4d, 0xac, 0xde, 0x98, 0x9e, 0x6c, 0x4c, 0x35, 0x69, 0x06, 0x4b, 0x8c,
+	0x5e, 0x98, 0x11, 0xde, 0x92, 0x95, 0xed, 0x2e, 0xcc, 0xcc, 0x6e, 0xdb, 0xff, 0xe4, 0x95, 0x3f,
+	0xc9, 0x5f, 0x62, 0x76, 0x77, 0x66, 0x97, 0xb6, 0xd4, 0xe0, 0xe1, 0x6e, 0x9e, 0xf7, 0xf8, 0xcc,
+	0xbc, 0x87, 0x81, 0xfa, 0x58, 0xb8, 0x11, 0x8a, 0xde, 0x4c, 0x04, 0x2a, 0x20, 0xe5, 0xfd, 0x04,
+	0xd1, 0xbb, 0x50, 0xdd, 0x0d, 0x02, 0x8f, 0xe1, 0xcc, 0xbb, 0x24, 0xeb, 0x60, 0x05, 0xd3, 0x56,
+	0xb1, 0x53, 0xec, 0x3a, 0xcc, 0x0a, 0xa6, 0xf4, 0x3d, 0x94, 0x8f, 0x86, 0xc7, 0xdc, 0x15, 0xe4,
+	0x01, 0xd8, 0x63, 0x8c, 0xdc, 0x71, 0xa2, 0xac, 0xf5, 0x37, 0x7a, 0xa9, 0x7b, 0x6f, 0x1f, 0x23,
+	0x77, 0x84, 0xaf, 0xf7, 0x59, 0xaa, 0x26, 0x1b, 0x50, 0x9a, 0xe2, 0x65, 0xcb, 0xea, 0x14, 0xbb,
+	0x55, 0x16, 0x1f, 0x49, 0x13, 0xec, 0x88, 0x7b, 0x21, 0xb6, 0x4a, 0x89, 0x2c, 0x05, 0xf4, 0x00,
+	0xaa, 0x47, 0x43, 0x86, 0xf3, 0x10, 0xa5, 0xfa, 0xfd, 0xe0, 0x74, 0x1b, 0x80, 0xe1, 0xc4, 0xc4,
+	0x21, 0xb0, 0xe6, 0xf3, 0x33, 0x4c, 0xc2, 0x54, 0x59, 0x72, 0x26, 0x77, 0xa0, 0x2c, 0x83, 0xd1,
+	0x14, 0x95, 0x76, 0xd3, 0x88, 0xb6, 0xc1, 0x31, 0xe1, 0xe3, 0x6b, 0xeb, 0xe4, 0x25, 0x66, 0xb9,
+	0x63, 0x2a, 0xa1, 0x31, 0x40, 0x11, 0x2b, 0xf7, 0x02, 0xff, 0xd4, 0x9d, 0xac, 0x4c, 0xd0, 0x10,
+	0xb0, 0x16, 0x08, 0x68, 0xd2, 0xa5, 0x25, 0x2f, 0xb2, 0xb6, 0xf8, 0x22, 0x5f, 0xc0, 0x39, 0x91,
+	0x28, 0x8e, 0xb9, 0x94, 0x2b, 0xe7, 0x6b, 0x83, 0x13, 0x4a, 0x14, 0x0b, 0x39, 0x33, 0x1c, 0xeb,
+	0x66, 0x5c, 0xca, 0xf3, 0x40, 0x8c, 0x75, 0xf2, 0x0c, 0xd3, 0x8f, 0x50, 0xd1, 0x17, 0xfc, 0xa3,
+	0xab, 0x35, 0xc1, 0x96, 0x8a, 0xab, 0xb4, 0xb4, 0x0e, 0x4b, 0x01, 0x3d, 0x81, 0xd2, 0x90, 0xff,
+	0xfd, 0x8e, 0xb9, 0x0f, 0x95, 0xbd, 0xe0, 0xec, 0x8c, 0xfb, 0x63, 0xd2, 0x82, 0xca, 0x28, 0x3d,
+	0xea, 0x52, 0x1b, 0x48, 0x39, 0x80, 0x36, 0x1a, 0xe0, 0x7c, 0x65, 0x0a, 0x9b, 0xe0, 0xe8, 0x00,
+	0xb2, 0x65, 0x75, 0x4a, 0xdd, 0x5a, 0xff, 0x1f, 0x63, 0xaa, 0xa3, 0xb1, 0xcc, 0x80, 0xbe, 0x00,
+	0x48, 0xbb, 0xe2, 0x95, 0xeb, 0xe1, 0xd2, 0x96, 0x4b, 0xe8, 0xf9, 0x0a, 0xfd, 0xb4, 0xe7, 0xea,
+	0xcc, 0x40, 0xfa, 0x09, 0x6a, 0xb9, 0xef, 0xea, 0x65, 0xee, 0x82, 0x7d, 0x1a, 0x3b, 0x68, 0x72,
+	0x24, 0x27, 0x67, 0x62, 0xb1, 0xd4, 0x80, 0x7e, 0x2b, 0x42, 0xfd, 0x0d, 0x72, 0x89, 0xbf, 0x3a,
+	0x5a, 0x4d, 0xb0, 0x83, 0x73, 0x1f, 0x85, 0xae, 0x43, 0x0a, 0xe2, 0x9b, 0xcc, 0x42, 0x31, 0x0b,
+	0xa4, 0xa9, 0x85, 0x81, 0xe4, 0x1e, 0x54, 0xf1, 0x62, 0xe4, 0x85, 0xd2, 0x8d, 0xd2, 0x3e, 0x76,
+	0x58, 0x2e, 0x48, 0x7a, 0x4f, 0xb8, 0x81, 0x70, 0xd5, 0x65, 0xcb, 0xee, 0x14, 0xbb, 0x36, 0xcb,
+	0x70, 0x5c, 0x6f, 0xa5, 0xbc, 0x56, 0x39, 0x99, 0xb6, 0xf8, 0x48, 0x5f, 0x82, 0x9d, 0x70, 0x5e,
+	0x98, 0xc3, 0x6a, 0x3c, 0x87, 0x39, 0x79, 0xeb, 0xa7, 0xe4, 0xfb, 0x5f, 0x2d, 0x28, 0x1f, 0xf8,
+	0x13, 0xd7, 0x47, 0xb2, 0x05, 0x0e, 0xc3, 0x89, 0x2b, 0x15, 0x0a, 0x92, 0xbd, 0x53, 0xbe, 0x22,
+	0xda, 0xff, 0x1a, 0x59, 0xb6, 0xf4, 0x68, 0x81, 0xf4, 0xa0, 0x72, 0x88, 0xea, 0x2d, 0x2a, 0x4e,
+	0x32, 0x7d, 0xb6, 0x9d, 0xda, 0xeb, 0xb9, 0x28, 0x5e, 0x85, 0xb4, 0x40, 0x1e, 0x81, 0x33, 0xe0,
+	0x11, 0x26, 0x0e, 0xd7, 0xb4, 0xcb, 0x13, 0x3c, 0x86, 0xca, 0xce, 0x68, 0x1e, 0xba, 0x02, 0x49,
+	0xd3, 0xe8, 0x17, 0xcb, 0xd4, 0x6e, 0x5c, 0x91, 0xd2, 0x02, 0x79, 0x08, 0x15, 0x86, 0x5e, 0x0c,
+	0xc8, 0x55, 0xdd, 0xf2, 0x04, 0x9b, 0x60, 0x33, 0xf4, 0xf1, 0x7c, 0x15, 0xe3, 0xfe, 0x77, 0x0b,
+	0xf4, 0xf6, 0x27, 0x4f, 0xa1, 0x7a, 0x88, 0x4a, 0x6f, 0xb9, 0x1b, 0xef, 0xdb, 0xfe, 0xef, 0x66,
+	0xa7, 0x49, 0x5a, 0x20, 0xcf, 0xa0, 0xf1, 0x4e, 0x70, 0x5f, 0x7a, 0x5c, 0x61, 0xb2, 0xaf, 0x32,
+	0x4f, 0xb3, 0xc1, 0xda, 0xe4, 0xda, 0x00, 0x0d, 0x70, 0x4e, 0x0b, 0xe4, 0x39, 0x6c, 0x64, 0x8e,
+	0x66, 0x01, 0x65, 0xa3, 0xa6, 0x05, 0xb7, 0xb8, 0x3e, 0x81, 0x7a, 0xe6, 0x1a, 0xaf, 0x97, 0x9a,
+	0xb1, 0x1a, 0x72, 0x71, 0x8b, 0xcb, 0x0e, 0x90, 0x3c, 0x5b, 0x34, 0xd2, 0xb7, 0xfc, 0xff, 0x5a,
+	0xbe, 0x54, 0x7c, 0x4b, 0x88, 0x6d, 0x68, 0x1c, 0x5c, 0xe0, 0x28, 0x54, 0xda, 0x8c, 0x2c, 0x31,
+	0x5b, 0xfa, 0xc8, 0xbb, 0xce, 0x87, 0x72, 0xfa, 0xdf, 0x7e, 0x2e, 0x27, 0x1f, 0xee, 0xd6, 0x8f,
+	0x01, 0x00, 0x98, 0x17, 0x28, 0x77, 0x80, 0x07, 0x00, 0x00,
 }
@@ -43,3 +43,11 @@ type ConnectionError struct {
 func NewConnectionError(s string) *ConnectionError {
 	return &ConnectionError{newDriverError(s)}
 }
+
+type AuthenticationError struct {
+	DriverError
+}
+
+func NewAuthenticationError(s string) *AuthenticationError {
+	return &AuthenticationError{newDriverError(s)}
+}
@@ -17,18 +17,46 @@ package driver
 ***********************************************************************/
 
 import (
+	arbiter "github.com/iti/pbconf/lib/pbarbiter"
 	config "github.com/iti/pbconf/lib/pbconfig"
 	db "github.com/iti/pbconf/lib/pbdatabase"
 	global "github.com/iti/pbconf/lib/pbglobal"
 	transport "github.com/iti/pbconf/lib/pbtransport"
+
+	"time"
+
+	"golang.org/x/net/context"
 )
 
 func ConnectToDevice(fn transport.CredentialFn, id int64, drvSerName string) (transport.ClientTransport, error) {
+	return ConnectToDeviceContext(context.Background(), fn, id, drvSerName)
+}
+
+/*
+ConnectToDeviceContext is ConnectToDevice, bounded by ctx.  When the device
+has a driverdialtimeout config item, connecting is further limited to
+that duration.
+*/
+func ConnectToDeviceContext(ctx context.Context, fn transport.CredentialFn, id int64, drvSerName string) (transport.ClientTransport, error) {
 	trans, err := GetTransportDriver(id, drvSerName)
 	if err != nil {
 		return nil, err
 	}
 
+	dev, err := GetDevice(id)
+	if err != nil {
+		return nil, NewConnectionError("Failed to acquire transport: " + err.Error())
+	}
+
+	final := trans
+	if c, ok := trans.(*transport.Chain); ok {
+		// The jump hosts are logged in to with fn as well
+		final = c.Final()
+	}
+	if t, ok := final.(*transport.Telnet); ok {
+		t.SetPrompts(transport.TelnetPromptsFromConfig(dev.ConfigValue, "driver"))
+	}
+
 	// Get the connection string
 	location, err := GetConnectionString(id)
 	if err != nil {
@@ -37,9 +65,15 @@ func ConnectToDevice(fn transport.CredentialFn, id int64, drvSerName string) (tr
 
 	trans.SetCredentialFn(fn)
 
+	dialCtx, cancel := WithDeviceTimeout(ctx, dev, "driverdialtimeout")
+	defer cancel()
+
 	// Connect to the device
-	err = trans.Dial(id, location)
+	err = transport.DialContext(dialCtx, trans, id, location)
 	if err != nil {
+		if _, ok := err.(transport.ErrAuthFailed); ok {
+			return nil, NewAuthenticationError("Failed to authenticate to device: " + err.Error())
+		}
 		return nil, NewConnectionError("Failed to connect to device: " + err.Error())
 	}
 
@@ -98,6 +132,89 @@ func GetDeviceConnectionString(dev *db.PbDevice) (string, string, error) {
 	return dev.GetConnectionString(pdb, "driver")
 }
 
+/*
+DeviceTimeout reads a duration from the device config item key, for
+instance drivertimeout or driverdialtimeout.  Items that are missing or
+do not parse as a duration are reported as not set.
+*/
+func DeviceTimeout(dev *db.PbDevice, key string) (time.Duration, bool) {
+	v, ok := dev.ConfigValue(key)
+	if !ok {
+		return 0, false
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, false
+	}
+	return d, true
+}
+
+// WithDeviceTimeout derives a context from ctx limited by the device
+// timeout stored in the config item key, if there is one
+func WithDeviceTimeout(ctx context.Context, dev *db.PbDevice, key string) (context.Context, context.CancelFunc) {
+	if d, ok := DeviceTimeout(dev, key); ok {
+		return context.WithTimeout(ctx, d)
+	}
+	return context.WithCancel(ctx)
+}
+
+// Lease time to live used by AcquireDevice.  A driver that dies while
+// holding a device only blocks it for this long.  Leases are renewed while
+// held, so work may take longer than this.
+var LeaseTTL = 10 * time.Minute
+
+/*
+AcquireDevice asks the engine for a lease on a device, waiting in the
+node wide queue until it is granted or ctx is done.  Every driver must
+hold a lease while it has a transport open to the device.  The lease is
+renewed every third of LeaseTTL until the returned function releases it.
+*/
+func AcquireDevice(ctx context.Context, client EngineClient, id int64, owner, purpose string, mode arbiter.Mode, prio arbiter.Priority) (func(), error) {
+	l, err := client.Acquire(ctx, &LeaseRequest{
+		Devid:     &DeviceID{Id: id},
+		Owner:     owner,
+		Purpose:   purpose,
+		Exclusive: mode == arbiter.Exclusive,
+		Priority:  int32(prio),
+		Ttl:       int64(LeaseTTL / time.Second),
+	})
+	if err != nil {
+		return nil, NewConnectionError("Device is busy: " + err.Error())
+	}
+
+	log := GetLogger(owner)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(LeaseTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				rctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				_, err := client.Renew(rctx, l)
+				cancel()
+				if err != nil {
+					log.Warning("Failed to renew lease %s on device %d: %s", l.Id, id, err.Error())
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+		rctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if _, err := client.Release(rctx, l); err != nil {
+			log.Warning("Failed to release lease %s on device %d: %s", l.Id, id, err.Error())
+		}
+	}, nil
+}
+
 func ReplyFalse(err error) (r *BoolReply, e error) {
 	e = err
 	r = &BoolReply{Ok: false}
@@ -22,6 +22,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"sync"
 	"time"
 
 	change "github.com/iti/pbconf/lib/pbchange"
@@ -32,7 +33,7 @@ import (
 	"golang.org/x/net/context"
 )
 
-func configure(cfg *config.Config, deviceID int64, b io.Reader) ([]*driver.Command, error) {
+func configure(ctx context.Context, cfg *config.Config, deviceID int64, b io.Reader) ([]*driver.Command, error) {
 	log.Debug("Configure()")
 	execmds := make([]*driver.Command, 0)
 
@@ -52,9 +53,13 @@ func configure(cfg *config.Config, deviceID int64, b io.Reader) ([]*driver.Comma
 		return nil, err
 	}
 	for _, op := range parsed_stmts {
+		// Translation errors are skipped, but a dead context is not
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		switch op.Op {
 		case "service":
-			cs, e = translateService(deviceID, dev.Name, op.Key, op.Val, cfg)
+			cs, e = translateService(ctx, deviceID, dev.Name, op.Key, op.Val, cfg)
 			if e != nil {
 				continue
 			}
@@ -62,7 +67,7 @@ func configure(cfg *config.Config, deviceID int64, b io.Reader) ([]*driver.Comma
 				execmds = append(execmds, cmd)
 			}
 		case "password":
-			cs, e = translatePassword(deviceID, dev.Name, op.Key, op.Val, cfg)
+			cs, e = translatePassword(ctx, deviceID, dev.Name, op.Key, op.Val, cfg)
 			if e != nil {
 				continue
 			}
@@ -70,7 +75,7 @@ func configure(cfg *config.Config, deviceID int64, b io.Reader) ([]*driver.Comma
 				execmds = append(execmds, cmd)
 			}
 		case "variable":
-			cs, e = translateVar(deviceID, dev.Name, op.Key, op.Val, cfg)
+			cs, e = translateVar(ctx, deviceID, dev.Name, op.Key, op.Val, cfg)
 			if e != nil {
 				continue
 			}
@@ -78,7 +83,7 @@ func configure(cfg *config.Config, deviceID int64, b io.Reader) ([]*driver.Comma
 				execmds = append(execmds, cmd)
 			}
 		case "service_option":
-			cs, e = translateSvcConfig(deviceID, dev.Name, op.Svc, op.Key, op.Val, cfg)
+			cs, e = translateSvcConfig(ctx, deviceID, dev.Name, op.Svc, op.Key, op.Val, cfg)
 			if e != nil {
 				continue
 			}
@@ -121,8 +126,14 @@ func configure(cfg *config.Config, deviceID int64, b io.Reader) ([]*driver.Comma
 	return execmds, nil
 
 }
+
+// The generated parser keeps its result in a package variable
+var parseLock sync.Mutex
+
 func parseCfg(b io.Reader) ([]op, error) {
 	log.Debug("ConfigureParsedStmt()")
+	parseLock.Lock()
+	defer parseLock.Unlock()
 
 	parsed_stmts, err := Parse(b)
 	if err != nil {
@@ -142,11 +153,25 @@ func GetMarshalledCfg(b io.Reader) ([]byte, error) {
 }
 
 func ExecuteConfig(cfg *config.Config, devID int64, b io.Reader) error {
+	return ExecuteConfigContext(context.Background(), cfg, devID, b)
+}
+
+/*
+ExecuteConfigContext translates and applies a configuration like
+ExecuteConfig, passing ctx to every driver RPC so that its deadline and
+cancellation reach the driver and, through it, the device transport.
+A drivertimeout config item on the device bounds the whole operation.
+*/
+func ExecuteConfigContext(ctx context.Context, cfg *config.Config, devID int64, b io.Reader) error {
 	dev, err := driver.GetDevice(int64(devID))
 	if err != nil {
 		return err
 	}
-	execmds, err := configure(cfg, devID, b)
+
+	ctx, cancel := driver.WithDeviceTimeout(ctx, dev, "drivertimeout")
+	defer cancel()
+
+	execmds, err := configure(ctx, cfg, devID, b)
 	if err != nil {
 		return err
 	}
@@ -165,7 +190,7 @@ func ExecuteConfig(cfg *config.Config, devID int64, b io.Reader) error {
 	}
 	cmds.Commands = execmds
 
-	_, e := client.Client.ExecuteConfig(context.Background(), &cmds)
+	_, e := client.Client.ExecuteConfig(ctx, &cmds)
 	if e != nil {
 		log.Error(e.Error())
 		return e
@@ -174,7 +199,7 @@ func ExecuteConfig(cfg *config.Config, devID int64, b io.Reader) error {
 	return nil
 }
 
-func translateService(id int64, dev, name, state string, cfg *config.Config) (*driver.CommandSeq, error) {
+func translateService(ctx context.Context, id int64, dev, name, state string, cfg *config.Config) (*driver.CommandSeq, error) {
 
 	client, ok := engineService.Clients[getDriver(dev, cfg)]
 	if !ok {
@@ -202,7 +227,7 @@ func translateService(id int64, dev, name, state string, cfg *config.Config) (*d
 		State: bstate,
 	}
 
-	r, err := client.Client.TranslateService(context.Background(), &s)
+	r, err := client.Client.TranslateService(ctx, &s)
 	if err != nil {
 		return nil, err
 	}
@@ -210,7 +235,7 @@ func translateService(id int64, dev, name, state string, cfg *config.Config) (*d
 	return r, nil
 }
 
-func translatePassword(id int64, dev, name, pass string, cfg *config.Config) (*driver.CommandSeq, error) {
+func translatePassword(ctx context.Context, id int64, dev, name, pass string, cfg *config.Config) (*driver.CommandSeq, error) {
 	client, ok := engineService.Clients[getDriver(dev, cfg)]
 	if !ok {
 		return nil, errors.New(
@@ -227,7 +252,7 @@ func translatePassword(id int64, dev, name, pass string, cfg *config.Config) (*d
 		Password: pass,
 	}
 
-	r, err := client.Client.TranslatePass(context.Background(), &p)
+	r, err := client.Client.TranslatePass(ctx, &p)
 	if err != nil {
 		return nil, err
 	}
@@ -235,7 +260,7 @@ func translatePassword(id int64, dev, name, pass string, cfg *config.Config) (*d
 	return r, nil
 }
 
-func translateSvcConfig(id int64, dev, svc, variable, opt string, cfg *config.Config) (*driver.CommandSeq, error) {
+func translateSvcConfig(ctx context.Context, id int64, dev, svc, variable, opt string, cfg *config.Config) (*driver.CommandSeq, error) {
 
 	client, ok := engineService.Clients[getDriver(dev, cfg)]
 	if !ok {
@@ -254,7 +279,7 @@ func translateSvcConfig(id int64, dev, svc, variable, opt string, cfg *config.Co
 		Value: opt,
 	}
 
-	r, err := client.Client.TranslateSvcConfig(context.Background(), &v)
+	r, err := client.Client.TranslateSvcConfig(ctx, &v)
 
 	if err != nil {
 		return nil, err
@@ -263,7 +288,7 @@ func translateSvcConfig(id int64, dev, svc, variable, opt string, cfg *config.Co
 	return r, nil
 }
 
-func translateVar(id int64, dev, key, val string, cfg *config.Config) (*driver.CommandSeq, error) {
+func translateVar(ctx context.Context, id int64, dev, key, val string, cfg *config.Config) (*driver.CommandSeq, error) {
 	client, ok := engineService.Clients[getDriver(dev, cfg)]
 	if !ok {
 		return nil, errors.New(
@@ -280,7 +305,7 @@ func translateVar(id int64, dev, key, val string, cfg *config.Config) (*driver.C
 		Value: val,
 	}
 
-	r, err := client.Client.TranslateVar(context.Background(), &v)
+	r, err := client.Client.TranslateVar(ctx, &v)
 	if err != nil {
 		return nil, err
 	}
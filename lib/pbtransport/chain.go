@@ -0,0 +1,342 @@
+package transport
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/context"
+)
+
+/*
+HopSeparator separates the hops of a chained transport.  The transport
+name and the location list one entry per hop, so a device reached over
+telnet through a bastion host is configured with
+
+	drivertransport ssh>telnet
+	driverlocation  bastion.example.com:22>10.1.1.5:23
+
+Every hop but the last must be SSH, the last may be SSH or telnet.
+*/
+const HopSeparator = ">"
+
+/*
+HopCredentialFn returns the credentials for an intermediate hop of a
+chain.  Hops are numbered from 1, in the order they are dialed.  Without
+one, the jump hosts are logged in to with the credential callback of the
+device.
+*/
+type HopCredentialFn func(id int64, hop int) (username, password string, err error)
+
+// Chain reaches a device through one or more SSH jump hosts
+type Chain struct {
+	names  []string
+	authcb CredentialFn
+	hopcb  HopCredentialFn
+	final  ClientTransport
+
+	// Guards the connections of the chain, which a cancelled dial closes
+	// from another goroutine
+	mx      sync.Mutex
+	hops    []*ssh.Client
+	pending []net.Conn // Connections not yet owned by a hop or the final transport
+	aborted bool
+}
+
+func NewChain(name, drvSrvName string) (ClientTransport, error) {
+	names := strings.Split(name, HopSeparator)
+	if len(names) < 2 {
+		return nil, errors.New(fmt.Sprintf("Transport chain %q needs at least two hops", name))
+	}
+	for i, n := range names[:len(names)-1] {
+		if n != "ssh" {
+			return nil, errors.New(fmt.Sprintf("Transport chain %q: hop %d is %s, only ssh can be used as a jump host", name, i+1, n))
+		}
+	}
+
+	c := &Chain{names: names}
+	switch names[len(names)-1] {
+	case "ssh":
+		c.final = NewSSH(drvSrvName)
+	case "telnet":
+		c.final = NewTelnet(drvSrvName)
+	default:
+		return nil, NotImplemented(fmt.Sprintf("Transport chain %q: %s can not be tunneled", name, names[len(names)-1]))
+	}
+	return c, nil
+}
+
+// Final returns the transport of the last hop, the one talking to the device
+func (c *Chain) Final() ClientTransport {
+	return c.final
+}
+
+func (c *Chain) SetHopCredentialFn(fn HopCredentialFn) {
+	c.hopcb = fn
+}
+
+func (c *Chain) Dial(id int64, dst string) error {
+	return c.DialContext(context.Background(), id, dst)
+}
+
+func (c *Chain) DialContext(ctx context.Context, id int64, dst string) error {
+	locs := strings.Split(dst, HopSeparator)
+	if len(locs) != len(c.names) {
+		return errors.New(fmt.Sprintf("Location %q does not match transport chain %s", dst, strings.Join(c.names, HopSeparator)))
+	}
+
+	c.mx.Lock()
+	c.aborted = false
+	c.mx.Unlock()
+
+	// Abandon the chain, wherever it is, when ctx is done.  Only the
+	// connections are closed from the watcher, which fails whatever dial
+	// or handshake is blocked on them.  The final transport is closed
+	// here, once dial has returned.
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-ctx.Done():
+			c.abort()
+		case <-stop:
+		}
+	}()
+
+	err := c.dial(ctx, id, locs)
+	close(stop)
+	<-done
+
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		c.final.Close()
+		c.abort()
+		return err
+	}
+	c.mx.Lock()
+	c.pending = nil
+	c.mx.Unlock()
+	return nil
+}
+
+// hold keeps a new connection where a cancellation can close it.  If the
+// dial was abandoned already the connection is closed right away.
+func (c *Chain) hold(conn net.Conn) error {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if c.aborted {
+		conn.Close()
+		return errors.New("Dial abandoned")
+	}
+	c.pending = append(c.pending, conn)
+	return nil
+}
+
+// abort closes every connection of the chain
+func (c *Chain) abort() {
+	c.mx.Lock()
+	c.aborted = true
+	for _, conn := range c.pending {
+		conn.Close()
+	}
+	c.pending = nil
+	c.mx.Unlock()
+	c.closeHops()
+}
+
+func (c *Chain) dial(ctx context.Context, id int64, locs []string) error {
+	var last *ssh.Client
+	for i, loc := range locs[:len(locs)-1] {
+		hop := i + 1
+		addr := withPort(loc, "22")
+
+		config, err := c.hopConfig(id, hop)
+		if err != nil {
+			return err
+		}
+
+		var conn net.Conn
+		if i == 0 {
+			var dialer net.Dialer
+			conn, err = dialer.DialContext(ctx, "tcp", addr)
+		} else {
+			conn, err = last.Dial("tcp", addr)
+		}
+		if err == nil {
+			err = c.hold(conn)
+		}
+		if err != nil {
+			return errors.New(fmt.Sprintf("Hop %d: %s", hop, err.Error()))
+		}
+		sc, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Hop %d: %s", hop, err.Error()))
+		}
+		client := ssh.NewClient(sc, chans, reqs)
+		log.Debug("Device %d: jump host %d at %s connected", id, hop, addr)
+		c.mx.Lock()
+		c.hops = append(c.hops, client)
+		aborted := c.aborted
+		c.mx.Unlock()
+		if aborted {
+			client.Close()
+			return errors.New("Dial abandoned")
+		}
+		last = client
+	}
+
+	port := "22"
+	if _, ok := c.final.(*Telnet); ok {
+		port = "23"
+	}
+	addr := withPort(locs[len(locs)-1], port)
+	conn, err := last.Dial("tcp", addr)
+	if err == nil {
+		err = c.hold(conn)
+	}
+	if err != nil {
+		return err
+	}
+
+	switch t := c.final.(type) {
+	case *SSH:
+		return t.dialConn(id, conn, addr)
+	case *Telnet:
+		return t.dialConn(ctx, id, withDeadlines(conn))
+	}
+	return nil
+}
+
+func (c *Chain) hopConfig(id int64, hop int) (*ssh.ClientConfig, error) {
+	var u, p string
+	var err error
+	switch {
+	case c.hopcb != nil:
+		u, p, err = c.hopcb(id, hop)
+	case c.authcb != nil:
+		u, p, err = c.authcb(id)
+	default:
+		return nil, errors.New("Missing Credential Function, can't continue")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &ssh.ClientConfig{
+		User: u,
+		Auth: []ssh.AuthMethod{
+			ssh.Password(p),
+		},
+	}, nil
+}
+
+func (c *Chain) Read(buf []byte) (int, error) {
+	return c.final.Read(buf)
+}
+
+func (c *Chain) Write(buf []byte) (int, error) {
+	return c.final.Write(buf)
+}
+
+func (c *Chain) Interact(srv io.ReadWriter) {
+	c.final.Interact(srv)
+}
+
+func (c *Chain) SendFile(file string, b []byte) error {
+	return c.final.SendFile(file, b)
+}
+
+func (c *Chain) RecvFile(file string) ([]byte, error) {
+	return c.final.RecvFile(file)
+}
+
+func (c *Chain) ReadContext(ctx context.Context, buf []byte) (int, error) {
+	return ReadContext(ctx, c.final, buf)
+}
+
+func (c *Chain) WriteContext(ctx context.Context, buf []byte) (int, error) {
+	return WriteContext(ctx, c.final, buf)
+}
+
+func (c *Chain) SendFileContext(ctx context.Context, file string, b []byte) error {
+	return SendFileContext(ctx, c.final, file, b)
+}
+
+func (c *Chain) RecvFileContext(ctx context.Context, file string) ([]byte, error) {
+	return RecvFileContext(ctx, c.final, file)
+}
+
+// SetCredentialFn sets the credentials of the device itself.  They are
+// also used for the jump hosts unless SetHopCredentialFn is called.
+func (c *Chain) SetCredentialFn(fn CredentialFn) {
+	c.authcb = fn
+	c.final.SetCredentialFn(fn)
+}
+
+func (c *Chain) InternalAuth() bool {
+	return c.final.InternalAuth()
+}
+
+// Close tears the chain down from the device end
+func (c *Chain) Close() error {
+	err := c.final.Close()
+	c.closeHops()
+	return err
+}
+
+func (c *Chain) closeHops() {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	for i := len(c.hops) - 1; i >= 0; i-- {
+		c.hops[i].Close()
+	}
+	c.hops = nil
+}
+
+func withPort(addr, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(addr, port)
+}
+
+/*
+withDeadlines wraps connections that do not support deadlines, as is the
+case for channels tunneled through SSH, in one that does.  Data is copied
+through an in-memory pipe, closing either end tears down both.
+*/
+func withDeadlines(conn net.Conn) net.Conn {
+	local, remote := net.Pipe()
+	go func() {
+		io.Copy(remote, conn)
+		remote.Close()
+	}()
+	go func() {
+		io.Copy(conn, remote)
+		conn.Close()
+	}()
+	return local
+}
@@ -0,0 +1,92 @@
+package transport
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestChainCancel(t *testing.T) {
+	begin(t, "TestChainCancel")
+	defer end(t, "TestChainCancel")
+
+	// A jump host that accepts connections but never answers the SSH
+	// handshake
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	for _, name := range []string{"ssh>telnet", "ssh>ssh"} {
+		tc, err := NewChain(name, "Test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := tc.(*Chain)
+		c.SetCredentialFn(credentials)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		start := time.Now()
+		err = c.DialContext(ctx, 1, l.Addr().String()+HopSeparator+"device")
+		cancel()
+		if err != context.DeadlineExceeded {
+			t.Errorf("%s: expected the deadline to be exceeded, got %v", name, err)
+		}
+		if time.Since(start) > 2*time.Second {
+			t.Errorf("%s: dial was not abandoned at the deadline", name)
+		}
+		if len(c.hops) != 0 || len(c.pending) != 0 {
+			t.Errorf("%s: connections left open after the dial was abandoned", name)
+		}
+	}
+}
+
+func TestChainNames(t *testing.T) {
+	begin(t, "TestChainNames")
+	defer end(t, "TestChainNames")
+
+	for name, ok := range map[string]bool{
+		"ssh>telnet":     true,
+		"ssh>ssh>telnet": true,
+		"ssh":            false,
+		"telnet>ssh":     false,
+		"ssh>ftp":        false,
+	} {
+		if _, err := NewChain(name, "Test"); (err == nil) != ok {
+			t.Errorf("NewChain(%q): unexpected error %v", name, err)
+		}
+	}
+
+	tc, _ := NewChain("ssh>telnet", "Test")
+	if err := tc.Dial(1, "bastion"); err == nil {
+		t.Errorf("Expected a location with too few hops to be refused")
+	}
+}
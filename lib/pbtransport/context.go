@@ -0,0 +1,130 @@
+package transport
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"golang.org/x/net/context"
+)
+
+/*
+ContextTransport is implemented by transports that honour context
+deadlines and cancellation natively.  Callers should not use it directly,
+but go through DialContext, ReadContext, etc, which fall back to a generic
+implementation for transports that only implement ClientTransport.
+*/
+type ContextTransport interface {
+	DialContext(context.Context, int64, string) error
+	ReadContext(context.Context, []byte) (int, error)
+	WriteContext(context.Context, []byte) (int, error)
+	SendFileContext(context.Context, string, []byte) error
+	RecvFileContext(context.Context, string) ([]byte, error)
+}
+
+/*
+DialContext connects t to dst, giving up when ctx is done.
+
+For transports without native context support, the call is run in the
+background and abandoned when ctx is done.  The transport is closed in
+that case, so a late connection is not leaked and a blocked Read or Write
+returns; the transport must be dialed again before further use.  The
+same applies to the other *Context functions.
+*/
+func DialContext(ctx context.Context, t ClientTransport, id int64, dst string) error {
+	if ct, ok := t.(ContextTransport); ok {
+		return ct.DialContext(ctx, id, dst)
+	}
+	return withContext(ctx, t, func() result {
+		return result{err: t.Dial(id, dst)}
+	}).err
+}
+
+func ReadContext(ctx context.Context, t ClientTransport, buf []byte) (int, error) {
+	if ct, ok := t.(ContextTransport); ok {
+		return ct.ReadContext(ctx, buf)
+	}
+	r := withContext(ctx, t, func() result {
+		n, err := t.Read(buf)
+		return result{n: n, err: err}
+	})
+	return r.n, r.err
+}
+
+func WriteContext(ctx context.Context, t ClientTransport, buf []byte) (int, error) {
+	if ct, ok := t.(ContextTransport); ok {
+		return ct.WriteContext(ctx, buf)
+	}
+	r := withContext(ctx, t, func() result {
+		n, err := t.Write(buf)
+		return result{n: n, err: err}
+	})
+	return r.n, r.err
+}
+
+func SendFileContext(ctx context.Context, t ClientTransport, name string, data []byte) error {
+	if ct, ok := t.(ContextTransport); ok {
+		return ct.SendFileContext(ctx, name, data)
+	}
+	return withContext(ctx, t, func() result {
+		return result{err: t.SendFile(name, data)}
+	}).err
+}
+
+func RecvFileContext(ctx context.Context, t ClientTransport, name string) ([]byte, error) {
+	if ct, ok := t.(ContextTransport); ok {
+		return ct.RecvFileContext(ctx, name)
+	}
+	r := withContext(ctx, t, func() result {
+		data, err := t.RecvFile(name)
+		return result{data: data, err: err}
+	})
+	return r.data, r.err
+}
+
+// result carries what an operation run by withContext returned.  It is
+// handed over on a channel, so an abandoned operation that completes late
+// has nowhere shared to write to.
+type result struct {
+	n    int
+	data []byte
+	err  error
+}
+
+func withContext(ctx context.Context, t ClientTransport, fn func() result) result {
+	if err := ctx.Err(); err != nil {
+		return result{err: err}
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		done <- fn()
+	}()
+
+	select {
+	case r := <-done:
+		return r
+	case <-ctx.Done():
+		log.Debug("Abandoning transport operation: %s", ctx.Err().Error())
+		t.Close()
+		// The operation may still complete (a dial in progress, for
+		// instance), so close again once it has
+		go func() {
+			<-done
+			t.Close()
+		}()
+		return result{err: ctx.Err()}
+	}
+}
@@ -0,0 +1,150 @@
+package transport
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// blockingTransport only implements ClientTransport.  Its Read and Dial
+// block until it is closed.
+type blockingTransport struct {
+	NullTransport
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newBlockingTransport() *blockingTransport {
+	return &blockingTransport{closed: make(chan struct{})}
+}
+
+func (b *blockingTransport) Dial(id int64, dst string) error {
+	<-b.closed
+	return errors.New("closed")
+}
+
+func (b *blockingTransport) Read(buf []byte) (int, error) {
+	<-b.closed
+	return 0, errors.New("closed")
+}
+
+func (b *blockingTransport) Write(buf []byte) (int, error) {
+	return len(buf), nil
+}
+
+func (b *blockingTransport) Close() error {
+	b.once.Do(func() { close(b.closed) })
+	return nil
+}
+
+func (b *blockingTransport) isClosed() bool {
+	select {
+	case <-b.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestContextFallback(t *testing.T) {
+	begin(t, "TestContextFallback")
+	defer end(t, "TestContextFallback")
+
+	// An operation that completes in time leaves the transport open
+	b := newBlockingTransport()
+	if n, err := WriteContext(context.Background(), b, []byte("abc")); n != 3 || err != nil {
+		t.Errorf("Expected 3 bytes written, got %d, %v", n, err)
+	}
+	if b.isClosed() {
+		t.Errorf("Transport closed after a successful write")
+	}
+
+	// A blocked one is abandoned when the context expires, and the
+	// transport closed
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := ReadContext(ctx, b, make([]byte, 8)); err != context.DeadlineExceeded {
+		t.Errorf("Expected the deadline to be exceeded, got %v", err)
+	}
+	if !b.isClosed() {
+		t.Errorf("Transport left open after an abandoned read")
+	}
+
+	// Nothing is started on a context that is already done
+	b = newBlockingTransport()
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if err := DialContext(ctx, b, 1, "device"); err != context.Canceled {
+		t.Errorf("Expected the dial to be cancelled, got %v", err)
+	}
+	for _, err := range []error{
+		SendFileContext(ctx, b, "f", nil),
+		func() error { _, err := RecvFileContext(ctx, b, "f"); return err }(),
+	} {
+		if err != context.Canceled {
+			t.Errorf("Expected the transfer to be cancelled, got %v", err)
+		}
+	}
+}
+
+func TestTelnetContext(t *testing.T) {
+	begin(t, "TestTelnetContext")
+	defer end(t, "TestTelnetContext")
+
+	dev, cli := newScriptedDevice()
+	defer dev.conn.Close()
+	tn := &Telnet{connection: newTelnetConn(cli)}
+	buf := make([]byte, 16)
+
+	// A read with nothing to read gives up at the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	if _, err := ReadContext(ctx, tn, buf); err != context.DeadlineExceeded {
+		t.Errorf("Expected the deadline to be exceeded, got %v", err)
+	}
+	cancel()
+
+	// A cancellation arriving after the read returned does not poison the
+	// connection for the reads that follow
+	for i := 0; i < 20; i++ {
+		ctx, cancel = context.WithCancel(context.Background())
+		dev.play([2]string{"", "x"})
+		if _, err := ReadContext(ctx, tn, buf); err != nil {
+			t.Fatalf("Read %d: %v", i, err)
+		}
+		cancel()
+	}
+	dev.play([2]string{"", "y"})
+	if n, err := tn.Read(buf); err != nil || string(buf[:n]) != "y" {
+		t.Errorf("Expected to read on after a late cancellation, got %q, %v", buf[:n], err)
+	}
+
+	// A cancelled write is interrupted
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	dev.conn.Close()
+	if _, err := WriteContext(ctx, tn, []byte("z")); err == nil {
+		t.Errorf("Expected the write to a closed device to fail")
+	}
+}
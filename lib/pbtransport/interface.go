@@ -19,6 +19,7 @@ package transport
 import (
 	"errors"
 	"io"
+	"strings"
 )
 
 type CredentialFn func(id int64) (username, password string, err error)
@@ -42,3 +43,23 @@ type ErrNotImplemented struct {
 func NotImplemented(msg string) ErrNotImplemented {
 	return ErrNotImplemented{error: errors.New(msg)}
 }
+
+type ErrAuthFailed struct {
+	error
+}
+
+func AuthFailed(msg string) ErrAuthFailed {
+	return ErrAuthFailed{error: errors.New(msg)}
+}
+
+// ParsePromptList splits a comma separated list of prompts, as stored in a
+// device config item, into its entries
+func ParsePromptList(s string) []string {
+	var prompts []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			prompts = append(prompts, p)
+		}
+	}
+	return prompts
+}
@@ -22,6 +22,7 @@ import (
 	"errors"
 	"golang.org/x/crypto/ssh"
 	"io"
+	"net"
 )
 
 func init() {
@@ -41,33 +42,56 @@ func NewSSH(drvSrvName string) ClientTransport {
 }
 
 func (s *SSH) Dial(id int64, dst string) error {
-
-	// Make sure we have username and password
-	if s.authcb == nil {
-		return errors.New("Missing Credential Function, can't continue")
+	config, err := s.clientConfig(id)
+	if err != nil {
+		return err
 	}
 
-	u, p, err := s.authcb(id)
+	client, err := ssh.Dial("tcp", dst, config)
 	if err != nil {
 		return err
 	}
 
-	config := &ssh.ClientConfig{
-		User: u,
-		Auth: []ssh.AuthMethod{
-			ssh.Password(p),
-		},
+	s.connection = client
+	return nil
+}
+
+// dialConn runs the SSH handshake over an already established connection,
+// such as a channel tunneled through a jump host
+func (s *SSH) dialConn(id int64, conn net.Conn, addr string) error {
+	config, err := s.clientConfig(id)
+	if err != nil {
+		return err
 	}
 
-	client, err := ssh.Dial("tcp", dst, config)
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
 	if err != nil {
 		return err
 	}
 
-	s.connection = client
+	s.connection = ssh.NewClient(c, chans, reqs)
 	return nil
 }
 
+func (s *SSH) clientConfig(id int64) (*ssh.ClientConfig, error) {
+	// Make sure we have username and password
+	if s.authcb == nil {
+		return nil, errors.New("Missing Credential Function, can't continue")
+	}
+
+	u, p, err := s.authcb(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ssh.ClientConfig{
+		User: u,
+		Auth: []ssh.AuthMethod{
+			ssh.Password(p),
+		},
+	}, nil
+}
+
 /*
 The semantics of Read and write break with the built in SSH transport
 As such, they shall be treated as follows:
@@ -121,6 +145,9 @@ func (s *SSH) Write(buf []byte) (int, error) {
 }
 
 func (s *SSH) Close() error {
+	if s.connection == nil {
+		return nil
+	}
 	return s.connection.Conn.Close()
 }
 
@@ -18,11 +18,14 @@ package transport
 
 import (
 	logging "github.com/iti/pbconf/lib/pblogger"
-	telnet "github.com/ziutek/telnet"
 
 	"fmt"
 	"io"
+	"net"
 	"strings"
+	"time"
+
+	"golang.org/x/net/context"
 )
 
 var log logging.Logger
@@ -31,42 +34,234 @@ func init() {
 	log, _ = logging.GetLogger("Telnet Transport")
 }
 
+/*
+TelnetPrompts describes how the telnet transport recognises the stages of
+a login.  Login and Password are matched against the end of the received
+text.  Success is optional; when one of its entries ends the text
+received after the password is sent the login is considered complete
+without waiting for Timeout to expire.  Failure is looked for anywhere in
+that text, but only when no Success prompt ended it, so a banner such as
+"Last failed login" before the shell prompt is not taken for a rejection.
+*/
+type TelnetPrompts struct {
+	Login    []string
+	Password []string
+	Success  []string
+	Failure  []string
+	Timeout  time.Duration
+}
+
+// DefaultTelnetPrompts returns prompts suitable for most unix-like devices
+func DefaultTelnetPrompts() TelnetPrompts {
+	return TelnetPrompts{
+		Login:    []string{"login:", "username:", "user name:", "user:"},
+		Password: []string{"password:"},
+		Success:  []string{"$", "#", ">"},
+		Failure:  []string{"incorrect", "invalid", "denied", "failed"},
+		Timeout:  5 * time.Second,
+	}
+}
+
+/*
+TelnetPromptsFromConfig builds login prompts from device config items,
+falling back to the defaults for any item that is not set.  The items
+are named after the subsystem using the transport, for instance
+driverloginprompt, driverpasswordprompt, driversuccessprompt,
+driverfailureprompt and driverlogintimeout.  Prompt lists are comma
+separated, the timeout is a duration string.
+*/
+func TelnetPromptsFromConfig(get func(key string) (string, bool), subsys string) TelnetPrompts {
+	p := DefaultTelnetPrompts()
+	if v, ok := get(subsys + "loginprompt"); ok {
+		p.Login = ParsePromptList(v)
+	}
+	if v, ok := get(subsys + "passwordprompt"); ok {
+		p.Password = ParsePromptList(v)
+	}
+	if v, ok := get(subsys + "successprompt"); ok {
+		p.Success = ParsePromptList(v)
+	}
+	if v, ok := get(subsys + "failureprompt"); ok {
+		p.Failure = ParsePromptList(v)
+	}
+	if v, ok := get(subsys + "logintimeout"); ok {
+		if d, err := time.ParseDuration(v); err == nil {
+			p.Timeout = d
+		} else {
+			log.Warning("Ignoring bad %slogintimeout %q: %s", subsys, v, err.Error())
+		}
+	}
+	return p
+}
+
+// How long to wait for the TCP connection to a device, unless set with
+// SetDialTimeout
+const DefaultTelnetDialTimeout = 10 * time.Second
+
 type Telnet struct {
-	connection *telnet.Conn
+	connection  *telnetConn
+	authcb      CredentialFn
+	prompts     TelnetPrompts
+	dialTimeout time.Duration
+
+	// Data received during login that the caller has not read yet
+	pending []byte
 }
 
 func NewTelnet(drvSrvName string) ClientTransport {
 	ll := logging.GetLevel(drvSrvName)
 	log, _ = logging.GetLogger(drvSrvName + ":Telnet Transport")
 	logging.SetLevel(ll, drvSrvName+":Telnet Transport")
-	return new(Telnet)
+	return &Telnet{prompts: DefaultTelnetPrompts(), dialTimeout: DefaultTelnetDialTimeout}
 }
 
 func (t *Telnet) Dial(id int64, dst string) error {
+	return t.DialContext(context.Background(), id, dst)
+}
+
+func (t *Telnet) DialContext(ctx context.Context, id int64, dst string) error {
 	// Check for port
 	if !strings.Contains(dst, ":") {
 		dst = strings.Join([]string{dst, "23"}, ":")
 	}
 
-	tcon, e := telnet.Dial("tcp", dst)
+	dialer := net.Dialer{Timeout: t.dialTimeout}
+	if dl, ok := ctx.Deadline(); ok {
+		dialer.Deadline = dl
+	}
+	tcon, e := dialer.Dial("tcp", dst)
 	if e != nil {
 		return e
 	}
-	t.connection = tcon
+	return t.dialConn(ctx, id, tcon)
+}
+
+// dialConn starts a telnet session, logging in if needed, over an already
+// established connection
+func (t *Telnet) dialConn(ctx context.Context, id int64, tcon net.Conn) error {
+	t.connection = newTelnetConn(tcon)
+
+	if t.authcb == nil {
+		return nil
+	}
+
+	stop := t.connection.watch(ctx)
+	e := t.login(ctx, id)
+	stop()
+	if ctx.Err() != nil {
+		e = ctx.Err()
+	}
+	if e != nil {
+		t.connection.Close()
+		return e
+	}
+
+	return nil
+}
+
+/*
+login walks through the device login using the credential callback.  If
+the device never presents a login or password prompt it is assumed not to
+require authentication, and whatever it did send is handed back to the
+caller on the next Read.
+*/
+func (t *Telnet) login(ctx context.Context, id int64) error {
+	u, p, err := t.authcb(id)
+	if err != nil {
+		return err
+	}
+
+	pr := t.prompts
+	prompts := append(append([]string{}, pr.Login...), pr.Password...)
+
+	data, idx, err := t.connection.readUntil(t.loginTimeout(ctx), prompts...)
+	if err != nil {
+		if isTimeout(err) {
+			log.Debug("No login prompt from device %d, assuming no authentication", id)
+			t.pending = data
+			return nil
+		}
+		return err
+	}
 
+	if idx < len(pr.Login) {
+		if _, err = t.connection.Write([]byte(u + "\r\n")); err != nil {
+			return err
+		}
+		if _, _, err = t.connection.readUntil(t.loginTimeout(ctx), pr.Password...); err != nil {
+			if isTimeout(err) {
+				return AuthFailed(fmt.Sprintf("Telnet login to device %d failed: no password prompt after username", id))
+			}
+			return err
+		}
+	}
+
+	if _, err = t.connection.Write([]byte(p + "\r\n")); err != nil {
+		return err
+	}
+
+	// A new login or password prompt means the credentials were rejected
+	outcome := append(append([]string{}, prompts...), pr.Success...)
+	data, idx, err = t.connection.readUntil(t.loginTimeout(ctx), outcome...)
+	if err != nil && !isTimeout(err) {
+		return err
+	}
+	if (idx >= 0 && idx < len(prompts)) || (idx < 0 && matchContains(data, pr.Failure) >= 0) {
+		return AuthFailed(fmt.Sprintf("Telnet login to device %d failed: credentials for %s rejected", id, u))
+	}
+
+	log.Debug("Telnet login to device %d as %s complete", id, u)
+	t.pending = data
 	return nil
 }
 
+// loginTimeout is the time to wait for each login step, shortened when
+// ctx expires first
+func (t *Telnet) loginTimeout(ctx context.Context) time.Duration {
+	timeout := t.prompts.Timeout
+	if dl, ok := ctx.Deadline(); ok {
+		if left := dl.Sub(time.Now()); left < timeout {
+			timeout = left
+		}
+	}
+	return timeout
+}
+
 func (t *Telnet) Read(buf []byte) (int, error) {
+	if len(t.pending) > 0 {
+		n := copy(buf, t.pending)
+		t.pending = t.pending[n:]
+		return n, nil
+	}
 	return t.connection.Read(buf)
 }
 
+func (t *Telnet) ReadContext(ctx context.Context, buf []byte) (int, error) {
+	if len(t.pending) > 0 {
+		return t.Read(buf)
+	}
+	stop := t.connection.watch(ctx)
+	n, err := t.connection.Read(buf)
+	stop()
+	return n, contextError(ctx, err)
+}
+
 func (t *Telnet) Write(buf []byte) (int, error) {
 	return t.connection.Write(buf)
 }
 
+func (t *Telnet) WriteContext(ctx context.Context, buf []byte) (int, error) {
+	stop := t.connection.watch(ctx)
+	n, err := t.connection.Write(buf)
+	stop()
+	return n, contextError(ctx, err)
+}
+
 func (t *Telnet) Close() error {
-	return t.connection.Conn.Close()
+	if t.connection == nil {
+		return nil
+	}
+	return t.connection.Close()
 }
 
 func (t *Telnet) Interact(srv io.ReadWriter) {
@@ -114,7 +309,24 @@ func (t *Telnet) Interact(srv io.ReadWriter) {
 	}
 }
 
-func (t *Telnet) SetCredentialFn(fn CredentialFn) {}
+func (t *Telnet) SetCredentialFn(fn CredentialFn) {
+	t.authcb = fn
+}
+
+// SetPrompts replaces the prompts used to drive the login.  It must be
+// called before Dial.
+func (t *Telnet) SetPrompts(p TelnetPrompts) {
+	if p.Timeout == 0 {
+		p.Timeout = DefaultTelnetPrompts().Timeout
+	}
+	t.prompts = p
+}
+
+// SetDialTimeout sets how long Dial waits for the TCP connection.  The
+// login steps that follow are bounded by the Timeout of the prompts.
+func (t *Telnet) SetDialTimeout(d time.Duration) {
+	t.dialTimeout = d
+}
 
 func (t *Telnet) RecvFile(file string) ([]byte, error) {
 	return nil, NotImplemented("RecvFile not implemented")
@@ -124,6 +336,14 @@ func (t *Telnet) SendFile(file string, b []byte) error {
 	return NotImplemented("SenFile not implemented")
 }
 
+func (t *Telnet) RecvFileContext(ctx context.Context, file string) ([]byte, error) {
+	return t.RecvFile(file)
+}
+
+func (t *Telnet) SendFileContext(ctx context.Context, file string, b []byte) error {
+	return t.SendFile(file, b)
+}
+
 func (t *Telnet) InternalAuth() bool {
-	return false
+	return t.authcb != nil
 }
@@ -0,0 +1,243 @@
+package transport
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func begin(t *testing.T, name string) {
+	fmt.Printf("##################### Begin Transport::%s #####################\n", name)
+}
+
+func end(t *testing.T, name string) {
+	fmt.Printf("###################### End Transport::%s ######################\n", name)
+}
+
+// scriptedDevice is the device end of a telnet session over net.Pipe.
+// Everything the client sends is collected for the test to look at.
+type scriptedDevice struct {
+	conn net.Conn
+	mx   sync.Mutex
+	got  bytes.Buffer
+}
+
+func newScriptedDevice() (*scriptedDevice, net.Conn) {
+	srv, cli := net.Pipe()
+	d := &scriptedDevice{conn: srv}
+	go func() {
+		buf := make([]byte, 256)
+		for {
+			n, err := srv.Read(buf)
+			d.mx.Lock()
+			d.got.Write(buf[:n])
+			d.mx.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return d, cli
+}
+
+func (d *scriptedDevice) received() string {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	return d.got.String()
+}
+
+// waitFor waits until the client has sent s
+func (d *scriptedDevice) waitFor(s string) bool {
+	for i := 0; i < 200; i++ {
+		if strings.Contains(d.received(), s) {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+// play sends each step to the client, first waiting for the client to have
+// sent what the step expects
+func (d *scriptedDevice) play(steps ...[2]string) {
+	go func() {
+		for _, s := range steps {
+			if s[0] != "" && !d.waitFor(s[0]) {
+				return
+			}
+			if _, err := d.conn.Write([]byte(s[1])); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+func credentials(id int64) (string, string, error) {
+	return "admin", "secret", nil
+}
+
+func testTelnet() *Telnet {
+	t := &Telnet{authcb: credentials}
+	p := DefaultTelnetPrompts()
+	p.Timeout = 500 * time.Millisecond
+	t.SetPrompts(p)
+	return t
+}
+
+func TestTelnetNegotiation(t *testing.T) {
+	begin(t, "TestTelnetNegotiation")
+	defer end(t, "TestTelnetNegotiation")
+
+	dev, cli := newScriptedDevice()
+	defer dev.conn.Close()
+	c := newTelnetConn(cli)
+
+	dev.play([2]string{"", string([]byte{
+		tnIAC, tnDO, tnOptTType,
+		tnIAC, tnWILL, tnOptEcho,
+		tnIAC, tnDO, 99,
+		tnIAC, tnSB, tnOptTType, tnTTypeSEND, tnIAC, tnSE,
+		'o', 'k', tnIAC, tnIAC, '\r', 0, '\n',
+	})})
+
+	buf := make([]byte, 64)
+	var data []byte
+	for len(data) < 5 {
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, buf[:n]...)
+	}
+	if want := []byte{'o', 'k', tnIAC, '\r', '\n'}; !bytes.Equal(data, want) {
+		t.Errorf("Expected data %v, got %v", want, data)
+	}
+
+	for _, want := range [][]byte{
+		{tnIAC, tnWILL, tnOptTType},
+		{tnIAC, tnDO, tnOptEcho},
+		{tnIAC, tnWONT, 99},
+		append(append([]byte{tnIAC, tnSB, tnOptTType, tnTTypeIS}, tnTerminalType...), tnIAC, tnSE),
+	} {
+		if !dev.waitFor(string(want)) {
+			t.Errorf("Expected the client to answer %v, got %v", want, []byte(dev.received()))
+		}
+	}
+
+	// A repeated request does not start a negotiation loop
+	before := dev.received()
+	dev.play([2]string{"", string([]byte{tnIAC, tnWILL, tnOptEcho, 'x'})})
+	if _, err := c.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	if dev.received() != before {
+		t.Errorf("Answered an option already agreed on")
+	}
+
+	// IAC bytes in data are escaped
+	if _, err := c.Write([]byte{'a', tnIAC, 'b'}); err != nil {
+		t.Fatal(err)
+	}
+	if !dev.waitFor(string([]byte{'a', tnIAC, tnIAC, 'b'})) {
+		t.Errorf("IAC in data was not escaped")
+	}
+}
+
+func TestTelnetLogin(t *testing.T) {
+	begin(t, "TestTelnetLogin")
+	defer end(t, "TestTelnetLogin")
+
+	tn := testTelnet()
+	dev, cli := newScriptedDevice()
+	defer dev.conn.Close()
+	dev.play(
+		[2]string{"", "Welcome\r\nLast login: yesterday\r\nlogin: "},
+		[2]string{"admin\r\n", "Password: "},
+		[2]string{"secret\r\n", "\r\nrelay> "},
+	)
+	if err := tn.dialConn(context.Background(), 1, cli); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	n, err := tn.Read(buf)
+	if err != nil || !strings.Contains(string(buf[:n]), "relay>") {
+		t.Errorf("Expected the prompt after login, got %q, %v", buf[:n], err)
+	}
+}
+
+func TestTelnetLoginFailedBanner(t *testing.T) {
+	begin(t, "TestTelnetLoginFailedBanner")
+	defer end(t, "TestTelnetLoginFailedBanner")
+
+	tn := testTelnet()
+	dev, cli := newScriptedDevice()
+	defer dev.conn.Close()
+	dev.play(
+		[2]string{"", "login: "},
+		[2]string{"admin\r\n", "Password: "},
+		[2]string{"secret\r\n", "\r\nLast failed login: Mon Jun  4 09:12:01 on ttyS0\r\n" +
+			"There was 1 failed login attempt since the last successful login.\r\n[admin@relay ~]$ "},
+	)
+	if err := tn.dialConn(context.Background(), 1, cli); err != nil {
+		t.Fatalf("Expected the login to succeed, got %v", err)
+	}
+}
+
+func TestTelnetLoginRejected(t *testing.T) {
+	begin(t, "TestTelnetLoginRejected")
+	defer end(t, "TestTelnetLoginRejected")
+
+	for _, reply := range []string{"\r\nLogin incorrect\r\n", "\r\nlogin: "} {
+		tn := testTelnet()
+		dev, cli := newScriptedDevice()
+		dev.play(
+			[2]string{"", "login: "},
+			[2]string{"admin\r\n", "Password: "},
+			[2]string{"secret\r\n", reply},
+		)
+		err := tn.dialConn(context.Background(), 1, cli)
+		if _, ok := err.(ErrAuthFailed); !ok {
+			t.Errorf("Reply %q: expected an authentication failure, got %v", reply, err)
+		}
+		dev.conn.Close()
+	}
+}
+
+func TestTelnetNoLogin(t *testing.T) {
+	begin(t, "TestTelnetNoLogin")
+	defer end(t, "TestTelnetNoLogin")
+
+	tn := testTelnet()
+	dev, cli := newScriptedDevice()
+	defer dev.conn.Close()
+	dev.play([2]string{"", "=>"})
+	if err := tn.dialConn(context.Background(), 1, cli); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	if n, err := tn.Read(buf); err != nil || string(buf[:n]) != "=>" {
+		t.Errorf("Expected what the device sent before the timeout, got %q, %v", buf[:n], err)
+	}
+}
@@ -0,0 +1,385 @@
+package transport
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Telnet commands (RFC 854)
+const (
+	tnSE   = 240
+	tnSB   = 250
+	tnWILL = 251
+	tnWONT = 252
+	tnDO   = 253
+	tnDONT = 254
+	tnIAC  = 255
+)
+
+// Telnet options we know how to talk about
+const (
+	tnOptBinary = 0
+	tnOptEcho   = 1
+	tnOptSGA    = 3
+	tnOptTType  = 24
+	tnOptNAWS   = 31
+)
+
+// Sub-negotiation verbs (RFC 1091)
+const (
+	tnTTypeIS   = 0
+	tnTTypeSEND = 1
+)
+
+// Values reported to the server when asked
+const (
+	tnTerminalType = "VT100"
+	tnWidth        = 80
+	tnHeight       = 24
+)
+
+// Options we are willing to have the remote side perform (answer to WILL)
+var tnRemoteOK = map[byte]bool{
+	tnOptBinary: true,
+	tnOptEcho:   true,
+	tnOptSGA:    true,
+}
+
+// Options we are willing to perform ourselves (answer to DO)
+var tnLocalOK = map[byte]bool{
+	tnOptBinary: true,
+	tnOptSGA:    true,
+	tnOptTType:  true,
+	tnOptNAWS:   true,
+}
+
+type tnState int
+
+const (
+	tnStData tnState = iota
+	tnStIAC
+	tnStOpt
+	tnStSB
+	tnStSBIAC
+	tnStCR
+)
+
+/*
+telnetConn implements the NVT side of a telnet session on top of a plain
+TCP connection.  All option negotiation is handled internally, so Read
+only ever returns data bytes, and Write escapes IAC bytes in the outgoing
+stream.  The parser state is kept on the struct so a read deadline can
+expire in the middle of a command without losing track of the stream.
+*/
+type telnetConn struct {
+	conn net.Conn
+
+	wmx sync.Mutex
+
+	state tnState
+	cmd   byte
+	sb    []byte
+
+	local  map[byte]bool
+	remote map[byte]bool
+}
+
+func newTelnetConn(c net.Conn) *telnetConn {
+	return &telnetConn{
+		conn:   c,
+		local:  make(map[byte]bool),
+		remote: make(map[byte]bool),
+	}
+}
+
+func (c *telnetConn) Read(buf []byte) (int, error) {
+	raw := make([]byte, len(buf))
+	for {
+		n, err := c.conn.Read(raw)
+		out := c.filter(raw[:n], buf[:0])
+		if len(out) > 0 || err != nil {
+			return len(out), err
+		}
+	}
+}
+
+func (c *telnetConn) Write(buf []byte) (int, error) {
+	esc := bytes.Replace(buf, []byte{tnIAC}, []byte{tnIAC, tnIAC}, -1)
+	c.wmx.Lock()
+	defer c.wmx.Unlock()
+	if _, err := c.conn.Write(esc); err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+func (c *telnetConn) Close() error {
+	return c.conn.Close()
+}
+
+/*
+watch applies the deadline of ctx to the connection and interrupts any
+blocked Read or Write when ctx is cancelled.  The returned function must
+be called once the guarded operation completes; it waits for the watcher
+to finish, so a late cancellation cannot touch the connection afterwards,
+then clears the deadline.
+*/
+func (c *telnetConn) watch(ctx context.Context) func() {
+	if dl, ok := ctx.Deadline(); ok {
+		c.conn.SetDeadline(dl)
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-ctx.Done():
+			c.conn.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+		c.conn.SetDeadline(time.Time{})
+	}
+}
+
+/*
+contextError returns the error of ctx in place of err when ctx ended the
+operation.  The connection deadline set by watch is the deadline of ctx,
+and can pass a moment before ctx reports it expired, so a timeout under a
+deadline waits for ctx to catch up.
+*/
+func contextError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := ctx.Deadline(); ok && isTimeout(err) {
+		<-ctx.Done()
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// filter strips telnet commands from in, answering any negotiation, and
+// appends the remaining data bytes to out.
+func (c *telnetConn) filter(in, out []byte) []byte {
+	for _, b := range in {
+		switch c.state {
+		case tnStData:
+			switch b {
+			case tnIAC:
+				c.state = tnStIAC
+			case '\r':
+				out = append(out, b)
+				c.state = tnStCR
+			default:
+				out = append(out, b)
+			}
+		case tnStCR:
+			// CR NUL is a bare carriage return
+			c.state = tnStData
+			if b == 0 {
+				continue
+			}
+			if b == tnIAC {
+				c.state = tnStIAC
+				continue
+			}
+			out = append(out, b)
+		case tnStIAC:
+			switch b {
+			case tnIAC:
+				out = append(out, b)
+				c.state = tnStData
+			case tnWILL, tnWONT, tnDO, tnDONT:
+				c.cmd = b
+				c.state = tnStOpt
+			case tnSB:
+				c.sb = c.sb[:0]
+				c.state = tnStSB
+			default:
+				// NOP, GA, AYT and friends carry no data
+				c.state = tnStData
+			}
+		case tnStOpt:
+			c.negotiate(c.cmd, b)
+			c.state = tnStData
+		case tnStSB:
+			if b == tnIAC {
+				c.state = tnStSBIAC
+				continue
+			}
+			c.sb = append(c.sb, b)
+		case tnStSBIAC:
+			switch b {
+			case tnSE:
+				c.subnegotiate(c.sb)
+				c.state = tnStData
+			case tnIAC:
+				c.sb = append(c.sb, b)
+				c.state = tnStSB
+			default:
+				// Malformed sub-negotiation, drop it
+				c.state = tnStData
+			}
+		}
+	}
+	return out
+}
+
+// negotiate answers a single option request.  Replies are only sent when
+// the option state actually changes, which prevents negotiation loops.
+func (c *telnetConn) negotiate(cmd, opt byte) {
+	switch cmd {
+	case tnWILL:
+		if !tnRemoteOK[opt] {
+			c.sendCmd(tnDONT, opt)
+			return
+		}
+		if !c.remote[opt] {
+			c.remote[opt] = true
+			c.sendCmd(tnDO, opt)
+		}
+	case tnWONT:
+		if c.remote[opt] {
+			c.remote[opt] = false
+			c.sendCmd(tnDONT, opt)
+		}
+	case tnDO:
+		if !tnLocalOK[opt] {
+			c.sendCmd(tnWONT, opt)
+			return
+		}
+		if !c.local[opt] {
+			c.local[opt] = true
+			c.sendCmd(tnWILL, opt)
+		}
+		if opt == tnOptNAWS {
+			c.sendNAWS()
+		}
+	case tnDONT:
+		if c.local[opt] {
+			c.local[opt] = false
+			c.sendCmd(tnWONT, opt)
+		}
+	}
+}
+
+func (c *telnetConn) subnegotiate(sb []byte) {
+	if len(sb) < 2 {
+		return
+	}
+	switch sb[0] {
+	case tnOptTType:
+		if sb[1] == tnTTypeSEND && c.local[tnOptTType] {
+			msg := []byte{tnIAC, tnSB, tnOptTType, tnTTypeIS}
+			msg = append(msg, tnTerminalType...)
+			msg = append(msg, tnIAC, tnSE)
+			c.sendRaw(msg)
+		}
+	default:
+		log.Debug("Ignoring telnet sub-negotiation for option %d", sb[0])
+	}
+}
+
+func (c *telnetConn) sendNAWS() {
+	c.sendRaw([]byte{tnIAC, tnSB, tnOptNAWS,
+		0, tnWidth, 0, tnHeight,
+		tnIAC, tnSE})
+}
+
+func (c *telnetConn) sendCmd(cmd, opt byte) {
+	c.sendRaw([]byte{tnIAC, cmd, opt})
+}
+
+func (c *telnetConn) sendRaw(b []byte) {
+	c.wmx.Lock()
+	defer c.wmx.Unlock()
+	if _, err := c.conn.Write(b); err != nil {
+		log.Debug("Telnet negotiation write failed: %s", err.Error())
+	}
+}
+
+/*
+readUntil reads from the connection until the received data, ignoring
+trailing white space, ends with one of delims.  Matching is case
+insensitive and is only attempted at the end of each read from the
+socket, so text such as "Last login: ..." in the middle of a banner does
+not look like a prompt.  The index of the matching delimiter is returned, or
+-1 with the error that stopped the read (a net.Error with Timeout() set
+when the timeout expires).  Everything read is returned either way.
+*/
+func (c *telnetConn) readUntil(timeout time.Duration, delims ...string) ([]byte, int, error) {
+	if err := c.conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, -1, err
+	}
+	defer c.conn.SetReadDeadline(time.Time{})
+
+	var data []byte
+	buf := make([]byte, 1024)
+	for {
+		n, err := c.Read(buf)
+		data = append(data, buf[:n]...)
+		if idx := matchSuffix(data, delims); idx >= 0 {
+			return data, idx, nil
+		}
+		if err != nil {
+			return data, -1, err
+		}
+	}
+}
+
+func matchSuffix(data []byte, delims []string) int {
+	s := strings.ToLower(strings.TrimRight(string(data), " \t\r\n"))
+	for i, d := range delims {
+		d = strings.ToLower(strings.TrimRight(d, " \t\r\n"))
+		if d != "" && strings.HasSuffix(s, d) {
+			return i
+		}
+	}
+	return -1
+}
+
+func matchContains(data []byte, needles []string) int {
+	s := strings.ToLower(string(data))
+	for i, n := range needles {
+		if n != "" && strings.Contains(s, strings.ToLower(n)) {
+			return i
+		}
+	}
+	return -1
+}
+
+func isTimeout(err error) bool {
+	if ne, ok := err.(net.Error); ok {
+		return ne.Timeout()
+	}
+	return false
+}
@@ -19,11 +19,14 @@ package transport
 import (
 	"errors"
 	"fmt"
+	"strings"
 )
 
 func GetTransport(name, drvSrvName string) (ClientTransport, error) {
 	switch {
 	// Add additional transports as they are defined
+	case strings.Contains(name, HopSeparator):
+		return NewChain(name, drvSrvName)
 	case name == "telnet":
 		return NewTelnet(drvSrvName), nil
 	case name == "ssh":
@@ -0,0 +1,60 @@
+package webhook
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Subscription that does not make sense
+type InvalidError struct {
+	error
+}
+
+func NewInvalidError(msg string) error {
+	return InvalidError{
+		error: errors.New(msg),
+	}
+}
+
+// Unknown subscription or delivery
+type NotFoundError struct {
+	error
+}
+
+func NewNotFoundError(kind, name string) error {
+	return NotFoundError{
+		error: errors.New(fmt.Sprintf("%s %s not found", kind, name)),
+	}
+}
+
+func IsInvalidError(e error) bool {
+	switch e.(type) {
+	case InvalidError:
+		return true
+	}
+	return false
+}
+
+func IsNotFoundError(e error) bool {
+	switch e.(type) {
+	case NotFoundError:
+		return true
+	}
+	return false
+}
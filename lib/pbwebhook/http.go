@@ -0,0 +1,195 @@
+package webhook
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"encoding/json"
+	"net/http"
+
+	mux "github.com/gorilla/mux"
+	database "github.com/iti/pbconf/lib/pbdatabase"
+	global "github.com/iti/pbconf/lib/pbglobal"
+	logging "github.com/iti/pbconf/lib/pblogger"
+)
+
+type APIHandler struct {
+	log        logging.Logger
+	db         database.AppDatabase
+	dispatcher *Dispatcher
+	Version    int
+}
+
+func NewAPIHandler(loglevel string, d database.AppDatabase) *APIHandler {
+	l, _ := logging.GetLogger("Webhook API")
+	logging.SetLevel(loglevel, "Webhook API")
+	return &APIHandler{log: l, db: d, dispatcher: Get(), Version: 1}
+}
+
+func (a *APIHandler) AddAPIEndpoints(router *mux.Router) {
+	a.log.Info("Registering webhook endpoints")
+
+	for _, v := range global.ApiUrlVersioning {
+		router.HandleFunc(v+"/webhooks", a.handleBaseRoute).Methods("GET", "POST")
+
+		s := router.PathPrefix(v + "/webhooks").Subrouter()
+		s.HandleFunc("/", a.handleBaseRoute).Methods("GET", "POST")
+		s.HandleFunc("/deliveries", a.handleDeliveriesRoute).Methods("GET")
+		s.HandleFunc("/deliveries/{id}", a.handleDeliveryRoute).Methods("GET", "POST")
+		s.HandleFunc("/{name}", a.handleWIdRoute).Methods("GET", "DELETE")
+	}
+}
+
+func (a *APIHandler) GetInfo() (string, int) {
+	return "webhooks", a.Version
+}
+
+func (a *APIHandler) checkVersion(writer http.ResponseWriter, req *http.Request) *logging.ResponseLogger {
+	//deal with any version in the URL or Accept header
+	version, err := global.ProcessVersioning(req)
+	if err != nil {
+		a.log.Debug("Versioning: %s", err.Error())
+		writer.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	if version != nil && *version > a.Version {
+		a.log.Debug("Version %v not implemented, current version is %v", *version, a.Version)
+		writer.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	return &logging.ResponseLogger{
+		ResponseWriter: writer,
+		Logger:         a.log,
+		SrcNodeName:    global.RootNode,
+	}
+}
+
+// handleBaseRoute lists the subscriptions, or adds one
+func (a *APIHandler) handleBaseRoute(writer http.ResponseWriter, req *http.Request) {
+	resp := a.checkVersion(writer, req)
+	if resp == nil {
+		return
+	}
+
+	if req.Method == "GET" {
+		subs := a.dispatcher.Subscriptions()
+		for i := range subs {
+			subs[i].Secret = ""
+		}
+		a.writeJSON(resp, "GET /webhooks", subs)
+		return
+	}
+
+	var s Subscription
+	if err := json.NewDecoder(req.Body).Decode(&s); err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Notice", "POST /webhooks::Decoder error: %s", err.Error())
+		return
+	}
+	if err := a.dispatcher.SetSubscription(s); err != nil {
+		a.writeError(resp, "POST /webhooks", err)
+		return
+	}
+	a.log.Notice("POST /webhooks::Subscription %s set", s.Name)
+	resp.WriteHeader(http.StatusOK)
+}
+
+func (a *APIHandler) handleWIdRoute(writer http.ResponseWriter, req *http.Request) {
+	resp := a.checkVersion(writer, req)
+	if resp == nil {
+		return
+	}
+	route := req.Method + " /webhooks/{name}"
+	name := mux.Vars(req)["name"]
+
+	if req.Method == "GET" {
+		s, err := a.dispatcher.GetSubscription(name)
+		if err != nil {
+			a.writeError(resp, route, err)
+			return
+		}
+		s.Secret = ""
+		a.writeJSON(resp, route, s)
+		return
+	}
+
+	if err := a.dispatcher.RemoveSubscription(name); err != nil {
+		a.writeError(resp, route, err)
+		return
+	}
+	a.log.Notice("%s::Subscription %s removed", route, name)
+	resp.WriteHeader(http.StatusOK)
+}
+
+// handleDeliveriesRoute is the delivery log, newest first.  The
+// subscription and status query parameters narrow it down.
+func (a *APIHandler) handleDeliveriesRoute(writer http.ResponseWriter, req *http.Request) {
+	resp := a.checkVersion(writer, req)
+	if resp == nil {
+		return
+	}
+
+	query := req.URL.Query()
+	a.writeJSON(resp, "GET /webhooks/deliveries", a.dispatcher.Deliveries(query.Get("subscription"), query.Get("status")))
+}
+
+// handleDeliveryRoute shows a delivery, or sends one that failed again
+func (a *APIHandler) handleDeliveryRoute(writer http.ResponseWriter, req *http.Request) {
+	resp := a.checkVersion(writer, req)
+	if resp == nil {
+		return
+	}
+	route := req.Method + " /webhooks/deliveries/{id}"
+	id := mux.Vars(req)["id"]
+
+	if req.Method == "GET" {
+		dl, err := a.dispatcher.GetDelivery(id)
+		if err != nil {
+			a.writeError(resp, route, err)
+			return
+		}
+		a.writeJSON(resp, route, dl)
+		return
+	}
+
+	if err := a.dispatcher.Redeliver(id); err != nil {
+		a.writeError(resp, route, err)
+		return
+	}
+	a.log.Notice("%s::Delivery %s queued again", route, id)
+	resp.WriteHeader(http.StatusAccepted)
+}
+
+func (a *APIHandler) writeJSON(resp *logging.ResponseLogger, route string, v interface{}) {
+	jsonStr, err := json.Marshal(v)
+	if err != nil {
+		resp.WriteLog(http.StatusInternalServerError, "Notice", "%s::Could not marshal the response Error: %s", route, err.Error())
+		return
+	}
+	if _, err = resp.Write(jsonStr); err != nil {
+		resp.WriteLog(http.StatusBadRequest, "Notice", "%s::Writing response body Error: %s", route, err.Error())
+	}
+}
+
+func (a *APIHandler) writeError(resp *logging.ResponseLogger, route string, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case IsInvalidError(err):
+		status = http.StatusBadRequest
+	case IsNotFoundError(err):
+		status = http.StatusNotFound
+	}
+	resp.WriteLog(status, "Info", "%s::%s", route, err.Error())
+}
@@ -0,0 +1,653 @@
+package webhook
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+/*
+Package webhook posts change management events to HTTP endpoints.
+
+A subscription names the URL to post to, and picks the events it wants by
+repository type, object name and kind of event.  Every event a
+subscription wants becomes a delivery, which is kept in the repo path
+until the endpoint takes it, so deliveries survive a restart of the node.
+A failed delivery is tried again after a backoff that doubles with every
+attempt, and given up after maxAttempts.
+
+Every post is signed with the secret of its subscription: the
+X-PBCONF-Signature header holds "sha256=" and the hex HMAC-SHA256 of the
+body.
+*/
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/twinj/uuid"
+
+	change "github.com/iti/pbconf/lib/pbchange"
+	global "github.com/iti/pbconf/lib/pbglobal"
+	logging "github.com/iti/pbconf/lib/pblogger"
+)
+
+var log logging.Logger
+
+func init() {
+	log, _ = logging.GetLogger("Webhook")
+}
+
+// Files that hold the subscriptions and deliveries, next to the repositories
+const (
+	stateFile    = "webhooks.json"
+	deliveryFile = "webhook-deliveries.json"
+)
+
+// Headers set on every post
+const (
+	SignatureHeader = "X-PBCONF-Signature"
+	EventHeader     = "X-PBCONF-Event"
+	DeliveryHeader  = "X-PBCONF-Delivery"
+)
+
+const (
+	maxAttempts    = 8
+	firstBackoff   = 30 * time.Second
+	maxBackoff     = time.Hour
+	postTimeout    = 30 * time.Second
+	keepDeliveries = 1000 // Finished deliveries kept for the log
+)
+
+// States of a delivery
+const (
+	Pending   = "pending"
+	Delivered = "delivered"
+	Failed    = "failed"
+)
+
+var events = []string{change.EventCommit, change.EventPackReceived, change.EventTransaction, change.EventConflict}
+
+var cmTypes = []change.CMType{change.DEVICE, change.POLICY, change.QUERY, change.REPORT, change.ONTOLOGY, change.WAIVER}
+
+/*
+Subscription posts events to URL.  Types holds repository types such as
+DEVICE or POLICY, Objects holds object name patterns as understood by
+path.Match, and Events holds kinds of event.  An empty list matches
+everything.
+*/
+type Subscription struct {
+	Name    string
+	URL     string
+	Secret  string `json:",omitempty"`
+	Types   []string
+	Objects []string
+	Events  []string
+}
+
+func (s *Subscription) Validate() error {
+	if s.Name == "" {
+		return NewInvalidError("A subscription needs a name")
+	}
+	if s.Name == "deliveries" {
+		return NewInvalidError("A subscription can not be called deliveries")
+	}
+	u, err := url.Parse(s.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return NewInvalidError(fmt.Sprintf("Subscription %s has a bad URL %q", s.Name, s.URL))
+	}
+	if s.Secret == "" {
+		return NewInvalidError(fmt.Sprintf("Subscription %s needs a secret to sign its posts with", s.Name))
+	}
+	for _, t := range s.Types {
+		if !knownType(t) {
+			return NewInvalidError(fmt.Sprintf("Subscription %s has an unknown type %s", s.Name, t))
+		}
+	}
+	for _, p := range s.Objects {
+		if _, err := path.Match(p, ""); err != nil {
+			return NewInvalidError(fmt.Sprintf("Subscription %s has a bad object pattern %q", s.Name, p))
+		}
+	}
+	for _, e := range s.Events {
+		if !contains(events, e) {
+			return NewInvalidError(fmt.Sprintf("Subscription %s has an unknown event %s", s.Name, e))
+		}
+	}
+	return nil
+}
+
+// Wants tells whether the subscription wants the event in p
+func (s *Subscription) Wants(p Payload) bool {
+	if len(s.Types) > 0 && !contains(s.Types, p.Type) {
+		return false
+	}
+	if len(s.Events) > 0 && !contains(s.Events, p.Event) {
+		return false
+	}
+	if len(s.Objects) == 0 {
+		return true
+	}
+	for _, pattern := range s.Objects {
+		for _, o := range p.Objects {
+			if ok, _ := path.Match(pattern, o); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Payload is the body posted for an event
+type Payload struct {
+	Event       string
+	Type        string
+	Node        string
+	Objects     []string         `json:",omitempty"`
+	Commit      string           `json:",omitempty"`
+	Transaction string           `json:",omitempty"`
+	Status      string           `json:",omitempty"`
+	Author      *change.CMAuthor `json:",omitempty"`
+	Message     string           `json:",omitempty"`
+	SrcNode     string           `json:",omitempty"`
+	Time        time.Time
+}
+
+func newPayload(ev change.Event) Payload {
+	return Payload{
+		Event:       ev.Kind,
+		Type:        ev.Type.String(),
+		Node:        global.RootNode,
+		Objects:     ev.Objects,
+		Commit:      ev.Commit,
+		Transaction: ev.Transaction,
+		Status:      ev.Status,
+		Author:      ev.Author,
+		Message:     ev.Message,
+		SrcNode:     ev.SrcNode,
+		Time:        ev.Time,
+	}
+}
+
+// Delivery is a payload on its way to a subscription, and what became of it
+type Delivery struct {
+	ID           string
+	Subscription string
+	Payload      Payload
+	Status       string
+	Attempts     int
+	NextAttempt  time.Time
+	LastStatus   int    `json:",omitempty"`
+	LastError    string `json:",omitempty"`
+	Created      time.Time
+	Updated      time.Time
+}
+
+// Sign returns the signature header value for body
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// backoff is how long to wait after the given number of failed attempts
+func backoff(attempts int) time.Duration {
+	wait := firstBackoff
+	for i := 1; i < attempts && wait < maxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > maxBackoff {
+		wait = maxBackoff
+	}
+	return wait
+}
+
+type state struct {
+	Subscriptions []Subscription
+}
+
+type Dispatcher struct {
+	mx         sync.Mutex
+	runMx      sync.Mutex
+	dir        string
+	subs       map[string]Subscription
+	deliveries []*Delivery
+	kick       chan bool
+
+	// Client posts the deliveries
+	Client *http.Client
+}
+
+var nodeDispatcher *Dispatcher
+var nodeOnce sync.Once
+
+// Get returns the node wide dispatcher, which keeps its state in the repo
+// path of the change management engine and listens to its events
+func Get() *Dispatcher {
+	nodeOnce.Do(func() {
+		dir := ""
+		engine, err := change.GetCMEngine(nil)
+		if err == nil {
+			dir = engine.Repopath
+		} else {
+			log.Warning("No change management engine, webhooks will not be saved: %s", err.Error())
+		}
+		nodeDispatcher = New(dir)
+		if err := nodeDispatcher.load(); err != nil {
+			log.Error("Could not load the webhooks: %s", err.Error())
+		}
+		if engine != nil {
+			engine.RegisterEventListener(nodeDispatcher.Notify)
+		}
+	})
+	return nodeDispatcher
+}
+
+// New returns a dispatcher that keeps its state in dir, or only in memory
+// if dir is empty
+func New(dir string) *Dispatcher {
+	return &Dispatcher{
+		dir:        dir,
+		subs:       make(map[string]Subscription),
+		deliveries: make([]*Delivery, 0),
+		kick:       make(chan bool, 1),
+		Client:     &http.Client{Timeout: postTimeout},
+	}
+}
+
+func (d *Dispatcher) load() error {
+	if d.dir == "" {
+		return nil
+	}
+
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	var st state
+	if err := readJSON(filepath.Join(d.dir, stateFile), &st); err != nil {
+		return err
+	}
+	for _, s := range st.Subscriptions {
+		d.subs[s.Name] = s
+	}
+	return readJSON(filepath.Join(d.dir, deliveryFile), &d.deliveries)
+}
+
+// saveSubscriptions writes the subscriptions out, the caller holds the lock
+func (d *Dispatcher) saveSubscriptions() error {
+	if d.dir == "" {
+		return nil
+	}
+	list := make([]Subscription, 0, len(d.subs))
+	for _, s := range d.subs {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return writeJSON(filepath.Join(d.dir, stateFile), state{Subscriptions: list})
+}
+
+// saveDeliveries drops the oldest finished deliveries beyond
+// keepDeliveries and writes the rest out, the caller holds the lock
+func (d *Dispatcher) saveDeliveries() error {
+	finished := 0
+	for _, dl := range d.deliveries {
+		if dl.Status != Pending {
+			finished++
+		}
+	}
+	if finished > keepDeliveries {
+		kept := make([]*Delivery, 0, len(d.deliveries))
+		for _, dl := range d.deliveries {
+			if dl.Status != Pending && finished > keepDeliveries {
+				finished--
+				continue
+			}
+			kept = append(kept, dl)
+		}
+		d.deliveries = kept
+	}
+
+	if d.dir == "" {
+		return nil
+	}
+	return writeJSON(filepath.Join(d.dir, deliveryFile), d.deliveries)
+}
+
+func readJSON(file string, v interface{}) error {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// writeJSON writes and renames, so a crash never leaves half a file behind
+func writeJSON(file string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// Subscriptions returns the subscriptions sorted by name
+func (d *Dispatcher) Subscriptions() []Subscription {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	list := make([]Subscription, 0, len(d.subs))
+	for _, s := range d.subs {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func (d *Dispatcher) GetSubscription(name string) (Subscription, error) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	s, ok := d.subs[name]
+	if !ok {
+		return s, NewNotFoundError("Subscription", name)
+	}
+	return s, nil
+}
+
+// SetSubscription adds a subscription, or replaces the one of that name
+func (d *Dispatcher) SetSubscription(s Subscription) error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	d.subs[s.Name] = s
+	return d.saveSubscriptions()
+}
+
+// RemoveSubscription deletes a subscription and gives up its pending
+// deliveries
+func (d *Dispatcher) RemoveSubscription(name string) error {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	if _, ok := d.subs[name]; !ok {
+		return NewNotFoundError("Subscription", name)
+	}
+	delete(d.subs, name)
+	if err := d.saveSubscriptions(); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, dl := range d.deliveries {
+		if dl.Subscription == name && dl.Status == Pending {
+			dl.Status = Failed
+			dl.LastError = "Subscription removed"
+			dl.Updated = now
+		}
+	}
+	return d.saveDeliveries()
+}
+
+// Deliveries returns the deliveries, newest first, of one subscription or
+// all of them if subscription is empty, with the given status if not empty
+func (d *Dispatcher) Deliveries(subscription, status string) []Delivery {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	list := make([]Delivery, 0)
+	for i := len(d.deliveries) - 1; i >= 0; i-- {
+		dl := d.deliveries[i]
+		if (subscription == "" || dl.Subscription == subscription) && (status == "" || dl.Status == status) {
+			list = append(list, *dl)
+		}
+	}
+	return list
+}
+
+func (d *Dispatcher) GetDelivery(id string) (Delivery, error) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	for _, dl := range d.deliveries {
+		if dl.ID == id {
+			return *dl, nil
+		}
+	}
+	return Delivery{}, NewNotFoundError("Delivery", id)
+}
+
+// Redeliver sends a delivery that failed again, from its first attempt
+func (d *Dispatcher) Redeliver(id string) error {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	for _, dl := range d.deliveries {
+		if dl.ID != id {
+			continue
+		}
+		if dl.Status != Failed {
+			return NewInvalidError(fmt.Sprintf("Delivery %s is %s", id, dl.Status))
+		}
+		if _, ok := d.subs[dl.Subscription]; !ok {
+			return NewNotFoundError("Subscription", dl.Subscription)
+		}
+		dl.Status = Pending
+		dl.Attempts = 0
+		dl.NextAttempt = time.Now()
+		dl.Updated = dl.NextAttempt
+		d.poke()
+		return d.saveDeliveries()
+	}
+	return NewNotFoundError("Delivery", id)
+}
+
+// Notify queues a delivery of an engine event for every subscription that
+// wants it
+func (d *Dispatcher) Notify(ev change.Event) {
+	p := newPayload(ev)
+
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	uuid.SwitchFormat(uuid.Clean)
+	queued := false
+	for _, s := range d.subs {
+		if !s.Wants(p) {
+			continue
+		}
+		d.deliveries = append(d.deliveries, &Delivery{
+			ID:           uuid.NewV4().String(),
+			Subscription: s.Name,
+			Payload:      p,
+			Status:       Pending,
+			NextAttempt:  p.Time,
+			Created:      p.Time,
+			Updated:      p.Time,
+		})
+		queued = true
+	}
+	if !queued {
+		return
+	}
+	if err := d.saveDeliveries(); err != nil {
+		log.Error("Could not save webhook deliveries: %s", err.Error())
+	}
+	d.poke()
+}
+
+// poke wakes up a started dispatcher
+func (d *Dispatcher) poke() {
+	select {
+	case d.kick <- true:
+	default:
+	}
+}
+
+// Run makes every delivery that is due at now
+func (d *Dispatcher) Run(now time.Time) {
+	d.runMx.Lock()
+	defer d.runMx.Unlock()
+
+	type due struct {
+		id    string
+		event string
+		sub   Subscription
+		body  []byte
+	}
+
+	d.mx.Lock()
+	list := make([]due, 0)
+	for _, dl := range d.deliveries {
+		if dl.Status != Pending || dl.NextAttempt.After(now) {
+			continue
+		}
+		body, err := json.Marshal(dl.Payload)
+		if err != nil {
+			log.Error("Could not marshal delivery %s: %s", dl.ID, err.Error())
+			continue
+		}
+		list = append(list, due{id: dl.ID, event: dl.Payload.Event, sub: d.subs[dl.Subscription], body: body})
+	}
+	d.mx.Unlock()
+
+	for _, x := range list {
+		status, err := d.post(x.id, x.event, x.sub, x.body)
+		d.record(x.id, now, status, err)
+	}
+}
+
+func (d *Dispatcher) post(id, event string, s Subscription, body []byte) (int, error) {
+	req, err := http.NewRequest("POST", s.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, event)
+	req.Header.Set(DeliveryHeader, id)
+	req.Header.Set(SignatureHeader, Sign(s.Secret, body))
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("%s answered %s", s.URL, resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// record notes the outcome of an attempt
+func (d *Dispatcher) record(id string, now time.Time, status int, err error) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	for _, dl := range d.deliveries {
+		if dl.ID != id {
+			continue
+		}
+		dl.Attempts++
+		dl.LastStatus = status
+		dl.Updated = time.Now()
+		switch {
+		case err == nil:
+			dl.Status = Delivered
+			dl.LastError = ""
+		case dl.Attempts >= maxAttempts:
+			dl.Status = Failed
+			dl.LastError = err.Error()
+			log.Warning("Giving up on delivery %s to %s: %s", id, dl.Subscription, err.Error())
+		default:
+			dl.LastError = err.Error()
+			dl.NextAttempt = now.Add(backoff(dl.Attempts))
+			log.Info("Delivery %s to %s failed, trying again at %v: %s", id, dl.Subscription, dl.NextAttempt, err.Error())
+		}
+		break
+	}
+	if err := d.saveDeliveries(); err != nil {
+		log.Error("Could not save webhook deliveries: %s", err.Error())
+	}
+}
+
+/*
+Start makes due deliveries every interval seconds, 10 if not given, and
+right away when an event is queued, until true is sent on the returned
+channel.
+*/
+func (d *Dispatcher) Start(interval ...int) chan bool {
+	every := 10
+	if len(interval) > 0 && interval[0] > 0 {
+		every = interval[0]
+	}
+
+	doneChan := make(chan bool)
+	ticker := time.NewTicker(time.Second * time.Duration(every))
+	go func() {
+		for {
+			select {
+			case t := <-ticker.C:
+				d.Run(t)
+			case <-d.kick:
+				d.Run(time.Now())
+			case <-doneChan:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+	return doneChan
+}
+
+func knownType(t string) bool {
+	for _, c := range cmTypes {
+		if c.String() == t {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
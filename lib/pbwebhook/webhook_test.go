@@ -0,0 +1,231 @@
+package webhook
+
+/***********************************************************************
+   Copyright 2018 Information Trust Institute
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+***********************************************************************/
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	change "github.com/iti/pbconf/lib/pbchange"
+	config "github.com/iti/pbconf/lib/pbconfig"
+)
+
+func begin(t *testing.T, name string) {
+	fmt.Printf("##################### Begin Webhook::%s #####################\n", name)
+}
+
+func end(t *testing.T, name string) {
+	fmt.Printf("###################### End Webhook::%s ######################\n", name)
+}
+
+func checkFatal(t *testing.T, err error) {
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// receiver is an endpoint that fails the first fail posts it gets
+type receiver struct {
+	mx     sync.Mutex
+	fail   int
+	bodies []string
+	bad    int
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	body, _ := ioutil.ReadAll(req.Body)
+	if req.Header.Get(SignatureHeader) != Sign("s3cret", body) {
+		r.bad++
+	}
+	if r.fail > 0 {
+		r.fail--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	r.bodies = append(r.bodies, string(body))
+}
+
+func TestWants(t *testing.T) {
+	begin(t, "TestWants")
+	defer end(t, "TestWants")
+
+	s := Subscription{Name: "relays", URL: "https://soc.example.com/hook", Secret: "s3cret",
+		Types: []string{"DEVICE"}, Objects: []string{"relay*"}, Events: []string{change.EventCommit}}
+	checkFatal(t, s.Validate())
+
+	for _, c := range []struct {
+		p    Payload
+		want bool
+	}{
+		{Payload{Event: change.EventCommit, Type: "DEVICE", Objects: []string{"relay1"}}, true},
+		{Payload{Event: change.EventCommit, Type: "DEVICE", Objects: []string{"meter", "relay2"}}, true},
+		{Payload{Event: change.EventCommit, Type: "DEVICE", Objects: []string{"meter"}}, false},
+		{Payload{Event: change.EventCommit, Type: "POLICY", Objects: []string{"relay1"}}, false},
+		{Payload{Event: change.EventTransaction, Type: "DEVICE", Objects: []string{"relay1"}}, false},
+	} {
+		if s.Wants(c.p) != c.want {
+			t.Errorf("Subscription wants %+v should be %v", c.p, c.want)
+		}
+	}
+
+	for _, s := range []Subscription{
+		{URL: "https://soc.example.com/hook", Secret: "s3cret"},
+		{Name: "deliveries", URL: "https://soc.example.com/hook", Secret: "s3cret"},
+		{Name: "ftp", URL: "ftp://soc.example.com/hook", Secret: "s3cret"},
+		{Name: "open", URL: "https://soc.example.com/hook"},
+		{Name: "types", URL: "https://soc.example.com/hook", Secret: "s3cret", Types: []string{"ROUTER"}},
+		{Name: "events", URL: "https://soc.example.com/hook", Secret: "s3cret", Events: []string{"push"}},
+		{Name: "objects", URL: "https://soc.example.com/hook", Secret: "s3cret", Objects: []string{"[relay"}},
+	} {
+		if err := s.Validate(); !IsInvalidError(err) {
+			t.Errorf("Subscription %+v should not validate: %v", s, err)
+		}
+	}
+}
+
+func TestDelivery(t *testing.T) {
+	begin(t, "TestDelivery")
+	defer end(t, "TestDelivery")
+
+	dir, err := ioutil.TempDir("", "webhook")
+	checkFatal(t, err)
+	defer os.RemoveAll(dir)
+
+	r := &receiver{fail: 1}
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	d := New(dir)
+	checkFatal(t, d.SetSubscription(Subscription{Name: "soc", URL: srv.URL, Secret: "s3cret"}))
+
+	now := time.Now()
+	d.Notify(change.Event{Kind: change.EventCommit, Type: change.DEVICE, Objects: []string{"relay"}, Commit: "abc123", Time: now})
+	d.Run(now)
+
+	list := d.Deliveries("soc", "")
+	if len(list) != 1 || list[0].Status != Pending || list[0].Attempts != 1 || list[0].LastStatus != http.StatusServiceUnavailable {
+		t.Fatalf("Expected a failed first attempt, got %+v", list)
+	}
+	if !list[0].NextAttempt.Equal(now.Add(firstBackoff)) {
+		t.Errorf("Expected the next attempt at %v, got %v", now.Add(firstBackoff), list[0].NextAttempt)
+	}
+
+	// Not due yet
+	d.Run(now.Add(time.Second))
+	if len(r.bodies) != 0 {
+		t.Errorf("Delivered before the backoff ran out")
+	}
+
+	// The deliveries survive a restart
+	d = New(dir)
+	checkFatal(t, d.load())
+	d.Run(now.Add(firstBackoff))
+
+	dl, err := d.GetDelivery(list[0].ID)
+	checkFatal(t, err)
+	if dl.Status != Delivered || dl.Attempts != 2 {
+		t.Errorf("Expected delivery on the second attempt, got %+v", dl)
+	}
+	if len(r.bodies) != 1 || r.bad != 0 {
+		t.Errorf("Expected one correctly signed post, got %v with %d bad signatures", r.bodies, r.bad)
+	}
+}
+
+func TestGiveUp(t *testing.T) {
+	begin(t, "TestGiveUp")
+	defer end(t, "TestGiveUp")
+
+	r := &receiver{fail: maxAttempts}
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	d := New("")
+	checkFatal(t, d.SetSubscription(Subscription{Name: "soc", URL: srv.URL, Secret: "s3cret"}))
+	checkFatal(t, d.SetSubscription(Subscription{Name: "policy", URL: srv.URL, Secret: "s3cret", Types: []string{"POLICY"}}))
+
+	now := time.Now()
+	d.Notify(change.Event{Kind: change.EventTransaction, Type: change.DEVICE, Objects: []string{"relay"}, Status: "COMPLETE", Time: now})
+	for i := 0; i < maxAttempts; i++ {
+		d.Run(now)
+		now = now.Add(maxBackoff)
+	}
+
+	list := d.Deliveries("", "")
+	if len(list) != 1 || list[0].Status != Failed || list[0].Attempts != maxAttempts {
+		t.Fatalf("Expected to give up after %d attempts, got %+v", maxAttempts, list)
+	}
+
+	checkFatal(t, d.Redeliver(list[0].ID))
+	d.Run(time.Now())
+	if dl, _ := d.GetDelivery(list[0].ID); dl.Status != Delivered {
+		t.Errorf("Redelivery failed: %+v", dl)
+	}
+	if err := d.Redeliver(list[0].ID); !IsInvalidError(err) {
+		t.Errorf("Redelivered a delivered delivery: %v", err)
+	}
+}
+
+func TestEngineEvents(t *testing.T) {
+	begin(t, "TestEngineEvents")
+	defer end(t, "TestEngineEvents")
+
+	repopath, err := ioutil.TempDir("", "cmengine")
+	checkFatal(t, err)
+	defer os.RemoveAll(repopath)
+	cfg := new(config.Config)
+	cfg.ChMgmt.RepoPath = repopath
+	engine, err := change.GetCMEngine(cfg)
+	checkFatal(t, err)
+	defer engine.Free()
+
+	d := New("")
+	checkFatal(t, d.SetSubscription(Subscription{Name: "soc", URL: "http://localhost/hook", Secret: "s3cret"}))
+	engine.RegisterEventListener(d.Notify)
+
+	commit := change.NewCMContent("relay")
+	commit.Files["configFile"] = []byte("set service FTP on\n")
+	cd := &change.ChangeData{
+		ObjectType: change.DEVICE,
+		Content:    commit,
+		Author:     &change.CMAuthor{Name: "Larry Bird", Email: "tootall@celtics.net", When: time.Now()},
+	}
+	id, err := engine.BeginTransaction(cd, "Turn on FTP")
+	checkFatal(t, err)
+	cd.TransactionID = id
+	checkFatal(t, engine.FinalizeTransaction(cd))
+
+	list := d.Deliveries("", "")
+	if len(list) != 2 {
+		t.Fatalf("Expected a commit and a transaction, got %+v", list)
+	}
+	tr, c := list[0].Payload, list[1].Payload
+	if c.Event != change.EventCommit || c.Type != "DEVICE" || c.Transaction != id || c.Commit == "" || c.Objects[0] != "relay" {
+		t.Errorf("Unexpected commit payload %+v", c)
+	}
+	if tr.Event != change.EventTransaction || tr.Status != "COMPLETE" || tr.Message != "Turn on FTP" || tr.Objects[0] != "relay" {
+		t.Errorf("Unexpected transaction payload %+v", tr)
+	}
+}
@@ -303,6 +303,8 @@ func handleAuthenticatedRequest(writer http.ResponseWriter, req *http.Request, t
 		writer.WriteHeader(http.StatusForbidden)
 		return
 	}
+	// The API takes the user acting from the token, see auth.Caller
+	req.Header.Set("Authorization", "Bearer "+token.Raw)
 	proxy.ServeHTTP(writer, req)
 }
 